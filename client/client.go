@@ -23,7 +23,10 @@ import (
 	"io/ioutil"
 	rawLog "log"
 	"os"
+	"os/signal"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/getsentry/raven-go"
@@ -34,17 +37,397 @@ import (
 	"github.com/longXboy/lunnel/util"
 	"github.com/longXboy/lunnel/version"
 	"github.com/longXboy/smux"
+	"github.com/pkg/errors"
 	"github.com/satori/go.uuid"
+	"golang.org/x/net/context"
 )
 
 const reconnectInterval = 8
 
-var clientId *uuid.UUID
-var tunnels map[string]msg.Tunnel
-var tunnelsLock sync.Mutex
+// maxMaintenancePage is the size limit of maintenance_page,server drops larger pages as well
+const maxMaintenancePage = 64 << 10
 
-func init() {
-	tunnels = make(map[string]msg.Tunnel, 0)
+// ErrServerExit is returned by Client.Run when server asked the client to exit
+var ErrServerExit = errors.New("server asked client to exit")
+
+// ServerError is returned by Client.Run when server refused the client with an error
+// connecting again can't fix,Code tells what to change
+type ServerError struct {
+	Err *msg.Error
+}
+
+func (e *ServerError) Error() string {
+	return e.Err.Error()
+}
+
+// ExitCode is the exit status of lunnelCli stopped by the error,
+// 3 for auth failures,4 for unsupported encryption,5 for tunnels the server refused
+// 6 for a client id in use by another client and 7 for a client to upgrade
+func (e *ServerError) ExitCode() int {
+	switch e.Err.Code {
+	case msg.ErrCodeAuthFailed:
+		return 3
+	case msg.ErrCodeUnsupportedEncryption:
+		return 4
+	case msg.ErrCodeInvalidTunnel, msg.ErrCodeUnsupportedFeature:
+		return 5
+	case msg.ErrCodeDuplicateClient:
+		return 6
+	case msg.ErrCodeClientTooOld:
+		return 7
+	}
+	return 1
+}
+
+// nextEncryptMode is the encrypt_fallback after the current encrypt mode,skipping the modes
+// server doesn't advertise.empty if none is left
+func (cli *Client) nextEncryptMode() string {
+	modes := append([]string{cli.conf.EncryptMode}, cli.conf.EncryptFallback...)
+	i := 0
+	for i < len(modes) && modes[i] != cli.encryptMode {
+		i++
+	}
+	for _, mode := range modes[i+1:] {
+		if cli.capabilities == nil || cli.capabilities.HasEncryptMode(mode) {
+			return mode
+		}
+	}
+	return ""
+}
+
+// handleServerError stops Run if reconnecting can't get past serverErr,
+// it reports whether the client was stopped
+func (cli *Client) handleServerError(serverErr *msg.Error) bool {
+	if serverErr.Code.Retryable() {
+		return false
+	}
+	cli.shutdown(&ServerError{Err: serverErr})
+	return true
+}
+
+const (
+	EventConnected        = "connected"
+	EventDisconnected     = "disconnected"
+	EventTunnelRegistered = "tunnel_registered"
+	EventTunnelRemoved    = "tunnel_removed"
+	EventNotice           = "notice"
+)
+
+type Event struct {
+	Type string
+	// Tunnel is set for tunnel events
+	Tunnel TunnelStatus
+	// Notice is set for notice events
+	Notice *msg.Notice `json:",omitempty"`
+	Time   time.Time
+}
+
+// Client keeps tunnels registered to server,reconnecting when the control connection is lost
+type Client struct {
+	conf     Config
+	clientId *uuid.UUID
+	//handed out by server to take over the tunnels on reconnecting,kept in memory only
+	resumeToken string
+
+	// tunnelsLock guards tunnels,configTunnels,registered,activeCtl and inspectors
+	tunnelsLock sync.Mutex
+	tunnels     map[string]msg.Tunnel
+	// configTunnels are the tunnels defined by the config file last loaded
+	configTunnels map[string]msg.Tunnel
+	// registered are the tunnels as assigned by server
+	registered map[string]msg.Tunnel
+	// activeCtl is the control connected to server currently
+	activeCtl *Control
+	// inspectors record the http exchanges of the tunnels with inspect configured
+	inspectors map[string]*inspector
+	// maintenance is sent again after reconnecting,nil if not in maintenance
+	maintenance *msg.Maintenance
+	// tlsSessions keeps the session tickets of server across reconnections
+	tlsSessions tls.ClientSessionCache
+	// capabilities were advertised by server the last time,nil if unknown.only the Run loop uses it
+	capabilities *msg.Capabilities
+	// encryptMode is encrypt_mode or the fallback it was downgraded to,only the Run loop uses it
+	encryptMode string
+	// dialStats are reported to server over every control
+	dialStats dialStats
+	// reverseConns are the connections server dialed in the reverse mode,nil if not in it
+	reverseConns chan reverseAccept
+
+	events  chan Event
+	stop    context.CancelFunc
+	exitErr error
+	// systemd is told the connection state,only for the client run by Serve
+	systemd bool
+}
+
+// New creates a client from conf,the defaults are filled as the config file does.
+// the manage api is only served if ManagePort is set
+func New(conf Config) (*Client, error) {
+	err := conf.normalize()
+	if err != nil {
+		return nil, err
+	}
+	return newClient(conf)
+}
+
+func newClient(conf Config) (*Client, error) {
+	tunnels, err := buildTunnels(conf.Tunnels)
+	if err != nil {
+		return nil, err
+	}
+	cli := &Client{
+		conf:          conf,
+		tunnels:       make(map[string]msg.Tunnel, len(tunnels)),
+		configTunnels: tunnels,
+		registered:    make(map[string]msg.Tunnel),
+		events:        make(chan Event, 64),
+		inspectors:    buildInspectors(conf.Tunnels, nil),
+	}
+	if conf.Reverse.Listen != "" {
+		cli.reverseConns = make(chan reverseAccept, reverseBacklog)
+	}
+	if !conf.Tls.DisableResumption {
+		cli.tlsSessions = tls.NewLRUClientSessionCache(4)
+	}
+	for name, tunnel := range tunnels {
+		cli.tunnels[name] = tunnel
+	}
+	cli.clientId, err = loadClientId(conf)
+	if err != nil {
+		return nil, err
+	}
+	return cli, nil
+}
+
+func loadClientId(conf Config) (*uuid.UUID, error) {
+	if conf.ClientId != "" {
+		u, err := uuid.FromString(conf.ClientId)
+		if err != nil {
+			return nil, errors.Wrap(err, "unmarshal client id")
+		}
+		return &u, nil
+	}
+	if !conf.Durable || conf.DurableFile == "" {
+		return nil, nil
+	}
+	idFile, err := os.OpenFile(conf.DurableFile, os.O_RDONLY|os.O_CREATE, os.ModePerm)
+	if err != nil {
+		return nil, errors.Wrapf(err, "open id file %s", conf.DurableFile)
+	}
+	content, err := ioutil.ReadAll(idFile)
+	idFile.Close()
+	if err != nil {
+		return nil, errors.Wrap(err, "read id file content")
+	}
+	if len(content) > 0 {
+		u, err := uuid.FromString(string(content))
+		if err != nil {
+			log.WithFields(log.Fields{"err": err, "content": string(content)}).Warningln("unmarshal uuid failed!")
+			return nil, nil
+		}
+		return &u, nil
+	}
+	return nil, nil
+}
+
+// Events returns the channel of client events,events are dropped if it is not drained in time
+func (cli *Client) Events() <-chan Event {
+	return cli.events
+}
+
+func (cli *Client) emit(eventType string, tunnel TunnelStatus) {
+	cli.emitEvent(Event{Type: eventType, Tunnel: tunnel, Time: time.Now()})
+}
+
+func (cli *Client) emitEvent(ev Event) {
+	cli.runHook(ev)
+	if cli.systemd {
+		notifySystemd(ev)
+	}
+	select {
+	case cli.events <- ev:
+	default:
+	}
+}
+
+// AddTunnel adds or replaces a tunnel,it is registered at once if the client is connected
+func (cli *Client) AddTunnel(name string, tc TunnelConfig) error {
+	tcs := map[string]TunnelConfig{name: tc}
+	err := validateTunnels(tcs, cli.conf.Profiles)
+	if err != nil {
+		return err
+	}
+	built, err := buildTunnels(tcs)
+	if err != nil {
+		return err
+	}
+	cli.tunnelsLock.Lock()
+	defer cli.tunnelsLock.Unlock()
+	cli.tunnels[name] = built[name]
+	older := make(map[string]*inspector)
+	if ins, isok := cli.inspectors[name]; isok {
+		older[name] = ins
+	}
+	inspectors := buildInspectors(tcs, older)
+	if ins, isok := inspectors[name]; isok {
+		cli.inspectors[name] = ins
+	} else {
+		delete(cli.inspectors, name)
+	}
+	cli.sendLocked(msg.TypeAddTunnels, msg.AddTunnels{Tunnels: built})
+	return nil
+}
+
+// removeProvisioned forgets the provisioned tunnels server has removed
+func (cli *Client) removeProvisioned(names []string) {
+	var removed []TunnelStatus
+	cli.tunnelsLock.Lock()
+	for _, name := range names {
+		t, isok := cli.tunnels[name]
+		if !isok || !t.Provisioned {
+			continue
+		}
+		delete(cli.tunnels, name)
+		delete(cli.registered, name)
+		removed = append(removed, newTunnelStatus(name, t))
+	}
+	cli.tunnelsLock.Unlock()
+	for _, status := range removed {
+		log.WithFields(log.Fields{"tunnel": status.Name}).Infoln("provisioned tunnel removed by server")
+		cli.emit(EventTunnelRemoved, status)
+	}
+}
+
+// RemoveTunnel removes a tunnel and closes its public address on server
+func (cli *Client) RemoveTunnel(name string) {
+	cli.tunnelsLock.Lock()
+	_, isok := cli.tunnels[name]
+	status := TunnelStatus{Name: name}
+	if t, registered := cli.registered[name]; registered {
+		status = newTunnelStatus(name, t)
+	}
+	delete(cli.tunnels, name)
+	delete(cli.configTunnels, name)
+	delete(cli.registered, name)
+	if ins, isok := cli.inspectors[name]; isok {
+		ins.close()
+		delete(cli.inspectors, name)
+	}
+	if isok {
+		cli.sendLocked(msg.TypeRemoveTunnels, msg.RemoveTunnels{Names: []string{name}})
+	}
+	cli.tunnelsLock.Unlock()
+	if isok {
+		cli.emit(EventTunnelRemoved, status)
+	}
+}
+
+// sendLocked sends msg by the active control,the caller must hold tunnelsLock.
+// if no control is active,tunnels will be sent when connected
+func (cli *Client) sendLocked(mType msg.MsgType, body interface{}) {
+	if cli.activeCtl == nil {
+		return
+	}
+	select {
+	case cli.activeCtl.writeChan <- writeReq{mType, body}:
+	default:
+		// reconnecting registers all tunnels again
+		cli.activeCtl.Close()
+	}
+}
+
+// hasHostTemplates reports whether the host of any tunnel has variables for server to expand
+func (cli *Client) hasHostTemplates() bool {
+	cli.tunnelsLock.Lock()
+	defer cli.tunnelsLock.Unlock()
+	for _, tunnel := range cli.tunnels {
+		if strings.Contains(tunnel.Public.Host, "{") {
+			return true
+		}
+	}
+	return false
+}
+
+// shutdown stops Run with err
+func (cli *Client) shutdown(err error) {
+	cli.tunnelsLock.Lock()
+	cli.exitErr = err
+	stop := cli.stop
+	cli.tunnelsLock.Unlock()
+	if stop != nil {
+		stop()
+	}
+}
+
+// Run connects to server and keeps the tunnels registered until ctx is done
+func (cli *Client) Run(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	cli.tunnelsLock.Lock()
+	cli.stop = cancel
+	cli.exitErr = nil
+	cli.tunnelsLock.Unlock()
+
+	cli.encryptMode = cli.conf.EncryptMode
+	if cli.reverseConns != nil {
+		lis, err := cli.listenReverse()
+		if err != nil {
+			return err
+		}
+		defer lis.Close()
+	}
+	for name, v := range cli.conf.Visitors {
+		lis, err := cli.listenVisitor(name, v)
+		if err != nil {
+			return err
+		}
+		defer lis.Close()
+	}
+	var transportMode string
+	var transportRetry int
+	if cli.conf.Transport == "mix" {
+		transportMode = "kcp"
+	} else {
+		transportMode = cli.conf.Transport
+	}
+	for {
+		start := time.Now()
+		if cli.conf.Transport == "mix" {
+			transportRetry++
+			if transportRetry >= 3 {
+				next := "kcp"
+				if transportMode == "kcp" {
+					next = "tcp"
+				}
+				// don't switch to a transport server doesn't listen in
+				if cli.capabilities == nil || cli.capabilities.HasTransport(next) {
+					transportMode = next
+					log.WithFields(log.Fields{"transport": transportMode}).Infoln("switch to new transport protocol")
+				}
+				transportRetry = 0
+			}
+		}
+		encryptMode := cli.encryptMode
+		cli.dialAndRun(ctx, transportMode)
+		if cli.encryptMode != encryptMode && ctx.Err() == nil {
+			// hello again in the mode downgraded to right away
+			continue
+		}
+		if time.Now().Sub(start) > time.Duration(cli.conf.Health.TimeOut*int64(time.Second)*3) {
+			transportRetry = 0
+		}
+		select {
+		case <-ctx.Done():
+			cli.tunnelsLock.Lock()
+			err := cli.exitErr
+			cli.tunnelsLock.Unlock()
+			if err != nil {
+				return err
+			}
+			return ctx.Err()
+		case <-time.After(cli.reconnectDelay()):
+		}
+	}
 }
 
 func LoadTLSConfig(rootCertPaths []string) (*tls.Config, error) {
@@ -72,55 +455,107 @@ func LoadTLSConfig(rootCertPaths []string) (*tls.Config, error) {
 	return &tls.Config{RootCAs: pool}, nil
 }
 
-func dialAndRun(transportMode string) {
-	defer time.Sleep(time.Duration(time.Second * reconnectInterval))
-	log.WithFields(log.Fields{"addr": cliConf.ServerAddr, "transportMode": transportMode}).Infoln("trying to create control conn to server")
-	conn, err := transport.CreateConn(cliConf.ServerAddr, transportMode, cliConf.HttpProxy)
-	if err != nil {
-		log.WithFields(log.Fields{"server address": cliConf.ServerAddr, "err": err}).Warnln("create ControlAddr conn failed!")
-		return
-	}
-	defer conn.Close()
-	chello := msg.ClientHello{EncryptMode: cliConf.EncryptMode, EnableCompress: cliConf.EnableCompress, Version: version.Version}
-	err = msg.WriteMsg(conn, msg.TypeClientHello, chello)
-	if err != nil {
-		log.WithFields(log.Fields{"server address": cliConf.ServerAddr, "err": err}).Warnln("write ControlClientHello failed!")
-		return
+func (cli *Client) dialAndRun(ctx context.Context, transportMode string) {
+	ctlID := util.NewTraceID()
+	controlLog.WithFields(log.Fields{"ctl_id": ctlID, "addr": cli.conf.ServerAddr, "transportMode": transportMode}).Infoln("trying to create control conn to server")
+	var hello helloResult
+	if cli.reverseConns != nil {
+		hello = cli.reverseHello(ctx, ctlID, transportMode)
+	} else if transportMode == "race" {
+		hello = cli.raceHello(ctlID)
+	} else {
+		hello = cli.hello(ctlID, transportMode)
 	}
-	mType, body, err := msg.ReadMsg(conn)
-	if err != nil {
-		log.WithFields(log.Fields{"server address": cliConf.ServerAddr, "err": err}).Warnln("read server hello failed!")
+	if hello.err != nil {
+		controlLog.WithFields(log.Fields{"ctl_id": ctlID, "server address": cli.conf.ServerAddr, "transport": hello.transport, "err": hello.err}).Warnln("client hello to server failed!")
 		return
 	}
+	conn, mType, body := hello.conn, hello.mType, hello.body
+	transportMode = hello.transport
+	defer conn.Close()
+	var err error
 	if mType == msg.TypeError {
 		serverError := body.(*msg.Error)
-		log.WithFields(log.Fields{"server error": serverError.Error()}).Errorln("client hello failed!")
+		fields := log.Fields{"ctl_id": ctlID, "server error": serverError.Error(), "code": serverError.Code, "detail": serverError.Detail}
+		if serverError.Capabilities != nil {
+			cli.capabilities = serverError.Capabilities
+			fields["server_encrypt_modes"] = serverError.Capabilities.EncryptModes
+			fields["server_transports"] = serverError.Capabilities.Transports
+		}
+		controlLog.WithFields(fields).Errorln("client hello failed!")
+		if serverError.Code == msg.ErrCodeUnsupportedEncryption {
+			if next := cli.nextEncryptMode(); next != "" {
+				controlLog.WithFields(log.Fields{"ctl_id": ctlID, "from": cli.encryptMode, "to": next}).Warningln("encrypt mode refused by server,downgrade to the next encrypt_fallback!")
+				cli.encryptMode = next
+				return
+			}
+		}
+		cli.handleServerError(serverError)
 		return
-	} else if mType == msg.TypeServerHello {
-		log.Debugln("recv msg serer hello success")
+	}
+	var halfClose, flowControl, reportDials, visits bool
+	if mType == msg.TypeServerHello {
+		if body != nil {
+			caps := body.(*msg.ServerHello).Capabilities
+			cli.capabilities = &caps
+			halfClose = caps.HasFeature("halfclose")
+			flowControl = caps.HasFeature("flowcontrol")
+			reportDials = caps.HasFeature("dialstats")
+			visits = caps.HasFeature("visit")
+			if !caps.HasFeature("hosttemplate") && cli.hasHostTemplates() {
+				controlLog.WithFields(log.Fields{"ctl_id": ctlID}).Warningln("server doesn't expand host templates,the hosts are registered as they are")
+			}
+			controlLog.WithFields(log.Fields{"ctl_id": ctlID, "protocol_version": caps.ProtocolVersion, "encrypt_modes": caps.EncryptModes, "transports": caps.Transports, "features": caps.Features}).Debugln("recv msg server hello success")
+		} else {
+			log.Debugln("recv msg serer hello success")
+		}
 	}
 	var underlyingConn io.ReadWriteCloser
-	if cliConf.EncryptMode == "tls" {
-		tlsConfig, err := LoadTLSConfig([]string{cliConf.Tls.TrustedCert})
+	if cli.encryptMode == "tls" {
+		tlsConfig, err := LoadTLSConfig([]string{cli.conf.Tls.TrustedCert})
 		if err != nil {
-			log.WithFields(log.Fields{"trusted cert": cliConf.Tls.TrustedCert, "err": err}).Fatalln("load tls trusted cert failed!")
+			controlLog.WithFields(log.Fields{"ctl_id": ctlID, "trusted cert": cli.conf.Tls.TrustedCert, "err": err}).Errorln("load tls trusted cert failed!")
+			// retrying can't help
+			cli.shutdown(errors.Wrap(err, "load tls trusted cert"))
 			return
 		}
-		tlsConfig.ServerName = cliConf.Tls.ServerName
-		underlyingConn = tls.Client(conn, tlsConfig)
-	} else if cliConf.EncryptMode == "aes" {
-		underlyingConn, err = crypto.NewCryptoStream(conn, []byte(cliConf.Aes.SecretKey))
+		tlsConfig.ServerName = cli.conf.Tls.ServerName
+		tlsConfig.ClientSessionCache = cli.tlsSessions
+		tlsConn := tls.Client(conn, tlsConfig)
+		tlsConn.SetDeadline(time.Now().Add(time.Duration(cli.conf.DialTimeout) * time.Second))
+		err = tlsConn.Handshake()
 		if err != nil {
-			log.WithFields(log.Fields{"err": err}).Errorln("client hello,crypto.NewCryptoConn failed!")
+			tlsConn.Close()
+			controlLog.WithFields(log.Fields{"ctl_id": ctlID, "err": err}).Warnln("tls handshake failed!")
 			return
 		}
-	} else if cliConf.EncryptMode == "none" {
+		tlsConn.SetDeadline(time.Time{})
+		controlLog.WithFields(log.Fields{"ctl_id": ctlID, "resumed": tlsConn.ConnectionState().DidResume}).Debugln("tls handshake success")
+		underlyingConn = tlsConn
+	} else if cli.encryptMode == "aes" {
+		underlyingConn, err = crypto.NewCryptoStream(conn, []byte(cli.conf.Aes.SecretKey))
+		if err != nil {
+			controlLog.WithFields(log.Fields{"ctl_id": ctlID, "err": err}).Errorln("client hello,crypto.NewCryptoConn failed!")
+			return
+		}
+	} else if cli.encryptMode == "noise" {
+		underlyingConn, err = crypto.NoiseClient(conn, cli.conf.Noise.key, func(peer [32]byte) error {
+			if peer != cli.conf.Noise.serverKey {
+				return errors.Errorf("noise server key %s mismatch", crypto.EncodeNoiseKey(peer))
+			}
+			return nil
+		})
+		if err != nil {
+			controlLog.WithFields(log.Fields{"ctl_id": ctlID, "err": err}).Errorln("noise handshake failed!")
+			return
+		}
+	} else if cli.encryptMode == "none" {
 		underlyingConn = conn
 	} else {
-		log.WithFields(log.Fields{"encrypt_mode": cliConf.EncryptMode, "err": "invalid EncryptMode"}).Errorln("client hello failed!")
+		controlLog.WithFields(log.Fields{"ctl_id": ctlID, "encrypt_mode": cli.encryptMode, "err": "invalid EncryptMode"}).Errorln("client hello failed!")
 		return
 	}
-	if cliConf.EnableCompress {
+	if cli.conf.EnableCompress {
 		underlyingConn = transport.NewCompStream(underlyingConn)
 	}
 	smuxConfig := smux.DefaultConfig()
@@ -128,87 +563,110 @@ func dialAndRun(transportMode string) {
 	sess, err := smux.Client(underlyingConn, smuxConfig)
 	if err != nil {
 		underlyingConn.Close()
-		log.WithFields(log.Fields{"err": err}).Warnln("upgrade to smux.Client failed!")
+		controlLog.WithFields(log.Fields{"ctl_id": ctlID, "err": err}).Warnln("upgrade to smux.Client failed!")
 		return
 	}
 	defer sess.Close()
 	stream, err := sess.OpenStream("")
 	if err != nil {
-		log.WithFields(log.Fields{"err": err}).Warnln("sess.OpenStream failed!")
+		controlLog.WithFields(log.Fields{"ctl_id": ctlID, "err": err}).Warnln("sess.OpenStream failed!")
 		return
 	}
 
-	ctl := NewControl(stream, cliConf.EncryptMode, transportMode, tunnels, &tunnelsLock)
+	ctl := NewControl(cli, stream, cli.encryptMode, transportMode)
+	ctl.id = ctlID
+	ctl.halfClose = halfClose
+	ctl.flowControl = flowControl
+	ctl.reportDials = reportDials
+	ctl.visits = visits
+	ctl.pipeTransport = cli.pipeTransport(transportMode)
+	ctl.rtt.observe(hello.rtt)
 	err = ctl.clientHandShake()
 	if err != nil {
-		log.WithFields(log.Fields{"err": err}).Warnln("control.ClientHandShake failed!")
+		controlLog.WithFields(log.Fields{"ctl_id": ctlID, "err": err}).Warnln("control.ClientHandShake failed!")
+		if serverErr, isok := errors.Cause(err).(*msg.Error); isok {
+			cli.handleServerError(serverErr)
+		}
 		return
 	}
-	log.WithFields(log.Fields{"client_id": ctl.ClientID.String(), "version": version.Version}).Infoln("server handshake success!")
+	controlLog.WithFields(log.Fields{"ctl_id": ctlID, "client_id": ctl.ClientID.String(), "version": version.Version}).Infoln("server handshake success!")
+	// hold tunnelsLock so that a changed tunnel is either sent here or by the active control
+	cli.tunnelsLock.Lock()
 	err = ctl.ClientAddTunnels()
+	if err == nil && cli.maintenance != nil {
+		err = msg.WriteMsg(ctl.ctlConn, msg.TypeMaintenance, *cli.maintenance)
+	}
+	if err == nil {
+		cli.activeCtl = ctl
+		cli.registered = make(map[string]msg.Tunnel)
+	}
+	cli.tunnelsLock.Unlock()
 	if err != nil {
-		log.WithFields(log.Fields{"err": err}).Warnln("control.ClientSyncTunnels failed!")
+		controlLog.WithFields(log.Fields{"ctl_id": ctlID, "err": err}).Warnln("control.ClientSyncTunnels failed!")
 		return
 	}
-	ctl.Run()
+	cli.emit(EventConnected, TunnelStatus{})
+	defer func() {
+		cli.tunnelsLock.Lock()
+		cli.activeCtl = nil
+		cli.registered = make(map[string]msg.Tunnel)
+		cli.tunnelsLock.Unlock()
+		cli.emit(EventDisconnected, TunnelStatus{})
+	}()
+	ctl.Run(ctx)
 }
 
-func Main(configDetail []byte, configType string) {
-	err := LoadConfig(configDetail, configType)
-	if err != nil {
-		rawLog.Fatalf("load config failed!err:=%v", err)
-	}
-	if cliConf.LogFile != "" {
-		f, err := os.OpenFile(cliConf.LogFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0660)
+// buildTunnels converts tunnel definitions of config file to tunnel msgs
+func buildTunnels(tcs map[string]TunnelConfig) (map[string]msg.Tunnel, error) {
+	built := make(map[string]msg.Tunnel, len(tcs))
+	for name, tc := range tcs {
+		localSchema, localHost, localPort, err := util.ParseAddr(tc.LocalAddr)
 		if err != nil {
-			rawLog.Fatalf("open log file failed!err:=%v\n", err)
-			return
+			return nil, errors.Wrapf(err, "parse %s local_address", name)
 		}
-		defer f.Close()
-		log.Init(cliConf.Debug, f)
-	} else {
-		log.Init(cliConf.Debug, nil)
-	}
-	raven.SetDSN(cliConf.DSN)
-	if cliConf.ClientId != "" {
-		u, err := uuid.FromString(string(cliConf.ClientId))
-		if err != nil {
-			log.WithFields(log.Fields{"err": err, "cliConf.ClientId": string(cliConf.ClientId)}).Errorln("unmarshal cliConf.ClientId failed!")
-			return
-		} else {
-			clientId = &u
+		var tunnel msg.Tunnel
+		tunnel.HttpHostRewrite = tc.HttpHostRewrite
+		tunnel.Labels = tc.Labels
+		tunnel.HttpAuth = tc.HttpAuth
+		tunnel.AllowIPs = tc.AllowIPs
+		tunnel.DenyIPs = tc.DenyIPs
+		tunnel.RateLimit = tc.RateLimit
+		tunnel.RateBurst = tc.RateBurst
+		tunnel.Transport = tc.Transport
+		tunnel.Psk = tc.Psk
+		tunnel.UrlSecret = tc.UrlSecret
+		tunnel.ByteCap = tc.ByteCap
+		tunnel.Schedule = tc.Schedule
+		tunnel.Timezone = tc.Timezone
+		tunnel.StatusToken = tc.StatusToken
+		tunnel.Cache = tc.Cache
+		tunnel.IdleTimeout = tc.IdleTimeout
+		tunnel.MaxLifetime = tc.MaxLifetime
+		tunnel.Http2 = tc.Http2
+		tunnel.Paths = tc.Paths
+		tunnel.Qos = tc.Qos
+		tunnel.MaxConns = tc.MaxConns
+		if tc.NotFoundPage != "" {
+			page, err := ioutil.ReadFile(tc.NotFoundPage)
+			if err != nil {
+				return nil, errors.Wrapf(err, "read %s not_found_page", name)
+			}
+			tunnel.NotFoundPage = string(page)
 		}
-	} else if cliConf.Durable && cliConf.DurableFile != "" {
-		idFile, err := os.OpenFile(cliConf.DurableFile, os.O_RDONLY|os.O_CREATE, os.ModePerm)
-		if err != nil {
-			rawLog.Fatalf("open log file %s failed!err:=%v\n", cliConf.DurableFile, err)
-			return
+		if tc.PipeEncrypt != nil || tc.PipeCompress != nil {
+			tunnel.Pipe = &msg.PipeOptions{Encrypt: tc.PipeEncrypt, Compress: tc.PipeCompress}
 		}
-		content, err := ioutil.ReadAll(idFile)
-		if err != nil {
-			idFile.Close()
-			rawLog.Fatalf("read id file content failed!err:=%v\n", err)
-		} else {
-			idFile.Close()
+		tunnel.Methods = tc.Methods
+		tunnel.Profile = tc.Profile
+		if tc.KnockSecret != "" {
+			tunnel.Knock = &msg.KnockOptions{Secret: tc.KnockSecret, Ttl: tc.KnockTtl}
 		}
-		if len(content) > 0 {
-			u, err := uuid.FromString(string(content))
-			if err != nil {
-				log.WithFields(log.Fields{"err": err, "content": string(content)}).Warningln("unmarshal uuid failed!")
-			} else {
-				clientId = &u
-			}
+		if tc.TcpNoDelay != nil || tc.TcpKeepAlive != 0 || tc.TcpLinger != nil {
+			tunnel.Tcp = &msg.TcpOptions{NoDelay: tc.TcpNoDelay, KeepAlive: tc.TcpKeepAlive, Linger: tc.TcpLinger}
 		}
-	}
-
-	for name, tc := range cliConf.Tunnels {
-		localSchema, localHost, localPort, err := util.ParseAddr(tc.LocalAddr)
-		if err != nil {
-			log.WithFields(log.Fields{"err": err}).Warnln("util.ParseLocalAddr failed!")
-			return
+		if tc.LocalBindIP != "" || tc.LocalBindInterface != "" || tc.LocalDscp != 0 {
+			tunnel.LocalDial = &msg.LocalDialOptions{BindIP: tc.LocalBindIP, BindInterface: tc.LocalBindInterface, Dscp: tc.LocalDscp}
 		}
-		var tunnel msg.Tunnel
-		tunnel.HttpHostRewrite = tc.HttpHostRewrite
 		tunnel.Local.Schema = localSchema
 		tunnel.Local.Host = localHost
 		tunnel.Local.Port = uint16(localPort)
@@ -218,33 +676,77 @@ func Main(configDetail []byte, configType string) {
 		if tunnel.Public.Host == "" && tunnel.Public.Port == 0 {
 			tunnel.Public.AllowReallocate = true
 		}
-		tunnels[name] = tunnel
+		built[name] = tunnel
 	}
+	return built, nil
+}
 
-	var transportMode string
-	var transportRetry int
-	if cliConf.Transport == "mix" {
-		transportMode = "kcp"
-	} else {
-		transportMode = cliConf.Transport
+// Serve runs the client of the config until ctx is done,it returns the error Client.Run stopped with.
+// systemd is told the client is ready once the tunnels are registered the first time
+func Serve(ctx context.Context, configDetail []byte, configType string) error {
+	err := LoadConfig(configDetail, configType)
+	if err != nil {
+		return errors.Wrap(err, "load config")
 	}
-	for {
-		start := time.Now()
-		if cliConf.Transport == "mix" {
-			transportRetry++
-			if transportRetry >= 3 {
-				if transportMode == "kcp" {
-					transportMode = "tcp"
-				} else {
-					transportMode = "kcp"
-				}
-				transportRetry = 0
-				log.WithFields(log.Fields{"transport": transportMode}).Infoln("switch to new transport protocol")
-			}
-		}
-		dialAndRun(transportMode)
-		if time.Now().Sub(start) > time.Duration(cliConf.Health.TimeOut*int64(time.Second)*3) {
-			transportRetry = 0
+	if cliConf.LogFile != "" {
+		f, err := os.OpenFile(cliConf.LogFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0660)
+		if err != nil {
+			return errors.Wrap(err, "open log file")
 		}
+		defer f.Close()
+		log.Init(cliConf.Debug, f)
+	} else {
+		log.Init(cliConf.Debug, nil)
+	}
+	err = log.SetLevels(cliConf.LogLevels)
+	if err != nil {
+		return errors.Wrap(err, "set log levels")
+	}
+	log.SetSampling(cliConf.LogSampling)
+	err = log.AddSinks(cliConf.Syslog, cliConf.Journald, cliConf.LogFile != "")
+	if err != nil {
+		return errors.Wrap(err, "add log sinks")
+	}
+	raven.SetDSN(cliConf.DSN)
+	cli, err := newClient(cliConf)
+	if err != nil {
+		return errors.Wrap(err, "create client")
+	}
+	go cli.watchReload(configType)
+	cli.systemd = true
+	go util.RunWatchdog(cli.responsive)
+	return cli.Run(ctx)
+}
+
+// ExitStatus is the exit status of lunnelCli for the error Serve returned
+func ExitStatus(err error) int {
+	if err == nil || err == context.Canceled {
+		return 0
+	}
+	if serverErr, isok := err.(*ServerError); isok {
+		return serverErr.ExitCode()
+	}
+	return 1
+}
+
+// Main runs the client of the config until SIGINT or SIGTERM,which is also delivered
+// for the close,logoff and shutdown events of a windows console
+func Main(configDetail []byte, configType string) {
+	ctx, cancel := context.WithCancel(context.Background())
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		s := <-sigChan
+		log.WithFields(log.Fields{"signal": s.String()}).Infoln("got signal to stop")
+		cancel()
+	}()
+	err := Serve(ctx, configDetail, configType)
+	if err == ErrServerExit {
+		os.Exit(1)
+	} else if serverErr, isok := err.(*ServerError); isok {
+		log.WithFields(log.Fields{"err": serverErr.Error(), "code": serverErr.Err.Code, "detail": serverErr.Err.Detail}).Errorln("client stopped by server error!")
+		os.Exit(ExitStatus(err))
+	} else if err != context.Canceled {
+		rawLog.Fatalf("client stopped!err:=%v\n", err)
 	}
 }
@@ -23,34 +23,35 @@ import (
 	"net"
 	"net/http"
 	"os"
-	"os/signal"
+	"strconv"
 	"sync"
 	"sync/atomic"
-	"syscall"
 	"time"
 
 	"github.com/longXboy/lunnel/crypto"
 	"github.com/longXboy/lunnel/log"
 	"github.com/longXboy/lunnel/msg"
 	"github.com/longXboy/lunnel/transport"
+	"github.com/longXboy/lunnel/util"
 	"github.com/longXboy/smux"
 	"github.com/pkg/errors"
 	"github.com/satori/go.uuid"
 	"golang.org/x/net/context"
 )
 
-func NewControl(conn net.Conn, encryptMode string, transport string, tunnels map[string]msg.Tunnel, lock *sync.Mutex) *Control {
+func NewControl(cli *Client, conn net.Conn, encryptMode string, transport string) *Control {
 	ctx, cancel := context.WithCancel(context.Background())
 
 	ctl := &Control{
+		cli:           cli,
 		ctlConn:       conn,
 		writeChan:     make(chan writeReq, 64),
 		encryptMode:   encryptMode,
-		tunnels:       tunnels,
+		tunnels:       cli.tunnels,
 		transportMode: transport,
 		ctx:           ctx,
 		cancel:        cancel,
-		tunnelsLock:   lock,
+		tunnelsLock:   &cli.tunnelsLock,
 	}
 	return ctl
 }
@@ -62,7 +63,10 @@ type writeReq struct {
 
 type Control struct {
 	ClientID uuid.UUID
+	//id of the control connection in the log lines of both sides
+	id string
 
+	cli             *Client
 	ctlConn         net.Conn
 	tunnelsLock     *sync.Mutex
 	tunnels         map[string]msg.Tunnel
@@ -71,6 +75,25 @@ type Control struct {
 	encryptMode     string
 	transportMode   string
 	totalPipes      int64
+	//set once the pipes are warmed up after the first tunnels registered
+	warmOnce sync.Once
+	//pipes failed in a row,the next pipe is delayed exponentially by it
+	pipeFailures int32
+	//server half-closes the streams of tcp tunnels and understands the half-close of client
+	halfClose bool
+	//server paces the streams of pipes by the stream window
+	flowControl bool
+	//transport of the pipes of the tunnels without their own,empty for transportMode
+	pipeTransport string
+	//server understands DialStats,sentDials is the version of the dial stats sent last
+	reportDials bool
+	sentDials   uint64
+	//rtt to server the windows of the pipes are sized by
+	rtt rttTracker
+	//server serves visitors over the visit pipe,which is dialed on the first visit
+	visits    bool
+	visitSess *smux.Session
+	visitLock sync.Mutex
 
 	writeChan chan writeReq
 	cancel    context.CancelFunc
@@ -79,28 +102,44 @@ type Control struct {
 
 func (c *Control) Close() {
 	c.cancel()
-	log.WithField("time", time.Now().UnixNano()).Debugln("control closing")
+	controlLog.WithFields(log.Fields{"ctl_id": c.id, "time": time.Now().UnixNano()}).Debugln("control closing")
 	return
 }
 
-func (c *Control) createPipe() {
-	log.WithFields(log.Fields{"time": time.Now().Unix(), "pipe_count": atomic.LoadInt64(&c.totalPipes)}).Debugln("create pipe to server!")
-	pipeConn, err := transport.CreateConn(cliConf.ServerAddr, c.transportMode, cliConf.HttpProxy)
+// createPipe creates a pipe over transportMode,empty means the transport of the control,
+// options overrides the encryption and compression of the control if not nil
+func (c *Control) createPipe(transportMode string, options *msg.PipeOptions) {
+	if transportMode == "" || c.cli.reverseConns != nil || len(c.cli.conf.Hops) > 0 {
+		// server dials the pipes of the reverse mode in the transport of the control,and hops only relay that
+		transportMode = c.transportMode
+	}
+	if !c.pipeBackoff() {
+		return
+	}
+	pipeLog.WithFields(log.Fields{"ctl_id": c.id, "time": time.Now().Unix(), "pipe_count": atomic.LoadInt64(&c.totalPipes), "transport": transportMode}).Debugln("create pipe to server!")
+	windows := c.pipeWindows()
+	opts := c.cli.conf.dialOptions()
+	opts.KcpSndWnd, opts.KcpRcvWnd = windows.kcpSnd, windows.kcpRcv
+	pipeConn, err := c.dialPipe(transportMode, opts)
 	if err != nil {
-		log.WithFields(log.Fields{"addr": cliConf.ServerAddr, "err": err}).Errorln("creating tunnel conn to server failed!")
+		atomic.AddInt32(&c.pipeFailures, 1)
+		pipeLog.WithFields(log.Fields{"ctl_id": c.id, "addr": c.cli.conf.ServerAddr, "err": err}).Errorln("creating tunnel conn to server failed!")
 		return
 	}
 	defer pipeConn.Close()
 
-	pipe, err := c.pipeHandShake(pipeConn)
+	pipe, pipeID, err := c.pipeHandShake(pipeConn, transportMode, options, windows, false)
 	if err != nil {
-		log.WithFields(log.Fields{"err": err}).Errorln("pipeHandShake failed!")
+		atomic.AddInt32(&c.pipeFailures, 1)
+		pipeLog.WithFields(log.Fields{"ctl_id": c.id, "err": err}).Errorln("pipeHandShake failed!")
 		return
 	}
+	atomic.StoreInt32(&c.pipeFailures, 0)
+	pipeLog.WithFields(log.Fields{"ctl_id": c.id, "pipe_id": pipeID, "transport": transportMode, "rtt": windows.rtt.String(), "receive_buffer": windows.receiveBuffer, "server_receive_buffer": windows.serverReceiveBuffer, "kcp_snd_wnd": windows.kcpSnd, "kcp_rcv_wnd": windows.kcpRcv}).Debugln("pipe handshake success")
 	defer pipe.Close()
 	atomic.AddInt64(&c.totalPipes, 1)
 	defer func() {
-		log.WithFields(log.Fields{"pipe_count": atomic.LoadInt64(&c.totalPipes)}).Debugln("total pipe count")
+		pipeLog.WithFields(log.Fields{"ctl_id": c.id, "pipe_id": pipeID, "pipe_count": atomic.LoadInt64(&c.totalPipes)}).Debugln("total pipe count")
 		atomic.AddInt64(&c.totalPipes, -1)
 	}()
 	for {
@@ -109,20 +148,23 @@ func (c *Control) createPipe() {
 		}
 		stream, err := pipe.AcceptStream()
 		if err != nil {
-			log.WithFields(log.Fields{"err": err, "time": time.Now().Unix(), "client_id": c.ClientID}).Warningln("pipeAcceptStream failed!")
+			pipeLog.WithFields(log.Fields{"ctl_id": c.id, "pipe_id": pipeID, "err": err, "time": time.Now().Unix(), "client_id": c.ClientID}).Warningln("pipeAcceptStream failed!")
 			return
 		}
 		go func() {
 			defer stream.Close()
+			streamID := util.StreamID(pipeID, stream.ID())
 			c.tunnelsLock.Lock()
 			tunnel, isok := c.tunnels[stream.TunnelName()]
+			ins := c.cli.inspectors[stream.TunnelName()]
 			c.tunnelsLock.Unlock()
 			if !isok {
-				log.WithFields(log.Fields{"name": stream.TunnelName()}).Errorln("can't find tunnel by name")
+				pipeLog.WithFields(log.Fields{"ctl_id": c.id, "stream_id": streamID, "name": stream.TunnelName()}).Errorln("can't find tunnel by name")
 				return
 			}
 			var conn net.Conn
 			var port uint16 = tunnel.Local.Port
+			dialStart := time.Now()
 			if tunnel.Local.Schema == "http" || tunnel.Local.Schema == "https" || tunnel.Local.Schema == "tcp" {
 				if tunnel.Local.Port == 0 {
 					if tunnel.Local.Schema == "https" {
@@ -131,68 +173,240 @@ func (c *Control) createPipe() {
 						port = 80
 					}
 				}
-				conn, err = net.Dial("tcp", fmt.Sprintf("%s:%d", tunnel.Local.Host, port))
+				conn, err = c.cli.dialLocal("tcp", net.JoinHostPort(tunnel.Local.Host, strconv.Itoa(int(port))), tunnel.LocalDial)
+				c.cli.dialStats.observe(stream.TunnelName(), time.Since(dialStart), err)
 				if err != nil {
-					log.WithFields(log.Fields{"err": err, "local": tunnel.LocalAddr()}).Warningln("pipe dial local failed!")
+					pipeLog.WithFields(log.Fields{"ctl_id": c.id, "stream_id": streamID, "err": err, "local": tunnel.LocalAddr()}).Warningln("pipe dial local failed!")
 					return
 				}
+				err = transport.ApplyTcpOptions(conn, tunnel.Tcp)
+				if err != nil {
+					pipeLog.WithFields(log.Fields{"ctl_id": c.id, "stream_id": streamID, "err": err, "local": tunnel.LocalAddr()}).Warningln("apply tcp options failed!")
+				}
 				if tunnel.Local.Schema == "https" {
 					conn = tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
 				}
 			} else if tunnel.Local.Schema == "unix" {
 				conn, err = net.Dial("unix", tunnel.Local.Host)
+				c.cli.dialStats.observe(stream.TunnelName(), time.Since(dialStart), err)
 				if err != nil {
-					log.WithFields(log.Fields{"err": err, "local": tunnel.LocalAddr()}).Warningln("pipe dial local failed!")
+					pipeLog.WithFields(log.Fields{"ctl_id": c.id, "stream_id": streamID, "err": err, "local": tunnel.LocalAddr()}).Warningln("pipe dial local failed!")
 					return
 				}
 			} else {
 				if port == 0 {
-					log.WithFields(log.Fields{"err": fmt.Sprintf("no port sepicified"), "local": tunnel.LocalAddr()}).Errorln("dial local addr failed!")
+					pipeLog.WithFields(log.Fields{"ctl_id": c.id, "stream_id": streamID, "err": fmt.Sprintf("no port sepicified"), "local": tunnel.LocalAddr()}).Errorln("dial local addr failed!")
 					return
 				}
-				conn, err = net.Dial(tunnel.Local.Schema, fmt.Sprintf("%s:%d", tunnel.Local.Host, port))
+				conn, err = c.cli.dialLocal(tunnel.Local.Schema, net.JoinHostPort(tunnel.Local.Host, strconv.Itoa(int(port))), tunnel.LocalDial)
+				c.cli.dialStats.observe(stream.TunnelName(), time.Since(dialStart), err)
 				if err != nil {
-					log.WithFields(log.Fields{"err": err, "local": tunnel.LocalAddr()}).Warningln("pipe dial local failed!")
+					pipeLog.WithFields(log.Fields{"ctl_id": c.id, "stream_id": streamID, "err": err, "local": tunnel.LocalAddr()}).Warningln("pipe dial local failed!")
 					return
 				}
 			}
 			defer conn.Close()
-
-			p1die := make(chan struct{})
-			p2die := make(chan struct{})
-
-			go func() {
-				io.Copy(stream, conn)
-				close(p1die)
-			}()
-			go func() {
-				io.Copy(conn, stream)
-				close(p2die)
-			}()
-			select {
-			case <-p1die:
-			case <-p2die:
+			if tunnel.Public.Schema == "udp" {
+				relayDatagrams(stream, conn)
+				return
+			}
+			if ins != nil {
+				ins.relay(stream, conn)
+				return
 			}
+
+			c.relay(stream, conn, streamID)
 		}()
 	}
 }
 
+// relay copies stream to the local conn and back,the EOF of either side is passed on as a half-close
+// and the other direction goes on until it ends too if server supports half-close
+func (c *Control) relay(stream *smux.Stream, conn net.Conn, streamID string) {
+	p1die := make(chan struct{})
+	p2die := make(chan struct{})
+	var upErr, downErr error
+	go func() {
+		_, upErr = io.Copy(stream, conn)
+		if upErr == nil && c.halfClose {
+			stream.CloseWrite()
+		}
+		close(p1die)
+	}()
+	go func() {
+		_, downErr = io.Copy(conn, stream)
+		if downErr == nil && c.halfClose && !stream.IsClosed() {
+			util.CloseWrite(conn)
+		}
+		close(p2die)
+	}()
+	select {
+	case <-p1die:
+		c.copyFailed(streamID, "local to server", upErr)
+		if upErr == nil && c.halfClose {
+			<-p2die
+			c.copyFailed(streamID, "server to local", downErr)
+		}
+	case <-p2die:
+		c.copyFailed(streamID, "server to local", downErr)
+		if downErr == nil && c.halfClose && !stream.IsClosed() {
+			<-p1die
+			c.copyFailed(streamID, "local to server", upErr)
+		}
+	}
+}
+
+// copyFailed logs the error a direction of a relayed stream ended with
+func (c *Control) copyFailed(streamID string, direction string, err error) {
+	if err != nil {
+		pipeLog.WithFields(log.Fields{"ctl_id": c.id, "stream_id": streamID, "direction": direction, "err": err}).Debugln("relay stream copy failed")
+	}
+}
+
+// relayDatagrams copies the framed datagrams of stream to the local udp conn and back
+func relayDatagrams(stream io.ReadWriter, conn net.Conn) {
+	p1die := make(chan struct{})
+	p2die := make(chan struct{})
+	go func() {
+		buf := make([]byte, util.MaxDatagramSize)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				break
+			}
+			err = util.WriteDatagram(stream, buf[:n])
+			if err != nil {
+				break
+			}
+		}
+		close(p1die)
+	}()
+	go func() {
+		buf := make([]byte, util.MaxDatagramSize)
+		for {
+			n, err := util.ReadDatagram(stream, buf)
+			if err != nil {
+				break
+			}
+			_, err = conn.Write(buf[:n])
+			if err != nil {
+				break
+			}
+		}
+		close(p2die)
+	}()
+	select {
+	case <-p1die:
+	case <-p2die:
+	}
+}
+
 func (c *Control) SyncTunnels(cstm *msg.AddTunnels) error {
 	for k, v := range cstm.Tunnels {
 		c.tunnelsLock.Lock()
 		t, isok := c.tunnels[k]
-		if !isok || t.HttpHostRewrite != v.HttpHostRewrite || t.LocalAddr() != v.LocalAddr() || t.Public.Schema != v.Public.Schema {
+		if !isok || t.LocalAddr() != v.LocalAddr() || t.Public.Schema != v.Public.Schema {
 			c.tunnels[k] = v
+		} else {
+			// settings may be changed by server on a live tunnel,keep them for reconnecting
+			t.ApplySettings(v)
+			c.tunnels[k] = t
 		}
+		c.cli.registered[k] = v
 		c.tunnelsLock.Unlock()
-		log.WithFields(log.Fields{"local": v.LocalAddr(), "public": v.PublicAddr()}).Infoln("client sync tunnel complete")
+		controlLog.WithFields(log.Fields{"ctl_id": c.id, "local": v.LocalAddr(), "public": v.PublicAddr()}).Infoln("client sync tunnel complete")
+		c.cli.emit(EventTunnelRegistered, newTunnelStatus(k, v))
 	}
+	c.cli.reportStatus()
+	c.warmOnce.Do(c.warmPipes)
 	return nil
 }
 
+// pipeTransport is the pipe_transport for a control in controlTransport as server can take it,
+// empty for the transport of the control
+func (cli *Client) pipeTransport(controlTransport string) string {
+	pt := cli.conf.PipeTransport
+	if pt == "" || pt == controlTransport {
+		return ""
+	}
+	if cli.capabilities == nil || !cli.capabilities.HasFeature("pipetransport") || !cli.capabilities.HasTransport(pt) {
+		pipeLog.WithFields(log.Fields{"pipe_transport": pt, "transport": controlTransport}).Warningln("server can't take pipe_transport,create pipes in the transport of the control")
+		return ""
+	}
+	return pt
+}
+
+const maxPipeBackoff = time.Second * 30
+
+// pipeBackoff delays the dial of a pipe after failures in a row,doubling from 100ms up to maxPipeBackoff,
+// it reports false if the control is closed meanwhile
+func (c *Control) pipeBackoff() bool {
+	failures := atomic.LoadInt32(&c.pipeFailures)
+	if failures == 0 {
+		return true
+	}
+	delay := maxPipeBackoff
+	if failures < 10 {
+		delay = time.Millisecond * 100 << uint(failures-1)
+		if delay > maxPipeBackoff {
+			delay = maxPipeBackoff
+		}
+	}
+	pipeLog.WithFields(log.Fields{"ctl_id": c.id, "failures": failures, "delay": delay}).Debugln("back off creating pipe")
+	select {
+	case <-time.After(delay):
+		return true
+	case <-c.ctx.Done():
+		return false
+	}
+}
+
+// warmPipes establishes warm_pipes pipes for every kind of pipes the tunnels use,
+// so that the first public connections don't wait for the pipes to be dialed
+func (c *Control) warmPipes() {
+	if c.cli.conf.WarmPipes <= 0 {
+		return
+	}
+	type pipeKind struct {
+		transport string
+		encrypt   bool
+		compress  bool
+	}
+	encrypt, compress := c.encryptMode != "none", c.cli.conf.EnableCompress
+	defaultTransport := c.pipeTransport
+	if defaultTransport == "" {
+		defaultTransport = c.transportMode
+	}
+	kinds := map[pipeKind]*msg.PipeOptions{pipeKind{defaultTransport, encrypt, compress}: nil}
+	c.tunnelsLock.Lock()
+	for _, t := range c.tunnels {
+		kind := pipeKind{transport: t.Transport}
+		if kind.transport == "" {
+			kind.transport = defaultTransport
+		}
+		kind.encrypt, kind.compress = t.Pipe.Resolve(encrypt, compress)
+		if _, isok := kinds[kind]; !isok {
+			kinds[kind] = t.Pipe
+		}
+	}
+	c.tunnelsLock.Unlock()
+	for kind, options := range kinds {
+		for i := 0; i < c.cli.conf.WarmPipes; i++ {
+			go c.createPipe(kind.transport, options)
+		}
+	}
+	pipeLog.WithFields(log.Fields{"ctl_id": c.id, "pipes": c.cli.conf.WarmPipes, "kinds": len(kinds)}).Debugln("warm up pipes")
+}
+
 func (c *Control) ClientAddTunnels() error {
 	cstm := new(msg.AddTunnels)
-	cstm.Tunnels = c.tunnels
+	cstm.Tunnels = make(map[string]msg.Tunnel, len(c.tunnels))
+	for name, tunnel := range c.tunnels {
+		// server assigns the provisioned tunnels again by itself
+		if !tunnel.Provisioned {
+			cstm.Tunnels[name] = tunnel
+		}
+	}
 	err := msg.WriteMsg(c.ctlConn, msg.TypeAddTunnels, *cstm)
 	if err != nil {
 		return errors.Wrap(err, "WriteMsg cstm")
@@ -205,14 +419,15 @@ func (c *Control) recvLoop() {
 	for {
 		mType, body, err := msg.ReadMsgWithoutTimeout(c.ctlConn)
 		if err != nil {
-			log.WithFields(log.Fields{"err": err, "client_id": c.ClientID.String()}).Warningln("ReadMsgWithoutTimeout in recv loop failed")
+			controlLog.WithFields(log.Fields{"ctl_id": c.id, "err": err, "client_id": c.ClientID.String()}).Warningln("ReadMsgWithoutTimeout in recv loop failed")
 			c.Close()
 			return
 		}
-		log.WithFields(log.Fields{"type": mType, "body": body}).Debugln("recv msg")
+		controlLog.WithFields(log.Fields{"ctl_id": c.id, "type": mType, "body": body}).Debugln("recv msg")
 		atomic.StoreUint64(&c.lastRead, uint64(time.Now().UnixNano()))
 		switch mType {
 		case msg.TypePong:
+			c.rtt.ponged()
 			log.Infoln("recv pong")
 		case msg.TypePing:
 			select {
@@ -222,16 +437,36 @@ func (c *Control) recvLoop() {
 				return
 			}
 		case msg.TypePipeReq:
-			go c.createPipe()
+			var req msg.PipeReq
+			if body != nil {
+				req = *body.(*msg.PipeReq)
+			}
+			go c.createPipe(req.Transport, req.Options)
 		case msg.TypeAddTunnels:
 			c.SyncTunnels(body.(*msg.AddTunnels))
+		case msg.TypeRemoveTunnels:
+			c.cli.removeProvisioned(body.(*msg.RemoveTunnels).Names)
 		case msg.TypeError:
-			log.Errorln("recv server error:", body.(*msg.Error).Error())
+			serverErr := body.(*msg.Error)
+			controlLog.WithFields(log.Fields{"ctl_id": c.id, "err": serverErr.Error(), "code": serverErr.Code, "detail": serverErr.Detail}).Errorln("recv server error!")
+			c.Close()
+			c.cli.handleServerError(serverErr)
+			return
+		case msg.TypeNotice:
+			notice := body.(*msg.Notice)
+			if notice.Kind == "busy" {
+				// connections were refused for lack of pipes,get one ready before asked
+				go c.createPipe(c.pipeTransport, nil)
+			}
+			c.cli.handleNotice(notice)
+		case msg.TypeKick:
+			controlLog.WithFields(log.Fields{"ctl_id": c.id, "reason": body.(*msg.Kick).Reason, "client_id": c.ClientID}).Warningln("kicked by server!")
 			c.Close()
 			return
 		case msg.TypeExit:
-			log.WithFields(log.Fields{"type": mType, "client_id": c.ClientID}).Warningln("recv msg to exit!")
-			os.Exit(1)
+			controlLog.WithFields(log.Fields{"ctl_id": c.id, "type": mType, "client_id": c.ClientID}).Warningln("recv msg to exit!")
+			c.Close()
+			c.cli.shutdown(ErrServerExit)
 			return
 		default:
 		}
@@ -244,15 +479,18 @@ func (c *Control) writeLoop() {
 		select {
 		case msgBody := <-c.writeChan:
 			if msgBody.mType == msg.TypePing {
-				if time.Now().Before(lastWrite.Add(time.Duration(cliConf.Health.Interval * int64(time.Second) / 2))) {
+				if time.Now().Before(lastWrite.Add(time.Duration(c.cli.conf.Health.Interval * int64(time.Second) / 2))) {
 					continue
 				}
 			}
-			log.WithFields(log.Fields{"type": msgBody.mType, "body": msgBody.body}).Debugln("ready to send msg")
+			controlLog.WithFields(log.Fields{"ctl_id": c.id, "type": msgBody.mType, "body": msgBody.body}).Debugln("ready to send msg")
 			lastWrite = time.Now()
+			if msgBody.mType == msg.TypePing {
+				c.rtt.pinged()
+			}
 			err := msg.WriteMsg(c.ctlConn, msgBody.mType, msgBody.body)
 			if err != nil {
-				log.WithFields(log.Fields{"mType": msgBody.mType, "body": fmt.Sprintf("%v", msgBody.body), "client_id": c.ClientID.String(), "err": err}).Warningln("send msg to server failed!")
+				controlLog.WithFields(log.Fields{"ctl_id": c.id, "mType": msgBody.mType, "body": fmt.Sprintf("%v", msgBody.body), "client_id": c.ClientID.String(), "err": err}).Warningln("send msg to server failed!")
 				c.Close()
 				return
 			}
@@ -295,37 +533,36 @@ func (c *Control) AddTunnel(w http.ResponseWriter, r *http.Request) {
 func (c *Control) serveHttp(lis net.Listener) {
 	m := http.NewServeMux()
 	m.HandleFunc("/tunnel", c.AddTunnel)
+	m.HandleFunc("/status", c.serveStatus)
+	m.HandleFunc("/maintenance", c.serveMaintenance)
+	m.HandleFunc("/log/levels", log.LevelsHandler)
 	err := http.Serve(lis, m)
-	log.WithFields(log.Fields{"client_id": c.ClientID, "err": err}).Debugln("close http serve")
+	manageLog.WithFields(log.Fields{"ctl_id": c.id, "client_id": c.ClientID, "err": err}).Debugln("close http serve")
 	c.Close()
 }
 
-func (c *Control) Run() {
+func (c *Control) Run(ctx context.Context) {
 	defer c.ctlConn.Close()
 
-	lis, err := net.Listen("tcp", fmt.Sprintf("%s:%d", "0.0.0.0", cliConf.ManagePort))
-	if err != nil {
-		c.Close()
-		log.WithFields(log.Fields{"port": cliConf.ManagePort, "err": err}).Fatalln("listen manage port failed!")
-		return
-	}
-	defer lis.Close()
-
 	go c.recvLoop()
 	go c.writeLoop()
-	go c.serveHttp(lis)
-
-	sigChan := make(chan os.Signal)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGKILL)
-	defer signal.Reset(syscall.SIGINT, syscall.SIGTERM, syscall.SIGKILL)
+	if c.cli.conf.ManagePort != 0 {
+		lis, err := net.Listen("tcp", fmt.Sprintf("%s:%d", "0.0.0.0", c.cli.conf.ManagePort))
+		if err != nil {
+			controlLog.WithFields(log.Fields{"ctl_id": c.id, "port": c.cli.conf.ManagePort, "err": err}).Errorln("listen manage port failed!")
+		} else {
+			defer lis.Close()
+			go c.serveHttp(lis)
+		}
+	}
 
-	ticker := time.NewTicker(time.Duration(cliConf.Health.Interval * int64(time.Second)))
+	ticker := time.NewTicker(time.Duration(c.cli.conf.Health.Interval * int64(time.Second)))
 	defer ticker.Stop()
 	for {
 		select {
 		case <-ticker.C:
-			if (uint64(time.Now().UnixNano()) - atomic.LoadUint64(&c.lastRead)) > uint64(cliConf.Health.TimeOut*int64(time.Second)) {
-				log.WithFields(log.Fields{"client_id": c.ClientID.String()}).Warningln("recv server ping time out!")
+			if (uint64(time.Now().UnixNano()) - atomic.LoadUint64(&c.lastRead)) > uint64(c.cli.conf.Health.TimeOut*int64(time.Second)) {
+				controlLog.WithFields(log.Fields{"ctl_id": c.id, "client_id": c.ClientID.String()}).Warningln("recv server ping time out!")
 				c.Close()
 				return
 			}
@@ -335,16 +572,15 @@ func (c *Control) Run() {
 				c.Close()
 				return
 			}
-		case s := <-sigChan:
-			log.WithFields(log.Fields{"signal": s.String(), "client_id": c.ClientID.String()}).Infoln("got signal to stop")
+			c.reportDialStats()
+		case <-ctx.Done():
 			select {
 			case c.writeChan <- writeReq{msg.TypeExit, nil}:
+				// give writeLoop a chance to tell server
+				time.Sleep(time.Millisecond * 250)
 			default:
-				os.Exit(1)
-				return
 			}
-			time.Sleep(time.Millisecond * 250)
-			os.Exit(1)
+			c.Close()
 			return
 		case <-c.ctx.Done():
 			return
@@ -352,6 +588,24 @@ func (c *Control) Run() {
 	}
 }
 
+// reportDialStats sends the dial stats to server if they changed since sent last
+func (c *Control) reportDialStats() {
+	if !c.reportDials {
+		return
+	}
+	c.tunnelsLock.Lock()
+	stats, version := c.cli.dialStats.snapshot(c.sentDials, c.tunnels)
+	c.tunnelsLock.Unlock()
+	if stats == nil {
+		return
+	}
+	select {
+	case c.writeChan <- writeReq{msg.TypeDialStats, stats}:
+		c.sentDials = version
+	default:
+	}
+}
+
 func (c *Control) clientHandShake() error {
 	var ckem msg.ControlClientHello
 	var priv []byte
@@ -363,9 +617,15 @@ func (c *Control) clientHandShake() error {
 		}
 		ckem.CipherKey = keyMsg
 	}
-	ckem.AuthToken = cliConf.AuthToken
-	if clientId != nil {
-		ckem.ClientID = clientId
+	ckem.AuthToken = c.cli.conf.AuthToken
+	if c.cli.clientId != nil {
+		ckem.ClientID = c.cli.clientId
+		ckem.ResumeToken = c.cli.resumeToken
+	}
+	ckem.PipeTransport = c.pipeTransport
+	ckem.Hostname = c.cli.conf.Hostname
+	if ckem.Hostname == "" {
+		ckem.Hostname, _ = os.Hostname()
 	}
 	err := msg.WriteMsg(c.ctlConn, msg.TypeControlClientHello, ckem)
 	if err != nil {
@@ -381,18 +641,26 @@ func (c *Control) clientHandShake() error {
 		return errors.Wrap(err, "read ClientID")
 	}
 	csh := body.(*msg.ControlServerHello)
+	if ckem.ClientID != nil && *ckem.ClientID != csh.ClientID {
+		controlLog.WithFields(log.Fields{"ctl_id": c.id, "client_id": ckem.ClientID.String(), "new_client_id": csh.ClientID.String()}).Warningln("client id in use by another client,reassigned by server")
+	}
 	c.ClientID = csh.ClientID
+	c.cli.resumeToken = csh.ResumeToken
+	if csh.Resumed {
+		controlLog.WithFields(log.Fields{"ctl_id": c.id, "client_id": csh.ClientID.String()}).Infoln("tunnels resumed by server")
+	}
 
-	clientId = &csh.ClientID
+	clientId := &csh.ClientID
+	c.cli.clientId = clientId
 
-	if cliConf.Durable && cliConf.DurableFile != "" {
-		idFile, err := os.OpenFile(cliConf.DurableFile, os.O_CREATE|os.O_WRONLY, os.ModePerm)
+	if c.cli.conf.Durable && c.cli.conf.DurableFile != "" {
+		idFile, err := os.OpenFile(c.cli.conf.DurableFile, os.O_CREATE|os.O_WRONLY, os.ModePerm)
 		if err != nil {
-			log.WithFields(log.Fields{"err": err, "path": cliConf.DurableFile}).Warningln("open file failed")
+			controlLog.WithFields(log.Fields{"ctl_id": c.id, "err": err, "path": c.cli.conf.DurableFile}).Warningln("open file failed")
 		} else {
 			n, err := idFile.WriteString(clientId.String())
 			if err != nil || n != len(clientId.String()) {
-				log.WithFields(log.Fields{"err": err, "content": clientId.String(), "nwrite": n}).Warningln("write file failed!")
+				controlLog.WithFields(log.Fields{"ctl_id": c.id, "err": err, "content": clientId.String(), "nwrite": n}).Warningln("write file failed!")
 			}
 		}
 		idFile.Close()
@@ -407,35 +675,78 @@ func (c *Control) clientHandShake() error {
 	return nil
 }
 
-func (c *Control) pipeHandShake(conn net.Conn) (*smux.Session, error) {
+// dialPipe connects a pipe conn to server,or waits for server to dial it in the reverse mode
+func (c *Control) dialPipe(transportMode string, opts transport.Options) (net.Conn, error) {
+	if c.cli.reverseConns != nil {
+		return c.reverseDial()
+	}
+	return c.cli.dialServer(transportMode, opts)
+}
+
+// pipeHandShake says hello over the pipe conn and returns the session over it with the id of the pipe,
+// which buffers and asks server to buffer by windows.client opens the streams of a visit pipe
+func (c *Control) pipeHandShake(conn net.Conn, transportMode string, options *msg.PipeOptions, windows pipeWindows, visit bool) (*smux.Session, string, error) {
 	var phs msg.PipeClientHello
+	phs.Visit = visit
 	phs.Once = uuid.NewV4()
 	phs.ClientID = c.ClientID
+	phs.Options = options
+	phs.Transport = transportMode
+	phs.ReceiveBuffer = windows.serverReceiveBuffer
+	if transportMode == "kcp" {
+		phs.KcpWindow = windows.kcpRcv
+	}
+	if c.flowControl && c.cli.conf.StreamWindow > 0 {
+		phs.StreamWindow = c.cli.conf.StreamWindow
+	}
+	if len(c.preMasterSecret) > 0 {
+		phs.Mac = crypto.PipeMac(c.preMasterSecret, phs.MacInput())
+	}
+	conn.SetWriteDeadline(time.Now().Add(time.Duration(c.cli.conf.DialTimeout) * time.Second))
 	err := msg.WriteMsg(conn, msg.TypePipeClientHello, phs)
 	if err != nil {
-		return nil, errors.Wrap(err, "write pipe handshake")
+		return nil, "", errors.Wrap(err, "write pipe handshake")
 	}
+	conn.SetWriteDeadline(time.Time{})
 	smuxConfig := smux.DefaultConfig()
-	smuxConfig.MaxReceiveBuffer = 4194304
+	smuxConfig.MaxReceiveBuffer = windows.receiveBuffer
+	smuxConfig.StreamWindow = phs.StreamWindow
 	var mux *smux.Session
 	var underlyingConn io.ReadWriteCloser
-	if c.encryptMode != "none" {
+	encrypt, compress := options.Resolve(c.encryptMode != "none", c.cli.conf.EnableCompress)
+	if encrypt {
 		prf := crypto.NewPrf12()
 		var masterKey []byte = make([]byte, 16)
 		prf(masterKey, c.preMasterSecret, c.ClientID[:], phs.Once[:])
 		underlyingConn, err = crypto.NewCryptoStream(conn, masterKey)
 		if err != nil {
-			return nil, errors.Wrap(err, "crypto.NewCryptoConn")
+			return nil, "", errors.Wrap(err, "crypto.NewCryptoConn")
 		}
 	} else {
 		underlyingConn = conn
 	}
-	if cliConf.EnableCompress {
+	if compress {
 		underlyingConn = transport.NewCompStream(underlyingConn)
 	}
-	mux, err = smux.Server(underlyingConn, smuxConfig)
+	if visit {
+		mux, err = smux.Client(underlyingConn, smuxConfig)
+	} else {
+		mux, err = smux.Server(underlyingConn, smuxConfig)
+	}
+	if err != nil {
+		return nil, "", errors.Wrap(err, "upgrade pipe to smux")
+	}
+	return mux, util.PipeID(phs.Once), nil
+}
+
+// dialLocal dials the local address of a tunnel with its host resolved by the dns config
+func (cli *Client) dialLocal(network string, addr string, opts *msg.LocalDialOptions) (net.Conn, error) {
+	ipAddr, err := cli.conf.Dns.resolver.ResolveAddr(addr)
 	if err != nil {
-		return nil, errors.Wrap(err, "smux.Server")
+		return nil, errors.Wrap(err, "resolve local address")
+	}
+	if opts == nil {
+		return net.Dial(network, ipAddr)
 	}
-	return mux, nil
+	return transport.Options{BindIP: opts.BindIP, BindInterface: opts.BindInterface, Dscp: opts.Dscp}.Dial(network, ipAddr)
 }
@@ -0,0 +1,73 @@
+// Copyright 2017 longXboy, longxboyhi@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"sync"
+	"time"
+
+	"github.com/longXboy/lunnel/msg"
+)
+
+// dialStats measures the dials of the local address of each tunnel,
+// so that a slow local service can be told apart from a slow tunnel on server
+type dialStats struct {
+	lock    sync.Mutex
+	tunnels map[string]*msg.DialStat
+	//bumped on every dial,a control sends the stats again when it has not sent this version
+	version uint64
+}
+
+func (s *dialStats) observe(tunnel string, d time.Duration, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.tunnels == nil {
+		s.tunnels = make(map[string]*msg.DialStat)
+	}
+	st, isok := s.tunnels[tunnel]
+	if !isok {
+		st = new(msg.DialStat)
+		s.tunnels[tunnel] = st
+	}
+	s.version++
+	if err != nil {
+		st.Failures++
+		return
+	}
+	for i, le := range msg.DialBuckets {
+		if d.Seconds() <= le {
+			st.Buckets[i]++
+			break
+		}
+	}
+	st.Sum += d.Seconds()
+	st.Count++
+}
+
+// snapshot returns the stats of the tunnels in tunnels and their version,nil if sent already
+func (s *dialStats) snapshot(sent uint64, tunnels map[string]msg.Tunnel) (*msg.DialStats, uint64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.version == sent {
+		return nil, sent
+	}
+	stats := &msg.DialStats{Tunnels: make(map[string]msg.DialStat)}
+	for name, st := range s.tunnels {
+		if _, isok := tunnels[name]; isok {
+			stats.Tunnels[name] = *st
+		}
+	}
+	return stats, s.version
+}
@@ -0,0 +1,129 @@
+// Copyright 2017 longXboy, longxboyhi@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/longXboy/lunnel/log"
+	"github.com/longXboy/lunnel/msg"
+	"github.com/pkg/errors"
+)
+
+// hookTimeout is how long a hook command may run before it is killed
+const hookTimeout = time.Second * 30
+
+// Hooks are the commands run on client events,every command gets the event in json
+// on its stdin and LUNNEL_EVENT,LUNNEL_CLIENT_ID in its environment.
+// a command is the path of an executable run without arguments,not a shell line
+type Hooks struct {
+	Connected    string `yaml:"connected,omitempty"`
+	Disconnected string `yaml:"disconnected,omitempty"`
+	//LUNNEL_TUNNEL_NAME,LUNNEL_TUNNEL_SCHEMA,LUNNEL_PUBLIC_URL and LUNNEL_LOCAL are set for tunnel events
+	TunnelRegistered string `yaml:"tunnel_registered,omitempty"`
+	TunnelClosed     string `yaml:"tunnel_closed,omitempty"`
+	//LUNNEL_NOTICE_KIND and LUNNEL_NOTICE_MESSAGE are set
+	Notice string `yaml:"notice,omitempty"`
+}
+
+func (h Hooks) command(eventType string) string {
+	switch eventType {
+	case EventConnected:
+		return h.Connected
+	case EventDisconnected:
+		return h.Disconnected
+	case EventTunnelRegistered:
+		return h.TunnelRegistered
+	case EventTunnelRemoved:
+		return h.TunnelClosed
+	case EventNotice:
+		return h.Notice
+	}
+	return ""
+}
+
+// validate checks the commands of the hooks at loading,a command with spaces which is no executable
+// is refused as it was meant as a shell line.a missing executable is only warned,it may be installed later
+func (h Hooks) validate() error {
+	for _, command := range []string{h.Connected, h.Disconnected, h.TunnelRegistered, h.TunnelClosed, h.Notice} {
+		if command == "" {
+			continue
+		}
+		_, err := exec.LookPath(command)
+		if err == nil {
+			continue
+		}
+		if strings.ContainsAny(command, " \t") {
+			return errors.Errorf("hook %q is not an executable,hooks run the path of an executable without arguments,wrap the arguments in a script", command)
+		}
+		log.WithFields(log.Fields{"command": command, "err": err}).Warningln("hook command not found")
+	}
+	return nil
+}
+
+func hookEnv(clientId string, ev Event) []string {
+	env := []string{"LUNNEL_EVENT=" + ev.Type, "LUNNEL_CLIENT_ID=" + clientId}
+	if ev.Tunnel.Name != "" {
+		env = append(env, "LUNNEL_TUNNEL_NAME="+ev.Tunnel.Name, "LUNNEL_TUNNEL_SCHEMA="+ev.Tunnel.Schema,
+			"LUNNEL_PUBLIC_URL="+ev.Tunnel.PublicURL, "LUNNEL_LOCAL="+ev.Tunnel.Local)
+	}
+	if ev.Notice != nil {
+		env = append(env, "LUNNEL_NOTICE_KIND="+ev.Notice.Kind, "LUNNEL_NOTICE_MESSAGE="+ev.Notice.Message)
+	}
+	return env
+}
+
+// runHook runs the command configured for the event in background,
+// the failures are only logged since hooks must never break the tunnels
+func (cli *Client) runHook(ev Event) {
+	command := cli.conf.Hooks.command(ev.Type)
+	if command == "" {
+		return
+	}
+	var clientId string
+	if cli.clientId != nil {
+		clientId = cli.clientId.String()
+	}
+	env := hookEnv(clientId, ev)
+	stdin, _ := json.Marshal(ev)
+	go func() {
+		cmd := exec.Command(command)
+		cmd.Env = append(os.Environ(), env...)
+		cmd.Stdin = bytes.NewReader(stdin)
+		err := cmd.Start()
+		if err != nil {
+			log.WithFields(log.Fields{"event": ev.Type, "command": command, "err": err}).Warningln("start hook failed!")
+			return
+		}
+		timer := time.AfterFunc(hookTimeout, func() {
+			cmd.Process.Kill()
+		})
+		err = cmd.Wait()
+		timer.Stop()
+		if err != nil {
+			log.WithFields(log.Fields{"event": ev.Type, "command": command, "err": err}).Warningln("run hook failed!")
+		}
+	}()
+}
+
+func (cli *Client) handleNotice(n *msg.Notice) {
+	log.WithFields(log.Fields{"kind": n.Kind, "message": n.Message, "time": n.Time}).Warningln("recv notice from server")
+	cli.emitEvent(Event{Type: EventNotice, Notice: n, Time: time.Now()})
+}
@@ -0,0 +1,407 @@
+// Copyright 2017 longXboy, longxboyhi@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/longXboy/lunnel/log"
+	"github.com/longXboy/lunnel/version"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultInspectMaxSize = 64 << 20
+	defaultInspectMaxBody = 1 << 20
+	redactedValue         = "REDACTED"
+)
+
+// headers carrying credentials,they are always redacted
+var defaultRedactHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie"}
+
+// Inspect records the http requests and responses of a tunnel into a HAR file
+type Inspect struct {
+	File string `yaml:"file"`
+	//bytes the HAR file may grow to before it is rotated to File.1,default to 64MB
+	MaxSize int64 `yaml:"max_size,omitempty"`
+	//bytes of a request or response body recorded at most,default to 1MB
+	MaxBody int64 `yaml:"max_body,omitempty"`
+	//headers whose values are replaced by REDACTED besides Authorization,Cookie and Set-Cookie
+	Redact []string `yaml:"redact,omitempty"`
+}
+
+func (ins *Inspect) validate(name string, schema string) error {
+	if schema != "http" && schema != "https" {
+		return errors.Errorf("%s inspect is only supported by http and https tunnels", name)
+	}
+	if ins.File == "" {
+		return errors.Errorf("%s inspect file can not be empty", name)
+	}
+	if ins.MaxSize < 0 || ins.MaxBody < 0 {
+		return errors.Errorf("%s inspect max_size and max_body can not be negative", name)
+	}
+	if ins.MaxSize == 0 {
+		ins.MaxSize = defaultInspectMaxSize
+	}
+	if ins.MaxBody == 0 {
+		ins.MaxBody = defaultInspectMaxBody
+	}
+	return nil
+}
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+	Encoding string `json:"encoding,omitempty"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+type harRequest struct {
+	Method      string         `json:"method"`
+	Url         string         `json:"url"`
+	HttpVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	QueryString []harNameValue `json:"queryString"`
+	PostData    *harPostData   `json:"postData,omitempty"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type harContent struct {
+	Size     int64  `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+type harResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HttpVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	Content     harContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type harTimings struct {
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+type harEntry struct {
+	StartedDateTime string      `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+}
+
+const harTrailer = "]}}"
+
+// inspector appends the entries of one tunnel to its HAR file,the file is kept
+// a complete HAR document by writing every entry in front of the trailer
+type inspector struct {
+	conf   Inspect
+	schema string
+	redact map[string]bool
+
+	lock    sync.Mutex
+	file    *os.File
+	size    int64
+	entries int
+}
+
+func newInspector(conf Inspect, schema string) *inspector {
+	ins := &inspector{conf: conf, schema: schema, redact: make(map[string]bool)}
+	for _, h := range defaultRedactHeaders {
+		ins.redact[http.CanonicalHeaderKey(h)] = true
+	}
+	for _, h := range conf.Redact {
+		ins.redact[http.CanonicalHeaderKey(h)] = true
+	}
+	return ins
+}
+
+// buildInspectors creates the inspectors of tunnels,the inspectors of older
+// with unchanged settings are kept and the others are closed
+func buildInspectors(tcs map[string]TunnelConfig, older map[string]*inspector) map[string]*inspector {
+	inspectors := make(map[string]*inspector)
+	for name, tc := range tcs {
+		if tc.Inspect == nil {
+			continue
+		}
+		if old, isok := older[name]; isok && old.schema == tc.Schema && reflect.DeepEqual(old.conf, *tc.Inspect) {
+			inspectors[name] = old
+			continue
+		}
+		inspectors[name] = newInspector(*tc.Inspect, tc.Schema)
+	}
+	for name, old := range older {
+		if inspectors[name] != old {
+			old.close()
+		}
+	}
+	return inspectors
+}
+
+func (ins *inspector) close() {
+	ins.lock.Lock()
+	defer ins.lock.Unlock()
+	if ins.file != nil {
+		ins.file.Close()
+		ins.file = nil
+	}
+}
+
+func (ins *inspector) open() error {
+	f, err := os.OpenFile(ins.conf.File, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0600)
+	if err != nil {
+		return errors.Wrapf(err, "open har file %s", ins.conf.File)
+	}
+	creator, _ := json.Marshal(map[string]string{"name": "lunnel", "version": version.Version})
+	header := `{"log":{"version":"1.2","creator":` + string(creator) + `,"entries":[` + harTrailer
+	_, err = f.WriteString(header)
+	if err != nil {
+		f.Close()
+		return errors.Wrapf(err, "write har file %s", ins.conf.File)
+	}
+	ins.file = f
+	ins.size = int64(len(header))
+	ins.entries = 0
+	return nil
+}
+
+func (ins *inspector) record(entry *harEntry) {
+	content, err := json.Marshal(entry)
+	if err != nil {
+		log.WithFields(log.Fields{"err": err}).Warningln("marshal har entry failed!")
+		return
+	}
+	ins.lock.Lock()
+	defer ins.lock.Unlock()
+	if ins.file != nil && ins.size+int64(len(content))+1 > ins.conf.MaxSize {
+		ins.file.Close()
+		ins.file = nil
+		err = os.Rename(ins.conf.File, ins.conf.File+".1")
+		if err != nil {
+			log.WithFields(log.Fields{"err": err, "file": ins.conf.File}).Warningln("rotate har file failed!")
+		}
+	}
+	if ins.file == nil {
+		err = ins.open()
+		if err != nil {
+			log.WithFields(log.Fields{"err": err}).Warningln("open har file failed!")
+			return
+		}
+	}
+	var buf bytes.Buffer
+	if ins.entries > 0 {
+		buf.WriteByte(',')
+	}
+	buf.Write(content)
+	buf.WriteString(harTrailer)
+	_, err = ins.file.WriteAt(buf.Bytes(), ins.size-int64(len(harTrailer)))
+	if err != nil {
+		log.WithFields(log.Fields{"err": err, "file": ins.conf.File}).Warningln("write har entry failed!")
+		return
+	}
+	ins.size += int64(buf.Len() - len(harTrailer))
+	ins.entries++
+}
+
+func (ins *inspector) headers(h http.Header) []harNameValue {
+	nvs := make([]harNameValue, 0, len(h))
+	for k, vs := range h {
+		for _, v := range vs {
+			if ins.redact[k] {
+				v = redactedValue
+			}
+			nvs = append(nvs, harNameValue{Name: k, Value: v})
+		}
+	}
+	return nvs
+}
+
+// bodyRecorder keeps the first limit bytes read through it
+type bodyRecorder struct {
+	r     io.ReadCloser
+	limit int64
+	buf   bytes.Buffer
+	size  int64
+}
+
+func (b *bodyRecorder) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	if n > 0 {
+		if room := b.limit - int64(b.buf.Len()); room > 0 {
+			if int64(n) < room {
+				room = int64(n)
+			}
+			b.buf.Write(p[:room])
+		}
+		b.size += int64(n)
+	}
+	return n, err
+}
+
+func (b *bodyRecorder) Close() error {
+	return b.r.Close()
+}
+
+// text returns the recorded body as text,or base64 encoded if it is binary
+func (b *bodyRecorder) text() (string, string, string) {
+	var comment string
+	if b.size > int64(b.buf.Len()) {
+		comment = "truncated"
+	}
+	if utf8.Valid(b.buf.Bytes()) {
+		return b.buf.String(), "", comment
+	}
+	return base64.StdEncoding.EncodeToString(b.buf.Bytes()), "base64", comment
+}
+
+func millis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// relay proxies the http exchanges between stream and the local conn and records them,
+// the connection is relayed untouched once it is upgraded
+func (ins *inspector) relay(stream io.ReadWriter, conn net.Conn) {
+	sr := bufio.NewReader(stream)
+	lr := bufio.NewReader(conn)
+	for {
+		req, err := http.ReadRequest(sr)
+		if err != nil {
+			return
+		}
+		start := time.Now()
+		reqBody := &bodyRecorder{r: req.Body, limit: ins.conf.MaxBody}
+		req.Body = reqBody
+		if _, isok := req.Header["User-Agent"]; !isok {
+			// keep Request.Write from adding the default user agent
+			req.Header["User-Agent"] = []string{""}
+		}
+		err = req.Write(conn)
+		if err != nil {
+			return
+		}
+		sent := time.Now()
+		resp, err := http.ReadResponse(lr, req)
+		if err != nil {
+			return
+		}
+		waited := time.Now()
+		respBody := &bodyRecorder{r: resp.Body, limit: ins.conf.MaxBody}
+		resp.Body = respBody
+		err = resp.Write(stream)
+		resp.Body.Close()
+		if req.Header.Get("User-Agent") == "" {
+			req.Header.Del("User-Agent")
+		}
+		ins.record(ins.entry(req, reqBody, resp, respBody, start, sent, waited, time.Now()))
+		if err != nil {
+			return
+		}
+		if resp.StatusCode == http.StatusSwitchingProtocols {
+			relayUpgraded(stream, sr, conn, lr)
+			return
+		}
+		if req.Close || resp.Close {
+			return
+		}
+	}
+}
+
+func relayUpgraded(stream io.Writer, sr io.Reader, conn io.Writer, lr io.Reader) {
+	p1die := make(chan struct{})
+	p2die := make(chan struct{})
+	go func() {
+		io.Copy(stream, lr)
+		close(p1die)
+	}()
+	go func() {
+		io.Copy(conn, sr)
+		close(p2die)
+	}()
+	select {
+	case <-p1die:
+	case <-p2die:
+	}
+}
+
+func (ins *inspector) entry(req *http.Request, reqBody *bodyRecorder, resp *http.Response, respBody *bodyRecorder, start, sent, waited, done time.Time) *harEntry {
+	entry := &harEntry{
+		StartedDateTime: start.UTC().Format(time.RFC3339Nano),
+		Time:            millis(done.Sub(start)),
+		Timings:         harTimings{Send: millis(sent.Sub(start)), Wait: millis(waited.Sub(sent)), Receive: millis(done.Sub(waited))},
+	}
+	entry.Request = harRequest{
+		Method:      req.Method,
+		Url:         ins.schema + "://" + req.Host + req.RequestURI,
+		HttpVersion: req.Proto,
+		Cookies:     []harNameValue{},
+		Headers:     ins.headers(req.Header),
+		QueryString: []harNameValue{},
+		HeadersSize: -1,
+		BodySize:    reqBody.size,
+	}
+	for k, vs := range req.URL.Query() {
+		for _, v := range vs {
+			entry.Request.QueryString = append(entry.Request.QueryString, harNameValue{Name: k, Value: v})
+		}
+	}
+	if reqBody.size > 0 {
+		text, encoding, comment := reqBody.text()
+		entry.Request.PostData = &harPostData{MimeType: req.Header.Get("Content-Type"), Text: text, Encoding: encoding, Comment: comment}
+	}
+	entry.Response = harResponse{
+		Status:      resp.StatusCode,
+		StatusText:  strings.TrimPrefix(resp.Status, strconv.Itoa(resp.StatusCode)+" "),
+		HttpVersion: resp.Proto,
+		Cookies:     []harNameValue{},
+		Headers:     ins.headers(resp.Header),
+		RedirectURL: resp.Header.Get("Location"),
+		HeadersSize: -1,
+		BodySize:    respBody.size,
+	}
+	text, encoding, comment := respBody.text()
+	entry.Response.Content = harContent{Size: respBody.size, MimeType: resp.Header.Get("Content-Type"), Text: text, Encoding: encoding, Comment: comment}
+	return entry
+}
@@ -0,0 +1,38 @@
+// Copyright 2017 longXboy, longxboyhi@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"net"
+	"time"
+
+	"github.com/longXboy/lunnel/util"
+	"github.com/pkg/errors"
+)
+
+// Knock sends a signed udp knock to knockAddr(the knock_port of server),
+// which opens the tcp tunnel on public port for the ip of this host
+func Knock(knockAddr string, port uint16, secret string) error {
+	conn, err := net.Dial("udp", knockAddr)
+	if err != nil {
+		return errors.Wrap(err, "dial knock addr")
+	}
+	defer conn.Close()
+	_, err = conn.Write(util.NewKnockPacket(secret, port, time.Now().Unix()))
+	if err != nil {
+		return errors.Wrap(err, "write knock packet")
+	}
+	return nil
+}
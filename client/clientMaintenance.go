@@ -0,0 +1,94 @@
+// Copyright 2017 longXboy, longxboyhi@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/longXboy/lunnel/log"
+	"github.com/longXboy/lunnel/msg"
+	"github.com/pkg/errors"
+)
+
+// SetMaintenance switches all tunnels into maintenance or restores their traffic,
+// the registrations are kept.http tunnels serve the maintenance_page meanwhile
+func (cli *Client) SetMaintenance(enable bool) error {
+	m := msg.Maintenance{Enable: enable}
+	if enable && cli.conf.MaintenancePage != "" {
+		page, err := ioutil.ReadFile(cli.conf.MaintenancePage)
+		if err != nil {
+			return errors.Wrap(err, "read maintenance_page")
+		}
+		if len(page) > maxMaintenancePage {
+			return errors.Errorf("maintenance_page size(%d) out of limit(%d)", len(page), maxMaintenancePage)
+		}
+		m.Page = string(page)
+	}
+	cli.tunnelsLock.Lock()
+	defer cli.tunnelsLock.Unlock()
+	if enable {
+		cli.maintenance = &m
+	} else {
+		cli.maintenance = nil
+	}
+	cli.sendLocked(msg.TypeMaintenance, m)
+	log.WithFields(log.Fields{"enable": enable}).Infoln("maintenance switched")
+	return nil
+}
+
+// serveMaintenance switches maintenance on by POST and off by DELETE
+func (c *Control) serveMaintenance(w http.ResponseWriter, r *http.Request) {
+	var err error
+	switch r.Method {
+	case "POST":
+		err = c.cli.SetMaintenance(true)
+	case "DELETE":
+		err = c.cli.SetMaintenance(false)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("ok"))
+}
+
+// RequestMaintenance asks the client running with manage api on manageAddr to switch maintenance
+func RequestMaintenance(manageAddr string, enable bool) error {
+	method := "DELETE"
+	if enable {
+		method = "POST"
+	}
+	req, err := http.NewRequest(method, fmt.Sprintf("http://%s/maintenance", manageAddr), nil)
+	if err != nil {
+		return errors.Wrap(err, "new maintenance request")
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "request manage api")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		content, _ := ioutil.ReadAll(resp.Body)
+		return errors.Errorf("manage api responded %s:%s", resp.Status, string(content))
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+// Copyright 2017 longXboy, longxboyhi@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"net"
+	"time"
+
+	"github.com/longXboy/lunnel/log"
+	"github.com/longXboy/lunnel/msg"
+	"github.com/longXboy/lunnel/version"
+	"github.com/pkg/errors"
+)
+
+// helloResult is the answer of server to the ClientHello sent over conn in transport
+type helloResult struct {
+	transport string
+	conn      net.Conn
+	mType     msg.MsgType
+	body      interface{}
+	err       error
+	//from the hello written to the answer read
+	rtt time.Duration
+}
+
+// hello connects to server in transportMode and says hello,conn is closed if err is not nil
+func (cli *Client) hello(ctlID string, transportMode string) helloResult {
+	r := helloResult{transport: transportMode}
+	conn, err := cli.dialServer(transportMode, cli.conf.dialOptions())
+	if err != nil {
+		r.err = errors.Wrap(err, "create control conn")
+		return r
+	}
+	return cli.helloOver(conn, ctlID, transportMode)
+}
+
+// helloOver says hello over conn connected to server in transportMode,conn is closed if err is not nil
+func (cli *Client) helloOver(conn net.Conn, ctlID string, transportMode string) helloResult {
+	r := helloResult{transport: transportMode}
+	chello := msg.ClientHello{EncryptMode: cli.encryptMode, EnableCompress: cli.conf.EnableCompress, Version: version.Version, ProtocolVersion: msg.ProtocolVersion, Transport: transportMode, ControlID: ctlID}
+	if cli.encryptMode == "aes" {
+		chello.KeyId = cli.conf.Aes.KeyId
+	}
+	err := msg.WriteMsg(conn, msg.TypeClientHello, chello)
+	if err != nil {
+		conn.Close()
+		r.err = errors.Wrap(err, "write client hello")
+		return r
+	}
+	sent := time.Now()
+	r.mType, r.body, err = msg.ReadMsg(conn)
+	r.rtt = time.Since(sent)
+	if err != nil {
+		conn.Close()
+		r.err = errors.Wrap(err, "read server hello")
+		return r
+	}
+	r.conn = conn
+	return r
+}
+
+// raceHello says hello over every transport of the race config at once and keeps the first answered,
+// or the preferred one if it is answered in the grace after that.the other conns are closed
+func (cli *Client) raceHello(ctlID string) helloResult {
+	race := cli.conf.Race
+	var transports []string
+	for _, t := range race.Transports {
+		// don't race in a transport server doesn't listen in
+		if cli.capabilities == nil || cli.capabilities.HasTransport(t) {
+			transports = append(transports, t)
+		}
+	}
+	if len(transports) == 0 {
+		transports = race.Transports
+	}
+	results := make(chan helloResult, len(transports))
+	for _, t := range transports {
+		go func(t string) {
+			results <- cli.hello(ctlID, t)
+		}(t)
+	}
+	var winner, failed *helloResult
+	var grace <-chan time.Time
+	pending := len(transports)
+race:
+	for pending > 0 {
+		select {
+		case r := <-results:
+			pending--
+			if r.err != nil {
+				controlLog.WithFields(log.Fields{"ctl_id": ctlID, "transport": r.transport, "err": r.err}).Debugln("race hello failed")
+				failed = &r
+				continue
+			}
+			if winner == nil {
+				winner = &r
+				if r.transport == race.Prefer {
+					break race
+				}
+				grace = time.After(time.Duration(race.Grace) * time.Millisecond)
+				continue
+			}
+			if r.transport == race.Prefer {
+				winner.conn.Close()
+				winner = &r
+				break race
+			}
+			r.conn.Close()
+		case <-grace:
+			break race
+		}
+	}
+	go func(n int) {
+		for i := 0; i < n; i++ {
+			if lost := <-results; lost.conn != nil {
+				lost.conn.Close()
+			}
+		}
+	}(pending)
+	if winner == nil {
+		return *failed
+	}
+	controlLog.WithFields(log.Fields{"ctl_id": ctlID, "transport": winner.transport, "raced": transports}).Infoln("race hello won")
+	return *winner
+}
@@ -0,0 +1,92 @@
+// Copyright 2017 longXboy, longxboyhi@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"net"
+
+	"github.com/longXboy/lunnel/msg"
+	"github.com/longXboy/lunnel/transport"
+	"github.com/pkg/errors"
+)
+
+// Hop is a lunnel server with relay enabled,the connections to server are chained through the hops in order
+type Hop struct {
+	Addr string `yaml:"addr"`
+	//relay token of the hop,if it requires one
+	Token string `yaml:"token,omitempty"`
+}
+
+func validateHops(conf *Config) error {
+	for i, hop := range conf.Hops {
+		if _, _, err := net.SplitHostPort(hop.Addr); err != nil {
+			return errors.Wrapf(err, "invalid addr of hop %d", i)
+		}
+	}
+	if conf.Transport != "tcp" {
+		return errors.Errorf("transport %s can't be relayed,hops only relay tcp", conf.Transport)
+	}
+	if conf.PipeTransport != "" && conf.PipeTransport != "tcp" {
+		return errors.New("pipe_transport is not supported,hops only relay tcp")
+	}
+	if conf.Reverse.Listen != "" {
+		return errors.New("reverse mode can't be relayed")
+	}
+	return nil
+}
+
+// dialServer connects to server in transportMode with opts,chaining through the hops if any.
+// obfs is of the first hop if there are hops
+func (cli *Client) dialServer(transportMode string, opts transport.Options) (net.Conn, error) {
+	hops := cli.conf.Hops
+	if len(hops) == 0 {
+		return transport.CreateConn(cli.conf.serverAddr(transportMode), transportMode, opts, cli.conf.Obfs.obfuscator)
+	}
+	conn, err := transport.CreateConn(hops[0].Addr, transportMode, opts, cli.conf.Obfs.obfuscator)
+	if err != nil {
+		return nil, errors.Wrapf(err, "dial hop %s", hops[0].Addr)
+	}
+	for i, hop := range hops {
+		next := cli.conf.serverAddr(transportMode)
+		if i+1 < len(hops) {
+			next = hops[i+1].Addr
+		}
+		err = relayTo(conn, next, hop.Token)
+		if err != nil {
+			conn.Close()
+			return nil, errors.Wrapf(err, "relay by %s to %s", hop.Addr, next)
+		}
+	}
+	return conn, nil
+}
+
+// relayTo asks the hop at the other end of conn to connect it to addr
+func relayTo(conn net.Conn, addr string, token string) error {
+	err := msg.WriteMsg(conn, msg.TypeRelay, msg.Relay{Addr: addr, Token: token})
+	if err != nil {
+		return errors.Wrap(err, "write relay")
+	}
+	mType, body, err := msg.ReadMsg(conn)
+	if err != nil {
+		return errors.Wrap(err, "read relay answer")
+	}
+	if mType == msg.TypeError {
+		return body.(*msg.Error)
+	}
+	if mType != msg.TypeRelay {
+		return errors.Errorf("invalid relay answer type %d", mType)
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+// Copyright 2017 longXboy, longxboyhi@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"os"
+	"os/signal"
+	"reflect"
+	"sort"
+	"syscall"
+
+	"github.com/longXboy/lunnel/log"
+	"github.com/longXboy/lunnel/msg"
+	"github.com/pkg/errors"
+)
+
+var configReader func() ([]byte, error)
+
+// SetConfigReader sets how the config file is read again when SIGHUP is received,
+// config reloading is disabled if no reader is set
+func SetConfigReader(reader func() ([]byte, error)) {
+	configReader = reader
+}
+
+func (cli *Client) watchReload(configType string) {
+	if configReader == nil {
+		return
+	}
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGHUP)
+	for range sigChan {
+		err := cli.reloadConfig(configType)
+		if err != nil {
+			log.WithFields(log.Fields{"err": err}).Errorln("reload config failed!")
+		}
+	}
+}
+
+// reloadConfig reads the config file again and syncs only the changed tunnels to server,
+// unchanged tunnels and their connections are kept alive.other options need a restart to take effect
+func (cli *Client) reloadConfig(configType string) error {
+	configDetail, err := configReader()
+	if err != nil {
+		return errors.Wrap(err, "read config file")
+	}
+	var conf Config
+	err = unmarshalConfig(configDetail, configType, &conf)
+	if err != nil {
+		return err
+	}
+	err = validateTunnels(conf.Tunnels, conf.Profiles)
+	if err != nil {
+		return err
+	}
+	newTunnels, err := buildTunnels(conf.Tunnels)
+	if err != nil {
+		return err
+	}
+
+	cli.tunnelsLock.Lock()
+	defer cli.tunnelsLock.Unlock()
+	changed, removed := diffTunnels(cli.configTunnels, newTunnels)
+	for _, name := range removed {
+		delete(cli.tunnels, name)
+		delete(cli.registered, name)
+	}
+	for name, tunnel := range changed {
+		cli.tunnels[name] = tunnel
+	}
+	// inspectors of the tunnels added by api are kept as they are
+	older := make(map[string]*inspector)
+	for name, ins := range cli.inspectors {
+		if _, isok := cli.configTunnels[name]; isok {
+			older[name] = ins
+		}
+	}
+	inspectors := buildInspectors(conf.Tunnels, older)
+	for name, ins := range cli.inspectors {
+		if _, isok := older[name]; !isok {
+			inspectors[name] = ins
+		}
+	}
+	cli.inspectors = inspectors
+	cli.configTunnels = newTunnels
+	log.WithFields(log.Fields{"changed": len(changed), "removed": len(removed)}).Infoln("config reloaded")
+	if len(removed) > 0 {
+		cli.sendLocked(msg.TypeRemoveTunnels, msg.RemoveTunnels{Names: removed})
+	}
+	if len(changed) > 0 {
+		cli.sendLocked(msg.TypeAddTunnels, msg.AddTunnels{Tunnels: changed})
+	}
+	return nil
+}
+
+// diffTunnels returns the tunnels added or modified in newer and the names missing from it
+func diffTunnels(older map[string]msg.Tunnel, newer map[string]msg.Tunnel) (map[string]msg.Tunnel, []string) {
+	changed := make(map[string]msg.Tunnel)
+	var removed []string
+	for name, tunnel := range newer {
+		if old, isok := older[name]; !isok || !reflect.DeepEqual(old, tunnel) {
+			changed[name] = tunnel
+		}
+	}
+	for name := range older {
+		if _, isok := newer[name]; !isok {
+			removed = append(removed, name)
+		}
+	}
+	sort.Strings(removed)
+	return changed, removed
+}
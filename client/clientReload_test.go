@@ -0,0 +1,53 @@
+// Copyright 2017 longXboy, longxboyhi@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/longXboy/lunnel/msg"
+)
+
+func TestDiffTunnels(t *testing.T) {
+	web := msg.Tunnel{Local: msg.Local{Schema: "http", Host: "127.0.0.1", Port: 8080}}
+	ssh := msg.Tunnel{Local: msg.Local{Schema: "tcp", Host: "127.0.0.1", Port: 22}}
+	moved := msg.Tunnel{Local: msg.Local{Schema: "tcp", Host: "127.0.0.1", Port: 2222}}
+	labeled := msg.Tunnel{Local: msg.Local{Schema: "tcp", Host: "127.0.0.1", Port: 22}, Labels: map[string]string{"env": "dev"}}
+	cases := []struct {
+		name    string
+		older   map[string]msg.Tunnel
+		newer   map[string]msg.Tunnel
+		changed map[string]msg.Tunnel
+		removed []string
+	}{
+		{"unchanged", map[string]msg.Tunnel{"web": web, "ssh": ssh}, map[string]msg.Tunnel{"web": web, "ssh": ssh}, map[string]msg.Tunnel{}, nil},
+		{"added", map[string]msg.Tunnel{"web": web}, map[string]msg.Tunnel{"web": web, "ssh": ssh}, map[string]msg.Tunnel{"ssh": ssh}, nil},
+		{"removed", map[string]msg.Tunnel{"web": web, "ssh": ssh, "db": moved}, map[string]msg.Tunnel{"web": web}, map[string]msg.Tunnel{}, []string{"db", "ssh"}},
+		{"changed port", map[string]msg.Tunnel{"ssh": ssh}, map[string]msg.Tunnel{"ssh": moved}, map[string]msg.Tunnel{"ssh": moved}, nil},
+		{"changed labels", map[string]msg.Tunnel{"ssh": ssh}, map[string]msg.Tunnel{"ssh": labeled}, map[string]msg.Tunnel{"ssh": labeled}, nil},
+		{"all at once", map[string]msg.Tunnel{"web": web, "ssh": ssh}, map[string]msg.Tunnel{"ssh": moved, "db": web}, map[string]msg.Tunnel{"ssh": moved, "db": web}, []string{"web"}},
+		{"from nothing", nil, map[string]msg.Tunnel{"web": web}, map[string]msg.Tunnel{"web": web}, nil},
+	}
+	for _, c := range cases {
+		changed, removed := diffTunnels(c.older, c.newer)
+		if !reflect.DeepEqual(changed, c.changed) {
+			t.Errorf("%s:changed %v,want %v", c.name, changed, c.changed)
+		}
+		if !reflect.DeepEqual(removed, c.removed) {
+			t.Errorf("%s:removed %v,want %v", c.name, removed, c.removed)
+		}
+	}
+}
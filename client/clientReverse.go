@@ -0,0 +1,180 @@
+// Copyright 2017 longXboy, longxboyhi@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"net"
+	"strings"
+	"time"
+
+	"github.com/longXboy/lunnel/log"
+	"github.com/longXboy/lunnel/msg"
+	"github.com/longXboy/lunnel/transport"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// reverseBacklog is how many connections dialed by server wait to be taken
+const reverseBacklog = 16
+
+// reverseStale is how long a connection dialed by server may wait,
+// server gives up on it after its handshake_timeout
+const reverseStale = time.Second * 5
+
+// Reverse makes client listen for server to dial it instead of dialing server,for the hosts which can be reached
+// from server but can't reach out.server must list the address in its reverse_clients
+type Reverse struct {
+	//address listened on in transport,like 0.0.0.0:7001,empty disables the reverse mode
+	Listen string `yaml:"listen,omitempty"`
+	//ips or cidrs server dials from,empty allows any
+	AllowIPs []string `yaml:"allow_ips,omitempty"`
+
+	allowNets []*net.IPNet
+}
+
+func (r *Reverse) normalize(conf *Config) error {
+	if _, _, err := net.SplitHostPort(r.Listen); err != nil {
+		return errors.Wrapf(err, "invalid listen %s", r.Listen)
+	}
+	switch conf.Transport {
+	case "race", "mix", "dns":
+		return errors.Errorf("transport %s can't be dialed by server,set a single one like tcp", conf.Transport)
+	}
+	if conf.PipeTransport != "" {
+		return errors.New("pipe_transport is not supported,server dials the pipes in transport")
+	}
+	for _, s := range r.AllowIPs {
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return errors.Errorf("invalid allow ip %s", s)
+			}
+			if ip.To4() != nil {
+				s = s + "/32"
+			} else {
+				s = s + "/128"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(s)
+		if err != nil {
+			return errors.Errorf("invalid allow cidr %s", s)
+		}
+		r.allowNets = append(r.allowNets, ipNet)
+	}
+	return nil
+}
+
+func (r *Reverse) allowed(addr net.Addr) bool {
+	if len(r.allowNets) == 0 {
+		return true
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	for _, n := range r.allowNets {
+		if ip != nil && n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// reverseAccept is a connection dialed by server and when it was accepted
+type reverseAccept struct {
+	conn net.Conn
+	at   time.Time
+}
+
+// listenReverse accepts the connections server dials into reverseConns until the listener is closed
+func (cli *Client) listenReverse() (net.Listener, error) {
+	lis, err := transport.Listen(cli.conf.Reverse.Listen, cli.conf.Transport, cli.conf.dialOptions(), cli.conf.Obfs.obfuscator)
+	if err != nil {
+		return nil, errors.Wrap(err, "listen reverse")
+	}
+	controlLog.WithFields(log.Fields{"addr": cli.conf.Reverse.Listen, "transport": cli.conf.Transport}).Infoln("listen for server to dial")
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				controlLog.WithFields(log.Fields{"err": err}).Debugln("reverse listener closed")
+				return
+			}
+			if !cli.conf.Reverse.allowed(conn.RemoteAddr()) {
+				controlLog.WithFields(log.Fields{"remote_addr": conn.RemoteAddr().String()}).Warningln("reverse conn denied by allow_ips")
+				conn.Close()
+				continue
+			}
+			select {
+			case cli.reverseConns <- reverseAccept{conn: conn, at: time.Now()}:
+			default:
+				controlLog.WithFields(log.Fields{"remote_addr": conn.RemoteAddr().String()}).Warningln("too many reverse conns waiting,close it")
+				conn.Close()
+			}
+		}
+	}()
+	return lis, nil
+}
+
+// reverseConn takes a connection dialed by server,waiting at most timeout for it unless timeout is 0
+func (cli *Client) reverseConn(ctx context.Context, timeout time.Duration) (net.Conn, error) {
+	var expire <-chan time.Time
+	if timeout > 0 {
+		expire = time.After(timeout)
+	}
+	for {
+		select {
+		case a := <-cli.reverseConns:
+			if time.Since(a.at) > reverseStale {
+				a.conn.Close()
+				continue
+			}
+			return a.conn, nil
+		case <-expire:
+			return nil, errors.Errorf("server dialed no conn in %s", timeout)
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// reverseHello waits for server to dial the control and says hello over it
+func (cli *Client) reverseHello(ctx context.Context, ctlID string, transportMode string) helloResult {
+	conn, err := cli.reverseConn(ctx, 0)
+	if err != nil {
+		return helloResult{transport: transportMode, err: errors.Wrap(err, "wait for control conn")}
+	}
+	return cli.helloOver(conn, ctlID, transportMode)
+}
+
+// reconnectDelay is how long Run waits before connecting again,
+// server paces the dials in the reverse mode
+func (cli *Client) reconnectDelay() time.Duration {
+	if cli.reverseConns != nil {
+		return 0
+	}
+	return time.Second * reconnectInterval
+}
+
+// reverseDial asks server to dial a pipe and waits for it
+func (c *Control) reverseDial() (net.Conn, error) {
+	select {
+	case c.writeChan <- writeReq{msg.TypeReverseDial, nil}:
+	default:
+		return nil, errors.New("control write queue full")
+	}
+	return c.cli.reverseConn(c.ctx, time.Duration(c.cli.conf.DialTimeout)*time.Second)
+}
@@ -0,0 +1,151 @@
+// Copyright 2017 longXboy, longxboyhi@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/longXboy/lunnel/log"
+	"github.com/longXboy/lunnel/msg"
+	"github.com/pkg/errors"
+)
+
+type TunnelStatus struct {
+	Name      string
+	Schema    string
+	PublicURL string
+	Local     string
+	Labels    map[string]string `json:",omitempty"`
+}
+
+type ClientStatus struct {
+	ClientID   string
+	ServerAddr string
+	Connected  bool
+	Transport  string `json:",omitempty"`
+	//transport of the pipes of the tunnels without their own,if not Transport
+	PipeTransport string `json:",omitempty"`
+	//tunnels are kept registered but serve no traffic
+	Maintenance bool `json:",omitempty"`
+	UpdatedAt   time.Time
+	Tunnels     []TunnelStatus
+}
+
+// publicURL omits the default port of http and https tunnels
+func publicURL(t msg.Tunnel) string {
+	if (t.Public.Schema == "http" && t.Public.Port == 80) || (t.Public.Schema == "https" && t.Public.Port == 443) {
+		return fmt.Sprintf("%s://%s", t.Public.Schema, t.Public.Host)
+	}
+	return t.PublicAddr()
+}
+
+func newTunnelStatus(name string, t msg.Tunnel) TunnelStatus {
+	return TunnelStatus{
+		Name:      name,
+		Schema:    t.Public.Schema,
+		PublicURL: publicURL(t),
+		Local:     t.LocalAddr(),
+		Labels:    t.Labels,
+	}
+}
+
+// Status returns the tunnels registered on server,it has no tunnels when disconnected
+func (cli *Client) Status() ClientStatus {
+	st := ClientStatus{
+		ServerAddr: cli.conf.ServerAddr,
+		UpdatedAt:  time.Now(),
+		Tunnels:    []TunnelStatus{},
+	}
+	cli.tunnelsLock.Lock()
+	if cli.clientId != nil {
+		st.ClientID = cli.clientId.String()
+	}
+	st.Maintenance = cli.maintenance != nil
+	if cli.activeCtl != nil {
+		st.Connected = true
+		st.Transport = cli.activeCtl.transportMode
+		st.PipeTransport = cli.activeCtl.pipeTransport
+	}
+	for name, t := range cli.registered {
+		st.Tunnels = append(st.Tunnels, newTunnelStatus(name, t))
+	}
+	cli.tunnelsLock.Unlock()
+	sort.Slice(st.Tunnels, func(i, j int) bool { return st.Tunnels[i].Name < st.Tunnels[j].Name })
+	return st
+}
+
+// reportStatus prints the registered tunnels in status_format and writes the status_file
+func (cli *Client) reportStatus() {
+	if cli.conf.StatusFormat == "" && cli.conf.StatusFile == "" {
+		return
+	}
+	st := cli.Status()
+	if cli.conf.StatusFormat == "json" {
+		content, err := json.Marshal(st)
+		if err == nil {
+			fmt.Fprintln(os.Stdout, string(content))
+		}
+	} else if cli.conf.statusTemplate != nil {
+		for _, t := range st.Tunnels {
+			err := cli.conf.statusTemplate.Execute(os.Stdout, t)
+			if err != nil {
+				log.WithFields(log.Fields{"err": err}).Warningln("execute status template failed!")
+				break
+			}
+		}
+	}
+	if cli.conf.StatusFile != "" {
+		err := writeStatusFile(cli.conf.StatusFile, st)
+		if err != nil {
+			log.WithFields(log.Fields{"path": cli.conf.StatusFile, "err": err}).Warningln("write status file failed!")
+		}
+	}
+}
+
+// writeStatusFile replaces the file by rename,so readers never see a partial status
+func writeStatusFile(path string, st ClientStatus) error {
+	content, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "json marshal status")
+	}
+	tmp := path + ".tmp"
+	err = ioutil.WriteFile(tmp, content, 0644)
+	if err != nil {
+		return errors.Wrap(err, "write tmp status file")
+	}
+	err = os.Rename(tmp, path)
+	if err != nil {
+		os.Remove(tmp)
+		return errors.Wrap(err, "rename status file")
+	}
+	return nil
+}
+
+func (c *Control) serveStatus(w http.ResponseWriter, r *http.Request) {
+	content, err := json.Marshal(c.cli.Status())
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(content)
+}
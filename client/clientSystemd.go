@@ -0,0 +1,51 @@
+// Copyright 2017 longXboy, longxboyhi@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"time"
+
+	"github.com/longXboy/lunnel/log"
+	"github.com/longXboy/lunnel/util"
+)
+
+// watchdogLockTimeout is how long tunnelsLock may stay locked before the client is taken as hung
+const watchdogLockTimeout = time.Second * 10
+
+// notifySystemd tells systemd the client is ready when the tunnels are registered
+// and shows the connection state in systemctl status
+func notifySystemd(ev Event) {
+	var state string
+	switch ev.Type {
+	case EventConnected:
+		state = "READY=1\nSTATUS=connected to server"
+	case EventDisconnected:
+		state = "STATUS=reconnecting to server"
+	default:
+		return
+	}
+	err := util.SdNotify(state)
+	if err != nil {
+		log.WithFields(log.Fields{"err": err}).Warningln("notify systemd failed!")
+	}
+}
+
+// responsive reports whether tunnelsLock can be locked,the systemd watchdog is fed only if it can
+func (cli *Client) responsive() bool {
+	return util.Responsive(func() {
+		cli.tunnelsLock.Lock()
+		cli.tunnelsLock.Unlock()
+	}, watchdogLockTimeout)
+}
@@ -0,0 +1,270 @@
+// Copyright 2017 longXboy, longxboyhi@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/longXboy/lunnel/log"
+	"github.com/longXboy/lunnel/msg"
+	"github.com/longXboy/lunnel/util"
+	"github.com/longXboy/smux"
+	"github.com/pkg/errors"
+)
+
+// Visitor listens locally and carries the connections accepted to a tunnel on server,
+// a tcp or tcpmux tunnel of any client by its public address or a stcp tunnel by its host
+type Visitor struct {
+	//local address listened on,like 127.0.0.1:15432
+	Listen string `yaml:"listen"`
+	//public address of the tunnel,like tcp://example.com:34567
+	Addr string `yaml:"addr,omitempty"`
+	//host of the stcp tunnel,its name if it sets no host
+	Stcp string `yaml:"stcp,omitempty"`
+	//psk of the tunnel,sent before the data
+	Psk string `yaml:"psk,omitempty"`
+	//serve socks5 on listen instead,the host:port connected to is the public address of a tcp tunnel,
+	//or <host of the stcp tunnel>.stcp with any port
+	Socks5 bool `yaml:"socks5,omitempty"`
+}
+
+func (v *Visitor) normalize() error {
+	if _, _, err := net.SplitHostPort(v.Listen); err != nil {
+		return errors.Wrapf(err, "invalid listen %s", v.Listen)
+	}
+	err := util.ResolveSecrets(&v.Psk)
+	if err != nil {
+		return errors.Wrap(err, "psk")
+	}
+	if v.Socks5 {
+		if v.Addr != "" || v.Stcp != "" {
+			return errors.New("socks5 visitor can't set addr or stcp")
+		}
+		return nil
+	}
+	if (v.Addr == "") == (v.Stcp == "") {
+		return errors.New("one of addr and stcp must be set")
+	}
+	if v.Addr != "" && !strings.HasPrefix(v.Addr, "tcp://") && !strings.HasPrefix(v.Addr, "tcpmux://") {
+		return errors.Errorf("addr %s must be of a tcp or tcpmux tunnel", v.Addr)
+	}
+	return nil
+}
+
+// listenVisitor serves the visitor v of name until the listener returned is closed
+func (cli *Client) listenVisitor(name string, v Visitor) (net.Listener, error) {
+	lis, err := net.Listen("tcp", v.Listen)
+	if err != nil {
+		return nil, errors.Wrapf(err, "listen visitor %s", name)
+	}
+	pipeLog.WithFields(log.Fields{"visitor": name, "addr": lis.Addr().String(), "socks5": v.Socks5}).Infoln("listen visitor")
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				pipeLog.WithFields(log.Fields{"visitor": name, "err": err}).Debugln("visitor listener closed")
+				return
+			}
+			go cli.handleVisitor(name, v, conn)
+		}
+	}()
+	return lis, nil
+}
+
+func (cli *Client) handleVisitor(name string, v Visitor, conn net.Conn) {
+	defer conn.Close()
+	target := msg.Visit{Addr: v.Addr, Stcp: v.Stcp}
+	if v.Socks5 {
+		conn.SetDeadline(time.Now().Add(time.Duration(cli.conf.DialTimeout) * time.Second))
+		host, port, err := socks5Request(conn)
+		if err != nil {
+			pipeLog.WithFields(log.Fields{"visitor": name, "remote_addr": conn.RemoteAddr().String(), "err": err}).Debugln("socks5 handshake failed")
+			return
+		}
+		conn.SetDeadline(time.Time{})
+		if strings.HasSuffix(host, ".stcp") {
+			target = msg.Visit{Stcp: strings.TrimSuffix(host, ".stcp")}
+		} else {
+			target = msg.Visit{Addr: fmt.Sprintf("tcp://%s:%d", host, port)}
+		}
+	}
+	stream, ctl, err := cli.visit(target, v.Psk)
+	if v.Socks5 {
+		rep := byte(socks5Succeeded)
+		if err != nil {
+			rep = socks5Refused
+		}
+		if werr := socks5Reply(conn, rep); werr != nil && err == nil {
+			stream.Close()
+			return
+		}
+	}
+	if err != nil {
+		pipeLog.WithFields(log.Fields{"visitor": name, "addr": target.Addr, "stcp": target.Stcp, "err": err}).Warningln("visit failed!")
+		return
+	}
+	defer stream.Close()
+	ctl.relay(stream, conn, fmt.Sprintf("visit-%s-%d", name, stream.ID()))
+}
+
+// visit opens a stream to the tunnel v asks for over the visit pipe of the active control,
+// psk is sent first if it is not empty
+func (cli *Client) visit(v msg.Visit, psk string) (*smux.Stream, *Control, error) {
+	cli.tunnelsLock.Lock()
+	ctl := cli.activeCtl
+	cli.tunnelsLock.Unlock()
+	if ctl == nil {
+		return nil, nil, errors.New("not connected to server")
+	}
+	if !ctl.visits {
+		return nil, nil, errors.New("server doesn't support visitors")
+	}
+	sess, err := ctl.visitSession()
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "visit pipe")
+	}
+	stream, err := sess.OpenStream("")
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "open visit stream")
+	}
+	stream.SetDeadline(time.Now().Add(time.Duration(cli.conf.DialTimeout) * time.Second))
+	err = msg.WriteMsg(stream, msg.TypeVisit, v)
+	if err == nil {
+		var mType msg.MsgType
+		var body interface{}
+		mType, body, err = msg.ReadMsg(stream)
+		if err == nil && mType == msg.TypeError {
+			err = body.(*msg.Error)
+		} else if err == nil && mType != msg.TypeVisit {
+			err = errors.Errorf("invalid visit answer type %d", mType)
+		}
+	}
+	if err == nil && psk != "" {
+		_, err = stream.Write([]byte(psk + "\n"))
+	}
+	if err != nil {
+		stream.Close()
+		return nil, nil, err
+	}
+	stream.SetDeadline(time.Time{})
+	return stream, ctl, nil
+}
+
+// visitSession returns the visit pipe of c,dialing it if there is none
+func (c *Control) visitSession() (*smux.Session, error) {
+	c.visitLock.Lock()
+	defer c.visitLock.Unlock()
+	if c.visitSess != nil && !c.visitSess.IsClosed() {
+		return c.visitSess, nil
+	}
+	windows := c.pipeWindows()
+	opts := c.cli.conf.dialOptions()
+	opts.KcpSndWnd, opts.KcpRcvWnd = windows.kcpSnd, windows.kcpRcv
+	conn, err := c.dialPipe(c.transportMode, opts)
+	if err != nil {
+		return nil, err
+	}
+	sess, pipeID, err := c.pipeHandShake(conn, c.transportMode, nil, windows, true)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	pipeLog.WithFields(log.Fields{"ctl_id": c.id, "pipe_id": pipeID, "transport": c.transportMode}).Debugln("visit pipe handshake success")
+	go func() {
+		<-c.ctx.Done()
+		sess.Close()
+	}()
+	c.visitSess = sess
+	return sess, nil
+}
+
+const (
+	socks5Succeeded       = 0
+	socks5Refused         = 5
+	socks5CmdUnsupported  = 7
+	socks5AddrUnsupported = 8
+)
+
+// socks5Request reads the greeting and CONNECT request of a socks5 client,
+// only the CONNECT without authentication is served
+func socks5Request(conn net.Conn) (string, uint16, error) {
+	buf := make([]byte, 256)
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return "", 0, err
+	}
+	if buf[0] != 5 {
+		return "", 0, errors.Errorf("invalid socks version %d", buf[0])
+	}
+	methods := buf[1]
+	if _, err := io.ReadFull(conn, buf[:methods]); err != nil {
+		return "", 0, err
+	}
+	noAuth := false
+	for _, m := range buf[:methods] {
+		noAuth = noAuth || m == 0
+	}
+	if !noAuth {
+		conn.Write([]byte{5, 0xff})
+		return "", 0, errors.New("socks5 client requires authentication")
+	}
+	if _, err := conn.Write([]byte{5, 0}); err != nil {
+		return "", 0, err
+	}
+	if _, err := io.ReadFull(conn, buf[:4]); err != nil {
+		return "", 0, err
+	}
+	if buf[1] != 1 {
+		socks5Reply(conn, socks5CmdUnsupported)
+		return "", 0, errors.Errorf("socks5 command %d not supported", buf[1])
+	}
+	var host string
+	switch buf[3] {
+	case 1, 4:
+		n := net.IPv4len
+		if buf[3] == 4 {
+			n = net.IPv6len
+		}
+		if _, err := io.ReadFull(conn, buf[:n]); err != nil {
+			return "", 0, err
+		}
+		host = net.IP(buf[:n]).String()
+	case 3:
+		if _, err := io.ReadFull(conn, buf[:1]); err != nil {
+			return "", 0, err
+		}
+		n := buf[0]
+		if _, err := io.ReadFull(conn, buf[:n]); err != nil {
+			return "", 0, err
+		}
+		host = string(buf[:n])
+	default:
+		socks5Reply(conn, socks5AddrUnsupported)
+		return "", 0, errors.Errorf("socks5 address type %d not supported", buf[3])
+	}
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return "", 0, err
+	}
+	return host, binary.BigEndian.Uint16(buf[:2]), nil
+}
+
+func socks5Reply(conn net.Conn, rep byte) error {
+	_, err := conn.Write([]byte{5, rep, 0, 1, 0, 0, 0, 0, 0, 0})
+	return err
+}
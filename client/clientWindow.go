@@ -0,0 +1,90 @@
+// Copyright 2017 longXboy, longxboyhi@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/longXboy/lunnel/transport"
+	"github.com/longXboy/lunnel/transport/kcp"
+)
+
+const (
+	//receive buffer of a pipe,also the least one sized by bandwidth
+	pipeReceiveBuffer    = 4194304
+	maxPipeReceiveBuffer = 64 << 20
+)
+
+// rttTracker smooths the rtt to server measured by the hello and the pings of the control like tcp does,
+// srtt = 7/8*srtt + 1/8*sample
+type rttTracker struct {
+	//smoothed rtt in nanoseconds,0 before the first sample
+	srtt int64
+	//unix nano the unanswered ping was sent at,0 if none
+	pingSent int64
+}
+
+func (r *rttTracker) observe(sample time.Duration) {
+	if sample <= 0 {
+		return
+	}
+	srtt := atomic.LoadInt64(&r.srtt)
+	if srtt == 0 {
+		srtt = int64(sample)
+	} else {
+		srtt = srtt - srtt/8 + int64(sample)/8
+	}
+	atomic.StoreInt64(&r.srtt, srtt)
+}
+
+func (r *rttTracker) rtt() time.Duration {
+	return time.Duration(atomic.LoadInt64(&r.srtt))
+}
+
+func (r *rttTracker) pinged() {
+	atomic.StoreInt64(&r.pingSent, time.Now().UnixNano())
+}
+
+func (r *rttTracker) ponged() {
+	sent := atomic.SwapInt64(&r.pingSent, 0)
+	if sent != 0 {
+		r.observe(time.Duration(time.Now().UnixNano() - sent))
+	}
+}
+
+// pipeWindows are the windows of a pipe sized by the bandwidth config over the rtt
+type pipeWindows struct {
+	rtt time.Duration
+	//receive buffer of the pipe session of client
+	receiveBuffer int
+	//receive buffer asked of server,0 keeps the default of server
+	serverReceiveBuffer int
+	//kcp windows in packets of client and the send window asked of server,0 keeps the defaults
+	kcpSnd int
+	kcpRcv int
+}
+
+func (c *Control) pipeWindows() pipeWindows {
+	bw := c.cli.conf.Bandwidth
+	w := pipeWindows{rtt: c.rtt.rtt()}
+	w.receiveBuffer = transport.SizeWindow(bw.Down, w.rtt, pipeReceiveBuffer, maxPipeReceiveBuffer)
+	if up := transport.SizeWindow(bw.Up, w.rtt, 0, maxPipeReceiveBuffer); up > pipeReceiveBuffer {
+		w.serverReceiveBuffer = up
+	}
+	w.kcpSnd = kcp.WindowPackets(transport.SizeWindow(bw.Up, w.rtt, 0, 0))
+	w.kcpRcv = kcp.WindowPackets(transport.SizeWindow(bw.Down, w.rtt, 0, 0))
+	return w
+}
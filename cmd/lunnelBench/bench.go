@@ -0,0 +1,212 @@
+// Copyright 2017 longXboy, longxboyhi@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/longXboy/lunnel/client"
+	"github.com/longXboy/lunnel/lunneltest"
+	"github.com/pkg/errors"
+)
+
+// combo is one encrypt,compress and transport combination benchmarked with its own client
+type combo struct {
+	Transport string
+	Encrypt   string
+	Compress  bool
+}
+
+func (c combo) String() string {
+	return fmt.Sprintf("%s/%s/compress=%v", c.Transport, c.Encrypt, c.Compress)
+}
+
+type result struct {
+	combo
+	//tunnels registered per second
+	SetupRate float64
+	//proxied connections opened,echoed one byte and closed per second
+	ConnRate float64
+	//MB per second echoed back through one connection
+	Throughput float64
+	Err        error
+}
+
+// serveEcho starts the local service of the tunnels,it echoes everything back
+func serveEcho() (net.Listener, error) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, errors.Wrap(err, "listen echo")
+	}
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	return lis, nil
+}
+
+func benchSetup(cli *lunneltest.Client, local string, n int) (float64, error) {
+	start := time.Now()
+	for i := 0; i < n; i++ {
+		name := fmt.Sprintf("bench-setup-%d", i)
+		err := cli.AddTunnel(name, client.TunnelConfig{Schema: "tcp", LocalAddr: "tcp://" + local})
+		if err != nil {
+			return 0, errors.Wrap(err, "add tunnel")
+		}
+		_, err = cli.WaitTunnel(name)
+		if err != nil {
+			return 0, err
+		}
+	}
+	rate := float64(n) / time.Since(start).Seconds()
+	for i := 0; i < n; i++ {
+		cli.RemoveTunnel(fmt.Sprintf("bench-setup-%d", i))
+	}
+	return rate, nil
+}
+
+func echoOnce(addr string) error {
+	conn, err := net.DialTimeout("tcp", addr, lunneltest.RegisterTimeout)
+	if err != nil {
+		return errors.Wrap(err, "dial tunnel")
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(lunneltest.RegisterTimeout))
+	_, err = conn.Write([]byte{'x'})
+	if err != nil {
+		return errors.Wrap(err, "write tunnel")
+	}
+	_, err = io.ReadFull(conn, make([]byte, 1))
+	if err != nil {
+		return errors.Wrap(err, "read tunnel")
+	}
+	return nil
+}
+
+func benchConns(addr string, n int, concurrency int) (float64, error) {
+	var next int64
+	var lock sync.Mutex
+	var firstErr error
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for atomic.AddInt64(&next, 1) <= int64(n) {
+				err := echoOnce(addr)
+				if err != nil {
+					lock.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					lock.Unlock()
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return 0, firstErr
+	}
+	return float64(n) / time.Since(start).Seconds(), nil
+}
+
+func benchThroughput(addr string, size int64) (float64, error) {
+	conn, err := net.DialTimeout("tcp", addr, lunneltest.RegisterTimeout)
+	if err != nil {
+		return 0, errors.Wrap(err, "dial tunnel")
+	}
+	defer conn.Close()
+	start := time.Now()
+	writeErr := make(chan error, 1)
+	go func() {
+		// random bytes so compression gains nothing the real traffic wouldn't
+		chunk := make([]byte, 1<<20)
+		rand.Read(chunk)
+		for left := size; left > 0; left -= int64(len(chunk)) {
+			if left < int64(len(chunk)) {
+				chunk = chunk[:left]
+			}
+			_, err := conn.Write(chunk)
+			if err != nil {
+				writeErr <- err
+				return
+			}
+		}
+		writeErr <- nil
+	}()
+	_, err = io.CopyN(ioutil.Discard, conn, size)
+	if err != nil {
+		return 0, errors.Wrap(err, "read tunnel")
+	}
+	err = <-writeErr
+	if err != nil {
+		return 0, errors.Wrap(err, "write tunnel")
+	}
+	return float64(size) / (1 << 20) / time.Since(start).Seconds(), nil
+}
+
+// runCombo connects a client configured by base for the combo and benchmarks it
+func runCombo(base client.Config, c combo, opts benchOptions) result {
+	res := result{combo: c}
+	conf := base
+	conf.Transport = c.Transport
+	conf.EncryptMode = c.Encrypt
+	conf.EnableCompress = c.Compress
+	conf.Tunnels = map[string]client.TunnelConfig{"bench": {Schema: "tcp", LocalAddr: "tcp://" + opts.local}}
+	cli, err := lunneltest.StartClient(conf)
+	if err != nil {
+		res.Err = err
+		return res
+	}
+	defer cli.Close()
+	addr, err := cli.WaitTunnel("bench")
+	if err != nil {
+		res.Err = err
+		return res
+	}
+	res.SetupRate, err = benchSetup(cli, opts.local, opts.tunnels)
+	if err != nil {
+		res.Err = errors.Wrap(err, "setup")
+		return res
+	}
+	res.ConnRate, err = benchConns(addr, opts.conns, opts.concurrency)
+	if err != nil {
+		res.Err = errors.Wrap(err, "conns")
+		return res
+	}
+	res.Throughput, err = benchThroughput(addr, opts.bytes)
+	if err != nil {
+		res.Err = errors.Wrap(err, "throughput")
+	}
+	return res
+}
@@ -0,0 +1,121 @@
+// Copyright 2017 longXboy, longxboyhi@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/longXboy/lunnel/client"
+	lunnelLog "github.com/longXboy/lunnel/log"
+	"github.com/longXboy/lunnel/lunneltest"
+	"github.com/pkg/errors"
+)
+
+type benchOptions struct {
+	local       string
+	tunnels     int
+	conns       int
+	concurrency int
+	bytes       int64
+}
+
+func parseCombos(transports string, encrypts string, compress string) ([]combo, error) {
+	var combos []combo
+	for _, t := range strings.Split(transports, ",") {
+		for _, e := range strings.Split(encrypts, ",") {
+			for _, c := range strings.Split(compress, ",") {
+				enabled, err := strconv.ParseBool(c)
+				if err != nil {
+					return nil, errors.Errorf("invalid compress %s", c)
+				}
+				combos = append(combos, combo{Transport: t, Encrypt: e, Compress: enabled})
+			}
+		}
+	}
+	return combos, nil
+}
+
+func main() {
+	serverAddr := flag.String("server", "", "address of a running server to benchmark,a server is started in process if empty")
+	authToken := flag.String("auth_token", "", "auth_token of the client connecting to server")
+	aesSecret := flag.String("aes_secret", "", "aes secret_key of server")
+	noiseKey := flag.String("noise_server_key", "", "noise public key of server")
+	trustedCert := flag.String("trusted_cert", "", "cert file trusted in tls mode")
+	serverName := flag.String("server_name", "", "server name verified in tls mode")
+	transports := flag.String("transports", "tcp,kcp", "transports to benchmark,comma separated")
+	encrypts := flag.String("encrypt", "none,aes,noise", "encrypt modes to benchmark,comma separated")
+	compress := flag.String("compress", "false,true", "compress settings to benchmark,comma separated")
+	tunnels := flag.Int("tunnels", 20, "tunnels registered one by one to measure the setup rate")
+	conns := flag.Int("conns", 500, "connections proxied to measure the connection rate")
+	concurrency := flag.Int("concurrency", 8, "connections proxied at the same time")
+	size := flag.Int64("bytes", 64<<20, "bytes echoed through one connection to measure the throughput")
+	logFile := flag.String("log", os.DevNull, "file the logs of client and server are written to")
+	flag.Parse()
+
+	combos, err := parseCombos(*transports, *encrypts, *compress)
+	if err != nil {
+		log.Fatalf("parse combinations failed!err:=%v\n", err)
+	}
+	echo, err := serveEcho()
+	if err != nil {
+		log.Fatalf("serve echo failed!err:=%v\n", err)
+	}
+	var base client.Config
+	if *serverAddr == "" {
+		s, err := lunneltest.StartServer(strings.Split(*transports, ","), *logFile)
+		if err != nil {
+			log.Fatalf("start server failed!err:=%v\n", err)
+		}
+		base = s.ClientConfig()
+	} else {
+		f, err := os.OpenFile(*logFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0660)
+		if err != nil {
+			log.Fatalf("open log file failed!err:=%v\n", err)
+		}
+		defer f.Close()
+		lunnelLog.Init(false, f)
+		base = client.Config{
+			ServerAddr: *serverAddr,
+			Aes:        client.Aes{SecretKey: *aesSecret},
+			Noise:      client.Noise{ServerKey: *noiseKey},
+			Tls:        client.Tls{TrustedCert: *trustedCert, ServerName: *serverName},
+		}
+	}
+	base.AuthToken = *authToken
+	opts := benchOptions{local: echo.Addr().String(), tunnels: *tunnels, conns: *conns, concurrency: *concurrency, bytes: *size}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "TRANSPORT\tENCRYPT\tCOMPRESS\tTUNNELS/S\tCONNS/S\tMB/S\tERROR")
+	for _, c := range combos {
+		if c.Encrypt == "tls" && *serverAddr == "" {
+			fmt.Fprintf(w, "%s\t%s\t%v\t\t\t\ttls needs -server\n", c.Transport, c.Encrypt, c.Compress)
+			continue
+		}
+		log.Printf("benchmarking %s\n", c)
+		res := runCombo(base, c, opts)
+		errMsg := ""
+		if res.Err != nil {
+			errMsg = res.Err.Error()
+		}
+		fmt.Fprintf(w, "%s\t%s\t%v\t%.1f\t%.1f\t%.2f\t%s\n", c.Transport, c.Encrypt, c.Compress, res.SetupRate, res.ConnRate, res.Throughput, errMsg)
+	}
+	w.Flush()
+}
@@ -16,16 +16,68 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"io/ioutil"
 	"log"
+	"path/filepath"
 	"strings"
 
 	"github.com/longXboy/lunnel/client"
+	"github.com/longXboy/lunnel/crypto"
+	"github.com/longXboy/lunnel/util"
 )
 
 func main() {
 	configFile := flag.String("c", "./config.yml", "path of config file")
+	knockAddr := flag.String("knock", "", "send a knock to the knock port of server(host:port) and exit")
+	knockPort := flag.Uint("knock_port", 0, "public port of the tunnel to open by knock")
+	knockSecret := flag.String("knock_secret", "", "knock_secret of the tunnel to open by knock")
+	genNoiseKey := flag.Bool("gen_noise_key", false, "print a new key pair for the noise encrypt mode and exit")
+	maintenance := flag.String("maintenance", "", "on or off,switch maintenance of the client running with manage api on manage_addr and exit")
+	manageAddr := flag.String("manage_addr", "127.0.0.1:8082", "manage api address of the running client")
+	service := flag.String("service", "", "install,uninstall,start or stop the windows service running the client of the config file and exit,run is used by the service")
+	serviceName := flag.String("service_name", "lunnel", "name of the windows service")
+	seal := flag.Bool("seal", false, "read a secret from stdin,print it sealed by the passphrase(LUNNEL_PASSPHRASE or asked) as ${sealed:...} and exit")
 	flag.Parse()
+	if *seal {
+		err := sealSecret()
+		if err != nil {
+			log.Fatalf("seal secret failed!err:=%v\n", err)
+		}
+		return
+	}
+	if *genNoiseKey {
+		key, err := crypto.GenerateNoiseKey()
+		if err != nil {
+			log.Fatalf("generate noise key failed!err:=%v\n", err)
+		}
+		fmt.Printf("private_key: %s\npublic_key: %s\n", crypto.EncodeNoiseKey(key.Private), crypto.EncodeNoiseKey(key.Public))
+		return
+	}
+	if *maintenance != "" {
+		if *maintenance != "on" && *maintenance != "off" {
+			log.Fatalf("maintenance must be on or off\n")
+		}
+		err := client.RequestMaintenance(*manageAddr, *maintenance == "on")
+		if err != nil {
+			log.Fatalf("switch maintenance failed!err:=%v\n", err)
+		}
+		return
+	}
+	if *knockAddr != "" {
+		err := client.Knock(*knockAddr, uint16(*knockPort), *knockSecret)
+		if err != nil {
+			log.Fatalf("knock failed!err:=%v\n", err)
+		}
+		return
+	}
+	if *service != "" && *service != "run" {
+		err := manageService(*service, *serviceName, *configFile)
+		if err != nil {
+			log.Fatalf("%s service failed!err:=%v\n", *service, err)
+		}
+		return
+	}
 	var configDetail []byte
 	var err error
 	configType := ""
@@ -42,5 +94,19 @@ func main() {
 		}
 	}
 
+	if *configFile != "" {
+		client.SetConfigDir(filepath.Dir(*configFile))
+		client.SetConfigReader(func() ([]byte, error) {
+			return ioutil.ReadFile(*configFile)
+		})
+	}
+	util.SetPassphraseFunc(askPassphrase)
+	if *service == "run" {
+		err = runService(*serviceName, configDetail, configType)
+		if err != nil {
+			log.Fatalf("run service failed!err:=%v\n", err)
+		}
+		return
+	}
 	client.Main(configDetail, configType)
 }
@@ -0,0 +1,86 @@
+// Copyright 2017 longXboy, longxboyhi@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/longXboy/lunnel/util"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+func readSecretLine(prompt string) (string, error) {
+	if !terminal.IsTerminal(int(os.Stdin.Fd())) {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			return "", errors.Wrap(err, "read stdin")
+		}
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+	fmt.Fprint(os.Stderr, prompt)
+	secret, err := terminal.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", errors.Wrap(err, "read terminal")
+	}
+	return string(secret), nil
+}
+
+// askPassphrase takes the passphrase from the environment,or asks it on the terminal lunnelCli runs in
+func askPassphrase() (string, error) {
+	p, err := util.EnvPassphrase()
+	if err == nil || !terminal.IsTerminal(int(os.Stdin.Fd())) {
+		return p, err
+	}
+	return readSecretLine("passphrase of the sealed secrets:")
+}
+
+// sealSecret prints the secret read from stdin sealed by the passphrase,which is asked twice on the terminal
+func sealSecret() error {
+	secret, err := readSecretLine("secret:")
+	if err != nil {
+		return err
+	}
+	p, err := util.EnvPassphrase()
+	if err != nil {
+		if !terminal.IsTerminal(int(os.Stdin.Fd())) {
+			return err
+		}
+		p, err = readSecretLine("passphrase:")
+		if err != nil {
+			return err
+		}
+		again, err := readSecretLine("passphrase again:")
+		if err != nil {
+			return err
+		}
+		if again != p {
+			return errors.New("passphrases don't match")
+		}
+	}
+	if p == "" {
+		return errors.New("passphrase can not be empty")
+	}
+	sealed, err := util.Seal(secret, p)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("${sealed:%s}\n", sealed)
+	return nil
+}
@@ -0,0 +1,32 @@
+// Copyright 2017 longXboy, longxboyhi@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"github.com/pkg/errors"
+)
+
+var errNoService = errors.New("service is only supported on windows,use systemd or another supervisor instead")
+
+func manageService(cmd string, name string, configFile string) error {
+	return errNoService
+}
+
+func runService(name string, configDetail []byte, configType string) error {
+	return errNoService
+}
@@ -0,0 +1,160 @@
+// Copyright 2017 longXboy, longxboyhi@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/longXboy/lunnel/client"
+	"github.com/longXboy/lunnel/log"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/eventlog"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+// manageService installs,uninstalls,starts or stops the windows service of name,
+// the installed service runs the client of configFile
+func manageService(cmd string, name string, configFile string) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return errors.Wrap(err, "connect service manager")
+	}
+	defer m.Disconnect()
+	switch cmd {
+	case "install":
+		exe, err := os.Executable()
+		if err != nil {
+			return errors.Wrap(err, "executable path")
+		}
+		configPath, err := filepath.Abs(configFile)
+		if err != nil {
+			return errors.Wrap(err, "config path")
+		}
+		s, err := m.CreateService(name, exe, mgr.Config{
+			DisplayName: "lunnel client",
+			Description: "exposes local services through the lunnel server",
+			StartType:   mgr.StartAutomatic,
+		}, "-c", configPath, "-service", "run", "-service_name", name)
+		if err != nil {
+			return errors.Wrap(err, "create service")
+		}
+		defer s.Close()
+		err = eventlog.InstallAsEventCreate(name, eventlog.Error|eventlog.Warning|eventlog.Info)
+		if err != nil {
+			s.Delete()
+			return errors.Wrap(err, "install event log source")
+		}
+		return nil
+	case "uninstall", "start", "stop":
+	default:
+		return errors.Errorf("invalid service command %s", cmd)
+	}
+	s, err := m.OpenService(name)
+	if err != nil {
+		return errors.Wrapf(err, "open service %s", name)
+	}
+	defer s.Close()
+	switch cmd {
+	case "uninstall":
+		err = s.Delete()
+		if err != nil {
+			return errors.Wrap(err, "delete service")
+		}
+		return eventlog.Remove(name)
+	case "start":
+		return s.Start()
+	}
+	status, err := s.Control(svc.Stop)
+	if err != nil {
+		return errors.Wrap(err, "stop service")
+	}
+	for timeout := time.Now().Add(time.Second * 20); status.State != svc.Stopped; {
+		if time.Now().After(timeout) {
+			return errors.New("timeout waiting for service to stop")
+		}
+		time.Sleep(time.Millisecond * 300)
+		status, err = s.Query()
+		if err != nil {
+			return errors.Wrap(err, "query service")
+		}
+	}
+	return nil
+}
+
+type clientService struct {
+	configDetail []byte
+	configType   string
+}
+
+func (cs *clientService) Execute(args []string, r <-chan svc.ChangeRequest, changes chan<- svc.Status) (bool, uint32) {
+	changes <- svc.Status{State: svc.StartPending}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- client.Serve(ctx, cs.configDetail, cs.configType)
+	}()
+	changes <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+	for {
+		select {
+		case err := <-done:
+			changes <- svc.Status{State: svc.StopPending}
+			if status := client.ExitStatus(err); status != 0 {
+				log.WithFields(log.Fields{"err": err, "status": status}).Errorln("client stopped!")
+				return true, uint32(status)
+			}
+			return false, 0
+		case c := <-r:
+			switch c.Cmd {
+			case svc.Interrogate:
+				changes <- c.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				log.WithFields(log.Fields{"cmd": c.Cmd}).Infoln("got service control to stop")
+				changes <- svc.Status{State: svc.StopPending}
+				cancel()
+			}
+		}
+	}
+}
+
+// runService runs the client as the windows service of name,logging to the windows event log as well
+func runService(name string, configDetail []byte, configType string) error {
+	elog, err := eventlog.Open(name)
+	if err != nil {
+		return errors.Wrap(err, "open event log")
+	}
+	defer elog.Close()
+	log.AddSink(func(level string, line string) {
+		switch level {
+		case "error", "fatal", "panic":
+			elog.Error(1, line)
+		case "warning":
+			elog.Warning(1, line)
+		default:
+			elog.Info(1, line)
+		}
+	})
+	err = svc.Run(name, &clientService{configDetail: configDetail, configType: configType})
+	if err != nil {
+		elog.Error(1, fmt.Sprintf("run service failed!err:=%v", err))
+		return errors.Wrap(err, "run service")
+	}
+	return nil
+}
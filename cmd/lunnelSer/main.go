@@ -16,16 +16,27 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"strings"
 
+	"github.com/longXboy/lunnel/crypto"
 	"github.com/longXboy/lunnel/server"
 )
 
 func main() {
 	configFile := flag.String("c", "./config.yml", "path of config file")
+	genNoiseKey := flag.Bool("gen_noise_key", false, "print a new key pair for the noise encrypt mode and exit")
 	flag.Parse()
+	if *genNoiseKey {
+		key, err := crypto.GenerateNoiseKey()
+		if err != nil {
+			log.Fatalf("generate noise key failed!err:=%v\n", err)
+		}
+		fmt.Printf("private_key: %s\npublic_key: %s\n", crypto.EncodeNoiseKey(key.Private), crypto.EncodeNoiseKey(key.Public))
+		return
+	}
 	var configDetail []byte
 	var err error
 	configType := ""
@@ -15,17 +15,219 @@
 package contrib
 
 import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/longXboy/lunnel/log"
 	"github.com/longXboy/lunnel/msg"
+	"github.com/pkg/errors"
 )
 
-func InitNotify(notifyUrl string, notifyKey string) error {
+var notifyUrl string
+var notifyKey string
+var notifyClient = &http.Client{Timeout: time.Second * 10}
+
+// tunnelQueue holds the tunnel notifies posted in order by one goroutine,
+// so the tunnels of a client aren't held up by a slow notify url
+var tunnelQueue = make(chan []byte, 1024)
+var startQueue sync.Once
+
+type tunnelNotify struct {
+	Action   string
+	Domain   string
+	ClientID string
+	Public   string
+	Local    string
+	Labels   map[string]string
+	Time     int64
+}
+
+func InitNotify(url string, key string) error {
+	notifyUrl = url
+	notifyKey = key
+	startQueue.Do(func() {
+		go postTunnelQueue()
+	})
 	return nil
 }
 
+func postTunnelQueue() {
+	for body := range tunnelQueue {
+		err := postNotify(body)
+		if err != nil {
+			log.WithFields(log.Fields{"err": err}).Errorln("notify tunnel failed!")
+		}
+	}
+}
+
+// AddTunnel queues the notify of the tunnel added,it fails only if the queue is full
 func AddTunnel(domain string, tunnel msg.Tunnel, clientId string) error {
-	return nil
+	return notifyTunnel("add", domain, tunnel, clientId)
 }
 
+// RemoveTunnel queues the notify of the tunnel removed,it fails only if the queue is full
 func RemoveTunnel(domain string, tunnel msg.Tunnel, clientId string) error {
+	return notifyTunnel("remove", domain, tunnel, clientId)
+}
+
+func QuotaExceeded(domain string, tunnel msg.Tunnel, clientId string) error {
+	body, err := tunnelBody("quota_exceeded", domain, tunnel, clientId)
+	if err != nil || body == nil {
+		return err
+	}
+	return postNotify(body)
+}
+
+type alertNotify struct {
+	Action    string
+	Domain    string
+	Rule      string
+	Kind      string
+	Target    string
+	Value     float64
+	Threshold float64
+	Time      int64
+}
+
+// Alert notifies that value of target has crossed the threshold of an alert rule
+func Alert(domain string, rule string, kind string, target string, value float64, threshold float64) error {
+	if notifyUrl == "" {
+		return nil
+	}
+	body, err := json.Marshal(alertNotify{
+		Action:    "alert",
+		Domain:    domain,
+		Rule:      rule,
+		Kind:      kind,
+		Target:    target,
+		Value:     value,
+		Threshold: threshold,
+		Time:      time.Now().Unix(),
+	})
+	if err != nil {
+		return errors.Wrap(err, "json marshal alert body")
+	}
+	return postNotify(body)
+}
+
+type certNotify struct {
+	Action   string
+	Domain   string
+	Subject  string
+	NotAfter int64
+	Problems []string
+	Time     int64
+}
+
+// CertProblem notifies that the check of the tls certificate found problems
+func CertProblem(domain string, subject string, notAfter int64, problems []string) error {
+	if notifyUrl == "" {
+		return nil
+	}
+	body, err := json.Marshal(certNotify{
+		Action:   "cert_problem",
+		Domain:   domain,
+		Subject:  subject,
+		NotAfter: notAfter,
+		Problems: problems,
+		Time:     time.Now().Unix(),
+	})
+	if err != nil {
+		return errors.Wrap(err, "json marshal cert problem body")
+	}
+	return postNotify(body)
+}
+
+type duplicateNotify struct {
+	Action        string
+	Domain        string
+	ClientID      string
+	OldRemoteAddr string
+	RemoteAddr    string
+	Policy        string
+	Time          int64
+}
+
+// DuplicateClient notifies that a client connected with the id of another client still connected
+func DuplicateClient(domain string, clientId string, oldRemoteAddr string, remoteAddr string, policy string) error {
+	if notifyUrl == "" {
+		return nil
+	}
+	body, err := json.Marshal(duplicateNotify{
+		Action:        "client_duplicate",
+		Domain:        domain,
+		ClientID:      clientId,
+		OldRemoteAddr: oldRemoteAddr,
+		RemoteAddr:    remoteAddr,
+		Policy:        policy,
+		Time:          time.Now().Unix(),
+	})
+	if err != nil {
+		return errors.Wrap(err, "json marshal duplicate client body")
+	}
+	return postNotify(body)
+}
+
+func notifyTunnel(action string, domain string, tunnel msg.Tunnel, clientId string) error {
+	body, err := tunnelBody(action, domain, tunnel, clientId)
+	if err != nil || body == nil {
+		return err
+	}
+	select {
+	case tunnelQueue <- body:
+		return nil
+	default:
+		return errors.Errorf("notify queue full,%s of %s dropped", action, tunnel.PublicAddr())
+	}
+}
+
+// tunnelBody is the notify body of the action on tunnel,nil without notify url
+func tunnelBody(action string, domain string, tunnel msg.Tunnel, clientId string) ([]byte, error) {
+	if notifyUrl == "" {
+		return nil, nil
+	}
+	body, err := json.Marshal(tunnelNotify{
+		Action:   action,
+		Domain:   domain,
+		ClientID: clientId,
+		Public:   tunnel.PublicAddr(),
+		Local:    tunnel.LocalAddr(),
+		Labels:   tunnel.Labels,
+		Time:     time.Now().Unix(),
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "json marshal notify body")
+	}
+	return body, nil
+}
+
+// postNotify sends body to the notify url,signed with notify key in the X-Lunnel-Signature header if configured
+func postNotify(body []byte) error {
+	req, err := http.NewRequest("POST", notifyUrl, bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "new notify request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if notifyKey != "" {
+		mac := hmac.New(sha256.New, []byte(notifyKey))
+		mac.Write(body)
+		req.Header.Set("X-Lunnel-Signature", hex.EncodeToString(mac.Sum(nil)))
+	}
+	resp, err := notifyClient.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "post notify")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		content, _ := ioutil.ReadAll(resp.Body)
+		return errors.Errorf("notify response code %d,body:%s", resp.StatusCode, string(content))
+	}
 	return nil
 }
@@ -0,0 +1,86 @@
+// Copyright 2017 longXboy, longxboyhi@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package contrib
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/longXboy/lunnel/util"
+	"github.com/pkg/errors"
+)
+
+// VaultProvider reads secrets from a kv secrets engine of Vault,
+// the ref is path#field like secret/data/lunnel#aes_key with both kv version 1 and 2 supported
+type VaultProvider struct {
+	Addr   string
+	Token  string
+	client *http.Client
+}
+
+func NewVaultProvider(addr string, token string) *VaultProvider {
+	return &VaultProvider{Addr: strings.TrimSuffix(addr, "/"), Token: token, client: &http.Client{Timeout: time.Second * 10}}
+}
+
+func (v *VaultProvider) Secret(ref string) (string, error) {
+	idx := strings.LastIndexByte(ref, '#')
+	if idx <= 0 || idx == len(ref)-1 {
+		return "", errors.Errorf("vault secret %s must be in path#field format", ref)
+	}
+	path, field := ref[:idx], ref[idx+1:]
+	req, err := http.NewRequest("GET", v.Addr+"/v1/"+strings.TrimPrefix(path, "/"), nil)
+	if err != nil {
+		return "", errors.Wrap(err, "new vault request")
+	}
+	req.Header.Set("X-Vault-Token", v.Token)
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return "", errors.Wrap(err, "read vault")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.Errorf("vault response code %d", resp.StatusCode)
+	}
+	var body struct {
+		Data map[string]interface{}
+	}
+	err = json.NewDecoder(resp.Body).Decode(&body)
+	if err != nil {
+		return "", errors.Wrap(err, "decode vault response")
+	}
+	data := body.Data
+	// kv version 2 nests the secret in data.data
+	if nested, isok := data["data"].(map[string]interface{}); isok {
+		data = nested
+	}
+	value, isok := data[field].(string)
+	if !isok {
+		return "", errors.Errorf("field %s not found in vault secret %s", field, path)
+	}
+	return value, nil
+}
+
+// RegisterVault makes ${vault:path#field} resolved by the Vault at VAULT_ADDR with VAULT_TOKEN,
+// nothing is registered if VAULT_ADDR is not set
+func RegisterVault() {
+	addr := os.Getenv("VAULT_ADDR")
+	if addr == "" {
+		return
+	}
+	util.RegisterSecretProvider("vault", NewVaultProvider(addr, os.Getenv("VAULT_TOKEN")))
+}
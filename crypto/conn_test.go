@@ -22,11 +22,11 @@ import (
 func Test_aesEncryptDecrypt(t *testing.T) {
 	blocken, err := NewCryptoStream(nil, []byte("0123456789abcdef"))
 	if err != nil {
-		t.Errorf("NewAESBlockCrypt error:", err)
+		t.Errorf("NewAESBlockCrypt error:%v", err)
 	}
 	blockde, err := NewCryptoStream(nil, []byte("0123456789abcdef"))
 	if err != nil {
-		t.Errorf("NewAESBlockCrypt error:", err)
+		t.Errorf("NewAESBlockCrypt error:%v", err)
 	}
 	input := []byte("01a2c")
 	blocken.encrypt(input, input)
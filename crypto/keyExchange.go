@@ -122,6 +122,20 @@ func NewPrf12() func(result, secret, label, seed []byte) {
 	return prf12(sha256.New)
 }
 
+// PipeMac is the hmac of the hello of a pipe,keyed by a key derived from the pre master secret of its control
+func PipeMac(preMasterSecret []byte, input []byte) []byte {
+	key := make([]byte, 32)
+	prf12(sha256.New)(key, preMasterSecret, []byte("pipe mac"), nil)
+	mac := hmac.New(sha256.New, key)
+	mac.Write(input)
+	return mac.Sum(nil)
+}
+
+// CheckPipeMac reports whether mac is the PipeMac of input,in constant time
+func CheckPipeMac(preMasterSecret []byte, input []byte, mac []byte) bool {
+	return hmac.Equal(mac, PipeMac(preMasterSecret, input))
+}
+
 func randBytes(x []byte) {
 	length := len(x)
 	n, err := crand.Read(x)
@@ -0,0 +1,484 @@
+// Copyright 2017 longXboy, longxboyhi@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package crypto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	crand "crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"hash"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/blake2s"
+	"golang.org/x/crypto/curve25519"
+)
+
+// the handshake is Noise_XX,both sides prove their static keys and every message is forward secret
+const noiseProtocolName = "Noise_XX_25519_AESGCM_BLAKE2s"
+
+const (
+	noiseKeyLen     = 32
+	noiseTagLen     = 16
+	noiseMaxMsgLen  = 65535
+	noiseMaxPayload = noiseMaxMsgLen - noiseTagLen
+	noiseTimeout    = time.Second * 10
+)
+
+// NoiseKey is a curve25519 static key pair
+type NoiseKey struct {
+	Private [noiseKeyLen]byte
+	Public  [noiseKeyLen]byte
+}
+
+func GenerateNoiseKey() (NoiseKey, error) {
+	var k NoiseKey
+	_, err := io.ReadFull(crand.Reader, k.Private[:])
+	if err != nil {
+		return k, errors.Wrap(err, "read random")
+	}
+	curve25519.ScalarBaseMult(&k.Public, &k.Private)
+	return k, nil
+}
+
+// ParseNoiseKey parses the base64 private key and derives the public key
+func ParseNoiseKey(private string) (NoiseKey, error) {
+	var k NoiseKey
+	priv, err := decodeNoiseKey(private)
+	if err != nil {
+		return k, err
+	}
+	k.Private = priv
+	curve25519.ScalarBaseMult(&k.Public, &k.Private)
+	return k, nil
+}
+
+// ParseNoisePublicKey decodes a base64 public key
+func ParseNoisePublicKey(key string) ([noiseKeyLen]byte, error) {
+	return decodeNoiseKey(key)
+}
+
+func decodeNoiseKey(key string) ([noiseKeyLen]byte, error) {
+	var k [noiseKeyLen]byte
+	raw, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return k, errors.Wrap(err, "decode noise key")
+	}
+	if len(raw) != noiseKeyLen {
+		return k, errors.Errorf("noise key must be %d bytes,got %d", noiseKeyLen, len(raw))
+	}
+	copy(k[:], raw)
+	return k, nil
+}
+
+func EncodeNoiseKey(k [noiseKeyLen]byte) string {
+	return base64.StdEncoding.EncodeToString(k[:])
+}
+
+func noiseDH(priv [noiseKeyLen]byte, pub [noiseKeyLen]byte) ([]byte, error) {
+	var out, zero [noiseKeyLen]byte
+	curve25519.ScalarMult(&out, &priv, &pub)
+	if subtle.ConstantTimeCompare(out[:], zero[:]) == 1 {
+		return nil, errors.New("invalid noise public key")
+	}
+	return out[:], nil
+}
+
+func newBlake2s() hash.Hash {
+	h, _ := blake2s.New256(nil)
+	return h
+}
+
+func noiseHkdf(ck []byte, ikm []byte) ([]byte, []byte) {
+	mac := hmac.New(newBlake2s, ck)
+	mac.Write(ikm)
+	temp := mac.Sum(nil)
+	mac = hmac.New(newBlake2s, temp)
+	mac.Write([]byte{1})
+	out1 := mac.Sum(nil)
+	mac = hmac.New(newBlake2s, temp)
+	mac.Write(out1)
+	mac.Write([]byte{2})
+	return out1, mac.Sum(nil)
+}
+
+type noiseCipher struct {
+	aead  cipher.AEAD
+	n     uint64
+	nonce [12]byte
+}
+
+func newNoiseCipher(k []byte) *noiseCipher {
+	block, _ := aes.NewCipher(k)
+	aead, _ := cipher.NewGCM(block)
+	return &noiseCipher{aead: aead}
+}
+
+func (c *noiseCipher) next() ([]byte, error) {
+	if c.n == ^uint64(0) {
+		return nil, errors.New("noise nonce exhausted")
+	}
+	binary.BigEndian.PutUint64(c.nonce[4:], c.n)
+	c.n++
+	return c.nonce[:], nil
+}
+
+func (c *noiseCipher) seal(dst []byte, ad []byte, plaintext []byte) ([]byte, error) {
+	nonce, err := c.next()
+	if err != nil {
+		return nil, err
+	}
+	return c.aead.Seal(dst, nonce, plaintext, ad), nil
+}
+
+func (c *noiseCipher) open(dst []byte, ad []byte, ciphertext []byte) ([]byte, error) {
+	nonce, err := c.next()
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := c.aead.Open(dst, nonce, ciphertext, ad)
+	if err != nil {
+		return nil, errors.New("noise decrypt failed")
+	}
+	return plaintext, nil
+}
+
+type noiseSymmetric struct {
+	ck []byte
+	h  []byte
+	c  *noiseCipher
+}
+
+func newNoiseSymmetric() *noiseSymmetric {
+	// a name no longer than the hash is padded with zeros instead of hashed
+	h := make([]byte, blake2s.Size)
+	if len(noiseProtocolName) <= blake2s.Size {
+		copy(h, noiseProtocolName)
+	} else {
+		sum := blake2s.Sum256([]byte(noiseProtocolName))
+		h = sum[:]
+	}
+	ss := &noiseSymmetric{ck: h, h: h}
+	// empty prologue
+	ss.mixHash(nil)
+	return ss
+}
+
+func (ss *noiseSymmetric) mixHash(data []byte) {
+	h := newBlake2s()
+	h.Write(ss.h)
+	h.Write(data)
+	ss.h = h.Sum(nil)
+}
+
+func (ss *noiseSymmetric) mixKey(ikm []byte) {
+	var k []byte
+	ss.ck, k = noiseHkdf(ss.ck, ikm)
+	ss.c = newNoiseCipher(k)
+}
+
+func (ss *noiseSymmetric) encryptAndHash(plaintext []byte) ([]byte, error) {
+	ciphertext := plaintext
+	if ss.c != nil {
+		var err error
+		ciphertext, err = ss.c.seal(nil, ss.h, plaintext)
+		if err != nil {
+			return nil, err
+		}
+	}
+	ss.mixHash(ciphertext)
+	return ciphertext, nil
+}
+
+func (ss *noiseSymmetric) decryptAndHash(ciphertext []byte) ([]byte, error) {
+	plaintext := ciphertext
+	if ss.c != nil {
+		var err error
+		plaintext, err = ss.c.open(nil, ss.h, ciphertext)
+		if err != nil {
+			return nil, err
+		}
+	}
+	ss.mixHash(ciphertext)
+	return plaintext, nil
+}
+
+func (ss *noiseSymmetric) split() (*noiseCipher, *noiseCipher) {
+	k1, k2 := noiseHkdf(ss.ck, nil)
+	return newNoiseCipher(k1), newNoiseCipher(k2)
+}
+
+func writeNoiseFrame(w io.Writer, frame []byte) error {
+	buf := make([]byte, 2+len(frame))
+	binary.BigEndian.PutUint16(buf, uint16(len(frame)))
+	copy(buf[2:], frame)
+	_, err := w.Write(buf)
+	return err
+}
+
+func readNoiseFrame(r io.Reader, buf []byte) ([]byte, error) {
+	var hdr [2]byte
+	_, err := io.ReadFull(r, hdr[:])
+	if err != nil {
+		return nil, err
+	}
+	n := int(binary.BigEndian.Uint16(hdr[:]))
+	if cap(buf) < n {
+		buf = make([]byte, n)
+	}
+	buf = buf[:n]
+	_, err = io.ReadFull(r, buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// NoiseVerifier decides whether the static public key of the peer is trusted
+type NoiseVerifier func(peer [noiseKeyLen]byte) error
+
+// generateEphemeral creates the ephemeral keys of the handshakes,replaced by the test vectors
+var generateEphemeral = GenerateNoiseKey
+
+type deadliner interface {
+	SetDeadline(t time.Time) error
+}
+
+// NoiseClient runs the initiator side of the handshake on conn,
+// verify is called with the static key of server before the static key of client is sent
+func NoiseClient(conn io.ReadWriteCloser, static NoiseKey, verify NoiseVerifier) (io.ReadWriteCloser, error) {
+	if d, isok := conn.(deadliner); isok {
+		d.SetDeadline(time.Now().Add(noiseTimeout))
+		defer d.SetDeadline(time.Time{})
+	}
+	ss := newNoiseSymmetric()
+	e, err := generateEphemeral()
+	if err != nil {
+		return nil, err
+	}
+	// -> e
+	ss.mixHash(e.Public[:])
+	payload, _ := ss.encryptAndHash(nil)
+	err = writeNoiseFrame(conn, append(e.Public[:], payload...))
+	if err != nil {
+		return nil, errors.Wrap(err, "write noise handshake")
+	}
+	// <- e, ee, s, es
+	frame, err := readNoiseFrame(conn, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "read noise handshake")
+	}
+	if len(frame) < noiseKeyLen*2+noiseTagLen*2 {
+		return nil, errors.New("noise handshake message too short")
+	}
+	var re, rs [noiseKeyLen]byte
+	copy(re[:], frame[:noiseKeyLen])
+	ss.mixHash(re[:])
+	dh, err := noiseDH(e.Private, re)
+	if err != nil {
+		return nil, err
+	}
+	ss.mixKey(dh)
+	s, err := ss.decryptAndHash(frame[noiseKeyLen : noiseKeyLen*2+noiseTagLen])
+	if err != nil {
+		return nil, err
+	}
+	copy(rs[:], s)
+	dh, err = noiseDH(e.Private, rs)
+	if err != nil {
+		return nil, err
+	}
+	ss.mixKey(dh)
+	_, err = ss.decryptAndHash(frame[noiseKeyLen*2+noiseTagLen:])
+	if err != nil {
+		return nil, err
+	}
+	if verify != nil {
+		err = verify(rs)
+		if err != nil {
+			return nil, err
+		}
+	}
+	// -> s, se
+	msg3, err := ss.encryptAndHash(static.Public[:])
+	if err != nil {
+		return nil, err
+	}
+	dh, err = noiseDH(static.Private, re)
+	if err != nil {
+		return nil, err
+	}
+	ss.mixKey(dh)
+	payload, err = ss.encryptAndHash(nil)
+	if err != nil {
+		return nil, err
+	}
+	err = writeNoiseFrame(conn, append(msg3, payload...))
+	if err != nil {
+		return nil, errors.Wrap(err, "write noise handshake")
+	}
+	send, recv := ss.split()
+	return &noiseConn{rawConn: conn, send: send, recv: recv}, nil
+}
+
+// NoiseServer runs the responder side of the handshake on conn,
+// verify is called with the static key of client before any data is accepted
+func NoiseServer(conn io.ReadWriteCloser, static NoiseKey, verify NoiseVerifier) (io.ReadWriteCloser, error) {
+	if d, isok := conn.(deadliner); isok {
+		d.SetDeadline(time.Now().Add(noiseTimeout))
+		defer d.SetDeadline(time.Time{})
+	}
+	ss := newNoiseSymmetric()
+	// -> e
+	frame, err := readNoiseFrame(conn, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "read noise handshake")
+	}
+	if len(frame) < noiseKeyLen {
+		return nil, errors.New("noise handshake message too short")
+	}
+	var re, rs [noiseKeyLen]byte
+	copy(re[:], frame[:noiseKeyLen])
+	ss.mixHash(re[:])
+	_, err = ss.decryptAndHash(frame[noiseKeyLen:])
+	if err != nil {
+		return nil, err
+	}
+	// <- e, ee, s, es
+	e, err := generateEphemeral()
+	if err != nil {
+		return nil, err
+	}
+	ss.mixHash(e.Public[:])
+	dh, err := noiseDH(e.Private, re)
+	if err != nil {
+		return nil, err
+	}
+	ss.mixKey(dh)
+	s, err := ss.encryptAndHash(static.Public[:])
+	if err != nil {
+		return nil, err
+	}
+	dh, err = noiseDH(static.Private, re)
+	if err != nil {
+		return nil, err
+	}
+	ss.mixKey(dh)
+	payload, err := ss.encryptAndHash(nil)
+	if err != nil {
+		return nil, err
+	}
+	msg2 := append(e.Public[:], s...)
+	err = writeNoiseFrame(conn, append(msg2, payload...))
+	if err != nil {
+		return nil, errors.Wrap(err, "write noise handshake")
+	}
+	// -> s, se
+	frame, err = readNoiseFrame(conn, frame)
+	if err != nil {
+		return nil, errors.Wrap(err, "read noise handshake")
+	}
+	if len(frame) < noiseKeyLen+noiseTagLen*2 {
+		return nil, errors.New("noise handshake message too short")
+	}
+	s, err = ss.decryptAndHash(frame[:noiseKeyLen+noiseTagLen])
+	if err != nil {
+		return nil, err
+	}
+	copy(rs[:], s)
+	dh, err = noiseDH(e.Private, rs)
+	if err != nil {
+		return nil, err
+	}
+	ss.mixKey(dh)
+	_, err = ss.decryptAndHash(frame[noiseKeyLen+noiseTagLen:])
+	if err != nil {
+		return nil, err
+	}
+	if verify != nil {
+		err = verify(rs)
+		if err != nil {
+			return nil, err
+		}
+	}
+	recv, send := ss.split()
+	return &noiseConn{rawConn: conn, send: send, recv: recv}, nil
+}
+
+// noiseConn carries data in length prefixed frames sealed by the transport keys of the handshake
+type noiseConn struct {
+	rawConn io.ReadWriteCloser
+	send    *noiseCipher
+	recv    *noiseCipher
+	wlock   sync.Mutex
+	// frame sealed by Write,kept for the next one
+	wframe []byte
+	rframe []byte
+	rbuf   []byte
+}
+
+func (c *noiseConn) Read(b []byte) (int, error) {
+	for len(c.rbuf) == 0 {
+		frame, err := readNoiseFrame(c.rawConn, c.rframe)
+		if err != nil {
+			return 0, err
+		}
+		c.rframe = frame
+		c.rbuf, err = c.recv.open(frame[:0], nil, frame)
+		if err != nil {
+			return 0, err
+		}
+	}
+	n := copy(b, c.rbuf)
+	c.rbuf = c.rbuf[n:]
+	return n, nil
+}
+
+func (c *noiseConn) Write(b []byte) (int, error) {
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
+	written := 0
+	if c.wframe == nil {
+		c.wframe = make([]byte, 2, 2+noiseMaxMsgLen)
+	}
+	for len(b) > 0 {
+		chunk := b
+		if len(chunk) > noiseMaxPayload {
+			chunk = chunk[:noiseMaxPayload]
+		}
+		sealed, err := c.send.seal(c.wframe[:2], nil, chunk)
+		if err != nil {
+			return written, err
+		}
+		binary.BigEndian.PutUint16(sealed, uint16(len(sealed)-2))
+		_, err = c.rawConn.Write(sealed)
+		if err != nil {
+			return written, err
+		}
+		written += len(chunk)
+		b = b[len(chunk):]
+	}
+	return written, nil
+}
+
+func (c *noiseConn) Close() error {
+	return c.rawConn.Close()
+}
@@ -0,0 +1,234 @@
+// Copyright 2017 longXboy, longxboyhi@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package crypto
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+)
+
+func noiseHandshake(serverVerify NoiseVerifier, clientVerify NoiseVerifier) (io.ReadWriteCloser, io.ReadWriteCloser, error, error) {
+	serverKey, _ := GenerateNoiseKey()
+	clientKey, _ := GenerateNoiseKey()
+	c1, c2 := net.Pipe()
+	type result struct {
+		conn io.ReadWriteCloser
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		conn, err := NoiseServer(c2, serverKey, serverVerify)
+		if err != nil {
+			c2.Close()
+		}
+		done <- result{conn, err}
+	}()
+	cconn, cerr := NoiseClient(c1, clientKey, clientVerify)
+	if cerr != nil {
+		c1.Close()
+	}
+	res := <-done
+	return cconn, res.conn, cerr, res.err
+}
+
+func Test_noiseHandshake(t *testing.T) {
+	serverKey, _ := GenerateNoiseKey()
+	clientKey, _ := GenerateNoiseKey()
+	c1, c2 := net.Pipe()
+	var gotClient, gotServer [32]byte
+	done := make(chan io.ReadWriteCloser, 1)
+	go func() {
+		conn, err := NoiseServer(c2, serverKey, func(peer [32]byte) error {
+			gotClient = peer
+			return nil
+		})
+		if err != nil {
+			t.Errorf("NoiseServer error:%v", err)
+		}
+		done <- conn
+	}()
+	cconn, err := NoiseClient(c1, clientKey, func(peer [32]byte) error {
+		gotServer = peer
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("NoiseClient error:%v", err)
+	}
+	sconn := <-done
+	if sconn == nil {
+		t.FailNow()
+	}
+	if gotClient != clientKey.Public || gotServer != serverKey.Public {
+		t.Errorf("static keys not exchanged")
+	}
+
+	input := make([]byte, 200000)
+	randBytes(input)
+	go func() {
+		cconn.Write(input)
+	}()
+	output := make([]byte, len(input))
+	_, err = io.ReadFull(sconn, output)
+	if err != nil {
+		t.Fatalf("read error:%v", err)
+	}
+	if !bytes.Equal(input, output) {
+		t.Errorf("noise decrypt error:not compare")
+	}
+	go func() {
+		sconn.Write([]byte("pong"))
+	}()
+	reply := make([]byte, 4)
+	_, err = io.ReadFull(cconn, reply)
+	if err != nil || string(reply) != "pong" {
+		t.Errorf("read reply error:%v,%s", err, reply)
+	}
+}
+
+func Test_noiseRejectPeer(t *testing.T) {
+	reject := func(peer [32]byte) error {
+		return errors.New("untrusted")
+	}
+	_, _, cerr, serr := noiseHandshake(reject, nil)
+	if cerr != nil && serr == nil {
+		t.Errorf("server accepted rejected client")
+	}
+	if serr == nil {
+		t.Errorf("server accepted rejected client")
+	}
+	_, _, cerr, _ = noiseHandshake(nil, reject)
+	if cerr == nil {
+		t.Errorf("client accepted rejected server")
+	}
+}
+
+func Test_noiseParseKey(t *testing.T) {
+	key, err := GenerateNoiseKey()
+	if err != nil {
+		t.Fatalf("GenerateNoiseKey error:%v", err)
+	}
+	parsed, err := ParseNoiseKey(EncodeNoiseKey(key.Private))
+	if err != nil {
+		t.Fatalf("ParseNoiseKey error:%v", err)
+	}
+	if parsed.Public != key.Public {
+		t.Errorf("public key not derived from private key")
+	}
+	if _, err = ParseNoisePublicKey("c2hvcnQ="); err == nil {
+		t.Errorf("short key accepted")
+	}
+}
+
+// recordConn keeps what is written to the conn,one frame a write
+type recordConn struct {
+	net.Conn
+	lock   sync.Mutex
+	writes [][]byte
+}
+
+func (c *recordConn) Write(p []byte) (int, error) {
+	c.lock.Lock()
+	c.writes = append(c.writes, append([]byte{}, p[2:]...))
+	c.lock.Unlock()
+	return c.Conn.Write(p)
+}
+
+func noiseVectorKey(t *testing.T, private string) NoiseKey {
+	raw, err := hex.DecodeString(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ParseNoiseKey(base64.StdEncoding.EncodeToString(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// Test_noiseVector checks the handshake and transport messages with the Noise_XX_25519_AESGCM_BLAKE2s
+// vector of github.com/flynn/noise(vectors.txt),which has an empty prologue and empty handshake payloads
+func Test_noiseVector(t *testing.T) {
+	initStatic := noiseVectorKey(t, "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
+	respStatic := noiseVectorKey(t, "0102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f20")
+	ephemerals := []NoiseKey{
+		noiseVectorKey(t, "202122232425262728292a2b2c2d2e2f303132333435363738393a3b3c3d3e3f"),
+		noiseVectorKey(t, "4142434445464748494a4b4c4d4e4f505152535455565758595a5b5c5d5e5f60"),
+	}
+	var lock sync.Mutex
+	generateEphemeral = func() (NoiseKey, error) {
+		// the responder generates its key only after reading the one of the initiator
+		lock.Lock()
+		defer lock.Unlock()
+		e := ephemerals[0]
+		ephemerals = ephemerals[1:]
+		return e, nil
+	}
+	defer func() {
+		generateEphemeral = GenerateNoiseKey
+	}()
+	c1, c2 := net.Pipe()
+	ci, cr := &recordConn{Conn: c1}, &recordConn{Conn: c2}
+	done := make(chan io.ReadWriteCloser, 1)
+	go func() {
+		conn, err := NoiseServer(cr, respStatic, nil)
+		if err != nil {
+			t.Errorf("NoiseServer error:%v", err)
+		}
+		done <- conn
+	}()
+	iconn, err := NoiseClient(ci, initStatic, nil)
+	if err != nil {
+		t.Fatalf("NoiseClient error:%v", err)
+	}
+	rconn := <-done
+	if rconn == nil {
+		t.FailNow()
+	}
+	go iconn.Write([]byte("yellowsubmarine"))
+	buf := make([]byte, 15)
+	if _, err = io.ReadFull(rconn, buf); err != nil || string(buf) != "yellowsubmarine" {
+		t.Fatalf("read error:%v,%s", err, buf)
+	}
+	go rconn.Write([]byte("submarineyellow"))
+	if _, err = io.ReadFull(iconn, buf); err != nil || string(buf) != "submarineyellow" {
+		t.Fatalf("read error:%v,%s", err, buf)
+	}
+	want := [][]string{{
+		"358072d6365880d1aeea329adf9121383851ed21a28e3b75e965d0d2cd166254",
+		"c0eef7241004fcad6fb84daa25d9a8921a8da60da9b8b39f387667e98069e72fea2a13ea74822183fae1d17df8a490e5ea7ab72edd2bce950758a4482447f664",
+		"bb9dd5494e382306a88f8f32a4bb268cad2632353dd13aad364dc7493c4561",
+	}, {
+		"64b101b1d0be5a8704bd078f9895001fc03e8e9f9522f188dd128d9846d48466c558f251b38f5770b20bfe770709ec1aa6e0aa1a2d8b4485e51667a91055ceed52213b8314b06ae8c63d9c596e2cdcb332ca2b99b3a8a6e7f71d1b1e62340fb3",
+		"5e5ac356a3234cee842c6f719fa0657d35b69bcfe51e2edf5534c4276b7131",
+	}}
+	for side, rc := range []*recordConn{ci, cr} {
+		rc.lock.Lock()
+		if len(rc.writes) != len(want[side]) {
+			t.Fatalf("side %d wrote %d messages,want %d", side, len(rc.writes), len(want[side]))
+		}
+		for i, w := range want[side] {
+			if got := hex.EncodeToString(rc.writes[i]); got != w {
+				t.Errorf("side %d message %d is %s,want %s", side, i, got, w)
+			}
+		}
+		rc.lock.Unlock()
+	}
+}
@@ -0,0 +1,197 @@
+// Copyright 2017 longXboy, longxboyhi@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package log
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+)
+
+// Logger logs the entries of a module,whose level may be set apart from the global one
+type Logger struct {
+	module string
+}
+
+var (
+	levelsLock sync.RWMutex
+	// globalLevel is the level of the modules without their own and of the entries of no module
+	globalLevel  = logrus.InfoLevel
+	modules      = make(map[string]bool)
+	moduleLevels = make(map[string]logrus.Level)
+)
+
+// Module returns the logger of the module of name,the entries carry the name as their module field
+func Module(name string) *Logger {
+	levelsLock.Lock()
+	modules[name] = true
+	levelsLock.Unlock()
+	return &Logger{module: name}
+}
+
+func (l *Logger) WithField(key string, value interface{}) *Entry {
+	return &Entry{entry: logrus.WithFields(logrus.Fields{"module": l.module, key: value}), module: l.module}
+}
+
+func (l *Logger) WithFields(fields Fields) *Entry {
+	data := logrus.Fields{"module": l.module}
+	for k, v := range fields {
+		data[k] = v
+	}
+	return &Entry{entry: logrus.WithFields(data), module: l.module}
+}
+
+// enabled reports whether the entries of module are logged at level
+func enabled(module string, level logrus.Level) bool {
+	levelsLock.RLock()
+	defer levelsLock.RUnlock()
+	limit, isok := moduleLevels[module]
+	if !isok {
+		limit = globalLevel
+	}
+	return level <= limit
+}
+
+// applyLevels lets logrus pass the most verbose level in use,the rest is filtered by enabled
+func applyLevels() {
+	verbose := globalLevel
+	for _, level := range moduleLevels {
+		if level > verbose {
+			verbose = level
+		}
+	}
+	logrus.SetLevel(verbose)
+}
+
+func parseLevel(level string) (logrus.Level, error) {
+	switch level {
+	case "debug":
+		return logrus.DebugLevel, nil
+	case "info":
+		return logrus.InfoLevel, nil
+	case "warning":
+		return logrus.WarnLevel, nil
+	case "error":
+		return logrus.ErrorLevel, nil
+	}
+	return 0, errors.Errorf("invalid log level %s,must be debug,info,warning or error", level)
+}
+
+func levelName(level logrus.Level) string {
+	if level == logrus.WarnLevel {
+		return "warning"
+	}
+	return level.String()
+}
+
+// SetLevel sets the level of module,or the global level if module is empty.
+// an empty level makes the module follow the global level again
+func SetLevel(module string, level string) error {
+	levelsLock.Lock()
+	defer levelsLock.Unlock()
+	if module != "" && !modules[module] {
+		return errors.Errorf("unknown log module %s", module)
+	}
+	if level == "" {
+		if module == "" {
+			return errors.New("global log level can not be empty")
+		}
+		delete(moduleLevels, module)
+		applyLevels()
+		return nil
+	}
+	l, err := parseLevel(level)
+	if err != nil {
+		return err
+	}
+	if module == "" {
+		globalLevel = l
+	} else {
+		moduleLevels[module] = l
+	}
+	applyLevels()
+	return nil
+}
+
+// SetLevels sets the levels of the modules in levels,whose key is empty for the global level
+func SetLevels(levels map[string]string) error {
+	// check all before setting any
+	levelsLock.RLock()
+	for module, level := range levels {
+		if module != "" && !modules[module] {
+			levelsLock.RUnlock()
+			return errors.Errorf("unknown log module %s", module)
+		}
+		if _, err := parseLevel(level); err != nil && (level != "" || module == "") {
+			levelsLock.RUnlock()
+			return err
+		}
+	}
+	levelsLock.RUnlock()
+	for module, level := range levels {
+		err := SetLevel(module, level)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Levels returns the level of every module,the global level is keyed by an empty module
+func Levels() map[string]string {
+	levelsLock.RLock()
+	defer levelsLock.RUnlock()
+	levels := map[string]string{"": levelName(globalLevel)}
+	for name := range modules {
+		level, isok := moduleLevels[name]
+		if !isok {
+			level = globalLevel
+		}
+		levels[name] = levelName(level)
+	}
+	return levels
+}
+
+// LevelsHandler serves the levels by GET and sets those in the json body of PUT,
+// like {"vhost":"debug","pipe":""}
+func LevelsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+	case "PUT":
+		var levels map[string]string
+		err := json.NewDecoder(r.Body).Decode(&levels)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "invalid levels:%v", err)
+			return
+		}
+		err = SetLevels(levels)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, err.Error())
+			return
+		}
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		fmt.Fprintf(w, "method not allowed")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(Levels())
+}
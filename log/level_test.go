@@ -0,0 +1,90 @@
+// Copyright 2017 longXboy, longxboyhi@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package log
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/Sirupsen/logrus"
+)
+
+func TestModuleLevels(t *testing.T) {
+	Init(false, nil)
+	defer Init(false, nil)
+	var buf bytes.Buffer
+	logrus.SetOutput(&buf)
+	vhost := Module("test_vhost")
+	pipe := Module("test_pipe")
+	err := SetLevels(map[string]string{"test_vhost": "debug", "test_pipe": "error"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer SetLevels(map[string]string{"test_vhost": "", "test_pipe": ""})
+	vhost.WithField("host", "a.example.com").Debugln("vhost debug")
+	pipe.WithFields(Fields{"pipe": 1}).Warningln("pipe warning")
+	WithField("k", "v").Debugln("global debug")
+	out := buf.String()
+	if !strings.Contains(out, "vhost debug") || !strings.Contains(out, `module="test_vhost"`) {
+		t.Fatalf("debug of vhost not logged:%s", out)
+	}
+	if strings.Contains(out, "pipe warning") || strings.Contains(out, "global debug") {
+		t.Fatalf("entries under their level logged:%s", out)
+	}
+	if levels := Levels(); levels[""] != "info" || levels["test_vhost"] != "debug" || levels["test_pipe"] != "error" {
+		t.Fatalf("levels %v", levels)
+	}
+	if SetLevels(map[string]string{"test_vhost": "info", "nope": "debug"}) == nil {
+		t.Fatal("unknown module should fail")
+	}
+	if SetLevels(map[string]string{"test_pipe": "info", "test_vhost": "verbose"}) == nil {
+		t.Fatal("invalid level should fail")
+	}
+	if Levels()["test_pipe"] != "error" {
+		t.Fatal("failed SetLevels should set nothing")
+	}
+	if SetLevel("", "") == nil {
+		t.Fatal("empty global level should fail")
+	}
+}
+
+func TestLevelsHandler(t *testing.T) {
+	Init(false, nil)
+	defer Init(false, nil)
+	Module("test_manage")
+	defer SetLevel("test_manage", "")
+	rec := httptest.NewRecorder()
+	LevelsHandler(rec, httptest.NewRequest("PUT", "/log/levels", strings.NewReader(`{"test_manage":"warning"}`)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("put levels:%d %s", rec.Code, rec.Body.String())
+	}
+	var levels map[string]string
+	err := json.Unmarshal(rec.Body.Bytes(), &levels)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if levels["test_manage"] != "warning" {
+		t.Fatalf("levels %v", levels)
+	}
+	rec = httptest.NewRecorder()
+	LevelsHandler(rec, httptest.NewRequest("PUT", "/log/levels", strings.NewReader(`{"test_manage":"loud"}`)))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("invalid level:%d,want 400", rec.Code)
+	}
+}
@@ -18,17 +18,21 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"strings"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/getsentry/raven-go"
 )
 
 func Init(isDebug bool, fileWriter *os.File) {
+	levelsLock.Lock()
 	if isDebug {
-		logrus.SetLevel(logrus.DebugLevel)
+		globalLevel = logrus.DebugLevel
 	} else {
-		logrus.SetLevel(logrus.InfoLevel)
+		globalLevel = logrus.InfoLevel
 	}
+	applyLevels()
+	levelsLock.Unlock()
 	if fileWriter != nil {
 		logrus.SetOutput(fileWriter)
 		logrus.SetFormatter(&logrus.JSONFormatter{})
@@ -38,21 +42,58 @@ func Init(isDebug bool, fileWriter *os.File) {
 	}
 }
 
+// SinkFunc receives the entries of info level and above besides the log output,
+// such as the windows event log
+type SinkFunc func(level string, line string)
+
+type sinkHook struct {
+	sink      SinkFunc
+	formatter *logrus.TextFormatter
+}
+
+func (h *sinkHook) Levels() []logrus.Level {
+	return []logrus.Level{logrus.PanicLevel, logrus.FatalLevel, logrus.ErrorLevel, logrus.WarnLevel, logrus.InfoLevel}
+}
+
+func (h *sinkHook) Fire(e *logrus.Entry) error {
+	line, err := h.formatter.Format(e)
+	if err != nil {
+		return err
+	}
+	h.sink(e.Level.String(), strings.TrimSpace(string(line)))
+	return nil
+}
+
+// AddSink sends the entries to sink as well
+func AddSink(sink SinkFunc) {
+	logrus.AddHook(&sinkHook{sink: sink, formatter: &logrus.TextFormatter{DisableColors: true, DisableTimestamp: true}})
+}
+
 type Fields map[string]interface{}
 
 type Entry struct {
-	entry *logrus.Entry
+	entry  *logrus.Entry
+	module string
 }
 
 func (e *Entry) Infoln(args ...interface{}) {
+	if !enabled(e.module, logrus.InfoLevel) || !sampled(logrus.InfoLevel, args) {
+		return
+	}
 	e.entry.Infoln(args...)
 }
 
 func (e *Entry) Debugln(args ...interface{}) {
+	if !enabled(e.module, logrus.DebugLevel) || !sampled(logrus.DebugLevel, args) {
+		return
+	}
 	e.entry.Debugln(args...)
 }
 
 func (e *Entry) Errorln(args ...interface{}) {
+	if !enabled(e.module, logrus.ErrorLevel) || !sampled(logrus.ErrorLevel, args) {
+		return
+	}
 	m := make(map[string]string)
 	for k, v := range e.entry.Data {
 		m[k] = fmt.Sprintf("%v", v)
@@ -66,6 +107,9 @@ func (e *Entry) Fatalln(args ...interface{}) {
 }
 
 func (e *Entry) Warningln(args ...interface{}) {
+	if !enabled(e.module, logrus.WarnLevel) || !sampled(logrus.WarnLevel, args) {
+		return
+	}
 	m := make(map[string]string)
 	for k, v := range e.entry.Data {
 		m[k] = fmt.Sprintf("%v", v)
@@ -75,6 +119,9 @@ func (e *Entry) Warningln(args ...interface{}) {
 }
 
 func (e *Entry) Warnln(args ...interface{}) {
+	if !enabled(e.module, logrus.WarnLevel) || !sampled(logrus.WarnLevel, args) {
+		return
+	}
 	m := make(map[string]string)
 	for k, v := range e.entry.Data {
 		m[k] = fmt.Sprintf("%v", v)
@@ -84,22 +131,31 @@ func (e *Entry) Warnln(args ...interface{}) {
 }
 
 func WithField(key string, value interface{}) *Entry {
-	return &Entry{logrus.WithField(key, value)}
+	return &Entry{entry: logrus.WithField(key, value)}
 }
 
 func WithFields(fields Fields) *Entry {
-	entry := Entry{logrus.WithFields(logrus.Fields(fields))}
+	entry := Entry{entry: logrus.WithFields(logrus.Fields(fields))}
 	return &entry
 }
 
 func Infoln(args ...interface{}) {
+	if !enabled("", logrus.InfoLevel) || !sampled(logrus.InfoLevel, args) {
+		return
+	}
 	logrus.Infoln(args...)
 }
 
 func Debugln(args ...interface{}) {
+	if !enabled("", logrus.DebugLevel) || !sampled(logrus.DebugLevel, args) {
+		return
+	}
 	logrus.Debugln(args...)
 }
 func Errorln(args ...interface{}) {
+	if !enabled("", logrus.ErrorLevel) || !sampled(logrus.ErrorLevel, args) {
+		return
+	}
 	raven.CaptureError(errors.New(fmt.Sprintln(args...)), nil)
 	logrus.Errorln(args...)
 }
@@ -108,8 +164,14 @@ func Fatalln(args ...interface{}) {
 }
 
 func Warnln(args ...interface{}) {
+	if !enabled("", logrus.WarnLevel) || !sampled(logrus.WarnLevel, args) {
+		return
+	}
 	logrus.Warnln(args...)
 }
 func Warningln(args ...interface{}) {
+	if !enabled("", logrus.WarnLevel) || !sampled(logrus.WarnLevel, args) {
+		return
+	}
 	logrus.Warningln(args...)
 }
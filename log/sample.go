@@ -0,0 +1,151 @@
+// Copyright 2017 longXboy, longxboyhi@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package log
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// Sampling limits how many times the same message is logged per minute at each level,
+// so a flapping client or a port scanner can't flood the log.0 is unlimited.
+// a summary line tells how many were suppressed once the minute is over
+type Sampling struct {
+	Debug   int `yaml:"debug,omitempty"`
+	Info    int `yaml:"info,omitempty"`
+	Warning int `yaml:"warning,omitempty"`
+	Error   int `yaml:"error,omitempty"`
+}
+
+func (s Sampling) limits() map[logrus.Level]int {
+	limits := make(map[logrus.Level]int)
+	for level, n := range map[logrus.Level]int{logrus.DebugLevel: s.Debug, logrus.InfoLevel: s.Info, logrus.WarnLevel: s.Warning, logrus.ErrorLevel: s.Error} {
+		if n > 0 {
+			limits[level] = n
+		}
+	}
+	return limits
+}
+
+const sampleWindow = time.Minute
+
+type sampleKey struct {
+	level logrus.Level
+	msg   string
+}
+
+type sampler struct {
+	limits map[logrus.Level]int
+	lock   sync.Mutex
+	counts map[sampleKey]int
+}
+
+func newSampler(s Sampling) *sampler {
+	limits := s.limits()
+	if len(limits) == 0 {
+		return nil
+	}
+	return &sampler{limits: limits, counts: make(map[sampleKey]int)}
+}
+
+// allow counts the message and reports whether it is still under the limit of its level in this window
+func (s *sampler) allow(level logrus.Level, msg string) bool {
+	limit, isok := s.limits[level]
+	if !isok {
+		return true
+	}
+	key := sampleKey{level: level, msg: msg}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.counts[key]++
+	return s.counts[key] <= limit
+}
+
+// flush starts a new window and returns how many times each message was suppressed in the last one
+func (s *sampler) flush() map[sampleKey]int {
+	s.lock.Lock()
+	counts := s.counts
+	s.counts = make(map[sampleKey]int)
+	s.lock.Unlock()
+	suppressed := make(map[sampleKey]int)
+	for key, n := range counts {
+		if n > s.limits[key.level] {
+			suppressed[key] = n - s.limits[key.level]
+		}
+	}
+	return suppressed
+}
+
+func (s *sampler) run(stop chan struct{}) {
+	ticker := time.NewTicker(sampleWindow)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			for key, n := range s.flush() {
+				entry := logrus.WithFields(logrus.Fields{"message": key.msg, "suppressed": n})
+				summary := "repeated log lines suppressed in the last minute"
+				switch key.level {
+				case logrus.DebugLevel:
+					entry.Debugln(summary)
+				case logrus.InfoLevel:
+					entry.Infoln(summary)
+				case logrus.WarnLevel:
+					entry.Warnln(summary)
+				default:
+					entry.Errorln(summary)
+				}
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+var (
+	samplerLock sync.RWMutex
+	current     *sampler
+	stopSampler chan struct{}
+)
+
+// SetSampling replaces the sampling of the log,a zero Sampling logs everything
+func SetSampling(s Sampling) {
+	samplerLock.Lock()
+	defer samplerLock.Unlock()
+	if stopSampler != nil {
+		close(stopSampler)
+		stopSampler = nil
+	}
+	current = newSampler(s)
+	if current != nil {
+		stopSampler = make(chan struct{})
+		go current.run(stopSampler)
+	}
+}
+
+// sampled reports whether the message of args should be logged at level
+func sampled(level logrus.Level, args []interface{}) bool {
+	samplerLock.RLock()
+	s := current
+	samplerLock.RUnlock()
+	if s == nil {
+		return true
+	}
+	return s.allow(level, strings.TrimSpace(fmt.Sprintln(args...)))
+}
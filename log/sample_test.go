@@ -0,0 +1,47 @@
+// Copyright 2017 longXboy, longxboyhi@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package log
+
+import (
+	"testing"
+
+	"github.com/Sirupsen/logrus"
+)
+
+func TestSampler(t *testing.T) {
+	if newSampler(Sampling{}) != nil {
+		t.Fatal("zero sampling should not sample")
+	}
+	s := newSampler(Sampling{Warning: 2})
+	var logged int
+	for i := 0; i < 5; i++ {
+		if s.allow(logrus.WarnLevel, "accept failed!") {
+			logged++
+		}
+	}
+	if logged != 2 {
+		t.Fatalf("logged %d of 5,want 2", logged)
+	}
+	if !s.allow(logrus.WarnLevel, "another failed!") || !s.allow(logrus.InfoLevel, "accept failed!") {
+		t.Fatal("other messages and levels should not be limited")
+	}
+	suppressed := s.flush()
+	if len(suppressed) != 1 || suppressed[sampleKey{logrus.WarnLevel, "accept failed!"}] != 3 {
+		t.Fatalf("suppressed %v,want 3 of accept failed!", suppressed)
+	}
+	if !s.allow(logrus.WarnLevel, "accept failed!") {
+		t.Fatal("a new window should log again")
+	}
+}
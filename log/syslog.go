@@ -0,0 +1,305 @@
+// Copyright 2017 longXboy, longxboyhi@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package log
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+)
+
+// Syslog sends the log to a syslog daemon besides or instead of log_file
+type Syslog struct {
+	//empty for the local daemon,or udp://host:514,tcp://host:514,tls://host:6514 for a remote one
+	//which receives RFC 5424 messages,octet counted over tcp and tls
+	Addr string `yaml:"addr,omitempty"`
+	//facility the messages are sent with,default to daemon
+	Facility string `yaml:"facility,omitempty"`
+	//app name of the messages,default to the name of the program
+	Tag string `yaml:"tag,omitempty"`
+	//pem file of the ca the tls daemon is verified with,empty for the system roots
+	TrustedCert string `yaml:"trusted_cert,omitempty"`
+}
+
+var facilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5, "lpr": 6, "news": 7,
+	"uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19, "local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+// priority is the syslog severity of level,which journald shares
+func priority(level logrus.Level) int {
+	switch level {
+	case logrus.PanicLevel, logrus.FatalLevel:
+		return 2
+	case logrus.ErrorLevel:
+		return 3
+	case logrus.WarnLevel:
+		return 4
+	case logrus.InfoLevel:
+		return 6
+	default:
+		return 7
+	}
+}
+
+func allLevels() []logrus.Level {
+	return []logrus.Level{logrus.PanicLevel, logrus.FatalLevel, logrus.ErrorLevel, logrus.WarnLevel, logrus.InfoLevel, logrus.DebugLevel}
+}
+
+func sortedKeys(data logrus.Fields) []string {
+	keys := make([]string, 0, len(data))
+	for k := range data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// sdName keeps the printable ascii an SD-NAME of RFC 5424 may have
+func sdName(s string) string {
+	name := strings.Map(func(r rune) rune {
+		if r <= ' ' || r > '~' || r == '=' || r == ']' || r == '"' {
+			return '_'
+		}
+		return r
+	}, s)
+	if len(name) > 32 {
+		name = name[:32]
+	}
+	return name
+}
+
+var sdEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`)
+
+// format5424 formats e as an RFC 5424 message,the fields are the structured data of lunnel@32473,
+// 32473 being the enterprise number RFC 5612 reserves for documentation
+func format5424(e *logrus.Entry, facility int, hostname string, tag string) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "<%d>1 %s %s %s %d - ", facility*8+priority(e.Level), e.Time.Format(time.RFC3339Nano), hostname, tag, os.Getpid())
+	if len(e.Data) == 0 {
+		b.WriteString("-")
+	} else {
+		b.WriteString("[lunnel@32473")
+		for _, k := range sortedKeys(e.Data) {
+			fmt.Fprintf(&b, ` %s="%s"`, sdName(k), sdEscaper.Replace(fmt.Sprint(e.Data[k])))
+		}
+		b.WriteString("]")
+	}
+	b.WriteString(" ")
+	b.WriteString(strings.TrimSpace(e.Message))
+	return b.Bytes()
+}
+
+// format3164 formats e for the local daemon which parses the BSD format,the fields follow the message
+func format3164(e *logrus.Entry, facility int, tag string) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "<%d>%s %s[%d]: %s", facility*8+priority(e.Level), e.Time.Format(time.Stamp), tag, os.Getpid(), strings.TrimSpace(e.Message))
+	for _, k := range sortedKeys(e.Data) {
+		fmt.Fprintf(&b, " %s=%v", k, e.Data[k])
+	}
+	return b.Bytes()
+}
+
+// syslogHook writes the entries to the daemon,reconnecting once if the connection is broken
+type syslogHook struct {
+	lock   sync.Mutex
+	conn   net.Conn
+	dial   func() (net.Conn, error)
+	format func(e *logrus.Entry) []byte
+	framed bool
+}
+
+func (h *syslogHook) Levels() []logrus.Level {
+	return allLevels()
+}
+
+func (h *syslogHook) write(p []byte) error {
+	var err error
+	if h.conn == nil {
+		h.conn, err = h.dial()
+		if err != nil {
+			return err
+		}
+	}
+	h.conn.SetWriteDeadline(time.Now().Add(time.Second * 5))
+	_, err = h.conn.Write(p)
+	if err != nil {
+		h.conn.Close()
+		h.conn = nil
+	}
+	return err
+}
+
+func (h *syslogHook) Fire(e *logrus.Entry) error {
+	p := h.format(e)
+	if h.framed {
+		p = append([]byte(fmt.Sprintf("%d ", len(p))), p...)
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	err := h.write(p)
+	if err != nil {
+		err = h.write(p)
+	}
+	return err
+}
+
+func dialRemoteSyslog(conf Syslog) (func() (net.Conn, error), bool, error) {
+	u, err := url.Parse(conf.Addr)
+	if err != nil {
+		return nil, false, errors.Wrap(err, "parse syslog addr")
+	}
+	switch u.Scheme {
+	case "udp", "tcp":
+		return func() (net.Conn, error) {
+			return net.DialTimeout(u.Scheme, u.Host, time.Second*5)
+		}, u.Scheme == "tcp", nil
+	case "tls":
+		config := &tls.Config{ServerName: u.Hostname()}
+		if conf.TrustedCert != "" {
+			pem, err := ioutil.ReadFile(conf.TrustedCert)
+			if err != nil {
+				return nil, false, errors.Wrap(err, "read syslog trusted_cert")
+			}
+			config.RootCAs = x509.NewCertPool()
+			if !config.RootCAs.AppendCertsFromPEM(pem) {
+				return nil, false, errors.New("no cert found in syslog trusted_cert")
+			}
+		}
+		return func() (net.Conn, error) {
+			return tls.DialWithDialer(&net.Dialer{Timeout: time.Second * 5}, "tcp", u.Host, config)
+		}, true, nil
+	default:
+		return nil, false, errors.Errorf("invalid syslog addr %s,must be udp,tcp or tls", conf.Addr)
+	}
+}
+
+// newSyslogHook connects the daemon of conf,failing early on one which can't be reached
+func newSyslogHook(conf Syslog) (*syslogHook, error) {
+	facilityName := conf.Facility
+	if facilityName == "" {
+		facilityName = "daemon"
+	}
+	facility, isok := facilities[facilityName]
+	if !isok {
+		return nil, errors.Errorf("invalid syslog facility %s", conf.Facility)
+	}
+	tag := conf.Tag
+	if tag == "" {
+		tag = filepath.Base(os.Args[0])
+	}
+	hook := &syslogHook{}
+	if conf.Addr == "" {
+		hook.dial = dialLocalSyslog
+		hook.format = func(e *logrus.Entry) []byte {
+			return format3164(e, facility, tag)
+		}
+	} else {
+		dial, framed, err := dialRemoteSyslog(conf)
+		if err != nil {
+			return nil, err
+		}
+		hostname, err := os.Hostname()
+		if err != nil || hostname == "" {
+			hostname = "-"
+		}
+		hook.dial = dial
+		hook.framed = framed
+		hook.format = func(e *logrus.Entry) []byte {
+			return format5424(e, facility, hostname, tag)
+		}
+	}
+	// later failures reconnect
+	hook.lock.Lock()
+	conn, err := hook.dial()
+	hook.conn = conn
+	hook.lock.Unlock()
+	if err != nil {
+		return nil, errors.Wrap(err, "connect syslog")
+	}
+	return hook, nil
+}
+
+// AddSyslog sends the entries to the syslog daemon of conf as well
+func AddSyslog(conf Syslog) error {
+	hook, err := newSyslogHook(conf)
+	if err != nil {
+		return err
+	}
+	logrus.AddHook(hook)
+	return nil
+}
+
+// SyslogWriter sends messages to a syslog daemon apart from the log,for the streams of other consumers
+type SyslogWriter struct {
+	hook *syslogHook
+}
+
+// DialSyslog connects the daemon of conf for a stream of messages kept out of the log
+func DialSyslog(conf Syslog) (*SyslogWriter, error) {
+	hook, err := newSyslogHook(conf)
+	if err != nil {
+		return nil, err
+	}
+	return &SyslogWriter{hook: hook}, nil
+}
+
+// Send sends msg with the severity of level,which is debug,info,warning or error
+func (w *SyslogWriter) Send(level string, msg string) error {
+	l, err := parseLevel(level)
+	if err != nil {
+		return err
+	}
+	return w.hook.Fire(&logrus.Entry{Level: l, Time: time.Now(), Message: msg})
+}
+
+// DiscardOutput stops writing the log to stdout or log_file,for the log sent to the sinks only
+func DiscardOutput() {
+	logrus.SetOutput(ioutil.Discard)
+}
+
+// AddSinks adds the syslog and journald sinks configured,which replace stdout unless the log goes to a file too
+func AddSinks(syslog *Syslog, journald bool, toFile bool) error {
+	if syslog != nil {
+		err := AddSyslog(*syslog)
+		if err != nil {
+			return err
+		}
+	}
+	if journald {
+		err := AddJournald("")
+		if err != nil {
+			return err
+		}
+	}
+	if !toFile && (syslog != nil || journald) {
+		DiscardOutput()
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+// Copyright 2017 longXboy, longxboyhi@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package log
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+func TestFormat5424(t *testing.T) {
+	e := &logrus.Entry{Level: logrus.WarnLevel, Time: time.Date(2017, 1, 2, 3, 4, 5, 0, time.UTC), Message: "accept failed!\n",
+		Data: logrus.Fields{"err": `bad "hello"]`, "remote addr": "1.2.3.4"}}
+	got := string(format5424(e, facilities["daemon"], "host", "lunnelSer"))
+	want := `<28>1 2017-01-02T03:04:05Z host lunnelSer `
+	if !strings.HasPrefix(got, want) {
+		t.Fatalf("header of %q,want %q", got, want)
+	}
+	if !strings.HasSuffix(got, ` - [lunnel@32473 err="bad \"hello\"\]" remote_addr="1.2.3.4"] accept failed!`) {
+		t.Fatalf("structured data of %q", got)
+	}
+}
+
+func TestRemoteSyslogFramed(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	dial, framed, err := dialRemoteSyslog(Syslog{Addr: "tcp://" + lis.Addr().String()})
+	if err != nil || !framed {
+		t.Fatalf("tcp syslog framed %v,err %v", framed, err)
+	}
+	hook := &syslogHook{dial: dial, framed: framed, format: func(e *logrus.Entry) []byte {
+		return format5424(e, 3, "host", "test")
+	}}
+	go func() {
+		for i := 0; i < 2; i++ {
+			hook.Fire(&logrus.Entry{Level: logrus.InfoLevel, Time: time.Now(), Message: "line " + strconv.Itoa(i)})
+		}
+	}()
+	conn, err := lis.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for i := 0; i < 2; i++ {
+		size, err := r.ReadString(' ')
+		if err != nil {
+			t.Fatal(err)
+		}
+		n, _ := strconv.Atoi(strings.TrimSpace(size))
+		msg := make([]byte, n)
+		_, err = io.ReadFull(r, msg)
+		if err != nil || !strings.HasSuffix(string(msg), "- line "+strconv.Itoa(i)) {
+			t.Fatalf("message %q,err %v", msg, err)
+		}
+	}
+}
+
+func TestSyslogWriter(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	w, err := DialSyslog(Syslog{Addr: "udp://" + conn.LocalAddr().String(), Facility: "authpriv", Tag: "siem"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Send("warning", "CEF:0|lunnel|lunnel|2|auth_failed|Authentication failed|5|"); err != nil {
+		t.Fatal(err)
+	}
+	if w.Send("fatal", "msg") == nil {
+		t.Fatal("invalid level accepted")
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	buf := make([]byte, 1024)
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := string(buf[:n])
+	if !strings.HasPrefix(got, "<84>1 ") || !strings.Contains(got, " siem ") || !strings.HasSuffix(got, " - CEF:0|lunnel|lunnel|2|auth_failed|Authentication failed|5|") {
+		t.Fatalf("message %q", got)
+	}
+}
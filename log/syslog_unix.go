@@ -0,0 +1,125 @@
+// Copyright 2017 longXboy, longxboyhi@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !windows
+// +build !windows
+
+package log
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+)
+
+// localSyslogPaths are where the local daemon listens on linux,macOS and the BSDs
+var localSyslogPaths = []string{"/dev/log", "/var/run/syslog", "/var/run/log"}
+
+func dialLocalSyslog() (net.Conn, error) {
+	for _, path := range localSyslogPaths {
+		for _, network := range []string{"unixgram", "unix"} {
+			conn, err := net.Dial(network, path)
+			if err == nil {
+				return conn, nil
+			}
+		}
+	}
+	return nil, errors.New("no local syslog daemon found")
+}
+
+var journalSocket = "/run/systemd/journal/socket"
+
+// journalField turns key into a journal field name,which has only upper case letters,digits and underscores
+// and doesn't start with an underscore
+func journalField(key string) string {
+	name := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' {
+			return r - 'a' + 'A'
+		}
+		if r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' {
+			return r
+		}
+		return '_'
+	}, key)
+	name = strings.TrimLeft(name, "_")
+	if name == "" || name[0] >= '0' && name[0] <= '9' {
+		name = "F_" + name
+	}
+	return name
+}
+
+func writeJournalField(b *bytes.Buffer, name string, value string) {
+	if !strings.Contains(value, "\n") {
+		fmt.Fprintf(b, "%s=%s\n", name, value)
+		return
+	}
+	// values with newlines are length prefixed
+	b.WriteString(name)
+	b.WriteByte('\n')
+	binary.Write(b, binary.LittleEndian, uint64(len(value)))
+	b.WriteString(value)
+	b.WriteByte('\n')
+}
+
+func formatJournal(e *logrus.Entry, tag string) []byte {
+	var b bytes.Buffer
+	writeJournalField(&b, "MESSAGE", strings.TrimSpace(e.Message))
+	writeJournalField(&b, "PRIORITY", fmt.Sprint(priority(e.Level)))
+	writeJournalField(&b, "SYSLOG_IDENTIFIER", tag)
+	writeJournalField(&b, "SYSLOG_PID", fmt.Sprint(os.Getpid()))
+	for _, k := range sortedKeys(e.Data) {
+		writeJournalField(&b, journalField(k), fmt.Sprint(e.Data[k]))
+	}
+	return b.Bytes()
+}
+
+// journalHook sends the entries to journald in its native protocol with the fields kept
+type journalHook struct {
+	lock sync.Mutex
+	conn net.Conn
+	tag  string
+}
+
+func (h *journalHook) Levels() []logrus.Level {
+	return allLevels()
+}
+
+func (h *journalHook) Fire(e *logrus.Entry) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	_, err := h.conn.Write(formatJournal(e, h.tag))
+	return err
+}
+
+// AddJournald sends the entries to systemd-journald as well,tag is the SYSLOG_IDENTIFIER
+// defaulting to the name of the program
+func AddJournald(tag string) error {
+	if tag == "" {
+		tag = filepath.Base(os.Args[0])
+	}
+	conn, err := net.Dial("unixgram", journalSocket)
+	if err != nil {
+		return errors.Wrap(err, "connect journald")
+	}
+	logrus.AddHook(&journalHook{conn: conn, tag: tag})
+	return nil
+}
@@ -0,0 +1,65 @@
+// Copyright 2017 longXboy, longxboyhi@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !windows
+// +build !windows
+
+package log
+
+import (
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+func TestJournalField(t *testing.T) {
+	for key, want := range map[string]string{"client_id": "CLIENT_ID", "remote-addr": "REMOTE_ADDR", "_cursor": "CURSOR", "2fa": "F_2FA"} {
+		if got := journalField(key); got != want {
+			t.Fatalf("field of %s is %s,want %s", key, got, want)
+		}
+	}
+}
+
+func TestJournalHook(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal.socket")
+	lis, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Skipf("unixgram not available:%v", err)
+	}
+	defer lis.Close()
+	conn, err := net.Dial("unixgram", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hook := &journalHook{conn: conn, tag: "lunnelSer"}
+	err = hook.Fire(&logrus.Entry{Level: logrus.ErrorLevel, Time: time.Now(), Message: "pipe failed!", Data: logrus.Fields{"err": "a\nb", "client_id": "x"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4096)
+	n, err := lis.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := string(buf[:n])
+	for _, want := range []string{"MESSAGE=pipe failed!\n", "PRIORITY=3\n", "SYSLOG_IDENTIFIER=lunnelSer\n", "CLIENT_ID=x\n", "ERR\n\x03\x00\x00\x00\x00\x00\x00\x00a\nb\n"} {
+		if !strings.Contains(got, want) {
+			t.Fatalf("journal entry %q lacks %q", got, want)
+		}
+	}
+}
@@ -0,0 +1,312 @@
+// Copyright 2017 longXboy, longxboyhi@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package lunneltest runs a lunnel server and clients in process for end-to-end tests,
+// they go through the real handshake and proxy path on loopback
+package lunneltest
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/longXboy/lunnel/client"
+	"github.com/longXboy/lunnel/crypto"
+	"github.com/longXboy/lunnel/server"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// RegisterTimeout is how long a tunnel may take to be registered
+const RegisterTimeout = time.Second * 15
+
+// Server is the server started in process,its addresses are bound on loopback.
+// it relays to itself at Addr for the clients with hops
+type Server struct {
+	Addr       string
+	HttpAddr   string
+	HttpsAddr  string
+	ManageAddr string
+	//address server dials a reverse client listening on every second
+	ReverseAddr string
+	//secret_key of the aes mode
+	AesSecret string
+	//aes key selected by AesKeyID in the client hello
+	AesKeyID     string
+	AesKeySecret string
+	//public key of the noise mode
+	NoiseKey   string
+	Transports []string
+	//admin token of the manage api used by Manage,and a token of the readonly role
+	ManageToken   string
+	ReadOnlyToken string
+	//auth token of the clients of the tenant,whose manage api token is TenantApiToken
+	TenantAuthToken string
+	TenantApiToken  string
+}
+
+// HeldDomain is the domain whose http hosts are held by server until approved
+const HeldDomain = "held.localhost"
+
+var (
+	startOnce sync.Once
+	started   *Server
+	startErr  error
+)
+
+func freePort() (int, error) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, errors.Wrap(err, "listen")
+	}
+	defer lis.Close()
+	return lis.Addr().(*net.TCPAddr).Port, nil
+}
+
+// StartServer starts the server listening in the transports with ephemeral ports and logging to logFile.
+// the server lives as long as the process,later calls return the server started by the first one
+func StartServer(transports []string, logFile string) (*Server, error) {
+	startOnce.Do(func() {
+		started, startErr = startServer(transports, logFile)
+	})
+	return started, startErr
+}
+
+func startServer(transports []string, logFile string) (*Server, error) {
+	var ports [5]int
+	for i := range ports {
+		port, err := freePort()
+		if err != nil {
+			return nil, err
+		}
+		ports[i] = port
+	}
+	noiseKey, err := crypto.GenerateNoiseKey()
+	if err != nil {
+		return nil, errors.Wrap(err, "generate noise key")
+	}
+	random := rand.New(rand.NewSource(time.Now().UnixNano()))
+	var secrets [6]string
+	for i := range secrets {
+		secrets[i] = strconv.FormatInt(random.Int63(), 36)
+	}
+	s := &Server{
+		Addr:            fmt.Sprintf("127.0.0.1:%d", ports[0]),
+		HttpAddr:        fmt.Sprintf("127.0.0.1:%d", ports[1]),
+		HttpsAddr:       fmt.Sprintf("127.0.0.1:%d", ports[2]),
+		ManageAddr:      fmt.Sprintf("127.0.0.1:%d", ports[3]),
+		ReverseAddr:     fmt.Sprintf("127.0.0.1:%d", ports[4]),
+		AesSecret:       secrets[0],
+		AesKeyID:        "lunneltest",
+		AesKeySecret:    secrets[1],
+		NoiseKey:        crypto.EncodeNoiseKey(noiseKey.Public),
+		Transports:      transports,
+		ManageToken:     secrets[2],
+		ReadOnlyToken:   secrets[3],
+		TenantAuthToken: secrets[4],
+		TenantApiToken:  secrets[5],
+	}
+	conf := fmt.Sprintf(`ip: 127.0.0.1
+port: %d
+http_port: %d
+https_port: %d
+manage_port: %d
+server_domain: localhost
+transports: [%s]
+aes:
+  secret_key: %s
+  keys:
+    %s: %s
+noise:
+  private_key: %s
+log_file: %s
+reverse_clients:
+  - addr: 127.0.0.1:%d
+    interval: 1
+relay:
+  targets: ["127.0.0.1:%d"]
+write_timeout: 2
+manage_token: %s
+api_tokens:
+  - token: %s
+    role: readonly
+tenants:
+  lunneltest:
+    tokens: [%s]
+    api_token: %s
+approval:
+  hosts: ["*.%s"]
+`, ports[0], ports[1], ports[2], ports[3], strings.Join(transports, ","), s.AesSecret, s.AesKeyID, s.AesKeySecret,
+		crypto.EncodeNoiseKey(noiseKey.Private), logFile, ports[4], ports[0],
+		s.ManageToken, s.ReadOnlyToken, s.TenantAuthToken, s.TenantApiToken, HeldDomain)
+	err = server.Start([]byte(conf), "yaml")
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// StartTestServer starts the server shared by the tests of the binary in tcp,its logs are discarded
+func StartTestServer(tb testing.TB) *Server {
+	s, err := StartServer([]string{"tcp"}, os.DevNull)
+	if err != nil {
+		tb.Fatalf("start server failed!err:=%v", err)
+	}
+	return s
+}
+
+// Manage makes a request to the manage api of the server as admin
+func (s *Server) Manage(method string, path string, body io.Reader) (*http.Response, error) {
+	return s.ManageAs(s.ManageToken, method, path, body)
+}
+
+// ManageAs makes a request to the manage api with token,no token is sent if it is empty
+func (s *Server) ManageAs(token string, method string, path string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest(method, "http://"+s.ManageAddr+path, body)
+	if err != nil {
+		return nil, errors.Wrap(err, "new request")
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return http.DefaultClient.Do(req)
+}
+
+// ClientConfig connects to the server in the first transport and aes mode,
+// any encrypt mode but tls may be selected with the keys filled
+func (s *Server) ClientConfig() client.Config {
+	return client.Config{
+		ServerAddr:  s.Addr,
+		Transport:   s.Transports[0],
+		EncryptMode: "aes",
+		Aes:         client.Aes{SecretKey: s.AesSecret},
+		Noise:       client.Noise{ServerKey: s.NoiseKey},
+	}
+}
+
+// Client is a client running in the background until it is closed
+type Client struct {
+	*client.Client
+	serverAddr string
+	cancel     context.CancelFunc
+	done       chan error
+}
+
+// StartClient runs a client of conf,the tunnels of conf are registered once WaitTunnel returns for them
+func StartClient(conf client.Config) (*Client, error) {
+	cli, err := client.New(conf)
+	if err != nil {
+		return nil, errors.Wrap(err, "create client")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &Client{Client: cli, serverAddr: conf.ServerAddr, cancel: cancel, done: make(chan error, 1)}
+	go func() {
+		c.done <- cli.Run(ctx)
+	}()
+	return c, nil
+}
+
+// StartTestClient runs a client of the server with the tunnels and waits for all of them registered,
+// the client is closed when the test finishes
+func StartTestClient(tb testing.TB, s *Server, tunnels map[string]client.TunnelConfig) (*Client, map[string]string) {
+	conf := s.ClientConfig()
+	conf.Tunnels = tunnels
+	c, err := StartClient(conf)
+	if err != nil {
+		tb.Fatalf("start client failed!err:=%v", err)
+	}
+	tb.Cleanup(c.Close)
+	addrs := make(map[string]string, len(tunnels))
+	for len(addrs) < len(tunnels) {
+		name, addr, err := c.nextRegistered()
+		if err != nil {
+			tb.Fatal(err)
+		}
+		if _, isok := tunnels[name]; isok {
+			addrs[name] = addr
+		}
+	}
+	return c, addrs
+}
+
+// nextRegistered drains the events of the client until a tunnel is registered
+func (c *Client) nextRegistered() (string, string, error) {
+	timeout := time.After(RegisterTimeout)
+	for {
+		select {
+		case ev := <-c.Events():
+			if ev.Type != client.EventTunnelRegistered {
+				continue
+			}
+			addr, err := c.dialAddr(ev.Tunnel.PublicURL)
+			return ev.Tunnel.Name, addr, err
+		case err := <-c.done:
+			c.done <- err
+			return "", "", errors.Wrap(err, "client stopped")
+		case <-timeout:
+			return "", "", errors.Errorf("no tunnel registered in %v", RegisterTimeout)
+		}
+	}
+}
+
+// WaitTunnel waits for the tunnel registered and returns the address its visitors dial,
+// the events of the other tunnels are dropped meanwhile
+func (c *Client) WaitTunnel(name string) (string, error) {
+	for {
+		registered, addr, err := c.nextRegistered()
+		if err != nil {
+			return "", errors.Wrapf(err, "wait tunnel %s", name)
+		}
+		if registered == name {
+			return addr, nil
+		}
+	}
+}
+
+// dialAddr reaches the port of the public url through the host of server_addr,
+// the domain server names the tunnel with may not resolve
+func (c *Client) dialAddr(publicURL string) (string, error) {
+	u, err := url.Parse(publicURL)
+	if err != nil {
+		return "", errors.Wrap(err, "parse public url")
+	}
+	serverHost, _, err := net.SplitHostPort(c.serverAddr)
+	if err != nil {
+		return "", errors.Wrap(err, "split server_addr")
+	}
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	return net.JoinHostPort(serverHost, port), nil
+}
+
+// Close stops the client and waits for it to disconnect
+func (c *Client) Close() {
+	c.cancel()
+	err := <-c.done
+	c.done <- err
+}
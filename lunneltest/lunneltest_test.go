@@ -0,0 +1,1050 @@
+// Copyright 2017 longXboy, longxboyhi@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lunneltest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/longXboy/lunnel/client"
+	"github.com/longXboy/lunnel/msg"
+	"github.com/satori/go.uuid"
+	"golang.org/x/net/proxy"
+)
+
+func serveEcho(t *testing.T) string {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { lis.Close() })
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	return "tcp://" + lis.Addr().String()
+}
+
+func echo(t *testing.T, addr string) {
+	conn, err := net.DialTimeout("tcp", addr, time.Second*5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	echoOver(t, conn)
+}
+
+func echoOver(t *testing.T, conn net.Conn) {
+	defer conn.Close()
+	echoOnce(t, conn)
+}
+
+// echoOnce sends hello over conn and reads it back,leaving conn open
+func echoOnce(t *testing.T, conn net.Conn) {
+	conn.SetDeadline(time.Now().Add(time.Second * 5))
+	_, err := conn.Write([]byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(conn, buf)
+	if err != nil || string(buf) != "hello" {
+		t.Fatalf("echo %q: %v", buf, err)
+	}
+}
+
+// expectClosed fails the test unless server closes conn without sending anything,
+// a conn still open is taken as accepted
+func expectClosed(t *testing.T, conn net.Conn, what string) {
+	conn.SetReadDeadline(time.Now().Add(time.Second * 3))
+	n, err := conn.Read(make([]byte, 1))
+	if nerr, isok := err.(net.Error); isok && nerr.Timeout() {
+		t.Fatalf("%s accepted", what)
+	}
+	if n > 0 {
+		t.Fatalf("%s answered", what)
+	}
+}
+
+func TestTcpTunnel(t *testing.T) {
+	s := StartTestServer(t)
+	local := serveEcho(t)
+	_, addrs := StartTestClient(t, s, map[string]client.TunnelConfig{"echo": {Schema: "tcp", LocalAddr: local}})
+	echo(t, addrs["echo"])
+}
+
+func TestAddTunnel(t *testing.T) {
+	s := StartTestServer(t)
+	local := serveEcho(t)
+	c, _ := StartTestClient(t, s, map[string]client.TunnelConfig{"first": {Schema: "tcp", LocalAddr: local}})
+	err := c.AddTunnel("second", client.TunnelConfig{Schema: "tcp", LocalAddr: local})
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr, err := c.WaitTunnel("second")
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo(t, addr)
+	c.RemoveTunnel("second")
+	for start := time.Now(); ; time.Sleep(time.Millisecond * 50) {
+		conn, err := net.DialTimeout("tcp", addr, time.Second)
+		if err != nil {
+			break
+		}
+		conn.Close()
+		if time.Since(start) > time.Second*5 {
+			t.Fatal("removed tunnel still accepts connections")
+		}
+	}
+}
+
+func TestDebugConnections(t *testing.T) {
+	s := StartTestServer(t)
+	local := serveEcho(t)
+	_, addrs := StartTestClient(t, s, map[string]client.TunnelConfig{"debug": {Schema: "tcp", LocalAddr: local}})
+	conn, err := net.DialTimeout("tcp", addrs["debug"], time.Second*5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second * 5))
+	_, err = conn.Write([]byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = io.ReadFull(conn, make([]byte, 5))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := s.Manage("GET", "/api/v1/debug/connections", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var dump []struct {
+		ID    string
+		Pipes []struct{ ID string }
+		Edges []struct {
+			StreamID string
+			Tunnel   string
+			BytesIn  uint64
+			BytesOut uint64
+		}
+	}
+	err = json.NewDecoder(resp.Body).Decode(&dump)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range dump {
+		for _, e := range c.Edges {
+			if e.Tunnel == "debug" && e.BytesIn == 5 && e.BytesOut == 5 && strings.Contains(e.StreamID, "/") && c.ID != "" && len(c.Pipes) > 0 {
+				return
+			}
+		}
+	}
+	t.Fatalf("connection of tunnel debug not in dump %+v", dump)
+}
+
+func TestHttpMetrics(t *testing.T) {
+	s := StartTestServer(t)
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { lis.Close() })
+	go http.Serve(lis, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+		io.WriteString(w, "body")
+	}))
+	_, addrs := StartTestClient(t, s, map[string]client.TunnelConfig{"metered": {Schema: "http", Host: "metered.localhost", LocalAddr: "http://" + lis.Addr().String()}})
+	// one keep-alive connection carries all the requests
+	hc := &http.Client{Transport: &http.Transport{MaxIdleConnsPerHost: 1}}
+	for _, path := range []string{"/", "/missing", "/", "/"} {
+		req, err := http.NewRequest("GET", "http://"+addrs["metered"]+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Host = "metered.localhost"
+		resp, err := hc.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}
+	resp, err := s.Manage("GET", "/metrics", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`tunnel="metered",class="2xx"} 3`,
+		`tunnel="metered",class="4xx"} 1`,
+		`tunnel="metered"} 4`,
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Fatalf("metrics miss %s:\n%s", want, body)
+		}
+	}
+}
+
+func TestLocalDialMetrics(t *testing.T) {
+	s := StartTestServer(t)
+	conf := s.ClientConfig()
+	// dial stats are reported along with the pings
+	conf.Health.Interval = 1
+	conf.Tunnels = map[string]client.TunnelConfig{"dialed": {Schema: "tcp", LocalAddr: serveEcho(t)}}
+	c, err := StartClient(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(c.Close)
+	_, addr, err := c.nextRegistered()
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo(t, addr)
+	echo(t, addr)
+	want := regexp.MustCompile(`lunnel_local_dial_seconds_count{client_id="[^"]+",tunnel="dialed"} 2`)
+	for start := time.Now(); ; time.Sleep(time.Millisecond * 100) {
+		resp, err := s.Manage("GET", "/metrics", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want.Match(body) {
+			return
+		}
+		if time.Since(start) > time.Second*5 {
+			t.Fatalf("metrics miss %s:\n%s", want, body)
+		}
+	}
+}
+
+func TestRaceTransport(t *testing.T) {
+	s := StartTestServer(t)
+	conf := s.ClientConfig()
+	// server doesn't listen in kcp,like udp being blocked
+	conf.Transport = "race"
+	conf.Race = client.Race{Transports: []string{"kcp", "tcp"}, Prefer: "kcp", Grace: 100}
+	conf.Tunnels = map[string]client.TunnelConfig{"raced": {Schema: "tcp", LocalAddr: serveEcho(t)}}
+	start := time.Now()
+	c, err := StartClient(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(c.Close)
+	_, addr, err := c.nextRegistered()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second*5 {
+		t.Fatalf("registered in %v,the blocked transport was waited for", elapsed)
+	}
+	if transport := c.Status().Transport; transport != "tcp" {
+		t.Fatalf("control in %s,want tcp", transport)
+	}
+	echo(t, addr)
+}
+
+func TestPipeTransportFallback(t *testing.T) {
+	s := StartTestServer(t)
+	conf := s.ClientConfig()
+	// server doesn't listen in ws,the pipes are created in the transport of the control
+	conf.PipeTransport = "ws"
+	conf.Tunnels = map[string]client.TunnelConfig{"fallback": {Schema: "tcp", LocalAddr: serveEcho(t)}}
+	c, err := StartClient(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(c.Close)
+	_, addr, err := c.nextRegistered()
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo(t, addr)
+	if st := c.Status(); st.PipeTransport != "" {
+		t.Fatalf("pipes in %s,want the transport of the control", st.PipeTransport)
+	}
+}
+
+func TestBandwidthWindows(t *testing.T) {
+	s := StartTestServer(t)
+	conf := s.ClientConfig()
+	// far beyond the bdp of loopback,so the receive buffer asked of server is capped by its max_receive_buffer
+	conf.Bandwidth.Up = 100000000
+	conf.Tunnels = map[string]client.TunnelConfig{"bandwidth": {Schema: "tcp", LocalAddr: serveEcho(t)}}
+	c, err := StartClient(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(c.Close)
+	_, addr, err := c.nextRegistered()
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo(t, addr)
+	resp, err := s.Manage("GET", "/api/v1/debug/connections", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var dump []struct {
+		ClientID string
+		Pipes    []struct{ MaxReceiveBuffer int }
+	}
+	err = json.NewDecoder(resp.Body).Decode(&dump)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientID := c.Status().ClientID
+	for _, ctl := range dump {
+		if ctl.ClientID != clientID {
+			continue
+		}
+		if len(ctl.Pipes) == 0 {
+			t.Fatal("no pipe of client")
+		}
+		for _, p := range ctl.Pipes {
+			if p.MaxReceiveBuffer != 16<<20 {
+				t.Fatalf("receive buffer of pipe is %d,want %d", p.MaxReceiveBuffer, 16<<20)
+			}
+		}
+		return
+	}
+	t.Fatalf("control of client %s not found", clientID)
+}
+
+func TestOverloadMetrics(t *testing.T) {
+	s := StartTestServer(t)
+	resp, err := s.Manage("GET", "/metrics", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the test server is far from its limits
+	for _, want := range []string{
+		"lunnel_overload_refusing_classes 0\n",
+		`lunnel_overload_refused_total{qos="bulk"} 0`,
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Fatalf("metrics miss %s:\n%s", want, body)
+		}
+	}
+}
+
+func TestReverse(t *testing.T) {
+	s := StartTestServer(t)
+	conf := s.ClientConfig()
+	// the client can't dial out,server dials the control and pipes to it
+	conf.ServerAddr = "127.0.0.1:1"
+	conf.Reverse.Listen = s.ReverseAddr
+	conf.Reverse.AllowIPs = []string{"127.0.0.1"}
+	conf.Tunnels = map[string]client.TunnelConfig{"reverse": {Schema: "tcp", LocalAddr: serveEcho(t)}}
+	c, err := StartClient(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(c.Close)
+	_, addr, err := c.nextRegistered()
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo(t, addr)
+}
+
+func TestHops(t *testing.T) {
+	s := StartTestServer(t)
+	conf := s.ClientConfig()
+	// through server relaying to itself twice
+	conf.Hops = []client.Hop{{Addr: s.Addr}, {Addr: s.Addr}}
+	conf.Tunnels = map[string]client.TunnelConfig{"hops": {Schema: "tcp", LocalAddr: serveEcho(t)}}
+	c, err := StartClient(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(c.Close)
+	_, addr, err := c.nextRegistered()
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo(t, addr)
+	resp, err := s.Manage("GET", "/metrics", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the control and a pipe at least,each relayed twice
+	m := regexp.MustCompile(`lunnel_relaying_conns (\d+)`).FindSubmatch(body)
+	if m == nil {
+		t.Fatal("no lunnel_relaying_conns in metrics")
+	}
+	if relaying, _ := strconv.Atoi(string(m[1])); relaying < 4 {
+		t.Fatalf("lunnel_relaying_conns is %d,want at least 4", relaying)
+	}
+}
+
+func TestVisitors(t *testing.T) {
+	s := StartTestServer(t)
+	_, addrs := StartTestClient(t, s, map[string]client.TunnelConfig{
+		"visited-tcp":  {Schema: "tcp", LocalAddr: serveEcho(t)},
+		"visited-stcp": {Schema: "stcp", LocalAddr: serveEcho(t), Psk: "visit-psk"},
+	})
+	var listens [3]string
+	for i := range listens {
+		port, err := freePort()
+		if err != nil {
+			t.Fatal(err)
+		}
+		listens[i] = fmt.Sprintf("127.0.0.1:%d", port)
+	}
+	_, port, _ := net.SplitHostPort(addrs["visited-tcp"])
+	conf := s.ClientConfig()
+	conf.Tunnels = map[string]client.TunnelConfig{"visitor": {Schema: "tcp", LocalAddr: serveEcho(t)}}
+	conf.Visitors = map[string]client.Visitor{
+		"tcp":    {Listen: listens[0], Addr: "tcp://localhost:" + port},
+		"stcp":   {Listen: listens[1], Stcp: "visited-stcp", Psk: "visit-psk"},
+		"socks5": {Listen: listens[2], Socks5: true, Psk: "visit-psk"},
+	}
+	c, err := StartClient(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(c.Close)
+	if _, _, err = c.nextRegistered(); err != nil {
+		t.Fatal(err)
+	}
+	echo(t, listens[0])
+	echo(t, listens[1])
+	dialer, err := proxy.SOCKS5("tcp", listens[2], nil, proxy.Direct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dialer.Dial("tcp", "visited-stcp.stcp:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	echoOver(t, conn)
+	_, err = dialer.Dial("tcp", "missing.stcp:1")
+	if err == nil {
+		t.Fatal("visited a missing stcp tunnel")
+	}
+}
+
+func TestHostTemplate(t *testing.T) {
+	s := StartTestServer(t)
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { lis.Close() })
+	go http.Serve(lis, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Host)
+	}))
+	conf := s.ClientConfig()
+	conf.Hostname = "Device_01"
+	conf.Tunnels = map[string]client.TunnelConfig{"web": {Schema: "http", Host: "{hostname}-{tunnel}.localhost", LocalAddr: "http://" + lis.Addr().String()}}
+	c, err := StartClient(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(c.Close)
+	_, addr, err := c.nextRegistered()
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest("GET", "http://"+addr+"/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Host = "device-01-web.localhost"
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || string(body) != "device-01-web.localhost" {
+		t.Fatalf("status %d body %q", resp.StatusCode, body)
+	}
+}
+
+func TestEphemeralTunnels(t *testing.T) {
+	s := StartTestServer(t)
+	c, _ := StartTestClient(t, s, map[string]client.TunnelConfig{"ephemeral-base": {Schema: "tcp", LocalAddr: serveEcho(t)}})
+	create := func(name string, ttl int) string {
+		body := fmt.Sprintf(`{"client_id":%q,"name":%q,"owner":"pr-42","ttl":%d,"tunnel":{"schema":"tcp","local":%q}}`, c.Status().ClientID, name, ttl, serveEcho(t))
+		resp, err := s.Manage("POST", "/api/v1/ephemeral", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var created struct {
+			ID string `json:"id"`
+		}
+		if resp.StatusCode != http.StatusCreated || json.NewDecoder(resp.Body).Decode(&created) != nil {
+			t.Fatalf("create ephemeral tunnel status %d", resp.StatusCode)
+		}
+		return created.ID
+	}
+	removed := func(name string) {
+		timeout := time.After(RegisterTimeout)
+		for {
+			select {
+			case ev := <-c.Events():
+				if ev.Type == client.EventTunnelRemoved && ev.Tunnel.Name == name {
+					return
+				}
+			case <-timeout:
+				t.Fatalf("%s not removed", name)
+			}
+		}
+	}
+	id := create("preview", 3600)
+	name, addr, err := c.nextRegistered()
+	if err != nil || name != "preview" {
+		t.Fatalf("registered %s:%v", name, err)
+	}
+	echo(t, addr)
+	resp, err := s.Manage("GET", "/api/v1/ephemeral?owner=pr-42", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var list []struct {
+		ID     string `json:"id"`
+		Public string `json:"public"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&list)
+	resp.Body.Close()
+	if err != nil || len(list) != 1 || list[0].ID != id || list[0].Public == "" {
+		t.Fatalf("listed %+v:%v", list, err)
+	}
+	resp, err = s.Manage("DELETE", "/api/v1/ephemeral/"+id, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("delete ephemeral tunnel status %d", resp.StatusCode)
+	}
+	removed("preview")
+
+	create("expiring", 1)
+	if name, _, err = c.nextRegistered(); err != nil || name != "expiring" {
+		t.Fatalf("registered %s:%v", name, err)
+	}
+	removed("expiring")
+}
+
+func TestAuditLog(t *testing.T) {
+	s := StartTestServer(t)
+	resp, err := s.Manage("DELETE", "/api/v1/ephemeral/audited", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	resp, err = s.Manage("GET", "/api/v1/audit?kind=api&limit=1000", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var records []struct {
+		Action string
+		Result string
+		Hash   string
+	}
+	err = json.NewDecoder(resp.Body).Decode(&records)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, r := range records {
+		if r.Action == "DELETE /api/v1/ephemeral/audited" && r.Result == "404" && r.Hash != "" {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("delete not audited in %+v", records)
+	}
+	resp, err = s.Manage("GET", "/api/v1/audit/verify", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var v struct {
+		Records int
+		Valid   bool
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&v); err != nil || !v.Valid || v.Records == 0 {
+		t.Fatalf("verify %+v:%v", v, err)
+	}
+}
+
+func TestForgedPipes(t *testing.T) {
+	s := StartTestServer(t)
+	c, _ := StartTestClient(t, s, map[string]client.TunnelConfig{"forged": {Schema: "tcp", LocalAddr: serveEcho(t)}})
+	clientID, err := uuid.FromString(c.Status().ClientID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain := false
+	refused := func(name string, phs msg.PipeClientHello) {
+		conn, err := net.DialTimeout("tcp", s.Addr, time.Second*5)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		phs.ClientID = clientID
+		phs.Once = uuid.NewV4()
+		err = msg.WriteMsg(conn, msg.TypePipeClientHello, phs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// an accepted pipe stays open for the streams of server
+		expectClosed(t, conn, name+" pipe")
+	}
+	refused("unencrypted", msg.PipeClientHello{Options: &msg.PipeOptions{Encrypt: &plain}})
+	refused("visit", msg.PipeClientHello{Visit: true})
+	refused("bad mac", msg.PipeClientHello{Options: &msg.PipeOptions{Encrypt: &plain}, Mac: make([]byte, 32)})
+}
+
+func TestPskPreamble(t *testing.T) {
+	s := StartTestServer(t)
+	_, addrs := StartTestClient(t, s, map[string]client.TunnelConfig{"psk": {Schema: "tcp", LocalAddr: serveEcho(t), Psk: "psk-of-tunnel"}})
+	dial := func(preamble string) net.Conn {
+		conn, err := net.DialTimeout("tcp", addrs["psk"], time.Second*5)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = conn.Write([]byte(preamble))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+	wrong := dial("wrong-psk\nhello")
+	defer wrong.Close()
+	expectClosed(t, wrong, "wrong psk")
+	echoOver(t, dial("psk-of-tunnel\n"))
+}
+
+func TestApprovalHold(t *testing.T) {
+	s := StartTestServer(t)
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { lis.Close() })
+	go http.Serve(lis, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "approved")
+	}))
+	host := "app." + HeldDomain
+	conf := s.ClientConfig()
+	conf.Tunnels = map[string]client.TunnelConfig{"held": {Schema: "http", Host: host, LocalAddr: "http://" + lis.Addr().String()}}
+	c, err := StartClient(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(c.Close)
+	// an idle connection of the earlier tests stays with the tunnel of its first request
+	hc := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	get := func() int {
+		req, err := http.NewRequest("GET", "http://"+s.HttpAddr+"/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Host = host
+		resp, err := hc.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	var id string
+	for start := time.Now(); id == ""; time.Sleep(time.Millisecond * 100) {
+		if time.Since(start) > RegisterTimeout {
+			t.Fatal("tunnel not held for approval")
+		}
+		resp, err := s.Manage("GET", "/api/v1/pending", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var pending []struct {
+			ID   string
+			Name string
+		}
+		err = json.NewDecoder(resp.Body).Decode(&pending)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, p := range pending {
+			if p.Name == "held" {
+				id = p.ID
+			}
+		}
+	}
+	if status := get(); status == http.StatusOK {
+		t.Fatal("held tunnel served before approved")
+	}
+	resp, err := s.ManageAs(s.ReadOnlyToken, "POST", "/api/v1/pending/"+id+"/approve", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("readonly approve status %d", resp.StatusCode)
+	}
+	resp, err = s.Manage("POST", "/api/v1/pending/"+id+"/approve", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("approve status %d", resp.StatusCode)
+	}
+	if _, err = c.WaitTunnel("held"); err != nil {
+		t.Fatal(err)
+	}
+	if status := get(); status != http.StatusOK {
+		t.Fatalf("approved tunnel status %d", status)
+	}
+}
+
+func TestTenantPartition(t *testing.T) {
+	s := StartTestServer(t)
+	other, _ := StartTestClient(t, s, map[string]client.TunnelConfig{"untenanted": {Schema: "tcp", LocalAddr: serveEcho(t)}})
+	conf := s.ClientConfig()
+	conf.AuthToken = s.TenantAuthToken
+	conf.Tunnels = map[string]client.TunnelConfig{"tenanted": {Schema: "tcp", LocalAddr: serveEcho(t)}}
+	c, err := StartClient(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(c.Close)
+	if _, err = c.WaitTunnel("tenanted"); err != nil {
+		t.Fatal(err)
+	}
+	status := func(method string, path string) int {
+		resp, err := s.ManageAs(s.TenantApiToken, method, path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	resp, err := s.ManageAs(s.TenantApiToken, "GET", "/api/v1/tunnels?limit=1000", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var list struct {
+		Tunnels []struct{ Name string }
+	}
+	err = json.NewDecoder(resp.Body).Decode(&list)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, tunnel := range list.Tunnels {
+		names = append(names, tunnel.Name)
+	}
+	if len(names) != 1 || names[0] != "tenanted" {
+		t.Fatalf("tenant listed tunnels %v", names)
+	}
+	otherID := other.Status().ClientID
+	if code := status("GET", "/api/v1/clients/"+otherID); code != http.StatusNotFound {
+		t.Fatalf("client of no tenant looked up by the tenant,status %d", code)
+	}
+	if code := status("DELETE", "/api/v1/clients/"+otherID); code != http.StatusNotFound {
+		t.Fatalf("client of no tenant kicked by the tenant,status %d", code)
+	}
+	if code := status("GET", "/api/v1/clients/"+c.Status().ClientID); code != http.StatusOK {
+		t.Fatalf("client of the tenant looked up by it,status %d", code)
+	}
+	if code := status("GET", "/metrics"); code != http.StatusForbidden {
+		t.Fatalf("metrics of all tenants read by the tenant,status %d", code)
+	}
+}
+
+func TestManageRoles(t *testing.T) {
+	s := StartTestServer(t)
+	cases := []struct {
+		who    string
+		token  string
+		method string
+		path   string
+		status int
+	}{
+		{"none", "", "GET", "/api/v1/tunnels", http.StatusUnauthorized},
+		{"wrong", "wrong-token", "GET", "/api/v1/tunnels", http.StatusUnauthorized},
+		{"readonly", s.ReadOnlyToken, "GET", "/api/v1/tunnels", http.StatusOK},
+		{"readonly", s.ReadOnlyToken, "POST", "/api/v1/ephemeral", http.StatusForbidden},
+		{"readonly", s.ReadOnlyToken, "DELETE", "/api/v1/clients/lunneltest", http.StatusForbidden},
+		{"readonly", s.ReadOnlyToken, "GET", "/api/v1/audit", http.StatusForbidden},
+		{"tenant", s.TenantApiToken, "GET", "/api/v1/log/levels", http.StatusForbidden},
+		{"admin", s.ManageToken, "GET", "/api/v1/audit", http.StatusOK},
+		{"admin", s.ManageToken, "GET", "/api/v1/log/levels", http.StatusOK},
+	}
+	for _, c := range cases {
+		resp, err := s.ManageAs(c.token, c.method, c.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != c.status {
+			t.Errorf("%s %s as %s,status %d,want %d", c.method, c.path, c.who, resp.StatusCode, c.status)
+		}
+	}
+}
+
+func TestAesKeyIds(t *testing.T) {
+	s := StartTestServer(t)
+	start := func(secret string, keyId string) *Client {
+		conf := s.ClientConfig()
+		conf.Aes = client.Aes{SecretKey: secret, KeyId: keyId}
+		conf.Tunnels = map[string]client.TunnelConfig{"keyed": {Schema: "tcp", LocalAddr: serveEcho(t)}}
+		c, err := StartClient(conf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(c.Close)
+		return c
+	}
+	keyed := start(s.AesKeySecret, s.AesKeyID)
+	addr, err := keyed.WaitTunnel("keyed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.DialTimeout("tcp", addr, time.Second*5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	echoOver(t, conn)
+
+	// the default secret is not the key of the key id
+	wrong := start(s.AesSecret, s.AesKeyID)
+	timeout := time.After(time.Second * 3)
+	for waited := false; !waited; {
+		select {
+		case ev := <-wrong.Events():
+			if ev.Type == client.EventTunnelRegistered {
+				t.Fatal("tunnel registered with the secret of another key")
+			}
+		case <-timeout:
+			waited = true
+		}
+	}
+
+	unknown := start(s.AesKeySecret, "unknown-key")
+	select {
+	case err = <-unknown.done:
+		unknown.done <- err
+		if err == nil || !strings.Contains(err.Error(), "server not support aes key id") {
+			t.Fatalf("client of unknown aes key id stopped by %v", err)
+		}
+	case <-time.After(RegisterTimeout):
+		t.Fatal("client of unknown aes key id not refused")
+	}
+}
+
+func TestKickClient(t *testing.T) {
+	s := StartTestServer(t)
+	c, addrs := StartTestClient(t, s, map[string]client.TunnelConfig{"kicked": {Schema: "tcp", LocalAddr: serveEcho(t)}})
+	conn, err := net.DialTimeout("tcp", addrs["kicked"], time.Second*5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	echoOnce(t, conn)
+	resp, err := s.Manage("DELETE", "/api/v1/clients/"+c.Status().ClientID+"?reason=lunneltest", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("kick status %d", resp.StatusCode)
+	}
+	timeout := time.After(RegisterTimeout)
+	for disconnected := false; !disconnected; {
+		select {
+		case ev := <-c.Events():
+			disconnected = ev.Type == client.EventDisconnected
+		case <-timeout:
+			t.Fatal("kicked client not disconnected")
+		}
+	}
+	expectClosed(t, conn, "connection of kicked client")
+}
+
+func TestMaintenance(t *testing.T) {
+	s := StartTestServer(t)
+	c, addrs := StartTestClient(t, s, map[string]client.TunnelConfig{"maintained": {Schema: "tcp", LocalAddr: serveEcho(t)}})
+	// echoed tells whether a new connection is proxied,the switch reaches server asynchronously
+	echoed := func() bool {
+		conn, err := net.DialTimeout("tcp", addrs["maintained"], time.Second*5)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(time.Second * 3))
+		buf := make([]byte, 5)
+		if _, err = conn.Write([]byte("hello")); err == nil {
+			_, err = io.ReadFull(conn, buf)
+		}
+		if nerr, isok := err.(net.Error); isok && nerr.Timeout() {
+			t.Fatal("connection neither proxied nor closed")
+		}
+		return err == nil && string(buf) == "hello"
+	}
+	waitEchoed := func(want bool) {
+		for start := time.Now(); echoed() != want; time.Sleep(time.Millisecond * 100) {
+			if time.Since(start) > RegisterTimeout {
+				t.Fatalf("connections proxied %t after maintenance switched", !want)
+			}
+		}
+	}
+	waitEchoed(true)
+	if err := c.SetMaintenance(true); err != nil {
+		t.Fatal(err)
+	}
+	waitEchoed(false)
+	if err := c.SetMaintenance(false); err != nil {
+		t.Fatal(err)
+	}
+	waitEchoed(true)
+}
+
+func TestConnTimeouts(t *testing.T) {
+	s := StartTestServer(t)
+	_, addrs := StartTestClient(t, s, map[string]client.TunnelConfig{
+		"idle":     {Schema: "tcp", LocalAddr: serveEcho(t), IdleTimeout: 1},
+		"lifetime": {Schema: "tcp", LocalAddr: serveEcho(t), MaxLifetime: 2},
+	})
+	dial := func(name string) net.Conn {
+		conn, err := net.DialTimeout("tcp", addrs[name], time.Second*5)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	}
+	// an active connection outlives idle_timeout
+	active := dial("idle")
+	for start := time.Now(); time.Since(start) < time.Second*2; time.Sleep(time.Millisecond * 300) {
+		echoOnce(t, active)
+	}
+	expectClosed(t, active, "connection idle past idle_timeout")
+
+	lived := dial("lifetime")
+	start := time.Now()
+	for {
+		lived.SetDeadline(time.Now().Add(time.Second))
+		_, err := lived.Write([]byte("hello"))
+		if err == nil {
+			_, err = io.ReadFull(lived, make([]byte, 5))
+		}
+		if err != nil {
+			if nerr, isok := err.(net.Error); isok && nerr.Timeout() {
+				t.Fatal(err)
+			}
+			break
+		}
+		if time.Since(start) > time.Second*4 {
+			t.Fatal("active connection alive past max_lifetime")
+		}
+		time.Sleep(time.Millisecond * 300)
+	}
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Fatalf("connection closed in %v,before max_lifetime", elapsed)
+	}
+}
+
+func TestWriteTimeout(t *testing.T) {
+	s := StartTestServer(t)
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { lis.Close() })
+	// stopped is closed once the local writes fail as the stalled connection is closed through the tunnel
+	stopped := make(chan struct{})
+	go func() {
+		conn, err := lis.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		chunk := make([]byte, 32*1024)
+		for {
+			if _, err := conn.Write(chunk); err != nil {
+				close(stopped)
+				return
+			}
+		}
+	}()
+	_, addrs := StartTestClient(t, s, map[string]client.TunnelConfig{"flood": {Schema: "tcp", LocalAddr: "tcp://" + lis.Addr().String()}})
+	conn, err := net.DialTimeout("tcp", addrs["flood"], time.Second*5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// the visitor never reads,the writes to it stall past write_timeout(2s)
+	conn.(*net.TCPConn).SetReadBuffer(4096)
+	select {
+	case <-stopped:
+	case <-time.After(time.Second * 10):
+		t.Fatal("stalled connection kept open past write_timeout")
+	}
+}
@@ -18,6 +18,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"net"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/pkg/errors"
@@ -38,36 +40,223 @@ const (
 	TypePong
 	TypeError
 	TypeExit
+	TypeKick
+	TypeRemoveTunnels
+	TypeMaintenance
+	TypeNotice
+	TypeDialStats
+	//asks server to dial a pipe to the client it dialed the control to,by the reverse feature
+	TypeReverseDial
+	//asks a relay server to connect to the next hop as the first msg of a connection,
+	//answered without body once connected
+	TypeRelay
+	//the first msg of a stream opened by client over a visit pipe,answered without body once the tunnel is found
+	TypeVisit
 )
 
+// ErrorCode classifies an Error so that clients can act on it without parsing Msg,
+// it is empty in the errors of servers older than the codes
+type ErrorCode string
+
+const (
+	ErrCodeAuthFailed            ErrorCode = "auth_failed"
+	ErrCodeUnsupportedEncryption ErrorCode = "unsupported_encryption"
+	ErrCodeTransportMismatch     ErrorCode = "transport_mismatch"
+	ErrCodeInvalidTunnel         ErrorCode = "invalid_tunnel"
+	ErrCodeUnsupportedFeature    ErrorCode = "unsupported_feature"
+	ErrCodeAddrInUse             ErrorCode = "addr_in_use"
+	ErrCodeQuotaExceeded         ErrorCode = "quota_exceeded"
+	ErrCodeDuplicateClient       ErrorCode = "duplicate_client"
+	ErrCodeClientTooOld          ErrorCode = "client_too_old"
+	ErrCodeInternal              ErrorCode = "internal"
+	ErrCodeRelayRefused          ErrorCode = "relay_refused"
+	ErrCodeRelayUnreachable      ErrorCode = "relay_unreachable"
+	ErrCodeVisitRefused          ErrorCode = "visit_refused"
+)
+
+// Retryable reports whether connecting again may succeed without changing the client config
+func (c ErrorCode) Retryable() bool {
+	switch c {
+	case ErrCodeAuthFailed, ErrCodeUnsupportedEncryption, ErrCodeInvalidTunnel, ErrCodeUnsupportedFeature, ErrCodeDuplicateClient, ErrCodeClientTooOld, ErrCodeRelayRefused:
+		return false
+	}
+	return true
+}
+
 type Error struct {
-	Msg string
+	Msg  string
+	Code ErrorCode `json:",omitempty"`
+	//what the error is about,e.g. "tunnel","addr","encrypt_mode","key_id" or "transport"
+	Detail map[string]string `json:",omitempty"`
+	//what server supports,sent when refusing a ClientHello
+	Capabilities *Capabilities `json:",omitempty"`
 }
 
 func (e *Error) Error() string {
 	return e.Msg
 }
 
+type Kick struct {
+	Reason string
+}
+
+// ProtocolVersion is the version of the msg protocol,clients announce it in ClientHello
+// and server advertises the highest version it speaks in its Capabilities
+const ProtocolVersion = 2
+
+// HalfCloseVersion is the first ProtocolVersion which half-closes the streams of tcp tunnels
+const HalfCloseVersion = 2
+
+// Capabilities advertise what server supports,so that clients can pick the options both sides support
+type Capabilities struct {
+	ProtocolVersion int
+	EncryptModes    []string
+	Compressions    []string `json:",omitempty"`
+	Transports      []string
+	//optional features enabled on server,e.g. "resume","tcpmux" or "knock"
+	Features []string `json:",omitempty"`
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// HasEncryptMode reports whether server accepts ClientHellos of mode
+func (c *Capabilities) HasEncryptMode(mode string) bool {
+	return contains(c.EncryptModes, mode)
+}
+
+// HasTransport reports whether server listens in transport
+func (c *Capabilities) HasTransport(transport string) bool {
+	return contains(c.Transports, transport)
+}
+
+// HasFeature reports whether the optional feature is enabled on server
+func (c *Capabilities) HasFeature(feature string) bool {
+	return contains(c.Features, feature)
+}
+
+// ServerHello accepts a ClientHello,it has a body only for the clients announcing a ProtocolVersion
+type ServerHello struct {
+	Capabilities Capabilities
+}
+
 type ClientHello struct {
 	EncryptMode    string
 	EnableCompress bool
 	Version        string
+	//0 for clients older than ServerHello capabilities
+	ProtocolVersion int `json:",omitempty"`
+	//id of the aes key the client is configured with,empty for the default secret_key of server
+	KeyId string `json:",omitempty"`
+	//transport the client dialed with,server rejects it if the connection was accepted by another transport
+	Transport string `json:",omitempty"`
+	//id of the control connection in the log lines of both sides,server makes one up for old clients
+	ControlID string `json:",omitempty"`
 }
 
 type ControlClientHello struct {
 	CipherKey []byte
 	AuthToken string
 	ClientID  *uuid.UUID
+	//token handed out by the last control of ClientID,to take over its tunnels
+	ResumeToken string `json:",omitempty"`
+	//transport the pipes of the tunnels without their own are created in,empty for the transport of the control.
+	//only sent to servers with the "pipetransport" feature
+	PipeTransport string `json:",omitempty"`
+	//hostname of the client,filled into the {hostname} of the host templates of tunnels
+	Hostname string `json:",omitempty"`
 }
 
 type ControlServerHello struct {
 	ClientID  uuid.UUID
 	CipherKey []byte
+	//token to resume this control from another connection,empty if server doesn't keep tunnels
+	ResumeToken string `json:",omitempty"`
+	//tunnels of the last control of ClientID are taken over
+	Resumed bool `json:",omitempty"`
+}
+
+// PipeReq asks for a pipe over Transport,it is sent without body for the transport of the control
+type PipeReq struct {
+	Transport string
+	//nil for the pipes encrypted and compressed like the control
+	Options *PipeOptions `json:",omitempty"`
 }
 
 type PipeClientHello struct {
 	Once     uuid.UUID
 	ClientID uuid.UUID
+	Options  *PipeOptions `json:",omitempty"`
+	//transport the pipe is dialed in,server refuses the pipe if it was accepted in another
+	Transport string `json:",omitempty"`
+	//bytes each stream of the pipe may have in flight before its reader acknowledges them,
+	//0 leaves the streams to the buffer of the whole pipe
+	StreamWindow int `json:",omitempty"`
+	//bytes server buffers for the pipe,sized by client for its upload bandwidth over the rtt measured.
+	//0 or less than the default of server keeps the default,server caps it by its max_receive_buffer
+	ReceiveBuffer int `json:",omitempty"`
+	//packets server may have in flight over a kcp pipe,sized for the download bandwidth of client
+	KcpWindow int `json:",omitempty"`
+	//the pipe carries the streams client opens to visit tunnels,sent to servers with the "visit" feature
+	Visit bool `json:",omitempty"`
+	//hmac of MacInput keyed by the secret of the control,proving the pipe is dialed by its client
+	//even if the pipe is left unencrypted.absent from the hellos of old clients
+	Mac []byte `json:",omitempty"`
+}
+
+// MacInput is what Mac authenticates,the fields choosing the control and how its pipe is carried
+func (phs *PipeClientHello) MacInput() []byte {
+	input := make([]byte, 0, len(phs.ClientID)+len(phs.Once)+len(phs.Transport)+4)
+	input = append(input, phs.ClientID[:]...)
+	input = append(input, phs.Once[:]...)
+	input = append(input, phs.Transport...)
+	input = append(input, 0, optionByte(phs.Visit), 0, 0)
+	if phs.Options != nil {
+		if phs.Options.Encrypt != nil {
+			input[len(input)-2] = 1 + optionByte(*phs.Options.Encrypt)
+		}
+		if phs.Options.Compress != nil {
+			input[len(input)-1] = 1 + optionByte(*phs.Options.Compress)
+		}
+	}
+	return input
+}
+
+func optionByte(b bool) byte {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// PipeOptions override the encryption and compression of the control for the pipes of a tunnel,
+// a nil field keeps the setting of the control
+type PipeOptions struct {
+	//false carries the streams unencrypted,e.g. for a backend speaking tls already.
+	//true requires the control to be encrypted
+	Encrypt  *bool `json:",omitempty"`
+	Compress *bool `json:",omitempty"`
+}
+
+// Resolve returns whether the pipes are encrypted and compressed,
+// given the encryption and compression of the control
+func (po *PipeOptions) Resolve(encrypt bool, compress bool) (bool, bool) {
+	if po == nil {
+		return encrypt, compress
+	}
+	if po.Encrypt != nil {
+		encrypt = *po.Encrypt
+	}
+	if po.Compress != nil {
+		compress = *po.Compress
+	}
+	return encrypt, compress
 }
 
 type Public struct {
@@ -87,12 +276,137 @@ type Tunnel struct {
 	Public          Public
 	Local           Local
 	HttpHostRewrite string
+	Labels          map[string]string `json:",omitempty"`
+	//basic auth credential(user:password) required by http and https tunnels
+	HttpAuth string   `json:",omitempty"`
+	AllowIPs []string `json:",omitempty"`
+	DenyIPs  []string `json:",omitempty"`
+	//new public connections allowed per second,0 means unlimited
+	RateLimit float64 `json:",omitempty"`
+	RateBurst int     `json:",omitempty"`
+	//socket options of public connections and local connections,nil keeps the defaults
+	Tcp *TcpOptions `json:",omitempty"`
+	//source address and dscp of the local connections,nil keeps the defaults
+	LocalDial *LocalDialOptions `json:",omitempty"`
+	//transport(tcp or kcp) of the pipes carrying this tunnel,empty for the transport of the control
+	Transport string `json:",omitempty"`
+	//public port of tcp tunnels is closed until opened by a signed knock
+	Knock *KnockOptions `json:",omitempty"`
+	//visitors of tcp,tcpmux and stcp tunnels must send Psk with a newline before being forwarded
+	Psk string `json:",omitempty"`
+	//requests of http tunnels must carry a token signed by UrlSecret
+	UrlSecret string `json:",omitempty"`
+	//bytes(in and out) the tunnel may transfer before it stops forwarding,0 is unlimited
+	ByteCap uint64 `json:",omitempty"`
+	//weekly windows like "mon-fri 09:00-18:00" the tunnel is reachable in,empty is always
+	Schedule []string `json:",omitempty"`
+	//IANA time zone the schedule is in,default to the time zone of server
+	Timezone string `json:",omitempty"`
+	//token of the status page served at /_lunnel/status of http tunnels,empty disables the page
+	StatusToken string `json:",omitempty"`
+	//cacheable responses of http tunnels are answered by server if server has cache enabled
+	Cache bool `json:",omitempty"`
+	//http methods served by the tunnel,tunnels on the same host are routed by the method of each request.
+	//empty serves the methods not claimed by the other tunnels of its host
+	Methods []string `json:",omitempty"`
+	//seconds a proxied connection may stay idle and may live at most,0 is unlimited
+	IdleTimeout int `json:",omitempty"`
+	MaxLifetime int `json:",omitempty"`
+	//encryption and compression of the pipes carrying the tunnel,nil for those of the control
+	Pipe *PipeOptions `json:",omitempty"`
+	//profile of server the empty settings are filled from
+	Profile string `json:",omitempty"`
+	//https tunnels negotiate http/2 by ALPN and server proxies the requests to local as http/1.1
+	Http2 bool `json:",omitempty"`
+	//path prefixes served by http tunnels,the other paths are answered with 404.empty serves every path
+	Paths []string `json:",omitempty"`
+	//html of the 404 answered for the paths not served,empty for a plain text message
+	NotFoundPage string `json:",omitempty"`
+	//proxied connections the tunnel may have at once,the others are refused,0 is unlimited
+	MaxConns int `json:",omitempty"`
+	//high,normal or bulk,the high traffic is sent first when the bandwidth of server is saturated,empty is normal
+	Qos string `json:",omitempty"`
+	//assigned to the client by server,the client doesn't send it again when reconnecting
+	Provisioned bool `json:",omitempty"`
+}
+
+type KnockOptions struct {
+	Secret string
+	//seconds the knocking ip can connect after knocked,default to 300
+	Ttl int `json:",omitempty"`
+}
+
+type TcpOptions struct {
+	//nil keeps the go default,which disables Nagle's algorithm
+	NoDelay *bool `json:",omitempty"`
+	//keepalive period in seconds,0 keeps the default and negative disables keepalive
+	KeepAlive int `json:",omitempty"`
+	//SO_LINGER in seconds,nil keeps the os default
+	Linger *int `json:",omitempty"`
+}
+
+// LocalDialOptions are how client dials the local address of a tunnel,server ignores them
+type LocalDialOptions struct {
+	//source ip of the local connections,empty lets the os choose
+	BindIP string `json:",omitempty"`
+	//interface the local connections are bound to by SO_BINDTODEVICE,linux only
+	BindInterface string `json:",omitempty"`
+	//DSCP(0-63) the packets to local are marked with,0 keeps the default,linux only
+	Dscp int `json:",omitempty"`
+}
+
+// ApplySettings copies the settings which can be changed without re-registering the tunnel
+func (tc *Tunnel) ApplySettings(from Tunnel) {
+	tc.HttpHostRewrite = from.HttpHostRewrite
+	tc.Labels = from.Labels
+	tc.HttpAuth = from.HttpAuth
+	tc.AllowIPs = from.AllowIPs
+	tc.DenyIPs = from.DenyIPs
+	tc.RateLimit = from.RateLimit
+	tc.RateBurst = from.RateBurst
+	tc.Tcp = from.Tcp
+	tc.LocalDial = from.LocalDial
+	tc.Transport = from.Transport
+	tc.Knock = from.Knock
+	tc.Psk = from.Psk
+	tc.UrlSecret = from.UrlSecret
+	tc.ByteCap = from.ByteCap
+	tc.Schedule = from.Schedule
+	tc.Timezone = from.Timezone
+	tc.StatusToken = from.StatusToken
+	tc.IdleTimeout = from.IdleTimeout
+	tc.MaxLifetime = from.MaxLifetime
+	tc.Pipe = from.Pipe
+	tc.Paths = from.Paths
+	tc.NotFoundPage = from.NotFoundPage
+	tc.Qos = from.Qos
+	tc.MaxConns = from.MaxConns
+}
+
+// MatchLabels reports whether every key/value pair in selector is present in the tunnel's labels
+func (tc Tunnel) MatchLabels(selector map[string]string) bool {
+	for k, v := range selector {
+		if label, isok := tc.Labels[k]; !isok || label != v {
+			return false
+		}
+	}
+	return true
 }
 
 func (tc Tunnel) PublicAddr() string {
 	return fmt.Sprintf("%s://%s:%d", tc.Public.Schema, tc.Public.Host, tc.Public.Port)
 }
 
+// RouteKey is PublicAddr followed by the sorted methods,tunnels sharing a host are told apart by it
+func (tc Tunnel) RouteKey() string {
+	if len(tc.Methods) == 0 {
+		return tc.PublicAddr()
+	}
+	methods := append([]string(nil), tc.Methods...)
+	sort.Strings(methods)
+	return tc.PublicAddr() + "#" + strings.Join(methods, ",")
+}
+
 func (tc Tunnel) LocalAddr() string {
 	if tc.Local.Port == 0 {
 		return fmt.Sprintf("%s://%s", tc.Local.Schema, tc.Local.Host)
@@ -105,6 +419,62 @@ type AddTunnels struct {
 	Tunnels map[string]Tunnel
 }
 
+type RemoveTunnels struct {
+	Names []string
+}
+
+// Maintenance switches all tunnels of the client into or out of maintenance,
+// server answers http requests with Page and refuses the other connections meanwhile
+type Maintenance struct {
+	Enable bool
+	//html page served by http tunnels,empty for the maintenance page of server
+	Page string `json:",omitempty"`
+}
+
+// Notice is sent by server to tell the client something it should know,
+// like shutdown imminent,quota warnings or policy changes
+type Notice struct {
+	//shutdown,quota,policy or anything defined by administrator
+	Kind    string
+	Message string
+	Time    time.Time
+}
+
+// DialBuckets are the upper bounds in seconds of the buckets of DialStat
+var DialBuckets = [...]float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5}
+
+// DialStat measures the dials of the local address of a tunnel since the client started
+type DialStat struct {
+	//dials succeeded per DialBuckets,not cumulative,the slower ones are only in Count
+	Buckets [len(DialBuckets)]uint64
+	//seconds taken by the dials succeeded in total
+	Sum   float64
+	Count uint64
+	//dials failed,their durations are not in the buckets
+	Failures uint64
+}
+
+// DialStats is sent by client to servers with the "dialstats" feature,
+// telling how long dialing the local address of each tunnel takes
+type DialStats struct {
+	Tunnels map[string]DialStat
+}
+
+// Visit asks server to connect the stream to a tunnel,a tcp or tcpmux tunnel by its public address
+// or a stcp tunnel by its host
+type Visit struct {
+	Addr string `json:",omitempty"`
+	Stcp string `json:",omitempty"`
+}
+
+// Relay asks a relay server to connect to Addr in tcp and carry the rest of the connection there,
+// Addr is another relay server or the server the client registers to
+type Relay struct {
+	Addr string
+	//token of the relay server,if it requires one
+	Token string `json:",omitempty"`
+}
+
 func WriteMsg(w net.Conn, mType MsgType, in interface{}) error {
 	var length int
 	var body []byte
@@ -142,6 +512,11 @@ func ReadMsgWithoutTimeout(r net.Conn) (MsgType, interface{}, error) {
 	return readMsg(r, 0)
 }
 
+// ReadMsgWithTimeout reads a msg which must arrive in timeout
+func ReadMsgWithTimeout(r net.Conn, timeout time.Duration) (MsgType, interface{}, error) {
+	return readMsg(r, timeout)
+}
+
 func ReadMsg(r net.Conn) (MsgType, interface{}, error) {
 	return readMsg(r, time.Second*12)
 }
@@ -153,6 +528,7 @@ func readMsg(r net.Conn, timeout time.Duration) (MsgType, interface{}, error) {
 		return 0, nil, errors.Wrap(err, "msg readInSize header")
 	}
 
+	length := int(header[1])<<16 | int(header[2])<<8 | int(header[3])
 	var out interface{}
 	if MsgType(header[0]) == TypeControlClientHello {
 		out = new(ControlClientHello)
@@ -162,19 +538,35 @@ func readMsg(r net.Conn, timeout time.Duration) (MsgType, interface{}, error) {
 		out = new(PipeClientHello)
 	} else if MsgType(header[0]) == TypeAddTunnels {
 		out = new(AddTunnels)
-	} else if MsgType(header[0]) == TypePipeReq || MsgType(header[0]) == TypePing || MsgType(header[0]) == TypePong || MsgType(header[0]) == TypeServerHello || MsgType(header[0]) == TypeExit {
+	} else if MsgType(header[0]) == TypePipeReq && length > 0 {
+		out = new(PipeReq)
+	} else if MsgType(header[0]) == TypeVisit && length > 0 {
+		out = new(Visit)
+	} else if MsgType(header[0]) == TypeRelay && length > 0 {
+		out = new(Relay)
+	} else if MsgType(header[0]) == TypeServerHello && length > 0 {
+		out = new(ServerHello)
+	} else if MsgType(header[0]) == TypePipeReq || MsgType(header[0]) == TypePing || MsgType(header[0]) == TypePong || MsgType(header[0]) == TypeServerHello || MsgType(header[0]) == TypeExit || MsgType(header[0]) == TypeReverseDial || MsgType(header[0]) == TypeRelay || MsgType(header[0]) == TypeVisit {
 		return MsgType(header[0]), nil, nil
 	} else if MsgType(header[0]) == TypeClientHello {
 		out = new(ClientHello)
 	} else if MsgType(header[0]) == TypeError {
 		out = new(Error)
+	} else if MsgType(header[0]) == TypeKick {
+		out = new(Kick)
+	} else if MsgType(header[0]) == TypeRemoveTunnels {
+		out = new(RemoveTunnels)
+	} else if MsgType(header[0]) == TypeMaintenance {
+		out = new(Maintenance)
+	} else if MsgType(header[0]) == TypeNotice {
+		out = new(Notice)
+	} else if MsgType(header[0]) == TypeDialStats {
+		out = new(DialStats)
 	} else {
 		return 0, nil, errors.Errorf("invalid msg type %d", header[0])
 	}
-	length := int(header[1])<<16 | int(header[2])<<8 | int(header[3])
 	if length > 0 {
-		body := make([]byte, length)
-		err = readInSize(r, body, timeout)
+		body, err := readBody(r, length, timeout)
 		if err != nil {
 			return 0, nil, errors.Wrap(err, "msg readInSize body")
 		}
@@ -186,6 +578,27 @@ func readMsg(r net.Conn, timeout time.Duration) (MsgType, interface{}, error) {
 	return MsgType(header[0]), out, nil
 }
 
+// bodyChunk is how much more of a msg body is allocated for as it arrives
+const bodyChunk = 64 << 10
+
+// readBody reads a body of length,the memory is allocated as the body arrives
+// rather than all at once by the length an untrusted peer claims
+func readBody(r net.Conn, length int, timeout time.Duration) ([]byte, error) {
+	var body []byte
+	for len(body) < length {
+		n := length - len(body)
+		if n > bodyChunk {
+			n = bodyChunk
+		}
+		body = append(body, make([]byte, n)...)
+		err := readInSize(r, body[len(body)-n:], timeout)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return body, nil
+}
+
 func readInSize(r net.Conn, b []byte, timeout time.Duration) error {
 	size := len(b)
 	bLeft := b
@@ -0,0 +1,64 @@
+// Copyright 2017 longXboy, longxboyhi@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package msg
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+// bufConn reads from r and writes to w,the deadlines are ignored
+type bufConn struct {
+	net.Conn
+	r *bytes.Reader
+	w bytes.Buffer
+}
+
+func (c *bufConn) Read(p []byte) (int, error)       { return c.r.Read(p) }
+func (c *bufConn) Write(p []byte) (int, error)      { return c.w.Write(p) }
+func (c *bufConn) SetReadDeadline(time.Time) error  { return nil }
+func (c *bufConn) SetWriteDeadline(time.Time) error { return nil }
+
+func encode(t testing.TB, mType MsgType, in interface{}) []byte {
+	c := &bufConn{}
+	err := WriteMsg(c, mType, in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c.w.Bytes()
+}
+
+func FuzzReadMsg(f *testing.F) {
+	f.Add(encode(f, TypeClientHello, ClientHello{EncryptMode: "aes", Version: "1.0", ProtocolVersion: ProtocolVersion}))
+	f.Add(encode(f, TypePipeClientHello, PipeClientHello{Once: [16]byte{1}, StreamWindow: 262144}))
+	f.Add(encode(f, TypeAddTunnels, AddTunnels{Tunnels: map[string]Tunnel{"web": {Public: Public{Schema: "http", Host: "a.example.com"}}}}))
+	f.Add(encode(f, TypePing, nil))
+	f.Add([]byte{byte(TypeError), 0xff, 0xff, 0xff, '{'})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		mType, body, err := ReadMsg(&bufConn{r: bytes.NewReader(data)})
+		if err != nil {
+			return
+		}
+		again, body2, err := ReadMsg(&bufConn{r: bytes.NewReader(encode(t, mType, body))})
+		if err != nil {
+			t.Fatalf("msg %d read back failed:%v", mType, err)
+		}
+		if again != mType || (body == nil) != (body2 == nil) {
+			t.Fatalf("msg %d read back as %d", mType, again)
+		}
+	})
+}
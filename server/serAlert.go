@@ -0,0 +1,198 @@
+// Copyright 2017 longXboy, longxboyhi@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/longXboy/lunnel/contrib"
+	"github.com/longXboy/lunnel/log"
+	"github.com/pkg/errors"
+)
+
+const (
+	alertTunnelOffline = "tunnel_offline"
+	alertErrorRate     = "error_rate"
+	alertBandwidth     = "bandwidth"
+)
+
+// offline tunnels are forgotten after this long so the churn of clients doesn't grow the state forever
+const alertForgetOffline = time.Hour * 24
+
+type AlertRule struct {
+	Name string `yaml:"name,omitempty"`
+	//tunnel_offline,error_rate or bandwidth
+	Kind string `yaml:"kind,omitempty"`
+	//name of the tunnel watched by tunnel_offline and bandwidth rules,empty for all tunnels,
+	//a bandwidth rule without tunnel watches the total bandwidth of server
+	Tunnel string `yaml:"tunnel,omitempty"`
+	//minutes for tunnel_offline,percent of failed connections for error_rate,bytes per second for bandwidth
+	Threshold float64 `yaml:"threshold,omitempty"`
+	//seconds before the same rule fires again for the same target,default to 600
+	Cooldown int64 `yaml:"cooldown,omitempty"`
+}
+
+type Alerting struct {
+	//seconds between two evaluations,default to 30
+	Interval int64       `yaml:"interval,omitempty"`
+	Rules    []AlertRule `yaml:"rules,omitempty"`
+}
+
+func validateAlertRules(rules []AlertRule) error {
+	names := make(map[string]bool)
+	for _, rule := range rules {
+		if rule.Name == "" {
+			return errors.New("alert rule name can not be empty")
+		}
+		if names[rule.Name] {
+			return errors.Errorf("duplicate alert rule %s", rule.Name)
+		}
+		names[rule.Name] = true
+		if rule.Kind != alertTunnelOffline && rule.Kind != alertErrorRate && rule.Kind != alertBandwidth {
+			return errors.Errorf("invalid kind %s of alert rule %s", rule.Kind, rule.Name)
+		}
+		if rule.Threshold <= 0 {
+			return errors.Errorf("threshold of alert rule %s must be positive", rule.Name)
+		}
+	}
+	return nil
+}
+
+type alerter struct {
+	lastFired   map[string]time.Time
+	lastSeen    map[string]time.Time
+	seenName    map[string]string
+	lastTunnels map[string]tunnelMetric
+	lastGlobal  metricSnapshot
+	lastTime    time.Time
+}
+
+func newAlerter() *alerter {
+	return &alerter{
+		lastFired:   make(map[string]time.Time),
+		lastSeen:    make(map[string]time.Time),
+		seenName:    make(map[string]string),
+		lastTunnels: make(map[string]tunnelMetric),
+	}
+}
+
+func (a *alerter) fire(rule AlertRule, target string, value float64, now time.Time) {
+	cooldown := rule.Cooldown
+	if cooldown <= 0 {
+		cooldown = 600
+	}
+	key := rule.Name + "/" + target
+	if last, isok := a.lastFired[key]; isok && now.Sub(last) < time.Duration(cooldown)*time.Second {
+		return
+	}
+	a.lastFired[key] = now
+	recordEvent("alert", nil, "", fmt.Sprintf("%s(%s) of %s is %.2f,threshold %.2f", rule.Name, rule.Kind, target, value, rule.Threshold))
+	log.WithFields(log.Fields{"rule": rule.Name, "kind": rule.Kind, "target": target, "value": value, "threshold": rule.Threshold}).Warningln("alert rule fired")
+	if serverConf.NotifyEnable {
+		go func() {
+			err := contrib.Alert(serverConf.ServerDomain, rule.Name, rule.Kind, target, value, rule.Threshold)
+			if err != nil {
+				log.WithFields(log.Fields{"err": err}).Errorln("notify alert failed!")
+			}
+		}()
+	}
+}
+
+func (a *alerter) evaluate(rules []AlertRule, now time.Time) {
+	global := snapshotMetrics()
+	tunnels := make(map[string]tunnelMetric)
+	for _, tm := range snapshotTunnels() {
+		key := tm.clientId + "/" + tm.name
+		tunnels[key] = tm
+		a.lastSeen[key] = now
+		a.seenName[key] = tm.name
+	}
+	for key, seen := range a.lastSeen {
+		if now.Sub(seen) > alertForgetOffline {
+			delete(a.lastSeen, key)
+			delete(a.seenName, key)
+		}
+	}
+	elapsed := now.Sub(a.lastTime).Seconds()
+	// rates need two samples
+	sampled := !a.lastTime.IsZero() && elapsed > 0
+
+	for _, rule := range rules {
+		switch rule.Kind {
+		case alertTunnelOffline:
+			for key, seen := range a.lastSeen {
+				if rule.Tunnel != "" && a.seenName[key] != rule.Tunnel {
+					continue
+				}
+				offline := now.Sub(seen).Minutes()
+				if offline > rule.Threshold {
+					a.fire(rule, key, offline, now)
+				}
+			}
+		case alertErrorRate:
+			if !sampled {
+				continue
+			}
+			conns := global.Connections - a.lastGlobal.Connections
+			errs := global.Errors - a.lastGlobal.Errors
+			if conns > 0 {
+				rate := float64(errs) * 100 / float64(conns)
+				if rate > rule.Threshold {
+					a.fire(rule, "server", rate, now)
+				}
+			}
+		case alertBandwidth:
+			if !sampled {
+				continue
+			}
+			if rule.Tunnel == "" {
+				bytes := global.BytesIn + global.BytesOut - a.lastGlobal.BytesIn - a.lastGlobal.BytesOut
+				bps := float64(bytes) / elapsed
+				if bps > rule.Threshold {
+					a.fire(rule, "server", bps, now)
+				}
+				continue
+			}
+			for key, tm := range tunnels {
+				last, isok := a.lastTunnels[key]
+				if tm.name != rule.Tunnel || !isok {
+					continue
+				}
+				bps := float64(tm.bytesIn+tm.bytesOut-last.bytesIn-last.bytesOut) / elapsed
+				if bps > rule.Threshold {
+					a.fire(rule, key, bps, now)
+				}
+			}
+		}
+	}
+	a.lastGlobal = global
+	a.lastTunnels = tunnels
+	a.lastTime = now
+}
+
+func runAlerting() {
+	conf := serverConf.Alerting
+	interval := conf.Interval
+	if interval <= 0 {
+		interval = 30
+	}
+	a := newAlerter()
+	ticker := time.NewTicker(time.Duration(interval) * time.Second)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		a.evaluate(conf.Rules, now)
+	}
+}
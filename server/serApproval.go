@@ -0,0 +1,251 @@
+// Copyright 2017 longXboy, longxboyhi@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/longXboy/lunnel/log"
+	"github.com/longXboy/lunnel/msg"
+)
+
+// Approval holds new clients and tunnels on sensitive hosts until approved
+type Approval struct {
+	//tunnels of clients which are not approved are held
+	Clients bool `yaml:"clients,omitempty"`
+	//tunnels whose public host matches any of the patterns(path.Match syntax like *.prod.example.com) are held
+	Hosts []string `yaml:"hosts,omitempty"`
+	//pending tunnels are posted to Webhook,a 2xx response with {"Approved":true} approves it
+	Webhook string `yaml:"webhook,omitempty"`
+}
+
+type pendingTunnel struct {
+	ID        string
+	ClientID  string
+	Name      string
+	Public    string
+	Local     string
+	Labels    map[string]string
+	Reason    string
+	CreatedAt time.Time
+
+	// Tunnel is not exposed as it carries the secrets of tunnel
+	Tunnel msg.Tunnel `json:"-"`
+
+	ctl *Control
+}
+
+var approvalLock sync.Mutex
+var approvedClients = make(map[string]bool)
+var approvedHosts = make(map[string]bool)
+var pendingTunnels = make(map[string]*pendingTunnel)
+
+var webhookClient = &http.Client{Timeout: time.Second * 10}
+
+func pendingID(clientId string, name string) string {
+	return clientId + "/" + name
+}
+
+func hostKey(clientId string, name string, tunnel msg.Tunnel) string {
+	return fmt.Sprintf("%s/%s/%s", clientId, name, tunnel.Public.Host)
+}
+
+func sensitiveHost(host string) bool {
+	if host == "" {
+		return false
+	}
+	for _, pattern := range serverConf.Approval.Hosts {
+		if matched, _ := path.Match(pattern, host); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// approvalReason returns why the tunnel must be approved,empty if it needn't,
+// approvalLock must be held
+func approvalReason(clientId string, name string, tunnel msg.Tunnel) string {
+	if serverConf.Approval.Clients && !approvedClients[clientId] {
+		return "client"
+	}
+	if sensitiveHost(tunnel.Public.Host) && !approvedHosts[hostKey(clientId, name, tunnel)] {
+		return "host"
+	}
+	return ""
+}
+
+// holdTunnel keeps the tunnel pending if it needs approval and reports whether it is held
+func (c *Control) holdTunnel(name string, tunnel msg.Tunnel) bool {
+	clientId := c.ClientID.String()
+	approvalLock.Lock()
+	reason := approvalReason(clientId, name, tunnel)
+	if reason == "" {
+		approvalLock.Unlock()
+		return false
+	}
+	p := &pendingTunnel{ID: pendingID(clientId, name), ClientID: clientId, Name: name, Public: tunnel.PublicAddr(), Local: tunnel.LocalAddr(), Labels: tunnel.Labels, Tunnel: tunnel, Reason: reason, CreatedAt: time.Now(), ctl: c}
+	pendingTunnels[p.ID] = p
+	approvalLock.Unlock()
+	log.WithFields(log.Fields{"tunnel": name, "client_id": clientId, "reason": reason}).Infoln("tunnel is pending for approval")
+	if serverConf.Approval.Webhook != "" {
+		go askWebhook(*p)
+	}
+	return true
+}
+
+func askWebhook(p pendingTunnel) {
+	body, err := json.Marshal(p)
+	if err != nil {
+		return
+	}
+	resp, err := webhookClient.Post(serverConf.Approval.Webhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.WithFields(log.Fields{"err": err, "id": p.ID}).Warningln("post approval webhook failed!")
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return
+	}
+	var result struct {
+		Approved bool
+	}
+	err = json.NewDecoder(resp.Body).Decode(&result)
+	if err != nil || !result.Approved {
+		return
+	}
+	if approvePending(p.ID) {
+		recordAudit("approval", "webhook", "", "approve", p.ID, "allowed", p.Reason)
+	}
+}
+
+// approvePending approves the client and host of the pending tunnel,
+// then registers the pending tunnels of that client which need no more approval
+func approvePending(id string) bool {
+	approvalLock.Lock()
+	p, isok := pendingTunnels[id]
+	if !isok {
+		approvalLock.Unlock()
+		return false
+	}
+	approvedClients[p.ClientID] = true
+	approvedHosts[hostKey(p.ClientID, p.Name, p.Tunnel)] = true
+	ready := make(map[string]msg.Tunnel)
+	for pid, pt := range pendingTunnels {
+		if pt.ClientID == p.ClientID && approvalReason(pt.ClientID, pt.Name, pt.Tunnel) == "" {
+			ready[pt.Name] = pt.Tunnel
+			delete(pendingTunnels, pid)
+		}
+	}
+	approvalLock.Unlock()
+	log.WithFields(log.Fields{"id": id, "tunnels": len(ready)}).Infoln("pending tunnel approved")
+	if c := liveControl(p.ClientID); c != nil && len(ready) > 0 {
+		go c.ServerAddTunnels(&msg.AddTunnels{Tunnels: ready})
+	}
+	return true
+}
+
+func rejectPending(id string) bool {
+	approvalLock.Lock()
+	defer approvalLock.Unlock()
+	_, isok := pendingTunnels[id]
+	delete(pendingTunnels, id)
+	return isok
+}
+
+// dropPending forgets the pending tunnels held by a control which is closed,
+// they are held again when the client reconnects
+func dropPending(c *Control) {
+	approvalLock.Lock()
+	defer approvalLock.Unlock()
+	for id, p := range pendingTunnels {
+		if p.ctl == c {
+			delete(pendingTunnels, id)
+		}
+	}
+}
+
+type pendingByID []pendingTunnel
+
+func (p pendingByID) Len() int           { return len(p) }
+func (p pendingByID) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+func (p pendingByID) Less(i, j int) bool { return p[i].ID < p[j].ID }
+
+// pendingHandler serves GET /api/v1/pending and
+// POST /api/v1/pending/{client_id}/{tunnel}/approve or reject
+func pendingHandler(w http.ResponseWriter, r *http.Request) {
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1/pending"), "/")
+	if rest == "" {
+		if r.Method != "GET" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			fmt.Fprintf(w, "method not allowed")
+			return
+		}
+		list := []pendingTunnel{}
+		approvalLock.Lock()
+		for _, p := range pendingTunnels {
+			if visible(r, p.ctl) {
+				list = append(list, *p)
+			}
+		}
+		approvalLock.Unlock()
+		sort.Sort(pendingByID(list))
+		writeJson(w, http.StatusOK, list)
+		return
+	}
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		fmt.Fprintf(w, "method not allowed")
+		return
+	}
+	idx := strings.LastIndex(rest, "/")
+	if idx <= 0 {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "pending tunnel not found")
+		return
+	}
+	id, action := rest[:idx], rest[idx+1:]
+	approvalLock.Lock()
+	p, isok := pendingTunnels[id]
+	approvalLock.Unlock()
+	if !isok || !visible(r, p.ctl) {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "pending tunnel not found")
+		return
+	}
+	if action == "approve" {
+		isok = approvePending(id)
+	} else if action == "reject" {
+		isok = rejectPending(id)
+	} else {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "unknown action")
+		return
+	}
+	if !isok {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "pending tunnel not found")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,353 @@
+// Copyright 2017 longXboy, longxboyhi@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/longXboy/lunnel/log"
+	"github.com/longXboy/lunnel/msg"
+	"github.com/pkg/errors"
+)
+
+// maxAuditRecords is how many records are kept in memory without an audit file
+const maxAuditRecords = 4096
+
+// maxAuditLine is the longest record read back from the audit file
+const maxAuditLine = 1 << 20
+
+// Audit records the administrative actions and the auth decisions,
+// each record carries the hash of the one before so that a record changed or removed breaks the chain
+type Audit struct {
+	//json lines file the records are appended to,empty keeps the last records in memory only
+	File string `yaml:"file,omitempty"`
+	//secret the hashes are hmac-sha256 keyed by,so that the chain can't be recomputed by whoever can write the file.
+	//without it the hashes are plain sha256,which only detect records changed by accident or by hand
+	Key string `yaml:"key,omitempty"`
+}
+
+type auditRecord struct {
+	Seq  uint64
+	Time time.Time
+	//api for the manage api,client_auth for the handshakes of clients,approval for the tunnels approved by webhook
+	Kind string
+	//role and fingerprint of the manage token,or the client id
+	Actor  string
+	Remote string `json:",omitempty"`
+	Action string
+	Target string `json:",omitempty"`
+	//allowed,denied or the status code answered
+	Result string
+	Detail string `json:",omitempty"`
+	//hash of the record before,empty for the first one
+	Prev string
+	Hash string `json:",omitempty"`
+}
+
+// hash is the hmac-sha256 by the audit key of the record without its hash,or its sha256 without a key
+func (a auditRecord) hash() string {
+	a.Hash = ""
+	content, _ := json.Marshal(a)
+	if serverConf.Audit.Key != "" {
+		mac := hmac.New(sha256.New, []byte(serverConf.Audit.Key))
+		mac.Write(content)
+		return hex.EncodeToString(mac.Sum(nil))
+	}
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+var (
+	auditLock    sync.Mutex
+	auditFile    *os.File
+	auditSeq     uint64
+	auditHash    string
+	auditRecords []auditRecord
+)
+
+// errTornAudit is returned for a last line of the audit file which isn't a whole record,
+// as left by a crash in the middle of an append
+var errTornAudit = errors.New("last audit record torn")
+
+// scanAudit calls f for each record of the audit file in order,until f returns false.
+// it returns the size of the lines of the records read
+func scanAudit(path string, f func(a auditRecord) bool) (int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 4096), maxAuditLine)
+	var size int64
+	var bad error
+	for scanner.Scan() {
+		// a line which can't be parsed is only tolerated as the last one
+		if bad != nil {
+			return size, bad
+		}
+		var a auditRecord
+		err = json.Unmarshal(scanner.Bytes(), &a)
+		if err != nil {
+			bad = errors.Wrap(err, "parse audit record")
+			continue
+		}
+		size += int64(len(scanner.Bytes())) + 1
+		if !f(a) {
+			return size, nil
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return size, err
+	}
+	if bad != nil {
+		return size, errTornAudit
+	}
+	return size, nil
+}
+
+// initAudit opens the audit file and continues the chain from its last record,
+// a torn last record is cut off and the cut is recorded
+func initAudit() error {
+	if serverConf.Audit.File == "" {
+		return nil
+	}
+	size, err := scanAudit(serverConf.Audit.File, func(a auditRecord) bool {
+		auditSeq = a.Seq
+		auditHash = a.Hash
+		return true
+	})
+	if err != nil && err != errTornAudit && !os.IsNotExist(err) {
+		return errors.Wrap(err, "read audit file")
+	}
+	var cut int64
+	if err == errTornAudit {
+		info, err := os.Stat(serverConf.Audit.File)
+		if err != nil {
+			return errors.Wrap(err, "stat audit file")
+		}
+		cut = info.Size() - size
+		err = os.Truncate(serverConf.Audit.File, size)
+		if err != nil {
+			return errors.Wrap(err, "cut torn audit record")
+		}
+		log.WithFields(log.Fields{"file": serverConf.Audit.File, "bytes": cut, "seq": auditSeq}).Warningln("torn last audit record cut off")
+	}
+	auditFile, err = os.OpenFile(serverConf.Audit.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return errors.Wrap(err, "open audit file")
+	}
+	// the last record may have been written without its newline
+	if info, err := auditFile.Stat(); err == nil && info.Size() < size {
+		auditFile.Write([]byte{'\n'})
+	}
+	if cut > 0 {
+		recordAudit("audit", "server", "", "cut", serverConf.Audit.File, "repaired", fmt.Sprintf("%d bytes of a torn record after seq %d", cut, auditSeq))
+	}
+	return nil
+}
+
+// recordAudit appends a record chained to the last one
+func recordAudit(kind string, actor string, remote string, action string, target string, result string, detail string) {
+	auditLock.Lock()
+	defer auditLock.Unlock()
+	auditSeq++
+	a := auditRecord{Seq: auditSeq, Time: time.Now().UTC(), Kind: kind, Actor: actor, Remote: remote, Action: action, Target: target, Result: result, Detail: detail, Prev: auditHash}
+	a.Hash = a.hash()
+	auditHash = a.Hash
+	exportAudit(a)
+	if auditFile != nil {
+		line, err := json.Marshal(a)
+		if err == nil {
+			_, err = auditFile.Write(append(line, '\n'))
+		}
+		if err != nil {
+			log.WithFields(log.Fields{"err": err, "seq": a.Seq}).Errorln("write audit record failed!")
+		}
+		return
+	}
+	auditRecords = append(auditRecords, a)
+	if len(auditRecords) > maxAuditRecords {
+		auditRecords = auditRecords[len(auditRecords)-maxAuditRecords:]
+	}
+}
+
+// eachAudit calls f for the records of the audit file,or of memory without one
+func eachAudit(f func(a auditRecord) bool) error {
+	if serverConf.Audit.File != "" {
+		_, err := scanAudit(serverConf.Audit.File, f)
+		return err
+	}
+	auditLock.Lock()
+	records := append([]auditRecord{}, auditRecords...)
+	auditLock.Unlock()
+	for _, a := range records {
+		if !f(a) {
+			break
+		}
+	}
+	return nil
+}
+
+type auditVerify struct {
+	Records uint64
+	Valid   bool
+	//seq of the first record whose hash or link is wrong
+	BrokenAt uint64 `json:",omitempty"`
+	Problem  string `json:",omitempty"`
+	//the last line of the file isn't a whole record,the torn records cut at startup are recorded with kind audit
+	Torn bool `json:",omitempty"`
+}
+
+// verifyAudit checks the hash of every record and its link to the one before,
+// the records in memory start from a record whose predecessor was dropped
+func verifyAudit() (auditVerify, error) {
+	v := auditVerify{Valid: true}
+	var prev *auditRecord
+	err := eachAudit(func(a auditRecord) bool {
+		v.Records++
+		switch {
+		case a.hash() != a.Hash:
+			v.Problem = "hash mismatch"
+		case prev != nil && a.Prev != prev.Hash:
+			v.Problem = "chain broken"
+		case prev != nil && a.Seq != prev.Seq+1:
+			v.Problem = "record missing"
+		case prev == nil && serverConf.Audit.File != "" && (a.Seq != 1 || a.Prev != ""):
+			v.Problem = "first records missing"
+		}
+		if v.Problem != "" {
+			v.Valid = false
+			v.BrokenAt = a.Seq
+			return false
+		}
+		prev = &a
+		return true
+	})
+	if err == errTornAudit {
+		v.Valid = false
+		v.Torn = true
+		v.Problem = "last record torn"
+		return v, nil
+	}
+	return v, err
+}
+
+// auditAuth records the decision of the auth server on the hello of the client
+func (c *Control) auditAuth(chello *msg.ControlClientHello, isok bool, err error) {
+	actor := "new client"
+	if chello.ClientID != nil {
+		actor = chello.ClientID.String()
+	}
+	result := "denied"
+	detail := ""
+	if err != nil {
+		result = "error"
+		detail = err.Error()
+	} else if isok {
+		result = "allowed"
+	}
+	recordAudit("client_auth", actor, c.remoteAddr, "auth", c.id, result, detail)
+}
+
+// manageActor names who a manage request is made by without revealing the token
+func manageActor(token string, id *identity) string {
+	fingerprint := "none"
+	if token != "" {
+		sum := sha256.Sum256([]byte(token))
+		fingerprint = hex.EncodeToString(sum[:4])
+	}
+	if id == nil {
+		return "token:" + fingerprint
+	}
+	role := ""
+	for name, r := range roleNames {
+		if r == id.role {
+			role = name
+		}
+	}
+	if id.tenant != nil {
+		role += "@" + id.tenant.Name
+	}
+	return fmt.Sprintf("%s(token:%s)", role, fingerprint)
+}
+
+// statusRecorder keeps the status code answered to a request
+type statusRecorder struct {
+	http.ResponseWriter
+	code int
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	s.code = code
+	s.ResponseWriter.WriteHeader(code)
+}
+
+// auditHandler lists the records at /api/v1/audit after the since parameter,of the kind parameter if given,
+// and checks the chain at /api/v1/audit/verify
+func auditHandler(w http.ResponseWriter, r *http.Request) {
+	if requestTenant(r) != nil {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprintf(w, "permission denied")
+		return
+	}
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		fmt.Fprintf(w, "method not allowed")
+		return
+	}
+	if r.URL.Path == "/api/v1/audit/verify" {
+		v, err := verifyAudit()
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(w, err.Error())
+			return
+		}
+		writeJson(w, http.StatusOK, v)
+		return
+	}
+	q := r.URL.Query()
+	since, _ := strconv.ParseUint(q.Get("since"), 10, 64)
+	kind := q.Get("kind")
+	limit, err := strconv.Atoi(q.Get("limit"))
+	if err != nil || limit <= 0 {
+		limit = defaultPageLimit
+	} else if limit > maxPageLimit {
+		limit = maxPageLimit
+	}
+	records := []auditRecord{}
+	err = eachAudit(func(a auditRecord) bool {
+		if a.Seq > since && (kind == "" || a.Kind == kind) {
+			records = append(records, a)
+		}
+		return len(records) < limit
+	})
+	if err != nil && err != errTornAudit {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, err.Error())
+		return
+	}
+	writeJson(w, http.StatusOK, records)
+}
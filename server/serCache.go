@@ -0,0 +1,292 @@
+// Copyright 2017 longXboy, longxboyhi@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"container/list"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const defaultCacheMaxObjectSize = 1 << 20
+
+// Cache keeps the responses of http tunnels with cache enabled on server,
+// so repeated fetches of static assets are not sent over the pipes
+type Cache struct {
+	//bytes of all the cached responses,0 disables caching
+	MaxSize int64 `yaml:"max_size,omitempty"`
+	//bytes of a cached response body at most,default to 1MB
+	MaxObjectSize int64 `yaml:"max_object_size,omitempty"`
+}
+
+// statuses cacheable by default according to rfc7231
+var cacheableStatus = map[int]bool{200: true, 203: true, 204: true, 300: true, 301: true, 404: true, 405: true, 410: true, 414: true, 501: true}
+
+type cacheEntry struct {
+	key      string
+	status   int
+	header   http.Header
+	body     []byte
+	storedAt time.Time
+	expires  time.Time
+	elem     *list.Element
+}
+
+func (e *cacheEntry) size() int64 {
+	size := int64(len(e.key) + len(e.body))
+	for k, vs := range e.header {
+		for _, v := range vs {
+			size += int64(len(k) + len(v))
+		}
+	}
+	return size
+}
+
+// responseCache is a lru cache bounded by the bytes of its entries
+type responseCache struct {
+	lock    sync.Mutex
+	size    int64
+	entries map[string]*cacheEntry
+	lru     *list.List
+
+	hits   uint64
+	misses uint64
+}
+
+var edgeCache = &responseCache{entries: make(map[string]*cacheEntry), lru: list.New()}
+
+func (rc *responseCache) get(key string, now time.Time) *cacheEntry {
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+	e, isok := rc.entries[key]
+	if !isok {
+		return nil
+	}
+	if now.After(e.expires) {
+		rc.remove(e)
+		return nil
+	}
+	rc.lru.MoveToFront(e.elem)
+	return e
+}
+
+func (rc *responseCache) put(e *cacheEntry) {
+	size := e.size()
+	if size > serverConf.Cache.MaxSize {
+		return
+	}
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+	if old, isok := rc.entries[e.key]; isok {
+		rc.remove(old)
+	}
+	for rc.size+size > serverConf.Cache.MaxSize {
+		rc.remove(rc.lru.Back().Value.(*cacheEntry))
+	}
+	e.elem = rc.lru.PushFront(e)
+	rc.entries[e.key] = e
+	rc.size += size
+}
+
+func (rc *responseCache) remove(e *cacheEntry) {
+	rc.lru.Remove(e.elem)
+	delete(rc.entries, e.key)
+	rc.size -= e.size()
+}
+
+// purge drops the responses of a tunnel,its public addr may be taken by another client next
+func (rc *responseCache) purge(publicAddr string) {
+	prefix := publicAddr + " "
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+	for key, e := range rc.entries {
+		if strings.HasPrefix(key, prefix) {
+			rc.remove(e)
+		}
+	}
+}
+
+func (rc *responseCache) stats() (int64, int) {
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+	return rc.size, len(rc.entries)
+}
+
+func cacheDirectives(h http.Header) map[string]string {
+	directives := make(map[string]string)
+	for _, v := range h["Cache-Control"] {
+		for _, d := range strings.Split(v, ",") {
+			d = strings.TrimSpace(d)
+			if d == "" {
+				continue
+			}
+			kv := strings.SplitN(d, "=", 2)
+			if len(kv) == 2 {
+				directives[strings.ToLower(kv[0])] = strings.Trim(kv[1], `"`)
+			} else {
+				directives[strings.ToLower(kv[0])] = ""
+			}
+		}
+	}
+	return directives
+}
+
+// cacheKey returns the key of req,false if the request must not be answered from cache
+func cacheKey(publicAddr string, req *http.Request) (string, bool) {
+	if req.Method != "GET" && req.Method != "HEAD" {
+		return "", false
+	}
+	if req.Header.Get("Authorization") != "" || req.Header.Get("Upgrade") != "" {
+		return "", false
+	}
+	directives := cacheDirectives(req.Header)
+	if _, isok := directives["no-store"]; isok {
+		return "", false
+	}
+	if _, isok := directives["no-cache"]; isok {
+		return "", false
+	}
+	if req.Header.Get("Pragma") == "no-cache" {
+		return "", false
+	}
+	return fmt.Sprintf("%s %s%s %s", publicAddr, req.Host, req.RequestURI, req.Header.Get("Accept-Encoding")), true
+}
+
+// freshness returns how long resp may be served from cache,0 if it is not cacheable
+func freshness(resp *http.Response, now time.Time) time.Duration {
+	if !cacheableStatus[resp.StatusCode] || len(resp.Header["Set-Cookie"]) > 0 {
+		return 0
+	}
+	for _, v := range resp.Header["Vary"] {
+		for _, field := range strings.Split(v, ",") {
+			if !strings.EqualFold(strings.TrimSpace(field), "Accept-Encoding") {
+				return 0
+			}
+		}
+	}
+	directives := cacheDirectives(resp.Header)
+	for _, d := range []string{"no-store", "no-cache", "private"} {
+		if _, isok := directives[d]; isok {
+			return 0
+		}
+	}
+	for _, d := range []string{"s-maxage", "max-age"} {
+		if v, isok := directives[d]; isok {
+			seconds, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || seconds <= 0 {
+				return 0
+			}
+			return time.Duration(seconds) * time.Second
+		}
+	}
+	expires, err := http.ParseTime(resp.Header.Get("Expires"))
+	if err != nil {
+		return 0
+	}
+	date, err := http.ParseTime(resp.Header.Get("Date"))
+	if err != nil {
+		date = now
+	}
+	return expires.Sub(date)
+}
+
+// limitedBuffer keeps what is written until limit is exceeded
+type limitedBuffer struct {
+	buf      bytes.Buffer
+	limit    int64
+	overflow bool
+}
+
+func (lb *limitedBuffer) Write(p []byte) (int, error) {
+	if !lb.overflow {
+		if int64(lb.buf.Len()+len(p)) > lb.limit {
+			lb.overflow = true
+			lb.buf.Reset()
+		} else {
+			lb.buf.Write(p)
+		}
+	}
+	return len(p), nil
+}
+
+func (e *cacheEntry) response(req *http.Request, now time.Time) *http.Response {
+	header := make(http.Header, len(e.header)+2)
+	for k, vs := range e.header {
+		header[k] = vs
+	}
+	header.Set("Age", strconv.Itoa(int(now.Sub(e.storedAt)/time.Second)))
+	header.Set("X-Lunnel-Cache", "HIT")
+	resp := &http.Response{StatusCode: e.status, ProtoMajor: 1, ProtoMinor: 1, Header: header, Request: req, ContentLength: int64(len(e.body))}
+	if req.Method == "HEAD" {
+		resp.Body = ioutil.NopCloser(bytes.NewReader(nil))
+	} else {
+		resp.Body = ioutil.NopCloser(bytes.NewReader(e.body))
+	}
+	return resp
+}
+
+func (t *Tunnel) cacheEnabled() bool {
+	return serverConf.Cache.MaxSize > 0 && t.config().Cache
+}
+
+// cachedResponse answers req from cache,it returns nil on a miss or if the request can't be cached.
+// key is set if the response of the request may be stored
+func cachedResponse(t *Tunnel, req *http.Request, now time.Time) (*http.Response, string) {
+	if !t.cacheEnabled() {
+		return nil, ""
+	}
+	key, cacheable := cacheKey(t.config().PublicAddr(), req)
+	if !cacheable {
+		return nil, ""
+	}
+	if e := edgeCache.get(key, now); e != nil {
+		atomic.AddUint64(&edgeCache.hits, 1)
+		return e.response(req, now), key
+	}
+	atomic.AddUint64(&edgeCache.misses, 1)
+	return nil, key
+}
+
+// cacheResponse tees the body of resp to be stored under key once it is written
+func cacheResponse(req *http.Request, resp *http.Response, key string, now time.Time) func() {
+	fresh := freshness(resp, now)
+	if key == "" || req.Method != "GET" || fresh <= 0 {
+		return func() {}
+	}
+	body := &limitedBuffer{limit: serverConf.Cache.MaxObjectSize}
+	resp.Body = ioutil.NopCloser(io.TeeReader(resp.Body, body))
+	resp.Header.Set("X-Lunnel-Cache", "MISS")
+	return func() {
+		if body.overflow {
+			return
+		}
+		header := make(http.Header, len(resp.Header))
+		for k, vs := range resp.Header {
+			header[k] = vs
+		}
+		header.Del("X-Lunnel-Cache")
+		header.Del("Connection")
+		header.Del("Keep-Alive")
+		edgeCache.put(&cacheEntry{key: key, status: resp.StatusCode, header: header, body: body.buf.Bytes(), storedAt: now, expires: now.Add(fresh)})
+	}
+}
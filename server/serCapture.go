@@ -0,0 +1,303 @@
+// Copyright 2017 longXboy, longxboyhi@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/longXboy/lunnel/log"
+	"github.com/longXboy/lunnel/util"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultCaptureDuration = time.Second * 60
+	maxCaptureDuration     = time.Minute * 30
+	defaultCaptureBytes    = 16 << 20
+	maxCaptureBytes        = 1 << 30
+)
+
+// capture writes the traffic of the public connections of a tunnel to a pcap file
+// until its duration elapses or max_bytes are written
+type capture struct {
+	t        *Tunnel
+	path     string
+	started  time.Time
+	deadline time.Time
+	maxBytes int64
+
+	lock    sync.Mutex
+	f       *os.File
+	w       *bufio.Writer
+	pw      *util.PcapWriter
+	timer   *time.Timer
+	bytes   int64
+	packets int64
+	//why the capture stopped,empty while it runs
+	stopped string
+}
+
+type captureInfo struct {
+	Path     string
+	Started  time.Time
+	Deadline time.Time
+	MaxBytes int64
+	Bytes    int64
+	Packets  int64
+	Stopped  string `json:",omitempty"`
+}
+
+func (c *capture) info() captureInfo {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return captureInfo{Path: c.path, Started: c.started, Deadline: c.deadline, MaxBytes: c.maxBytes, Bytes: c.bytes, Packets: c.packets, Stopped: c.stopped}
+}
+
+var errCaptureRunning = errors.New("tunnel is being captured already")
+
+var captureNameRe = regexp.MustCompile(`[^A-Za-z0-9_.-]`)
+
+// startCapture starts capturing the traffic of t into a new file of capture_dir
+func startCapture(t *Tunnel, duration time.Duration, maxBytes int64) (*capture, error) {
+	now := time.Now()
+	name := fmt.Sprintf("%s-%s-%d.pcap", captureNameRe.ReplaceAllString(t.name, "_"), t.ctl.ClientID.String()[:8], now.Unix())
+	path := filepath.Join(serverConf.CaptureDir, name)
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, errors.Wrap(err, "create capture file")
+	}
+	w := bufio.NewWriter(f)
+	pw, err := util.NewPcapWriter(w)
+	if err != nil {
+		f.Close()
+		return nil, errors.Wrap(err, "write capture header")
+	}
+	c := &capture{t: t, path: path, started: now, deadline: now.Add(duration), maxBytes: maxBytes, f: f, w: w, pw: pw}
+	c.timer = time.AfterFunc(duration, func() { c.stop("duration elapsed") })
+	t.captureLock.Lock()
+	if t.capture != nil {
+		t.captureLock.Unlock()
+		c.timer.Stop()
+		f.Close()
+		os.Remove(path)
+		return nil, errCaptureRunning
+	}
+	t.capture = c
+	t.captureLock.Unlock()
+	log.WithFields(log.Fields{"tunnel": t.name, "client_id": t.ctl.ClientID.String(), "path": path, "duration": duration, "max_bytes": maxBytes}).Infoln("traffic capture started")
+	recordEvent("capture_started", t.ctl, t.name, path)
+	return c, nil
+}
+
+func (c *capture) stop(reason string) {
+	c.lock.Lock()
+	if c.stopped != "" {
+		c.lock.Unlock()
+		return
+	}
+	c.stopLocked(reason)
+	c.lock.Unlock()
+}
+
+func (c *capture) stopLocked(reason string) {
+	c.stopped = reason
+	c.timer.Stop()
+	err := c.w.Flush()
+	if err == nil {
+		err = c.f.Close()
+	} else {
+		c.f.Close()
+	}
+	c.t.captureLock.Lock()
+	if c.t.capture == c {
+		c.t.capture = nil
+	}
+	c.t.captureLock.Unlock()
+	fields := log.Fields{"tunnel": c.t.name, "path": c.path, "reason": reason, "bytes": c.bytes, "packets": c.packets}
+	if err != nil {
+		fields["err"] = err
+	}
+	log.WithFields(fields).Infoln("traffic capture stopped")
+}
+
+// write writes a segment of a captured connection,the capture stops once it is out of bytes
+func (c *capture) write(src, dst *net.TCPAddr, seq, ack uint32, flags uint8, payload []byte) {
+	if c.stopped != "" {
+		return
+	}
+	n, err := c.pw.WriteTCP(time.Now(), src, dst, seq, ack, flags, payload)
+	c.bytes += int64(n)
+	c.packets++
+	if err != nil {
+		c.stopLocked(fmt.Sprintf("write failed:%v", err))
+	} else if c.bytes >= c.maxBytes {
+		c.stopLocked("max_bytes reached")
+	}
+}
+
+// captureFlow makes up a tcp connection from the user to the public address for a captured connection
+type captureFlow struct {
+	c          *capture
+	user, edge *net.TCPAddr
+	userSeq    uint32
+	edgeSeq    uint32
+}
+
+func tcpAddrOf(addr net.Addr) *net.TCPAddr {
+	if tcp, isok := addr.(*net.TCPAddr); isok {
+		return tcp
+	}
+	ta := &net.TCPAddr{IP: net.IPv4zero}
+	if addr == nil {
+		return ta
+	}
+	host, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return ta
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		ta.IP = ip
+	}
+	ta.Port, _ = strconv.Atoi(port)
+	return ta
+}
+
+// captureConn returns the flow of userConn if t is being captured,nil otherwise
+func (t *Tunnel) captureConn(userConn net.Conn) *captureFlow {
+	t.captureLock.Lock()
+	c := t.capture
+	t.captureLock.Unlock()
+	if c == nil {
+		return nil
+	}
+	f := &captureFlow{c: c, user: tcpAddrOf(userConn.RemoteAddr()), edge: tcpAddrOf(userConn.LocalAddr())}
+	c.lock.Lock()
+	c.write(f.user, f.edge, 0, 0, util.TcpSyn, nil)
+	c.write(f.edge, f.user, 0, 1, util.TcpSyn|util.TcpAck, nil)
+	c.write(f.user, f.edge, 1, 1, util.TcpAck, nil)
+	c.lock.Unlock()
+	f.userSeq, f.edgeSeq = 1, 1
+	return f
+}
+
+// data writes p sent by the user if up is true,otherwise received by the user
+func (f *captureFlow) data(up bool, p []byte) {
+	f.c.lock.Lock()
+	defer f.c.lock.Unlock()
+	for len(p) > 0 {
+		seg := p
+		if len(seg) > util.PcapMaxPayload {
+			seg = seg[:util.PcapMaxPayload]
+		}
+		if up {
+			f.c.write(f.user, f.edge, f.userSeq, f.edgeSeq, util.TcpPsh|util.TcpAck, seg)
+			f.userSeq += uint32(len(seg))
+		} else {
+			f.c.write(f.edge, f.user, f.edgeSeq, f.userSeq, util.TcpPsh|util.TcpAck, seg)
+			f.edgeSeq += uint32(len(seg))
+		}
+		p = p[len(seg):]
+	}
+}
+
+func (f *captureFlow) up(p []byte) {
+	f.data(true, p)
+}
+
+func (f *captureFlow) down(p []byte) {
+	f.data(false, p)
+}
+
+func (f *captureFlow) close() {
+	f.c.lock.Lock()
+	f.c.write(f.user, f.edge, f.userSeq, f.edgeSeq, util.TcpFin|util.TcpAck, nil)
+	f.c.write(f.edge, f.user, f.edgeSeq, f.userSeq+1, util.TcpFin|util.TcpAck, nil)
+	f.c.lock.Unlock()
+}
+
+// tunnelCapture handles /api/v1/tunnels/{name}/capture,POST starts capturing for the duration(seconds)
+// and max_bytes query parameters,GET shows the running capture and DELETE stops it
+func tunnelCapture(w http.ResponseWriter, r *http.Request, t *Tunnel) {
+	if requestTenant(r) != nil {
+		// the capture is of the decrypted traffic and is written on server,so it is left to the tokens of server
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprintf(w, "permission denied")
+		return
+	}
+	t.captureLock.Lock()
+	c := t.capture
+	t.captureLock.Unlock()
+	switch r.Method {
+	case "POST":
+		if serverConf.CaptureDir == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "capture_dir of server is not set")
+			return
+		}
+		duration := defaultCaptureDuration
+		if s := r.URL.Query().Get("duration"); s != "" {
+			secs, err := strconv.ParseInt(s, 10, 64)
+			if err != nil || secs <= 0 || time.Duration(secs)*time.Second > maxCaptureDuration {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprintf(w, "duration must be 1 to %d seconds", int64(maxCaptureDuration/time.Second))
+				return
+			}
+			duration = time.Duration(secs) * time.Second
+		}
+		maxBytes := int64(defaultCaptureBytes)
+		if s := r.URL.Query().Get("max_bytes"); s != "" {
+			var err error
+			maxBytes, err = strconv.ParseInt(s, 10, 64)
+			if err != nil || maxBytes <= 0 || maxBytes > maxCaptureBytes {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprintf(w, "max_bytes must be 1 to %d", maxCaptureBytes)
+				return
+			}
+		}
+		c, err := startCapture(t, duration, maxBytes)
+		if err == errCaptureRunning {
+			w.WriteHeader(http.StatusConflict)
+			fmt.Fprint(w, err.Error())
+			return
+		} else if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(w, err.Error())
+			return
+		}
+		writeJson(w, http.StatusOK, c.info())
+	case "GET", "DELETE":
+		if c == nil {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintf(w, "tunnel is not being captured")
+			return
+		}
+		if r.Method == "DELETE" {
+			c.stop("stopped by administrator")
+		}
+		writeJson(w, http.StatusOK, c.info())
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		fmt.Fprintf(w, "method not allowed")
+	}
+}
@@ -0,0 +1,319 @@
+// Copyright 2017 longXboy, longxboyhi@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/longXboy/lunnel/contrib"
+	"github.com/longXboy/lunnel/log"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ocsp"
+)
+
+// certExpiryWarning is how long before expiry a certificate of the chain is reported
+const certExpiryWarning = time.Hour * 24 * 14
+
+// maxOCSPResponse is the largest ocsp response read from the responder
+const maxOCSPResponse = 1 << 20
+
+var ocspClient = &http.Client{Timeout: time.Second * 15}
+
+// certStatus is the state of the configured tls certificate found by the last check
+type certStatus struct {
+	Subject  string
+	DNSNames []string `json:",omitempty"`
+	NotAfter int64
+	//good,revoked or unknown as answered by the ocsp responder,empty if not checked
+	OCSPStatus     string `json:",omitempty"`
+	OCSPNextUpdate int64  `json:",omitempty"`
+	Stapled        bool
+	Problems       []string `json:",omitempty"`
+	Checked        int64
+
+	inventory []certInfo
+}
+
+// certInfo is a certificate loaded by server,the leaf or an intermediate of its chain
+type certInfo struct {
+	//file for the certificates loaded from tls.cert
+	Source    string
+	Path      string
+	Leaf      bool
+	Subject   string
+	Issuer    string
+	DNSNames  []string `json:",omitempty"`
+	Serial    string
+	NotBefore int64
+	NotAfter  int64
+}
+
+var certLock sync.RWMutex
+var lastCertStatus certStatus
+
+// certInventory are the certificates found by the last check
+var certInventory []certInfo
+
+// ocspStaple is the ocsp response stapled to the handshakes of leaf
+var ocspStaple struct {
+	leaf       []byte
+	response   []byte
+	nextUpdate time.Time
+}
+
+// stapleOCSP attaches the ocsp response fetched for the leaf of cert,
+// a certificate replaced on disk isn't stapled until it is checked again
+func stapleOCSP(cert *tls.Certificate) {
+	if len(cert.Certificate) == 0 {
+		return
+	}
+	certLock.RLock()
+	defer certLock.RUnlock()
+	if ocspStaple.response != nil && bytes.Equal(ocspStaple.leaf, cert.Certificate[0]) && time.Now().Before(ocspStaple.nextUpdate) {
+		cert.OCSPStaple = ocspStaple.response
+	}
+}
+
+func parseChain(cert tls.Certificate) ([]*x509.Certificate, error) {
+	chain := make([]*x509.Certificate, 0, len(cert.Certificate))
+	for _, der := range cert.Certificate {
+		c, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, errors.Wrap(err, "parse certificate")
+		}
+		chain = append(chain, c)
+	}
+	if len(chain) == 0 {
+		return nil, errors.New("no certificate found")
+	}
+	return chain, nil
+}
+
+// checkChain reports the certificates of chain expired or about to,
+// and the chain which can't be verified with the intermediates it carries
+func checkChain(chain []*x509.Certificate, now time.Time) []string {
+	var problems []string
+	for _, c := range chain {
+		if now.Before(c.NotBefore) {
+			problems = append(problems, fmt.Sprintf("certificate %s is not valid before %s", c.Subject.CommonName, c.NotBefore.Format(time.RFC3339)))
+		} else if now.After(c.NotAfter) {
+			problems = append(problems, fmt.Sprintf("certificate %s expired at %s", c.Subject.CommonName, c.NotAfter.Format(time.RFC3339)))
+		} else if c.NotAfter.Sub(now) < certExpiryWarning {
+			problems = append(problems, fmt.Sprintf("certificate %s expires at %s", c.Subject.CommonName, c.NotAfter.Format(time.RFC3339)))
+		}
+	}
+	intermediates := x509.NewCertPool()
+	for _, c := range chain[1:] {
+		intermediates.AddCert(c)
+	}
+	_, err := chain[0].Verify(x509.VerifyOptions{Intermediates: intermediates, CurrentTime: now})
+	if err != nil {
+		problems = append(problems, fmt.Sprintf("chain incomplete or untrusted:%s", err.Error()))
+	}
+	return problems
+}
+
+// fetchOCSP asks the ocsp responder of leaf for its status
+func fetchOCSP(leaf *x509.Certificate, issuer *x509.Certificate) ([]byte, *ocsp.Response, error) {
+	req, err := ocsp.CreateRequest(leaf, issuer, nil)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "create ocsp request")
+	}
+	resp, err := ocspClient.Post(leaf.OCSPServer[0], "application/ocsp-request", bytes.NewReader(req))
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "post ocsp request")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, errors.Errorf("ocsp response code %d", resp.StatusCode)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxOCSPResponse))
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "read ocsp response")
+	}
+	parsed, err := ocsp.ParseResponseForCert(body, leaf, issuer)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "parse ocsp response")
+	}
+	return body, parsed, nil
+}
+
+// checkCert loads the configured certificate,checks its chain and refreshes the ocsp staple
+func checkCert() certStatus {
+	now := time.Now()
+	status := certStatus{Checked: now.Unix()}
+	cert, err := tls.LoadX509KeyPair(serverConf.Tls.TlsCert, serverConf.Tls.TlsKey)
+	if err != nil {
+		status.Problems = append(status.Problems, fmt.Sprintf("load certificate failed:%s", err.Error()))
+		return status
+	}
+	chain, err := parseChain(cert)
+	if err != nil {
+		status.Problems = append(status.Problems, err.Error())
+		return status
+	}
+	for i, c := range chain {
+		status.inventory = append(status.inventory, certInfo{
+			Source:    "file",
+			Path:      serverConf.Tls.TlsCert,
+			Leaf:      i == 0,
+			Subject:   c.Subject.CommonName,
+			Issuer:    c.Issuer.CommonName,
+			DNSNames:  c.DNSNames,
+			Serial:    c.SerialNumber.Text(16),
+			NotBefore: c.NotBefore.Unix(),
+			NotAfter:  c.NotAfter.Unix(),
+		})
+	}
+	leaf := chain[0]
+	status.Subject = leaf.Subject.CommonName
+	status.DNSNames = leaf.DNSNames
+	status.NotAfter = leaf.NotAfter.Unix()
+	status.Problems = checkChain(chain, now)
+	if serverConf.Tls.DisableOCSP || len(leaf.OCSPServer) == 0 {
+		return status
+	}
+	if len(chain) < 2 {
+		status.Problems = append(status.Problems, "issuer missing from chain,can't staple ocsp")
+		return status
+	}
+	raw, resp, err := fetchOCSP(leaf, chain[1])
+	if err != nil {
+		status.Problems = append(status.Problems, fmt.Sprintf("fetch ocsp failed:%s", err.Error()))
+		// the staple fetched before is still served until its next update
+		certLock.RLock()
+		status.Stapled = bytes.Equal(ocspStaple.leaf, leaf.Raw) && now.Before(ocspStaple.nextUpdate)
+		certLock.RUnlock()
+		return status
+	}
+	status.OCSPNextUpdate = resp.NextUpdate.Unix()
+	switch resp.Status {
+	case ocsp.Good:
+		status.OCSPStatus = "good"
+		nextUpdate := resp.NextUpdate
+		if nextUpdate.IsZero() {
+			nextUpdate = now.Add(time.Duration(serverConf.Tls.CheckInterval) * time.Second)
+		}
+		certLock.Lock()
+		ocspStaple.leaf = leaf.Raw
+		ocspStaple.response = raw
+		ocspStaple.nextUpdate = nextUpdate
+		certLock.Unlock()
+		status.Stapled = true
+	case ocsp.Revoked:
+		status.OCSPStatus = "revoked"
+		status.Problems = append(status.Problems, fmt.Sprintf("certificate %s revoked at %s", leaf.Subject.CommonName, resp.RevokedAt.Format(time.RFC3339)))
+	default:
+		status.OCSPStatus = "unknown"
+		status.Problems = append(status.Problems, fmt.Sprintf("ocsp status of certificate %s unknown", leaf.Subject.CommonName))
+	}
+	return status
+}
+
+// updateCertStatus runs a check and reports the problems which weren't found by the check before
+func updateCertStatus() certStatus {
+	status := checkCert()
+	certLock.Lock()
+	last := lastCertStatus
+	lastCertStatus = status
+	certInventory = status.inventory
+	certLock.Unlock()
+	problems := append([]string{}, status.Problems...)
+	sort.Strings(problems)
+	lastProblems := append([]string{}, last.Problems...)
+	sort.Strings(lastProblems)
+	if len(problems) == 0 || strings.Join(problems, "\n") == strings.Join(lastProblems, "\n") {
+		return status
+	}
+	detail := strings.Join(status.Problems, ";")
+	recordEvent("cert_problem", nil, "", detail)
+	log.WithFields(log.Fields{"cert": serverConf.Tls.TlsCert, "problems": detail}).Warningln("tls certificate check failed!")
+	if serverConf.NotifyEnable {
+		go func() {
+			err := contrib.CertProblem(serverConf.ServerDomain, status.Subject, status.NotAfter, status.Problems)
+			if err != nil {
+				log.WithFields(log.Fields{"err": err}).Errorln("notify cert problem failed!")
+			}
+		}()
+	}
+	return status
+}
+
+// runCertCheck checks the certificate on startup and then every check_interval seconds
+func runCertCheck() {
+	ticker := time.NewTicker(time.Duration(serverConf.Tls.CheckInterval) * time.Second)
+	defer ticker.Stop()
+	for {
+		updateCertStatus()
+		<-ticker.C
+	}
+}
+
+// certHandler serves /api/v1/tls,GET returns the last check and POST checks again at once
+func certHandler(w http.ResponseWriter, r *http.Request) {
+	if serverConf.Tls.TlsCert == "" {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "tls not configured")
+		return
+	}
+	switch r.Method {
+	case "GET":
+		certLock.RLock()
+		status := lastCertStatus
+		certLock.RUnlock()
+		writeJson(w, http.StatusOK, status)
+	case "POST":
+		writeJson(w, http.StatusOK, updateCertStatus())
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		fmt.Fprintf(w, "method not allowed")
+	}
+}
+
+// certListHandler serves the certificates of the last check at /api/v1/tls/certs
+func certListHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		fmt.Fprintf(w, "method not allowed")
+		return
+	}
+	certLock.RLock()
+	list := append([]certInfo{}, certInventory...)
+	certLock.RUnlock()
+	writeJson(w, http.StatusOK, list)
+}
+
+// writeCertMetrics writes the days left before each certificate of the inventory expires,
+// negative for the expired ones
+func writeCertMetrics(w io.Writer) {
+	certLock.RLock()
+	defer certLock.RUnlock()
+	fmt.Fprintf(w, "# TYPE lunnel_tls_cert_expiry_days gauge\n")
+	now := time.Now()
+	for _, c := range certInventory {
+		days := time.Unix(c.NotAfter, 0).Sub(now).Hours() / 24
+		fmt.Fprintf(w, "lunnel_tls_cert_expiry_days{subject=%q,serial=%q,source=%q,leaf=\"%t\"} %.2f\n", c.Subject, c.Serial, c.Source, c.Leaf, days)
+	}
+}
@@ -17,9 +17,15 @@ package server
 import (
 	"crypto/sha1"
 	"encoding/json"
+	"io/ioutil"
+	"os"
 	"strconv"
 
+	"github.com/longXboy/lunnel/contrib"
+	"github.com/longXboy/lunnel/crypto"
 	"github.com/longXboy/lunnel/log"
+	"github.com/longXboy/lunnel/transport"
+	"github.com/longXboy/lunnel/util"
 	"github.com/pkg/errors"
 	"golang.org/x/crypto/pbkdf2"
 	"gopkg.in/yaml.v2"
@@ -27,11 +33,56 @@ import (
 
 type Aes struct {
 	SecretKey string `yaml:"secret_key,omitempty"`
+	//more keys by id,a client selects one by its aes key_id so the keys can be rotated client by client
+	Keys map[string]string `yaml:"keys,omitempty"`
+
+	keys map[string][]byte
+}
+
+func deriveAesKey(secret string) []byte {
+	pass := pbkdf2.Key([]byte(secret), []byte("lunnel"), 4096, 32, sha1.New)
+	return pass[:16]
+}
+
+// key returns the derived key of id,the empty id is the secret_key
+func (a *Aes) key(id string) ([]byte, bool) {
+	key, isok := a.keys[id]
+	return key, isok
+}
+
+// Noise is the static key of server for the noise encrypt mode,generated by lunnelSer -gen_noise_key
+type Noise struct {
+	PrivateKey string `yaml:"private_key,omitempty"`
+	//public keys of the clients allowed to connect in noise mode,empty allows any client
+	ClientKeys []string `yaml:"client_keys,omitempty"`
+
+	key        *crypto.NoiseKey
+	clientKeys map[[32]byte]bool
+}
+
+// Obfs wraps the connections of clients beneath the encrypt mode,clients must be configured with the same mode and key
+type Obfs struct {
+	//xor or tls(mimic a tls 1.3 handshake),empty disables obfuscation
+	Mode string `yaml:"mode,omitempty"`
+	Key  string `yaml:"key,omitempty"`
+
+	obfuscator transport.Obfuscator
 }
 
 type Tls struct {
 	TlsCert string `yaml:"cert,omitempty"`
 	TlsKey  string `yaml:"key,omitempty"`
+	//clients reconnecting resume their tls sessions by tickets unless disabled
+	DisableTickets bool `yaml:"disable_session_tickets,omitempty"`
+	//seconds between rotations of the ticket keys,default to 3600.tickets are accepted for 3 rotations
+	TicketRotation int `yaml:"ticket_rotation,omitempty"`
+	//ticket keys are derived from it if not empty,sharing it lets servers resume the sessions of each other,
+	//otherwise they are random and lost on restart
+	TicketSecret string `yaml:"ticket_secret,omitempty"`
+	//ocsp responses are stapled to the handshakes of https tunnels unless disabled
+	DisableOCSP bool `yaml:"disable_ocsp_stapling,omitempty"`
+	//seconds between checks of the chain and refreshes of the ocsp staple,default to 3600
+	CheckInterval int `yaml:"check_interval,omitempty"`
 }
 
 type Health struct {
@@ -39,9 +90,44 @@ type Health struct {
 	TimeOut  int64 `yaml:"timeout,omitempty"`
 }
 
+// TcpMux shares one public port between tcpmux tunnels,
+// the tunnel is selected by the first line of the connection
+// Websocket configures the ws transport,which is usually fronted by a CDN or load balancer
+type Websocket struct {
+	//url path the websocket is served at,default to /lunnel
+	Path string `yaml:"path,omitempty"`
+	//seconds between the pings to clients,default to 30
+	Heartbeat int `yaml:"heartbeat,omitempty"`
+}
+
+// DnsTunnel configures the experimental dns transport,which answers the queries of clients for a zone
+// delegated to server by a NS record.it listens on transport_ports.dns,default to 53
+type DnsTunnel struct {
+	//zone whose names are answered,like t.example.com
+	Zone string `yaml:"zone,omitempty"`
+}
+
+type TcpMux struct {
+	//0 disables tcpmux tunnels
+	Port uint16 `yaml:"port,omitempty"`
+	//the connection starts with Prefix followed by the host of the tunnel and a newline
+	Prefix string `yaml:"prefix,omitempty"`
+	//the connection starts with a PROXY protocol v1 header from an upstream load balancer,
+	//and the tunnel whose host is the destination port in the header is selected
+	ProxyProtocol bool `yaml:"proxy_protocol,omitempty"`
+}
+
 type Config struct {
-	Debug        bool   `yaml:"debug,omitempty"`
-	LogFile      string `yaml:"log_file,omitempty"`
+	Debug   bool   `yaml:"debug,omitempty"`
+	LogFile string `yaml:"log_file,omitempty"`
+	//times the same message is logged per minute at each level,the rest are counted in a summary line
+	LogSampling log.Sampling `yaml:"log_sampling,omitempty"`
+	//levels of the log modules(control,pipe,transport,vhost,manage) apart from the global one set by debug
+	LogLevels map[string]string `yaml:"log_levels,omitempty"`
+	//syslog daemon the log is sent to,local if addr is empty.it replaces stdout unless log_file is set
+	Syslog *log.Syslog `yaml:"syslog,omitempty"`
+	//send the log to systemd-journald with the fields kept,it replaces stdout unless log_file is set
+	Journald     bool   `yaml:"journald,omitempty"`
 	ListenPort   int    `yaml:"port,omitempty"`
 	ListenIP     string `yaml:"ip,omitempty"`
 	HttpPort     uint16 `yaml:"http_port,omitempty"`
@@ -50,19 +136,155 @@ type Config struct {
 	ServerDomain string `yaml:"server_domain,omitempty"`
 	Aes          Aes    `yaml:"aes,omitempty"`
 	Tls          Tls    `yaml:"tls,omitempty"`
-	AuthEnable   bool   `yaml:"auth_enable,omitempty"`
-	AuthUrl      string `yaml:"auth_url,omitempty"`
-	NotifyEnable bool   `yaml:"notify_enable,omitempty"`
-	NotifyUrl    string `yaml:"notify_url,omitempty"`
-	NotifyKey    string `yaml:"notify_key,omitempty"`
-	DSN          string `yaml:"dsn,omitempty"`
-	Health       Health `yaml:"health,omitempty"`
-	MaxIdlePipes string `yaml:"max_idle_pipes,omitempty"`
-	MaxStreams   string `yaml:"max_streams,omitempty"`
+	Noise        Noise  `yaml:"noise,omitempty"`
+	Obfs         Obfs   `yaml:"obfs,omitempty"`
+	//transports the control port is listened in,default to kcp and tcp.custom transports must be compiled in
+	Transports []string `yaml:"transports,omitempty"`
+	//port of the transports not listening on the control port
+	TransportPorts map[string]int `yaml:"transport_ports,omitempty"`
+	Websocket      Websocket      `yaml:"websocket,omitempty"`
+	DnsTunnel      DnsTunnel      `yaml:"dns_tunnel,omitempty"`
+	//tcp fast open,buffer sizes and congestion control of the tcp and ws listeners,linux only
+	Socket transport.SocketOptions `yaml:"socket,omitempty"`
+	//mtu of the kcp packets sent to clients,0 probes the path mtu to each client
+	KcpMtu int `yaml:"kcp_mtu,omitempty"`
+	//bytes a client may ask to be buffered for each of its pipes to carry its bandwidth over its rtt,default to 16MB
+	MaxReceiveBuffer int `yaml:"max_receive_buffer,omitempty"`
+	//soft RLIMIT_NOFILE raised to at startup,linux only.0 keeps the limit,which go raises to the hard one
+	MaxOpenFiles int `yaml:"max_open_files,omitempty"`
+	//clients listening for server to dial them,for the hosts which can be reached from server but can't reach out
+	ReverseClients []ReverseClient `yaml:"reverse_clients,omitempty"`
+	Relay          Relay           `yaml:"relay,omitempty"`
+	//faults injected into the connections of clients,only honored by lunnelSer built with -tags faults
+	Faults       transport.Faults `yaml:"faults,omitempty"`
+	Resume       Resume           `yaml:"resume,omitempty"`
+	Cache        Cache            `yaml:"cache,omitempty"`
+	AuthEnable   bool             `yaml:"auth_enable,omitempty"`
+	AuthUrl      string           `yaml:"auth_url,omitempty"`
+	NotifyEnable bool             `yaml:"notify_enable,omitempty"`
+	NotifyUrl    string           `yaml:"notify_url,omitempty"`
+	NotifyKey    string           `yaml:"notify_key,omitempty"`
+	DSN          string           `yaml:"dsn,omitempty"`
+	Health       Health           `yaml:"health,omitempty"`
+	MaxIdlePipes string           `yaml:"max_idle_pipes,omitempty"`
+	MaxStreams   string           `yaml:"max_streams,omitempty"`
+	//concurrent streams of a client over all its pipes,new public connections are refused beyond it,0 is unlimited
+	MaxClientStreams int64 `yaml:"max_client_streams,omitempty"`
+	//seconds a public connection waits for a pipe before refused as too busy,default to 10
+	PipeWaitTimeout int `yaml:"pipe_wait_timeout,omitempty"`
+	//seconds a write of proxied traffic may block on a visitor which stops reading or on a stuck pipe
+	//before the connection is closed as stalled,default to 60,negative disables it
+	WriteTimeout int `yaml:"write_timeout,omitempty"`
+	//pipes asked for at once when public connections are waiting for pipes,default to 4
+	MaxPipeRequests int `yaml:"max_pipe_requests,omitempty"`
+	//seconds a new control or pipe connection must send its hello in,default to 12
+	HandshakeTimeout int    `yaml:"handshake_timeout,omitempty"`
+	TcpMux           TcpMux `yaml:"tcp_mux,omitempty"`
+	//port knocks are accepted on,both udp packets and http requests,0 disables knocking
+	KnockPort uint16 `yaml:"knock_port,omitempty"`
+	//bytes every tunnel may transfer at most,0 is unlimited,a smaller byte_cap of tunnel takes precedence
+	TunnelByteCap uint64 `yaml:"tunnel_byte_cap,omitempty"`
+	//html file served by http tunnels which exceeded the byte cap
+	QuotaPage string `yaml:"quota_page,omitempty"`
+	//html file served by http tunnels of clients in maintenance which send no page of their own
+	MaintenancePage string `yaml:"maintenance_page,omitempty"`
+	//host of the http and https tunnel which serves the requests for the hosts no tunnel serves,
+	//empty answers them with bad gateway
+	FallbackHost string `yaml:"fallback_host,omitempty"`
+	//kick(default),reject or reassign,what to do with a client connecting with the id of another client still connected
+	DuplicateClient string `yaml:"duplicate_client,omitempty"`
+	//clients older than the version are told to upgrade,empty accepts any version
+	MinClientVersion string   `yaml:"min_client_version,omitempty"`
+	Approval         Approval `yaml:"approval,omitempty"`
+	//admin token of the manage api,which is open if it and api_tokens are empty
+	ManageToken string     `yaml:"manage_token,omitempty"`
+	ApiTokens   []ApiToken `yaml:"api_tokens,omitempty"`
+	//directory the traffic captures started from the manage api are written to,empty disables capturing
+	CaptureDir string             `yaml:"capture_dir,omitempty"`
+	Tenants    map[string]*Tenant `yaml:"tenants,omitempty"`
+	//settings shared by the tunnels which refer to them by profile
+	Profiles map[string]*Profile `yaml:"profiles,omitempty"`
+	//hosts served on the http and https ports by fixed backends instead of tunnels,clients can't register them
+	StaticRoutes map[string]*StaticRoute `yaml:"static_routes,omitempty"`
+	//tunnels assigned to the clients of the ids by name,the clients receive them when they connect
+	Provision map[string]map[string]*ProvisionedTunnel `yaml:"provision,omitempty"`
+	//ttl and webhook of the tunnels created at /api/v1/ephemeral of the manage api
+	Ephemeral Ephemeral `yaml:"ephemeral,omitempty"`
+	//ips or cidrs of the reverse proxies in front of the http and https ports,the visitor address
+	//is taken from their PROXY protocol header or X-Forwarded-For instead of the connection
+	TrustedProxies []string `yaml:"trusted_proxies,omitempty"`
+	Qos            Qos      `yaml:"qos,omitempty"`
+	Usage          Usage    `yaml:"usage,omitempty"`
+	Statsd         Statsd   `yaml:"statsd,omitempty"`
+	Tsdb           Tsdb     `yaml:"tsdb,omitempty"`
+	Alerting       Alerting `yaml:"alerting,omitempty"`
+	Overload       Overload `yaml:"overload,omitempty"`
+	Audit          Audit    `yaml:"audit,omitempty"`
+	//security events streamed to a siem in cef or json,apart from the log
+	Siem Siem `yaml:"siem,omitempty"`
+
+	faultInjector *transport.FaultInjector
 }
 
 var serverConf Config
 
+// quotaPage is the content of serverConf.QuotaPage
+var quotaPage string
+
+// maintenancePage is the content of serverConf.MaintenancePage
+var maintenancePage string
+
+// transportEnabled reports whether server listens in the transport of name
+func transportEnabled(name string) bool {
+	for _, t := range serverConf.Transports {
+		if t == name {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveSecrets replaces the ${scheme:ref} references of the secret options with the secrets they refer to
+func resolveSecrets() error {
+	contrib.RegisterVault()
+	secrets := []*string{
+		&serverConf.Tls.TlsCert,
+		&serverConf.Tls.TlsKey,
+		&serverConf.Tls.TicketSecret,
+		&serverConf.Aes.SecretKey,
+		&serverConf.Noise.PrivateKey,
+		&serverConf.NotifyKey,
+		&serverConf.Obfs.Key,
+		&serverConf.ManageToken,
+		&serverConf.Audit.Key,
+	}
+	for id, secret := range serverConf.Aes.Keys {
+		resolved, err := util.ResolveSecret(secret)
+		if err != nil {
+			return err
+		}
+		serverConf.Aes.Keys[id] = resolved
+	}
+	for i := range serverConf.ApiTokens {
+		secrets = append(secrets, &serverConf.ApiTokens[i].Token)
+	}
+	for _, tenant := range serverConf.Tenants {
+		if tenant == nil {
+			continue
+		}
+		secrets = append(secrets, &tenant.ApiToken)
+		for i := range tenant.Tokens {
+			secrets = append(secrets, &tenant.Tokens[i])
+		}
+	}
+	for _, profile := range serverConf.Profiles {
+		if profile != nil {
+			secrets = append(secrets, &profile.HttpAuth)
+		}
+	}
+	return util.ResolveSecrets(secrets...)
+}
+
 func LoadConfig(configDetail []byte, configType string) error {
 	var err error
 	if len(configDetail) > 0 {
@@ -78,6 +300,10 @@ func LoadConfig(configDetail []byte, configType string) error {
 			}
 		}
 	}
+	err = resolveSecrets()
+	if err != nil {
+		return err
+	}
 	if serverConf.ListenIP == "" {
 		serverConf.ListenIP = "0.0.0.0"
 	}
@@ -90,15 +316,155 @@ func LoadConfig(configDetail []byte, configType string) error {
 	if serverConf.HttpsPort == 0 {
 		serverConf.HttpsPort = 443
 	}
+	if serverConf.TcpMux.Prefix == "" {
+		serverConf.TcpMux.Prefix = "LUNNEL "
+	}
+	if serverConf.QuotaPage != "" {
+		page, err := ioutil.ReadFile(serverConf.QuotaPage)
+		if err != nil {
+			return errors.Wrap(err, "read quota_page")
+		}
+		quotaPage = string(page)
+	}
+	if serverConf.MaintenancePage != "" {
+		page, err := ioutil.ReadFile(serverConf.MaintenancePage)
+		if err != nil {
+			return errors.Wrap(err, "read maintenance_page")
+		}
+		maintenancePage = string(page)
+	}
+	if serverConf.CaptureDir != "" {
+		fi, err := os.Stat(serverConf.CaptureDir)
+		if err != nil {
+			return errors.Wrap(err, "stat capture_dir")
+		}
+		if !fi.IsDir() {
+			return errors.Errorf("capture_dir %s is not a directory", serverConf.CaptureDir)
+		}
+	}
+	if serverConf.Usage.Format != "" && serverConf.Usage.Format != "json" && serverConf.Usage.Format != "csv" {
+		return errors.Errorf("invalid usage format %s", serverConf.Usage.Format)
+	}
+	if serverConf.Tsdb.Format == "influx" && serverConf.Tsdb.Url == "" || serverConf.Tsdb.Format == "graphite" && serverConf.Tsdb.Addr == "" {
+		return errors.New("tsdb url(influx) or addr(graphite) must be specified")
+	} else if serverConf.Tsdb.Format != "" && serverConf.Tsdb.Format != "influx" && serverConf.Tsdb.Format != "graphite" {
+		return errors.Errorf("invalid tsdb format %s", serverConf.Tsdb.Format)
+	}
+	err = validateAlertRules(serverConf.Alerting.Rules)
+	if err != nil {
+		return err
+	}
+	err = initTenants()
+	if err != nil {
+		return err
+	}
+	err = validateProfiles()
+	if err != nil {
+		return err
+	}
+	err = validateStaticRoutes()
+	if err != nil {
+		return err
+	}
+	err = initProvisions()
+	if err != nil {
+		return err
+	}
+	if serverConf.Qos.Bandwidth > 0 {
+		uplink = newQosShaper(serverConf.Qos.Bandwidth, serverConf.Qos.Burst)
+	}
+	err = serverConf.Overload.normalize()
+	if err != nil {
+		return errors.Wrap(err, "overload")
+	}
+	trustedProxyNets, err = parseIPNets(serverConf.TrustedProxies)
+	if err != nil {
+		return errors.Wrap(err, "trusted_proxies")
+	}
+	err = initApiTokens()
+	if err != nil {
+		return err
+	}
 	if serverConf.ManagePort == 0 {
 		serverConf.ManagePort = 8081
 	}
+	serverConf.Aes.keys = make(map[string][]byte)
 	if serverConf.Aes.SecretKey != "" {
-		pass := pbkdf2.Key([]byte(serverConf.Aes.SecretKey), []byte("lunnel"), 4096, 32, sha1.New)
-		serverConf.Aes.SecretKey = string(pass[:16])
-	} else {
+		serverConf.Aes.SecretKey = string(deriveAesKey(serverConf.Aes.SecretKey))
+		serverConf.Aes.keys[""] = []byte(serverConf.Aes.SecretKey)
+	}
+	for id, secret := range serverConf.Aes.Keys {
+		if id == "" || secret == "" {
+			return errors.New("aes key id and secret can not be empty")
+		}
+		serverConf.Aes.keys[id] = deriveAesKey(secret)
+	}
+	if len(serverConf.Aes.keys) == 0 {
 		log.Warningln("server can not support AES mode without configuring AES's secretkey")
 	}
+	if len(serverConf.Transports) == 0 {
+		serverConf.Transports = []string{"kcp", "tcp"}
+	}
+	for _, name := range serverConf.Transports {
+		if _, err = transport.Lookup(name); err != nil {
+			return err
+		}
+	}
+	if transportEnabled("dns") {
+		if serverConf.DnsTunnel.Zone == "" {
+			return errors.New("zone of the dns transport can not be empty")
+		}
+		if _, isok := serverConf.TransportPorts["dns"]; !isok {
+			if serverConf.TransportPorts == nil {
+				serverConf.TransportPorts = make(map[string]int)
+			}
+			serverConf.TransportPorts["dns"] = 53
+		}
+	}
+	if serverConf.Cache.MaxSize < 0 || serverConf.Cache.MaxObjectSize < 0 {
+		return errors.New("cache max_size and max_object_size can not be negative")
+	}
+	if serverConf.Cache.MaxObjectSize == 0 {
+		serverConf.Cache.MaxObjectSize = defaultCacheMaxObjectSize
+	}
+	if serverConf.DuplicateClient == "" {
+		serverConf.DuplicateClient = duplicateKick
+	} else if serverConf.DuplicateClient != duplicateKick && serverConf.DuplicateClient != duplicateReject && serverConf.DuplicateClient != duplicateReassign {
+		return errors.Errorf("invalid duplicate_client %s", serverConf.DuplicateClient)
+	}
+	if serverConf.MinClientVersion != "" {
+		_, err = util.CompareVersion(serverConf.MinClientVersion, serverConf.MinClientVersion)
+		if err != nil {
+			return errors.Wrap(err, "min_client_version")
+		}
+	}
+	if serverConf.Resume.Window < 0 {
+		return errors.Errorf("invalid resume window %d", serverConf.Resume.Window)
+	}
+	if serverConf.Obfs.Mode != "" {
+		serverConf.Obfs.obfuscator, err = transport.NewObfuscator(serverConf.Obfs.Mode, serverConf.Obfs.Key, "")
+		if err != nil {
+			return err
+		}
+	}
+	if serverConf.Noise.PrivateKey != "" {
+		key, err := crypto.ParseNoiseKey(serverConf.Noise.PrivateKey)
+		if err != nil {
+			return errors.Wrap(err, "parse noise private_key")
+		}
+		serverConf.Noise.key = &key
+		serverConf.Noise.clientKeys = make(map[[32]byte]bool)
+		for _, k := range serverConf.Noise.ClientKeys {
+			pub, err := crypto.ParseNoisePublicKey(k)
+			if err != nil {
+				return errors.Wrapf(err, "parse noise client key %s", k)
+			}
+			serverConf.Noise.clientKeys[pub] = true
+		}
+		if len(serverConf.Noise.clientKeys) == 0 {
+			log.Warningln("noise client_keys is empty,any client with the key of server is accepted in noise mode")
+		}
+	}
 	if serverConf.ServerDomain == "" {
 		log.Warningln("server may not proxy http or https req correctly without configuring ServerDomain")
 	}
@@ -127,6 +493,70 @@ func LoadConfig(configDetail []byte, configType string) error {
 			log.Fatalln("max_streams must be an unsigned integer")
 		}
 	}
+	if serverConf.MaxClientStreams < 0 {
+		return errors.New("max_client_streams can not be negative")
+	}
+	if serverConf.Websocket.Heartbeat == 0 {
+		serverConf.Websocket.Heartbeat = 30
+	} else if serverConf.Websocket.Heartbeat < 0 {
+		return errors.New("websocket heartbeat can not be negative")
+	}
+	if serverConf.Tls.TicketRotation == 0 {
+		serverConf.Tls.TicketRotation = 3600
+	} else if serverConf.Tls.TicketRotation < 0 {
+		return errors.New("tls ticket_rotation can not be negative")
+	}
+	if serverConf.Tls.CheckInterval == 0 {
+		serverConf.Tls.CheckInterval = 3600
+	} else if serverConf.Tls.CheckInterval < 0 {
+		return errors.New("tls check_interval can not be negative")
+	}
+	if serverConf.MaxPipeRequests == 0 {
+		serverConf.MaxPipeRequests = 4
+	} else if serverConf.MaxPipeRequests < 0 {
+		return errors.New("max_pipe_requests can not be negative")
+	}
+	if serverConf.HandshakeTimeout == 0 {
+		serverConf.HandshakeTimeout = 12
+	} else if serverConf.HandshakeTimeout < 0 {
+		return errors.New("handshake_timeout can not be negative")
+	}
+	if serverConf.PipeWaitTimeout == 0 {
+		serverConf.PipeWaitTimeout = 10
+	} else if serverConf.PipeWaitTimeout < 0 {
+		return errors.New("pipe_wait_timeout can not be negative")
+	}
+	if err := serverConf.Socket.Validate(); err != nil {
+		return errors.Wrap(err, "socket")
+	}
+	if err := transport.ValidateKcpMtu(serverConf.KcpMtu); err != nil {
+		return err
+	}
+	if serverConf.MaxOpenFiles < 0 {
+		return errors.New("max_open_files can not be negative")
+	}
+	for i := range serverConf.ReverseClients {
+		err = serverConf.ReverseClients[i].normalize()
+		if err != nil {
+			return errors.Wrapf(err, "reverse client %d", i)
+		}
+	}
+	err = serverConf.Relay.normalize()
+	if err != nil {
+		return errors.Wrap(err, "relay")
+	}
+	if serverConf.MaxReceiveBuffer == 0 {
+		serverConf.MaxReceiveBuffer = 16 << 20
+	} else if serverConf.MaxReceiveBuffer < pipeReceiveBuffer {
+		return errors.Errorf("max_receive_buffer can not be less than %d", pipeReceiveBuffer)
+	}
+	serverConf.faultInjector, err = transport.NewFaultInjector(serverConf.Faults)
+	if err != nil {
+		return errors.Wrap(err, "faults")
+	}
+	if serverConf.WriteTimeout == 0 {
+		serverConf.WriteTimeout = 60
+	}
 
 	return nil
 }
@@ -27,7 +27,9 @@ import (
 	"github.com/longXboy/lunnel/log"
 	"github.com/longXboy/lunnel/msg"
 	"github.com/longXboy/lunnel/transport"
+	"github.com/longXboy/lunnel/transport/kcp"
 	"github.com/longXboy/lunnel/util"
+	"github.com/longXboy/lunnel/vhost"
 	"github.com/longXboy/smux"
 	"github.com/pkg/errors"
 	"github.com/satori/go.uuid"
@@ -52,8 +54,9 @@ func NewControl(conn net.Conn, encryptMode string, enableCompress bool, version
 
 	ctl := &Control{
 		ctlConn:        conn,
-		pipeGet:        make(chan *smux.Session),
-		pipeAdd:        make(chan *smux.Session),
+		pools:          make(map[string]*pipePool),
+		pipes:          make(map[*smux.Session]trackedPipe),
+		edges:          make(map[*edgeConn]struct{}),
 		writeChan:      make(chan writeReq, 64),
 		encryptMode:    encryptMode,
 		tunnels:        make(map[string]*Tunnel, 0),
@@ -62,6 +65,8 @@ func NewControl(conn net.Conn, encryptMode string, enableCompress bool, version
 		ctx:            ctx,
 		cancel:         cancel,
 		version:        version,
+		connectedAt:    time.Now(),
+		handover:       make(chan struct{}),
 	}
 	return ctl
 }
@@ -74,9 +79,32 @@ type writeReq struct {
 type Tunnel struct {
 	tunnelConfig msg.Tunnel
 	listener     net.Listener
+	packetConn   net.PacketConn
 	name         string
 	ctl          *Control
 	isClosed     bool
+	createdAt    time.Time
+
+	// lock guards tunnelConfig settings and policy which can be changed on a live tunnel
+	lock   sync.RWMutex
+	policy *tunnelPolicy
+	//ips opened by knocks and when they expire
+	knocks map[string]time.Time
+	//set to 1 once the byte cap is exceeded
+	quotaExceeded int32
+	//set to 1 once the client is warned that the byte cap is nearly reached
+	quotaWarned int32
+
+	streams  int64
+	bytesIn  uint64
+	bytesOut uint64
+	//byte cap of tunnelConfig,server and tenant,0 if uncapped
+	cachedByteCap uint64
+	//requests and latency shown on the status page of http tunnels
+	stats requestStats
+	//traffic capture started from the manage api,nil if not capturing
+	capture     *capture
+	captureLock sync.Mutex
 }
 
 func (t *Tunnel) Close() {
@@ -84,251 +112,154 @@ func (t *Tunnel) Close() {
 		return
 	}
 	TunnelMapLock.Lock()
-	delete(TunnelMap, t.tunnelConfig.PublicAddr())
+	removeRouteLocked(t)
 	TunnelMapLock.Unlock()
+	edgeCache.purge(t.tunnelConfig.PublicAddr())
 	if t.listener != nil {
 		t.listener.Close()
 	}
+	if t.packetConn != nil {
+		t.packetConn.Close()
+	}
+	t.captureLock.Lock()
+	c := t.capture
+	t.captureLock.Unlock()
+	if c != nil {
+		c.stop("tunnel closed")
+	}
+	recordEvent("tunnel_removed", t.ctl, t.name, t.tunnelConfig.PublicAddr())
 	if serverConf.NotifyEnable {
-		err := contrib.RemoveTunnel(serverConf.ServerDomain, t.tunnelConfig, t.ctl.ClientID.String())
+		err := contrib.RemoveTunnel(serverConf.ServerDomain, t.config(), t.ctl.ClientID.String())
 		if err != nil {
-			log.WithFields(log.Fields{"err": err}).Errorln("notify remove member failed!")
+			controlLog.WithFields(log.Fields{"err": err}).Errorln("notify remove member failed!")
 		}
 	}
 	t.isClosed = true
 	t.listener = nil
+	t.packetConn = nil
 }
 
-type pipeNode struct {
-	prev *pipeNode
-	next *pipeNode
-	pipe *smux.Session
+const (
+	maxTunnelLabels     = 32
+	maxLabelKeyLength   = 63
+	maxLabelValueLength = 255
+)
+
+func validateLabels(labels map[string]string) error {
+	if len(labels) > maxTunnelLabels {
+		return errors.Errorf("labels count(%d) out of limit(%d)", len(labels), maxTunnelLabels)
+	}
+	for k, v := range labels {
+		if k == "" || len(k) > maxLabelKeyLength {
+			return errors.Errorf("label key(%s) length must be between 1 and %d", k, maxLabelKeyLength)
+		}
+		if len(v) > maxLabelValueLength {
+			return errors.Errorf("label(%s) value length out of limit(%d)", k, maxLabelValueLength)
+		}
+	}
+	return nil
 }
 
 type Control struct {
-	ClientID        uuid.UUID
+	ClientID uuid.UUID
+	//id of the control connection in the log lines of both sides
+	id              string
 	ctlConn         net.Conn
 	preMasterSecret []byte
 	lastRead        uint64
 	encryptMode     string
-	enableCompress  bool
-	writeChan       chan writeReq
-	version         string
+	//aes key the client connected with,empty for the default key
+	aesKeyId       string
+	enableCompress bool
+	writeChan      chan writeReq
+	version        string
+	remoteAddr     string
+	transportMode  string
+	//transport of the pipes of the tunnels without their own,empty for transportMode
+	pipeTransport string
+	connectedAt   time.Time
+	//the client understands the half-close of streams
+	halfClose bool
+	//the reverse client server dialed the control to,nil if the client dialed server
+	reverse *reverseTarget
+	// tenant is resolved from the auth token,nil if the client belongs to no tenant
+	tenant *Tenant
+	//hostname the client reported,filled into the {hostname} of the host templates
+	hostname string
+
+	streams  int64
+	bytesIn  uint64
+	bytesOut uint64
 
 	tunnels    map[string]*Tunnel
 	tunnelLock *sync.Mutex
 
-	busyPipes  *pipeNode
-	idleCount  uint64
-	idlePipes  *pipeNode
+	//set by the client while it deploys,guarded by maintenanceLock
+	maintenance     *msg.Maintenance
+	maintenanceLock sync.RWMutex
+
+	resumeToken string
+	//set to 1 if the client exits or is kicked,its tunnels are not kept for resuming
+	exited int32
+	//released is guarded by detachedLock,handover is closed once it is set
+	released bool
+	handover chan struct{}
+
 	totalPipes int64
-	pipeAdd    chan *smux.Session
-	pipeGet    chan *smux.Session
+	//unix nano of the last too busy notice sent to the client
+	busyNotified int64
+	// pools are keyed by transport,empty key for the transport of the control
+	pools map[string]*pipePool
+	//all pipes with their transport and id for the stats and logs,closed pipes are removed lazily
+	pipes    map[*smux.Session]trackedPipe
+	poolLock sync.Mutex
+	//public connections being served,for the connection dump
+	edges    map[*edgeConn]struct{}
+	edgeLock sync.Mutex
+	//how long the client takes to dial the local address of each tunnel,as it reported last
+	dialStats     map[string]msg.DialStat
+	dialStatsLock sync.Mutex
 
 	cancel context.CancelFunc
 	ctx    context.Context
 }
 
-func (c *Control) addIdlePipe(pipe *smux.Session) {
-	pNode := &pipeNode{pipe: pipe, prev: nil, next: nil}
-	if c.idlePipes != nil {
-		c.idlePipes.prev = pNode
-		pNode.next = c.idlePipes
-	}
-	c.idlePipes = pNode
-	c.idleCount++
-}
-
-func (c *Control) addBusyPipe(pipe *smux.Session) {
-	pNode := &pipeNode{pipe: pipe, prev: nil, next: nil}
-	if c.busyPipes != nil {
-		c.busyPipes.prev = pNode
-		pNode.next = c.busyPipes
-	}
-	c.busyPipes = pNode
-}
-
-func (c *Control) removeIdleNode(pNode *pipeNode) {
-	if pNode.prev == nil {
-		c.idlePipes = pNode.next
-		if c.idlePipes != nil {
-			c.idlePipes.prev = nil
-		}
-	} else {
-		pNode.prev.next = pNode.next
-		if pNode.next != nil {
-			pNode.next.prev = pNode.prev
-		}
-	}
-	c.idleCount--
-}
-
-func (c *Control) removeBusyNode(pNode *pipeNode) {
-	if pNode.prev == nil {
-		c.busyPipes = pNode.next
-		if c.busyPipes != nil {
-			c.busyPipes.prev = nil
-		}
-	} else {
-		pNode.prev.next = pNode.next
-		if pNode.next != nil {
-			pNode.next.prev = pNode.prev
-		}
-	}
+func (c *Control) Close() {
+	controlLog.WithFields(log.Fields{"ctl_id": c.id, "client_id": c.ClientID.String()}).Debugln("ready to close control")
+	c.cancel()
 }
 
-func (c *Control) putPipe(p *smux.Session) {
+// Kick tells the client why it is disconnected and then closes the control,
+// the close is forced if the kick message can't be sent in time
+func (c *Control) Kick(reason string) {
+	controlLog.WithFields(log.Fields{"ctl_id": c.id, "client_id": c.ClientID.String(), "reason": reason}).Infoln("kick client")
+	atomic.StoreInt32(&c.exited, 1)
 	select {
-	case c.pipeAdd <- p:
-	case <-c.ctx.Done():
-		atomic.AddInt64(&c.totalPipes, -1)
-		p.Close()
+	case c.writeChan <- writeReq{msg.TypeKick, msg.Kick{Reason: reason}}:
+	default:
+		c.Close()
 		return
 	}
-	return
-}
-
-func (c *Control) getPipe() *smux.Session {
-	select {
-	case p := <-c.pipeGet:
-		return p
-	case <-c.ctx.Done():
-		return nil
-	}
-}
-
-func (c *Control) clean() {
-	if atomic.LoadInt64(&c.totalPipes) > int64(maxIdlePipes) {
-		log.WithFields(log.Fields{"total_pipe_count": atomic.LoadInt64(&c.totalPipes), "client_id": c.ClientID.String()}).Debugln("total pipe count")
-	}
-	busy := c.busyPipes
-	for {
-		if busy == nil {
-			break
-		}
-		if busy.pipe.IsClosed() {
-			c.removeBusyNode(busy)
-		} else if uint64(busy.pipe.NumStreams()) < maxStreams {
-			c.removeBusyNode(busy)
-			c.addIdlePipe(busy.pipe)
-		}
-		busy = busy.next
-	}
-	idle := c.idlePipes
-	for {
-		if idle == nil {
-			return
-		}
-		if idle.pipe.IsClosed() {
-			c.removeIdleNode(idle)
-		} else if idle.pipe.NumStreams() == 0 && c.idleCount >= maxIdlePipes {
-			log.WithFields(log.Fields{"time": time.Now().Unix(), "pipe": fmt.Sprintf("%p", idle.pipe), "client_id": c.ClientID.String()}).Debugln("remove and close idle")
-			c.removeIdleNode(idle)
-			atomic.AddInt64(&c.totalPipes, -1)
-			idle.pipe.Close()
-		}
-		idle = idle.next
-	}
-	return
-
-}
-func (c *Control) getIdleFast() (idle *pipeNode) {
-	idle = c.idlePipes
-	for {
-		if idle == nil {
-			return
-		}
-		if idle.pipe.IsClosed() {
-			c.removeIdleNode(idle)
-			idle = idle.next
-		} else {
-			c.removeIdleNode(idle)
-			return
-		}
-	}
-	return
-}
-
-func (c *Control) pipeManage() {
-	defer c.closePipes()
-	var available *smux.Session
-	ticker := time.NewTicker(cleanInterval)
-	defer ticker.Stop()
-	for {
-	Prepare:
-		if available == nil || available.IsClosed() {
-			available = nil
-			idle := c.getIdleFast()
-			if idle == nil {
-				c.clean()
-				idle := c.getIdleFast()
-				select {
-				case c.writeChan <- writeReq{msg.TypePipeReq, nil}:
-				default:
-					c.Close()
-					return
-				}
-				if idle == nil {
-					pipeGetTimeout := time.After(time.Second * 12)
-					for {
-						select {
-						case <-ticker.C:
-							c.clean()
-							idle := c.getIdleFast()
-							if idle != nil {
-								available = idle.pipe
-								goto Available
-							}
-						case p := <-c.pipeAdd:
-							if !p.IsClosed() {
-								if uint64(p.NumStreams()) < maxStreams {
-									available = p
-									goto Available
-								} else {
-									c.addBusyPipe(p)
-								}
-							}
-						case <-c.ctx.Done():
-							return
-						case <-pipeGetTimeout:
-							goto Prepare
-						}
-					}
-				} else {
-					available = idle.pipe
-				}
-			} else {
-				available = idle.pipe
-			}
-		}
-	Available:
+	go func() {
 		select {
-		case <-ticker.C:
-			c.clean()
-		case c.pipeGet <- available:
-			log.WithFields(log.Fields{"pipe": fmt.Sprintf("%p", available), "client_id": c.ClientID.String()}).Debugln("dispatch pipe to consumer")
-			available = nil
-		case p := <-c.pipeAdd:
-			if !p.IsClosed() {
-				if uint64(p.NumStreams()) < maxStreams {
-					c.addIdlePipe(p)
-				} else {
-					c.addBusyPipe(p)
-				}
-			}
+		case <-time.After(time.Second * 5):
+			c.Close()
 		case <-c.ctx.Done():
-			return
 		}
-	}
+	}()
 }
 
-func (c *Control) Close() {
-	log.WithField("clientId", c.ClientID).Debugln("ready to close control")
-	c.cancel()
+func (c *Control) IsClosed() bool {
+	select {
+	case <-c.ctx.Done():
+		return true
+	default:
+		return false
+	}
 }
 
 func (c *Control) closeTunnels() []*Tunnel {
-	log.WithField("clientId", c.ClientID).Debugln("ready to close tunnels")
+	controlLog.WithFields(log.Fields{"ctl_id": c.id, "client_id": c.ClientID.String()}).Debugln("ready to close tunnels")
 	var tunnels []*Tunnel
 	c.tunnelLock.Lock()
 	for _, t := range c.tunnels {
@@ -339,51 +270,35 @@ func (c *Control) closeTunnels() []*Tunnel {
 	return tunnels
 }
 
-func (c *Control) closePipes() {
-	log.WithField("clientId", c.ClientID).Debugln("ready to close pipes")
-	idle := c.idlePipes
-	for {
-		if idle == nil {
-			break
-		}
-		if !idle.pipe.IsClosed() {
-			atomic.AddInt64(&c.totalPipes, -1)
-			idle.pipe.Close()
-		}
-		idle = idle.next
-	}
-	c.idlePipes = nil
-
-	busy := c.busyPipes
-	for {
-		if busy == nil {
-			break
-		}
-		if !busy.pipe.IsClosed() {
-			atomic.AddInt64(&c.totalPipes, -1)
-			busy.pipe.Close()
-		}
-		busy = busy.next
-	}
-	c.busyPipes = nil
-}
-
 func (c *Control) recvLoop() {
 	atomic.StoreUint64(&c.lastRead, uint64(time.Now().UnixNano()))
 	for {
 		mType, body, err := msg.ReadMsgWithoutTimeout(c.ctlConn)
 		if err != nil {
-			log.WithFields(log.Fields{"err": err, "client_Id": c.ClientID.String()}).Warningln("ReadMsgWithoutTimeout in recvLoop failed")
+			controlLog.WithFields(log.Fields{"ctl_id": c.id, "err": err, "client_Id": c.ClientID.String()}).Warningln("ReadMsgWithoutTimeout in recvLoop failed")
 			c.Close()
 			return
 		}
 		if mType != msg.TypePing && mType != msg.TypePong {
-			log.WithFields(log.Fields{"type": mType, "body": body, "client_id": c.ClientID}).Debugln("recv msg")
+			controlLog.WithFields(log.Fields{"ctl_id": c.id, "type": mType, "body": body, "client_id": c.ClientID}).Debugln("recv msg")
 		}
 		atomic.StoreUint64(&c.lastRead, uint64(time.Now().UnixNano()))
 		switch mType {
 		case msg.TypeAddTunnels:
-			go c.ServerAddTunnels(body.(*msg.AddTunnels))
+			cstm := body.(*msg.AddTunnels)
+			if !c.dropReserved(cstm) {
+				return
+			}
+			go c.ServerAddTunnels(cstm)
+		case msg.TypeRemoveTunnels:
+			// removing before handling later added tunnels,so that a public addr can be moved between tunnels
+			c.ServerRemoveTunnels(body.(*msg.RemoveTunnels))
+		case msg.TypeMaintenance:
+			c.setMaintenance(body.(*msg.Maintenance))
+		case msg.TypeDialStats:
+			c.setDialStats(body.(*msg.DialStats))
+		case msg.TypeReverseDial:
+			c.reverseDial()
 		case msg.TypePong:
 		case msg.TypePing:
 			select {
@@ -393,6 +308,7 @@ func (c *Control) recvLoop() {
 				return
 			}
 		case msg.TypeExit:
+			atomic.StoreInt32(&c.exited, 1)
 			c.Close()
 			return
 		default:
@@ -416,11 +332,16 @@ func (c *Control) writeLoop() {
 			}
 			lastWrite = time.Now()
 			if msgBody.mType != msg.TypePing && msgBody.mType != msg.TypePong {
-				log.WithFields(log.Fields{"type": msgBody.mType, "body": msgBody.body, "client_id": c.ClientID}).Debugln("ready to send msg")
+				controlLog.WithFields(log.Fields{"ctl_id": c.id, "type": msgBody.mType, "body": msgBody.body, "client_id": c.ClientID}).Debugln("ready to send msg")
 			}
 			err := msg.WriteMsg(c.ctlConn, msgBody.mType, msgBody.body)
 			if err != nil {
-				log.WithFields(log.Fields{"mType": msgBody.mType, "body": fmt.Sprintf("%v", msgBody.body), "client_id": c.ClientID.String(), "err": err}).Warningln("send msg to client failed!")
+				controlLog.WithFields(log.Fields{"ctl_id": c.id, "mType": msgBody.mType, "body": fmt.Sprintf("%v", msgBody.body), "client_id": c.ClientID.String(), "err": err}).Warningln("send msg to client failed!")
+				c.Close()
+				return
+			}
+			//kicked or refused
+			if msgBody.mType == msg.TypeKick || (msgBody.mType == msg.TypeError && atomic.LoadInt32(&c.exited) == 1) {
 				c.Close()
 				return
 			}
@@ -432,11 +353,12 @@ func (c *Control) writeLoop() {
 
 func (c *Control) Serve() {
 	defer c.ctlConn.Close()
-	defer c.closeTunnels()
+	defer c.release()
+	defer recordEvent("client_offline", c, "", "")
 
 	go c.recvLoop()
 	go c.writeLoop()
-	go c.pipeManage()
+	c.pool("", nil)
 
 	ticker := time.NewTicker(time.Duration(serverConf.Health.Interval * int64(time.Second)))
 	defer ticker.Stop()
@@ -445,7 +367,7 @@ func (c *Control) Serve() {
 		select {
 		case <-ticker.C:
 			if (uint64(time.Now().UnixNano()) - atomic.LoadUint64(&c.lastRead)) > uint64(serverConf.Health.TimeOut*int64(time.Second)) {
-				log.WithFields(log.Fields{"client_id": c.ClientID.String()}).Warningln("recv client ping time out!")
+				controlLog.WithFields(log.Fields{"ctl_id": c.id, "client_id": c.ClientID.String()}).Warningln("recv client ping time out!")
 				c.Close()
 				return
 			}
@@ -461,34 +383,200 @@ func (c *Control) Serve() {
 	}
 }
 
-func proxyConn(userConn net.Conn, c *Control, tunnelName string) {
-	defer userConn.Close()
-	p := c.getPipe()
+// trafficWriter counts the bytes written through it on both the control and the tunnel
+type trafficWriter struct {
+	w      io.Writer
+	ctl    *uint64
+	tunnel *uint64
+	global *uint64
+	//owner stops the copying once over its byte cap
+	owner *Tunnel
+	//timeout is touched on every write if not nil
+	timeout *connTimeout
+	//bytes of the edge connection,counted if not nil
+	edge *uint64
+	//tap sees the bytes written if not nil,e.g. for a traffic capture
+	tap func(p []byte)
+}
+
+var errQuotaExceeded = errors.New("tunnel byte cap exceeded")
+
+func (tw *trafficWriter) Write(p []byte) (n int, err error) {
+	if uplink != nil && tw.owner != nil {
+		uplink.wait(tw.owner.qosClass(), len(p))
+	}
+	n, err = writeWithDeadline(tw.w, p)
+	if isTimeout(err) {
+		tw.stalled()
+	}
+	atomic.AddUint64(tw.ctl, uint64(n))
+	atomic.AddUint64(tw.tunnel, uint64(n))
+	atomic.AddUint64(tw.global, uint64(n))
+	if tw.edge != nil {
+		atomic.AddUint64(tw.edge, uint64(n))
+	}
+	if tw.tap != nil && n > 0 {
+		tw.tap(p[:n])
+	}
+	if tw.timeout != nil && n > 0 {
+		tw.timeout.touch()
+	}
+	if err == nil && tw.owner != nil && tw.owner.overQuota() {
+		return n, errQuotaExceeded
+	}
+	return n, err
+}
+
+// openStream opens a stream to client over a pipe of the tunnel's transport,
+// errTooBusy is returned if the client is out of streams or no pipe is available in time.
+// the id of the stream is returned for the logs
+func (t *Tunnel) openStream() (*smux.Stream, string, error) {
+	ctl := t.control()
+	if serverConf.MaxClientStreams > 0 && atomic.LoadInt64(&ctl.streams) >= serverConf.MaxClientStreams {
+		return nil, "", ctl.tooBusy(t, "max_client_streams reached")
+	}
+	cfg := t.config()
+	if cfg.MaxConns > 0 && atomic.LoadInt64(&t.streams) >= int64(cfg.MaxConns) {
+		return nil, "", t.tooManyConns(cfg.MaxConns)
+	}
+	wait := time.Duration(serverConf.PipeWaitTimeout) * time.Second
+	pool := ctl.pool(cfg.Transport, cfg.Pipe)
+	p, err := pool.getPipe(wait)
+	if err != nil {
+		return nil, "", ctl.tooBusy(t, "no pipe available in time")
+	}
 	if p == nil {
-		return
+		// the client may resume the control from another network
+		ctl = t.waitResume(ctl)
+		if ctl == nil {
+			return nil, "", errors.New("control closed")
+		}
+		pool = ctl.pool(cfg.Transport, cfg.Pipe)
+		p, err = pool.getPipe(wait)
+		if err != nil {
+			return nil, "", ctl.tooBusy(t, "no pipe available in time")
+		}
+		if p == nil {
+			return nil, "", errors.New("control closed")
+		}
+	}
+	stream, err := p.OpenStream(t.name)
+	pool.putPipe(p)
+	if err != nil {
+		pipeLog.WithFields(log.Fields{"ctl_id": ctl.id, "pipe_id": ctl.pipeID(p), "tunnel": t.name, "err": err}).Warningln("open stream failed!")
+		return nil, "", errors.Wrap(err, "open stream")
 	}
-	stream, err := p.OpenStream(tunnelName)
+	streamID := util.StreamID(ctl.pipeID(p), stream.ID())
+	pipeLog.WithFields(log.Fields{"ctl_id": ctl.id, "stream_id": streamID, "tunnel": t.name}).Debugln("open stream")
+	return stream, streamID, nil
+}
+
+func proxyConn(userConn net.Conn, t *Tunnel) {
+	defer userConn.Close()
+	atomic.AddUint64(&serverMetrics.connections, 1)
+	stream, streamID, err := t.openStream()
 	if err != nil {
-		c.putPipe(p)
+		atomic.AddUint64(&serverMetrics.errors, 1)
+		if schema := t.config().Public.Schema; err == errTooBusy && (schema == "http" || schema == "https") {
+			userConn.Write([]byte(vhost.TooBusyResp()))
+		}
 		return
 	}
 	defer stream.Close()
-	c.putPipe(p)
+	c := t.control()
+	atomic.AddInt64(&c.streams, 1)
+	atomic.AddInt64(&t.streams, 1)
+	edge := c.trackEdge(streamID, t.name, userConn.RemoteAddr())
+	defer func() {
+		c.untrackEdge(edge)
+		atomic.AddInt64(&c.streams, -1)
+		atomic.AddInt64(&t.streams, -1)
+	}()
 	p1die := make(chan struct{})
 	p2die := make(chan struct{})
+	done := make(chan struct{})
+	defer close(done)
+	cfg := t.config()
+	timeout := newConnTimeout(cfg.IdleTimeout, cfg.MaxLifetime)
+	expired := timeout.expired(done)
+	// both directions are finished one by one if the client can half-close,otherwise one EOF ends both
+	upTap, downTap := (func([]byte))(nil), (func([]byte))(nil)
+	if flow := t.captureConn(userConn); flow != nil {
+		upTap, downTap = flow.up, flow.down
+		defer flow.close()
+	}
+	var upErr, downErr error
+	fields := func() log.Fields {
+		return log.Fields{"ctl_id": c.id, "stream_id": streamID, "tunnel": t.name, "remote_addr": userConn.RemoteAddr().String()}
+	}
 	go func() {
-		io.Copy(stream, userConn)
+		_, upErr = io.Copy(&trafficWriter{w: stream, ctl: &c.bytesIn, tunnel: &t.bytesIn, global: &serverMetrics.bytesIn, owner: t, timeout: timeout, edge: &edge.bytesIn, tap: upTap}, userConn)
+		if upErr == nil && c.halfClose {
+			stream.CloseWrite()
+		}
 		close(p1die)
 	}()
 	go func() {
-		io.Copy(userConn, stream)
+		_, downErr = io.Copy(&trafficWriter{w: userConn, ctl: &c.bytesOut, tunnel: &t.bytesOut, global: &serverMetrics.bytesOut, owner: t, timeout: timeout, edge: &edge.bytesOut, tap: downTap}, stream)
+		if downErr == nil && c.halfClose && !stream.IsClosed() {
+			util.CloseWrite(userConn)
+		}
 		close(p2die)
 	}()
+	var rest <-chan struct{}
+	var restErr *error
 	select {
 	case <-p1die:
+		copyFailed(fields, "user to client", upErr)
+		if upErr == nil && c.halfClose {
+			rest, restErr = p2die, &downErr
+		}
 	case <-p2die:
+		copyFailed(fields, "client to user", downErr)
+		if downErr == nil && c.halfClose && !stream.IsClosed() {
+			rest, restErr = p1die, &upErr
+		}
+	case <-expired:
+		pipeLog.WithFields(fields()).Debugln("proxied connection timed out")
+		return
 	}
-	return
+	if rest != nil {
+		select {
+		case <-rest:
+			copyFailed(fields, "half-closed", *restErr)
+		case <-expired:
+			pipeLog.WithFields(fields()).Debugln("half-closed connection timed out")
+		}
+	}
+}
+
+// copyFailed logs the error a direction of a proxied connection ended with
+func copyFailed(fields func() log.Fields, direction string, err error) {
+	if err == nil {
+		return
+	}
+	f := fields()
+	f["direction"] = direction
+	f["err"] = err
+	pipeLog.WithFields(f).Debugln("proxied connection copy failed")
+}
+
+// listenPublic listens on the public port of tcp and udp tunnels,
+// the port actually listened is returned as port may be 0
+func listenPublic(schema string, port uint16) (net.Listener, net.PacketConn, uint16, error) {
+	addr := fmt.Sprintf("%s:%d", serverConf.ListenIP, port)
+	if schema == "udp" {
+		pc, err := net.ListenPacket("udp", addr)
+		if err != nil {
+			return nil, nil, 0, err
+		}
+		return nil, pc, uint16(pc.LocalAddr().(*net.UDPAddr).Port), nil
+	}
+	lis, err := net.Listen(schema, addr)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	return lis, nil, uint16(lis.Addr().(*net.TCPAddr).Port), nil
 }
 
 //add or update tunnel stat
@@ -497,27 +585,74 @@ func (c *Control) ServerAddTunnels(sstm *msg.AddTunnels) {
 	defer c.tunnelLock.Unlock()
 	for name, tunnel := range sstm.Tunnels {
 		var lis net.Listener = nil
+		var pc net.PacketConn = nil
 		var err error
+		var policy *tunnelPolicy
+		tunnel, err = applyProfile(tunnel)
+		if err == nil && tunnel.Public.Schema != "tcp" && tunnel.Public.Schema != "udp" {
+			tunnel.Public.Host, err = c.expandHost(name, tunnel.Public.Host)
+		}
+		if err == nil {
+			err = c.checkPipeOptions(tunnel.Pipe)
+		}
+		if err == nil {
+			sstm.Tunnels[name] = tunnel
+			policy, err = newTunnelPolicy(tunnel)
+		}
+		if err != nil {
+			controlLog.WithFields(log.Fields{"ctl_id": c.id, "tunnel": name, "client_id": c.ClientID.String(), "err": err}).Warningln("forbidden,invalid tunnel settings")
+			select {
+			case c.writeChan <- writeReq{msg.TypeError, msg.Error{Msg: fmt.Sprintf("add tunnels failed!tunnel(%s) %s", name, err.Error()), Code: msg.ErrCodeInvalidTunnel, Detail: map[string]string{"tunnel": name}}}:
+			default:
+				c.Close()
+				return
+			}
+			continue
+		}
+		if c.holdTunnel(name, tunnel) {
+			delete(sstm.Tunnels, name)
+			continue
+		}
 		oldTunnel, isok := c.tunnels[name]
+		if isok && !oldTunnel.isClosed && oldTunnel.sameEndpoint(tunnel) {
+			// only settings changed,keep the listener and the proxying connections
+			err = oldTunnel.applyConfig(tunnel)
+			if err == nil {
+				sstm.Tunnels[name] = oldTunnel.config()
+				continue
+			}
+		}
 		if isok {
 			oldTunnel.Close()
 			delete(c.tunnels, name)
 		}
+		err = c.checkTenantLimit(tunnel)
+		if err != nil {
+			controlLog.WithFields(log.Fields{"ctl_id": c.id, "tunnel": name, "client_id": c.ClientID.String(), "tenant": c.tenant.name(), "err": err}).Warningln("forbidden,tenant limit")
+			select {
+			case c.writeChan <- writeReq{msg.TypeError, msg.Error{Msg: fmt.Sprintf("add tunnels failed!tunnel(%s) %s", name, err.Error()), Code: msg.ErrCodeQuotaExceeded, Detail: map[string]string{"tunnel": name}}}:
+			default:
+				c.Close()
+				return
+			}
+			continue
+		}
 
 		if tunnel.Public.Schema == "tcp" || tunnel.Public.Schema == "udp" {
 			if tunnel.Public.Port == 0 && oldTunnel != nil && tunnel.Public.Schema == oldTunnel.tunnelConfig.Public.Schema && tunnel.LocalAddr() == oldTunnel.tunnelConfig.LocalAddr() {
 				tunnel.Public.AllowReallocate = true
 				tunnel.Public.Port = oldTunnel.tunnelConfig.Public.Port
 			}
-			lis, err = net.Listen(tunnel.Public.Schema, fmt.Sprintf("%s:%d", serverConf.ListenIP, tunnel.Public.Port))
+			var port uint16
+			lis, pc, port, err = c.listenPort(tunnel.Public.Schema, tunnel.Public.Port)
 			if err != nil {
 				if tunnel.Public.AllowReallocate {
-					lis, err = net.Listen(tunnel.Public.Schema, fmt.Sprintf("%s:%d", serverConf.ListenIP, 0))
+					lis, pc, port, err = c.listenPort(tunnel.Public.Schema, 0)
 				}
 				if err != nil {
-					log.WithFields(log.Fields{"remote_addr": tunnel.PublicAddr(), "client_id": c.ClientID.String()}).Warningln("forbidden,remote port already in use")
+					controlLog.WithFields(log.Fields{"ctl_id": c.id, "remote_addr": tunnel.PublicAddr(), "client_id": c.ClientID.String()}).Warningln("forbidden,remote port already in use")
 					select {
-					case c.writeChan <- writeReq{msg.TypeError, msg.Error{fmt.Sprintf("add tunnels failed!forbidden,remote addrs(%s) already in use", tunnel.PublicAddr())}}:
+					case c.writeChan <- writeReq{msg.TypeError, msg.Error{Msg: fmt.Sprintf("add tunnels failed!forbidden,remote addrs(%s) already in use", tunnel.PublicAddr()), Code: msg.ErrCodeAddrInUse, Detail: map[string]string{"tunnel": name, "addr": tunnel.PublicAddr()}}}:
 					default:
 						c.Close()
 						return
@@ -526,61 +661,120 @@ func (c *Control) ServerAddTunnels(sstm *msg.AddTunnels) {
 					continue
 				}
 			}
-			go func(tunnelName string) {
-				for {
-					conn, err := lis.Accept()
-					if err != nil {
-						return
-					}
-					go proxyConn(conn, c, tunnelName)
-				}
-			}(name)
 			//todo: port should  allocated and managed by server not by OS
-			addr := lis.Addr().(*net.TCPAddr)
-			tunnel.Public.Port = uint16(addr.Port)
+			tunnel.Public.Port = port
 			tunnel.Public.Host = serverConf.ServerDomain
-		} else if tunnel.Public.Schema == "http" || tunnel.Public.Schema == "https" {
+		} else if tunnel.Public.Schema == "http" || tunnel.Public.Schema == "https" || tunnel.Public.Schema == "tcpmux" {
+			if tunnel.Public.Schema == "tcpmux" && serverConf.TcpMux.Port == 0 {
+				controlLog.WithFields(log.Fields{"ctl_id": c.id, "tunnel": name, "client_id": c.ClientID.String()}).Warningln("forbidden,tcp mux is not enabled")
+				select {
+				case c.writeChan <- writeReq{msg.TypeError, msg.Error{Msg: fmt.Sprintf("add tunnels failed!tunnel(%s) tcp mux is not enabled on server", name), Code: msg.ErrCodeUnsupportedFeature, Detail: map[string]string{"tunnel": name}}}:
+				default:
+					c.Close()
+					return
+				}
+				continue
+			}
 			if tunnel.Public.Host == "" {
 				if oldTunnel != nil && tunnel.Public.Schema == oldTunnel.tunnelConfig.Public.Schema && tunnel.LocalAddr() == oldTunnel.tunnelConfig.LocalAddr() {
 					tunnel.Public.AllowReallocate = true
 					tunnel.Public.Host = oldTunnel.tunnelConfig.Public.Host
 				} else {
 					subDomain := util.Int2Short(atomic.AddUint64(&subDomainIdx, 1))
-					tunnel.Public.Host = fmt.Sprintf("%s.%s", string(subDomain), serverConf.ServerDomain)
+					tunnel.Public.Host = fmt.Sprintf("%s.%s", string(subDomain), c.domain())
 				}
 			}
 			if tunnel.Public.Schema == "http" {
 				tunnel.Public.Port = serverConf.HttpPort
+			} else if tunnel.Public.Schema == "tcpmux" {
+				tunnel.Public.Port = serverConf.TcpMux.Port
 			} else {
 				tunnel.Public.Port = serverConf.HttpsPort
 			}
+		} else if tunnel.Public.Schema == "stcp" {
+			// listens nowhere,only reached by the visitors presenting its psk
+			if tunnel.Public.Host == "" {
+				tunnel.Public.Host = name
+			}
+			tunnel.Public.Port = 0
 		}
-		tunnelControl := Tunnel{tunnelConfig: tunnel, listener: lis, ctl: c, name: name}
+		tunnelControl := &Tunnel{tunnelConfig: tunnel, listener: lis, packetConn: pc, ctl: c, name: name, createdAt: time.Now(), policy: policy}
+		tunnelControl.storeByteCap()
 		TunnelMapLock.Lock()
-		_, isok = TunnelMap[tunnel.PublicAddr()]
-		if isok {
+		if !addRouteLocked(tunnelControl) {
 			TunnelMapLock.Unlock()
 			if lis != nil {
 				lis.Close()
 			}
-			log.WithFields(log.Fields{"remote_addr": tunnel.PublicAddr(), "client_id": c.ClientID.String()}).Warningln("forbidden,remote addrs already in use")
+			if pc != nil {
+				pc.Close()
+			}
+			controlLog.WithFields(log.Fields{"ctl_id": c.id, "remote_addr": tunnel.PublicAddr(), "client_id": c.ClientID.String()}).Warningln("forbidden,remote addrs already in use")
 			select {
-			case c.writeChan <- writeReq{msg.TypeError, msg.Error{fmt.Sprintf("add tunnels failed!forbidden,remote addrs(%s) already in use", tunnel.PublicAddr())}}:
+			case c.writeChan <- writeReq{msg.TypeError, msg.Error{Msg: fmt.Sprintf("add tunnels failed!forbidden,remote addrs(%s) already in use", tunnel.PublicAddr()), Code: msg.ErrCodeAddrInUse, Detail: map[string]string{"tunnel": name, "addr": tunnel.PublicAddr()}}}:
 			default:
 				c.Close()
 				return
 			}
 			continue
 		}
-		TunnelMap[tunnel.PublicAddr()] = &tunnelControl
 		TunnelMapLock.Unlock()
-		c.tunnels[name] = &tunnelControl
+		c.tunnels[name] = tunnelControl
+		if pc != nil {
+			go tunnelControl.serveUdp(pc)
+		}
+		if lis != nil {
+			go func(t *Tunnel, lis net.Listener) {
+				var backoff acceptBackoff
+				for {
+					conn, err := lis.Accept()
+					if err != nil {
+						if backoff.wait(err) {
+							continue
+						}
+						return
+					}
+					backoff.reset()
+					switch t.checkAccess(conn) {
+					case accessForbidden:
+						controlLog.WithFields(log.Fields{"ctl_id": c.id, "remote_addr": conn.RemoteAddr().String(), "tunnel": t.name}).Debugln("connection denied by ip rules")
+						conn.Close()
+						continue
+					case accessRateLimited:
+						controlLog.WithFields(log.Fields{"ctl_id": c.id, "remote_addr": conn.RemoteAddr().String(), "tunnel": t.name}).Debugln("connection rate limited")
+						conn.Close()
+						continue
+					case accessQuotaExceeded, accessOffline, accessMaintenance, accessOverloaded:
+						conn.Close()
+						continue
+					}
+					err = transport.ApplyTcpOptions(conn, t.config().Tcp)
+					if err != nil {
+						controlLog.WithFields(log.Fields{"ctl_id": c.id, "err": err, "tunnel": t.name}).Warningln("apply tcp options failed!")
+					}
+					go func(conn net.Conn) {
+						pconn, err := t.readPreamble(conn, nil)
+						if err != nil {
+							controlLog.WithFields(log.Fields{"ctl_id": c.id, "remote_addr": conn.RemoteAddr().String(), "tunnel": t.name, "err": err}).Debugln("connection denied by preamble")
+							conn.Close()
+							return
+						}
+						proxyConn(pconn, t)
+					}(conn)
+				}
+			}(tunnelControl, lis)
+		}
 		sstm.Tunnels[name] = tunnel
+		recordEvent("tunnel_added", c, name, tunnel.PublicAddr())
+		claim := c.securityEvent(securityTunnelClaimed, 3)
+		claim.Tunnel = name
+		claim.Host = tunnel.PublicAddr()
+		exportSecurity(claim)
 
 		if serverConf.NotifyEnable {
 			err = contrib.AddTunnel(serverConf.ServerDomain, tunnel, c.ClientID.String())
 			if err != nil {
-				log.WithFields(log.Fields{"err": err}).Errorln("notify add member failed!")
+				controlLog.WithFields(log.Fields{"ctl_id": c.id, "err": err}).Errorln("notify add member failed!")
 			}
 		}
 	}
@@ -593,6 +787,56 @@ func (c *Control) ServerAddTunnels(sstm *msg.AddTunnels) {
 	return
 }
 
+func (c *Control) ServerRemoveTunnels(rtm *msg.RemoveTunnels) {
+	c.tunnelLock.Lock()
+	defer c.tunnelLock.Unlock()
+	for _, name := range rtm.Names {
+		t, isok := c.tunnels[name]
+		if !isok {
+			continue
+		}
+		t.Close()
+		delete(c.tunnels, name)
+		controlLog.WithFields(log.Fields{"ctl_id": c.id, "tunnel": name, "client_id": c.ClientID.String()}).Infoln("tunnel removed by client")
+	}
+}
+
+// maxMaintenancePage is the size limit of the maintenance page sent by client
+const maxMaintenancePage = 64 << 10
+
+func (c *Control) setMaintenance(m *msg.Maintenance) {
+	if len(m.Page) > maxMaintenancePage {
+		controlLog.WithFields(log.Fields{"ctl_id": c.id, "client_id": c.ClientID.String(), "size": len(m.Page)}).Warningln("maintenance page out of size limit,serve the page of server instead")
+		m.Page = ""
+	}
+	c.maintenanceLock.Lock()
+	if m.Enable {
+		c.maintenance = m
+	} else {
+		c.maintenance = nil
+	}
+	c.maintenanceLock.Unlock()
+	controlLog.WithFields(log.Fields{"ctl_id": c.id, "client_id": c.ClientID.String(), "enable": m.Enable}).Infoln("client maintenance switched")
+	if m.Enable {
+		recordEvent("maintenance_on", c, "", "")
+	} else {
+		recordEvent("maintenance_off", c, "", "")
+	}
+}
+
+// maintenancePage reports whether the client is in maintenance and the page its http tunnels serve
+func (c *Control) maintenancePage() (bool, string) {
+	c.maintenanceLock.RLock()
+	defer c.maintenanceLock.RUnlock()
+	if c.maintenance == nil {
+		return false, ""
+	}
+	if c.maintenance.Page == "" {
+		return true, maintenancePage
+	}
+	return true, c.maintenance.Page
+}
+
 func (c *Control) GenerateClientId() uuid.UUID {
 	c.ClientID = uuid.NewV4()
 	return c.ClientID
@@ -611,10 +855,13 @@ func (c *Control) ServerHandShake() error {
 	chello = body.(*msg.ControlClientHello)
 	if serverConf.AuthEnable {
 		isok, err := contrib.Auth(chello)
+		c.auditAuth(chello, isok, err)
 		if err != nil {
+			msg.WriteMsg(c.ctlConn, msg.TypeError, msg.Error{Msg: "auth unavailable", Code: msg.ErrCodeInternal})
 			return errors.Wrap(err, "contrib.Auth")
 		}
 		if !isok {
+			msg.WriteMsg(c.ctlConn, msg.TypeError, msg.Error{Msg: "auth failed", Code: msg.ErrCodeAuthFailed})
 			return errors.Errorf("auth failed!token:%s", chello.AuthToken)
 		}
 	}
@@ -637,29 +884,72 @@ func (c *Control) ServerHandShake() error {
 		shello.ClientID = c.GenerateClientId()
 	}
 	c.ClientID = shello.ClientID
+	c.tenant = tenantByToken(chello.AuthToken)
+	c.hostname = chello.Hostname
+	if chello.PipeTransport != "" && chello.PipeTransport != c.transportMode {
+		if transportEnabled(chello.PipeTransport) {
+			c.pipeTransport = chello.PipeTransport
+		} else {
+			controlLog.WithFields(log.Fields{"ctl_id": c.id, "client_id": c.ClientID.String(), "pipe_transport": chello.PipeTransport}).Warningln("pipe transport not listened,create pipes in the transport of the control")
+		}
+	}
+	ControlMapLock.RLock()
+	old, isok := ControlMap[c.ClientID]
+	ControlMapLock.RUnlock()
+	if isok && old.tenant != c.tenant {
+		// the id of another tenant is never taken over,which would hand its tunnels and hosts to this client
+		controlLog.WithFields(log.Fields{"ctl_id": c.id, "client_id": c.ClientID.String(), "tenant": c.tenant.name(), "old_tenant": old.tenant.name(), "remote_addr": c.remoteAddr}).Warningln("client id of another tenant connected,reassign")
+		mismatch := c.securityEvent(securityClientDuplicate, 8)
+		mismatch.Detail = fmt.Sprintf("tenant mismatch,old tenant %s,reassigned", old.tenant.name())
+		exportSecurity(mismatch)
+		shello.ClientID = c.GenerateClientId()
+		isok = false
+	}
+	var resumed bool
+	if isok && chello.ResumeToken != "" {
+		resumed = c.resume(old, chello.ResumeToken)
+	}
+	if isok && !resumed && old.alive(duplicateProbeTimeout) {
+		isok, err = c.handleDuplicate(old, &shello)
+		if err != nil {
+			return err
+		}
+	}
+	if serverConf.Resume.Window > 0 {
+		c.resumeToken = newResumeToken()
+		shello.ResumeToken = c.resumeToken
+	}
+	shello.Resumed = resumed
 	err = msg.WriteMsg(c.ctlConn, msg.TypeControlServerHello, shello)
 	if err != nil {
 		return errors.Wrap(err, "Write ClientId")
 	}
 
-	ControlMapLock.RLock()
-	old, isok := ControlMap[c.ClientID]
+	ControlMapLock.Lock()
 	ControlMap[c.ClientID] = c
-	ControlMapLock.RUnlock()
-	if isok {
+	ControlMapLock.Unlock()
+	if isok && !resumed && c.takeOver(old) {
+		dropPending(old)
 		oldTunnels := old.closeTunnels()
+		c.tunnelLock.Lock()
 		for _, oldTunnel := range oldTunnels {
 			c.tunnels[oldTunnel.name] = oldTunnel
 		}
+		c.tunnelLock.Unlock()
 		c.tunnelLock = old.tunnelLock
+		close(old.handover)
+	}
+	recordEvent("client_online", c, "", c.remoteAddr)
+	if chello.ClientID == nil {
+		exportSecurity(c.securityEvent(securityClientRegistered, 3))
 	}
-	ControlMapLock.Lock()
-	ControlMap[c.ClientID] = c
-	ControlMapLock.Unlock()
 	return nil
 }
 
-func PipeHandShake(conn net.Conn, phs *msg.PipeClientHello) error {
+// pipeReceiveBuffer is the receive buffer of a pipe unless the client asks for a larger one
+const pipeReceiveBuffer = 4194304
+
+func PipeHandShake(conn net.Conn, phs *msg.PipeClientHello, transportMode string) error {
 	ControlMapLock.RLock()
 	ctl, isok := ControlMap[phs.ClientID]
 	ControlMapLock.RUnlock()
@@ -667,11 +957,37 @@ func PipeHandShake(conn net.Conn, phs *msg.PipeClientHello) error {
 		return errors.Errorf("invalid phs.client_id %s", phs.ClientID.String())
 	}
 	smuxConfig := smux.DefaultConfig()
-	smuxConfig.MaxReceiveBuffer = 4194304
+	smuxConfig.MaxReceiveBuffer = pipeReceiveBuffer
+	if phs.ReceiveBuffer > pipeReceiveBuffer {
+		smuxConfig.MaxReceiveBuffer = phs.ReceiveBuffer
+		if smuxConfig.MaxReceiveBuffer > serverConf.MaxReceiveBuffer {
+			smuxConfig.MaxReceiveBuffer = serverConf.MaxReceiveBuffer
+		}
+	}
+	// the client picks the window,the session refuses the windows it can't hold
+	smuxConfig.StreamWindow = phs.StreamWindow
 	var err error
 	var sess *smux.Session
 	var underlyingConn io.ReadWriteCloser
-	if ctl.encryptMode != "none" {
+	if phs.Transport != "" && phs.Transport != transportMode {
+		return errors.Errorf("pipe of transport %s accepted by %s", phs.Transport, transportMode)
+	}
+	err = ctl.checkPipeMac(phs)
+	if err != nil {
+		return err
+	}
+	err = ctl.checkPipeOptions(phs.Options)
+	if err != nil {
+		return err
+	}
+	if !phs.Visit && !ctl.pipeOptionsUsed(transportMode, phs.Options) {
+		return errors.New("pipe options of no tunnel")
+	}
+	if phs.KcpWindow > 0 && transportMode == "kcp" && !kcp.RaiseSndWnd(conn, phs.KcpWindow) {
+		pipeLog.WithFields(log.Fields{"ctl_id": ctl.id, "kcp_window": phs.KcpWindow}).Debugln("kcp window of a wrapped pipe conn kept")
+	}
+	encrypt, compress := phs.Options.Resolve(ctl.encryptMode != "none", ctl.enableCompress)
+	if encrypt {
 		prf := crypto.NewPrf12()
 		var masterKey []byte = make([]byte, 16)
 		prf(masterKey, ctl.preMasterSecret, phs.ClientID[:], phs.Once[:])
@@ -682,14 +998,26 @@ func PipeHandShake(conn net.Conn, phs *msg.PipeClientHello) error {
 	} else {
 		underlyingConn = conn
 	}
-	if ctl.enableCompress {
+	if compress {
 		underlyingConn = transport.NewCompStream(underlyingConn)
 	}
+	pipeID := util.PipeID(phs.Once)
+	if phs.Visit {
+		sess, err = smux.Server(underlyingConn, smuxConfig)
+		if err != nil {
+			return errors.Wrap(err, "smux.Server")
+		}
+		pipeLog.WithFields(log.Fields{"ctl_id": ctl.id, "client_id": ctl.ClientID.String(), "pipe_id": pipeID, "transport": transportMode}).Debugln("visit pipe handshake success")
+		go ctl.acceptVisits(sess, pipeID, conn.RemoteAddr())
+		return nil
+	}
 	sess, err = smux.Client(underlyingConn, smuxConfig)
 	if err != nil {
 		return errors.Wrap(err, "smux.Client")
 	}
-	ctl.putPipe(sess)
+	ctl.trackPipe(sess, transportMode, pipeID)
+	ctl.pool(transportMode, phs.Options).putPipe(sess)
 	atomic.AddInt64(&ctl.totalPipes, 1)
+	pipeLog.WithFields(log.Fields{"ctl_id": ctl.id, "client_id": ctl.ClientID.String(), "pipe_id": pipeID, "transport": transportMode, "encrypt": encrypt, "compress": compress, "receive_buffer": smuxConfig.MaxReceiveBuffer}).Debugln("pipe handshake success")
 	return nil
 }
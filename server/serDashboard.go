@@ -0,0 +1,160 @@
+// Copyright 2017 longXboy, longxboyhi@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// dashboardHandler serves a single page showing the clients,tunnels and events of the manage api,
+// the page passes the token query parameter it is opened with to the api
+func dashboardHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		fmt.Fprintf(w, "method not allowed")
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Security-Policy", "default-src 'self'; script-src 'unsafe-inline'; style-src 'unsafe-inline'")
+	fmt.Fprint(w, dashboardPage)
+}
+
+const dashboardPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>lunnel dashboard</title>
+<style>
+body{font-family:sans-serif;margin:20px;color:#222}
+h2{margin-top:28px}
+table{border-collapse:collapse;width:100%}
+th,td{border-bottom:1px solid #ddd;padding:4px 8px;text-align:left;font-size:13px}
+th{background:#f4f4f4}
+#summary span{margin-right:24px}
+svg{vertical-align:middle}
+polyline{fill:none;stroke:#2a7ae2;stroke-width:1.5}
+#events td:first-child{white-space:nowrap}
+</style>
+</head>
+<body>
+<h1>lunnel</h1>
+<div id="summary"></div>
+<h2>Clients</h2>
+<table><thead><tr><th>Client</th><th>Tenant</th><th>Remote</th><th>Transport</th><th>Version</th><th>Connected</th><th>Pipes</th><th>Streams</th><th>In</th><th>Out</th></tr></thead><tbody id="clients"></tbody></table>
+<h2>Tunnels</h2>
+<table><thead><tr><th>Name</th><th>Client</th><th>Public</th><th>Local</th><th>Streams</th><th>In</th><th>Out</th><th>Traffic</th></tr></thead><tbody id="tunnels"></tbody></table>
+<h2>Events</h2>
+<table><tbody id="events"></tbody></table>
+<script>
+(function(){
+var token=new URLSearchParams(location.search).get("token")||"";
+function api(path){
+	var sep=path.indexOf("?")<0?"?":"&";
+	return token?path+sep+"token="+encodeURIComponent(token):path;
+}
+function bytes(n){
+	var units=["B","KB","MB","GB","TB"],i=0;
+	while(n>=1024&&i<units.length-1){n/=1024;i++;}
+	return n.toFixed(i?1:0)+units[i];
+}
+function row(cells){
+	var tr=document.createElement("tr");
+	cells.forEach(function(c){
+		var td=document.createElement("td");
+		if(c instanceof Node){td.appendChild(c);}else{td.textContent=c;}
+		tr.appendChild(td);
+	});
+	return tr;
+}
+var samples={},last={},maxSamples=60;
+function sparkline(key){
+	var s=samples[key]||[],max=1;
+	s.forEach(function(v){if(v>max){max=v;}});
+	var ns="http://www.w3.org/2000/svg";
+	var svg=document.createElementNS(ns,"svg");
+	svg.setAttribute("width","120");
+	svg.setAttribute("height","24");
+	var line=document.createElementNS(ns,"polyline");
+	line.setAttribute("points",s.map(function(v,i){return (i*2)+","+(23-v/max*22).toFixed(1);}).join(" "));
+	svg.appendChild(line);
+	var title=document.createElementNS(ns,"title");
+	title.textContent=s.length?bytes(s[s.length-1])+"/s":"";
+	svg.appendChild(title);
+	return svg;
+}
+function refresh(){
+	fetch(api("/api/v1/clients?limit=1000")).then(function(resp){return resp.json();}).then(function(data){
+		var clients=document.getElementById("clients"),tunnels=document.getElementById("tunnels");
+		var now=Date.now(),total={tunnels:0,in:0,out:0},seen={};
+		clients.textContent="";
+		tunnels.textContent="";
+		data.Clients.forEach(function(c){
+			clients.appendChild(row([c.ClientID,c.Tenant||"",c.RemoteAddr,c.Transport,c.Version,new Date(c.ConnectedAt).toLocaleString(),c.Pipes,c.Streams,bytes(c.BytesIn),bytes(c.BytesOut)]));
+			total.in+=c.BytesIn;
+			total.out+=c.BytesOut;
+			(c.Tunnels||[]).forEach(function(t){
+				var key=c.ClientID+"/"+t.Name,sum=t.BytesIn+t.BytesOut;
+				seen[key]=true;
+				if(last[key]&&sum>=last[key].sum){
+					var s=samples[key]=samples[key]||[];
+					s.push((sum-last[key].sum)*1000/(now-last[key].time));
+					if(s.length>maxSamples){s.shift();}
+				}
+				last[key]={sum:sum,time:now};
+				total.tunnels++;
+				tunnels.appendChild(row([t.Name,c.ClientID,t.Public,t.Local,t.Streams,bytes(t.BytesIn),bytes(t.BytesOut),sparkline(key)]));
+			});
+		});
+		Object.keys(last).forEach(function(key){if(!seen[key]){delete last[key];delete samples[key];}});
+		var summary=document.getElementById("summary");
+		summary.textContent="";
+		[["clients",data.Total],["tunnels",total.tunnels],["in",bytes(total.in)],["out",bytes(total.out)]].forEach(function(kv){
+			var span=document.createElement("span");
+			span.textContent=kv[0]+": "+kv[1];
+			summary.appendChild(span);
+		});
+	}).catch(function(){});
+}
+var lastEvent=0;
+function addEvent(ev){
+	if(ev.Id<=lastEvent){return;}
+	lastEvent=ev.Id;
+	var events=document.getElementById("events");
+	var target=[ev.ClientID,ev.Tunnel].filter(function(v){return v;}).join("/");
+	events.insertBefore(row([new Date(ev.Time*1000).toLocaleString(),ev.Kind,target,ev.Detail||""]),events.firstChild);
+	while(events.childNodes.length>200){events.removeChild(events.lastChild);}
+}
+function stream(){
+	var es=new EventSource(api("/api/v1/events/stream"));
+	es.onmessage=function(e){addEvent(JSON.parse(e.data));};
+	es.onerror=function(){
+		es.close();
+		setTimeout(function(){loadEvents().then(stream);},5000);
+	};
+}
+function loadEvents(){
+	return fetch(api("/api/v1/events?since="+lastEvent)).then(function(resp){return resp.json();}).then(function(events){
+		events.forEach(addEvent);
+	}).catch(function(){});
+}
+refresh();
+setInterval(refresh,2000);
+loadEvents().then(stream);
+})();
+</script>
+</body>
+</html>
+`
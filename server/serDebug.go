@@ -0,0 +1,128 @@
+// Copyright 2017 longXboy, longxboyhi@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// edgeConn is a public connection proxied over a stream of a control,kept for the debug dump
+type edgeConn struct {
+	streamID   string
+	tunnel     string
+	remoteAddr string
+	since      time.Time
+	bytesIn    uint64
+	bytesOut   uint64
+}
+
+// trackEdge records the public connection from remote served by stream of tunnel until untrackEdge
+func (c *Control) trackEdge(stream string, tunnel string, remote net.Addr) *edgeConn {
+	e := &edgeConn{streamID: stream, tunnel: tunnel, since: time.Now()}
+	if remote != nil {
+		e.remoteAddr = remote.String()
+	}
+	c.edgeLock.Lock()
+	c.edges[e] = struct{}{}
+	c.edgeLock.Unlock()
+	return e
+}
+
+func (c *Control) untrackEdge(e *edgeConn) {
+	c.edgeLock.Lock()
+	delete(c.edges, e)
+	c.edgeLock.Unlock()
+}
+
+type edgeInfo struct {
+	StreamID   string
+	Tunnel     string
+	RemoteAddr string
+	Since      time.Time
+	BytesIn    uint64
+	BytesOut   uint64
+}
+
+func (c *Control) edgeInfos() []edgeInfo {
+	infos := []edgeInfo{}
+	c.edgeLock.Lock()
+	for e := range c.edges {
+		infos = append(infos, edgeInfo{
+			StreamID:   e.streamID,
+			Tunnel:     e.tunnel,
+			RemoteAddr: e.remoteAddr,
+			Since:      e.since,
+			BytesIn:    atomic.LoadUint64(&e.bytesIn),
+			BytesOut:   atomic.LoadUint64(&e.bytesOut),
+		})
+	}
+	c.edgeLock.Unlock()
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Since.Before(infos[j].Since) })
+	return infos
+}
+
+// debugControl is the live state of a control connection in the connection dump
+type debugControl struct {
+	ID          string
+	ClientID    string
+	RemoteAddr  string
+	Transport   string
+	ConnectedAt time.Time
+	Streams     int64
+	BytesIn     uint64
+	BytesOut    uint64
+	Pipes       []pipeInfo
+	Edges       []edgeInfo
+}
+
+// debugConnections dumps the controls with their pipes and the public connections they serve
+// at /api/v1/debug/connections
+func debugConnections(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		fmt.Fprintf(w, "method not allowed")
+		return
+	}
+	var controls []*Control
+	ControlMapLock.RLock()
+	for _, c := range ControlMap {
+		if !c.IsClosed() && visible(r, c) {
+			controls = append(controls, c)
+		}
+	}
+	ControlMapLock.RUnlock()
+	sort.Sort(controlsByID(controls))
+	dump := []debugControl{}
+	for _, c := range controls {
+		dump = append(dump, debugControl{
+			ID:          c.id,
+			ClientID:    c.ClientID.String(),
+			RemoteAddr:  c.remoteAddr,
+			Transport:   c.transportMode,
+			ConnectedAt: c.connectedAt,
+			Streams:     atomic.LoadInt64(&c.streams),
+			BytesIn:     atomic.LoadUint64(&c.bytesIn),
+			BytesOut:    atomic.LoadUint64(&c.bytesOut),
+			Pipes:       c.pipeInfos(),
+			Edges:       c.edgeInfos(),
+		})
+	}
+	writeJson(w, http.StatusOK, dump)
+}
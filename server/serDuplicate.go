@@ -0,0 +1,123 @@
+// Copyright 2017 longXboy, longxboyhi@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/longXboy/lunnel/contrib"
+	"github.com/longXboy/lunnel/log"
+	"github.com/longXboy/lunnel/msg"
+	"github.com/pkg/errors"
+	"github.com/satori/go.uuid"
+)
+
+// policies for a client connecting with the id of a control which is still alive,
+// usually a cloned config carrying a durable id
+const (
+	//the newcomer takes the tunnels over and the old client is told to stop
+	duplicateKick = "kick"
+	//the newcomer is told to stop
+	duplicateReject = "reject"
+	//the newcomer gets a new id,client ids are uuids so they are not suffixed
+	duplicateReassign = "reassign"
+)
+
+// duplicateProbeTimeout is how long the old control may take to answer the ping
+const duplicateProbeTimeout = time.Second * 3
+
+// alive pings the client of c and reports whether it answers in timeout,
+// the control left by a client reconnecting from another network doesn't
+func (c *Control) alive(timeout time.Duration) bool {
+	if c.IsClosed() {
+		return false
+	}
+	last := atomic.LoadUint64(&c.lastRead)
+	select {
+	case c.writeChan <- writeReq{msg.TypePing, nil}:
+	default:
+		return false
+	}
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 100)
+		if atomic.LoadUint64(&c.lastRead) != last {
+			return true
+		}
+		if c.IsClosed() {
+			return false
+		}
+	}
+	return false
+}
+
+func duplicateError(id uuid.UUID, remoteAddr string) msg.Error {
+	return msg.Error{
+		Msg:    fmt.Sprintf("client id %s is in use by the client from %s", id.String(), remoteAddr),
+		Code:   msg.ErrCodeDuplicateClient,
+		Detail: map[string]string{"client_id": id.String(), "remote_addr": remoteAddr},
+	}
+}
+
+// refuse tells the client of c to stop by serverErr and closes c once it is sent,
+// the close is forced if serverErr can't be sent in time
+func (c *Control) refuse(serverErr msg.Error) {
+	atomic.StoreInt32(&c.exited, 1)
+	select {
+	case c.writeChan <- writeReq{msg.TypeError, serverErr}:
+	default:
+		c.Close()
+		return
+	}
+	go func() {
+		select {
+		case <-time.After(time.Second * 5):
+			c.Close()
+		case <-c.ctx.Done():
+		}
+	}()
+}
+
+// handleDuplicate applies duplicate_client to c,which connected with the id of old while old is alive,
+// it reports whether c takes the tunnels of old over
+func (c *Control) handleDuplicate(old *Control, shello *msg.ControlServerHello) (bool, error) {
+	policy := serverConf.DuplicateClient
+	controlLog.WithFields(log.Fields{"ctl_id": c.id, "old_ctl_id": old.id, "client_id": c.ClientID.String(), "remote_addr": c.remoteAddr, "old_remote_addr": old.remoteAddr, "policy": policy}).Warningln("duplicate client id connected!")
+	recordEvent("client_duplicate", c, "", fmt.Sprintf("%s,%s,%s", old.remoteAddr, c.remoteAddr, policy))
+	duplicate := c.securityEvent(securityClientDuplicate, 6)
+	duplicate.Detail = fmt.Sprintf("old remote %s,policy %s", old.remoteAddr, policy)
+	exportSecurity(duplicate)
+	if serverConf.NotifyEnable {
+		go func(id string) {
+			err := contrib.DuplicateClient(serverConf.ServerDomain, id, old.remoteAddr, c.remoteAddr, policy)
+			if err != nil {
+				controlLog.WithFields(log.Fields{"ctl_id": c.id, "err": err}).Errorln("notify duplicate client failed!")
+			}
+		}(c.ClientID.String())
+	}
+	switch policy {
+	case duplicateReject:
+		msg.WriteMsg(c.ctlConn, msg.TypeError, duplicateError(c.ClientID, old.remoteAddr))
+		return false, errors.Errorf("client id %s is in use by %s", c.ClientID.String(), old.remoteAddr)
+	case duplicateReassign:
+		shello.ClientID = c.GenerateClientId()
+		controlLog.WithFields(log.Fields{"ctl_id": c.id, "client_id": c.ClientID.String(), "old_client_id": old.ClientID.String(), "remote_addr": c.remoteAddr}).Infoln("client id reassigned")
+		return false, nil
+	}
+	old.refuse(duplicateError(old.ClientID, c.remoteAddr))
+	return true, nil
+}
@@ -0,0 +1,280 @@
+// Copyright 2017 longXboy, longxboyhi@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/longXboy/lunnel/log"
+	"github.com/pkg/errors"
+)
+
+// Ephemeral are the settings of the tunnels the manage api creates for a while,like the previews
+// of pull requests,they are kept in memory only and lost when server restarts
+type Ephemeral struct {
+	//seconds the tunnels created without a ttl live,default to 86400
+	DefaultTtl int `yaml:"default_ttl,omitempty"`
+	//longest ttl in seconds a tunnel may be created with,0 is unlimited
+	MaxTtl int `yaml:"max_ttl,omitempty"`
+	//the tunnels expired or deleted are posted to Webhook as json
+	Webhook string `yaml:"webhook,omitempty"`
+}
+
+// ephemeralTunnel is provisioned to the client of ClientID until it expires or is deleted
+type ephemeralTunnel struct {
+	ID       string `json:"id"`
+	ClientID string `json:"client_id"`
+	//name of the tunnel on the client,default to ID
+	Name string `json:"name,omitempty"`
+	//who the tunnel is made for,like the number of a pull request
+	Owner  string            `json:"owner,omitempty"`
+	Ttl    int               `json:"ttl,omitempty"`
+	Tunnel ProvisionedTunnel `json:"tunnel"`
+	//public address the client registered the tunnel at,empty if not registered
+	Public    string    `json:"public,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+	//expired or deleted,only posted to the webhook
+	Reason string `json:"reason,omitempty"`
+
+	timer *time.Timer
+}
+
+var (
+	ephemeralLock sync.Mutex
+	ephemerals    = make(map[string]*ephemeralTunnel)
+)
+
+// ephemeralTunnels adds the ephemeral tunnels of the client id to tunnels
+func ephemeralTunnels(clientId string, tunnels map[string]*ProvisionedTunnel) {
+	ephemeralLock.Lock()
+	defer ephemeralLock.Unlock()
+	for _, e := range ephemerals {
+		if e.ClientID == clientId {
+			p := e.Tunnel
+			tunnels[e.Name] = &p
+		}
+	}
+}
+
+func isEphemeral(clientId string, name string) bool {
+	ephemeralLock.Lock()
+	defer ephemeralLock.Unlock()
+	for _, e := range ephemerals {
+		if e.ClientID == clientId && e.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// createEphemeral validates e,provisions it to its client and removes it once its ttl passes
+func createEphemeral(e *ephemeralTunnel) error {
+	e.ClientID = strings.ToLower(e.ClientID)
+	e.ID = newResumeToken()
+	if e.ID == "" {
+		return errors.New("generate ephemeral id failed")
+	}
+	e.ID = e.ID[:12]
+	if e.Name == "" {
+		e.Name = "ephemeral-" + e.ID
+	}
+	if e.Ttl <= 0 {
+		e.Ttl = serverConf.Ephemeral.DefaultTtl
+		if e.Ttl <= 0 {
+			e.Ttl = 86400
+		}
+	}
+	if serverConf.Ephemeral.MaxTtl > 0 && e.Ttl > serverConf.Ephemeral.MaxTtl {
+		return errors.Errorf("ttl %d exceeds max_ttl %d", e.Ttl, serverConf.Ephemeral.MaxTtl)
+	}
+	err := validateProvision(e.ClientID, map[string]*ProvisionedTunnel{e.Name: &e.Tunnel})
+	if err != nil {
+		return err
+	}
+	if isProvisioned(e.ClientID, e.Name) {
+		return errors.Errorf("tunnel %s of %s is already provisioned", e.Name, e.ClientID)
+	}
+	e.Public = ""
+	e.Reason = ""
+	e.CreatedAt = time.Now()
+	e.ExpiresAt = e.CreatedAt.Add(time.Duration(e.Ttl) * time.Second)
+	ephemeralLock.Lock()
+	ephemerals[e.ID] = e
+	id := e.ID
+	e.timer = time.AfterFunc(time.Duration(e.Ttl)*time.Second, func() {
+		removeEphemeral(id, "expired")
+	})
+	ephemeralLock.Unlock()
+	log.WithFields(log.Fields{"id": e.ID, "client_id": e.ClientID, "tunnel": e.Name, "owner": e.Owner, "ttl": e.Ttl}).Infoln("ephemeral tunnel created")
+	if ctl := liveControl(e.ClientID); ctl != nil {
+		ctl.provision()
+	}
+	return nil
+}
+
+// removeEphemeral removes the tunnel from its client and posts it to the webhook,
+// it reports false if the tunnel is not found
+func removeEphemeral(id string, reason string) bool {
+	ephemeralLock.Lock()
+	e, isok := ephemerals[id]
+	delete(ephemerals, id)
+	ephemeralLock.Unlock()
+	if !isok {
+		return false
+	}
+	e.timer.Stop()
+	removed := *e
+	removed.timer = nil
+	ctl := liveControl(e.ClientID)
+	if ctl != nil {
+		removed.Public = ctl.tunnelPublic(e.Name)
+		ctl.removeProvisioned([]string{e.Name})
+	}
+	removed.Reason = reason
+	log.WithFields(log.Fields{"id": e.ID, "client_id": e.ClientID, "tunnel": e.Name, "owner": e.Owner, "reason": reason}).Infoln("ephemeral tunnel removed")
+	recordEvent("ephemeral_"+reason, ctl, e.Name, e.Owner)
+	if serverConf.Ephemeral.Webhook != "" {
+		go postEphemeral(removed)
+	}
+	return true
+}
+
+func postEphemeral(e ephemeralTunnel) {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	resp, err := webhookClient.Post(serverConf.Ephemeral.Webhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.WithFields(log.Fields{"err": err, "id": e.ID}).Warningln("post ephemeral webhook failed!")
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		log.WithFields(log.Fields{"code": resp.StatusCode, "id": e.ID}).Warningln("ephemeral webhook refused!")
+	}
+}
+
+// tunnelPublic is the public address of the tunnel of name,empty if the control has no such tunnel
+func (c *Control) tunnelPublic(name string) string {
+	c.tunnelLock.Lock()
+	defer c.tunnelLock.Unlock()
+	if t, isok := c.tunnels[name]; isok {
+		return t.config().PublicAddr()
+	}
+	return ""
+}
+
+// ephemeralView copies e with the public address of its tunnel if registered
+func ephemeralView(e *ephemeralTunnel) ephemeralTunnel {
+	view := *e
+	view.timer = nil
+	if ctl := liveControl(e.ClientID); ctl != nil {
+		view.Public = ctl.tunnelPublic(e.Name)
+	}
+	return view
+}
+
+type ephemeralByID []ephemeralTunnel
+
+func (e ephemeralByID) Len() int           { return len(e) }
+func (e ephemeralByID) Swap(i, j int)      { e[i], e[j] = e[j], e[i] }
+func (e ephemeralByID) Less(i, j int) bool { return e[i].ID < e[j].ID }
+
+// ephemeralHandler lists(filtered by the owner parameter) and creates by POST the ephemeral tunnels
+// at /api/v1/ephemeral,and gets or deletes one at /api/v1/ephemeral/{id}
+func ephemeralHandler(w http.ResponseWriter, r *http.Request) {
+	if requestTenant(r) != nil {
+		// ephemeral tunnels pick any client id like provisions
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprintf(w, "permission denied")
+		return
+	}
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1/ephemeral"), "/")
+	if id == "" {
+		switch r.Method {
+		case "GET":
+			owner := r.URL.Query().Get("owner")
+			var all []*ephemeralTunnel
+			ephemeralLock.Lock()
+			for _, e := range ephemerals {
+				if owner == "" || e.Owner == owner {
+					all = append(all, e)
+				}
+			}
+			ephemeralLock.Unlock()
+			list := []ephemeralTunnel{}
+			for _, e := range all {
+				list = append(list, ephemeralView(e))
+			}
+			sort.Sort(ephemeralByID(list))
+			writeJson(w, http.StatusOK, list)
+		case "POST":
+			content, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxProvisionBody))
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprintf(w, "read req body failed")
+				return
+			}
+			var e ephemeralTunnel
+			err = json.Unmarshal(content, &e)
+			if err == nil {
+				err = createEphemeral(&e)
+			}
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprint(w, err.Error())
+				return
+			}
+			writeJson(w, http.StatusCreated, ephemeralView(&e))
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			fmt.Fprintf(w, "method not allowed")
+		}
+		return
+	}
+	switch r.Method {
+	case "GET":
+		ephemeralLock.Lock()
+		e, isok := ephemerals[id]
+		ephemeralLock.Unlock()
+		if !isok {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintf(w, "ephemeral tunnel not found")
+			return
+		}
+		writeJson(w, http.StatusOK, ephemeralView(e))
+	case "DELETE":
+		if !removeEphemeral(id, "deleted") {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintf(w, "ephemeral tunnel not found")
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("ok"))
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		fmt.Fprintf(w, "method not allowed")
+	}
+}
@@ -0,0 +1,136 @@
+// Copyright 2017 longXboy, longxboyhi@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// maxRecentEvents is how many events are kept for the manage api
+const maxRecentEvents = 256
+
+type serverEvent struct {
+	Id       uint64
+	Time     int64
+	Kind     string
+	ClientID string `json:",omitempty"`
+	Tunnel   string `json:",omitempty"`
+	Tenant   string `json:",omitempty"`
+	Detail   string `json:",omitempty"`
+}
+
+var eventsLock sync.Mutex
+var recentEvents []serverEvent
+var lastEventId uint64
+var eventSubscribers = make(map[chan serverEvent]struct{})
+
+// recordEvent keeps the event for the manage api and sends it to the subscribers of the event stream
+func recordEvent(kind string, c *Control, tunnel string, detail string) {
+	ev := serverEvent{Time: time.Now().Unix(), Kind: kind, Tunnel: tunnel, Detail: detail}
+	if c != nil {
+		ev.ClientID = c.ClientID.String()
+		ev.Tenant = c.tenant.name()
+	}
+	eventsLock.Lock()
+	lastEventId++
+	ev.Id = lastEventId
+	recentEvents = append(recentEvents, ev)
+	if len(recentEvents) > maxRecentEvents {
+		recentEvents = recentEvents[len(recentEvents)-maxRecentEvents:]
+	}
+	for ch := range eventSubscribers {
+		select {
+		case ch <- ev:
+		default:
+			// slow subscriber misses the event,it can catch up by the since parameter
+		}
+	}
+	eventsLock.Unlock()
+}
+
+func eventVisible(r *http.Request, ev serverEvent) bool {
+	tenant := requestTenant(r)
+	return tenant == nil || ev.Tenant == tenant.Name
+}
+
+// eventList returns the recent events,after the id in since parameter if specified
+func eventList(w http.ResponseWriter, r *http.Request) {
+	since, _ := strconv.ParseUint(r.URL.Query().Get("since"), 10, 64)
+	events := []serverEvent{}
+	eventsLock.Lock()
+	for _, ev := range recentEvents {
+		if ev.Id > since && eventVisible(r, ev) {
+			events = append(events, ev)
+		}
+	}
+	eventsLock.Unlock()
+	writeJson(w, http.StatusOK, events)
+}
+
+// eventStream streams the events as server-sent events
+func eventStream(w http.ResponseWriter, r *http.Request) {
+	flusher, isok := w.(http.Flusher)
+	if !isok {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "streaming not supported")
+		return
+	}
+	ch := make(chan serverEvent, 64)
+	eventsLock.Lock()
+	eventSubscribers[ch] = struct{}{}
+	eventsLock.Unlock()
+	defer func() {
+		eventsLock.Lock()
+		delete(eventSubscribers, ch)
+		eventsLock.Unlock()
+	}()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	ticker := time.NewTicker(time.Second * 30)
+	defer ticker.Stop()
+	for {
+		select {
+		case ev := <-ch:
+			if !eventVisible(r, ev) {
+				continue
+			}
+			data, err := json.Marshal(ev)
+			if err != nil {
+				return
+			}
+			_, err = fmt.Fprintf(w, "id: %d\ndata: %s\n\n", ev.Id, data)
+			if err != nil {
+				return
+			}
+		case <-ticker.C:
+			// keep the idle connection from being closed by proxies
+			_, err := fmt.Fprintf(w, ": ping\n\n")
+			if err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,99 @@
+// Copyright 2017 longXboy, longxboyhi@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bufio"
+	"net"
+	"strings"
+)
+
+// trustedProxyNets are the parsed trusted_proxies
+var trustedProxyNets []*net.IPNet
+
+// trustedProxy reports whether addr is one of the reverse proxies fronting the http and https ports
+func trustedProxy(addr net.Addr) bool {
+	ip := remoteIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, n := range trustedProxyNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// proxiedConn is a connection relayed by a trusted proxy with the address of the visitor
+type proxiedConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (pc *proxiedConn) NetConn() net.Conn {
+	return pc.Conn
+}
+
+func (pc *proxiedConn) RemoteAddr() net.Addr {
+	return pc.remote
+}
+
+// readProxyProtocol takes the address of the visitor from the PROXY protocol v1 header
+// sent first by a trusted proxy,the connections without the header are returned as they are
+func readProxyProtocol(conn net.Conn) (net.Conn, error) {
+	if !trustedProxy(conn.RemoteAddr()) {
+		return conn, nil
+	}
+	r := bufio.NewReaderSize(conn, maxMuxHeader)
+	head, err := r.Peek(6)
+	if err != nil {
+		return nil, err
+	}
+	bc := &bufferedConn{Conn: conn, r: r}
+	if string(head) != "PROXY " {
+		return bc, nil
+	}
+	line, err := readMuxLine(r)
+	if err != nil {
+		return nil, err
+	}
+	src, _, err := parseProxyHeader(line)
+	if err != nil {
+		return nil, err
+	}
+	return &proxiedConn{Conn: bc, remote: src}, nil
+}
+
+// visitorAddr is the address the tunnel policy is checked against,the X-Forwarded-For of
+// a request relayed by a trusted proxy is walked from the right to the first untrusted hop
+func visitorAddr(conn net.Conn, info map[string]string) net.Addr {
+	addr := conn.RemoteAddr()
+	if info["ForwardedFor"] == "" || !trustedProxy(addr) {
+		return addr
+	}
+	hops := strings.Split(info["ForwardedFor"], ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(hops[i]))
+		if ip == nil {
+			break
+		}
+		addr = &net.TCPAddr{IP: ip}
+		if !trustedProxy(addr) {
+			break
+		}
+	}
+	return addr
+}
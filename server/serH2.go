@@ -0,0 +1,212 @@
+// Copyright 2017 longXboy, longxboyhi@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/longXboy/lunnel/log"
+	"github.com/longXboy/lunnel/vhost"
+	"github.com/longXboy/smux"
+	"github.com/pkg/errors"
+)
+
+type h2ConnKey struct{}
+type h2StreamKey struct{}
+
+// connListener hands the connections accepted elsewhere to an http.Server
+type connListener struct {
+	conns chan net.Conn
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	return <-l.conns, nil
+}
+
+func (l *connListener) Close() error {
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return &net.TCPAddr{}
+}
+
+// h2Listener feeds the tls connections which negotiated h2 to h2Server
+var h2Listener = &connListener{conns: make(chan net.Conn)}
+var h2Once sync.Once
+
+// h2Server terminates http/2 for the https tunnels with http2 enabled
+var h2Server = &http.Server{
+	Handler: http.HandlerFunc(serveH2Request),
+	ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+		return context.WithValue(ctx, h2ConnKey{}, c)
+	},
+}
+
+// h2Proxy sends each request over the stream opened for it by serveH2Request
+var h2Proxy = &httputil.ReverseProxy{
+	Director: func(req *http.Request) {
+		req.URL.Scheme = "http"
+		req.URL.Host = req.Host
+		// the http/1.1 path forwards the requests untouched,so does this one
+		req.Header["X-Forwarded-For"] = nil
+		if _, isok := req.Header["User-Agent"]; !isok {
+			req.Header["User-Agent"] = []string{""}
+		}
+	},
+	Transport: &http.Transport{
+		DisableKeepAlives: true,
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			sc := ctx.Value(h2StreamKey{}).(*h2Stream)
+			if !atomic.CompareAndSwapInt32(&sc.dialed, 0, 1) {
+				return nil, errors.New("stream of request already used")
+			}
+			return sc, nil
+		},
+	},
+	ModifyResponse: func(resp *http.Response) error {
+		sc := resp.Request.Context().Value(h2StreamKey{}).(*h2Stream)
+		atomic.StoreInt32(&sc.status, int32(resp.StatusCode))
+		return nil
+	},
+	ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+		if sc, isok := r.Context().Value(h2StreamKey{}).(*h2Stream); isok {
+			atomic.StoreInt32(&sc.status, http.StatusBadGateway)
+		}
+		vhostLog.WithFields(log.Fields{"err": err, "host": r.Host}).Debugln("proxy http2 request failed!")
+		writeRawResp(w, r, vhost.BadGateWayResp())
+	},
+}
+
+// h2Stream is the stream to client carrying one http/2 request,the traffic is counted as proxyConn does
+type h2Stream struct {
+	*smux.Stream
+	c      *Control
+	t      *Tunnel
+	edge   *edgeConn
+	dialed int32
+	//status of the response,502 if proxying failed
+	status    int32
+	closeOnce sync.Once
+}
+
+func (s *h2Stream) Read(p []byte) (int, error) {
+	n, err := s.Stream.Read(p)
+	atomic.AddUint64(&s.edge.bytesOut, uint64(n))
+	atomic.AddUint64(&s.c.bytesOut, uint64(n))
+	atomic.AddUint64(&s.t.bytesOut, uint64(n))
+	atomic.AddUint64(&serverMetrics.bytesOut, uint64(n))
+	if err == nil && s.t.overQuota() {
+		return n, errQuotaExceeded
+	}
+	return n, err
+}
+
+func (s *h2Stream) Write(p []byte) (int, error) {
+	return (&trafficWriter{w: s.Stream, ctl: &s.c.bytesIn, tunnel: &s.t.bytesIn, global: &serverMetrics.bytesIn, owner: s.t, edge: &s.edge.bytesIn}).Write(p)
+}
+
+func (s *h2Stream) Close() error {
+	s.closeOnce.Do(func() {
+		s.c.untrackEdge(s.edge)
+		atomic.AddInt64(&s.c.streams, -1)
+		atomic.AddInt64(&s.t.streams, -1)
+	})
+	return s.Stream.Close()
+}
+
+// http2Enabled reports whether the tunnel serving addr has http2 enabled
+func http2Enabled(addr string) bool {
+	TunnelMapLock.RLock()
+	t, isok := TunnelMap[routeAddrLocked(addr)]
+	TunnelMapLock.RUnlock()
+	return isok && t.config().Http2
+}
+
+// serveH2 hands tlsConn which negotiated h2 to h2Server
+func serveH2(tlsConn net.Conn) {
+	h2Once.Do(func() {
+		go h2Server.Serve(h2Listener)
+	})
+	h2Listener.conns <- tlsConn
+}
+
+// writeRawResp answers r with raw,one of the http/1.1 responses of vhost
+func writeRawResp(w http.ResponseWriter, r *http.Request, raw string) {
+	resp, err := http.ReadResponse(bufio.NewReader(strings.NewReader(raw)), r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	for k, v := range resp.Header {
+		if k == "Connection" || k == "Content-Length" {
+			continue
+		}
+		w.Header()[k] = v
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
+
+// serveH2Request routes and admits an http/2 request the way handleHttpsConn does
+// for http/1.1,then proxies it over a stream of its own
+func serveH2Request(w http.ResponseWriter, r *http.Request) {
+	conn := r.Context().Value(h2ConnKey{}).(net.Conn)
+	info := vhost.RequestInfo(r)
+	addr := fmt.Sprintf("https://%s:%d", info["Host"], serverConf.HttpsPort)
+	t, isok := lookupHttpTunnel(addr, r.Method)
+	if !isok {
+		writeRawResp(w, r, vhost.BadGateWayResp())
+		return
+	}
+	if resp := admitHttp(conn, info, t); resp != "" {
+		writeRawResp(w, r, resp)
+		return
+	}
+	atomic.AddUint64(&serverMetrics.connections, 1)
+	now := time.Now()
+	t.stats.count(now)
+	stream, streamID, err := t.openStream()
+	if err != nil {
+		atomic.AddUint64(&serverMetrics.errors, 1)
+		if err == errTooBusy {
+			writeRawResp(w, r, vhost.TooBusyResp())
+		} else {
+			writeRawResp(w, r, vhost.BadGateWayResp())
+		}
+		return
+	}
+	c := t.control()
+	atomic.AddInt64(&c.streams, 1)
+	atomic.AddInt64(&t.streams, 1)
+	sc := &h2Stream{Stream: stream, c: c, t: t, edge: c.trackEdge(streamID, t.name, conn.RemoteAddr())}
+	defer sc.Close()
+	if rewrite := t.config().HttpHostRewrite; rewrite != "" {
+		r.Host = rewrite
+	}
+	h2Proxy.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), h2StreamKey{}, sc)))
+	t.stats.observe(int(atomic.LoadInt32(&sc.status)), time.Since(now))
+}
@@ -0,0 +1,160 @@
+// Copyright 2017 longXboy, longxboyhi@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/longXboy/lunnel/vhost"
+	"github.com/longXboy/smux"
+)
+
+// httpUpstream is the stream to client of one tunnel serving the requests of a public connection
+type httpUpstream struct {
+	stream *smux.Stream
+	r      *bufio.Reader
+	ctl    *Control
+	edge   *edgeConn
+}
+
+// proxyHttp proxies the http requests of userConn one by one,so that each of them is routed
+// by its method and the cacheable ones are answered from cache.first is the tunnel admitted
+// for the first request,the other tunnels are admitted on the first request routed to them
+func proxyHttp(conn net.Conn, userConn net.Conn, first *Tunnel) {
+	defer userConn.Close()
+	atomic.AddUint64(&serverMetrics.connections, 1)
+	addr := first.config().PublicAddr()
+	ur := bufio.NewReader(userConn)
+	upstreams := make(map[*Tunnel]*httpUpstream)
+	defer func() {
+		for t, up := range upstreams {
+			up.stream.Close()
+			up.ctl.untrackEdge(up.edge)
+			atomic.AddInt64(&up.ctl.streams, -1)
+			atomic.AddInt64(&t.streams, -1)
+		}
+	}()
+	for idx := 0; ; idx++ {
+		req, err := http.ReadRequest(ur)
+		if err != nil {
+			return
+		}
+		t := first
+		if idx > 0 {
+			var isok bool
+			t, isok = lookupHttpTunnel(addr, req.Method)
+			if !isok {
+				userConn.Write([]byte(vhost.BadGateWayResp()))
+				return
+			}
+		}
+		up, isok := upstreams[t]
+		if !isok && t != first {
+			if resp := admitHttp(conn, vhost.RequestInfo(req), t); resp != "" {
+				userConn.Write([]byte(resp))
+				return
+			}
+		}
+		if !t.pathServed(req.URL.Path) {
+			req.Body.Close()
+			_, err = userConn.Write([]byte(vhost.NotFoundResp(t.config().NotFoundPage)))
+			if err != nil || req.Close {
+				return
+			}
+			continue
+		}
+		now := time.Now()
+		t.stats.count(now)
+		resp, key := cachedResponse(t, req, now)
+		if resp != nil {
+			req.Body.Close()
+			t.stats.observe(resp.StatusCode, time.Since(now))
+			err = resp.Write(userConn)
+			if err != nil || req.Close {
+				return
+			}
+			continue
+		}
+		if !isok {
+			stream, streamID, err := t.openStream()
+			if err != nil {
+				atomic.AddUint64(&serverMetrics.errors, 1)
+				if err == errTooBusy {
+					userConn.Write([]byte(vhost.TooBusyResp()))
+				}
+				return
+			}
+			ctl := t.control()
+			up = &httpUpstream{stream: stream, r: bufio.NewReader(stream), ctl: ctl, edge: ctl.trackEdge(streamID, t.name, userConn.RemoteAddr())}
+			upstreams[t] = up
+			atomic.AddInt64(&up.ctl.streams, 1)
+			atomic.AddInt64(&t.streams, 1)
+		}
+		c := up.ctl
+		if rewrite := t.config().HttpHostRewrite; rewrite != "" {
+			req.Host = rewrite
+		}
+		if _, isok := req.Header["User-Agent"]; !isok {
+			// keep Request.Write from adding the default user agent
+			req.Header["User-Agent"] = []string{""}
+		}
+		err = req.Write(&trafficWriter{w: up.stream, ctl: &c.bytesIn, tunnel: &t.bytesIn, global: &serverMetrics.bytesIn, owner: t, edge: &up.edge.bytesIn})
+		if err != nil {
+			return
+		}
+		resp, err = http.ReadResponse(up.r, req)
+		if err != nil {
+			return
+		}
+		t.stats.observe(resp.StatusCode, time.Since(now))
+		store := cacheResponse(req, resp, key, now)
+		err = resp.Write(&trafficWriter{w: userConn, ctl: &c.bytesOut, tunnel: &t.bytesOut, global: &serverMetrics.bytesOut, owner: t, edge: &up.edge.bytesOut})
+		resp.Body.Close()
+		if err != nil {
+			return
+		}
+		store()
+		if resp.StatusCode == http.StatusSwitchingProtocols {
+			relayUpgraded(userConn, ur, up.stream, up.r, c, t, up.edge)
+			return
+		}
+		if req.Close || resp.Close {
+			return
+		}
+	}
+}
+
+// relayUpgraded copies the upgraded connection as it is,the bytes buffered while parsing are sent first
+func relayUpgraded(userConn net.Conn, ur io.Reader, stream io.Writer, sr io.Reader, c *Control, t *Tunnel, edge *edgeConn) {
+	p1die := make(chan struct{})
+	p2die := make(chan struct{})
+	go func() {
+		io.Copy(&trafficWriter{w: stream, ctl: &c.bytesIn, tunnel: &t.bytesIn, global: &serverMetrics.bytesIn, owner: t, edge: &edge.bytesIn}, ur)
+		close(p1die)
+	}()
+	go func() {
+		io.Copy(&trafficWriter{w: userConn, ctl: &c.bytesOut, tunnel: &t.bytesOut, global: &serverMetrics.bytesOut, owner: t, edge: &edge.bytesOut}, sr)
+		close(p2die)
+	}()
+	select {
+	case <-p1die:
+	case <-p2die:
+	}
+}
@@ -0,0 +1,144 @@
+// Copyright 2017 longXboy, longxboyhi@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/longXboy/lunnel/log"
+	"github.com/longXboy/lunnel/util"
+)
+
+const defaultKnockTtl = 300
+
+var knockReplay util.KnockReplay
+
+// knocked reports whether ip has opened the tunnel by a knock which has not expired
+func (t *Tunnel) knocked(ip net.IP) bool {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	expire, isok := t.knocks[ip.String()]
+	return isok && time.Now().Before(expire)
+}
+
+func (t *Tunnel) grantKnock(ip net.IP, ttl time.Duration) {
+	now := time.Now()
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.knocks == nil {
+		t.knocks = make(map[string]time.Time)
+	}
+	for k, expire := range t.knocks {
+		if now.After(expire) {
+			delete(t.knocks, k)
+		}
+	}
+	t.knocks[ip.String()] = now.Add(ttl)
+}
+
+// handleKnock opens the tcp tunnel on port for ip if sig is signed by the knock secret of the tunnel
+func handleKnock(ip net.IP, port uint16, ts int64, sig string) bool {
+	if ip == nil {
+		return false
+	}
+	TunnelMapLock.RLock()
+	tunnel, isok := TunnelMap[fmt.Sprintf("tcp://%s:%d", serverConf.ServerDomain, port)]
+	TunnelMapLock.RUnlock()
+	if !isok {
+		return false
+	}
+	policy := tunnel.getPolicy()
+	if policy == nil || policy.knock == nil {
+		return false
+	}
+	if !util.VerifyKnock(policy.knock.Secret, port, ts, sig, time.Now()) {
+		log.WithFields(log.Fields{"ip": ip.String(), "tunnel": tunnel.name}).Warningln("invalid knock signature")
+		return false
+	}
+	if !knockReplay.Use(port, ts, sig, time.Now()) {
+		log.WithFields(log.Fields{"ip": ip.String(), "tunnel": tunnel.name}).Warningln("replayed knock")
+		return false
+	}
+	ttl := policy.knock.Ttl
+	if ttl == 0 {
+		ttl = defaultKnockTtl
+	}
+	tunnel.grantKnock(ip, time.Duration(ttl)*time.Second)
+	log.WithFields(log.Fields{"ip": ip.String(), "tunnel": tunnel.name, "ttl": ttl}).Infoln("tunnel opened by knock")
+	return true
+}
+
+func knockHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	port, err := strconv.ParseUint(query.Get("port"), 10, 16)
+	if err != nil {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	ts, err := strconv.ParseInt(query.Get("ts"), 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if !handleKnock(net.ParseIP(host), uint16(port), ts, query.Get("sig")) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// serveKnock accepts knocks as udp packets and as http requests of /knock on the same port
+func serveKnock(addr string) {
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		log.WithFields(log.Fields{"addr": addr, "err": err}).Fatalln("listen knock udp failed!")
+	}
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, raddr, err := pc.ReadFrom(buf)
+			if err != nil {
+				log.WithFields(log.Fields{"err": err}).Errorln("read knock packet failed!")
+				return
+			}
+			port, ts, sig, err := util.ParseKnockPacket(buf[:n])
+			if err != nil {
+				continue
+			}
+			handleKnock(remoteIP(raddr), port, ts, sig)
+		}
+	}()
+	m := http.NewServeMux()
+	m.HandleFunc("/knock", knockHandler)
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.WithFields(log.Fields{"addr": addr, "err": err}).Fatalln("listen knock tcp failed!")
+	}
+	log.WithFields(log.Fields{"addr": addr}).Infoln("listen knock")
+	listening.Done()
+	err = http.Serve(lis, m)
+	if err != nil {
+		log.WithFields(log.Fields{"addr": addr, "err": err}).Errorln("serve knock failed!")
+	}
+}
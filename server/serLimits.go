@@ -0,0 +1,96 @@
+// Copyright 2017 longXboy, longxboyhi@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/longXboy/lunnel/log"
+	"github.com/longXboy/lunnel/util"
+)
+
+// raiseOpenFiles raises the open files limit to max_open_files,
+// the server goes on with the limit it got if it can't be raised that far
+func raiseOpenFiles() {
+	target := serverConf.MaxOpenFiles
+	if target == 0 {
+		return
+	}
+	limit, err := util.RaiseOpenFiles(target)
+	if err != nil {
+		log.WithFields(log.Fields{"max_open_files": target, "limit": limit, "err": err}).Warningln("raise open files limit failed,keep the limit got")
+		return
+	}
+	log.WithFields(log.Fields{"max_open_files": target, "limit": limit}).Infoln("open files limit raised")
+}
+
+// openFilesWarned is the unix nano the open files running low was warned at last
+var openFilesWarned int64
+
+// warnOpenFiles warns every minute while usage percent of the open files limit is over the warn of overload
+func warnOpenFiles(open int, limit int, usage int32) {
+	if usage < int32(serverConf.Overload.Warn) {
+		return
+	}
+	now := time.Now().UnixNano()
+	if now-atomic.LoadInt64(&openFilesWarned) < int64(time.Minute) {
+		return
+	}
+	atomic.StoreInt64(&openFilesWarned, now)
+	log.WithFields(log.Fields{"open_files": open, "limit": limit, "usage": usage}).Warningln("open files running low,raise max_open_files before connections fail")
+	recordEvent("files_running_low", nil, "", fmt.Sprintf("%d of %d files open", open, limit))
+}
+
+// acceptErrors counts the failed accepts of all the listeners
+var acceptErrors uint64
+
+const (
+	minAcceptBackoff = time.Millisecond * 5
+	maxAcceptBackoff = time.Second
+)
+
+// acceptBackoff paces an accept loop after failed accepts like net/http does,
+// so that running out of file descriptors doesn't spin it
+type acceptBackoff struct {
+	delay time.Duration
+}
+
+// wait sleeps after the accept failed by err,it returns false if the listener is closed
+func (b *acceptBackoff) wait(err error) bool {
+	if errors.Is(err, net.ErrClosed) {
+		return false
+	}
+	atomic.AddUint64(&acceptErrors, 1)
+	if b.delay == 0 {
+		b.delay = minAcceptBackoff
+	} else if b.delay *= 2; b.delay > maxAcceptBackoff {
+		b.delay = maxAcceptBackoff
+	}
+	if errors.Is(err, syscall.EMFILE) || errors.Is(err, syscall.ENFILE) {
+		open, limit, _ := util.OpenFiles()
+		transportLog.WithFields(log.Fields{"err": err, "open_files": open, "limit": limit, "retry_in": b.delay.String()}).Warningln("out of file descriptors,raise max_open_files or lower the load")
+	}
+	time.Sleep(b.delay)
+	return true
+}
+
+func (b *acceptBackoff) reset() {
+	b.delay = 0
+}
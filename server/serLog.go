@@ -0,0 +1,42 @@
+// Copyright 2017 longXboy, longxboyhi@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/longXboy/lunnel/log"
+)
+
+// loggers of the subsystems,log_levels and the manage api can set their levels apart
+var (
+	controlLog   = log.Module("control")
+	pipeLog      = log.Module("pipe")
+	transportLog = log.Module("transport")
+	vhostLog     = log.Module("vhost")
+	manageLog    = log.Module("manage")
+)
+
+// logLevelsHandler gets or puts the log levels at /api/v1/log/levels
+func logLevelsHandler(w http.ResponseWriter, r *http.Request) {
+	if requestTenant(r) != nil {
+		// the levels are process wide,so they are left to the tokens of server
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprintf(w, "permission denied")
+		return
+	}
+	log.LevelsHandler(w, r)
+}
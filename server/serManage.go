@@ -0,0 +1,712 @@
+// Copyright 2017 longXboy, longxboyhi@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/longXboy/lunnel/log"
+	"github.com/longXboy/lunnel/msg"
+	"github.com/longXboy/lunnel/util"
+	"github.com/pkg/errors"
+	"github.com/satori/go.uuid"
+)
+
+const (
+	defaultPageLimit = 100
+	maxPageLimit     = 1000
+)
+
+func serveManage() {
+	m := http.NewServeMux()
+	m.HandleFunc("/tunnel", tunnelQuery)
+	m.HandleFunc("/api/v1/tunnels", tunnelList)
+	m.HandleFunc("/api/v1/tunnels/", tunnelHandler)
+	m.HandleFunc("/api/v1/clients", clientList)
+	m.HandleFunc("/api/v1/clients/", clientHandler)
+	m.HandleFunc("/metrics", metricsHandler)
+	m.HandleFunc("/api/v1/pending", pendingHandler)
+	m.HandleFunc("/api/v1/pending/", pendingHandler)
+	m.HandleFunc("/api/v1/notices", noticeHandler)
+	m.HandleFunc("/api/v1/provisions", provisionHandler)
+	m.HandleFunc("/api/v1/provisions/", provisionHandler)
+	m.HandleFunc("/api/v1/ephemeral", ephemeralHandler)
+	m.HandleFunc("/api/v1/ephemeral/", ephemeralHandler)
+	m.HandleFunc("/api/v1/events", eventList)
+	m.HandleFunc("/api/v1/audit", auditHandler)
+	m.HandleFunc("/api/v1/audit/verify", auditHandler)
+	m.HandleFunc("/api/v1/events/stream", eventStream)
+	m.HandleFunc("/api/v1/tls", certHandler)
+	m.HandleFunc("/api/v1/tls/certs", certListHandler)
+	m.HandleFunc("/api/v1/log/levels", logLevelsHandler)
+	m.HandleFunc("/api/v1/debug/connections", debugConnections)
+	m.HandleFunc("/dashboard", dashboardHandler)
+	addr := fmt.Sprintf("%s:%d", serverConf.ListenIP, serverConf.ManagePort)
+	lis, err := net.Listen("tcp", addr)
+	// the server runs without the manage api if it can't listen
+	listening.Done()
+	if err != nil {
+		manageLog.WithFields(log.Fields{"addr": addr, "err": err}).Errorln("listen manage failed!")
+		return
+	}
+	err = http.Serve(lis, manageAuth(m))
+	if err != nil {
+		manageLog.WithFields(log.Fields{"addr": addr, "err": err}).Errorln("serve manage failed!")
+	}
+}
+
+type tunnelFilter struct {
+	// Tenant scopes the tunnels to the clients of the tenant if not nil
+	Tenant     *Tenant
+	RemoteAddr string
+	ClientID   string
+	Protocol   string
+	Host       string
+	Labels     map[string]string
+}
+
+func (f *tunnelFilter) match(t *Tunnel) bool {
+	if f.RemoteAddr != "" && t.tunnelConfig.PublicAddr() != f.RemoteAddr {
+		return false
+	}
+	if f.ClientID != "" && t.ctl.ClientID.String() != f.ClientID {
+		return false
+	}
+	if f.Tenant != nil && t.ctl.tenant != f.Tenant {
+		return false
+	}
+	if f.Protocol != "" && t.tunnelConfig.Public.Schema != f.Protocol {
+		return false
+	}
+	if f.Host != "" && !strings.Contains(t.tunnelConfig.Public.Host, f.Host) {
+		return false
+	}
+	return t.config().MatchLabels(f.Labels)
+}
+
+// parseTunnelFilter reads client_id,protocol,host and label query parameters,
+// label selectors are given as label=k1=v1,k2=v2 and may be repeated
+func parseTunnelFilter(values url.Values) (tunnelFilter, error) {
+	filter := tunnelFilter{
+		RemoteAddr: values.Get("remote_addr"),
+		ClientID:   values.Get("client_id"),
+		Protocol:   values.Get("protocol"),
+		Host:       values.Get("host"),
+	}
+	for _, selector := range values["label"] {
+		for _, pair := range strings.Split(selector, ",") {
+			if pair == "" {
+				continue
+			}
+			kv := strings.SplitN(pair, "=", 2)
+			if len(kv) != 2 || kv[0] == "" {
+				return filter, errors.Errorf("invalid label selector %s", pair)
+			}
+			if filter.Labels == nil {
+				filter.Labels = make(map[string]string)
+			}
+			filter.Labels[kv[0]] = kv[1]
+		}
+	}
+	return filter, nil
+}
+
+func parsePage(values url.Values) (offset int, limit int, err error) {
+	limit = defaultPageLimit
+	if v := values.Get("limit"); v != "" {
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit <= 0 {
+			return 0, 0, errors.Errorf("invalid limit %s", v)
+		}
+		if limit > maxPageLimit {
+			limit = maxPageLimit
+		}
+	}
+	if v := values.Get("offset"); v != "" {
+		offset, err = strconv.Atoi(v)
+		if err != nil || offset < 0 {
+			return 0, 0, errors.Errorf("invalid offset %s", v)
+		}
+	}
+	return offset, limit, nil
+}
+
+type tunnelsByAddr []*Tunnel
+
+func (t tunnelsByAddr) Len() int      { return len(t) }
+func (t tunnelsByAddr) Swap(i, j int) { t[i], t[j] = t[j], t[i] }
+func (t tunnelsByAddr) Less(i, j int) bool {
+	return t[i].tunnelConfig.PublicAddr() < t[j].tunnelConfig.PublicAddr()
+}
+
+// queryTunnels returns the tunnels matched by filter,ordered by public address
+func queryTunnels(filter tunnelFilter) []*Tunnel {
+	var tunnels []*Tunnel
+	TunnelMapLock.RLock()
+	for _, v := range TunnelMap {
+		if filter.match(v) {
+			tunnels = append(tunnels, v)
+		}
+	}
+	TunnelMapLock.RUnlock()
+	sort.Sort(tunnelsByAddr(tunnels))
+	return tunnels
+}
+
+func paginate(total int, offset int, limit int) (start int, end int) {
+	if offset > total {
+		offset = total
+	}
+	end = offset + limit
+	if end > total {
+		end = total
+	}
+	return offset, end
+}
+
+func writeJson(w http.ResponseWriter, code int, v interface{}) {
+	retBody, err := json.Marshal(v)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "marshal resp body failed")
+		return
+	}
+	header := w.Header()
+	header["Content-Type"] = []string{"application/json"}
+	w.WriteHeader(code)
+	w.Write(retBody)
+}
+
+type tunnelStateReq struct {
+	RemoteAddr string
+	Labels     map[string]string
+}
+
+type tunnelStateResp struct {
+	Total   int
+	Tunnels []string
+}
+
+func tunnelQuery(w http.ResponseWriter, r *http.Request) {
+	content, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "req body is empty")
+		return
+	}
+	r.Body.Close()
+
+	var query tunnelStateReq
+	if len(content) > 0 {
+		err = json.Unmarshal(content, &query)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "unmarshal req body failed")
+			return
+		}
+	}
+	filter, err := parseTunnelFilter(r.URL.Query())
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, err.Error())
+		return
+	}
+	filter.Tenant = requestTenant(r)
+	if query.RemoteAddr != "" {
+		filter.RemoteAddr = query.RemoteAddr
+	}
+	for k, v := range query.Labels {
+		if filter.Labels == nil {
+			filter.Labels = make(map[string]string)
+		}
+		filter.Labels[k] = v
+	}
+	tunnels := queryTunnels(filter)
+	start, end := 0, len(tunnels)
+	// the legacy endpoint returns all the tunnels unless a page is asked for
+	if values := r.URL.Query(); values.Get("limit") != "" || values.Get("offset") != "" {
+		offset, limit, err := parsePage(values)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, err.Error())
+			return
+		}
+		start, end = paginate(len(tunnels), offset, limit)
+	}
+	var tunnelStats tunnelStateResp = tunnelStateResp{Total: len(tunnels), Tunnels: []string{}}
+	for _, t := range tunnels[start:end] {
+		tunnelStats.Tunnels = append(tunnelStats.Tunnels, t.tunnelConfig.PublicAddr())
+	}
+	writeJson(w, http.StatusOK, tunnelStats)
+}
+
+type tunnelInfo struct {
+	Name            string
+	ClientID        string
+	Tenant          string `json:",omitempty"`
+	Schema          string
+	Public          string
+	Local           string
+	Labels          map[string]string
+	HttpHostRewrite string          `json:",omitempty"`
+	HttpAuth        bool            `json:",omitempty"`
+	AllowIPs        []string        `json:",omitempty"`
+	DenyIPs         []string        `json:",omitempty"`
+	RateLimit       float64         `json:",omitempty"`
+	RateBurst       int             `json:",omitempty"`
+	Tcp             *msg.TcpOptions `json:",omitempty"`
+	Transport       string          `json:",omitempty"`
+	Knock           bool            `json:",omitempty"`
+	Psk             bool            `json:",omitempty"`
+	SignedURL       bool            `json:",omitempty"`
+	StatusPage      bool            `json:",omitempty"`
+	Cache           bool            `json:",omitempty"`
+	ByteCap         uint64          `json:",omitempty"`
+	Schedule        []string        `json:",omitempty"`
+	Timezone        string          `json:",omitempty"`
+	CreatedAt       time.Time
+	Streams         int64
+	BytesIn         uint64
+	BytesOut        uint64
+}
+
+func newTunnelInfo(t *Tunnel) tunnelInfo {
+	cfg := t.config()
+	return tunnelInfo{
+		Name:            t.name,
+		ClientID:        t.ctl.ClientID.String(),
+		Tenant:          t.ctl.tenant.name(),
+		Schema:          cfg.Public.Schema,
+		Public:          cfg.PublicAddr(),
+		Local:           cfg.LocalAddr(),
+		Labels:          cfg.Labels,
+		HttpHostRewrite: cfg.HttpHostRewrite,
+		HttpAuth:        cfg.HttpAuth != "",
+		AllowIPs:        cfg.AllowIPs,
+		DenyIPs:         cfg.DenyIPs,
+		RateLimit:       cfg.RateLimit,
+		RateBurst:       cfg.RateBurst,
+		Tcp:             cfg.Tcp,
+		Transport:       cfg.Transport,
+		Knock:           cfg.Knock != nil,
+		Psk:             cfg.Psk != "",
+		SignedURL:       cfg.UrlSecret != "",
+		StatusPage:      cfg.StatusToken != "",
+		Cache:           cfg.Cache,
+		ByteCap:         t.byteCap(),
+		Schedule:        cfg.Schedule,
+		Timezone:        cfg.Timezone,
+		CreatedAt:       t.createdAt,
+		Streams:         atomic.LoadInt64(&t.streams),
+		BytesIn:         atomic.LoadUint64(&t.bytesIn),
+		BytesOut:        atomic.LoadUint64(&t.bytesOut),
+	}
+}
+
+type tunnelListResp struct {
+	Total   int
+	Offset  int
+	Limit   int
+	Tunnels []tunnelInfo
+}
+
+func tunnelList(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		fmt.Fprintf(w, "method not allowed")
+		return
+	}
+	values := r.URL.Query()
+	filter, err := parseTunnelFilter(values)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, err.Error())
+		return
+	}
+	filter.Tenant = requestTenant(r)
+	offset, limit, err := parsePage(values)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, err.Error())
+		return
+	}
+	tunnels := queryTunnels(filter)
+	start, end := paginate(len(tunnels), offset, limit)
+	resp := tunnelListResp{Total: len(tunnels), Offset: offset, Limit: limit, Tunnels: []tunnelInfo{}}
+	for _, t := range tunnels[start:end] {
+		resp.Tunnels = append(resp.Tunnels, newTunnelInfo(t))
+	}
+	writeJson(w, http.StatusOK, resp)
+}
+
+// tunnelHandler serves /api/v1/tunnels/{name},tunnel names are only unique per client,
+// so client_id is required when several clients registered the same name
+func tunnelHandler(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/api/v1/tunnels/")
+	sign := strings.HasSuffix(name, "/sign")
+	name = strings.TrimSuffix(name, "/sign")
+	capture := strings.HasSuffix(name, "/capture")
+	name = strings.TrimSuffix(name, "/capture")
+	if name == "" || strings.Contains(name, "/") {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "tunnel not found")
+		return
+	}
+	if sign && r.Method != "POST" || !sign && !capture && r.Method != "GET" && r.Method != "PATCH" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		fmt.Fprintf(w, "method not allowed")
+		return
+	}
+	tunnels := findTunnels(name, r.URL.Query().Get("client_id"), requestTenant(r))
+	if len(tunnels) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "tunnel not found")
+		return
+	} else if len(tunnels) > 1 {
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprintf(w, "tunnel name is ambiguous,specify client_id")
+		return
+	}
+	if sign {
+		signTunnelURL(w, r, tunnels[0])
+		return
+	}
+	if capture {
+		tunnelCapture(w, r, tunnels[0])
+		return
+	}
+	if r.Method == "PATCH" {
+		var req tunnelSettingsReq
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "unmarshal req body failed")
+			return
+		}
+		err = updateTunnel(tunnels[0], req)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, err.Error())
+			return
+		}
+	}
+	writeJson(w, http.StatusOK, newTunnelInfo(tunnels[0]))
+}
+
+// signTunnelURL handles POST /api/v1/tunnels/{name}/sign?ttl=3600,
+// which returns a public url of the tunnel that works for ttl seconds
+func signTunnelURL(w http.ResponseWriter, r *http.Request, t *Tunnel) {
+	cfg := t.config()
+	if cfg.UrlSecret == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "url_secret of the tunnel is not set")
+		return
+	}
+	ttl := int64(3600)
+	if s := r.URL.Query().Get("ttl"); s != "" {
+		var err error
+		ttl, err = strconv.ParseInt(s, 10, 64)
+		if err != nil || ttl <= 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "ttl must be a positive integer")
+			return
+		}
+	}
+	expire := time.Now().Unix() + ttl
+	token := util.SignURL(cfg.UrlSecret, cfg.Public.Host, expire)
+	u := url.URL{Scheme: cfg.Public.Schema, Host: cfg.Public.Host, Path: "/", RawQuery: url.Values{util.SignedURLParam: []string{token}}.Encode()}
+	if !(cfg.Public.Schema == "http" && cfg.Public.Port == 80) && !(cfg.Public.Schema == "https" && cfg.Public.Port == 443) {
+		u.Host = fmt.Sprintf("%s:%d", cfg.Public.Host, cfg.Public.Port)
+	}
+	writeJson(w, http.StatusOK, map[string]interface{}{"URL": u.String(), "ExpiresAt": time.Unix(expire, 0)})
+}
+
+// tunnelSettingsReq is the body of PATCH /api/v1/tunnels/{name},
+// only the present fields are changed
+type tunnelSettingsReq struct {
+	HttpHostRewrite *string
+	Labels          *map[string]string
+	HttpAuth        *string
+	AllowIPs        *[]string
+	DenyIPs         *[]string
+	RateLimit       *float64
+	RateBurst       *int
+	Tcp             *msg.TcpOptions
+	ByteCap         *uint64
+	Schedule        *[]string
+	Timezone        *string
+	IdleTimeout     *int
+	MaxLifetime     *int
+}
+
+// updateTunnel changes the settings of a live tunnel and pushes the result to its client
+func updateTunnel(t *Tunnel, req tunnelSettingsReq) error {
+	c := t.ctl
+	c.tunnelLock.Lock()
+	defer c.tunnelLock.Unlock()
+	if t.isClosed {
+		return errors.New("tunnel closed")
+	}
+	cfg := t.config()
+	if req.HttpHostRewrite != nil {
+		cfg.HttpHostRewrite = *req.HttpHostRewrite
+	}
+	if req.Labels != nil {
+		cfg.Labels = *req.Labels
+	}
+	if req.HttpAuth != nil {
+		cfg.HttpAuth = *req.HttpAuth
+	}
+	if req.AllowIPs != nil {
+		cfg.AllowIPs = *req.AllowIPs
+	}
+	if req.DenyIPs != nil {
+		cfg.DenyIPs = *req.DenyIPs
+	}
+	if req.RateLimit != nil {
+		cfg.RateLimit = *req.RateLimit
+	}
+	if req.ByteCap != nil {
+		cfg.ByteCap = *req.ByteCap
+	}
+	if req.Schedule != nil {
+		cfg.Schedule = *req.Schedule
+	}
+	if req.Timezone != nil {
+		cfg.Timezone = *req.Timezone
+	}
+	if req.RateBurst != nil {
+		cfg.RateBurst = *req.RateBurst
+	}
+	if req.Tcp != nil {
+		cfg.Tcp = req.Tcp
+	}
+	if req.IdleTimeout != nil {
+		cfg.IdleTimeout = *req.IdleTimeout
+	}
+	if req.MaxLifetime != nil {
+		cfg.MaxLifetime = *req.MaxLifetime
+	}
+	err := t.applyConfig(cfg)
+	if err != nil {
+		return err
+	}
+	manageLog.WithFields(log.Fields{"tunnel": t.name, "client_id": c.ClientID.String()}).Infoln("tunnel settings updated")
+	select {
+	case c.writeChan <- writeReq{msg.TypeAddTunnels, msg.AddTunnels{Tunnels: map[string]msg.Tunnel{t.name: t.config()}}}:
+	default:
+		manageLog.WithFields(log.Fields{"tunnel": t.name, "client_id": c.ClientID.String()}).Warningln("sync tunnel settings to client failed!")
+	}
+	c.notify("policy", fmt.Sprintf("settings of tunnel %s updated by administrator", t.name))
+	return nil
+}
+
+func findTunnels(name string, clientId string, tenant *Tenant) []*Tunnel {
+	var tunnels []*Tunnel
+	TunnelMapLock.RLock()
+	for _, v := range TunnelMap {
+		if v.name == name && (clientId == "" || v.ctl.ClientID.String() == clientId) && (tenant == nil || v.ctl.tenant == tenant) {
+			tunnels = append(tunnels, v)
+		}
+	}
+	TunnelMapLock.RUnlock()
+	sort.Sort(tunnelsByAddr(tunnels))
+	return tunnels
+}
+
+type clientInfo struct {
+	ClientID       string
+	Tenant         string `json:",omitempty"`
+	RemoteAddr     string
+	Transport      string
+	EncryptMode    string
+	AesKeyId       string `json:",omitempty"`
+	EnableCompress bool
+	Maintenance    bool `json:",omitempty"`
+	Version        string
+	ConnectedAt    time.Time
+	LastHeartbeat  time.Time
+	Pipes          int64
+	Streams        int64
+	BytesIn        uint64
+	BytesOut       uint64
+	Tunnels        []tunnelInfo
+	//smux stats of every pipe,only in the detail of a client
+	PipeStats []pipeInfo `json:",omitempty"`
+}
+
+func newClientInfo(c *Control) clientInfo {
+	info := clientInfo{
+		ClientID:       c.ClientID.String(),
+		Tenant:         c.tenant.name(),
+		RemoteAddr:     c.remoteAddr,
+		Transport:      c.transportMode,
+		EncryptMode:    c.encryptMode,
+		AesKeyId:       c.aesKeyId,
+		EnableCompress: c.enableCompress,
+		Version:        c.version,
+		ConnectedAt:    c.connectedAt,
+		LastHeartbeat:  time.Unix(0, int64(atomic.LoadUint64(&c.lastRead))),
+		Pipes:          atomic.LoadInt64(&c.totalPipes),
+		Streams:        atomic.LoadInt64(&c.streams),
+		BytesIn:        atomic.LoadUint64(&c.bytesIn),
+		BytesOut:       atomic.LoadUint64(&c.bytesOut),
+		Tunnels:        []tunnelInfo{},
+	}
+	info.Maintenance, _ = c.maintenancePage()
+	var tunnels []*Tunnel
+	c.tunnelLock.Lock()
+	for _, t := range c.tunnels {
+		if !t.isClosed {
+			tunnels = append(tunnels, t)
+		}
+	}
+	c.tunnelLock.Unlock()
+	sort.Sort(tunnelsByAddr(tunnels))
+	for _, t := range tunnels {
+		info.Tunnels = append(info.Tunnels, newTunnelInfo(t))
+	}
+	return info
+}
+
+// liveControl returns the connected control of clientId,or nil if it is offline
+func liveControl(clientId string) *Control {
+	id, err := uuid.FromString(clientId)
+	if err != nil {
+		return nil
+	}
+	ControlMapLock.RLock()
+	c, isok := ControlMap[id]
+	ControlMapLock.RUnlock()
+	if !isok || c.IsClosed() {
+		return nil
+	}
+	return c
+}
+
+type controlsByID []*Control
+
+func (c controlsByID) Len() int           { return len(c) }
+func (c controlsByID) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
+func (c controlsByID) Less(i, j int) bool { return c[i].ClientID.String() < c[j].ClientID.String() }
+
+type clientListResp struct {
+	Total   int
+	Offset  int
+	Limit   int
+	Clients []clientInfo
+}
+
+func clientList(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		fmt.Fprintf(w, "method not allowed")
+		return
+	}
+	offset, limit, err := parsePage(r.URL.Query())
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, err.Error())
+		return
+	}
+	var controls []*Control
+	ControlMapLock.RLock()
+	for _, c := range ControlMap {
+		if !c.IsClosed() && visible(r, c) {
+			controls = append(controls, c)
+		}
+	}
+	ControlMapLock.RUnlock()
+	sort.Sort(controlsByID(controls))
+	start, end := paginate(len(controls), offset, limit)
+	resp := clientListResp{Total: len(controls), Offset: offset, Limit: limit, Clients: []clientInfo{}}
+	for _, c := range controls[start:end] {
+		resp.Clients = append(resp.Clients, newClientInfo(c))
+	}
+	writeJson(w, http.StatusOK, resp)
+}
+
+// clientHandler serves /api/v1/clients/{id}
+func clientHandler(w http.ResponseWriter, r *http.Request) {
+	clientId := strings.TrimPrefix(r.URL.Path, "/api/v1/clients/")
+	ctl := liveControl(clientId)
+	if ctl == nil || !visible(r, ctl) {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "client not found")
+		return
+	}
+	switch r.Method {
+	case "GET":
+		info := newClientInfo(ctl)
+		info.PipeStats = ctl.pipeInfos()
+		writeJson(w, http.StatusOK, info)
+	case "DELETE":
+		reason, err := kickReason(r)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, err.Error())
+			return
+		}
+		ctl.Kick(reason)
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("ok"))
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		fmt.Fprintf(w, "method not allowed")
+	}
+}
+
+const maxKickReasonLength = 1024
+
+type kickReq struct {
+	Reason string
+}
+
+// kickReason reads the optional reason from the reason query parameter or the json body
+func kickReason(r *http.Request) (string, error) {
+	reason := r.URL.Query().Get("reason")
+	content, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return "", errors.Wrap(err, "read req body")
+	}
+	r.Body.Close()
+	if len(content) > 0 {
+		var req kickReq
+		err = json.Unmarshal(content, &req)
+		if err != nil {
+			return "", errors.New("unmarshal req body failed")
+		}
+		if req.Reason != "" {
+			reason = req.Reason
+		}
+	}
+	if len(reason) > maxKickReasonLength {
+		return "", errors.Errorf("reason out of length limit(%d)", maxKickReasonLength)
+	}
+	if reason == "" {
+		reason = "kicked by administrator"
+	}
+	return reason, nil
+}
@@ -0,0 +1,280 @@
+// Copyright 2017 longXboy, longxboyhi@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/longXboy/lunnel/msg"
+	"github.com/longXboy/lunnel/transport/kcp"
+)
+
+// serverMetrics are the global counters of server,they only increase
+var serverMetrics struct {
+	connections     uint64
+	handshakes      uint64
+	handshakeErrors uint64
+	errors          uint64
+	bytesIn         uint64
+	bytesOut        uint64
+	//public connections refused since the client was out of streams or pipes
+	streamsRejected uint64
+	//public connections refused since their tunnel had max_conns connections
+	connsRejected uint64
+	//proxied connections closed since a write was blocked for write_timeout
+	stalls uint64
+}
+
+type metricSnapshot struct {
+	Clients         int64
+	Tunnels         int64
+	Streams         int64
+	Connections     uint64
+	Handshakes      uint64
+	HandshakeErrors uint64
+	Errors          uint64
+	BytesIn         uint64
+	BytesOut        uint64
+	StreamsRejected uint64
+	ConnsRejected   uint64
+	Stalls          uint64
+	CacheHits       uint64
+	CacheMisses     uint64
+	CacheBytes      int64
+	CacheEntries    int
+}
+
+func snapshotMetrics() metricSnapshot {
+	var s metricSnapshot
+	ControlMapLock.RLock()
+	for _, c := range ControlMap {
+		if !c.IsClosed() {
+			s.Clients++
+			s.Streams += atomic.LoadInt64(&c.streams)
+		}
+	}
+	ControlMapLock.RUnlock()
+	TunnelMapLock.RLock()
+	s.Tunnels = int64(len(TunnelMap))
+	TunnelMapLock.RUnlock()
+	s.Connections = atomic.LoadUint64(&serverMetrics.connections)
+	s.Handshakes = atomic.LoadUint64(&serverMetrics.handshakes)
+	s.HandshakeErrors = atomic.LoadUint64(&serverMetrics.handshakeErrors)
+	s.Errors = atomic.LoadUint64(&serverMetrics.errors)
+	s.BytesIn = atomic.LoadUint64(&serverMetrics.bytesIn)
+	s.BytesOut = atomic.LoadUint64(&serverMetrics.bytesOut)
+	s.StreamsRejected = atomic.LoadUint64(&serverMetrics.streamsRejected)
+	s.ConnsRejected = atomic.LoadUint64(&serverMetrics.connsRejected)
+	s.Stalls = atomic.LoadUint64(&serverMetrics.stalls)
+	s.CacheHits = atomic.LoadUint64(&edgeCache.hits)
+	s.CacheMisses = atomic.LoadUint64(&edgeCache.misses)
+	s.CacheBytes, s.CacheEntries = edgeCache.stats()
+	return s
+}
+
+type tunnelConnGauge struct {
+	clientId string
+	tunnel   string
+	conns    int64
+}
+
+// tunnelConnGauges returns the live proxied connections of every tunnel
+func tunnelConnGauges() []tunnelConnGauge {
+	var gauges []tunnelConnGauge
+	ControlMapLock.RLock()
+	for _, c := range ControlMap {
+		if c.IsClosed() {
+			continue
+		}
+		c.tunnelLock.Lock()
+		for name, t := range c.tunnels {
+			gauges = append(gauges, tunnelConnGauge{clientId: c.ClientID.String(), tunnel: name, conns: atomic.LoadInt64(&t.streams)})
+		}
+		c.tunnelLock.Unlock()
+	}
+	ControlMapLock.RUnlock()
+	return gauges
+}
+
+type tunnelHttpStats struct {
+	clientId      string
+	tunnel        string
+	statuses      [6]uint64
+	buckets       [len(latencyBuckets)]uint64
+	durationSum   time.Duration
+	durationCount uint64
+}
+
+// tunnelHttpMetrics returns the response statuses and durations of every http tunnel
+func tunnelHttpMetrics() []tunnelHttpStats {
+	var stats []tunnelHttpStats
+	ControlMapLock.RLock()
+	for _, c := range ControlMap {
+		if c.IsClosed() {
+			continue
+		}
+		c.tunnelLock.Lock()
+		for name, t := range c.tunnels {
+			if schema := t.config().Public.Schema; schema != "http" && schema != "https" {
+				continue
+			}
+			st := tunnelHttpStats{clientId: c.ClientID.String(), tunnel: name}
+			t.stats.lock.Lock()
+			st.statuses = t.stats.statuses
+			st.buckets = t.stats.buckets
+			st.durationSum = t.stats.durationSum
+			st.durationCount = t.stats.durationCount
+			t.stats.lock.Unlock()
+			stats = append(stats, st)
+		}
+		c.tunnelLock.Unlock()
+	}
+	ControlMapLock.RUnlock()
+	return stats
+}
+
+var statusClasses = [6]string{"unknown", "1xx", "2xx", "3xx", "4xx", "5xx"}
+
+// writeHttpMetrics writes the responses by status class and the histogram of the time to response header
+func writeHttpMetrics(w io.Writer) {
+	stats := tunnelHttpMetrics()
+	fmt.Fprintf(w, "# TYPE lunnel_http_responses_total counter\n")
+	for _, st := range stats {
+		for class, n := range st.statuses {
+			fmt.Fprintf(w, "lunnel_http_responses_total{client_id=%q,tunnel=%q,class=%q} %d\n", st.clientId, st.tunnel, statusClasses[class], n)
+		}
+	}
+	fmt.Fprintf(w, "# TYPE lunnel_http_request_duration_seconds histogram\n")
+	for _, st := range stats {
+		var cumulative uint64
+		for i, le := range latencyBuckets {
+			cumulative += st.buckets[i]
+			fmt.Fprintf(w, "lunnel_http_request_duration_seconds_bucket{client_id=%q,tunnel=%q,le=\"%g\"} %d\n", st.clientId, st.tunnel, le, cumulative)
+		}
+		fmt.Fprintf(w, "lunnel_http_request_duration_seconds_bucket{client_id=%q,tunnel=%q,le=\"+Inf\"} %d\n", st.clientId, st.tunnel, st.durationCount)
+		fmt.Fprintf(w, "lunnel_http_request_duration_seconds_sum{client_id=%q,tunnel=%q} %g\n", st.clientId, st.tunnel, st.durationSum.Seconds())
+		fmt.Fprintf(w, "lunnel_http_request_duration_seconds_count{client_id=%q,tunnel=%q} %d\n", st.clientId, st.tunnel, st.durationCount)
+	}
+}
+
+// setDialStats keeps the dial stats of the tunnels the client has
+func (c *Control) setDialStats(stats *msg.DialStats) {
+	kept := make(map[string]msg.DialStat, len(stats.Tunnels))
+	c.tunnelLock.Lock()
+	for name, st := range stats.Tunnels {
+		if _, isok := c.tunnels[name]; isok {
+			kept[name] = st
+		}
+	}
+	c.tunnelLock.Unlock()
+	c.dialStatsLock.Lock()
+	c.dialStats = kept
+	c.dialStatsLock.Unlock()
+}
+
+// writeDialMetrics writes the histogram of how long the clients take to dial the local address of each tunnel
+func writeDialMetrics(w io.Writer) {
+	fmt.Fprintf(w, "# TYPE lunnel_local_dial_seconds histogram\n")
+	type dialStat struct {
+		clientId string
+		tunnel   string
+		msg.DialStat
+	}
+	var stats []dialStat
+	ControlMapLock.RLock()
+	for _, c := range ControlMap {
+		if c.IsClosed() {
+			continue
+		}
+		c.dialStatsLock.Lock()
+		for name, st := range c.dialStats {
+			stats = append(stats, dialStat{clientId: c.ClientID.String(), tunnel: name, DialStat: st})
+		}
+		c.dialStatsLock.Unlock()
+	}
+	ControlMapLock.RUnlock()
+	for _, st := range stats {
+		var cumulative uint64
+		for i, le := range msg.DialBuckets {
+			cumulative += st.Buckets[i]
+			fmt.Fprintf(w, "lunnel_local_dial_seconds_bucket{client_id=%q,tunnel=%q,le=\"%g\"} %d\n", st.clientId, st.tunnel, le, cumulative)
+		}
+		fmt.Fprintf(w, "lunnel_local_dial_seconds_bucket{client_id=%q,tunnel=%q,le=\"+Inf\"} %d\n", st.clientId, st.tunnel, st.Count)
+		fmt.Fprintf(w, "lunnel_local_dial_seconds_sum{client_id=%q,tunnel=%q} %g\n", st.clientId, st.tunnel, st.Sum)
+		fmt.Fprintf(w, "lunnel_local_dial_seconds_count{client_id=%q,tunnel=%q} %d\n", st.clientId, st.tunnel, st.Count)
+	}
+	fmt.Fprintf(w, "# TYPE lunnel_local_dial_failures_total counter\n")
+	for _, st := range stats {
+		fmt.Fprintf(w, "lunnel_local_dial_failures_total{client_id=%q,tunnel=%q} %d\n", st.clientId, st.tunnel, st.Failures)
+	}
+}
+
+// metricsHandler serves the snapshot in prometheus text format,
+// which covers the clients of every tenant so tenant tokens are refused
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	if requestTenant(r) != nil {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprintf(w, "permission denied")
+		return
+	}
+	s := snapshotMetrics()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprintf(w, "# TYPE lunnel_clients gauge\nlunnel_clients %d\n", s.Clients)
+	fmt.Fprintf(w, "# TYPE lunnel_tunnels gauge\nlunnel_tunnels %d\n", s.Tunnels)
+	fmt.Fprintf(w, "# TYPE lunnel_streams gauge\nlunnel_streams %d\n", s.Streams)
+	fmt.Fprintf(w, "# TYPE lunnel_connections_total counter\nlunnel_connections_total %d\n", s.Connections)
+	fmt.Fprintf(w, "# TYPE lunnel_handshakes_total counter\nlunnel_handshakes_total %d\n", s.Handshakes)
+	fmt.Fprintf(w, "# TYPE lunnel_handshake_errors_total counter\nlunnel_handshake_errors_total %d\n", s.HandshakeErrors)
+	fmt.Fprintf(w, "# TYPE lunnel_errors_total counter\nlunnel_errors_total %d\n", s.Errors)
+	fmt.Fprintf(w, "# TYPE lunnel_bytes_in_total counter\nlunnel_bytes_in_total %d\n", s.BytesIn)
+	fmt.Fprintf(w, "# TYPE lunnel_bytes_out_total counter\nlunnel_bytes_out_total %d\n", s.BytesOut)
+	fmt.Fprintf(w, "# TYPE lunnel_streams_rejected_total counter\nlunnel_streams_rejected_total %d\n", s.StreamsRejected)
+	fmt.Fprintf(w, "# TYPE lunnel_conns_rejected_total counter\nlunnel_conns_rejected_total %d\n", s.ConnsRejected)
+	fmt.Fprintf(w, "# TYPE lunnel_stalled_conns_total counter\nlunnel_stalled_conns_total %d\n", s.Stalls)
+	fmt.Fprintf(w, "# TYPE lunnel_tunnel_connections gauge\n")
+	for _, g := range tunnelConnGauges() {
+		fmt.Fprintf(w, "lunnel_tunnel_connections{client_id=%q,tunnel=%q} %d\n", g.clientId, g.tunnel, g.conns)
+	}
+	writeHttpMetrics(w)
+	writeDialMetrics(w)
+	writeOverloadMetrics(w)
+	writeCertMetrics(w)
+	fmt.Fprintf(w, "# TYPE lunnel_accept_errors_total counter\nlunnel_accept_errors_total %d\n", atomic.LoadUint64(&acceptErrors))
+	fmt.Fprintf(w, "# TYPE lunnel_relaying_conns gauge\nlunnel_relaying_conns %d\n", atomic.LoadInt64(&relaying))
+	fmt.Fprintf(w, "# TYPE lunnel_relay_refused_total counter\nlunnel_relay_refused_total %d\n", atomic.LoadUint64(&relayRefused))
+	fmt.Fprintf(w, "# TYPE lunnel_kcp_conns_total counter\n")
+	for _, c := range kcp.MtuCounts() {
+		fmt.Fprintf(w, "lunnel_kcp_conns_total{mtu=\"%d\"} %d\n", c.Mtu, c.Conns)
+	}
+	fmt.Fprintf(w, "# TYPE lunnel_cache_hits_total counter\nlunnel_cache_hits_total %d\n", s.CacheHits)
+	fmt.Fprintf(w, "# TYPE lunnel_cache_misses_total counter\nlunnel_cache_misses_total %d\n", s.CacheMisses)
+	fmt.Fprintf(w, "# TYPE lunnel_cache_bytes gauge\nlunnel_cache_bytes %d\n", s.CacheBytes)
+	fmt.Fprintf(w, "# TYPE lunnel_cache_entries gauge\nlunnel_cache_entries %d\n", s.CacheEntries)
+	p := snapshotPipeMetrics()
+	fmt.Fprintf(w, "# TYPE lunnel_pipes gauge\nlunnel_pipes %d\n", p.Pipes)
+	fmt.Fprintf(w, "# TYPE lunnel_pipes_saturated gauge\nlunnel_pipes_saturated %d\n", p.SaturatedPipes)
+	fmt.Fprintf(w, "# TYPE lunnel_pipe_buffered_bytes gauge\nlunnel_pipe_buffered_bytes %d\n", p.BufferedBytes)
+	fmt.Fprintf(w, "# TYPE lunnel_pipe_max_streams gauge\nlunnel_pipe_max_streams %d\n", maxStreams)
+	// summed over the live pipes,so they drop when pipes are closed
+	fmt.Fprintf(w, "# TYPE lunnel_pipe_receive_stalls gauge\nlunnel_pipe_receive_stalls %d\n", p.Stalls)
+	fmt.Fprintf(w, "# TYPE lunnel_pipe_keepalives_sent gauge\nlunnel_pipe_keepalives_sent %d\n", p.KeepalivesSent)
+	fmt.Fprintf(w, "# TYPE lunnel_pipe_keepalives_received gauge\nlunnel_pipe_keepalives_received %d\n", p.KeepalivesRecv)
+	fmt.Fprintf(w, "# TYPE lunnel_kcp_retrans_segs_total counter\nlunnel_kcp_retrans_segs_total %d\n", p.KcpRetransSegs)
+	fmt.Fprintf(w, "# TYPE lunnel_kcp_lost_segs_total counter\nlunnel_kcp_lost_segs_total %d\n", p.KcpLostSegs)
+}
@@ -0,0 +1,157 @@
+// Copyright 2017 longXboy, longxboyhi@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/longXboy/lunnel/log"
+	"github.com/longXboy/lunnel/transport"
+	"github.com/pkg/errors"
+)
+
+// maxMuxHeader is the longest routing line accepted on the tcp mux port,
+// the PROXY protocol v1 header is at most 107 bytes
+const maxMuxHeader = 256
+
+// bufferedConn reads the bytes buffered while routing before the rest of conn
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (bc *bufferedConn) NetConn() net.Conn {
+	return bc.Conn
+}
+
+func (bc *bufferedConn) Read(p []byte) (int, error) {
+	return bc.r.Read(p)
+}
+
+func readMuxLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadSlice('\n')
+	if err != nil {
+		if err == bufio.ErrBufferFull {
+			return "", errors.New("routing header too long")
+		}
+		return "", err
+	}
+	return strings.TrimRight(string(line), "\r\n"), nil
+}
+
+// parseProxyHeader parses a PROXY protocol v1 header into the source address
+// of the user and the destination port the upstream load balancer accepted on
+func parseProxyHeader(line string) (net.Addr, uint16, error) {
+	fields := strings.Fields(line)
+	if len(fields) != 6 || fields[0] != "PROXY" || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, 0, errors.Errorf("invalid proxy header(%s)", line)
+	}
+	srcIP := net.ParseIP(fields[2])
+	if srcIP == nil {
+		return nil, 0, errors.Errorf("invalid proxy source ip(%s)", fields[2])
+	}
+	srcPort, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "parse proxy source port")
+	}
+	dstPort, err := strconv.ParseUint(fields[5], 10, 16)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "parse proxy destination port")
+	}
+	return &net.TCPAddr{IP: srcIP, Port: int(srcPort)}, uint16(dstPort), nil
+}
+
+// routeMuxConn reads the routing header of conn and returns the key of the tunnel
+// and the address the access rules should be checked against
+func routeMuxConn(r *bufio.Reader, conn net.Conn) (string, net.Addr, error) {
+	line, err := readMuxLine(r)
+	if err != nil {
+		return "", nil, err
+	}
+	if serverConf.TcpMux.ProxyProtocol {
+		srcAddr, dstPort, err := parseProxyHeader(line)
+		if err != nil {
+			return "", nil, err
+		}
+		return strconv.Itoa(int(dstPort)), srcAddr, nil
+	}
+	if !strings.HasPrefix(line, serverConf.TcpMux.Prefix) {
+		return "", nil, errors.New("routing prefix mismatch")
+	}
+	return strings.TrimPrefix(line, serverConf.TcpMux.Prefix), conn.RemoteAddr(), nil
+}
+
+func handleMuxConn(conn net.Conn) {
+	conn.SetDeadline(time.Now().Add(time.Second * 20))
+	r := bufio.NewReaderSize(conn, maxMuxHeader)
+	key, addr, err := routeMuxConn(r, conn)
+	if err != nil {
+		vhostLog.WithFields(log.Fields{"err": err, "remote_addr": conn.RemoteAddr().String()}).Debugln("route tcp mux conn failed!")
+		conn.Close()
+		return
+	}
+	TunnelMapLock.RLock()
+	tunnel, isok := TunnelMap[fmt.Sprintf("tcpmux://%s:%d", key, serverConf.TcpMux.Port)]
+	TunnelMapLock.RUnlock()
+	if !isok {
+		vhostLog.WithFields(log.Fields{"key": key, "remote_addr": conn.RemoteAddr().String()}).Debugln("tcp mux tunnel not found")
+		conn.Close()
+		return
+	}
+	if tunnel.checkAccessAddr(addr) != accessAllowed {
+		vhostLog.WithFields(log.Fields{"remote_addr": addr.String(), "tunnel": tunnel.name}).Debugln("connection denied by ip rules or rate limit")
+		conn.Close()
+		return
+	}
+	err = transport.ApplyTcpOptions(conn, tunnel.config().Tcp)
+	if err != nil {
+		vhostLog.WithFields(log.Fields{"err": err, "tunnel": tunnel.name}).Warningln("apply tcp options failed!")
+	}
+	pconn, err := tunnel.readPreamble(conn, r)
+	if err != nil {
+		vhostLog.WithFields(log.Fields{"remote_addr": addr.String(), "tunnel": tunnel.name, "err": err}).Debugln("connection denied by preamble")
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	proxyConn(pconn, tunnel)
+}
+
+func serveTcpMux(addr string) {
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		vhostLog.WithFields(log.Fields{"addr": addr, "err": err}).Fatalln("listen tcp mux failed!")
+	}
+	vhostLog.WithFields(log.Fields{"addr": addr, "proxy_protocol": serverConf.TcpMux.ProxyProtocol}).Infoln("listen tcp mux")
+	listening.Done()
+	var backoff acceptBackoff
+	for {
+		conn, err := lis.Accept()
+		if err != nil {
+			vhostLog.WithFields(log.Fields{"err": err}).Errorln("accept tcp mux conn failed!")
+			if !backoff.wait(err) {
+				return
+			}
+			continue
+		}
+		backoff.reset()
+		go handleMuxConn(conn)
+	}
+}
@@ -0,0 +1,112 @@
+// Copyright 2017 longXboy, longxboyhi@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/longXboy/lunnel/log"
+	"github.com/longXboy/lunnel/msg"
+)
+
+const (
+	maxNoticeKindLength    = 64
+	maxNoticeMessageLength = 1024
+)
+
+type noticeReq struct {
+	//empty to broadcast to all the clients visible to the caller
+	ClientID string
+	Kind     string
+	Message  string
+}
+
+type noticeResp struct {
+	Sent int
+}
+
+// notify sends a notice to the client without blocking,
+// it reports false if the write queue of control is full
+func (c *Control) notify(kind string, message string) bool {
+	select {
+	case c.writeChan <- writeReq{msg.TypeNotice, msg.Notice{Kind: kind, Message: message, Time: time.Now()}}:
+		return true
+	default:
+		log.WithFields(log.Fields{"client_id": c.ClientID.String(), "kind": kind}).Warningln("send notice to client failed!")
+		return false
+	}
+}
+
+// noticeHandler serves /api/v1/notices,it sends the notice to the client
+// of ClientID or broadcasts it if ClientID is empty
+func noticeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		fmt.Fprintf(w, "method not allowed")
+		return
+	}
+	content, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "read req body failed")
+		return
+	}
+	r.Body.Close()
+	var req noticeReq
+	err = json.Unmarshal(content, &req)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "unmarshal req body failed")
+		return
+	}
+	if req.Kind == "" {
+		req.Kind = "info"
+	}
+	if len(req.Kind) > maxNoticeKindLength || len(req.Message) > maxNoticeMessageLength {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "kind or message out of length limit(%d,%d)", maxNoticeKindLength, maxNoticeMessageLength)
+		return
+	}
+	var controls []*Control
+	if req.ClientID != "" {
+		ctl := liveControl(req.ClientID)
+		if ctl == nil || !visible(r, ctl) {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintf(w, "client not found")
+			return
+		}
+		controls = append(controls, ctl)
+	} else {
+		ControlMapLock.RLock()
+		for _, c := range ControlMap {
+			if !c.IsClosed() && visible(r, c) {
+				controls = append(controls, c)
+			}
+		}
+		ControlMapLock.RUnlock()
+	}
+	var resp noticeResp
+	for _, c := range controls {
+		if c.notify(req.Kind, req.Message) {
+			resp.Sent++
+		}
+	}
+	log.WithFields(log.Fields{"kind": req.Kind, "client_id": req.ClientID, "sent": resp.Sent}).Infoln("notice sent")
+	writeJson(w, http.StatusOK, resp)
+}
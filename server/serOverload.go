@@ -0,0 +1,160 @@
+// Copyright 2017 longXboy, longxboyhi@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"io"
+	"runtime/metrics"
+	"sync/atomic"
+	"time"
+
+	"github.com/longXboy/lunnel/log"
+	"github.com/longXboy/lunnel/util"
+	"github.com/pkg/errors"
+)
+
+// Overload refuses the public connections of tunnels by their qos class as server nears its limit
+// of file descriptors or memory,the bulk ones first.the controls,pipes and their heartbeats are never refused
+type Overload struct {
+	//bytes of memory server should stay under,0 watches the file descriptors only
+	MaxMemory uint64 `yaml:"max_memory,omitempty"`
+	//percent of the nearest limit in use the public connections of bulk,normal and high tunnels are refused at,
+	//default to 80,90 and 97.a percent over 100 never refuses
+	Bulk   int `yaml:"bulk,omitempty"`
+	Normal int `yaml:"normal,omitempty"`
+	High   int `yaml:"high,omitempty"`
+	//percent of the open files limit in use a warning is logged at every minute,default to 70
+	Warn int `yaml:"warn,omitempty"`
+}
+
+func (o *Overload) normalize() error {
+	if o.Bulk == 0 {
+		o.Bulk = 80
+	}
+	if o.Normal == 0 {
+		o.Normal = 90
+	}
+	if o.High == 0 {
+		o.High = 97
+	}
+	if o.Warn == 0 {
+		o.Warn = 70
+	}
+	if o.Bulk < 0 || o.Normal < 0 || o.High < 0 || o.Warn < 0 {
+		return errors.New("percents can not be negative")
+	}
+	if o.Bulk > o.Normal || o.Normal > o.High {
+		return errors.New("bulk tunnels must be refused no later than normal ones,and normal ones than high ones")
+	}
+	return nil
+}
+
+// overloadInterval is how often the usage of the limits is sampled
+const overloadInterval = time.Second
+
+var overload struct {
+	//percent of the nearest limit in use
+	usage int32
+	//qos classes the public connections are refused of,counted from bulk up
+	refusing   int32
+	openFiles  int64
+	filesLimit int64
+	memory     uint64
+	refused    [qosClasses]uint64
+}
+
+// refusing returns how many qos classes the public connections are refused of at usage percent,
+// counted from bulk up
+func (o *Overload) refusing(usage int32) int32 {
+	switch {
+	case usage >= int32(o.High):
+		return 3
+	case usage >= int32(o.Normal):
+		return 2
+	case usage >= int32(o.Bulk):
+		return 1
+	}
+	return 0
+}
+
+var memorySamples = []metrics.Sample{{Name: "/memory/classes/total:bytes"}, {Name: "/memory/classes/heap/released:bytes"}}
+
+// sampleOverload measures the usage of the limits and refuses more or fewer qos classes by it
+func sampleOverload() {
+	var usage int32
+	open, limit, err := util.OpenFiles()
+	if err == nil && limit > 0 {
+		atomic.StoreInt64(&overload.openFiles, int64(open))
+		atomic.StoreInt64(&overload.filesLimit, int64(limit))
+		usage = int32(int64(open) * 100 / int64(limit))
+		warnOpenFiles(open, limit, usage)
+	}
+	metrics.Read(memorySamples)
+	memory := memorySamples[0].Value.Uint64() - memorySamples[1].Value.Uint64()
+	atomic.StoreUint64(&overload.memory, memory)
+	if max := serverConf.Overload.MaxMemory; max > 0 {
+		if m := int32(memory * 100 / max); m > usage {
+			usage = m
+		}
+	}
+	atomic.StoreInt32(&overload.usage, usage)
+	refusing := serverConf.Overload.refusing(usage)
+	old := atomic.SwapInt32(&overload.refusing, refusing)
+	if refusing == old {
+		return
+	}
+	fields := log.Fields{"usage": usage, "open_files": open, "files_limit": limit, "memory": memory, "max_memory": serverConf.Overload.MaxMemory}
+	if refusing == 0 {
+		vhostLog.WithFields(fields).Warningln("server recovered from overload,public connections accepted again")
+		recordEvent("server_recovered", nil, "", fmt.Sprintf("%d%% of limits in use", usage))
+		return
+	}
+	lowest := qosClassNames[qosClasses-refusing]
+	fields["refused_from"] = lowest
+	vhostLog.WithFields(fields).Warningln("server overloaded,public connections of lower qos refused")
+	recordEvent("server_overloaded", nil, "", fmt.Sprintf("%d%% of limits in use,tunnels of qos %s and below refused", usage, lowest))
+}
+
+func runOverloadWatch() {
+	ticker := time.NewTicker(overloadInterval)
+	defer ticker.Stop()
+	for {
+		sampleOverload()
+		<-ticker.C
+	}
+}
+
+func writeOverloadMetrics(w io.Writer) {
+	fmt.Fprintf(w, "# TYPE lunnel_open_files gauge\nlunnel_open_files %d\n", atomic.LoadInt64(&overload.openFiles))
+	fmt.Fprintf(w, "# TYPE lunnel_open_files_limit gauge\nlunnel_open_files_limit %d\n", atomic.LoadInt64(&overload.filesLimit))
+	fmt.Fprintf(w, "# TYPE lunnel_memory_bytes gauge\nlunnel_memory_bytes %d\n", atomic.LoadUint64(&overload.memory))
+	fmt.Fprintf(w, "# TYPE lunnel_overload_usage_percent gauge\nlunnel_overload_usage_percent %d\n", atomic.LoadInt32(&overload.usage))
+	fmt.Fprintf(w, "# TYPE lunnel_overload_refusing_classes gauge\nlunnel_overload_refusing_classes %d\n", atomic.LoadInt32(&overload.refusing))
+	fmt.Fprintf(w, "# TYPE lunnel_overload_refused_total counter\n")
+	for class, name := range qosClassNames {
+		fmt.Fprintf(w, "lunnel_overload_refused_total{qos=%q} %d\n", name, atomic.LoadUint64(&overload.refused[class]))
+	}
+}
+
+// overloaded reports whether the public connections of t are refused for overload,counting the refused one
+func (t *Tunnel) overloaded() bool {
+	class := t.qosClass()
+	if int32(class) < qosClasses-atomic.LoadInt32(&overload.refusing) {
+		return false
+	}
+	atomic.AddUint64(&overload.refused[class], 1)
+	return true
+}
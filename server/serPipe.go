@@ -0,0 +1,423 @@
+// Copyright 2017 longXboy, longxboyhi@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/longXboy/lunnel/crypto"
+	"github.com/longXboy/lunnel/log"
+	"github.com/longXboy/lunnel/msg"
+	"github.com/longXboy/smux"
+	"github.com/pkg/errors"
+)
+
+// pipePool keeps the pipes of a control which are created over one transport
+type pipePool struct {
+	ctl *Control
+	// transport is empty for the transport which the control connected with
+	transport string
+	// options is nil for the pipes encrypted and compressed like the control
+	options *msg.PipeOptions
+
+	busyPipes *pipeNode
+	idleCount uint64
+	idlePipes *pipeNode
+	pipeAdd   chan *smux.Session
+	pipeGet   chan *smux.Session
+	//consumers blocked in getPipe
+	waiting int64
+}
+
+func newPipePool(ctl *Control, transport string, options *msg.PipeOptions) *pipePool {
+	return &pipePool{
+		ctl:       ctl,
+		transport: transport,
+		options:   options,
+		pipeAdd:   make(chan *smux.Session),
+		pipeGet:   make(chan *smux.Session),
+	}
+}
+
+// pool returns the pipe pool of transport and options,it is created and managed on first use
+func (c *Control) pool(transport string, options *msg.PipeOptions) *pipePool {
+	key, transport, options := c.poolKey(transport, options)
+	c.poolLock.Lock()
+	defer c.poolLock.Unlock()
+	pool, isok := c.pools[key]
+	if !isok {
+		pool = newPipePool(c, transport, options)
+		c.pools[key] = pool
+		go pool.pipeManage()
+	}
+	return pool
+}
+
+// poolKey returns the key of the pool of the pipes made over transport as options asks,
+// with transport and options normalized so that the pools of the same pipes are shared
+func (c *Control) poolKey(transport string, options *msg.PipeOptions) (string, string, *msg.PipeOptions) {
+	if transport == "" {
+		transport = c.pipeTransport
+	}
+	if transport == c.transportMode {
+		transport = ""
+	}
+	key := transport
+	encrypt, compress := options.Resolve(c.encryptMode != "none", c.enableCompress)
+	if encrypt != (c.encryptMode != "none") || compress != c.enableCompress {
+		options = &msg.PipeOptions{Encrypt: &encrypt, Compress: &compress}
+		key = fmt.Sprintf("%s/encrypt=%t,compress=%t", transport, encrypt, compress)
+	} else {
+		options = nil
+	}
+	return key, transport, options
+}
+
+// pipeOptionsUsed reports whether a pipe over transport made as options asks is of the pool of the control
+// or of a registered tunnel,other pipes would only start pools no tunnel takes streams from
+func (c *Control) pipeOptionsUsed(transport string, options *msg.PipeOptions) bool {
+	key, _, _ := c.poolKey(transport, options)
+	if defaultKey, _, _ := c.poolKey("", nil); key == defaultKey {
+		return true
+	}
+	c.tunnelLock.Lock()
+	defer c.tunnelLock.Unlock()
+	for _, t := range c.tunnels {
+		cfg := t.config()
+		if tunnelKey, _, _ := c.poolKey(cfg.Transport, cfg.Pipe); key == tunnelKey {
+			return true
+		}
+	}
+	return false
+}
+
+// checkPipeMac verifies the pipe of phs is dialed by the client of the control,
+// the hello is authenticated by the secret of the control even if the pipe is left unencrypted.
+// the controls of encrypt_mode none have no secret,their pipes are as open as themselves
+func (c *Control) checkPipeMac(phs *msg.PipeClientHello) error {
+	if len(c.preMasterSecret) == 0 {
+		return nil
+	}
+	if len(phs.Mac) == 0 {
+		// old clients neither send a mac nor ask for options or visits,
+		// their pipes are encrypted by a key derived from the secret which authenticates them
+		if phs.Options != nil || phs.Visit {
+			return errors.New("pipe hello without mac")
+		}
+		return nil
+	}
+	if !crypto.CheckPipeMac(c.preMasterSecret, phs.MacInput(), phs.Mac) {
+		return errors.New("invalid pipe mac")
+	}
+	return nil
+}
+
+// checkPipeOptions verifies the pipes of a tunnel can be made as options asks
+func (c *Control) checkPipeOptions(options *msg.PipeOptions) error {
+	if options != nil && options.Encrypt != nil && *options.Encrypt && c.encryptMode == "none" {
+		return errors.New("encrypted pipes need an encrypted control")
+	}
+	return nil
+}
+
+// pipeRequests is how many pipes to ask for at once,enough for the waiting consumers
+// while at most max_pipe_requests,so that a burst of connections is served without dialing pipes one by one
+func (pool *pipePool) pipeRequests() int {
+	n := 1
+	if maxStreams > 0 {
+		n += int(uint64(atomic.LoadInt64(&pool.waiting)) / maxStreams)
+	}
+	if n > serverConf.MaxPipeRequests {
+		n = serverConf.MaxPipeRequests
+	}
+	return n
+}
+
+// pipeReq asks client for a new pipe,old clients only know the pipe req without body
+func (pool *pipePool) pipeReq() writeReq {
+	if pool.transport == "" && pool.options == nil {
+		return writeReq{msg.TypePipeReq, nil}
+	}
+	return writeReq{msg.TypePipeReq, msg.PipeReq{Transport: pool.transport, Options: pool.options}}
+}
+
+type pipeNode struct {
+	prev *pipeNode
+	next *pipeNode
+	pipe *smux.Session
+}
+
+func (pool *pipePool) addIdlePipe(pipe *smux.Session) {
+	pNode := &pipeNode{pipe: pipe, prev: nil, next: nil}
+	if pool.idlePipes != nil {
+		pool.idlePipes.prev = pNode
+		pNode.next = pool.idlePipes
+	}
+	pool.idlePipes = pNode
+	pool.idleCount++
+}
+
+func (pool *pipePool) addBusyPipe(pipe *smux.Session) {
+	pNode := &pipeNode{pipe: pipe, prev: nil, next: nil}
+	if pool.busyPipes != nil {
+		pool.busyPipes.prev = pNode
+		pNode.next = pool.busyPipes
+	}
+	pool.busyPipes = pNode
+}
+
+func (pool *pipePool) removeIdleNode(pNode *pipeNode) {
+	if pNode.prev == nil {
+		pool.idlePipes = pNode.next
+		if pool.idlePipes != nil {
+			pool.idlePipes.prev = nil
+		}
+	} else {
+		pNode.prev.next = pNode.next
+		if pNode.next != nil {
+			pNode.next.prev = pNode.prev
+		}
+	}
+	pool.idleCount--
+}
+
+func (pool *pipePool) removeBusyNode(pNode *pipeNode) {
+	if pNode.prev == nil {
+		pool.busyPipes = pNode.next
+		if pool.busyPipes != nil {
+			pool.busyPipes.prev = nil
+		}
+	} else {
+		pNode.prev.next = pNode.next
+		if pNode.next != nil {
+			pNode.next.prev = pNode.prev
+		}
+	}
+}
+
+func (pool *pipePool) putPipe(p *smux.Session) {
+	select {
+	case pool.pipeAdd <- p:
+	case <-pool.ctl.ctx.Done():
+		atomic.AddInt64(&pool.ctl.totalPipes, -1)
+		p.Close()
+	}
+}
+
+// getPipe waits at most timeout for a pipe,it returns a nil pipe if the control is closed
+func (pool *pipePool) getPipe(timeout time.Duration) (*smux.Session, error) {
+	atomic.AddInt64(&pool.waiting, 1)
+	defer atomic.AddInt64(&pool.waiting, -1)
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case p := <-pool.pipeGet:
+		return p, nil
+	case <-pool.ctl.ctx.Done():
+		return nil, nil
+	case <-timer.C:
+		return nil, errTooBusy
+	}
+}
+
+func (pool *pipePool) clean() {
+	if atomic.LoadInt64(&pool.ctl.totalPipes) > int64(maxIdlePipes) {
+		pipeLog.WithFields(log.Fields{"ctl_id": pool.ctl.id, "total_pipe_count": atomic.LoadInt64(&pool.ctl.totalPipes), "client_id": pool.ctl.ClientID.String()}).Debugln("total pipe count")
+	}
+	busy := pool.busyPipes
+	for {
+		if busy == nil {
+			break
+		}
+		if busy.pipe.IsClosed() {
+			pool.removeBusyNode(busy)
+		} else if uint64(busy.pipe.NumStreams()) < maxStreams {
+			pool.removeBusyNode(busy)
+			pool.addIdlePipe(busy.pipe)
+		}
+		busy = busy.next
+	}
+	idle := pool.idlePipes
+	for {
+		if idle == nil {
+			return
+		}
+		if idle.pipe.IsClosed() {
+			pool.removeIdleNode(idle)
+		} else if idle.pipe.NumStreams() == 0 && pool.idleCount >= maxIdlePipes {
+			pipeLog.WithFields(log.Fields{"ctl_id": pool.ctl.id, "time": time.Now().Unix(), "pipe_id": pool.ctl.pipeID(idle.pipe), "client_id": pool.ctl.ClientID.String()}).Debugln("remove and close idle")
+			pool.removeIdleNode(idle)
+			atomic.AddInt64(&pool.ctl.totalPipes, -1)
+			idle.pipe.Close()
+		}
+		idle = idle.next
+	}
+}
+
+func (pool *pipePool) getIdleFast() (idle *pipeNode) {
+	idle = pool.idlePipes
+	for {
+		if idle == nil {
+			return
+		}
+		if idle.pipe.IsClosed() {
+			pool.removeIdleNode(idle)
+			idle = idle.next
+		} else {
+			pool.removeIdleNode(idle)
+			return
+		}
+	}
+}
+
+func (pool *pipePool) pipeManage() {
+	var available *smux.Session
+	defer func() {
+		//the pipe ready for consumers is on neither list
+		if available != nil && !available.IsClosed() {
+			pool.addIdlePipe(available)
+		}
+		pool.closePipes()
+	}()
+	ticker := time.NewTicker(cleanInterval)
+	defer ticker.Stop()
+	for {
+	Prepare:
+		if available == nil || available.IsClosed() {
+			available = nil
+			idle := pool.getIdleFast()
+			if idle == nil {
+				pool.clean()
+				idle := pool.getIdleFast()
+				for i := pool.pipeRequests(); i > 0; i-- {
+					select {
+					case pool.ctl.writeChan <- pool.pipeReq():
+					default:
+						pool.ctl.Close()
+						return
+					}
+				}
+				if idle == nil {
+					pipeGetTimeout := time.After(time.Second * 12)
+					for {
+						select {
+						case <-ticker.C:
+							pool.clean()
+							idle := pool.getIdleFast()
+							if idle != nil {
+								available = idle.pipe
+								goto Available
+							}
+						case p := <-pool.pipeAdd:
+							if !p.IsClosed() {
+								if uint64(p.NumStreams()) < maxStreams {
+									available = p
+									goto Available
+								} else {
+									pool.addBusyPipe(p)
+								}
+							}
+						case <-pool.ctl.ctx.Done():
+							return
+						case <-pipeGetTimeout:
+							goto Prepare
+						}
+					}
+				} else {
+					available = idle.pipe
+				}
+			} else {
+				available = idle.pipe
+			}
+		}
+	Available:
+		select {
+		case <-ticker.C:
+			pool.clean()
+		case pool.pipeGet <- available:
+			pipeLog.WithFields(log.Fields{"ctl_id": pool.ctl.id, "pipe_id": pool.ctl.pipeID(available), "client_id": pool.ctl.ClientID.String()}).Debugln("dispatch pipe to consumer")
+			available = nil
+		case p := <-pool.pipeAdd:
+			if !p.IsClosed() {
+				if uint64(p.NumStreams()) < maxStreams {
+					pool.addIdlePipe(p)
+				} else {
+					pool.addBusyPipe(p)
+				}
+			}
+		case <-pool.ctl.ctx.Done():
+			return
+		}
+	}
+}
+
+func (pool *pipePool) closePipes() {
+	pipeLog.WithFields(log.Fields{"ctl_id": pool.ctl.id, "client_id": pool.ctl.ClientID.String()}).Debugln("ready to close pipes")
+	idle := pool.idlePipes
+	for {
+		if idle == nil {
+			break
+		}
+		if !idle.pipe.IsClosed() {
+			atomic.AddInt64(&pool.ctl.totalPipes, -1)
+			idle.pipe.Close()
+		}
+		idle = idle.next
+	}
+	pool.idlePipes = nil
+
+	busy := pool.busyPipes
+	for {
+		if busy == nil {
+			break
+		}
+		if !busy.pipe.IsClosed() {
+			atomic.AddInt64(&pool.ctl.totalPipes, -1)
+			busy.pipe.Close()
+		}
+		busy = busy.next
+	}
+	pool.busyPipes = nil
+}
+
+var errTooBusy = errors.New("client too busy")
+
+// busyNoticeInterval is how often the client is told about refused connections at most
+const busyNoticeInterval = time.Minute
+
+// tooBusy counts a public connection of t refused for reason and tells the client about it,
+// so that it can be scaled out or have the stream limits raised
+func (c *Control) tooBusy(t *Tunnel, reason string) error {
+	atomic.AddUint64(&serverMetrics.streamsRejected, 1)
+	now := time.Now().UnixNano()
+	last := atomic.LoadInt64(&c.busyNotified)
+	if now-last >= int64(busyNoticeInterval) && atomic.CompareAndSwapInt64(&c.busyNotified, last, now) {
+		streams, pipes := atomic.LoadInt64(&c.streams), atomic.LoadInt64(&c.totalPipes)
+		pipeLog.WithFields(log.Fields{"ctl_id": c.id, "client_id": c.ClientID.String(), "tunnel": t.name, "reason": reason, "streams": streams, "pipes": pipes}).Warningln("public connection refused,client too busy")
+		recordEvent("client_busy", c, t.name, reason)
+		c.notify("busy", fmt.Sprintf("connections of tunnel %s refused,%s(%d streams over %d pipes)", t.name, reason, streams, pipes))
+	}
+	return errTooBusy
+}
+
+// tooManyConns refuses a public connection over the max_conns of t, the client isn't told
+// since more pipes wouldn't help
+func (t *Tunnel) tooManyConns(max int) error {
+	atomic.AddUint64(&serverMetrics.connsRejected, 1)
+	pipeLog.WithFields(log.Fields{"ctl_id": t.control().id, "client_id": t.control().ClientID.String(), "tunnel": t.name, "max_conns": max}).Debugln("public connection refused,max_conns reached")
+	return errTooBusy
+}
@@ -0,0 +1,106 @@
+// Copyright 2017 longXboy, longxboyhi@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"sort"
+	"sync/atomic"
+
+	"github.com/longXboy/smux"
+	kcp "github.com/xtaci/kcp-go"
+)
+
+// pipeInfo is the smux stats of a pipe shown in the client detail api
+type pipeInfo struct {
+	ID        string
+	Transport string
+	smux.Stats
+	//streams a pipe carries before another pipe is asked for
+	MaxStreams uint64
+}
+
+type trackedPipe struct {
+	transport string
+	id        string
+}
+
+// trackPipe records sess so its stats are reported until it is closed
+func (c *Control) trackPipe(sess *smux.Session, transport string, id string) {
+	c.poolLock.Lock()
+	c.pipes[sess] = trackedPipe{transport: transport, id: id}
+	c.poolLock.Unlock()
+}
+
+// pipeID returns the id of sess in the logs
+func (c *Control) pipeID(sess *smux.Session) string {
+	c.poolLock.Lock()
+	defer c.poolLock.Unlock()
+	return c.pipes[sess].id
+}
+
+// pipeInfos returns the stats of the live pipes,forgetting the closed ones
+func (c *Control) pipeInfos() []pipeInfo {
+	infos := []pipeInfo{}
+	c.poolLock.Lock()
+	for sess, tp := range c.pipes {
+		if sess.IsClosed() {
+			delete(c.pipes, sess)
+			continue
+		}
+		infos = append(infos, pipeInfo{ID: tp.id, Transport: tp.transport, Stats: sess.Stats(), MaxStreams: maxStreams})
+	}
+	c.poolLock.Unlock()
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Streams > infos[j].Streams })
+	return infos
+}
+
+type pipeMetrics struct {
+	Pipes          int64
+	BufferedBytes  int64
+	Stalls         uint64
+	KeepalivesSent uint64
+	KeepalivesRecv uint64
+	//pipes carrying maxStreams streams,which makes server ask for more pipes
+	SaturatedPipes int64
+	KcpRetransSegs uint64
+	KcpLostSegs    uint64
+}
+
+func snapshotPipeMetrics() pipeMetrics {
+	var m pipeMetrics
+	var controls []*Control
+	ControlMapLock.RLock()
+	for _, c := range ControlMap {
+		if !c.IsClosed() {
+			controls = append(controls, c)
+		}
+	}
+	ControlMapLock.RUnlock()
+	for _, c := range controls {
+		for _, p := range c.pipeInfos() {
+			m.Pipes++
+			m.BufferedBytes += int64(p.BufferedBytes)
+			m.Stalls += p.Stalls
+			m.KeepalivesSent += p.KeepalivesSent
+			m.KeepalivesRecv += p.KeepalivesRecv
+			if uint64(p.Streams) >= maxStreams {
+				m.SaturatedPipes++
+			}
+		}
+	}
+	m.KcpRetransSegs = atomic.LoadUint64(&kcp.DefaultSnmp.RetransSegs)
+	m.KcpLostSegs = atomic.LoadUint64(&kcp.DefaultSnmp.LostSegs)
+	return m
+}
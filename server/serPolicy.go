@@ -0,0 +1,420 @@
+// Copyright 2017 longXboy, longxboyhi@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/longXboy/lunnel/contrib"
+	"github.com/longXboy/lunnel/log"
+	"github.com/longXboy/lunnel/msg"
+	"github.com/longXboy/lunnel/util"
+	"github.com/pkg/errors"
+)
+
+const preambleTimeout = time.Second * 10
+
+// maxNotFoundPage is the largest not found page a tunnel may register
+const maxNotFoundPage = 64 << 10
+
+const (
+	accessAllowed = iota
+	accessForbidden
+	accessRateLimited
+	accessQuotaExceeded
+	accessOffline
+	accessMaintenance
+	accessOverloaded
+)
+
+// tunnelPolicy is the parsed form of the tunnel settings that are enforced on public connections
+type tunnelPolicy struct {
+	allowNets []*net.IPNet
+	denyNets  []*net.IPNet
+	limiter   *util.RateLimiter
+	auth      string
+	knock     *msg.KnockOptions
+	psk       string
+	urlSecret string
+	schedule  util.Schedule
+	location  *time.Location
+	qos       int
+}
+
+func parseIPNets(list []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, s := range list {
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, errors.Errorf("invalid ip %s", s)
+			}
+			if ip.To4() != nil {
+				s = s + "/32"
+			} else {
+				s = s + "/128"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, errors.Errorf("invalid cidr %s", s)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+func newTunnelPolicy(cfg msg.Tunnel) (*tunnelPolicy, error) {
+	var err error
+	err = validateLabels(cfg.Labels)
+	if err != nil {
+		return nil, err
+	}
+	policy := new(tunnelPolicy)
+	policy.allowNets, err = parseIPNets(cfg.AllowIPs)
+	if err != nil {
+		return nil, errors.Wrap(err, "allow_ips")
+	}
+	policy.denyNets, err = parseIPNets(cfg.DenyIPs)
+	if err != nil {
+		return nil, errors.Wrap(err, "deny_ips")
+	}
+	if cfg.RateLimit < 0 || cfg.RateBurst < 0 {
+		return nil, errors.New("rate_limit and rate_burst can not be negative")
+	}
+	if cfg.IdleTimeout < 0 || cfg.MaxLifetime < 0 {
+		return nil, errors.New("idle_timeout and max_lifetime can not be negative")
+	}
+	if cfg.MaxConns < 0 {
+		return nil, errors.New("max_conns can not be negative")
+	}
+	if cfg.RateLimit > 0 {
+		policy.limiter = util.NewRateLimiter(cfg.RateLimit, cfg.RateBurst)
+	}
+	if cfg.Transport != "" && !transportEnabled(cfg.Transport) {
+		return nil, errors.Errorf("invalid transport %s", cfg.Transport)
+	}
+	if cfg.Public.Schema == "udp" && cfg.Local.Schema != "udp" {
+		return nil, errors.New("udp tunnels can only proxy udp local address")
+	}
+	if cfg.Public.Schema == "tcpmux" && (cfg.Local.Schema == "udp" || strings.ContainsAny(cfg.Public.Host, " \r\n")) {
+		return nil, errors.New("tcpmux tunnels must proxy stream local address and host can't contain spaces")
+	}
+	if cfg.Public.Schema == "stcp" && (cfg.Local.Schema == "udp" || cfg.Psk == "") {
+		return nil, errors.New("stcp tunnels must proxy stream local address and set psk")
+	}
+	if len(cfg.Methods) > 0 {
+		if cfg.Public.Schema != "http" && cfg.Public.Schema != "https" {
+			return nil, errors.New("methods are only supported by http and https tunnels")
+		}
+		for _, m := range cfg.Methods {
+			if !validMethod(m) {
+				return nil, errors.Errorf("invalid http method %s", m)
+			}
+		}
+	}
+	if len(cfg.Paths) > 0 || cfg.NotFoundPage != "" {
+		if cfg.Public.Schema != "http" && cfg.Public.Schema != "https" {
+			return nil, errors.New("paths are only supported by http and https tunnels")
+		}
+		if len(cfg.NotFoundPage) > maxNotFoundPage {
+			return nil, errors.Errorf("not_found_page can not be larger than %d bytes", maxNotFoundPage)
+		}
+		for _, p := range cfg.Paths {
+			if !strings.HasPrefix(p, "/") {
+				return nil, errors.Errorf("path %s must start with /", p)
+			}
+		}
+	}
+	if cfg.Knock != nil {
+		if cfg.Public.Schema != "tcp" {
+			return nil, errors.New("knock is only supported by tcp tunnels")
+		}
+		if cfg.Knock.Secret == "" || cfg.Knock.Ttl < 0 {
+			return nil, errors.New("knock secret can not be empty and ttl can not be negative")
+		}
+		policy.knock = cfg.Knock
+	}
+	if cfg.Psk != "" {
+		if cfg.Public.Schema != "tcp" && cfg.Public.Schema != "tcpmux" && cfg.Public.Schema != "stcp" {
+			return nil, errors.New("psk is only supported by tcp,tcpmux and stcp tunnels")
+		}
+		if strings.ContainsAny(cfg.Psk, "\r\n") {
+			return nil, errors.New("psk can't contain newlines")
+		}
+		policy.psk = cfg.Psk
+	}
+	policy.qos, err = parseQosClass(cfg.Qos)
+	if err != nil {
+		return nil, err
+	}
+	policy.schedule, err = util.ParseSchedule(cfg.Schedule)
+	if err != nil {
+		return nil, errors.Wrap(err, "schedule")
+	}
+	policy.location = time.Local
+	if cfg.Timezone != "" {
+		policy.location, err = time.LoadLocation(cfg.Timezone)
+		if err != nil {
+			return nil, errors.Wrap(err, "timezone")
+		}
+	}
+	if cfg.UrlSecret != "" {
+		if cfg.Public.Schema != "http" && cfg.Public.Schema != "https" {
+			return nil, errors.New("url_secret is only supported by http and https tunnels")
+		}
+		policy.urlSecret = cfg.UrlSecret
+	}
+	if cfg.HttpAuth != "" {
+		if cfg.Public.Schema != "http" && cfg.Public.Schema != "https" {
+			return nil, errors.New("http_auth is only supported by http and https tunnels")
+		}
+		if !strings.Contains(cfg.HttpAuth, ":") {
+			return nil, errors.New("http_auth must be in user:password format")
+		}
+		policy.auth = cfg.HttpAuth
+	}
+	return policy, nil
+}
+
+func (p *tunnelPolicy) allowIP(ip net.IP) bool {
+	for _, n := range p.denyNets {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	if len(p.allowNets) == 0 {
+		return true
+	}
+	for _, n := range p.allowNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func remoteIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+func (t *Tunnel) config() msg.Tunnel {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	return t.tunnelConfig
+}
+
+func (t *Tunnel) getPolicy() *tunnelPolicy {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	return t.policy
+}
+
+// applyConfig updates the settings of a live tunnel in place,
+// the public listener and the proxying connections are kept
+func (t *Tunnel) applyConfig(cfg msg.Tunnel) error {
+	policy, err := newTunnelPolicy(cfg)
+	if err != nil {
+		return err
+	}
+	t.lock.Lock()
+	if t.policy != nil && t.policy.limiter != nil && cfg.RateLimit == t.tunnelConfig.RateLimit && cfg.RateBurst == t.tunnelConfig.RateBurst {
+		policy.limiter = t.policy.limiter
+	}
+	t.tunnelConfig.ApplySettings(cfg)
+	t.policy = policy
+	t.storeByteCap()
+	t.lock.Unlock()
+	return nil
+}
+
+// sameEndpoint reports whether cfg asks for the public and local address this tunnel already holds
+func (t *Tunnel) sameEndpoint(cfg msg.Tunnel) bool {
+	old := t.config()
+	if cfg.Public.Schema != old.Public.Schema || cfg.LocalAddr() != old.LocalAddr() || !sameMethods(cfg.Methods, old.Methods) {
+		return false
+	}
+	if cfg.Public.Schema == "http" || cfg.Public.Schema == "https" || cfg.Public.Schema == "tcpmux" || cfg.Public.Schema == "stcp" {
+		return cfg.Public.Host == "" || cfg.Public.Host == old.Public.Host
+	}
+	return cfg.Public.Port == 0 || cfg.Public.Port == old.Public.Port
+}
+
+func (t *Tunnel) checkAccess(conn net.Conn) int {
+	return t.checkAccessAddr(conn.RemoteAddr())
+}
+
+func (t *Tunnel) checkAccessAddr(addr net.Addr) int {
+	if t.overQuota() {
+		return accessQuotaExceeded
+	}
+	if on, _ := t.control().maintenancePage(); on {
+		return accessMaintenance
+	}
+	if t.overloaded() {
+		return accessOverloaded
+	}
+	policy := t.getPolicy()
+	if policy == nil {
+		return accessAllowed
+	}
+	if !policy.schedule.Active(time.Now().In(policy.location)) {
+		return accessOffline
+	}
+	ip := remoteIP(addr)
+	if ip != nil && !policy.allowIP(ip) {
+		return accessForbidden
+	}
+	if policy.knock != nil && (ip == nil || !t.knocked(ip)) {
+		return accessForbidden
+	}
+	if policy.limiter != nil && !policy.limiter.Allow() {
+		return accessRateLimited
+	}
+	return accessAllowed
+}
+
+// readPreamble checks the pre-shared key line sent first by visitors of the tunnel,
+// the returned conn keeps the bytes buffered after the preamble.r may be nil
+func (t *Tunnel) readPreamble(conn net.Conn, r *bufio.Reader) (net.Conn, error) {
+	policy := t.getPolicy()
+	if policy == nil || policy.psk == "" {
+		if r == nil {
+			return conn, nil
+		}
+		return &bufferedConn{Conn: conn, r: r}, nil
+	}
+	if r == nil {
+		r = bufio.NewReaderSize(conn, maxMuxHeader)
+	}
+	conn.SetReadDeadline(time.Now().Add(preambleTimeout))
+	line, err := readMuxLine(r)
+	if err != nil {
+		return nil, errors.Wrap(err, "read preamble")
+	}
+	conn.SetReadDeadline(time.Time{})
+	if subtle.ConstantTimeCompare([]byte(line), []byte(policy.psk)) != 1 {
+		return nil, errors.New("psk mismatch")
+	}
+	return &bufferedConn{Conn: conn, r: r}, nil
+}
+
+// effectiveByteCap is the smaller non-zero one of the byte cap of tunnel and server(or tenant)
+func effectiveByteCap(limit uint64, tenant *Tenant) uint64 {
+	serverCap := serverConf.TunnelByteCap
+	if tenant != nil && tenant.TunnelByteCap != 0 {
+		serverCap = tenant.TunnelByteCap
+	}
+	if limit == 0 || (serverCap != 0 && serverCap < limit) {
+		limit = serverCap
+	}
+	return limit
+}
+
+// storeByteCap caches the byte cap of tunnelConfig,the caller holds t.lock or owns t yet.
+// the quota flags are reset once the tunnel is uncapped,overQuota skips them then
+func (t *Tunnel) storeByteCap() {
+	limit := effectiveByteCap(t.tunnelConfig.ByteCap, t.ctl.tenant)
+	atomic.StoreUint64(&t.cachedByteCap, limit)
+	if limit == 0 {
+		atomic.StoreInt32(&t.quotaExceeded, 0)
+		atomic.StoreInt32(&t.quotaWarned, 0)
+	}
+}
+
+// byteCap is the byte cap of the tunnel cached by applyConfig,it is read on every write of the tunnel
+func (t *Tunnel) byteCap() uint64 {
+	return atomic.LoadUint64(&t.cachedByteCap)
+}
+
+// overQuota reports whether the tunnel has transferred more than its byte cap,
+// the notify event is sent only the first time the cap is reached,
+// and the client is warned once when 90 percent of the cap is used
+func (t *Tunnel) overQuota() bool {
+	limit := t.byteCap()
+	if limit == 0 {
+		return false
+	}
+	used := atomic.LoadUint64(&t.bytesIn) + atomic.LoadUint64(&t.bytesOut)
+	if used < limit {
+		// the cap may be raised after exceeded
+		atomic.StoreInt32(&t.quotaExceeded, 0)
+		if used < limit/10*9 {
+			atomic.StoreInt32(&t.quotaWarned, 0)
+		} else if atomic.CompareAndSwapInt32(&t.quotaWarned, 0, 1) {
+			t.ctl.notify("quota", fmt.Sprintf("tunnel %s used %d of its byte cap %d", t.name, used, limit))
+		}
+		return false
+	}
+	if atomic.CompareAndSwapInt32(&t.quotaExceeded, 0, 1) {
+		cfg := t.config()
+		controlLog.WithFields(log.Fields{"ctl_id": t.ctl.id, "tunnel": t.name, "client_id": t.ctl.ClientID.String(), "byte_cap": limit}).Warningln("tunnel byte cap exceeded,stop forwarding")
+		recordEvent("quota_exceeded", t.ctl, t.name, fmt.Sprintf("byte cap %d", limit))
+		t.ctl.notify("quota", fmt.Sprintf("tunnel %s exceeded its byte cap %d,forwarding stopped", t.name, limit))
+		if serverConf.NotifyEnable {
+			go func() {
+				err := contrib.QuotaExceeded(serverConf.ServerDomain, cfg, t.ctl.ClientID.String())
+				if err != nil {
+					controlLog.WithFields(log.Fields{"tunnel": t.name, "err": err}).Errorln("notify quota exceeded failed!")
+				}
+			}()
+		}
+	}
+	return true
+}
+
+// checkSignedURL verifies the signed url token of a request,
+// it returns the expire time of the token and whether the tunnel requires it
+func (t *Tunnel) checkSignedURL(host string, token string) (expire int64, required bool, ok bool) {
+	policy := t.getPolicy()
+	if policy == nil || policy.urlSecret == "" {
+		return 0, false, true
+	}
+	expire, ok = util.VerifySignedURL(policy.urlSecret, host, token, time.Now())
+	return expire, true, ok
+}
+
+func (t *Tunnel) checkHttpAuth(authorization string) bool {
+	policy := t.getPolicy()
+	if policy == nil || policy.auth == "" {
+		return true
+	}
+	const prefix = "Basic "
+	if !strings.HasPrefix(authorization, prefix) {
+		return false
+	}
+	credential, err := base64.StdEncoding.DecodeString(authorization[len(prefix):])
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(credential, []byte(policy.auth)) == 1
+}
@@ -0,0 +1,88 @@
+// Copyright 2017 longXboy, longxboyhi@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"github.com/longXboy/lunnel/msg"
+	"github.com/longXboy/lunnel/util"
+	"github.com/pkg/errors"
+)
+
+// Profile holds the settings shared by the tunnels referring to it by name,
+// the settings of a tunnel itself take precedence and labels are merged
+type Profile struct {
+	Labels    map[string]string `yaml:"labels,omitempty"`
+	HttpAuth  string            `yaml:"http_auth,omitempty"`
+	AllowIPs  []string          `yaml:"allow_ips,omitempty"`
+	DenyIPs   []string          `yaml:"deny_ips,omitempty"`
+	RateLimit float64           `yaml:"rate_limit,omitempty"`
+	RateBurst int               `yaml:"rate_burst,omitempty"`
+	ByteCap   uint64            `yaml:"byte_cap,omitempty"`
+	Schedule  []string          `yaml:"schedule,omitempty"`
+	Timezone  string            `yaml:"timezone,omitempty"`
+	//seconds,see the idle_timeout and max_lifetime of tunnel
+	IdleTimeout int `yaml:"idle_timeout,omitempty"`
+	MaxLifetime int `yaml:"max_lifetime,omitempty"`
+	//qos class,see the qos of tunnel
+	Qos      string `yaml:"qos,omitempty"`
+	MaxConns int    `yaml:"max_conns,omitempty"`
+}
+
+func (p *Profile) tunnel() msg.Tunnel {
+	return msg.Tunnel{
+		Labels:      p.Labels,
+		HttpAuth:    p.HttpAuth,
+		AllowIPs:    p.AllowIPs,
+		DenyIPs:     p.DenyIPs,
+		RateLimit:   p.RateLimit,
+		RateBurst:   p.RateBurst,
+		ByteCap:     p.ByteCap,
+		Schedule:    p.Schedule,
+		Timezone:    p.Timezone,
+		IdleTimeout: p.IdleTimeout,
+		MaxLifetime: p.MaxLifetime,
+		Qos:         p.Qos,
+		MaxConns:    p.MaxConns,
+	}
+}
+
+func validateProfiles() error {
+	for name, p := range serverConf.Profiles {
+		if p == nil {
+			return errors.Errorf("profile %s is empty", name)
+		}
+		_, err := newTunnelPolicy(p.tunnel())
+		if err != nil {
+			return errors.Wrapf(err, "profile %s", name)
+		}
+		if _, err = util.ParseSchedule(p.Schedule); err != nil {
+			return errors.Wrapf(err, "profile %s schedule", name)
+		}
+	}
+	return nil
+}
+
+// applyProfile fills the settings the tunnel leaves empty from the profile it refers to
+func applyProfile(cfg msg.Tunnel) (msg.Tunnel, error) {
+	if cfg.Profile == "" {
+		return cfg, nil
+	}
+	p, isok := serverConf.Profiles[cfg.Profile]
+	if !isok {
+		return cfg, errors.Errorf("profile %s not found", cfg.Profile)
+	}
+	util.MergeProfile(&cfg, p.tunnel())
+	return cfg, nil
+}
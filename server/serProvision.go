@@ -0,0 +1,304 @@
+// Copyright 2017 longXboy, longxboyhi@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/longXboy/lunnel/log"
+	"github.com/longXboy/lunnel/msg"
+	"github.com/longXboy/lunnel/util"
+	"github.com/pkg/errors"
+	"github.com/satori/go.uuid"
+)
+
+// maxProvisionBody is the size limit of the tunnels put by the manage api for a client
+const maxProvisionBody = 1 << 20
+
+// ProvisionedTunnel is declared on server for a client id,the client receives it when it connects
+// instead of carrying it in its own config
+type ProvisionedTunnel struct {
+	Schema string `yaml:"schema,omitempty" json:"schema,omitempty"`
+	Host   string `yaml:"host,omitempty" json:"host,omitempty"`
+	Port   uint16 `yaml:"port,omitempty" json:"port,omitempty"`
+	//address the client proxies to,like tcp://127.0.0.1:22
+	LocalAddr       string            `yaml:"local,omitempty" json:"local,omitempty"`
+	HttpHostRewrite string            `yaml:"http_host_rewrite,omitempty" json:"http_host_rewrite,omitempty"`
+	Labels          map[string]string `yaml:"labels,omitempty" json:"labels,omitempty"`
+	//profile of server the other settings are filled from
+	Profile string `yaml:"profile,omitempty" json:"profile,omitempty"`
+}
+
+var (
+	provisionLock sync.RWMutex
+	// provisions are the provisioned tunnels of each client id by name,changed by the manage api at runtime
+	provisions map[string]map[string]*ProvisionedTunnel
+)
+
+// tunnel builds the tunnel the client is told to register
+func (p *ProvisionedTunnel) tunnel() (msg.Tunnel, error) {
+	var tunnel msg.Tunnel
+	localSchema, localHost, localPort, err := util.ParseAddr(p.LocalAddr)
+	if err != nil {
+		return tunnel, errors.Wrap(err, "parse local")
+	}
+	if localHost == "" {
+		return tunnel, errors.New("local host can not be empty")
+	}
+	if localSchema == "" {
+		localSchema = "tcp"
+	}
+	tunnel.Local = msg.Local{Schema: localSchema, Host: localHost, Port: uint16(localPort)}
+	tunnel.Public = msg.Public{Schema: p.Schema, Host: p.Host, Port: p.Port}
+	if tunnel.Public.Schema == "" {
+		tunnel.Public.Schema = localSchema
+	}
+	if tunnel.Public.Host == "" && tunnel.Public.Port == 0 {
+		tunnel.Public.AllowReallocate = true
+	}
+	if p.Profile != "" {
+		if _, isok := serverConf.Profiles[p.Profile]; !isok {
+			return tunnel, errors.Errorf("profile %s not found", p.Profile)
+		}
+	}
+	tunnel.HttpHostRewrite = p.HttpHostRewrite
+	tunnel.Labels = p.Labels
+	tunnel.Profile = p.Profile
+	tunnel.Provisioned = true
+	return tunnel, nil
+}
+
+func validateProvision(clientId string, tunnels map[string]*ProvisionedTunnel) error {
+	if _, err := uuid.FromString(clientId); err != nil {
+		return errors.Errorf("provision client id %s is not a uuid", clientId)
+	}
+	for name, p := range tunnels {
+		if name == "" || p == nil {
+			return errors.Errorf("provision of %s has an empty tunnel", clientId)
+		}
+		if _, err := p.tunnel(); err != nil {
+			return errors.Wrapf(err, "provision of %s tunnel %s", clientId, name)
+		}
+	}
+	return nil
+}
+
+func initProvisions() error {
+	all := make(map[string]map[string]*ProvisionedTunnel, len(serverConf.Provision))
+	for clientId, tunnels := range serverConf.Provision {
+		err := validateProvision(clientId, tunnels)
+		if err != nil {
+			return err
+		}
+		all[strings.ToLower(clientId)] = tunnels
+	}
+	provisionLock.Lock()
+	provisions = all
+	provisionLock.Unlock()
+	return nil
+}
+
+// provisionedTunnels returns the tunnels provisioned for the client id,the ephemeral ones included
+func provisionedTunnels(clientId string) map[string]msg.Tunnel {
+	provisionLock.RLock()
+	all := make(map[string]*ProvisionedTunnel, len(provisions[clientId]))
+	for name, p := range provisions[clientId] {
+		all[name] = p
+	}
+	provisionLock.RUnlock()
+	ephemeralTunnels(clientId, all)
+	tunnels := make(map[string]msg.Tunnel, len(all))
+	for name, p := range all {
+		// validated when provisioned,the profile may only be missing after it is removed from config
+		if tunnel, err := p.tunnel(); err == nil {
+			tunnels[name] = tunnel
+		}
+	}
+	return tunnels
+}
+
+func isProvisioned(clientId string, name string) bool {
+	provisionLock.RLock()
+	_, isok := provisions[clientId][name]
+	provisionLock.RUnlock()
+	return isok || isEphemeral(clientId, name)
+}
+
+// provision registers the tunnels provisioned for the client once it has connected
+func (c *Control) provision() {
+	tunnels := provisionedTunnels(c.ClientID.String())
+	if len(tunnels) == 0 {
+		return
+	}
+	controlLog.WithFields(log.Fields{"client_id": c.ClientID.String(), "tunnels": len(tunnels)}).Infoln("assign provisioned tunnels")
+	go c.ServerAddTunnels(&msg.AddTunnels{Tunnels: tunnels})
+}
+
+// dropReserved removes the tunnels the client sends under the names of its provisioned tunnels,
+// it reports false if the control is closed because the client can't be told
+func (c *Control) dropReserved(cstm *msg.AddTunnels) bool {
+	for name, tunnel := range cstm.Tunnels {
+		if !isProvisioned(c.ClientID.String(), name) {
+			// only the tunnels assigned by server are provisioned
+			tunnel.Provisioned = false
+			cstm.Tunnels[name] = tunnel
+			continue
+		}
+		delete(cstm.Tunnels, name)
+		controlLog.WithFields(log.Fields{"tunnel": name, "client_id": c.ClientID.String()}).Warningln("forbidden,tunnel name reserved by provision")
+		select {
+		case c.writeChan <- writeReq{msg.TypeError, msg.Error{Msg: fmt.Sprintf("add tunnels failed!tunnel(%s) name is reserved by a tunnel provisioned on server", name), Code: msg.ErrCodeInvalidTunnel, Detail: map[string]string{"tunnel": name}}}:
+		default:
+			c.Close()
+			return false
+		}
+	}
+	return true
+}
+
+// removeProvisioned closes the provisioned tunnels of names and tells the client to forget them
+func (c *Control) removeProvisioned(names []string) {
+	var removed []string
+	c.tunnelLock.Lock()
+	for _, name := range names {
+		t, isok := c.tunnels[name]
+		if !isok || !t.config().Provisioned {
+			continue
+		}
+		t.Close()
+		delete(c.tunnels, name)
+		removed = append(removed, name)
+		controlLog.WithFields(log.Fields{"tunnel": name, "client_id": c.ClientID.String()}).Infoln("provisioned tunnel removed")
+	}
+	c.tunnelLock.Unlock()
+	if len(removed) == 0 {
+		return
+	}
+	select {
+	case c.writeChan <- writeReq{msg.TypeRemoveTunnels, msg.RemoveTunnels{Names: removed}}:
+	default:
+		c.Close()
+	}
+}
+
+// setProvision replaces the provisioned tunnels of the client id and applies them to the client if connected,
+// nil tunnels removes the provision
+func setProvision(clientId string, tunnels map[string]*ProvisionedTunnel) {
+	provisionLock.Lock()
+	older := provisions[clientId]
+	if len(tunnels) == 0 {
+		delete(provisions, clientId)
+	} else {
+		provisions[clientId] = tunnels
+	}
+	provisionLock.Unlock()
+	ctl := liveControl(clientId)
+	if ctl == nil {
+		return
+	}
+	var removed []string
+	for name := range older {
+		if _, isok := tunnels[name]; !isok {
+			removed = append(removed, name)
+		}
+	}
+	if len(removed) > 0 {
+		ctl.removeProvisioned(removed)
+	}
+	ctl.provision()
+}
+
+// provisionHandler lists the provisions at /api/v1/provisions and gets,puts or deletes
+// the provisioned tunnels of a client at /api/v1/provisions/{client_id}
+func provisionHandler(w http.ResponseWriter, r *http.Request) {
+	if requestTenant(r) != nil {
+		// provisions pick any client id,so they are left to the tokens of server
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprintf(w, "permission denied")
+		return
+	}
+	clientId := strings.ToLower(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1/provisions"), "/"))
+	if clientId == "" {
+		if r.Method != "GET" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			fmt.Fprintf(w, "method not allowed")
+			return
+		}
+		ids := []string{}
+		provisionLock.RLock()
+		for id := range provisions {
+			ids = append(ids, id)
+		}
+		provisionLock.RUnlock()
+		sort.Strings(ids)
+		writeJson(w, http.StatusOK, ids)
+		return
+	}
+	switch r.Method {
+	case "GET":
+		provisionLock.RLock()
+		tunnels, isok := provisions[clientId]
+		provisionLock.RUnlock()
+		if !isok {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintf(w, "provision not found")
+			return
+		}
+		writeJson(w, http.StatusOK, tunnels)
+	case "PUT":
+		content, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxProvisionBody))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "read req body failed")
+			return
+		}
+		var tunnels map[string]*ProvisionedTunnel
+		err = json.Unmarshal(content, &tunnels)
+		if err == nil {
+			err = validateProvision(clientId, tunnels)
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, err.Error())
+			return
+		}
+		setProvision(clientId, tunnels)
+		manageLog.WithFields(log.Fields{"client_id": clientId, "tunnels": len(tunnels)}).Infoln("provision updated by manage api")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("ok"))
+	case "DELETE":
+		provisionLock.RLock()
+		_, isok := provisions[clientId]
+		provisionLock.RUnlock()
+		if !isok {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintf(w, "provision not found")
+			return
+		}
+		setProvision(clientId, nil)
+		manageLog.WithFields(log.Fields{"client_id": clientId}).Infoln("provision removed by manage api")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("ok"))
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		fmt.Fprintf(w, "method not allowed")
+	}
+}
@@ -0,0 +1,139 @@
+// Copyright 2017 longXboy, longxboyhi@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const qosTick = time.Millisecond * 10
+
+// classes of the tunnel traffic,a lower class is sent first when the bandwidth of server is saturated
+const (
+	qosHigh = iota
+	qosNormal
+	qosBulk
+	qosClasses
+)
+
+type Qos struct {
+	//bytes per second server sends at most over all the tunnels(to visitors and to clients),0 is unlimited
+	Bandwidth uint64 `yaml:"bandwidth,omitempty"`
+	//bytes sent at once before shaping starts,default to a tenth of bandwidth
+	Burst uint64 `yaml:"burst,omitempty"`
+}
+
+// uplink shapes the traffic of every tunnel if bandwidth is set,nil otherwise
+var uplink *qosShaper
+
+var qosClassNames = [qosClasses]string{"high", "normal", "bulk"}
+
+func parseQosClass(class string) (int, error) {
+	switch class {
+	case "high":
+		return qosHigh, nil
+	case "", "normal":
+		return qosNormal, nil
+	case "bulk":
+		return qosBulk, nil
+	}
+	return 0, errors.Errorf("invalid qos class %s", class)
+}
+
+type qosWaiter struct {
+	n     float64
+	ready chan struct{}
+}
+
+// qosShaper is a token bucket of the bandwidth,writers wait once it runs dry
+// and are let go strictly in the order of their classes
+type qosShaper struct {
+	lock    sync.Mutex
+	rate    float64
+	burst   float64
+	tokens  float64
+	last    time.Time
+	queued  int
+	waiting [qosClasses][]*qosWaiter
+}
+
+func newQosShaper(bandwidth uint64, burst uint64) *qosShaper {
+	if burst == 0 {
+		burst = bandwidth / 10
+	}
+	if burst < 64<<10 {
+		burst = 64 << 10
+	}
+	s := &qosShaper{rate: float64(bandwidth), burst: float64(burst), tokens: float64(burst), last: time.Now()}
+	go s.run()
+	return s
+}
+
+func (s *qosShaper) refillLocked(now time.Time) {
+	if now.After(s.last) {
+		s.tokens += now.Sub(s.last).Seconds() * s.rate
+		if s.tokens > s.burst {
+			s.tokens = s.burst
+		}
+		s.last = now
+	}
+}
+
+// wait blocks until n bytes of class may be sent,a write larger than the tokens left
+// is let go as soon as there are tokens and paid off by the following writes
+func (s *qosShaper) wait(class int, n int) {
+	s.lock.Lock()
+	s.refillLocked(time.Now())
+	if s.queued == 0 && s.tokens > 0 {
+		s.tokens -= float64(n)
+		s.lock.Unlock()
+		return
+	}
+	w := &qosWaiter{n: float64(n), ready: make(chan struct{})}
+	s.waiting[class] = append(s.waiting[class], w)
+	s.queued++
+	s.lock.Unlock()
+	<-w.ready
+}
+
+func (s *qosShaper) run() {
+	ticker := time.NewTicker(qosTick)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		s.lock.Lock()
+		s.refillLocked(now)
+		for class := 0; class < qosClasses && s.tokens > 0; class++ {
+			for len(s.waiting[class]) > 0 && s.tokens > 0 {
+				w := s.waiting[class][0]
+				s.waiting[class][0] = nil
+				s.waiting[class] = s.waiting[class][1:]
+				s.queued--
+				s.tokens -= w.n
+				close(w.ready)
+			}
+		}
+		s.lock.Unlock()
+	}
+}
+
+func (t *Tunnel) qosClass() int {
+	if policy := t.getPolicy(); policy != nil {
+		return policy.qos
+	}
+	return qosNormal
+}
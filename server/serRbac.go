@@ -0,0 +1,183 @@
+// Copyright 2017 longXboy, longxboyhi@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	roleReadOnly = iota + 1
+	roleOperator
+	roleAdmin
+)
+
+var roleNames = map[string]int{
+	"readonly": roleReadOnly,
+	"operator": roleOperator,
+	"admin":    roleAdmin,
+}
+
+// ApiToken binds a manage api token to a role and optionally a tenant,
+// readonly can only GET,operator can also change tunnels and approve,admin can also kick clients
+type ApiToken struct {
+	Token  string `yaml:"token"`
+	Role   string `yaml:"role,omitempty"`
+	Tenant string `yaml:"tenant,omitempty"`
+
+	role   int
+	tenant *Tenant
+}
+
+// identity is who a manage api request is made by
+type identity struct {
+	role int
+	// tenant the request is scoped to,nil for all tenants
+	tenant *Tenant
+}
+
+// initApiTokens validates the api tokens of serverConf,it must be called after initTenants
+func initApiTokens() error {
+	for i := range serverConf.ApiTokens {
+		token := &serverConf.ApiTokens[i]
+		if token.Token == "" {
+			return errors.New("api token can not be empty")
+		}
+		if token.Role == "" {
+			token.Role = "admin"
+		}
+		role, isok := roleNames[token.Role]
+		if !isok {
+			return errors.Errorf("invalid role %s of api token", token.Role)
+		}
+		token.role = role
+		if token.Tenant != "" {
+			token.tenant, isok = serverConf.Tenants[token.Tenant]
+			if !isok {
+				return errors.Errorf("tenant %s of api token not found", token.Tenant)
+			}
+		}
+	}
+	return nil
+}
+
+func tokenEqual(a string, b string) bool {
+	return b != "" && subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// lookupIdentity resolves token,the manage api is open for admin if no token is configured
+func lookupIdentity(token string) *identity {
+	if tokenEqual(token, serverConf.ManageToken) {
+		return &identity{role: roleAdmin}
+	}
+	for _, t := range serverConf.ApiTokens {
+		if tokenEqual(token, t.Token) {
+			return &identity{role: t.role, tenant: t.tenant}
+		}
+	}
+	for _, tenant := range serverConf.Tenants {
+		if tokenEqual(token, tenant.ApiToken) {
+			return &identity{role: roleAdmin, tenant: tenant}
+		}
+	}
+	if !manageTokensConfigured() {
+		return &identity{role: roleAdmin}
+	}
+	return nil
+}
+
+// manageTokensConfigured reports whether any token is configured for the manage api,tenant ones included
+func manageTokensConfigured() bool {
+	if serverConf.ManageToken != "" || len(serverConf.ApiTokens) > 0 {
+		return true
+	}
+	for _, tenant := range serverConf.Tenants {
+		if tenant.ApiToken != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// requiredRole is the least role allowed to make the request
+func requiredRole(r *http.Request) int {
+	// the audit records reveal what every token did
+	if strings.HasPrefix(r.URL.Path, "/api/v1/audit") {
+		return roleAdmin
+	}
+	// the legacy tunnel query takes its filter from the body of any method
+	if r.Method == "GET" || r.Method == "HEAD" || r.URL.Path == "/tunnel" {
+		return roleReadOnly
+	}
+	if r.Method == "DELETE" && strings.HasPrefix(r.URL.Path, "/api/v1/clients/") {
+		return roleAdmin
+	}
+	// captures hold the decrypted traffic of the users
+	if strings.HasPrefix(r.URL.Path, "/api/v1/tunnels/") && strings.HasSuffix(r.URL.Path, "/capture") {
+		return roleAdmin
+	}
+	return roleOperator
+}
+
+type identityCtxKey struct{}
+
+// manageAuth checks the bearer token(or token query parameter) of manage api requests against their role
+func manageAuth(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if token == "" {
+			token = r.URL.Query().Get("token")
+		}
+		id := lookupIdentity(token)
+		action := r.Method + " " + r.URL.Path
+		if id == nil {
+			recordAudit("api", manageActor(token, nil), r.RemoteAddr, action, "", "denied", "invalid manage token")
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprintf(w, "invalid manage token")
+			return
+		}
+		if id.role < requiredRole(r) {
+			recordAudit("api", manageActor(token, id), r.RemoteAddr, action, "", "denied", "permission denied")
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprintf(w, "permission denied")
+			return
+		}
+		r = r.WithContext(context.WithValue(r.Context(), identityCtxKey{}, id))
+		if requiredRole(r) == roleReadOnly {
+			// reads are not audited
+			h.ServeHTTP(w, r)
+			return
+		}
+		sr := &statusRecorder{ResponseWriter: w, code: http.StatusOK}
+		h.ServeHTTP(sr, r)
+		recordAudit("api", manageActor(token, id), r.RemoteAddr, action, "", strconv.Itoa(sr.code), "")
+	})
+}
+
+// requestTenant returns the tenant a manage request is scoped to,nil for the unscoped requests
+func requestTenant(r *http.Request) *Tenant {
+	id, _ := r.Context().Value(identityCtxKey{}).(*identity)
+	if id == nil {
+		return nil
+	}
+	return id.tenant
+}
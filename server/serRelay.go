@@ -0,0 +1,102 @@
+// Copyright 2017 longXboy, longxboyhi@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto/subtle"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/longXboy/lunnel/log"
+	"github.com/longXboy/lunnel/msg"
+	"github.com/longXboy/lunnel/transport"
+	"github.com/pkg/errors"
+)
+
+// Relay lets server carry the connections of clients to other lunnel servers,
+// so that clients can chain through it to a server they can't reach directly
+type Relay struct {
+	//addresses clients may ask to be relayed to,as they ask for them,empty disables relaying
+	Targets []string `yaml:"targets,omitempty"`
+	//token clients must present,empty relays for anyone
+	Token string `yaml:"token,omitempty"`
+
+	targets map[string]bool
+}
+
+func (r *Relay) normalize() error {
+	r.targets = make(map[string]bool, len(r.Targets))
+	for _, t := range r.Targets {
+		if _, _, err := net.SplitHostPort(t); err != nil {
+			return errors.Wrapf(err, "invalid target %s", t)
+		}
+		r.targets[t] = true
+	}
+	return nil
+}
+
+var (
+	// relaying is the number of connections being relayed
+	relaying int64
+	// relayRefused counts the relays refused or failed to connect
+	relayRefused uint64
+)
+
+func refuseRelay(conn net.Conn, code msg.ErrorCode, reason string, addr string) {
+	atomic.AddUint64(&relayRefused, 1)
+	msg.WriteMsg(conn, msg.TypeError, msg.Error{Msg: reason, Code: code, Detail: map[string]string{"addr": addr}})
+	conn.Close()
+	transportLog.WithFields(log.Fields{"remote_addr": conn.RemoteAddr().String(), "addr": addr, "reason": reason}).Warningln("relay refused")
+}
+
+// handleRelay connects conn to the next hop it asked for and copies between them until either is closed
+func handleRelay(conn net.Conn, r *msg.Relay) {
+	if !serverConf.Relay.targets[r.Addr] {
+		refuseRelay(conn, msg.ErrCodeRelayRefused, "relay target not allowed", r.Addr)
+		return
+	}
+	if serverConf.Relay.Token != "" && subtle.ConstantTimeCompare([]byte(r.Token), []byte(serverConf.Relay.Token)) != 1 {
+		refuseRelay(conn, msg.ErrCodeRelayRefused, "invalid relay token", r.Addr)
+		return
+	}
+	opts := transport.Options{DialTimeout: time.Duration(serverConf.HandshakeTimeout) * time.Second, Socket: serverConf.Socket}
+	next, err := transport.CreateConn(r.Addr, "tcp", opts, nil)
+	if err != nil {
+		refuseRelay(conn, msg.ErrCodeRelayUnreachable, err.Error(), r.Addr)
+		return
+	}
+	defer next.Close()
+	defer conn.Close()
+	err = msg.WriteMsg(conn, msg.TypeRelay, nil)
+	if err != nil {
+		return
+	}
+	atomic.AddInt64(&relaying, 1)
+	defer atomic.AddInt64(&relaying, -1)
+	transportLog.WithFields(log.Fields{"remote_addr": conn.RemoteAddr().String(), "addr": r.Addr}).Debugln("relaying")
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(next, conn)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(conn, next)
+		done <- struct{}{}
+	}()
+	// the hops and ends all speak over one connection,so either side closing ends it
+	<-done
+}
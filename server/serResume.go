@@ -0,0 +1,139 @@
+// Copyright 2017 longXboy, longxboyhi@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/longXboy/lunnel/log"
+	"github.com/satori/go.uuid"
+)
+
+// Resume keeps the tunnels of a dropped control for a while,so that a client
+// reconnecting from another network takes them over without losing the public addrs
+type Resume struct {
+	//seconds the tunnels are kept after the control is dropped,0 to disable resuming
+	Window int64 `yaml:"window,omitempty"`
+}
+
+var detachedLock sync.Mutex
+var detachedControls = make(map[uuid.UUID]*time.Timer)
+
+func newResumeToken() string {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		controlLog.WithFields(log.Fields{"err": err}).Errorln("generate resume token failed!")
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
+
+func (t *Tunnel) control() *Control {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	return t.ctl
+}
+
+// release closes the tunnels of c when it is served no more,unless they are
+// moved to a resumed control or kept for the resume window
+func (c *Control) release() {
+	detachedLock.Lock()
+	if c.released {
+		detachedLock.Unlock()
+		return
+	}
+	if serverConf.Resume.Window > 0 && c.resumeToken != "" && atomic.LoadInt32(&c.exited) == 0 {
+		controlLog.WithFields(log.Fields{"ctl_id": c.id, "client_id": c.ClientID.String(), "window": serverConf.Resume.Window}).Infoln("keep tunnels for resuming")
+		detachedControls[c.ClientID] = time.AfterFunc(time.Duration(serverConf.Resume.Window)*time.Second, func() {
+			detachedLock.Lock()
+			if c.released {
+				detachedLock.Unlock()
+				return
+			}
+			c.released = true
+			delete(detachedControls, c.ClientID)
+			detachedLock.Unlock()
+			c.closeTunnels()
+			dropPending(c)
+			close(c.handover)
+		})
+		detachedLock.Unlock()
+		return
+	}
+	c.released = true
+	detachedLock.Unlock()
+	c.closeTunnels()
+	dropPending(c)
+	close(c.handover)
+}
+
+// takeOver marks old as released by c,it reports false if old was released already
+func (c *Control) takeOver(old *Control) bool {
+	detachedLock.Lock()
+	defer detachedLock.Unlock()
+	if old.released {
+		return false
+	}
+	old.released = true
+	if timer, isok := detachedControls[old.ClientID]; isok {
+		timer.Stop()
+		delete(detachedControls, old.ClientID)
+	}
+	return true
+}
+
+// resume moves the tunnels of old to c without closing their listeners,
+// token must be the resume token old was handed out
+func (c *Control) resume(old *Control, token string) bool {
+	if serverConf.Resume.Window <= 0 || !tokenEqual(old.resumeToken, token) || old.tenant != c.tenant {
+		return false
+	}
+	if !c.takeOver(old) {
+		return false
+	}
+	old.tunnelLock.Lock()
+	moved := old.tunnels
+	old.tunnels = make(map[string]*Tunnel)
+	old.tunnelLock.Unlock()
+	c.tunnelLock.Lock()
+	for name, t := range moved {
+		t.lock.Lock()
+		t.ctl = c
+		t.lock.Unlock()
+		c.tunnels[name] = t
+	}
+	c.tunnelLock.Unlock()
+	dropPending(old)
+	close(old.handover)
+	old.Close()
+	controlLog.WithFields(log.Fields{"ctl_id": c.id, "old_ctl_id": old.id, "client_id": c.ClientID.String(), "tunnels": len(moved), "remote_addr": c.remoteAddr}).Infoln("control resumed")
+	recordEvent("client_resumed", c, "", c.remoteAddr)
+	return true
+}
+
+// waitResume blocks until the tunnels of ctl are moved or closed,
+// it returns the control which serves t now or nil if t is gone with ctl
+func (t *Tunnel) waitResume(ctl *Control) *Control {
+	<-ctl.handover
+	if next := t.control(); next != ctl {
+		return next
+	}
+	return nil
+}
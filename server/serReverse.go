@@ -0,0 +1,116 @@
+// Copyright 2017 longXboy, longxboyhi@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"net"
+	"time"
+
+	"github.com/longXboy/lunnel/log"
+	"github.com/longXboy/lunnel/transport"
+	"github.com/pkg/errors"
+)
+
+// ReverseClient is a client listening for server to dial it,the client speaks first over the connections
+// dialed as if it had dialed them,and asks server to dial the pipes too
+type ReverseClient struct {
+	//address the client listens on,like 10.0.0.5:7001
+	Addr string `yaml:"addr"`
+	//transport the client listens in,default to tcp
+	Transport string `yaml:"transport,omitempty"`
+	//seconds between the dials while the client is offline,default to 30
+	Interval int `yaml:"interval,omitempty"`
+}
+
+func (r *ReverseClient) normalize() error {
+	if _, _, err := net.SplitHostPort(r.Addr); err != nil {
+		return errors.Wrapf(err, "invalid addr %s", r.Addr)
+	}
+	if r.Transport == "" {
+		r.Transport = "tcp"
+	} else if r.Transport == "dns" {
+		return errors.New("dns transport can not dial reverse clients")
+	} else if _, err := transport.Lookup(r.Transport); err != nil {
+		return err
+	}
+	if r.Interval == 0 {
+		r.Interval = 30
+	} else if r.Interval < 0 {
+		return errors.New("interval can not be negative")
+	}
+	return nil
+}
+
+type reverseTarget struct {
+	conf ReverseClient
+}
+
+// reverseConn is a connection server dialed to a reverse client
+type reverseConn struct {
+	net.Conn
+	target *reverseTarget
+}
+
+func (rt *reverseTarget) dial() (net.Conn, error) {
+	opts := transport.Options{
+		DialTimeout: time.Duration(serverConf.HandshakeTimeout) * time.Second,
+		WsPath:      serverConf.Websocket.Path,
+		Heartbeat:   time.Duration(serverConf.Websocket.Heartbeat) * time.Second,
+		Socket:      serverConf.Socket,
+		Faults:      serverConf.faultInjector,
+		KcpMtu:      serverConf.KcpMtu,
+	}
+	conn, err := transport.CreateConn(rt.conf.Addr, rt.conf.Transport, opts, serverConf.Obfs.obfuscator)
+	if err != nil {
+		return nil, err
+	}
+	return &reverseConn{Conn: conn, target: rt}, nil
+}
+
+// runReverseDialer dials the control to rt every interval while it is offline,
+// and right away once a control lasted longer than that drops
+func runReverseDialer(rt *reverseTarget) {
+	interval := time.Duration(rt.conf.Interval) * time.Second
+	for {
+		start := time.Now()
+		conn, err := rt.dial()
+		if err != nil {
+			controlLog.WithFields(log.Fields{"addr": rt.conf.Addr, "transport": rt.conf.Transport, "err": err}).Debugln("dial reverse client failed")
+		} else {
+			controlLog.WithFields(log.Fields{"addr": rt.conf.Addr, "transport": rt.conf.Transport}).Debugln("dialed reverse client")
+			//returns once the control is over,or at once if the client took conn for something else
+			handleConn(conn, rt.conf.Transport)
+		}
+		if time.Since(start) < interval {
+			time.Sleep(interval - time.Since(start))
+		}
+	}
+}
+
+// reverseDial dials a pipe to the reverse client of c on its request
+func (c *Control) reverseDial() {
+	if c.reverse == nil {
+		pipeLog.WithFields(log.Fields{"ctl_id": c.id, "client_id": c.ClientID.String()}).Warningln("reverse dial asked by a client server didn't dial")
+		return
+	}
+	go func() {
+		conn, err := c.reverse.dial()
+		if err != nil {
+			pipeLog.WithFields(log.Fields{"ctl_id": c.id, "addr": c.reverse.conf.Addr, "err": err}).Warningln("dial pipe to reverse client failed!")
+			return
+		}
+		handleConn(conn, c.reverse.conf.Transport)
+	}()
+}
@@ -0,0 +1,161 @@
+// Copyright 2017 longXboy, longxboyhi@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// methodRoutes are the http tunnels serving only some methods of their host,
+// keyed by public addr and then by method.it is guarded by TunnelMapLock
+var methodRoutes = make(map[string]map[string]*Tunnel)
+
+// validMethod reports whether m is an upper case http method token
+func validMethod(m string) bool {
+	if m == "" || len(m) > 32 {
+		return false
+	}
+	for i := 0; i < len(m); i++ {
+		if m[i] < 'A' || m[i] > 'Z' {
+			return false
+		}
+	}
+	return true
+}
+
+func sameMethods(a []string, b []string) bool {
+	if len(a) == 0 && len(b) == 0 {
+		return true
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// addRouteLocked registers t by its route key and methods,it reports false if the key
+// or one of the methods is taken already,or the host is served by another client or a static route
+func addRouteLocked(t *Tunnel) bool {
+	cfg := t.tunnelConfig
+	if (cfg.Public.Schema == "http" || cfg.Public.Schema == "https") && lookupStaticRoute(cfg.Public.Host) != nil {
+		return false
+	}
+	if _, isok := TunnelMap[cfg.RouteKey()]; isok {
+		return false
+	}
+	routes := methodRoutes[cfg.PublicAddr()]
+	for _, m := range cfg.Methods {
+		if _, isok := routes[m]; isok {
+			return false
+		}
+	}
+	if other, isok := TunnelMap[cfg.PublicAddr()]; isok && other.ctl.ClientID != t.ctl.ClientID {
+		return false
+	}
+	for _, other := range routes {
+		if other.ctl.ClientID != t.ctl.ClientID {
+			return false
+		}
+	}
+	TunnelMap[cfg.RouteKey()] = t
+	if len(cfg.Methods) > 0 {
+		if routes == nil {
+			routes = make(map[string]*Tunnel)
+			methodRoutes[cfg.PublicAddr()] = routes
+		}
+		for _, m := range cfg.Methods {
+			routes[m] = t
+		}
+	}
+	return true
+}
+
+func removeRouteLocked(t *Tunnel) {
+	cfg := t.tunnelConfig
+	if TunnelMap[cfg.RouteKey()] == t {
+		delete(TunnelMap, cfg.RouteKey())
+	}
+	routes := methodRoutes[cfg.PublicAddr()]
+	for _, m := range cfg.Methods {
+		if routes[m] == t {
+			delete(routes, m)
+		}
+	}
+	if routes != nil && len(routes) == 0 {
+		delete(methodRoutes, cfg.PublicAddr())
+	}
+}
+
+// lookupHttpTunnel returns the tunnel serving method on addr,
+// falling back to the tunnel of addr without methods
+func lookupHttpTunnel(addr string, method string) (*Tunnel, bool) {
+	TunnelMapLock.RLock()
+	defer TunnelMapLock.RUnlock()
+	addr = routeAddrLocked(addr)
+	if t, isok := methodRoutes[addr][method]; isok {
+		return t, true
+	}
+	t, isok := TunnelMap[addr]
+	return t, isok
+}
+
+// httpHostServed reports whether any tunnel serves addr
+func httpHostServed(addr string) bool {
+	TunnelMapLock.RLock()
+	defer TunnelMapLock.RUnlock()
+	return hostServedLocked(routeAddrLocked(addr))
+}
+
+func hostServedLocked(addr string) bool {
+	if _, isok := TunnelMap[addr]; isok {
+		return true
+	}
+	return len(methodRoutes[addr]) > 0
+}
+
+// routeAddrLocked returns the addr of fallback_host on the same schema and port
+// if no tunnel serves addr,so that the unknown hosts reach the fallback tunnel
+func routeAddrLocked(addr string) string {
+	if serverConf.FallbackHost == "" || hostServedLocked(addr) {
+		return addr
+	}
+	schemaEnd := strings.Index(addr, "://")
+	portStart := strings.LastIndex(addr, ":")
+	if schemaEnd < 0 || portStart <= schemaEnd {
+		return addr
+	}
+	return fmt.Sprintf("%s://%s%s", addr[:schemaEnd], serverConf.FallbackHost, addr[portStart:])
+}
+
+// pathServed reports whether the http tunnel serves path by its path prefixes
+func (t *Tunnel) pathServed(path string) bool {
+	paths := t.config().Paths
+	if len(paths) == 0 || path == statusPagePath {
+		return true
+	}
+	for _, prefix := range paths {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// methodRouted reports whether the requests of addr are routed by method,
+// the requests on a keep-alive connection must be routed one by one then
+func methodRouted(addr string) bool {
+	TunnelMapLock.RLock()
+	defer TunnelMapLock.RUnlock()
+	return len(methodRoutes[addr]) > 0
+}
@@ -0,0 +1,212 @@
+// Copyright 2017 longXboy, longxboyhi@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/longXboy/lunnel/log"
+	"github.com/longXboy/lunnel/version"
+	"github.com/pkg/errors"
+)
+
+// Siem streams the security events to a siem apart from the log
+type Siem struct {
+	//cef or json,default to cef
+	Format string `yaml:"format,omitempty"`
+	//syslog daemon the events are sent to,addr must be udp://,tcp:// or tls://host:port
+	Syslog *log.Syslog `yaml:"syslog,omitempty"`
+	//url each event is posted to,as application/json or as text/plain for cef
+	Http string `yaml:"http,omitempty"`
+}
+
+const (
+	securityAuthFailed       = "auth_failed"
+	securityClientRegistered = "client_registered"
+	securityClientDuplicate  = "client_duplicate"
+	securityTunnelClaimed    = "tunnel_claimed"
+)
+
+// securityNames are the names of the kinds in cef
+var securityNames = map[string]string{
+	securityAuthFailed:       "Authentication failed",
+	securityClientRegistered: "New client registered",
+	securityClientDuplicate:  "Duplicate client id connected",
+	securityTunnelClaimed:    "Tunnel hostname claimed",
+}
+
+type securityEvent struct {
+	Time time.Time
+	Kind string
+	//0 to 10 as in cef
+	Severity int
+	ClientID string `json:",omitempty"`
+	Tenant   string `json:",omitempty"`
+	Remote   string `json:",omitempty"`
+	Actor    string `json:",omitempty"`
+	Tunnel   string `json:",omitempty"`
+	Host     string `json:",omitempty"`
+	Detail   string `json:",omitempty"`
+}
+
+// siemQueue is nil unless siem is configured
+var siemQueue chan securityEvent
+var siemSyslog *log.SyslogWriter
+var siemDropped uint64
+
+func initSiem() error {
+	conf := serverConf.Siem
+	if conf.Syslog == nil && conf.Http == "" {
+		return nil
+	}
+	if conf.Format != "" && conf.Format != "cef" && conf.Format != "json" {
+		return errors.Errorf("invalid siem format %s,must be cef or json", conf.Format)
+	}
+	if conf.Syslog != nil {
+		if conf.Syslog.Addr == "" {
+			return errors.New("siem syslog addr can not be empty")
+		}
+		w, err := log.DialSyslog(*conf.Syslog)
+		if err != nil {
+			return errors.Wrap(err, "dial siem syslog")
+		}
+		siemSyslog = w
+	}
+	siemQueue = make(chan securityEvent, 1024)
+	go runSiem(siemQueue)
+	return nil
+}
+
+// exportSecurity queues ev for the siem without blocking,the events beyond the queue are dropped
+func exportSecurity(ev securityEvent) {
+	if siemQueue == nil {
+		return
+	}
+	ev.Time = time.Now().UTC()
+	select {
+	case siemQueue <- ev:
+	default:
+		if atomic.AddUint64(&siemDropped, 1)%100 == 1 {
+			log.WithFields(log.Fields{"kind": ev.Kind, "dropped": atomic.LoadUint64(&siemDropped)}).Warningln("siem queue full,security event dropped!")
+		}
+	}
+}
+
+// securityEvent is an event of kind about the client of c
+func (c *Control) securityEvent(kind string, severity int) securityEvent {
+	return securityEvent{Kind: kind, Severity: severity, ClientID: c.ClientID.String(), Tenant: c.tenant.name(), Remote: c.remoteAddr}
+}
+
+// exportAudit exports the audit records of the requests denied by the auth server or the manage tokens
+func exportAudit(a auditRecord) {
+	if a.Result != "denied" && a.Result != "error" {
+		return
+	}
+	severity := 5
+	if a.Result == "error" {
+		severity = 3
+	}
+	exportSecurity(securityEvent{Kind: securityAuthFailed, Severity: severity, Actor: a.Actor, Remote: a.Remote,
+		Detail: strings.TrimSpace(fmt.Sprintf("%s %s %s", a.Kind, a.Result, a.Detail))})
+}
+
+func runSiem(queue chan securityEvent) {
+	for ev := range queue {
+		cef := serverConf.Siem.Format != "json"
+		var line []byte
+		if cef {
+			line = []byte(formatCef(ev))
+		} else {
+			var err error
+			line, err = json.Marshal(ev)
+			if err != nil {
+				continue
+			}
+		}
+		if siemSyslog != nil {
+			level := "info"
+			if ev.Severity >= 5 {
+				level = "warning"
+			}
+			err := siemSyslog.Send(level, string(line))
+			if err != nil {
+				log.WithFields(log.Fields{"err": err, "kind": ev.Kind}).Warningln("send security event to siem syslog failed!")
+			}
+		}
+		if serverConf.Siem.Http != "" {
+			postSiem(line, cef)
+		}
+	}
+}
+
+func postSiem(line []byte, cef bool) {
+	contentType := "application/json"
+	if cef {
+		contentType = "text/plain"
+	}
+	resp, err := webhookClient.Post(serverConf.Siem.Http, contentType, bytes.NewReader(line))
+	if err != nil {
+		log.WithFields(log.Fields{"err": err}).Warningln("post security event to siem failed!")
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		log.WithFields(log.Fields{"code": resp.StatusCode}).Warningln("siem refused security event!")
+	}
+}
+
+var cefHeaderEscaper = strings.NewReplacer(`\`, `\\`, `|`, `\|`, "\n", " ", "\r", " ")
+var cefValueEscaper = strings.NewReplacer(`\`, `\\`, `=`, `\=`, "\n", `\n`, "\r", `\r`)
+
+// formatCef formats ev as an ArcSight common event format line
+func formatCef(ev securityEvent) string {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "CEF:0|lunnel|lunnel|%s|%s|%s|%d|", cefHeaderEscaper.Replace(version.Version), cefHeaderEscaper.Replace(ev.Kind), cefHeaderEscaper.Replace(securityNames[ev.Kind]), ev.Severity)
+	ext := []string{fmt.Sprintf("rt=%d", ev.Time.UnixNano()/int64(time.Millisecond))}
+	add := func(key string, value string) {
+		if value != "" {
+			ext = append(ext, key+"="+cefValueEscaper.Replace(value))
+		}
+	}
+	if host, port, err := net.SplitHostPort(ev.Remote); err == nil {
+		add("src", host)
+		add("spt", port)
+	} else {
+		add("src", ev.Remote)
+	}
+	add("suser", ev.Actor)
+	add("dhost", ev.Host)
+	if ev.ClientID != "" {
+		add("cs1Label", "clientId")
+		add("cs1", ev.ClientID)
+	}
+	if ev.Tunnel != "" {
+		add("cs2Label", "tunnel")
+		add("cs2", ev.Tunnel)
+	}
+	if ev.Tenant != "" {
+		add("cs3Label", "tenant")
+		add("cs3", ev.Tenant)
+	}
+	add("msg", ev.Detail)
+	b.WriteString(strings.Join(ext, " "))
+	return b.String()
+}
@@ -0,0 +1,92 @@
+// Copyright 2017 longXboy, longxboyhi@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/longXboy/lunnel/log"
+	"github.com/longXboy/lunnel/vhost"
+	"github.com/pkg/errors"
+)
+
+const staticDialTimeout = time.Second * 10
+
+// StaticRoute proxies the http and https requests of its host to a backend which isn't a lunnel client,
+// https is terminated by server with the tls certificate of server
+type StaticRoute struct {
+	//address of the backend,like 10.0.0.5:8080
+	Backend string `yaml:"backend,omitempty"`
+	//dial the backend with tls,its certificate is verified against the host unless tls_skip_verify
+	BackendTls    bool `yaml:"backend_tls,omitempty"`
+	TlsSkipVerify bool `yaml:"tls_skip_verify,omitempty"`
+}
+
+func validateStaticRoutes() error {
+	for host, route := range serverConf.StaticRoutes {
+		if route == nil || route.Backend == "" {
+			return errors.Errorf("static route %s has no backend", host)
+		}
+		if host != strings.ToLower(host) {
+			return errors.Errorf("static route %s must be in lower case", host)
+		}
+		if _, _, err := net.SplitHostPort(route.Backend); err != nil {
+			return errors.Wrapf(err, "static route %s backend", host)
+		}
+	}
+	return nil
+}
+
+// lookupStaticRoute returns the static route of host,nil if host is left to the tunnels
+func lookupStaticRoute(host string) *StaticRoute {
+	return serverConf.StaticRoutes[strings.ToLower(host)]
+}
+
+// proxy copies the connection of user to the backend of r as it is,
+// sconn replays the request read while routing
+func (r *StaticRoute) proxy(sconn net.Conn, host string) {
+	atomic.AddUint64(&serverMetrics.connections, 1)
+	backend, err := net.DialTimeout("tcp", r.Backend, staticDialTimeout)
+	if err != nil {
+		atomic.AddUint64(&serverMetrics.errors, 1)
+		vhostLog.WithFields(log.Fields{"host": host, "backend": r.Backend, "err": err}).Warningln("dial static route backend failed!")
+		sconn.Write([]byte(vhost.BadGateWayResp()))
+		return
+	}
+	if r.BackendTls {
+		backend = tls.Client(backend, &tls.Config{ServerName: host, InsecureSkipVerify: r.TlsSkipVerify})
+	}
+	defer backend.Close()
+	sconn.SetDeadline(time.Time{})
+	p1die := make(chan struct{})
+	p2die := make(chan struct{})
+	go func() {
+		io.Copy(backend, sconn)
+		close(p1die)
+	}()
+	go func() {
+		io.Copy(sconn, backend)
+		close(p2die)
+	}()
+	select {
+	case <-p1die:
+	case <-p2die:
+	}
+}
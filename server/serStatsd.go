@@ -0,0 +1,104 @@
+// Copyright 2017 longXboy, longxboyhi@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/longXboy/lunnel/log"
+)
+
+// Statsd pushes the server metrics to a statsd(or datadog agent) server
+type Statsd struct {
+	//host:port of the statsd server,empty disables the emitter
+	Addr   string `yaml:"addr,omitempty"`
+	Prefix string `yaml:"prefix,omitempty"`
+	//datadog style tags like env:prod
+	Tags []string `yaml:"tags,omitempty"`
+	//seconds between two pushes,default to 10
+	Interval int64 `yaml:"interval,omitempty"`
+}
+
+// maxStatsdPacket keeps the packets under the common mtu
+const maxStatsdPacket = 1400
+
+type statsdWriter struct {
+	conn   net.Conn
+	prefix string
+	tags   string
+	buf    bytes.Buffer
+}
+
+func (sw *statsdWriter) metric(name string, value interface{}, kind string) {
+	line := fmt.Sprintf("%s%s:%v|%s%s\n", sw.prefix, name, value, kind, sw.tags)
+	if sw.buf.Len()+len(line) > maxStatsdPacket {
+		sw.flush()
+	}
+	sw.buf.WriteString(line)
+}
+
+func (sw *statsdWriter) flush() {
+	if sw.buf.Len() == 0 {
+		return
+	}
+	_, err := sw.conn.Write(sw.buf.Bytes())
+	if err != nil {
+		log.WithFields(log.Fields{"err": err}).Debugln("write statsd packet failed!")
+	}
+	sw.buf.Reset()
+}
+
+func runStatsd() {
+	conf := serverConf.Statsd
+	conn, err := net.Dial("udp", conf.Addr)
+	if err != nil {
+		log.WithFields(log.Fields{"addr": conf.Addr, "err": err}).Errorln("dial statsd failed!")
+		return
+	}
+	defer conn.Close()
+	sw := &statsdWriter{conn: conn}
+	if conf.Prefix != "" {
+		sw.prefix = strings.TrimSuffix(conf.Prefix, ".") + "."
+	}
+	if len(conf.Tags) > 0 {
+		sw.tags = "|#" + strings.Join(conf.Tags, ",")
+	}
+	interval := conf.Interval
+	if interval <= 0 {
+		interval = 10
+	}
+	ticker := time.NewTicker(time.Duration(interval) * time.Second)
+	defer ticker.Stop()
+	last := snapshotMetrics()
+	for range ticker.C {
+		s := snapshotMetrics()
+		sw.metric("clients", s.Clients, "g")
+		sw.metric("tunnels", s.Tunnels, "g")
+		sw.metric("streams", s.Streams, "g")
+		// counters are sent as the increments since last push
+		sw.metric("connections", s.Connections-last.Connections, "c")
+		sw.metric("handshakes", s.Handshakes-last.Handshakes, "c")
+		sw.metric("handshake_errors", s.HandshakeErrors-last.HandshakeErrors, "c")
+		sw.metric("errors", s.Errors-last.Errors, "c")
+		sw.metric("bytes_in", s.BytesIn-last.BytesIn, "c")
+		sw.metric("bytes_out", s.BytesOut-last.BytesOut, "c")
+		sw.flush()
+		last = s
+	}
+}
@@ -0,0 +1,256 @@
+// Copyright 2017 longXboy, longxboyhi@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/longXboy/lunnel/vhost"
+)
+
+const statusPagePath = "/_lunnel/status"
+
+// maxLatencySamples is how many recent latencies the percentiles are computed from
+const maxLatencySamples = 1024
+
+// latencyBuckets are the upper bounds in seconds of the buckets of the request duration histogram
+var latencyBuckets = [...]float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// requestStats counts the requests of a http tunnel per minute in the last hour and keeps the recent latencies,
+// those proxied as a byte stream are followed until an upgrade or a response read until close
+type requestStats struct {
+	lock      sync.Mutex
+	total     uint64
+	minutes   [60]uint64
+	minuteAt  [60]int64
+	latencies [maxLatencySamples]time.Duration
+	observed  int
+	//responses by status class,1xx at 1 to 5xx at 5 and the unparsed ones at 0
+	statuses [6]uint64
+	//requests per latencyBuckets,not cumulative,the slower ones are only in durationCount
+	buckets       [len(latencyBuckets)]uint64
+	durationSum   time.Duration
+	durationCount uint64
+}
+
+func (s *requestStats) count(now time.Time) {
+	minute := now.Unix() / 60
+	i := minute % 60
+	s.lock.Lock()
+	if s.minuteAt[i] != minute {
+		s.minuteAt[i] = minute
+		s.minutes[i] = 0
+	}
+	s.minutes[i]++
+	s.total++
+	s.lock.Unlock()
+}
+
+// observe records the response of status which took d to its header,status is 0 if unknown
+func (s *requestStats) observe(status int, d time.Duration) {
+	class := status / 100
+	if class < 1 || class > 5 {
+		class = 0
+	}
+	s.lock.Lock()
+	s.latencies[s.observed%maxLatencySamples] = d
+	s.observed++
+	s.statuses[class]++
+	for i, le := range latencyBuckets {
+		if d.Seconds() <= le {
+			s.buckets[i]++
+			break
+		}
+	}
+	s.durationSum += d
+	s.durationCount++
+	s.lock.Unlock()
+}
+
+// track follows the requests and responses proxied as a byte stream on conn,
+// counting each request and observing the latency until the header of its response
+func (s *requestStats) track(conn net.Conn) net.Conn {
+	mc := &meteredConn{Conn: conn, stats: s}
+	mc.requests = vhost.NewRequestFramer(mc.request)
+	mc.responses = vhost.NewResponseFramer(mc.response)
+	return mc
+}
+
+type pendingRequest struct {
+	method string
+	start  time.Time
+}
+
+// meteredConn is read for requests and written with responses by the two directions of proxyConn
+type meteredConn struct {
+	net.Conn
+	stats     *requestStats
+	requests  *vhost.HttpFramer
+	responses *vhost.HttpFramer
+	lock      sync.Mutex
+	pending   []pendingRequest
+}
+
+func (mc *meteredConn) request(method string) {
+	now := time.Now()
+	mc.stats.count(now)
+	mc.lock.Lock()
+	mc.pending = append(mc.pending, pendingRequest{method: method, start: now})
+	mc.lock.Unlock()
+}
+
+func (mc *meteredConn) response(status int) string {
+	mc.lock.Lock()
+	if len(mc.pending) == 0 {
+		// sent before any request was followed,its latency is unknown
+		mc.lock.Unlock()
+		return ""
+	}
+	req := mc.pending[0]
+	mc.pending = mc.pending[1:]
+	mc.lock.Unlock()
+	mc.stats.observe(status, time.Since(req.start))
+	return req.method
+}
+
+func (mc *meteredConn) Read(p []byte) (int, error) {
+	n, err := mc.Conn.Read(p)
+	if n > 0 && !mc.requests.Stopped() {
+		mc.requests.Feed(p[:n])
+	}
+	return n, err
+}
+
+func (mc *meteredConn) Write(p []byte) (int, error) {
+	if !mc.responses.Stopped() {
+		mc.responses.Feed(p)
+	}
+	return mc.Conn.Write(p)
+}
+
+type tunnelStatus struct {
+	Name        string
+	Public      string
+	CreatedAt   time.Time
+	Uptime      string
+	Streams     int64
+	BytesIn     uint64
+	BytesOut    uint64
+	Requests    uint64
+	Requests1m  uint64
+	Requests5m  uint64
+	Requests60m uint64
+	//milliseconds to the first byte of response
+	LatencyP50 float64
+	LatencyP90 float64
+	LatencyP99 float64
+}
+
+func percentile(sorted []time.Duration, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(float64(len(sorted)-1) * p)
+	return float64(sorted[i]) / float64(time.Millisecond)
+}
+
+func (t *Tunnel) status(now time.Time) tunnelStatus {
+	st := tunnelStatus{
+		Name:      t.name,
+		Public:    t.config().PublicAddr(),
+		CreatedAt: t.createdAt,
+		Uptime:    now.Sub(t.createdAt).Truncate(time.Second).String(),
+		Streams:   atomic.LoadInt64(&t.streams),
+		BytesIn:   atomic.LoadUint64(&t.bytesIn),
+		BytesOut:  atomic.LoadUint64(&t.bytesOut),
+	}
+	s := &t.stats
+	minute := now.Unix() / 60
+	s.lock.Lock()
+	st.Requests = s.total
+	for i := range s.minutes {
+		age := minute - s.minuteAt[i]
+		if age < 0 || age >= 60 {
+			continue
+		}
+		st.Requests60m += s.minutes[i]
+		if age < 5 {
+			st.Requests5m += s.minutes[i]
+		}
+		if age < 1 {
+			st.Requests1m += s.minutes[i]
+		}
+	}
+	n := s.observed
+	if n > maxLatencySamples {
+		n = maxLatencySamples
+	}
+	latencies := make([]time.Duration, n)
+	copy(latencies, s.latencies[:n])
+	s.lock.Unlock()
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	st.LatencyP50 = percentile(latencies, 0.5)
+	st.LatencyP90 = percentile(latencies, 0.9)
+	st.LatencyP99 = percentile(latencies, 0.99)
+	return st
+}
+
+// statusPage answers the status page request of info,json is returned if format=json is in the query
+func (t *Tunnel) statusPage(info map[string]string) string {
+	query, _ := url.ParseQuery(info["Query"])
+	token := query.Get("token")
+	if token == "" && strings.HasPrefix(info["Authorization"], "Bearer ") {
+		token = strings.TrimPrefix(info["Authorization"], "Bearer ")
+	}
+	if !tokenEqual(token, t.config().StatusToken) {
+		return vhost.StatusTokenRequiredResp()
+	}
+	st := t.status(time.Now())
+	if query.Get("format") == "json" {
+		body, err := json.Marshal(st)
+		if err != nil {
+			return vhost.BadGateWayResp()
+		}
+		return vhost.StatusPageResp("application/json", string(body))
+	}
+	var buf bytes.Buffer
+	buf.WriteString("<!DOCTYPE html><html><head><meta charset=\"utf-8\"><title>status</title>")
+	buf.WriteString("<style>body{font-family:sans-serif;margin:20px}td{padding:4px 12px;border-bottom:1px solid #ddd}</style></head><body>")
+	fmt.Fprintf(&buf, "<h1>%s</h1><table>", html.EscapeString(st.Name))
+	rows := [][2]string{
+		{"Public", st.Public},
+		{"Up since", st.CreatedAt.Format(time.RFC3339)},
+		{"Uptime", st.Uptime},
+		{"Active streams", fmt.Sprint(st.Streams)},
+		{"Bytes in/out", fmt.Sprintf("%d / %d", st.BytesIn, st.BytesOut)},
+		{"Requests(1m/5m/60m/total)", fmt.Sprintf("%d / %d / %d / %d", st.Requests1m, st.Requests5m, st.Requests60m, st.Requests)},
+		{"Latency p50/p90/p99", fmt.Sprintf("%.1fms / %.1fms / %.1fms", st.LatencyP50, st.LatencyP90, st.LatencyP99)},
+	}
+	for _, row := range rows {
+		fmt.Fprintf(&buf, "<tr><td>%s</td><td>%s</td></tr>", html.EscapeString(row[0]), html.EscapeString(row[1]))
+	}
+	buf.WriteString("</table></body></html>")
+	return vhost.StatusPageResp("text/html; charset=utf-8", buf.String())
+}
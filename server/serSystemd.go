@@ -0,0 +1,47 @@
+// Copyright 2017 longXboy, longxboyhi@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"sync"
+	"time"
+
+	"github.com/longXboy/lunnel/log"
+	"github.com/longXboy/lunnel/util"
+)
+
+// listening counts the listeners Start starts,systemd is told the server is ready once all are bound
+var listening sync.WaitGroup
+
+// watchdogLockTimeout is how long the maps may stay locked before the server is taken as hung
+const watchdogLockTimeout = time.Second * 10
+
+// notifySystemd sends READY=1 to systemd after every listener is bound and then feeds
+// the watchdog of systemd while the control and tunnel maps can be locked
+func notifySystemd() {
+	listening.Wait()
+	err := util.SdNotify("READY=1")
+	if err != nil {
+		log.WithFields(log.Fields{"err": err}).Warningln("notify systemd ready failed!")
+	}
+	util.RunWatchdog(func() bool {
+		return util.Responsive(func() {
+			ControlMapLock.Lock()
+			ControlMapLock.Unlock()
+			TunnelMapLock.Lock()
+			TunnelMapLock.Unlock()
+		}, watchdogLockTimeout)
+	})
+}
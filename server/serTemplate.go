@@ -0,0 +1,91 @@
+// Copyright 2017 longXboy, longxboyhi@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// hostLabel turns v into a dns label,the letters are lowered and the other characters
+// than letters,digits and '-' are replaced by '-'
+func hostLabel(v string) string {
+	label := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '-':
+			return r
+		case r >= 'A' && r <= 'Z':
+			return r + 'a' - 'A'
+		}
+		return '-'
+	}, v)
+	return strings.Trim(label, "-")
+}
+
+// hostVar is the value of the variable of host templates,ok is false for unknown variables
+func (c *Control) hostVar(tunnel string, name string) (string, bool) {
+	switch name {
+	case "hostname":
+		return hostLabel(c.hostname), true
+	case "tunnel":
+		return hostLabel(tunnel), true
+	case "client_id":
+		return c.ClientID.String(), true
+	case "client_id_short":
+		return c.ClientID.String()[:8], true
+	case "tenant":
+		return hostLabel(c.tenant.name()), true
+	case "domain":
+		return c.domain(), true
+	}
+	return "", false
+}
+
+// expandHost expands the variables in braces of the host template of tunnel,
+// like {hostname}-{tunnel}.example.com or {client_id_short}.{domain}
+func (c *Control) expandHost(tunnel string, host string) (string, error) {
+	if !strings.Contains(host, "{") {
+		return host, nil
+	}
+	var expanded strings.Builder
+	rest := host
+	for {
+		start := strings.IndexByte(rest, '{')
+		if start < 0 {
+			expanded.WriteString(rest)
+			break
+		}
+		end := strings.IndexByte(rest[start:], '}')
+		if end < 0 {
+			return "", errors.Errorf("unterminated variable in host template %s", host)
+		}
+		name := rest[start+1 : start+end]
+		v, isok := c.hostVar(tunnel, name)
+		if !isok {
+			return "", errors.Errorf("unknown variable {%s} in host template %s", name, host)
+		}
+		if v == "" {
+			return "", errors.Errorf("variable {%s} of host template %s is empty", name, host)
+		}
+		expanded.WriteString(rest[:start])
+		expanded.WriteString(v)
+		rest = rest[start+end+1:]
+	}
+	if strings.ContainsAny(expanded.String(), "{}") {
+		return "", errors.Errorf("invalid host template %s", host)
+	}
+	return expanded.String(), nil
+}
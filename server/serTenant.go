@@ -0,0 +1,184 @@
+// Copyright 2017 longXboy, longxboyhi@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/longXboy/lunnel/msg"
+	"github.com/pkg/errors"
+)
+
+// Tenant partitions hostnames,ports,quotas and the manage api between independent teams,
+// clients belong to the tenant whose tokens contain their auth token
+type Tenant struct {
+	Name string `yaml:"-"`
+	//auth tokens of the clients of this tenant
+	Tokens []string `yaml:"tokens,omitempty"`
+	//manage api token which only sees and changes the clients and tunnels of this tenant
+	ApiToken string `yaml:"api_token,omitempty"`
+	//http and https hosts must be Domain or its sub domains,and sub domains are allocated under it
+	Domain string `yaml:"domain,omitempty"`
+	//public ports of tcp and udp tunnels,in "20000-20999" format
+	Ports string `yaml:"ports,omitempty"`
+	//tunnels the tenant can register at most,0 is unlimited
+	MaxTunnels int `yaml:"max_tunnels,omitempty"`
+	//byte cap of every tunnel of the tenant,replacing the tunnel_byte_cap of server
+	TunnelByteCap uint64 `yaml:"tunnel_byte_cap,omitempty"`
+
+	minPort uint16
+	maxPort uint16
+}
+
+func parsePortRange(s string) (uint16, uint16, error) {
+	bounds := strings.SplitN(s, "-", 2)
+	if len(bounds) != 2 {
+		return 0, 0, errors.Errorf("invalid port range %s", s)
+	}
+	min, err := strconv.ParseUint(bounds[0], 10, 16)
+	if err != nil {
+		return 0, 0, errors.Errorf("invalid port range %s", s)
+	}
+	max, err := strconv.ParseUint(bounds[1], 10, 16)
+	if err != nil || min == 0 || min > max {
+		return 0, 0, errors.Errorf("invalid port range %s", s)
+	}
+	return uint16(min), uint16(max), nil
+}
+
+// initTenants validates the tenants of serverConf
+func initTenants() error {
+	tokens := make(map[string]string)
+	for name, tenant := range serverConf.Tenants {
+		if tenant == nil {
+			tenant = new(Tenant)
+			serverConf.Tenants[name] = tenant
+		}
+		tenant.Name = name
+		for _, token := range tenant.Tokens {
+			if other, isok := tokens[token]; isok {
+				return errors.Errorf("tenant %s and %s share the same token", other, name)
+			}
+			tokens[token] = name
+		}
+		if tenant.Ports != "" {
+			var err error
+			tenant.minPort, tenant.maxPort, err = parsePortRange(tenant.Ports)
+			if err != nil {
+				return errors.Wrapf(err, "tenant %s", name)
+			}
+		}
+	}
+	return nil
+}
+
+func tenantByToken(token string) *Tenant {
+	if token == "" {
+		return nil
+	}
+	for _, tenant := range serverConf.Tenants {
+		for _, t := range tenant.Tokens {
+			if t == token {
+				return tenant
+			}
+		}
+	}
+	return nil
+}
+
+func (t *Tenant) name() string {
+	if t == nil {
+		return ""
+	}
+	return t.Name
+}
+
+// domain is the domain the hosts of the control's tunnels are under
+func (c *Control) domain() string {
+	if c.tenant != nil && c.tenant.Domain != "" {
+		return c.tenant.Domain
+	}
+	return serverConf.ServerDomain
+}
+
+func (c *Control) checkHost(host string) error {
+	if c.tenant == nil || c.tenant.Domain == "" {
+		return nil
+	}
+	if host != c.tenant.Domain && !strings.HasSuffix(host, "."+c.tenant.Domain) {
+		return errors.Errorf("host %s is not under the domain(%s) of tenant", host, c.tenant.Domain)
+	}
+	return nil
+}
+
+// checkTenantLimit checks a new tunnel against the host domain and tunnel count of the tenant
+func (c *Control) checkTenantLimit(tunnel msg.Tunnel) error {
+	if c.tenant == nil {
+		return nil
+	}
+	if (tunnel.Public.Schema == "http" || tunnel.Public.Schema == "https") && tunnel.Public.Host != "" {
+		err := c.checkHost(tunnel.Public.Host)
+		if err != nil {
+			return err
+		}
+	}
+	if c.tenant.MaxTunnels > 0 && tenantTunnels(c.tenant) >= c.tenant.MaxTunnels {
+		return errors.Errorf("tenant can register %d tunnels at most", c.tenant.MaxTunnels)
+	}
+	return nil
+}
+
+// tenantTunnels counts the tunnels registered by the clients of tenant
+func tenantTunnels(tenant *Tenant) int {
+	var count int
+	TunnelMapLock.RLock()
+	for _, t := range TunnelMap {
+		if t.ctl.tenant == tenant {
+			count++
+		}
+	}
+	TunnelMapLock.RUnlock()
+	return count
+}
+
+// listenPort listens the public port of tcp and udp tunnels in the port range of the tenant,
+// port 0 takes the first free port of the range
+func (c *Control) listenPort(schema string, port uint16) (net.Listener, net.PacketConn, uint16, error) {
+	if c.tenant == nil || c.tenant.maxPort == 0 {
+		return listenPublic(schema, port)
+	}
+	if port != 0 {
+		if port < c.tenant.minPort || port > c.tenant.maxPort {
+			return nil, nil, 0, errors.Errorf("port %d out of the range(%s) of tenant", port, c.tenant.Ports)
+		}
+		return listenPublic(schema, port)
+	}
+	for p := int(c.tenant.minPort); p <= int(c.tenant.maxPort); p++ {
+		lis, pc, allocated, err := listenPublic(schema, uint16(p))
+		if err == nil {
+			return lis, pc, allocated, nil
+		}
+	}
+	return nil, nil, 0, errors.Errorf("no free port in the range(%s) of tenant", c.tenant.Ports)
+}
+
+// visible reports whether the control can be seen by the manage request
+func visible(r *http.Request, c *Control) bool {
+	tenant := requestTenant(r)
+	return tenant == nil || c.tenant == tenant
+}
@@ -0,0 +1,93 @@
+// Copyright 2017 longXboy, longxboyhi@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"sync"
+	"time"
+
+	"github.com/longXboy/lunnel/log"
+)
+
+// ticketKeysKept is how many ticket keys are accepted,tickets issued within
+// the last ticketKeysKept-1 rotations can still be resumed
+const ticketKeysKept = 3
+
+// ticketKeys encrypt the tls session tickets of the controls and https tunnels,
+// the first one encrypts the new tickets
+var ticketKeys struct {
+	sync.RWMutex
+	keys [][32]byte
+}
+
+// deriveTicketKey makes the key of a rotation epoch from ticket_secret,
+// so that servers sharing the secret resume the sessions of each other
+func deriveTicketKey(secret string, epoch int64) [32]byte {
+	var key [32]byte
+	mac := hmac.New(sha256.New, []byte(secret))
+	binary.Write(mac, binary.BigEndian, epoch)
+	copy(key[:], mac.Sum(nil))
+	return key
+}
+
+func rotateTicketKeys(now time.Time) {
+	rotation := time.Duration(serverConf.Tls.TicketRotation) * time.Second
+	var key [32]byte
+	if serverConf.Tls.TicketSecret != "" {
+		epoch := now.UnixNano() / int64(rotation)
+		keys := make([][32]byte, 0, ticketKeysKept)
+		for i := int64(0); i < ticketKeysKept; i++ {
+			keys = append(keys, deriveTicketKey(serverConf.Tls.TicketSecret, epoch-i))
+		}
+		ticketKeys.Lock()
+		ticketKeys.keys = keys
+		ticketKeys.Unlock()
+		return
+	}
+	_, err := rand.Read(key[:])
+	if err != nil {
+		log.WithFields(log.Fields{"err": err}).Errorln("generate tls ticket key failed!")
+		return
+	}
+	ticketKeys.Lock()
+	ticketKeys.keys = append([][32]byte{key}, ticketKeys.keys...)
+	if len(ticketKeys.keys) > ticketKeysKept {
+		ticketKeys.keys = ticketKeys.keys[:ticketKeysKept]
+	}
+	ticketKeys.Unlock()
+}
+
+// runTicketRotation rotates the ticket keys every ticket_rotation seconds,
+// the keys derived from ticket_secret change at the same moments on every server
+func runTicketRotation() {
+	rotation := time.Duration(serverConf.Tls.TicketRotation) * time.Second
+	rotateTicketKeys(time.Now())
+	for {
+		now := time.Now()
+		next := now.Truncate(rotation).Add(rotation)
+		time.Sleep(next.Sub(now))
+		rotateTicketKeys(time.Now())
+	}
+}
+
+func currentTicketKeys() [][32]byte {
+	ticketKeys.RLock()
+	defer ticketKeys.RUnlock()
+	return ticketKeys.keys
+}
@@ -0,0 +1,129 @@
+// Copyright 2017 longXboy, longxboyhi@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/longXboy/lunnel/log"
+	"github.com/longXboy/smux"
+)
+
+// connTimeout ends a proxied connection once it is idle for longer than idle
+// or has lived for longer than lifetime,zero disables either of them
+type connTimeout struct {
+	idle       time.Duration
+	lifetime   time.Duration
+	start      time.Time
+	lastActive int64
+}
+
+func newConnTimeout(idleTimeout int, maxLifetime int) *connTimeout {
+	now := time.Now()
+	return &connTimeout{
+		idle:       time.Duration(idleTimeout) * time.Second,
+		lifetime:   time.Duration(maxLifetime) * time.Second,
+		start:      now,
+		lastActive: now.UnixNano(),
+	}
+}
+
+func (ct *connTimeout) touch() {
+	atomic.StoreInt64(&ct.lastActive, time.Now().UnixNano())
+}
+
+func (ct *connTimeout) deadline() time.Time {
+	var deadline time.Time
+	if ct.lifetime > 0 {
+		deadline = ct.start.Add(ct.lifetime)
+	}
+	if ct.idle > 0 {
+		idleDeadline := time.Unix(0, atomic.LoadInt64(&ct.lastActive)).Add(ct.idle)
+		if deadline.IsZero() || idleDeadline.Before(deadline) {
+			deadline = idleDeadline
+		}
+	}
+	return deadline
+}
+
+// expired returns a channel closed when the connection times out,
+// it is nil if no timeout is configured so that it never fires in a select
+func (ct *connTimeout) expired(done <-chan struct{}) <-chan struct{} {
+	if ct.idle <= 0 && ct.lifetime <= 0 {
+		return nil
+	}
+	expired := make(chan struct{})
+	go func() {
+		timer := time.NewTimer(time.Until(ct.deadline()))
+		defer timer.Stop()
+		for {
+			select {
+			case <-timer.C:
+				// the connection may have been active since the timer was set
+				wait := time.Until(ct.deadline())
+				if wait <= 0 {
+					close(expired)
+					return
+				}
+				timer.Reset(wait)
+			case <-done:
+				return
+			}
+		}
+	}()
+	return expired
+}
+
+type writeDeadliner interface {
+	SetWriteDeadline(t time.Time) error
+}
+
+// writeWithDeadline writes p to w within write_timeout if w supports write deadlines,
+// the deadline is cleared afterwards for the writes which aren't proxied traffic
+func writeWithDeadline(w io.Writer, p []byte) (int, error) {
+	d, isok := w.(writeDeadliner)
+	if !isok || serverConf.WriteTimeout <= 0 {
+		return w.Write(p)
+	}
+	d.SetWriteDeadline(time.Now().Add(time.Duration(serverConf.WriteTimeout) * time.Second))
+	n, err := w.Write(p)
+	if err == nil {
+		d.SetWriteDeadline(time.Time{})
+	}
+	return n, err
+}
+
+func isTimeout(err error) bool {
+	ne, isok := err.(net.Error)
+	return isok && ne.Timeout()
+}
+
+// stalled records a proxied connection the writes of which were blocked,
+// it is closed by the caller as the copying stops with the error
+func (tw *trafficWriter) stalled() {
+	atomic.AddUint64(&serverMetrics.stalls, 1)
+	peer := "visitor"
+	if _, isok := tw.w.(*smux.Stream); isok {
+		peer = "client"
+	}
+	fields := log.Fields{"peer": peer, "write_timeout": serverConf.WriteTimeout}
+	if tw.owner != nil {
+		fields["tunnel"] = tw.owner.name
+	}
+	log.WithFields(fields).Warningln("proxied connection stalled,closed!")
+}
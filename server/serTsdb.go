@@ -0,0 +1,190 @@
+// Copyright 2017 longXboy, longxboyhi@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/longXboy/lunnel/log"
+	"github.com/pkg/errors"
+)
+
+// Tsdb reports the global and per-tunnel metrics to influxdb or graphite periodically
+type Tsdb struct {
+	//influx or graphite,empty disables the reporter
+	Format string `yaml:"format,omitempty"`
+	//write url of influxdb,like http://127.0.0.1:8086/write?db=lunnel
+	Url string `yaml:"url,omitempty"`
+	//host:port of the graphite plaintext receiver
+	Addr   string            `yaml:"addr,omitempty"`
+	Prefix string            `yaml:"prefix,omitempty"`
+	Tags   map[string]string `yaml:"tags,omitempty"`
+	//seconds between two reports,default to 10
+	Interval int64 `yaml:"interval,omitempty"`
+}
+
+type tunnelMetric struct {
+	name     string
+	clientId string
+	schema   string
+	streams  int64
+	bytesIn  uint64
+	bytesOut uint64
+}
+
+func snapshotTunnels() []tunnelMetric {
+	var tms []tunnelMetric
+	TunnelMapLock.RLock()
+	for _, t := range TunnelMap {
+		tms = append(tms, tunnelMetric{
+			name:     t.name,
+			clientId: t.ctl.ClientID.String(),
+			schema:   t.tunnelConfig.Public.Schema,
+			streams:  atomic.LoadInt64(&t.streams),
+			bytesIn:  atomic.LoadUint64(&t.bytesIn),
+			bytesOut: atomic.LoadUint64(&t.bytesOut),
+		})
+	}
+	TunnelMapLock.RUnlock()
+	return tms
+}
+
+var influxEscaper = strings.NewReplacer(",", "\\,", " ", "\\ ", "=", "\\=")
+
+func sortedTags(tags map[string]string) []string {
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func influxTags(tags map[string]string) string {
+	var buf bytes.Buffer
+	for _, k := range sortedTags(tags) {
+		fmt.Fprintf(&buf, ",%s=%s", influxEscaper.Replace(k), influxEscaper.Replace(tags[k]))
+	}
+	return buf.String()
+}
+
+func withTags(base map[string]string, extra map[string]string) map[string]string {
+	tags := make(map[string]string, len(base)+len(extra))
+	for k, v := range base {
+		tags[k] = v
+	}
+	for k, v := range extra {
+		tags[k] = v
+	}
+	return tags
+}
+
+// encodeInflux encodes the metrics in influxdb line protocol
+func encodeInflux(conf Tsdb, s metricSnapshot, tms []tunnelMetric, now time.Time) []byte {
+	var buf bytes.Buffer
+	prefix := conf.Prefix
+	if prefix == "" {
+		prefix = "lunnel"
+	}
+	ts := now.UnixNano()
+	fmt.Fprintf(&buf, "%s_global%s clients=%di,tunnels=%di,streams=%di,connections=%di,handshakes=%di,handshake_errors=%di,errors=%di,bytes_in=%di,bytes_out=%di %d\n",
+		prefix, influxTags(conf.Tags), s.Clients, s.Tunnels, s.Streams, s.Connections, s.Handshakes, s.HandshakeErrors, s.Errors, s.BytesIn, s.BytesOut, ts)
+	for _, tm := range tms {
+		tags := withTags(conf.Tags, map[string]string{"tunnel": tm.name, "client_id": tm.clientId, "schema": tm.schema})
+		fmt.Fprintf(&buf, "%s_tunnel%s streams=%di,bytes_in=%di,bytes_out=%di %d\n", prefix, influxTags(tags), tm.streams, tm.bytesIn, tm.bytesOut, ts)
+	}
+	return buf.Bytes()
+}
+
+var graphiteEscaper = strings.NewReplacer(".", "_", " ", "_", ";", "_", "=", "_")
+
+// encodeGraphite encodes the metrics in graphite plaintext protocol,tags are appended in the graphite 1.1 format
+func encodeGraphite(conf Tsdb, s metricSnapshot, tms []tunnelMetric, now time.Time) []byte {
+	var buf bytes.Buffer
+	prefix := strings.TrimSuffix(conf.Prefix, ".")
+	if prefix == "" {
+		prefix = "lunnel"
+	}
+	var tags bytes.Buffer
+	for _, k := range sortedTags(conf.Tags) {
+		fmt.Fprintf(&tags, ";%s=%s", graphiteEscaper.Replace(k), graphiteEscaper.Replace(conf.Tags[k]))
+	}
+	ts := now.Unix()
+	write := func(path string, value interface{}) {
+		fmt.Fprintf(&buf, "%s.%s%s %v %d\n", prefix, path, tags.String(), value, ts)
+	}
+	write("global.clients", s.Clients)
+	write("global.tunnels", s.Tunnels)
+	write("global.streams", s.Streams)
+	write("global.connections", s.Connections)
+	write("global.handshakes", s.Handshakes)
+	write("global.handshake_errors", s.HandshakeErrors)
+	write("global.errors", s.Errors)
+	write("global.bytes_in", s.BytesIn)
+	write("global.bytes_out", s.BytesOut)
+	for _, tm := range tms {
+		path := fmt.Sprintf("tunnels.%s.%s", graphiteEscaper.Replace(tm.clientId), graphiteEscaper.Replace(tm.name))
+		write(path+".streams", tm.streams)
+		write(path+".bytes_in", tm.bytesIn)
+		write(path+".bytes_out", tm.bytesOut)
+	}
+	return buf.Bytes()
+}
+
+func reportTsdb(conf Tsdb, now time.Time) error {
+	s := snapshotMetrics()
+	tms := snapshotTunnels()
+	if conf.Format == "graphite" {
+		conn, err := net.DialTimeout("tcp", conf.Addr, time.Second*10)
+		if err != nil {
+			return errors.Wrap(err, "dial graphite")
+		}
+		defer conn.Close()
+		conn.SetWriteDeadline(now.Add(time.Second * 10))
+		_, err = conn.Write(encodeGraphite(conf, s, tms, now))
+		return errors.Wrap(err, "write graphite")
+	}
+	resp, err := webhookClient.Post(conf.Url, "text/plain", bytes.NewReader(encodeInflux(conf, s, tms, now)))
+	if err != nil {
+		return errors.Wrap(err, "post influxdb")
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return errors.Errorf("influxdb response code %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func runTsdbReporter() {
+	conf := serverConf.Tsdb
+	interval := conf.Interval
+	if interval <= 0 {
+		interval = 10
+	}
+	ticker := time.NewTicker(time.Duration(interval) * time.Second)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		err := reportTsdb(conf, now)
+		if err != nil {
+			log.WithFields(log.Fields{"format": conf.Format, "err": err}).Warningln("report metrics to tsdb failed!")
+		}
+	}
+}
@@ -0,0 +1,195 @@
+// Copyright 2017 longXboy, longxboyhi@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/longXboy/lunnel/log"
+	"github.com/longXboy/lunnel/util"
+)
+
+const (
+	udpSessionTimeout = time.Second * 60
+	udpSessionBacklog = 128
+	// udpMaxSessions bounds the remote addresses relayed at once by a tunnel without max_conns
+	udpMaxSessions = 4096
+)
+
+// udpSession relays the datagrams of one remote address over a stream
+type udpSession struct {
+	addr       net.Addr
+	out        chan []byte
+	die        chan struct{}
+	dieOnce    sync.Once
+	lastActive int64
+}
+
+func (s *udpSession) close() {
+	s.dieOnce.Do(func() {
+		close(s.die)
+	})
+}
+
+func (s *udpSession) touch() {
+	atomic.StoreInt64(&s.lastActive, time.Now().UnixNano())
+}
+
+func (s *udpSession) idle() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&s.lastActive)))
+}
+
+func (t *Tunnel) serveUdp(pc net.PacketConn) {
+	var lock sync.Mutex
+	sessions := make(map[string]*udpSession)
+	done := make(chan struct{})
+	defer func() {
+		close(done)
+		lock.Lock()
+		for _, sess := range sessions {
+			sess.close()
+		}
+		lock.Unlock()
+	}()
+	go func() {
+		ticker := time.NewTicker(udpSessionTimeout / 4)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				lock.Lock()
+				for _, sess := range sessions {
+					if sess.idle() > udpSessionTimeout {
+						sess.close()
+					}
+				}
+				lock.Unlock()
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	buf := make([]byte, util.MaxDatagramSize)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		key := addr.String()
+		lock.Lock()
+		sess, isok := sessions[key]
+		if !isok {
+			if t.checkAccessAddr(addr) != accessAllowed {
+				lock.Unlock()
+				pipeLog.WithFields(log.Fields{"remote_addr": key, "tunnel": t.name}).Debugln("datagram denied by ip rules")
+				continue
+			}
+			limit := udpMaxSessions
+			if max := t.config().MaxConns; max > 0 && max < limit {
+				limit = max
+			}
+			if len(sessions) >= limit {
+				lock.Unlock()
+				atomic.AddUint64(&serverMetrics.connsRejected, 1)
+				pipeLog.WithFields(log.Fields{"remote_addr": key, "tunnel": t.name, "sessions": limit}).Debugln("datagram denied,too many udp sessions")
+				continue
+			}
+			sess = &udpSession{addr: addr, out: make(chan []byte, udpSessionBacklog), die: make(chan struct{})}
+			sess.touch()
+			sessions[key] = sess
+			go func() {
+				t.relayUdp(pc, sess)
+				lock.Lock()
+				if sessions[key] == sess {
+					delete(sessions, key)
+				}
+				lock.Unlock()
+			}()
+		}
+		lock.Unlock()
+		p := make([]byte, n)
+		copy(p, buf[:n])
+		select {
+		case sess.out <- p:
+		default:
+			// drop it like the network does when the stream can't keep up
+		}
+	}
+}
+
+func (t *Tunnel) relayUdp(pc net.PacketConn, sess *udpSession) {
+	defer sess.close()
+	atomic.AddUint64(&serverMetrics.connections, 1)
+	stream, streamID, err := t.openStream()
+	if err != nil {
+		atomic.AddUint64(&serverMetrics.errors, 1)
+		return
+	}
+	defer stream.Close()
+	c := t.control()
+	atomic.AddInt64(&c.streams, 1)
+	atomic.AddInt64(&t.streams, 1)
+	edge := c.trackEdge(streamID, t.name, sess.addr)
+	defer func() {
+		c.untrackEdge(edge)
+		atomic.AddInt64(&c.streams, -1)
+		atomic.AddInt64(&t.streams, -1)
+	}()
+	go func() {
+		defer sess.close()
+		buf := make([]byte, util.MaxDatagramSize)
+		for {
+			n, err := util.ReadDatagram(stream, buf)
+			if err != nil {
+				return
+			}
+			sess.touch()
+			_, err = pc.WriteTo(buf[:n], sess.addr)
+			if err != nil {
+				return
+			}
+			atomic.AddUint64(&edge.bytesOut, uint64(n))
+			atomic.AddUint64(&c.bytesOut, uint64(n))
+			atomic.AddUint64(&t.bytesOut, uint64(n))
+			atomic.AddUint64(&serverMetrics.bytesOut, uint64(n))
+			if t.overQuota() {
+				return
+			}
+		}
+	}()
+	for {
+		select {
+		case p := <-sess.out:
+			err = util.WriteDatagram(stream, p)
+			if err != nil {
+				return
+			}
+			sess.touch()
+			atomic.AddUint64(&edge.bytesIn, uint64(len(p)))
+			atomic.AddUint64(&c.bytesIn, uint64(len(p)))
+			atomic.AddUint64(&t.bytesIn, uint64(len(p)))
+			atomic.AddUint64(&serverMetrics.bytesIn, uint64(len(p)))
+			if t.overQuota() {
+				return
+			}
+		case <-sess.die:
+			return
+		}
+	}
+}
@@ -0,0 +1,182 @@
+// Copyright 2017 longXboy, longxboyhi@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/longXboy/lunnel/log"
+	"github.com/pkg/errors"
+)
+
+// Usage exports the traffic and tunnel hours of every client periodically for billing
+type Usage struct {
+	//seconds between two exports,0 disables the exporter
+	Interval int64 `yaml:"interval,omitempty"`
+	//json or csv,default to json
+	Format string `yaml:"format,omitempty"`
+	//directory the usage files are written to
+	Dir string `yaml:"dir,omitempty"`
+	//usage records are posted to Webhook as json
+	Webhook string `yaml:"webhook,omitempty"`
+}
+
+type usageRecord struct {
+	ClientID    string
+	Tenant      string `json:",omitempty"`
+	From        time.Time
+	To          time.Time
+	BytesIn     uint64
+	BytesOut    uint64
+	TunnelHours float64
+}
+
+type usageCounter struct {
+	ctl      *Control
+	bytesIn  uint64
+	bytesOut uint64
+}
+
+// usageLast keeps the counters of every client at the last export,only used by the exporter goroutine
+var usageLast = make(map[string]usageCounter)
+
+// collectUsage returns the usage of the connected clients between from and to
+func collectUsage(from time.Time, to time.Time) []usageRecord {
+	var controls []*Control
+	ControlMapLock.RLock()
+	for _, c := range ControlMap {
+		if !c.IsClosed() {
+			controls = append(controls, c)
+		}
+	}
+	ControlMapLock.RUnlock()
+	sort.Sort(controlsByID(controls))
+
+	records := []usageRecord{}
+	current := make(map[string]usageCounter, len(controls))
+	for _, c := range controls {
+		id := c.ClientID.String()
+		counter := usageCounter{ctl: c, bytesIn: atomic.LoadUint64(&c.bytesIn), bytesOut: atomic.LoadUint64(&c.bytesOut)}
+		current[id] = counter
+		rec := usageRecord{ClientID: id, Tenant: c.tenant.name(), From: from, To: to, BytesIn: counter.bytesIn, BytesOut: counter.bytesOut}
+		// the counters restart when the client reconnects with a new control
+		if last, isok := usageLast[id]; isok && last.ctl == c {
+			rec.BytesIn -= last.bytesIn
+			rec.BytesOut -= last.bytesOut
+		}
+		var seconds float64
+		c.tunnelLock.Lock()
+		for _, t := range c.tunnels {
+			start := t.createdAt
+			if start.Before(from) {
+				start = from
+			}
+			if to.After(start) {
+				seconds += to.Sub(start).Seconds()
+			}
+		}
+		c.tunnelLock.Unlock()
+		rec.TunnelHours = seconds / 3600
+		records = append(records, rec)
+	}
+	usageLast = current
+	return records
+}
+
+func encodeUsage(records []usageRecord, format string) ([]byte, error) {
+	if format != "csv" {
+		return json.Marshal(records)
+	}
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Write([]string{"client_id", "tenant", "from", "to", "bytes_in", "bytes_out", "tunnel_hours"})
+	for _, rec := range records {
+		w.Write([]string{
+			rec.ClientID,
+			rec.Tenant,
+			rec.From.UTC().Format(time.RFC3339),
+			rec.To.UTC().Format(time.RFC3339),
+			strconv.FormatUint(rec.BytesIn, 10),
+			strconv.FormatUint(rec.BytesOut, 10),
+			strconv.FormatFloat(rec.TunnelHours, 'f', 4, 64),
+		})
+	}
+	w.Flush()
+	return buf.Bytes(), w.Error()
+}
+
+func exportUsage(records []usageRecord, to time.Time) error {
+	conf := serverConf.Usage
+	if conf.Dir != "" {
+		content, err := encodeUsage(records, conf.Format)
+		if err != nil {
+			return errors.Wrap(err, "encode usage")
+		}
+		ext := "json"
+		if conf.Format == "csv" {
+			ext = "csv"
+		}
+		name := filepath.Join(conf.Dir, fmt.Sprintf("usage-%s.%s", to.UTC().Format("20060102T150405Z"), ext))
+		err = ioutil.WriteFile(name, content, 0644)
+		if err != nil {
+			return errors.Wrap(err, "write usage file")
+		}
+	}
+	if conf.Webhook != "" {
+		body, err := json.Marshal(records)
+		if err != nil {
+			return errors.Wrap(err, "json marshal usage")
+		}
+		resp, err := webhookClient.Post(conf.Webhook, "application/json", bytes.NewReader(body))
+		if err != nil {
+			return errors.Wrap(err, "post usage")
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+			return errors.Errorf("usage webhook response code %d", resp.StatusCode)
+		}
+	}
+	return nil
+}
+
+func runUsageExporter() {
+	if serverConf.Usage.Dir != "" {
+		err := os.MkdirAll(serverConf.Usage.Dir, 0755)
+		if err != nil {
+			log.WithFields(log.Fields{"dir": serverConf.Usage.Dir, "err": err}).Errorln("create usage dir failed!")
+		}
+	}
+	ticker := time.NewTicker(time.Duration(serverConf.Usage.Interval) * time.Second)
+	defer ticker.Stop()
+	from := time.Now()
+	for to := range ticker.C {
+		records := collectUsage(from, to)
+		err := exportUsage(records, to)
+		if err != nil {
+			log.WithFields(log.Fields{"err": err}).Errorln("export usage failed!")
+		}
+		from = to
+	}
+}
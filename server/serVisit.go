@@ -0,0 +1,117 @@
+// Copyright 2017 longXboy, longxboyhi@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/longXboy/lunnel/log"
+	"github.com/longXboy/lunnel/msg"
+	"github.com/longXboy/lunnel/util"
+	"github.com/longXboy/smux"
+	"github.com/pkg/errors"
+)
+
+// visitingAddr is the remote address of the pipe a visit came over
+type visitingAddr string
+
+func (a visitingAddr) Network() string {
+	return "visit"
+}
+
+func (a visitingAddr) String() string {
+	return string(a)
+}
+
+// visitConn is a stream opened by a visitor,the address of the stream is of its pipe
+type visitConn struct {
+	*smux.Stream
+	addr visitingAddr
+}
+
+func (vc *visitConn) RemoteAddr() net.Addr {
+	return vc.addr
+}
+
+// acceptVisits serves the streams client opens over its visit pipe sess until it or the control is closed,
+// the access rules of the tunnels visited are checked against remoteAddr of the pipe
+func (c *Control) acceptVisits(sess *smux.Session, pipeID string, remoteAddr net.Addr) {
+	defer sess.Close()
+	go func() {
+		<-c.ctx.Done()
+		sess.Close()
+	}()
+	for {
+		stream, err := sess.AcceptStream()
+		if err != nil {
+			pipeLog.WithFields(log.Fields{"ctl_id": c.id, "pipe_id": pipeID, "err": err}).Debugln("visit pipe closed")
+			return
+		}
+		go c.handleVisit(&visitConn{Stream: stream, addr: visitingAddr(remoteAddr.String())}, util.StreamID(pipeID, stream.ID()))
+	}
+}
+
+// visitTunnel finds the tunnel v asks for,the tunnels of other tenants are not found
+func (c *Control) visitTunnel(v *msg.Visit) (*Tunnel, error) {
+	key := v.Addr
+	if v.Stcp != "" {
+		key = fmt.Sprintf("stcp://%s:0", v.Stcp)
+	}
+	TunnelMapLock.RLock()
+	t, isok := TunnelMap[key]
+	TunnelMapLock.RUnlock()
+	if !isok || t.control().tenant.name() != c.tenant.name() {
+		return nil, errors.Errorf("tunnel %s not found", key)
+	}
+	if schema := t.config().Public.Schema; schema != "tcp" && schema != "tcpmux" && schema != "stcp" {
+		return nil, errors.Errorf("%s tunnels can't be visited", schema)
+	}
+	return t, nil
+}
+
+func (c *Control) handleVisit(conn *visitConn, streamID string) {
+	mType, body, err := msg.ReadMsgWithTimeout(conn, time.Duration(serverConf.HandshakeTimeout)*time.Second)
+	if err != nil || mType != msg.TypeVisit || body == nil {
+		conn.Close()
+		pipeLog.WithFields(log.Fields{"ctl_id": c.id, "stream_id": streamID, "type": mType, "err": err}).Warningln("read visit failed!")
+		return
+	}
+	v := body.(*msg.Visit)
+	t, err := c.visitTunnel(v)
+	if err == nil && t.checkAccessAddr(conn.RemoteAddr()) != accessAllowed {
+		err = errors.New("visit denied by the access rules of tunnel")
+	}
+	if err != nil {
+		msg.WriteMsg(conn, msg.TypeError, msg.Error{Msg: err.Error(), Code: msg.ErrCodeVisitRefused})
+		conn.Close()
+		pipeLog.WithFields(log.Fields{"ctl_id": c.id, "stream_id": streamID, "addr": v.Addr, "stcp": v.Stcp, "err": err}).Debugln("visit refused")
+		return
+	}
+	err = msg.WriteMsg(conn, msg.TypeVisit, nil)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	pconn, err := t.readPreamble(conn, nil)
+	if err != nil {
+		pipeLog.WithFields(log.Fields{"ctl_id": c.id, "stream_id": streamID, "tunnel": t.name, "err": err}).Debugln("visit denied by preamble")
+		conn.Close()
+		return
+	}
+	pipeLog.WithFields(log.Fields{"ctl_id": c.id, "stream_id": streamID, "tunnel": t.name, "client_id": t.control().ClientID.String()}).Debugln("visiting tunnel")
+	proxyConn(pconn, t)
+}
@@ -16,15 +16,14 @@ package server
 
 import (
 	"crypto/tls"
-	"encoding/json"
 	"fmt"
 	"io"
-	"io/ioutil"
 	rawLog "log"
 	"net"
 	"net/http"
 	"os"
 	"strconv"
+	"sync/atomic"
 	"time"
 
 	"github.com/getsentry/raven-go"
@@ -33,27 +32,55 @@ import (
 	"github.com/longXboy/lunnel/log"
 	"github.com/longXboy/lunnel/msg"
 	"github.com/longXboy/lunnel/transport"
+	"github.com/longXboy/lunnel/util"
 	"github.com/longXboy/lunnel/vhost"
 	"github.com/longXboy/smux"
+	"github.com/pkg/errors"
 )
 
 func Main(configDetail []byte, configType string) {
+	err := Start(configDetail, configType)
+	if err != nil {
+		rawLog.Fatalf("start server failed!err:=%v", err)
+	}
+	wait := make(chan struct{})
+	<-wait
+}
+
+// Start serves the config in the background and returns once all the listeners are bound,
+// the server lives as long as the process so it can only be started once
+func Start(configDetail []byte, configType string) error {
 	err := LoadConfig(configDetail, configType)
 	if err != nil {
-		rawLog.Fatalf("load config failed!err:=%v", err)
+		return errors.Wrap(err, "load config")
 	}
 	if serverConf.LogFile != "" {
 		f, err := os.OpenFile(serverConf.LogFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0660)
 		if err != nil {
-			rawLog.Fatalf("open log file failed!err:=%v\n", err)
-			return
+			return errors.Wrap(err, "open log file")
 		}
-		defer f.Close()
 		log.Init(serverConf.Debug, f)
 	} else {
 		log.Init(serverConf.Debug, nil)
 	}
+	err = log.SetLevels(serverConf.LogLevels)
+	if err != nil {
+		return errors.Wrap(err, "set log levels")
+	}
+	log.SetSampling(serverConf.LogSampling)
+	err = log.AddSinks(serverConf.Syslog, serverConf.Journald, serverConf.LogFile != "")
+	if err != nil {
+		return errors.Wrap(err, "add log sinks")
+	}
 	raven.SetDSN(serverConf.DSN)
+	err = initAudit()
+	if err != nil {
+		return errors.Wrap(err, "init audit")
+	}
+	err = initSiem()
+	if err != nil {
+		return errors.Wrap(err, "init siem")
+	}
 	if serverConf.AuthEnable {
 		contrib.InitAuth(serverConf.AuthUrl)
 	}
@@ -62,113 +89,133 @@ func Main(configDetail []byte, configType string) {
 	}
 	maxIdlePipes, err = strconv.ParseUint(serverConf.MaxIdlePipes, 10, 64)
 	if err != nil {
-		log.Fatalln("max_idle_pipes must be unsigned integer")
+		return errors.New("max_idle_pipes must be unsigned integer")
 	}
 	maxStreams, err = strconv.ParseUint(serverConf.MaxStreams, 10, 64)
 	if err != nil {
-		log.Fatalln("max_idle_pipes must be unsigned integer")
+		return errors.New("max_streams must be unsigned integer")
 	}
 
+	if serverConf.Tls.TlsCert != "" && !serverConf.Tls.DisableTickets {
+		go runTicketRotation()
+	}
+	if serverConf.Tls.TlsCert != "" {
+		go runCertCheck()
+	}
+	listening.Add(2)
 	go serveHttp(fmt.Sprintf("%s:%d", serverConf.ListenIP, serverConf.HttpPort))
 	go serveHttps(fmt.Sprintf("%s:%d", serverConf.ListenIP, serverConf.HttpsPort))
-	go listenAndServe("kcp")
-	go listenAndServe("tcp")
-	go serveManage()
-
-	wait := make(chan struct{})
-	<-wait
-}
-
-func serveManage() {
-	http.HandleFunc("/tunnel", tunnelQuery)
-	http.ListenAndServe(fmt.Sprintf("%s:%d", serverConf.ListenIP, serverConf.ManagePort), nil)
-}
-
-type tunnelStateReq struct {
-	RemoteAddr string
-}
-
-type tunnelStateResp struct {
-	Tunnels []string
-}
-
-func tunnelQuery(w http.ResponseWriter, r *http.Request) {
-	content, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprintf(w, "req body is empty")
-		return
+	if serverConf.TcpMux.Port != 0 {
+		listening.Add(1)
+		go serveTcpMux(fmt.Sprintf("%s:%d", serverConf.ListenIP, serverConf.TcpMux.Port))
 	}
-	r.Body.Close()
-
-	var query tunnelStateReq
-	err = json.Unmarshal(content, &query)
-	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprintf(w, "unmarshal req body failed")
-		return
+	if serverConf.KnockPort != 0 {
+		listening.Add(1)
+		go serveKnock(fmt.Sprintf("%s:%d", serverConf.ListenIP, serverConf.KnockPort))
 	}
-	var tunnelStats tunnelStateResp = tunnelStateResp{Tunnels: []string{}}
-	if query.RemoteAddr != "" {
-		TunnelMapLock.RLock()
-		tunnel, isok := TunnelMap[query.RemoteAddr]
-		TunnelMapLock.RUnlock()
-		if isok {
-			tunnelStats.Tunnels = append(tunnelStats.Tunnels, tunnel.tunnelConfig.PublicAddr())
-		}
-	} else {
-		TunnelMapLock.RLock()
-		for _, v := range TunnelMap {
-			tunnelStats.Tunnels = append(tunnelStats.Tunnels, v.tunnelConfig.PublicAddr())
-		}
-		TunnelMapLock.RUnlock()
+	if serverConf.Statsd.Addr != "" {
+		go runStatsd()
 	}
-	header := w.Header()
-	header["Content-Type"] = []string{"application/json"}
-	w.WriteHeader(http.StatusOK)
-	retBody, err := json.Marshal(tunnelStats)
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprintf(w, "marshal resp body failed")
-		return
+	if len(serverConf.Alerting.Rules) > 0 {
+		go runAlerting()
+	}
+	if serverConf.Tsdb.Format != "" {
+		go runTsdbReporter()
+	}
+	if serverConf.Usage.Interval > 0 {
+		go runUsageExporter()
+	}
+	raiseOpenFiles()
+	go runOverloadWatch()
+	for i := range serverConf.ReverseClients {
+		go runReverseDialer(&reverseTarget{conf: serverConf.ReverseClients[i]})
+	}
+	for _, name := range serverConf.Transports {
+		if name == "https" {
+			// served by handleHttpsConn for the connections negotiating transport.ALPN
+			continue
+		}
+		listening.Add(1)
+		go listenAndServe(name)
 	}
-	w.Write(retBody)
+	listening.Add(1)
+	go serveManage()
+	go notifySystemd()
+	listening.Wait()
+	return nil
 }
 
 func listenAndServe(transportMode string) {
-	addr := fmt.Sprintf("%s:%d", serverConf.ListenIP, serverConf.ListenPort)
-	lis, err := transport.Listen(addr, transportMode)
+	port := serverConf.ListenPort
+	if p, isok := serverConf.TransportPorts[transportMode]; isok {
+		port = p
+	}
+	addr := fmt.Sprintf("%s:%d", serverConf.ListenIP, port)
+	opts := transport.Options{WsPath: serverConf.Websocket.Path, Heartbeat: time.Duration(serverConf.Websocket.Heartbeat) * time.Second, Socket: serverConf.Socket, Faults: serverConf.faultInjector, KcpMtu: serverConf.KcpMtu, DnsZone: serverConf.DnsTunnel.Zone}
+	lis, err := transport.Listen(addr, transportMode, opts, serverConf.Obfs.obfuscator)
 	if err != nil {
-		log.WithFields(log.Fields{"address": addr, "protocol": transportMode, "err": err}).Fatalln("server's control listen failed!")
+		transportLog.WithFields(log.Fields{"address": addr, "protocol": transportMode, "err": err}).Fatalln("server's control listen failed!")
 		return
 	}
-	log.WithFields(log.Fields{"address": addr, "protocol": transportMode}).Infoln("server's control listen at")
-	serve(lis)
+	transportLog.WithFields(log.Fields{"address": addr, "protocol": transportMode}).Infoln("server's control listen at")
+	listening.Done()
+	serve(lis, transportMode)
 }
 
-func handleConn(conn net.Conn) {
-	mType, body, err := msg.ReadMsg(conn)
+func handleConn(conn net.Conn, transportMode string) {
+	mType, body, err := msg.ReadMsgWithTimeout(conn, time.Duration(serverConf.HandshakeTimeout)*time.Second)
 	if err != nil {
 		conn.Close()
-		log.WithFields(log.Fields{"err": err}).Warningln("read handshake msg failed!")
+		controlLog.WithFields(log.Fields{"err": err}).Warningln("read handshake msg failed!")
 		return
 	}
 	if mType == msg.TypeClientHello {
 		clientHello := body.(*msg.ClientHello)
+		if !util.ValidTraceID(clientHello.ControlID) {
+			clientHello.ControlID = util.NewTraceID()
+		}
+		caps := serverCapabilities()
+		aesKey, hasAesKey := serverConf.Aes.key(clientHello.KeyId)
+		if !clientVersionAccepted(clientHello.Version) {
+			msg.WriteMsg(conn, msg.TypeError, msg.Error{Msg: fmt.Sprintf("client version %s is older than %s,please upgrade", clientHello.Version, serverConf.MinClientVersion), Code: msg.ErrCodeClientTooOld, Detail: map[string]string{"version": clientHello.Version, "min_version": serverConf.MinClientVersion}, Capabilities: caps})
+			conn.Close()
+			controlLog.WithFields(log.Fields{"ctl_id": clientHello.ControlID, "version": clientHello.Version, "min_version": serverConf.MinClientVersion, "remote_addr": conn.RemoteAddr().String()}).Warningln("client version too old!")
+			return
+		}
+		if clientHello.Transport != "" && clientHello.Transport != transportMode {
+			msg.WriteMsg(conn, msg.TypeError, msg.Error{Msg: fmt.Sprintf("connection of transport %s accepted by %s", clientHello.Transport, transportMode), Code: msg.ErrCodeTransportMismatch, Detail: map[string]string{"transport": transportMode}, Capabilities: caps})
+			conn.Close()
+			return
+		}
 		if clientHello.EncryptMode == "tls" && (serverConf.Tls.TlsCert == "" || serverConf.Tls.TlsKey == "") {
-			err = msg.WriteMsg(conn, msg.TypeError, msg.Error{Msg: "server not support tls mode"})
+			err = msg.WriteMsg(conn, msg.TypeError, msg.Error{Msg: "server not support tls mode", Code: msg.ErrCodeUnsupportedEncryption, Detail: map[string]string{"encrypt_mode": "tls"}, Capabilities: caps})
 			if err != nil {
 				conn.Close()
 				return
 			}
-		} else if clientHello.EncryptMode == "aes" && serverConf.Aes.SecretKey == "" {
-			err = msg.WriteMsg(conn, msg.TypeError, msg.Error{Msg: "server not support aes mode"})
+		} else if clientHello.EncryptMode == "aes" && !hasAesKey {
+			serverErr := msg.Error{Msg: "server not support aes mode", Code: msg.ErrCodeUnsupportedEncryption, Detail: map[string]string{"encrypt_mode": "aes"}, Capabilities: caps}
+			if clientHello.KeyId != "" {
+				serverErr.Msg = fmt.Sprintf("server not support aes key id %s", clientHello.KeyId)
+				serverErr.Detail["key_id"] = clientHello.KeyId
+			}
+			err = msg.WriteMsg(conn, msg.TypeError, serverErr)
+			if err != nil {
+				conn.Close()
+				return
+			}
+		} else if clientHello.EncryptMode == "noise" && serverConf.Noise.key == nil {
+			err = msg.WriteMsg(conn, msg.TypeError, msg.Error{Msg: "server not support noise mode", Code: msg.ErrCodeUnsupportedEncryption, Detail: map[string]string{"encrypt_mode": "noise"}, Capabilities: caps})
 			if err != nil {
 				conn.Close()
 				return
 			}
 		} else {
-			err = msg.WriteMsg(conn, msg.TypeServerHello, nil)
+			var shello interface{}
+			if clientHello.ProtocolVersion > 0 {
+				shello = msg.ServerHello{Capabilities: *caps}
+			}
+			err = msg.WriteMsg(conn, msg.TypeServerHello, shello)
 			if err != nil {
 				conn.Close()
 				return
@@ -184,18 +231,25 @@ func handleConn(conn net.Conn) {
 			}
 			underlyingConn = tls.Server(conn, tlsConfig)
 		} else if clientHello.EncryptMode == "aes" {
-			underlyingConn, err = crypto.NewCryptoStream(conn, []byte(serverConf.Aes.SecretKey))
+			underlyingConn, err = crypto.NewCryptoStream(conn, aesKey)
 			if err != nil {
 				conn.Close()
-				log.WithFields(log.Fields{"err": err}).Errorln("client hello,crypto.NewCryptoConn failed!")
+				controlLog.WithFields(log.Fields{"ctl_id": clientHello.ControlID, "err": err}).Errorln("client hello,crypto.NewCryptoConn failed!")
+				return
+			}
+		} else if clientHello.EncryptMode == "noise" {
+			underlyingConn, err = crypto.NoiseServer(conn, *serverConf.Noise.key, verifyNoiseClient)
+			if err != nil {
+				conn.Close()
+				controlLog.WithFields(log.Fields{"ctl_id": clientHello.ControlID, "err": err, "remote_addr": conn.RemoteAddr().String()}).Warningln("noise handshake failed!")
 				return
 			}
 		} else if clientHello.EncryptMode == "none" {
 			underlyingConn = conn
 		} else {
-			msg.WriteMsg(conn, msg.TypeError, msg.Error{Msg: "invalid encryption mode"})
+			msg.WriteMsg(conn, msg.TypeError, msg.Error{Msg: "invalid encryption mode", Code: msg.ErrCodeUnsupportedEncryption, Detail: map[string]string{"encrypt_mode": clientHello.EncryptMode}, Capabilities: caps})
 			conn.Close()
-			log.WithFields(log.Fields{"encrypt_mode": clientHello.EncryptMode, "err": "invalid EncryptMode"}).Errorln("client hello failed!")
+			controlLog.WithFields(log.Fields{"ctl_id": clientHello.ControlID, "encrypt_mode": clientHello.EncryptMode, "err": "invalid EncryptMode"}).Errorln("client hello failed!")
 			return
 		}
 		if clientHello.EnableCompress {
@@ -206,55 +260,172 @@ func handleConn(conn net.Conn) {
 		sess, err := smux.Server(underlyingConn, smuxConfig)
 		if err != nil {
 			underlyingConn.Close()
-			log.WithFields(log.Fields{"err": err}).Warningln("upgrade to smux.Server failed!")
+			controlLog.WithFields(log.Fields{"ctl_id": clientHello.ControlID, "err": err}).Warningln("upgrade to smux.Server failed!")
 			return
 		}
 		defer sess.Close()
 		stream, err := sess.AcceptStream()
 		if err != nil {
-			log.WithFields(log.Fields{"err": err}).Warningln("accept stream failed!")
+			controlLog.WithFields(log.Fields{"ctl_id": clientHello.ControlID, "err": err}).Warningln("accept stream failed!")
 			return
 		}
-		log.WithFields(log.Fields{"encrypt_mode": body.(*msg.ClientHello).EncryptMode}).Debugln("new client hello")
-		handleControl(stream, clientHello)
+		controlLog.WithFields(log.Fields{"ctl_id": clientHello.ControlID, "encrypt_mode": body.(*msg.ClientHello).EncryptMode}).Debugln("new client hello")
+		var reverse *reverseTarget
+		if rc, isok := conn.(*reverseConn); isok {
+			reverse = rc.target
+		}
+		handleControl(stream, clientHello, conn.RemoteAddr().String(), transportMode, reverse)
 	} else if mType == msg.TypePipeClientHello {
-		handlePipe(conn, body.(*msg.PipeClientHello))
+		handlePipe(conn, body.(*msg.PipeClientHello), transportMode)
+	} else if mType == msg.TypeRelay && body != nil {
+		handleRelay(conn, body.(*msg.Relay))
 	} else {
-		log.WithFields(log.Fields{"msgType": mType, "body": body}).Errorln("read handshake msg invalid type!")
+		controlLog.WithFields(log.Fields{"msgType": mType, "body": body}).Errorln("read handshake msg invalid type!")
+	}
+}
+
+// verifyNoiseClient allows the client keys configured,or any client if none is configured
+func verifyNoiseClient(peer [32]byte) error {
+	if len(serverConf.Noise.clientKeys) == 0 || serverConf.Noise.clientKeys[peer] {
+		return nil
+	}
+	return errors.Errorf("noise client key %s not allowed", crypto.EncodeNoiseKey(peer))
+}
+
+// clientVersionAccepted reports whether version is at least min_client_version,
+// unparsable versions are not
+func clientVersionAccepted(version string) bool {
+	if serverConf.MinClientVersion == "" {
+		return true
 	}
+	cmp, err := util.CompareVersion(version, serverConf.MinClientVersion)
+	return err == nil && cmp >= 0
 }
 
-func serve(lis net.Listener) {
+// serverCapabilities are advertised to clients in ServerHello and the refusals of ClientHello
+func serverCapabilities() *msg.Capabilities {
+	caps := &msg.Capabilities{ProtocolVersion: msg.ProtocolVersion, Compressions: []string{"snappy"}}
+	if serverConf.Tls.TlsCert != "" && serverConf.Tls.TlsKey != "" {
+		caps.EncryptModes = append(caps.EncryptModes, "tls")
+	}
+	if serverConf.Noise.key != nil {
+		caps.EncryptModes = append(caps.EncryptModes, "noise")
+	}
+	if len(serverConf.Aes.keys) > 0 {
+		caps.EncryptModes = append(caps.EncryptModes, "aes")
+	}
+	caps.EncryptModes = append(caps.EncryptModes, "none")
+	caps.Transports = append(caps.Transports, serverConf.Transports...)
+	if serverConf.Resume.Window > 0 {
+		caps.Features = append(caps.Features, "resume")
+	}
+	if serverConf.TcpMux.Port != 0 {
+		caps.Features = append(caps.Features, "tcpmux")
+	}
+	caps.Features = append(caps.Features, "halfclose", "flowcontrol", "dialstats", "pipetransport", "visit", "hosttemplate")
+	if serverConf.KnockPort != 0 {
+		caps.Features = append(caps.Features, "knock")
+	}
+	if len(serverConf.ReverseClients) > 0 {
+		caps.Features = append(caps.Features, "reverse")
+	}
+	if len(serverConf.Relay.Targets) > 0 {
+		caps.Features = append(caps.Features, "relay")
+	}
+	return caps
+}
+
+func serve(lis net.Listener, transportMode string) {
+	var backoff acceptBackoff
 	for {
 		if conn, err := lis.Accept(); err == nil {
-			go handleConn(conn)
+			backoff.reset()
+			go handleConn(conn, transportMode)
 		} else {
-			log.WithFields(log.Fields{"err": err}).Errorln("lis.Accept failed!")
+			transportLog.WithFields(log.Fields{"err": err}).Errorln("lis.Accept failed!")
+			if !backoff.wait(err) {
+				return
+			}
 		}
 	}
 
 }
 
+// httpsProtos are the ALPN protocols offered on the https port for addr,
+// nil leaves the protocol to http/1.1 as before ALPN was used
+func httpsProtos(addr string) []string {
+	var protos []string
+	if http2Enabled(addr) {
+		protos = append(protos, "h2")
+	}
+	if transportEnabled("https") {
+		protos = append(protos, transport.ALPN)
+	}
+	if protos == nil {
+		return nil
+	}
+	return append(protos, "http/1.1")
+}
+
 func handleHttpsConn(conn net.Conn) {
-	defer conn.Close()
 	conn.SetDeadline(time.Now().Add(time.Second * 20))
+	pconn, err := readProxyProtocol(conn)
+	if err != nil {
+		conn.Close()
+		vhostLog.WithFields(log.Fields{"err": err}).Debugln("read proxy protocol header failed!")
+		return
+	}
+	conn = pconn
 	sconn, info, err := vhost.GetHttpsHostname(conn)
 	if err != nil {
-		log.WithFields(log.Fields{"err": err}).Debugln("vhost.GetHttpRequestInfo failed!")
+		conn.Close()
+		vhostLog.WithFields(log.Fields{"err": err}).Debugln("vhost.GetHttpRequestInfo failed!")
 		return
 	}
-	TunnelMapLock.RLock()
-	tunnel, isok := TunnelMap[fmt.Sprintf("https://%s:%d", info["Host"], serverConf.HttpsPort)]
-	TunnelMapLock.RUnlock()
+	addr := fmt.Sprintf("https://%s:%d", info["Host"], serverConf.HttpsPort)
 	tlsConfig, err := newTlsConfig()
 	if err != nil {
+		conn.Close()
 		log.Errorln("server error cert")
 		return
 	}
+	tlsConfig.NextProtos = httpsProtos(addr)
 	tlsConn := tls.Server(sconn, tlsConfig)
-	if isok {
-		conn.SetDeadline(time.Time{})
-		proxyConn(tlsConn, tunnel.ctl, tunnel.name)
+	if tlsConfig.NextProtos != nil {
+		err = tlsConn.Handshake()
+		if err != nil {
+			conn.Close()
+			vhostLog.WithFields(log.Fields{"err": err, "remote_addr": conn.RemoteAddr().String()}).Debugln("https tls handshake failed!")
+			return
+		}
+		switch tlsConn.ConnectionState().NegotiatedProtocol {
+		case transport.ALPN:
+			conn.SetDeadline(time.Time{})
+			handleConn(tlsConn, "https")
+			return
+		case "h2":
+			conn.SetDeadline(time.Time{})
+			serveH2(tlsConn)
+			return
+		}
+	}
+	defer conn.Close()
+	if route := lookupStaticRoute(info["Host"]); route != nil {
+		route.proxy(tlsConn, info["Host"])
+		return
+	}
+	if httpHostServed(addr) {
+		hconn, info, err := vhost.GetHttpRequestInfo(tlsConn)
+		if err != nil {
+			vhostLog.WithFields(log.Fields{"err": err}).Debugln("vhost.GetHttpRequestInfo failed!")
+			return
+		}
+		tunnel, isok := lookupHttpTunnel(addr, info["Method"])
+		if !isok {
+			hconn.Write([]byte(vhost.BadGateWayResp()))
+			return
+		}
+		serveHttpTunnel(conn, hconn, info, tunnel)
 	} else {
 		tlsConn.Write([]byte(vhost.BadGateWayResp()))
 	}
@@ -263,15 +434,21 @@ func handleHttpsConn(conn net.Conn) {
 func serveHttps(addr string) {
 	lis, err := net.Listen("tcp", addr)
 	if err != nil {
-		log.WithFields(log.Fields{"addr": addr, "err": err}).Fatalln("listen https failed!")
+		vhostLog.WithFields(log.Fields{"addr": addr, "err": err}).Fatalln("listen https failed!")
 	}
-	log.WithFields(log.Fields{"addr": addr, "err": err}).Infoln("listen https")
+	vhostLog.WithFields(log.Fields{"addr": addr, "err": err}).Infoln("listen https")
+	listening.Done()
+	var backoff acceptBackoff
 	for {
 		conn, err := lis.Accept()
 		if err != nil {
-			log.WithFields(log.Fields{"err": err}).Errorln("accept http conn failed!")
+			vhostLog.WithFields(log.Fields{"err": err}).Errorln("accept http conn failed!")
+			if !backoff.wait(err) {
+				return
+			}
 			continue
 		}
+		backoff.reset()
 		go handleHttpsConn(conn)
 	}
 }
@@ -279,41 +456,114 @@ func serveHttps(addr string) {
 func handleHttpConn(conn net.Conn) {
 	defer conn.Close()
 	conn.SetDeadline(time.Now().Add(time.Second * 20))
+	pconn, err := readProxyProtocol(conn)
+	if err != nil {
+		vhostLog.WithFields(log.Fields{"err": err}).Debugln("read proxy protocol header failed!")
+		return
+	}
+	conn = pconn
 	sconn, info, err := vhost.GetHttpRequestInfo(conn)
 	if err != nil {
-		log.WithFields(log.Fields{"err": err}).Debugln("vhost.GetHttpRequestInfo failed!")
+		vhostLog.WithFields(log.Fields{"err": err}).Debugln("vhost.GetHttpRequestInfo failed!")
+		return
+	}
+	if route := lookupStaticRoute(info["Host"]); route != nil {
+		route.proxy(sconn, info["Host"])
 		return
 	}
-	TunnelMapLock.RLock()
-	tunnel, isok := TunnelMap[fmt.Sprintf("http://%s:%d", info["Host"], serverConf.HttpPort)]
-	TunnelMapLock.RUnlock()
+	tunnel, isok := lookupHttpTunnel(fmt.Sprintf("http://%s:%d", info["Host"], serverConf.HttpPort), info["Method"])
 	if isok {
-		if tunnel.tunnelConfig.HttpHostRewrite != "" {
-			sconn, err = vhost.HttpHostNameRewrite(sconn, tunnel.tunnelConfig.HttpHostRewrite)
-			if err != nil {
-				log.WithFields(log.Fields{"err": err}).Errorln("vhost.HttpHostNameRewrite failed!")
-				return
-			}
-		}
-		conn.SetDeadline(time.Time{})
-		proxyConn(sconn, tunnel.ctl, tunnel.name)
+		serveHttpTunnel(conn, sconn, info, tunnel)
 	} else {
 		sconn.Write([]byte(vhost.BadGateWayResp()))
 	}
 }
 
+// admitHttp enforces the tunnel policy on a parsed http request,
+// it returns the response to answer the request with if it is not proxied
+func admitHttp(conn net.Conn, info map[string]string, tunnel *Tunnel) string {
+	switch tunnel.checkAccessAddr(visitorAddr(conn, info)) {
+	case accessForbidden:
+		return vhost.ForbiddenResp()
+	case accessRateLimited:
+		return vhost.TooManyRequestsResp()
+	case accessQuotaExceeded:
+		return vhost.QuotaExceededResp(quotaPage)
+	case accessOffline:
+		return vhost.OfflineResp()
+	case accessMaintenance:
+		_, page := tunnel.control().maintenancePage()
+		return vhost.MaintenanceResp(page)
+	case accessOverloaded:
+		return vhost.OverloadedResp()
+	}
+	if info["Path"] == statusPagePath && tunnel.config().StatusToken != "" {
+		return tunnel.statusPage(info)
+	}
+	if !tunnel.checkHttpAuth(info["Authorization"]) {
+		return vhost.UnauthorizedResp()
+	}
+	expire, required, ok := tunnel.checkSignedURL(info["Host"], info["Token"])
+	if !ok {
+		return vhost.InvalidTokenResp()
+	}
+	if required && info["TokenRedirect"] != "" {
+		// move the token from the shared link into a cookie so the following requests of browser carry it
+		cookie := http.Cookie{Name: util.SignedURLParam, Value: info["Token"], Path: "/", Expires: time.Unix(expire, 0), HttpOnly: true}
+		return vhost.RedirectResp(info["TokenRedirect"], cookie.String())
+	}
+	if !tunnel.pathServed(info["Path"]) {
+		return vhost.NotFoundResp(tunnel.config().NotFoundPage)
+	}
+	return ""
+}
+
+// serveHttpTunnel enforces the tunnel policy on a parsed http request and proxies it,
+// conn is the raw public connection while sconn carries the (decrypted) request
+func serveHttpTunnel(conn net.Conn, sconn net.Conn, info map[string]string, tunnel *Tunnel) {
+	if resp := admitHttp(conn, info, tunnel); resp != "" {
+		sconn.Write([]byte(resp))
+		return
+	}
+	cfg := tunnel.config()
+	err := transport.ApplyTcpOptions(conn, cfg.Tcp)
+	if err != nil {
+		vhostLog.WithFields(log.Fields{"err": err, "tunnel": tunnel.name}).Warningln("apply tcp options failed!")
+	}
+	if methodRouted(cfg.PublicAddr()) || tunnel.cacheEnabled() || len(cfg.Paths) > 0 {
+		conn.SetDeadline(time.Time{})
+		proxyHttp(conn, sconn, tunnel)
+		return
+	}
+	if rewrite := cfg.HttpHostRewrite; rewrite != "" {
+		sconn, err = vhost.HttpHostNameRewrite(sconn, rewrite)
+		if err != nil {
+			vhostLog.WithFields(log.Fields{"err": err}).Errorln("vhost.HttpHostNameRewrite failed!")
+			return
+		}
+	}
+	conn.SetDeadline(time.Time{})
+	proxyConn(tunnel.stats.track(sconn), tunnel)
+}
+
 func serveHttp(addr string) {
 	lis, err := net.Listen("tcp", addr)
 	if err != nil {
-		log.WithFields(log.Fields{"addr": addr, "err": err}).Fatalln("listen http failed!")
+		vhostLog.WithFields(log.Fields{"addr": addr, "err": err}).Fatalln("listen http failed!")
 	}
-	log.WithFields(log.Fields{"addr": addr, "err": err}).Infoln("listen http")
+	vhostLog.WithFields(log.Fields{"addr": addr, "err": err}).Infoln("listen http")
+	listening.Done()
+	var backoff acceptBackoff
 	for {
 		conn, err := lis.Accept()
 		if err != nil {
-			log.WithFields(log.Fields{"err": err}).Errorln("accept http conn failed!")
+			vhostLog.WithFields(log.Fields{"err": err}).Errorln("accept http conn failed!")
+			if !backoff.wait(err) {
+				return
+			}
 			continue
 		}
+		backoff.reset()
 		go handleHttpConn(conn)
 	}
 }
@@ -327,25 +577,41 @@ func newTlsConfig() (*tls.Config, error) {
 		log.WithFields(log.Fields{"cert": serverConf.Tls.TlsCert, "private_key": serverConf.Tls.TlsKey, "err": err}).Errorln("load LoadX509KeyPair failed!")
 		return tlsConfig, err
 	}
+	stapleOCSP(&tlsConfig.Certificates[0])
+	if serverConf.Tls.DisableTickets {
+		tlsConfig.SessionTicketsDisabled = true
+	} else if keys := currentTicketKeys(); len(keys) > 0 {
+		// shared by every config,or each connection would get a ticket key of its own
+		tlsConfig.SetSessionTicketKeys(keys)
+	}
 	return tlsConfig, nil
 }
 
-func handleControl(conn net.Conn, cch *msg.ClientHello) {
+func handleControl(conn net.Conn, cch *msg.ClientHello, remoteAddr string, transportMode string, reverse *reverseTarget) {
 	ctl := NewControl(conn, cch.EncryptMode, cch.EnableCompress, cch.Version)
+	ctl.remoteAddr = remoteAddr
+	ctl.transportMode = transportMode
+	ctl.reverse = reverse
+	ctl.aesKeyId = cch.KeyId
+	ctl.id = cch.ControlID
+	ctl.halfClose = cch.ProtocolVersion >= msg.HalfCloseVersion
 	err := ctl.ServerHandShake()
 	if err != nil {
+		atomic.AddUint64(&serverMetrics.handshakeErrors, 1)
 		conn.Close()
-		log.WithFields(log.Fields{"err": err, "client_id": ctl.ClientID.String()}).Errorln("ctl.ServerHandShake failed!")
+		controlLog.WithFields(log.Fields{"err": err, "ctl_id": ctl.id, "client_id": ctl.ClientID.String()}).Errorln("ctl.ServerHandShake failed!")
 		return
 	}
-	log.WithFields(log.Fields{"client_id": ctl.ClientID.String(), "encrypt_mode": ctl.encryptMode, "enableCompress": ctl.enableCompress, "version": cch.Version}).Infoln("client handshake success!")
+	atomic.AddUint64(&serverMetrics.handshakes, 1)
+	controlLog.WithFields(log.Fields{"ctl_id": ctl.id, "client_id": ctl.ClientID.String(), "encrypt_mode": ctl.encryptMode, "aes_key_id": ctl.aesKeyId, "enableCompress": ctl.enableCompress, "version": cch.Version}).Infoln("client handshake success!")
+	ctl.provision()
 	ctl.Serve()
 }
 
-func handlePipe(conn net.Conn, phs *msg.PipeClientHello) {
-	err := PipeHandShake(conn, phs)
+func handlePipe(conn net.Conn, phs *msg.PipeClientHello, transportMode string) {
+	err := PipeHandShake(conn, phs, transportMode)
 	if err != nil {
 		conn.Close()
-		log.WithFields(log.Fields{"err": err}).Warningln("pipe handshake failed!")
+		pipeLog.WithFields(log.Fields{"client_id": phs.ClientID.String(), "pipe_id": util.PipeID(phs.Once), "err": err}).Warningln("pipe handshake failed!")
 	}
 }
@@ -0,0 +1,39 @@
+// Copyright 2017 longXboy, longxboyhi@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transport
+
+import "time"
+
+// BdpBytes returns the bandwidth-delay product of mbps megabits per second over a path of rtt,
+// a window smaller than it caps the throughput at window/rtt
+func BdpBytes(mbps int, rtt time.Duration) int {
+	return int(float64(mbps) * 1e6 / 8 * rtt.Seconds())
+}
+
+// SizeWindow returns the bdp of mbps over rtt no smaller than floor and no larger than ceil,
+// it is floor if mbps or rtt is unknown
+func SizeWindow(mbps int, rtt time.Duration, floor int, ceil int) int {
+	if mbps <= 0 || rtt <= 0 {
+		return floor
+	}
+	window := BdpBytes(mbps, rtt)
+	if window < floor {
+		return floor
+	}
+	if ceil > 0 && window > ceil {
+		return ceil
+	}
+	return window
+}
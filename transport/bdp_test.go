@@ -0,0 +1,42 @@
+// Copyright 2017 longXboy, longxboyhi@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transport
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSizeWindow(t *testing.T) {
+	cases := []struct {
+		mbps  int
+		rtt   time.Duration
+		floor int
+		ceil  int
+		want  int
+	}{
+		// 100Mbit/s over 100ms needs 1.25MB in flight
+		{100, time.Millisecond * 100, 0, 0, 1250000},
+		{100, time.Millisecond * 100, 4 << 20, 0, 4 << 20},
+		{1000, time.Millisecond * 300, 4 << 20, 16 << 20, 16 << 20},
+		{0, time.Millisecond * 100, 4 << 20, 0, 4 << 20},
+		{100, 0, 4 << 20, 0, 4 << 20},
+	}
+	for _, c := range cases {
+		if got := SizeWindow(c.mbps, c.rtt, c.floor, c.ceil); got != c.want {
+			t.Fatalf("window of %dMbit/s over %v got %d,want %d", c.mbps, c.rtt, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+// Copyright 2017 longXboy, longxboyhi@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transport
+
+import (
+	"net"
+)
+
+// bound reports whether the dials are bound to a source ip,an interface or a routing mark
+func (opts Options) bound() bool {
+	return opts.BindIP != "" || opts.BindInterface != "" || opts.RoutingMark != 0 || opts.Dscp != 0
+}
+
+// Dial dials addr in network from the source ip and interface of opts and marks the packets by its dscp,
+// for the connections dialed beside the transports
+func (opts Options) Dial(network string, addr string) (net.Conn, error) {
+	return opts.dialer(network).Dial(network, addr)
+}
+
+// dialer dials network("tcp" or "udp") from the source ip,interface,routing mark and dscp of opts
+func (opts Options) dialer(network string) *net.Dialer {
+	d := &net.Dialer{Timeout: opts.DialTimeout}
+	if ip := net.ParseIP(opts.BindIP); ip != nil {
+		if network == "udp" {
+			d.LocalAddr = &net.UDPAddr{IP: ip}
+		} else {
+			d.LocalAddr = &net.TCPAddr{IP: ip}
+		}
+	}
+	if opts.BindInterface != "" || opts.RoutingMark != 0 {
+		d.Control = bindControl(opts.BindInterface, opts.RoutingMark)
+	}
+	if opts.Dscp != 0 {
+		d.Control = chainControls(d.Control, dscpControl(opts.Dscp))
+	}
+	if network == "tcp" && !opts.Socket.empty() {
+		d.Control = chainControls(d.Control, socketControl(opts.Socket, false))
+	}
+	return d
+}
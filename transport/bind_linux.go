@@ -0,0 +1,69 @@
+// Copyright 2017 longXboy, longxboyhi@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transport
+
+import (
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// bindControl binds the socket to iface by SO_BINDTODEVICE and marks its packets by SO_MARK,
+// both need CAP_NET_RAW or CAP_NET_ADMIN
+func bindControl(iface string, mark int) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		var opErr error
+		err := c.Control(func(fd uintptr) {
+			if iface != "" {
+				if err := syscall.BindToDevice(int(fd), iface); err != nil {
+					opErr = errors.Wrapf(err, "bind to interface %s", iface)
+					return
+				}
+			}
+			if mark != 0 {
+				if err := syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_MARK, mark); err != nil {
+					opErr = errors.Wrap(err, "set routing mark")
+				}
+			}
+		})
+		if err != nil {
+			return err
+		}
+		return opErr
+	}
+}
+
+// dscpControl sets the DSCP of the packets,the upper 6 bits of the traffic class of ipv6
+// or of the TOS byte of ipv4
+func dscpControl(dscp int) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		var opErr error
+		err := c.Control(func(fd uintptr) {
+			if strings.HasSuffix(network, "6") {
+				opErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS, dscp<<2)
+			} else {
+				opErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TOS, dscp<<2)
+			}
+			if opErr != nil {
+				opErr = errors.Wrap(opErr, "set dscp")
+			}
+		})
+		if err != nil {
+			return err
+		}
+		return opErr
+	}
+}
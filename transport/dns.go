@@ -0,0 +1,56 @@
+// Copyright 2017 longXboy, longxboyhi@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transport
+
+import (
+	"net"
+
+	"github.com/longXboy/lunnel/transport/dns"
+	"github.com/pkg/errors"
+)
+
+// dnsTransport carries the connections in the queries to a zone delegated to server and their answers,
+// for the networks only dns resolution escapes.it is slow and meant for the control in emergencies
+type dnsTransport struct{}
+
+func (opts Options) dnsOptions() dns.Options {
+	return dns.Options{Zone: opts.DnsZone, Record: opts.DnsRecord}
+}
+
+func (dnsTransport) Listen(addr string, opts Options) (net.Listener, error) {
+	lis, err := dns.Listen(addr, opts.dnsOptions())
+	if err != nil {
+		return nil, errors.Wrap(err, "listen dns")
+	}
+	return lis, nil
+}
+
+// Dial starts a session through the resolver at addr
+func (dnsTransport) Dial(addr string, opts Options) (net.Conn, error) {
+	addr, err := opts.Resolver.ResolveAddr(addr)
+	if err != nil {
+		return nil, errors.Wrap(err, "dns resolve")
+	}
+	udp, err := opts.dialer("udp").Dial("udp", addr)
+	if err != nil {
+		return nil, errors.Wrap(err, "dial resolver")
+	}
+	conn, err := dns.DialWithConn(udp, opts.dnsOptions())
+	if err != nil {
+		udp.Close()
+		return nil, errors.Wrap(err, "dns dial")
+	}
+	return conn, nil
+}
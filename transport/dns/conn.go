@@ -0,0 +1,190 @@
+// Copyright 2017 longXboy, longxboyhi@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dns
+
+import (
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/longXboy/lunnel/log"
+	"github.com/pkg/errors"
+)
+
+var dnsLog = log.Module("dns")
+
+const (
+	//a query unanswered in it is sent again
+	queryTimeout = time.Second
+	//queries sent for a sequence before the conn is given up
+	maxTries = 8
+	//idle polls of the client back off from minPoll to maxPoll
+	minPoll = time.Millisecond * 20
+	maxPoll = time.Millisecond * 500
+)
+
+// Options tunes the conns of the dns transport
+type Options struct {
+	//zone delegated to server,whose names are answered by server
+	Zone string
+	//record type carrying the data downstream,TypeTXT if 0
+	Record uint16
+}
+
+func normalizeZone(zone string) string {
+	return strings.ToLower(strings.Trim(zone, "."))
+}
+
+// Conn is a stream carried by the queries of a client through a resolver to the server of the zone,
+// every query carries the bytes written and its answer the bytes server wrote,one query at a time
+type Conn struct {
+	*stream
+	udp     net.Conn
+	zone    string
+	record  uint16
+	session string
+	seq     uint32
+	closing sync.Once
+	die     chan struct{}
+}
+
+// DialWithConn starts a session over udp,which is connected to the resolver already
+func DialWithConn(udp net.Conn, opts Options) (*Conn, error) {
+	zone := normalizeZone(opts.Zone)
+	if zone == "" {
+		return nil, errors.New("dns zone not configured")
+	}
+	if upstreamRoom(zone) < 16 {
+		return nil, errors.Errorf("dns zone %s too long", zone)
+	}
+	c := &Conn{stream: newStream(), udp: udp, zone: zone, record: opts.Record, session: newSessionID(), die: make(chan struct{})}
+	if c.record == 0 {
+		c.record = TypeTXT
+	}
+	go c.loop()
+	return c, nil
+}
+
+// Dial starts a session through the resolver at addr
+func Dial(addr string, opts Options) (*Conn, error) {
+	udp, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, errors.Wrap(err, "dial resolver")
+	}
+	c, err := DialWithConn(udp, opts)
+	if err != nil {
+		udp.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	return c.udp.LocalAddr()
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.udp.RemoteAddr()
+}
+
+// Close tells server the session is closed without waiting for the answer
+func (c *Conn) Close() error {
+	c.closing.Do(func() {
+		close(c.die)
+		c.shut(nil)
+		name := queryName(nil, flagClose, 0, c.session, c.zone)
+		c.udp.Write(buildQuery(uint16(rand.Uint32()), question{name: name, qtype: c.record}))
+		c.udp.Close()
+	})
+	return nil
+}
+
+func (c *Conn) loop() {
+	room := upstreamRoom(c.zone)
+	buf := make([]byte, ednsSize)
+	poll := minPoll
+	for {
+		data := c.peek(room)
+		name := queryName(data, flagData, c.seq, c.session, c.zone)
+		payload, err := c.exchange(name, buf)
+		if err != nil {
+			select {
+			case <-c.die:
+			default:
+				dnsLog.WithFields(log.Fields{"session": c.session, "seq": c.seq, "err": err}).Warningln("dns session broken")
+			}
+			c.shut(err)
+			c.udp.Close()
+			return
+		}
+		c.take(len(data))
+		c.deliver(payload)
+		c.seq++
+		if len(data) > 0 || len(payload) > 0 || c.pending() > 0 {
+			poll = minPoll
+			continue
+		}
+		// nothing either way,poll less often till something is written
+		select {
+		case <-c.wrote:
+			poll = minPoll
+		case <-time.After(poll):
+			if poll *= 2; poll > maxPoll {
+				poll = maxPoll
+			}
+		case <-c.die:
+			return
+		}
+	}
+}
+
+// exchange queries name till it is answered and returns the payload of the answer
+func (c *Conn) exchange(name string, buf []byte) ([]byte, error) {
+	for try := 0; try < maxTries; try++ {
+		id := uint16(rand.Uint32())
+		_, err := c.udp.Write(buildQuery(id, question{name: name, qtype: c.record}))
+		if err != nil {
+			return nil, errors.Wrap(err, "send query")
+		}
+		deadline := time.Now().Add(queryTimeout)
+		for {
+			c.udp.SetReadDeadline(deadline)
+			n, err := c.udp.Read(buf)
+			if err != nil {
+				if ne, isok := err.(net.Error); isok && ne.Timeout() {
+					break
+				}
+				return nil, errors.Wrap(err, "read answer")
+			}
+			rid, rcode, qname, payload, err := parseResponse(buf[:n], c.record)
+			if err != nil || rid != id || !strings.EqualFold(qname, name) {
+				// an answer of a query given up before
+				continue
+			}
+			if rcode != rcodeSuccess {
+				return nil, errors.Errorf("session refused by server,rcode %d", rcode)
+			}
+			return payload, nil
+		}
+		select {
+		case <-c.die:
+			return nil, errors.New("conn closed")
+		default:
+		}
+	}
+	return nil, errors.Errorf("no answer after %d queries", maxTries)
+}
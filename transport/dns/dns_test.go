@@ -0,0 +1,105 @@
+// Copyright 2017 longXboy, longxboyhi@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dns
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestQueryName(t *testing.T) {
+	zone := "t.example.com"
+	room := upstreamRoom(zone)
+	data := make([]byte, room)
+	rand.Read(data)
+	name := queryName(data, flagData, 42, "abcdefgh", zone)
+	if len(name) > maxNameLength {
+		t.Fatalf("name of %d bytes longer than %d", len(name), maxNameLength)
+	}
+	got, flag, seq, session, err := parseQueryName(name, zone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) || flag != flagData || seq != 42 || session != "abcdefgh" {
+		t.Fatalf("decoded %x %c %d %s", got, flag, seq, session)
+	}
+	if _, _, _, _, err := parseQueryName(name, "other.com"); err == nil {
+		t.Fatal("name of another zone decoded")
+	}
+}
+
+func TestAnswer(t *testing.T) {
+	for _, qtype := range []uint16{TypeTXT, TypeNULL} {
+		q := question{name: queryName([]byte("up"), flagData, 1, "abcdefgh", "t.example.com"), qtype: qtype}
+		id, got, size, err := parseQuery(buildQuery(7, q))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id != 7 || got != q || size != ednsSize {
+			t.Fatalf("query parsed into %d %v %d", id, got, size)
+		}
+		payload := make([]byte, answerRoom(q, size))
+		rand.Read(payload)
+		resp := buildResponse(id, q, rcodeSuccess, payload)
+		if len(resp) > size {
+			t.Fatalf("answer of %d bytes over %d", len(resp), size)
+		}
+		rid, rcode, name, data, err := parseResponse(resp, qtype)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rid != id || rcode != rcodeSuccess || name != q.name || !bytes.Equal(data, payload) {
+			t.Fatalf("answer of type %d parsed into %d %d %s %d bytes", qtype, rid, rcode, name, len(data))
+		}
+	}
+}
+
+func TestSession(t *testing.T) {
+	opts := Options{Zone: "t.example.com."}
+	lis, err := Listen("127.0.0.1:0", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	go func() {
+		conn, err := lis.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+	// server answers the queries itself as if it was the resolver
+	conn, err := Dial(lis.Addr().String(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	data := make([]byte, 16<<10)
+	rand.Read(data)
+	conn.SetDeadline(time.Now().Add(time.Second * 20))
+	go conn.Write(data)
+	got := make([]byte, len(data))
+	_, err = io.ReadFull(conn, got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("echo mismatch")
+	}
+}
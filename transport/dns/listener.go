@@ -0,0 +1,214 @@
+// Copyright 2017 longXboy, longxboyhi@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dns
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/longXboy/lunnel/log"
+	"github.com/pkg/errors"
+)
+
+// sessionTimeout closes the sessions whose client stopped querying
+const sessionTimeout = time.Minute
+
+// serverConn is the server side of a session,its bytes are carried by the answers to the queries of it
+type serverConn struct {
+	*stream
+	lis     *Listener
+	session string
+	//sequence of the next query and the answer to the last one,which is sent again if it is retransmitted
+	seq        uint32
+	lastAnswer []byte
+	lastQuery  time.Time
+	remote     net.Addr
+}
+
+func (c *serverConn) LocalAddr() net.Addr {
+	return c.lis.Addr()
+}
+
+func (c *serverConn) RemoteAddr() net.Addr {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.remote
+}
+
+func (c *serverConn) Close() error {
+	c.shut(nil)
+	return nil
+}
+
+// Listener answers the queries of the sessions under zone and accepts a conn for every new session
+type Listener struct {
+	pc       net.PacketConn
+	zone     string
+	lock     sync.Mutex
+	sessions map[string]*serverConn
+	accepted chan *serverConn
+	die      chan struct{}
+	dieOnce  sync.Once
+}
+
+// Listen answers the queries for zone at addr,which is usually port 53 of the name server the zone is delegated to
+func Listen(addr string, opts Options) (*Listener, error) {
+	zone := normalizeZone(opts.Zone)
+	if zone == "" {
+		return nil, errors.New("dns zone not configured")
+	}
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, errors.Wrap(err, "listen udp")
+	}
+	l := &Listener{pc: pc, zone: zone, sessions: make(map[string]*serverConn), accepted: make(chan *serverConn, 16), die: make(chan struct{})}
+	go l.serve()
+	go l.expire()
+	return l, nil
+}
+
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.accepted:
+		return c, nil
+	case <-l.die:
+		return nil, errors.Wrap(net.ErrClosed, "dns listener")
+	}
+}
+
+func (l *Listener) Close() error {
+	l.dieOnce.Do(func() {
+		close(l.die)
+	})
+	return l.pc.Close()
+}
+
+func (l *Listener) Addr() net.Addr {
+	return l.pc.LocalAddr()
+}
+
+func (l *Listener) serve() {
+	buf := make([]byte, 4096)
+	for {
+		n, addr, err := l.pc.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-l.die:
+				return
+			default:
+			}
+			dnsLog.WithFields(log.Fields{"err": err}).Warningln("read dns query failed!")
+			continue
+		}
+		answer := l.answer(buf[:n], addr)
+		if answer != nil {
+			l.pc.WriteTo(answer, addr)
+		}
+	}
+}
+
+// answer returns the answer to the query msg from addr,nil to drop it
+func (l *Listener) answer(msg []byte, addr net.Addr) []byte {
+	id, q, size, err := parseQuery(msg)
+	if err != nil {
+		return nil
+	}
+	data, flag, seq, session, err := parseQueryName(q.name, l.zone)
+	if err != nil || (q.qtype != TypeTXT && q.qtype != TypeNULL) {
+		dnsLog.WithFields(log.Fields{"name": q.name, "type": q.qtype, "remote_addr": addr.String()}).Debugln("dns query refused")
+		return buildResponse(id, q, rcodeRefused, nil)
+	}
+	l.lock.Lock()
+	c, isok := l.sessions[session]
+	if !isok && flag == flagData && seq == 0 {
+		c = &serverConn{stream: newStream(), lis: l, session: session}
+		select {
+		case l.accepted <- c:
+			l.sessions[session] = c
+			isok = true
+		default:
+			// nobody accepting,the client retries the query
+			l.lock.Unlock()
+			return nil
+		}
+	}
+	l.lock.Unlock()
+	if !isok {
+		return buildResponse(id, q, rcodeNXDomain, nil)
+	}
+	if flag == flagClose {
+		l.remove(c)
+		c.shut(nil)
+		return buildResponse(id, q, rcodeSuccess, nil)
+	}
+	c.lock.Lock()
+	c.lastQuery = time.Now()
+	c.remote = addr
+	c.lock.Unlock()
+	switch seq {
+	case c.seq:
+		if c.broken() && c.pending() == 0 {
+			// closed by server and everything written is sent
+			l.remove(c)
+			return buildResponse(id, q, rcodeNXDomain, nil)
+		}
+		c.deliver(data)
+		room := answerRoom(q, size)
+		payload := c.peek(room)
+		c.take(len(payload))
+		c.lastAnswer = payload
+		c.seq++
+		return buildResponse(id, q, rcodeSuccess, payload)
+	case c.seq - 1:
+		// the answer was lost or the query was retransmitted by a resolver
+		return buildResponse(id, q, rcodeSuccess, c.lastAnswer)
+	}
+	return buildResponse(id, q, rcodeNXDomain, nil)
+}
+
+func (l *Listener) remove(c *serverConn) {
+	l.lock.Lock()
+	if l.sessions[c.session] == c {
+		delete(l.sessions, c.session)
+	}
+	l.lock.Unlock()
+}
+
+func (l *Listener) expire() {
+	ticker := time.NewTicker(sessionTimeout / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			var idle []*serverConn
+			l.lock.Lock()
+			for _, c := range l.sessions {
+				c.lock.Lock()
+				if time.Since(c.lastQuery) > sessionTimeout {
+					idle = append(idle, c)
+				}
+				c.lock.Unlock()
+			}
+			l.lock.Unlock()
+			for _, c := range idle {
+				l.remove(c)
+				c.shut(errors.New("dns session timed out"))
+			}
+		case <-l.die:
+			return
+		}
+	}
+}
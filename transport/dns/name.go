@@ -0,0 +1,101 @@
+// Copyright 2017 longXboy, longxboyhi@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dns
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// the names of queries are data labels,a label of the flag and sequence,the session and the zone,
+// like <base32 data>.d0000002a.<session>.t.example.com.the data is base32 since resolvers don't keep the case
+var encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+const (
+	maxNameLength  = 253
+	maxLabelLength = 63
+	sessionLength  = 8
+	//flag and 8 hex digits of the sequence
+	seqLabelLength = 9
+)
+
+// flags of the queries
+const (
+	flagData  = 'd'
+	flagClose = 'f'
+)
+
+func newSessionID() string {
+	b := make([]byte, sessionLength*5/8)
+	rand.Read(b)
+	return strings.ToLower(encoding.EncodeToString(b))
+}
+
+// upstreamRoom is the bytes of data a query name under zone can carry
+func upstreamRoom(zone string) int {
+	room := maxNameLength - len(zone) - 1 - sessionLength - 1 - seqLabelLength
+	// each label of data takes a dot after it
+	chars := room - (room+maxLabelLength)/(maxLabelLength+1)
+	return chars * 5 / 8
+}
+
+// queryName encodes data of sequence seq of session under zone
+func queryName(data []byte, flag byte, seq uint32, session string, zone string) string {
+	var b strings.Builder
+	enc := strings.ToLower(encoding.EncodeToString(data))
+	for len(enc) > 0 {
+		n := len(enc)
+		if n > maxLabelLength {
+			n = maxLabelLength
+		}
+		b.WriteString(enc[:n])
+		b.WriteByte('.')
+		enc = enc[n:]
+	}
+	fmt.Fprintf(&b, "%c%08x.%s.%s", flag, seq, session, zone)
+	return b.String()
+}
+
+// parseQueryName decodes a query name under zone,it returns an error for the names of other zones
+func parseQueryName(name string, zone string) (data []byte, flag byte, seq uint32, session string, err error) {
+	suffix := "." + zone
+	if len(name) <= len(suffix) || !strings.EqualFold(name[len(name)-len(suffix):], suffix) {
+		return nil, 0, 0, "", errors.Errorf("name %s not under zone %s", name, zone)
+	}
+	labels := strings.Split(strings.ToLower(name[:len(name)-len(suffix)]), ".")
+	if len(labels) < 2 {
+		return nil, 0, 0, "", errors.Errorf("name %s of no session", name)
+	}
+	session = labels[len(labels)-1]
+	seqLabel := labels[len(labels)-2]
+	if len(session) != sessionLength || len(seqLabel) != seqLabelLength {
+		return nil, 0, 0, "", errors.Errorf("name %s of no session", name)
+	}
+	flag = seqLabel[0]
+	n, err := strconv.ParseUint(seqLabel[1:], 16, 32)
+	if err != nil {
+		return nil, 0, 0, "", errors.Wrap(err, "parse sequence")
+	}
+	data, err = encoding.DecodeString(strings.ToUpper(strings.Join(labels[:len(labels)-2], "")))
+	if err != nil {
+		return nil, 0, 0, "", errors.Wrap(err, "decode data")
+	}
+	return data, flag, uint32(n), session, nil
+}
@@ -0,0 +1,180 @@
+// Copyright 2017 longXboy, longxboyhi@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dns
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// maxBuffered is the bytes written ahead of the exchanges before Write blocks
+const maxBuffered = 64 << 10
+
+// stream holds the bytes of a conn between its Read and Write and the dns exchanges carrying them
+type stream struct {
+	lock sync.Mutex
+	cond *sync.Cond
+	//received,waiting for Read
+	in bytes.Buffer
+	//written,waiting to be sent
+	out bytes.Buffer
+	//set once the conn is closed or broken,Read returns it after in is drained
+	err           error
+	readDeadline  time.Time
+	writeDeadline time.Time
+	//signals the writes to the exchanges
+	wrote chan struct{}
+}
+
+func newStream() *stream {
+	s := &stream{wrote: make(chan struct{}, 1)}
+	s.cond = sync.NewCond(&s.lock)
+	return s
+}
+
+func expired(deadline time.Time) bool {
+	return !deadline.IsZero() && !time.Now().Before(deadline)
+}
+
+func (s *stream) Read(p []byte) (int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for s.in.Len() == 0 {
+		if s.err != nil {
+			return 0, s.err
+		}
+		if expired(s.readDeadline) {
+			return 0, os.ErrDeadlineExceeded
+		}
+		s.cond.Wait()
+	}
+	return s.in.Read(p)
+}
+
+func (s *stream) Write(p []byte) (int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	n := 0
+	for n < len(p) {
+		if s.err != nil {
+			return n, s.err
+		}
+		if expired(s.writeDeadline) {
+			return n, os.ErrDeadlineExceeded
+		}
+		if s.out.Len() >= maxBuffered {
+			s.cond.Wait()
+			continue
+		}
+		m := len(p) - n
+		if m > maxBuffered-s.out.Len() {
+			m = maxBuffered - s.out.Len()
+		}
+		s.out.Write(p[n : n+m])
+		n += m
+		select {
+		case s.wrote <- struct{}{}:
+		default:
+		}
+	}
+	return n, nil
+}
+
+// deliver appends the bytes received to in
+func (s *stream) deliver(p []byte) {
+	if len(p) == 0 {
+		return
+	}
+	s.lock.Lock()
+	s.in.Write(p)
+	s.lock.Unlock()
+	s.cond.Broadcast()
+}
+
+// peek returns up to n bytes written without taking them
+func (s *stream) peek(n int) []byte {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if n > s.out.Len() {
+		n = s.out.Len()
+	}
+	return append([]byte(nil), s.out.Bytes()[:n]...)
+}
+
+// take removes the first n bytes written once they are sent
+func (s *stream) take(n int) {
+	s.lock.Lock()
+	s.out.Next(n)
+	s.lock.Unlock()
+	s.cond.Broadcast()
+}
+
+// pending returns the bytes written and not taken yet
+func (s *stream) pending() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.out.Len()
+}
+
+// shut breaks the stream with err,Read returns io.EOF for a nil err
+func (s *stream) shut(err error) {
+	if err == nil {
+		err = io.EOF
+	}
+	s.lock.Lock()
+	if s.err == nil {
+		s.err = err
+	}
+	s.lock.Unlock()
+	s.cond.Broadcast()
+}
+
+func (s *stream) broken() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.err != nil
+}
+
+func (s *stream) SetDeadline(t time.Time) error {
+	s.SetReadDeadline(t)
+	return s.SetWriteDeadline(t)
+}
+
+func (s *stream) SetReadDeadline(t time.Time) error {
+	s.lock.Lock()
+	s.readDeadline = t
+	s.lock.Unlock()
+	s.wakeAt(t)
+	return nil
+}
+
+func (s *stream) SetWriteDeadline(t time.Time) error {
+	s.lock.Lock()
+	s.writeDeadline = t
+	s.lock.Unlock()
+	s.wakeAt(t)
+	return nil
+}
+
+// wakeAt wakes the blocked Read and Write at t,so they see the deadline expired
+func (s *stream) wakeAt(t time.Time) {
+	s.cond.Broadcast()
+	if !t.IsZero() {
+		time.AfterFunc(time.Until(t), s.cond.Broadcast)
+	}
+}
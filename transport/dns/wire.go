@@ -0,0 +1,264 @@
+// Copyright 2017 longXboy, longxboyhi@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dns
+
+import (
+	"encoding/binary"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// record types the streams are carried in
+const (
+	TypeTXT  uint16 = 16
+	TypeNULL uint16 = 10
+	typeOPT  uint16 = 41
+	classIN  uint16 = 1
+)
+
+const (
+	rcodeSuccess  = 0
+	rcodeNXDomain = 3
+	rcodeRefused  = 5
+)
+
+const (
+	headerSize = 12
+	//payload of udp the queries announce by EDNS0,the common size passing the resolvers unfragmented
+	ednsSize = 1232
+	//payload of udp a query without EDNS0 can be answered in
+	classicSize = 512
+)
+
+var errMalformed = errors.New("malformed dns message")
+
+// question is the only question of a query and its answer
+type question struct {
+	name  string
+	qtype uint16
+}
+
+// appendName appends name in wire format,it must be no longer than 253 bytes with labels no longer than 63
+func appendName(b []byte, name string) []byte {
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if label == "" {
+			continue
+		}
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	return append(b, 0)
+}
+
+// readName reads the name at off of msg following the compression pointers,
+// it returns the name and the offset after it
+func readName(msg []byte, off int) (string, int, error) {
+	var labels []string
+	end := -1
+	for hops := 0; ; hops++ {
+		if off >= len(msg) || hops > 127 {
+			return "", 0, errMalformed
+		}
+		l := int(msg[off])
+		switch {
+		case l == 0:
+			if end < 0 {
+				end = off + 1
+			}
+			return strings.Join(labels, "."), end, nil
+		case l&0xC0 == 0xC0:
+			if off+1 >= len(msg) {
+				return "", 0, errMalformed
+			}
+			if end < 0 {
+				end = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3FFF)
+		case l > 63:
+			return "", 0, errMalformed
+		default:
+			if off+1+l > len(msg) {
+				return "", 0, errMalformed
+			}
+			labels = append(labels, string(msg[off+1:off+1+l]))
+			off += 1 + l
+		}
+	}
+}
+
+// buildQuery makes a recursive query of q announcing ednsSize
+func buildQuery(id uint16, q question) []byte {
+	b := make([]byte, headerSize, headerSize+len(q.name)+2+4+11)
+	binary.BigEndian.PutUint16(b[0:], id)
+	// recursion desired
+	binary.BigEndian.PutUint16(b[2:], 0x0100)
+	binary.BigEndian.PutUint16(b[4:], 1)
+	binary.BigEndian.PutUint16(b[10:], 1)
+	b = appendName(b, q.name)
+	b = binary.BigEndian.AppendUint16(b, q.qtype)
+	b = binary.BigEndian.AppendUint16(b, classIN)
+	// OPT pseudo record of the root name
+	b = append(b, 0)
+	b = binary.BigEndian.AppendUint16(b, typeOPT)
+	b = binary.BigEndian.AppendUint16(b, ednsSize)
+	b = append(b, 0, 0, 0, 0, 0, 0)
+	return b
+}
+
+// parseQuery returns the id and the question of a query with the udp payload its sender accepts
+func parseQuery(msg []byte) (uint16, question, int, error) {
+	var q question
+	if len(msg) < headerSize {
+		return 0, q, 0, errMalformed
+	}
+	id := binary.BigEndian.Uint16(msg)
+	if msg[2]&0x80 != 0 || binary.BigEndian.Uint16(msg[4:]) != 1 {
+		return 0, q, 0, errMalformed
+	}
+	name, off, err := readName(msg, headerSize)
+	if err != nil {
+		return 0, q, 0, err
+	}
+	if off+4 > len(msg) {
+		return 0, q, 0, errMalformed
+	}
+	q.name = name
+	q.qtype = binary.BigEndian.Uint16(msg[off:])
+	off += 4
+	size := classicSize
+	// look for the OPT record in the additional section
+	for i := 0; i < int(binary.BigEndian.Uint16(msg[10:])); i++ {
+		_, next, err := readName(msg, off)
+		if err != nil || next+10 > len(msg) {
+			break
+		}
+		if binary.BigEndian.Uint16(msg[next:]) == typeOPT {
+			if s := int(binary.BigEndian.Uint16(msg[next+2:])); s > size {
+				size = s
+			}
+		}
+		off = next + 10 + int(binary.BigEndian.Uint16(msg[next+8:]))
+	}
+	if size > ednsSize {
+		size = ednsSize
+	}
+	return id, q, size, nil
+}
+
+// appendRdata appends the rdata of payload in a record of qtype,
+// TXT splits it into strings of 255 bytes
+func appendRdata(b []byte, qtype uint16, payload []byte) []byte {
+	if qtype != TypeTXT {
+		b = binary.BigEndian.AppendUint16(b, uint16(len(payload)))
+		return append(b, payload...)
+	}
+	strs := (len(payload) + 254) / 255
+	if strs == 0 {
+		// a TXT record holds one string at least
+		strs = 1
+	}
+	b = binary.BigEndian.AppendUint16(b, uint16(len(payload)+strs))
+	for i := 0; i < strs; i++ {
+		end := (i + 1) * 255
+		if end > len(payload) {
+			end = len(payload)
+		}
+		b = append(b, byte(end-i*255))
+		b = append(b, payload[i*255:end]...)
+	}
+	return b
+}
+
+// answerRoom is the payload an answer to q fits in a udp payload of size
+func answerRoom(q question, size int) int {
+	// header,question,answer of the name pointer,type,class,ttl and rdlength
+	room := size - headerSize - (len(q.name) + 2 + 4) - (2 + 10)
+	if q.qtype == TypeTXT {
+		room -= (room + 255) / 256
+	}
+	return room
+}
+
+// buildResponse answers q with a record of payload,no answer is carried unless rcode is success
+func buildResponse(id uint16, q question, rcode int, payload []byte) []byte {
+	b := make([]byte, headerSize, headerSize+len(q.name)+2+4+12+len(payload)+len(payload)/255+1)
+	binary.BigEndian.PutUint16(b[0:], id)
+	// response,authoritative,recursion desired
+	binary.BigEndian.PutUint16(b[2:], 0x8500|uint16(rcode))
+	binary.BigEndian.PutUint16(b[4:], 1)
+	b = appendName(b, q.name)
+	b = binary.BigEndian.AppendUint16(b, q.qtype)
+	b = binary.BigEndian.AppendUint16(b, classIN)
+	if rcode != rcodeSuccess {
+		return b
+	}
+	binary.BigEndian.PutUint16(b[6:], 1)
+	b = append(b, 0xC0, headerSize)
+	b = binary.BigEndian.AppendUint16(b, q.qtype)
+	b = binary.BigEndian.AppendUint16(b, classIN)
+	// ttl 0,the resolvers shouldn't cache the answers
+	b = append(b, 0, 0, 0, 0)
+	return appendRdata(b, q.qtype, payload)
+}
+
+// parseResponse returns the id,rcode,question name and the payload of the answers of qtype in a response
+func parseResponse(msg []byte, qtype uint16) (uint16, int, string, []byte, error) {
+	if len(msg) < headerSize || msg[2]&0x80 == 0 {
+		return 0, 0, "", nil, errMalformed
+	}
+	id := binary.BigEndian.Uint16(msg)
+	rcode := int(msg[3] & 0x0F)
+	if binary.BigEndian.Uint16(msg[4:]) != 1 {
+		return 0, 0, "", nil, errMalformed
+	}
+	name, off, err := readName(msg, headerSize)
+	if err != nil {
+		return 0, 0, "", nil, err
+	}
+	off += 4
+	if off > len(msg) {
+		return 0, 0, "", nil, errMalformed
+	}
+	var payload []byte
+	for i := 0; i < int(binary.BigEndian.Uint16(msg[6:])); i++ {
+		_, next, err := readName(msg, off)
+		if err != nil || next+10 > len(msg) {
+			return 0, 0, "", nil, errMalformed
+		}
+		rtype := binary.BigEndian.Uint16(msg[next:])
+		rdlen := int(binary.BigEndian.Uint16(msg[next+8:]))
+		rdata := next + 10
+		if rdata+rdlen > len(msg) {
+			return 0, 0, "", nil, errMalformed
+		}
+		if rtype == qtype {
+			if qtype == TypeTXT {
+				for p := rdata; p < rdata+rdlen; {
+					l := int(msg[p])
+					if p+1+l > rdata+rdlen {
+						return 0, 0, "", nil, errMalformed
+					}
+					payload = append(payload, msg[p+1:p+1+l]...)
+					p += 1 + l
+				}
+			} else {
+				payload = append(payload, msg[rdata:rdata+rdlen]...)
+			}
+		}
+		off = rdata + rdlen
+	}
+	return id, rcode, name, payload, nil
+}
@@ -0,0 +1,171 @@
+// Copyright 2017 longXboy, longxboyhi@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transport
+
+import (
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Faults are injected into the connections of the transports to test how reconnecting,pipe failover
+// and heartbeats cope with a bad network,only the binaries built with -tags faults honor them
+type Faults struct {
+	//percent of the connections closed right after they are dialed or accepted
+	Drop float64 `yaml:"drop,omitempty"`
+	//milliseconds every write is delayed by,plus up to Jitter milliseconds at random
+	Latency int `yaml:"latency,omitempty"`
+	Jitter  int `yaml:"jitter,omitempty"`
+	//bytes per second a connection writes at most,0 is unlimited
+	Bandwidth int `yaml:"bandwidth,omitempty"`
+	//percent of the writes the connection is reset at instead,cutting it mid-stream
+	Reset float64 `yaml:"reset,omitempty"`
+	//seed of the random decisions so that a run can be repeated,0 seeds by the time
+	Seed int64 `yaml:"seed,omitempty"`
+}
+
+func (f Faults) empty() bool {
+	return f.Drop == 0 && f.Latency == 0 && f.Jitter == 0 && f.Bandwidth == 0 && f.Reset == 0
+}
+
+var errFaultDrop = errors.New("connection dropped by fault injection")
+var errFaultReset = errors.New("connection reset by fault injection")
+
+// FaultInjector injects Faults into connections,all of them draw from one random source
+type FaultInjector struct {
+	faults Faults
+	lock   sync.Mutex
+	rnd    *rand.Rand
+}
+
+// NewFaultInjector returns nil if no fault is configured,
+// and an error if faults are configured but not compiled in
+func NewFaultInjector(f Faults) (*FaultInjector, error) {
+	if f.empty() {
+		return nil, nil
+	}
+	if !faultsCompiled {
+		return nil, errors.New("faults are only injected by lunnel built with -tags faults")
+	}
+	return newFaultInjector(f)
+}
+
+func newFaultInjector(f Faults) (*FaultInjector, error) {
+	if f.Drop < 0 || f.Drop > 100 || f.Reset < 0 || f.Reset > 100 {
+		return nil, errors.New("drop and reset must be percents between 0 and 100")
+	}
+	if f.Latency < 0 || f.Jitter < 0 || f.Bandwidth < 0 {
+		return nil, errors.New("latency,jitter and bandwidth can not be negative")
+	}
+	seed := f.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	return &FaultInjector{faults: f, rnd: rand.New(rand.NewSource(seed))}, nil
+}
+
+func (fi *FaultInjector) chance(percent float64) bool {
+	if percent == 0 {
+		return false
+	}
+	fi.lock.Lock()
+	defer fi.lock.Unlock()
+	return fi.rnd.Float64()*100 < percent
+}
+
+func (fi *FaultInjector) delay() time.Duration {
+	d := time.Duration(fi.faults.Latency) * time.Millisecond
+	if fi.faults.Jitter > 0 {
+		fi.lock.Lock()
+		d += time.Duration(fi.rnd.Intn(fi.faults.Jitter+1)) * time.Millisecond
+		fi.lock.Unlock()
+	}
+	return d
+}
+
+// wrap closes conn and returns errFaultDrop if it is dropped
+func (fi *FaultInjector) wrap(conn net.Conn) (net.Conn, error) {
+	if fi.chance(fi.faults.Drop) {
+		conn.Close()
+		return nil, errFaultDrop
+	}
+	return &faultConn{Conn: conn, fi: fi}, nil
+}
+
+type faultConn struct {
+	net.Conn
+	fi *FaultInjector
+}
+
+func (c *faultConn) Write(p []byte) (int, error) {
+	if c.fi.chance(c.fi.faults.Reset) {
+		if tcpConn, isok := c.Conn.(*net.TCPConn); isok {
+			// send RST rather than FIN as a broken middlebox does
+			tcpConn.SetLinger(0)
+		}
+		c.Conn.Close()
+		return 0, errFaultReset
+	}
+	if d := c.fi.delay(); d > 0 {
+		time.Sleep(d)
+	}
+	bandwidth := c.fi.faults.Bandwidth
+	if bandwidth == 0 {
+		return c.Conn.Write(p)
+	}
+	// write in slices worth 10ms so that the cap holds within a large write too
+	slice := bandwidth / 100
+	if slice == 0 {
+		slice = 1
+	}
+	var n int
+	for len(p) > 0 {
+		size := slice
+		if size > len(p) {
+			size = len(p)
+		}
+		start := time.Now()
+		written, err := c.Conn.Write(p[:size])
+		n += written
+		if err != nil {
+			return n, err
+		}
+		time.Sleep(time.Duration(size)*time.Second/time.Duration(bandwidth) - time.Since(start))
+		p = p[size:]
+	}
+	return n, nil
+}
+
+// faultListener drops the accepted connections by chance and injects faults into the rest
+type faultListener struct {
+	net.Listener
+	fi *FaultInjector
+}
+
+func (l *faultListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		conn, err = l.fi.wrap(conn)
+		if err == nil {
+			return conn, nil
+		}
+	}
+}
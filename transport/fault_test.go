@@ -0,0 +1,108 @@
+// Copyright 2017 longXboy, longxboyhi@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transport
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestFaultsNeedTag(t *testing.T) {
+	fi, err := NewFaultInjector(Faults{})
+	if fi != nil || err != nil {
+		t.Fatalf("no faults should give no injector,got %v %v", fi, err)
+	}
+	_, err = NewFaultInjector(Faults{Drop: 10})
+	if (err == nil) != faultsCompiled {
+		t.Fatalf("faults compiled %v,err %v", faultsCompiled, err)
+	}
+	_, err = newFaultInjector(Faults{Drop: 101})
+	if err == nil {
+		t.Fatal("drop over 100 should be refused")
+	}
+}
+
+func TestFaultDropSeeded(t *testing.T) {
+	drops := func() []bool {
+		fi, err := newFaultInjector(Faults{Drop: 50, Seed: 42})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var dropped []bool
+		for i := 0; i < 64; i++ {
+			c1, c2 := net.Pipe()
+			_, err := fi.wrap(c1)
+			dropped = append(dropped, err == errFaultDrop)
+			c1.Close()
+			c2.Close()
+		}
+		return dropped
+	}
+	first, second := drops(), drops()
+	var n int
+	for i := range first {
+		if first[i] != second[i] {
+			t.Fatalf("conn %d dropped differently by the same seed", i)
+		}
+		if first[i] {
+			n++
+		}
+	}
+	if n == 0 || n == len(first) {
+		t.Fatalf("%d of %d conns dropped at 50%%", n, len(first))
+	}
+}
+
+func TestFaultReset(t *testing.T) {
+	fi, err := newFaultInjector(Faults{Reset: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	conn, _ := fi.wrap(c1)
+	_, err = conn.Write([]byte("x"))
+	if err != errFaultReset {
+		t.Fatalf("write err %v,want reset", err)
+	}
+	_, err = c2.Read(make([]byte, 1))
+	if err != io.EOF {
+		t.Fatalf("peer read err %v,want EOF", err)
+	}
+}
+
+func TestFaultBandwidth(t *testing.T) {
+	fi, err := newFaultInjector(Faults{Bandwidth: 100 << 10, Latency: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	go io.Copy(ioutil.Discard, c2)
+	conn, _ := fi.wrap(c1)
+	defer conn.Close()
+	start := time.Now()
+	_, err = conn.Write(make([]byte, 20<<10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 20KB at 100KB/s after 10ms of latency
+	if elapsed := time.Since(start); elapsed < time.Millisecond*200 {
+		t.Fatalf("write took %v,bandwidth not applied", elapsed)
+	}
+}
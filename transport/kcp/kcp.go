@@ -33,16 +33,85 @@ var (
 	udpSegmentSize = 1452
 )
 
+// newBlockCrypt encrypts the kcp packets by key so their headers are hidden,or not at all if key is empty
+func newBlockCrypt(key []byte) kcp.BlockCrypt {
+	if len(key) == 0 {
+		block, _ := kcp.NewNoneBlockCrypt([]byte{12})
+		return block
+	}
+	block, _ := kcp.NewAESBlockCrypt(key)
+	return block
+}
+
+// Options tunes the kcp connections,the zero value keeps the defaults
+type Options struct {
+	//largest packet sent,0 probes the mtu of the path
+	Mtu int
+	//send and receive windows in packets,no smaller than the defaults of 128 and 1024
+	SndWnd int
+	RcvWnd int
+}
+
+const (
+	defaultSndWnd = 128
+	defaultRcvWnd = 1024
+	//send window of the accepted connections
+	acceptSndWnd = 1024
+	//MaxWnd caps the windows,32768 packets is about 45MB in flight
+	MaxWnd = 32768
+)
+
+// WindowPackets returns the packets of a window of bytes
+func WindowPackets(bytes int) int {
+	return bytes / udpSegmentSize
+}
+
+func (opts Options) windows() (int, int) {
+	snd, rcv := defaultSndWnd, defaultRcvWnd
+	if opts.SndWnd > snd {
+		snd = opts.SndWnd
+	}
+	if opts.RcvWnd > rcv {
+		rcv = opts.RcvWnd
+	}
+	if snd > MaxWnd {
+		snd = MaxWnd
+	}
+	if rcv > MaxWnd {
+		rcv = MaxWnd
+	}
+	return snd, rcv
+}
+
 func Dial(addr string) (net.Conn, error) {
-	block, _ := kcp.NewNoneBlockCrypt([]byte{12})
+	return DialWithKey(addr, nil, Options{})
+}
+
+// DialWithKey dials addr with the packets encrypted by key(16,24 or 32 bytes)
+func DialWithKey(addr string, key []byte, opts Options) (net.Conn, error) {
+	block := newBlockCrypt(key)
 	kcpconn, err := kcp.DialWithOptions(addr, block, dataShard, parityShard)
 	if err != nil {
 		return nil, errors.Wrap(err, "create kcpConn")
 	}
+	return setupConn(kcpconn, opts)
+}
+
+// DialWithConn dials addr over conn,which is connected to addr already,
+// so the caller decides the source address and socket options of the packets
+func DialWithConn(addr string, key []byte, opts Options, conn *net.UDPConn) (net.Conn, error) {
+	kcpconn, err := kcp.NewConn(addr, newBlockCrypt(key), dataShard, parityShard, &kcp.ConnectedUDPConn{UDPConn: conn, Conn: conn})
+	if err != nil {
+		return nil, errors.Wrap(err, "create kcpConn")
+	}
+	return setupConn(kcpconn, opts)
+}
+
+func setupConn(kcpconn *kcp.UDPSession, opts Options) (net.Conn, error) {
 	kcpconn.SetStreamMode(true)
 	kcpconn.SetNoDelay(noDelay, interval, resend, noCongestion)
-	kcpconn.SetWindowSize(128, 1024)
-	kcpconn.SetMtu(udpSegmentSize)
+	kcpconn.SetWindowSize(opts.windows())
+	kcpconn.SetMtu(kcpMtu(kcpconn.RemoteAddr(), opts.Mtu))
 	kcpconn.SetACKNoDelay(false)
 
 	if err := kcpconn.SetDSCP(0); err != nil {
@@ -60,10 +129,17 @@ func Dial(addr string) (net.Conn, error) {
 
 type Listener struct {
 	lis *kcp.Listener
+	//options of the accepted connections,whose send window defaults to 1024 rather than 128
+	opts Options
 }
 
 func Listen(addr string) (*Listener, error) {
-	block, _ := kcp.NewNoneBlockCrypt([]byte{12})
+	return ListenWithKey(addr, nil, Options{})
+}
+
+// ListenWithKey listens on addr with the packets encrypted by key(16,24 or 32 bytes)
+func ListenWithKey(addr string, key []byte, opts Options) (*Listener, error) {
+	block := newBlockCrypt(key)
 	lis, err := kcp.ListenWithOptions(addr, block, dataShard, parityShard)
 	if err != nil {
 		return nil, errors.Wrap(err, "kcp ListenWithOptions")
@@ -80,7 +156,10 @@ func Listen(addr string) (*Listener, error) {
 	if err := lis.SetWriteBuffer(SockBuf); err != nil {
 		return nil, errors.Wrap(err, "kcp SetWriteBuffer")
 	}
-	return &Listener{lis: lis}, nil
+	if opts.SndWnd < acceptSndWnd {
+		opts.SndWnd = acceptSndWnd
+	}
+	return &Listener{lis: lis, opts: opts}, nil
 }
 
 func (l *Listener) Close() error {
@@ -96,8 +175,24 @@ func (l *Listener) Accept() (net.Conn, error) {
 	}
 	conn.SetStreamMode(true)
 	conn.SetNoDelay(noDelay, interval, resend, noCongestion)
-	conn.SetMtu(udpSegmentSize)
-	conn.SetWindowSize(1024, 1024)
+	conn.SetMtu(kcpMtu(conn.RemoteAddr(), l.opts.Mtu))
+	conn.SetWindowSize(l.opts.windows())
 	conn.SetACKNoDelay(false)
 	return conn, nil
 }
+
+// RaiseSndWnd raises the send window of conn accepted by Listener to wnd packets,capped by MaxWnd.
+// it returns false if conn is not a kcp connection,e.g. wrapped by obfuscation
+func RaiseSndWnd(conn net.Conn, wnd int) bool {
+	kcpconn, isok := conn.(*kcp.UDPSession)
+	if !isok {
+		return false
+	}
+	if wnd > MaxWnd {
+		wnd = MaxWnd
+	}
+	if wnd > acceptSndWnd {
+		kcpconn.SetWindowSize(wnd, 0)
+	}
+	return true
+}
@@ -0,0 +1,124 @@
+// Copyright 2017 longXboy, longxboyhi@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kcp
+
+import (
+	"net"
+	"sort"
+	"sync"
+
+	"github.com/longXboy/lunnel/log"
+)
+
+var kcpLog = log.Module("kcp")
+
+const (
+	//ip and udp headers in front of the kcp packets
+	ipv4Overhead = 20 + 8
+	ipv6Overhead = 40 + 8
+	//MinMtu is the smallest mtu of the kcp packets,what every ipv4 path carries
+	MinMtu = 576 - ipv4Overhead
+	//MaxMtu is the largest mtu of the kcp packets kcp-go sends
+	MaxMtu = 1500
+)
+
+// mtuCounts counts the kcp connections set up by their mtu
+var mtuCounts = struct {
+	sync.Mutex
+	byMtu map[int]uint64
+}{byMtu: make(map[int]uint64)}
+
+// MtuCount is how many kcp connections were set up with Mtu
+type MtuCount struct {
+	Mtu   int
+	Conns uint64
+}
+
+// MtuCounts returns how many kcp connections were set up with each mtu,ordered by mtu
+func MtuCounts() []MtuCount {
+	mtuCounts.Lock()
+	counts := make([]MtuCount, 0, len(mtuCounts.byMtu))
+	for mtu, n := range mtuCounts.byMtu {
+		counts = append(counts, MtuCount{Mtu: mtu, Conns: n})
+	}
+	mtuCounts.Unlock()
+	sort.Slice(counts, func(i, j int) bool { return counts[i].Mtu < counts[j].Mtu })
+	return counts
+}
+
+// PathMtu returns the mtu of the path to raddr and where it is known from,
+// "route" for the path mtu of the route on linux,which learns the smaller mtus of the path from icmp,
+// "interface" for the mtu of the interface the packets leave by,or 0 and "" if unknown
+func PathMtu(raddr *net.UDPAddr) (int, string) {
+	conn, err := net.DialUDP("udp", nil, raddr)
+	if err != nil {
+		return 0, ""
+	}
+	defer conn.Close()
+	if mtu := routeMtu(conn, raddr.IP.To4() == nil); mtu > 0 {
+		return mtu, "route"
+	}
+	laddr := conn.LocalAddr().(*net.UDPAddr)
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return 0, ""
+	}
+	for _, iface := range ifaces {
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if ipnet, isok := addr.(*net.IPNet); isok && ipnet.IP.Equal(laddr.IP) {
+				return iface.MTU, "interface"
+			}
+		}
+	}
+	return 0, ""
+}
+
+// kcpMtu returns the mtu of the kcp packets to raddr,which is mtu if set,
+// otherwise the mtu of the path without the ip and udp headers,no larger than the default
+func kcpMtu(raddr net.Addr, mtu int) int {
+	source := "config"
+	if mtu == 0 {
+		mtu = udpSegmentSize
+		source = "default"
+		if uaddr, isok := raddr.(*net.UDPAddr); isok {
+			pathMtu, from := PathMtu(uaddr)
+			overhead := ipv4Overhead
+			if uaddr.IP.To4() == nil {
+				overhead = ipv6Overhead
+			}
+			if pathMtu > 0 && pathMtu-overhead < mtu {
+				mtu = pathMtu - overhead
+				source = from
+				if mtu < MinMtu {
+					mtu = MinMtu
+				}
+			}
+		}
+	}
+	mtuCounts.Lock()
+	mtuCounts.byMtu[mtu]++
+	mtuCounts.Unlock()
+	fields := log.Fields{"remote_addr": raddr.String(), "mtu": mtu, "source": source}
+	if source == "route" || source == "interface" {
+		kcpLog.WithFields(fields).Infoln("kcp mtu lowered to the path mtu")
+	} else {
+		kcpLog.WithFields(fields).Debugln("kcp mtu")
+	}
+	return mtu
+}
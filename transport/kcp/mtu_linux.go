@@ -0,0 +1,40 @@
+// Copyright 2017 longXboy, longxboyhi@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kcp
+
+import (
+	"net"
+	"syscall"
+)
+
+// routeMtu reads the path mtu of the route conn is connected by,0 if unknown
+func routeMtu(conn *net.UDPConn, ipv6 bool) int {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return 0
+	}
+	var mtu int
+	rc.Control(func(fd uintptr) {
+		if ipv6 {
+			mtu, err = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_MTU)
+		} else {
+			mtu, err = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_MTU)
+		}
+	})
+	if err != nil {
+		return 0
+	}
+	return mtu
+}
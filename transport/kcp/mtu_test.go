@@ -0,0 +1,43 @@
+// Copyright 2017 longXboy, longxboyhi@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kcp
+
+import (
+	"net"
+	"testing"
+)
+
+func TestKcpMtu(t *testing.T) {
+	loopback := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 8089}
+	if mtu, source := PathMtu(loopback); mtu <= 0 || source == "" {
+		t.Fatalf("path mtu of loopback unknown,got %d from %q", mtu, source)
+	}
+	// the mtu of loopback is larger than the default
+	if mtu := kcpMtu(loopback, 0); mtu != udpSegmentSize {
+		t.Fatalf("kcp mtu of loopback got %d,want %d", mtu, udpSegmentSize)
+	}
+	if mtu := kcpMtu(loopback, 1200); mtu != 1200 {
+		t.Fatalf("configured kcp mtu got %d,want 1200", mtu)
+	}
+	var conns uint64
+	for _, c := range MtuCounts() {
+		if c.Mtu == 1200 {
+			conns = c.Conns
+		}
+	}
+	if conns != 1 {
+		t.Fatalf("conns of mtu 1200 got %d,want 1", conns)
+	}
+}
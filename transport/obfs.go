@@ -0,0 +1,486 @@
+// Copyright 2017 longXboy, longxboyhi@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transport
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Obfuscator wraps the raw connections beneath the encrypt mode,
+// so neither the handshake of lunnel nor the framing of kcp can be recognized on the wire
+type Obfuscator interface {
+	// Client wraps a connection dialed to server
+	Client(conn net.Conn) (net.Conn, error)
+	// Server wraps a connection accepted from client,the deadlines of conn are set by the caller
+	Server(conn net.Conn) (net.Conn, error)
+	// PacketKey encrypts the packets of kcp
+	PacketKey() []byte
+}
+
+var obfuscatorsLock sync.RWMutex
+var obfuscators = map[string]func(key string, serverName string) Obfuscator{
+	"xor": func(key string, serverName string) Obfuscator {
+		return &xorObfuscator{key: []byte(key)}
+	},
+	"tls": func(key string, serverName string) Obfuscator {
+		return &tlsObfuscator{xorObfuscator: xorObfuscator{key: []byte(key)}, serverName: serverName}
+	},
+}
+
+// RegisterObfuscator makes the obfuscator created by factory available as mode
+func RegisterObfuscator(mode string, factory func(key string, serverName string) Obfuscator) {
+	obfuscatorsLock.Lock()
+	obfuscators[mode] = factory
+	obfuscatorsLock.Unlock()
+}
+
+// NewObfuscator creates the obfuscator of mode,the same key must be shared by client and server,
+// serverName is the SNI the tls mode pretends to connect to
+func NewObfuscator(mode string, key string, serverName string) (Obfuscator, error) {
+	obfuscatorsLock.RLock()
+	factory, isok := obfuscators[mode]
+	obfuscatorsLock.RUnlock()
+	if !isok {
+		return nil, errors.Errorf("invalid obfs mode:%s", mode)
+	}
+	if key == "" {
+		return nil, errors.New("obfs key can not be empty")
+	}
+	return factory(key, serverName), nil
+}
+
+const obfsTimeout = time.Second * 10
+
+// obfsListener defers the obfuscation handshake of the accepted connections to their first use,
+// so a slow client can't block the accept loop
+type obfsListener struct {
+	net.Listener
+	obfs Obfuscator
+}
+
+func (l *obfsListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &lazyConn{Conn: conn, wrap: l.obfs.Server}, nil
+}
+
+type lazyConn struct {
+	net.Conn
+	wrap    func(net.Conn) (net.Conn, error)
+	once    sync.Once
+	wrapped net.Conn
+	err     error
+
+	// deadlines set by the user of the conn,restored once the handshake is done
+	deadlineLock  sync.Mutex
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+// init runs the handshake within obfsTimeout,or the earlier deadline the user set
+func (c *lazyConn) init() error {
+	c.once.Do(func() {
+		c.deadlineLock.Lock()
+		deadline := time.Now().Add(obfsTimeout)
+		if !c.readDeadline.IsZero() && c.readDeadline.Before(deadline) {
+			deadline = c.readDeadline
+		}
+		c.Conn.SetDeadline(deadline)
+		c.deadlineLock.Unlock()
+		c.wrapped, c.err = c.wrap(c.Conn)
+		c.deadlineLock.Lock()
+		defer c.deadlineLock.Unlock()
+		c.Conn.SetReadDeadline(c.readDeadline)
+		c.Conn.SetWriteDeadline(c.writeDeadline)
+	})
+	return c.err
+}
+
+func (c *lazyConn) SetDeadline(t time.Time) error {
+	c.deadlineLock.Lock()
+	defer c.deadlineLock.Unlock()
+	c.readDeadline, c.writeDeadline = t, t
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *lazyConn) SetReadDeadline(t time.Time) error {
+	c.deadlineLock.Lock()
+	defer c.deadlineLock.Unlock()
+	c.readDeadline = t
+	return c.Conn.SetReadDeadline(t)
+}
+
+func (c *lazyConn) SetWriteDeadline(t time.Time) error {
+	c.deadlineLock.Lock()
+	defer c.deadlineLock.Unlock()
+	c.writeDeadline = t
+	return c.Conn.SetWriteDeadline(t)
+}
+
+func (c *lazyConn) Read(p []byte) (int, error) {
+	if err := c.init(); err != nil {
+		return 0, err
+	}
+	return c.wrapped.Read(p)
+}
+
+func (c *lazyConn) Write(p []byte) (int, error) {
+	if err := c.init(); err != nil {
+		return 0, err
+	}
+	return c.wrapped.Write(p)
+}
+
+// xorObfuscator xors the stream with a keystream of the shared key and a random nonce,
+// the nonce is authenticated by the key and random padding follows it in both directions
+type xorObfuscator struct {
+	key []byte
+}
+
+func (o *xorObfuscator) PacketKey() []byte {
+	sum := sha256.Sum256(append([]byte("lunnel kcp "), o.key...))
+	return sum[:]
+}
+
+func (o *xorObfuscator) mac(nonce []byte) []byte {
+	m := hmac.New(sha256.New, o.key)
+	m.Write(nonce)
+	return m.Sum(nil)[:16]
+}
+
+func (o *xorObfuscator) stream(direction string, nonce []byte) cipher.Stream {
+	m := hmac.New(sha256.New, o.key)
+	m.Write([]byte(direction))
+	m.Write(nonce)
+	block, _ := aes.NewCipher(m.Sum(nil))
+	return cipher.NewCTR(block, make([]byte, aes.BlockSize))
+}
+
+// newXorConn returns the conn of the side which sends on the send direction
+func (o *xorObfuscator) newXorConn(conn net.Conn, nonce []byte, client bool) *xorConn {
+	c2s, s2c := o.stream("c2s", nonce), o.stream("s2c", nonce)
+	if client {
+		return &xorConn{Conn: conn, enc: c2s, dec: s2c}
+	}
+	return &xorConn{Conn: conn, enc: s2c, dec: c2s}
+}
+
+func randomPadding() []byte {
+	var n [1]byte
+	rand.Read(n[:])
+	pad := make([]byte, 1+int(n[0]))
+	pad[0] = n[0]
+	rand.Read(pad[1:])
+	return pad
+}
+
+func (o *xorObfuscator) Client(conn net.Conn) (net.Conn, error) {
+	nonce := make([]byte, 16)
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return nil, errors.Wrap(err, "obfs nonce")
+	}
+	xc := o.newXorConn(conn, nonce, true)
+	_, err = conn.Write(append(append(nonce, o.mac(nonce)...), xc.seal(randomPadding())...))
+	if err != nil {
+		return nil, errors.Wrap(err, "write obfs header")
+	}
+	xc.skipPadding = true
+	return xc, nil
+}
+
+func (o *xorObfuscator) Server(conn net.Conn) (net.Conn, error) {
+	header := make([]byte, 32)
+	_, err := io.ReadFull(conn, header)
+	if err != nil {
+		return nil, errors.Wrap(err, "read obfs header")
+	}
+	if !hmac.Equal(header[16:], o.mac(header[:16])) {
+		return nil, errors.New("obfs header mac mismatch")
+	}
+	xc := o.newXorConn(conn, header[:16], false)
+	err = xc.discardPadding()
+	if err != nil {
+		return nil, err
+	}
+	_, err = conn.Write(xc.seal(randomPadding()))
+	if err != nil {
+		return nil, errors.Wrap(err, "write obfs padding")
+	}
+	return xc, nil
+}
+
+type xorConn struct {
+	net.Conn
+	enc cipher.Stream
+	dec cipher.Stream
+	//the padding of peer hasn't been read yet
+	skipPadding bool
+	wlock       sync.Mutex
+}
+
+func (c *xorConn) seal(p []byte) []byte {
+	out := make([]byte, len(p))
+	c.enc.XORKeyStream(out, p)
+	return out
+}
+
+func (c *xorConn) discardPadding() error {
+	var n [1]byte
+	_, err := io.ReadFull(c.Conn, n[:])
+	if err != nil {
+		return errors.Wrap(err, "read obfs padding")
+	}
+	c.dec.XORKeyStream(n[:], n[:])
+	pad := make([]byte, int(n[0]))
+	_, err = io.ReadFull(c.Conn, pad)
+	if err != nil {
+		return errors.Wrap(err, "read obfs padding")
+	}
+	c.dec.XORKeyStream(pad, pad)
+	return nil
+}
+
+func (c *xorConn) Read(p []byte) (int, error) {
+	if c.skipPadding {
+		c.skipPadding = false
+		err := c.discardPadding()
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := c.Conn.Read(p)
+	c.dec.XORKeyStream(p[:n], p[:n])
+	return n, err
+}
+
+func (c *xorConn) Write(p []byte) (int, error) {
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
+	return c.Conn.Write(c.seal(p))
+}
+
+const (
+	recordHandshake        = 0x16
+	recordChangeCipherSpec = 0x14
+	recordApplicationData  = 0x17
+	maxRecordPayload       = 16384
+)
+
+// tlsObfuscator makes the connection look like tls 1.3 to a host named serverName,
+// the client random carries the nonce and its mac and the data is sent xored in application data records
+type tlsObfuscator struct {
+	xorObfuscator
+	serverName string
+}
+
+func appendUint16(b []byte, v int) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+func appendRecord(b []byte, typ byte, version uint16, payload []byte) []byte {
+	b = append(b, typ, byte(version>>8), byte(version))
+	b = appendUint16(b, len(payload))
+	return append(b, payload...)
+}
+
+func appendHandshake(b []byte, typ byte, body []byte) []byte {
+	b = append(b, typ, byte(len(body)>>16), byte(len(body)>>8), byte(len(body)))
+	return append(b, body...)
+}
+
+func appendExtension(b []byte, typ int, data []byte) []byte {
+	b = appendUint16(b, typ)
+	b = appendUint16(b, len(data))
+	return append(b, data...)
+}
+
+func randomBytes(n int) []byte {
+	b := make([]byte, n)
+	rand.Read(b)
+	return b
+}
+
+func (o *tlsObfuscator) clientHello(random []byte) []byte {
+	var exts []byte
+	if o.serverName != "" {
+		var sni []byte
+		sni = appendUint16(sni, len(o.serverName)+3)
+		sni = append(sni, 0)
+		sni = appendUint16(sni, len(o.serverName))
+		sni = append(sni, o.serverName...)
+		exts = appendExtension(exts, 0x0000, sni)
+	}
+	exts = appendExtension(exts, 0x000a, []byte{0x00, 0x04, 0x00, 0x1d, 0x00, 0x17})
+	exts = appendExtension(exts, 0x000b, []byte{0x01, 0x00})
+	exts = appendExtension(exts, 0x000d, []byte{0x00, 0x08, 0x04, 0x03, 0x08, 0x04, 0x04, 0x01, 0x05, 0x03})
+	exts = appendExtension(exts, 0x0010, []byte{0x00, 0x0c, 0x02, 'h', '2', 0x08, 'h', 't', 't', 'p', '/', '1', '.', '1'})
+	exts = appendExtension(exts, 0x002b, []byte{0x04, 0x03, 0x04, 0x03, 0x03})
+	keyShare := []byte{0x00, 0x24, 0x00, 0x1d, 0x00, 0x20}
+	exts = appendExtension(exts, 0x0033, append(keyShare, randomBytes(32)...))
+	var n [1]byte
+	rand.Read(n[:])
+	exts = appendExtension(exts, 0x0015, make([]byte, int(n[0])))
+
+	body := []byte{0x03, 0x03}
+	body = append(body, random...)
+	body = append(body, 32)
+	body = append(body, randomBytes(32)...)
+	suites := []int{0x1301, 0x1302, 0x1303, 0xc02b, 0xc02f, 0xc02c, 0xc030, 0xcca9, 0xcca8}
+	body = appendUint16(body, len(suites)*2)
+	for _, suite := range suites {
+		body = appendUint16(body, suite)
+	}
+	body = append(body, 0x01, 0x00)
+	body = appendUint16(body, len(exts))
+	body = append(body, exts...)
+	return appendRecord(nil, recordHandshake, 0x0301, appendHandshake(nil, 0x01, body))
+}
+
+func (o *tlsObfuscator) serverHello(sessionId []byte) []byte {
+	body := []byte{0x03, 0x03}
+	body = append(body, randomBytes(32)...)
+	body = append(body, byte(len(sessionId)))
+	body = append(body, sessionId...)
+	body = append(body, 0x13, 0x01, 0x00)
+	var exts []byte
+	exts = appendExtension(exts, 0x002b, []byte{0x03, 0x04})
+	keyShare := []byte{0x00, 0x1d, 0x00, 0x20}
+	exts = appendExtension(exts, 0x0033, append(keyShare, randomBytes(32)...))
+	body = appendUint16(body, len(exts))
+	body = append(body, exts...)
+	out := appendRecord(nil, recordHandshake, 0x0303, appendHandshake(nil, 0x02, body))
+	return appendRecord(out, recordChangeCipherSpec, 0x0303, []byte{0x01})
+}
+
+func readRecord(r io.Reader, buf []byte) (byte, []byte, error) {
+	var hdr [5]byte
+	_, err := io.ReadFull(r, hdr[:])
+	if err != nil {
+		return 0, nil, err
+	}
+	n := int(binary.BigEndian.Uint16(hdr[3:]))
+	if n > maxRecordPayload+256 {
+		return 0, nil, errors.New("obfs record too long")
+	}
+	if cap(buf) < n {
+		buf = make([]byte, n)
+	}
+	buf = buf[:n]
+	_, err = io.ReadFull(r, buf)
+	if err != nil {
+		return 0, nil, err
+	}
+	return hdr[0], buf, nil
+}
+
+func (o *tlsObfuscator) Client(conn net.Conn) (net.Conn, error) {
+	random := make([]byte, 16, 32)
+	_, err := rand.Read(random)
+	if err != nil {
+		return nil, errors.Wrap(err, "obfs nonce")
+	}
+	random = append(random, o.mac(random)...)
+	_, err = conn.Write(o.clientHello(random))
+	if err != nil {
+		return nil, errors.Wrap(err, "write obfs client hello")
+	}
+	return &recordConn{xorConn: o.newXorConn(conn, random[:16], true)}, nil
+}
+
+func (o *tlsObfuscator) Server(conn net.Conn) (net.Conn, error) {
+	typ, hello, err := readRecord(conn, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "read obfs client hello")
+	}
+	// record type,handshake type,3 bytes length,version,32 bytes random and the session id length
+	if typ != recordHandshake || len(hello) < 39 || hello[0] != 0x01 {
+		return nil, errors.New("invalid obfs client hello")
+	}
+	random := hello[6:38]
+	if !hmac.Equal(random[16:], o.mac(random[:16])) {
+		return nil, errors.New("obfs client hello mac mismatch")
+	}
+	sidLen := int(hello[38])
+	if len(hello) < 39+sidLen {
+		return nil, errors.New("invalid obfs client hello")
+	}
+	_, err = conn.Write(o.serverHello(hello[39 : 39+sidLen]))
+	if err != nil {
+		return nil, errors.Wrap(err, "write obfs server hello")
+	}
+	return &recordConn{xorConn: o.newXorConn(conn, random[:16], false)}, nil
+}
+
+// recordConn carries the xored stream in tls application data records
+type recordConn struct {
+	*xorConn
+	rbuf   []byte
+	record []byte
+}
+
+func (c *recordConn) Read(p []byte) (int, error) {
+	for len(c.rbuf) == 0 {
+		typ, payload, err := readRecord(c.Conn, c.record)
+		if err != nil {
+			return 0, err
+		}
+		c.record = payload
+		switch typ {
+		case recordApplicationData:
+			c.dec.XORKeyStream(payload, payload)
+			c.rbuf = payload
+		case recordHandshake, recordChangeCipherSpec:
+			// the hello of server
+		default:
+			return 0, errors.Errorf("unexpected obfs record type %d", typ)
+		}
+	}
+	n := copy(p, c.rbuf)
+	c.rbuf = c.rbuf[n:]
+	return n, nil
+}
+
+func (c *recordConn) Write(p []byte) (int, error) {
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
+	written := 0
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > maxRecordPayload {
+			chunk = chunk[:maxRecordPayload]
+		}
+		_, err := c.Conn.Write(appendRecord(nil, recordApplicationData, 0x0303, c.seal(chunk)))
+		if err != nil {
+			return written, err
+		}
+		written += len(chunk)
+		p = p[len(chunk):]
+	}
+	return written, nil
+}
@@ -0,0 +1,125 @@
+// Copyright 2017 longXboy, longxboyhi@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transport
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func testObfsRoundTrip(t *testing.T, mode string) {
+	obfs, err := NewObfuscator(mode, "secret", "example.com")
+	if err != nil {
+		t.Fatalf("NewObfuscator error:%v", err)
+	}
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen error:%v", err)
+	}
+	lis = &obfsListener{Listener: lis, obfs: obfs}
+	defer lis.Close()
+	input := make([]byte, 100000)
+	rand.Read(input)
+	go func() {
+		conn, err := lis.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		buf := make([]byte, len(input))
+		_, err = io.ReadFull(conn, buf)
+		if err != nil {
+			return
+		}
+		conn.Write(buf)
+	}()
+	raw, err := net.Dial("tcp", lis.Addr().String())
+	if err != nil {
+		t.Fatalf("dial error:%v", err)
+	}
+	conn, err := obfs.Client(raw)
+	if err != nil {
+		t.Fatalf("obfs client error:%v", err)
+	}
+	defer conn.Close()
+	_, err = conn.Write(input)
+	if err != nil {
+		t.Fatalf("write error:%v", err)
+	}
+	output := make([]byte, len(input))
+	_, err = io.ReadFull(conn, output)
+	if err != nil {
+		t.Fatalf("read error:%v", err)
+	}
+	if !bytes.Equal(input, output) {
+		t.Errorf("%s obfs round trip:not compare", mode)
+	}
+}
+
+func Test_obfsXor(t *testing.T) {
+	testObfsRoundTrip(t, "xor")
+}
+
+func Test_obfsTls(t *testing.T) {
+	testObfsRoundTrip(t, "tls")
+}
+
+func Test_obfsWrongKey(t *testing.T) {
+	server, _ := NewObfuscator("tls", "secret", "")
+	client, _ := NewObfuscator("tls", "other", "")
+	c1, c2 := net.Pipe()
+	go client.Client(c1)
+	_, err := server.Server(c2)
+	if err == nil {
+		t.Errorf("client with wrong key accepted")
+	}
+}
+
+func Test_obfsHandshakeDeadline(t *testing.T) {
+	obfs, err := NewObfuscator("xor", "secret", "")
+	if err != nil {
+		t.Fatalf("NewObfuscator error:%v", err)
+	}
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen error:%v", err)
+	}
+	lis = &obfsListener{Listener: lis, obfs: obfs}
+	defer lis.Close()
+	raw, err := net.Dial("tcp", lis.Addr().String())
+	if err != nil {
+		t.Fatalf("dial error:%v", err)
+	}
+	defer raw.Close()
+	// a valid header without the padding after it
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	raw.Write(append(nonce, obfs.(*xorObfuscator).mac(nonce)...))
+	conn, err := lis.Accept()
+	if err != nil {
+		t.Fatalf("accept error:%v", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(time.Millisecond * 200))
+	start := time.Now()
+	_, err = conn.Read(make([]byte, 1))
+	if err == nil || time.Since(start) > time.Second*2 {
+		t.Fatalf("read of a silent peer returned %v after %v", err, time.Since(start))
+	}
+}
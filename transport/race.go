@@ -0,0 +1,130 @@
+// Copyright 2017 longXboy, longxboyhi@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transport
+
+import (
+	"net"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// attemptDelay is the delay before racing the next address while the last attempt
+// is still pending,as recommended by RFC 8305
+const attemptDelay = 250 * time.Millisecond
+
+// interleaveFamilies reorders ips alternating between ipv6 and ipv4,
+// the family of the first ip stays first
+func interleaveFamilies(ips []net.IP) []net.IP {
+	if len(ips) < 2 {
+		return ips
+	}
+	var first, second []net.IP
+	firstV4 := ips[0].To4() != nil
+	for _, ip := range ips {
+		if (ip.To4() != nil) == firstV4 {
+			first = append(first, ip)
+		} else {
+			second = append(second, ip)
+		}
+	}
+	sorted := make([]net.IP, 0, len(ips))
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			sorted = append(sorted, first[i])
+		}
+		if i < len(second) {
+			sorted = append(sorted, second[i])
+		}
+	}
+	return sorted
+}
+
+type raceResult struct {
+	conn net.Conn
+	err  error
+}
+
+// dialRace dials tcp to every address addr(host:port) resolves to,the next attempt starts
+// once the last one failed or attemptDelay passed.the first established conn wins and the
+// others are closed,so an unreachable address(often ipv6) doesn't stall the connect
+func dialRace(addr string, opts Options) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, errors.Wrap(err, "split host port")
+	}
+	ips, err := opts.Resolver.LookupIP(host)
+	if err != nil {
+		return nil, errors.Wrap(err, "tcp resolve")
+	}
+	ips = interleaveFamilies(ips)
+	d := opts.dialer("tcp")
+	if d.Timeout > 0 {
+		// the attempts share the dial timeout
+		d.Deadline = time.Now().Add(d.Timeout)
+		d.Timeout = 0
+	}
+	if len(ips) == 1 {
+		return d.Dial("tcp", net.JoinHostPort(ips[0].String(), port))
+	}
+
+	results := make(chan raceResult, len(ips))
+	next, pending := 0, 0
+	start := func() {
+		target := net.JoinHostPort(ips[next].String(), port)
+		next++
+		pending++
+		go func() {
+			conn, err := d.Dial("tcp", target)
+			results <- raceResult{conn: conn, err: err}
+		}()
+	}
+	start()
+	timer := time.NewTimer(attemptDelay)
+	defer timer.Stop()
+	for pending > 0 {
+		select {
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				go func(n int) {
+					for i := 0; i < n; i++ {
+						if lost := <-results; lost.conn != nil {
+							lost.conn.Close()
+						}
+					}
+				}(pending)
+				return r.conn, nil
+			}
+			err = r.err
+			if next < len(ips) {
+				start()
+				if !timer.Stop() {
+					select {
+					case <-timer.C:
+					default:
+					}
+				}
+				timer.Reset(attemptDelay)
+			}
+		case <-timer.C:
+			if next < len(ips) {
+				start()
+				timer.Reset(attemptDelay)
+			}
+		}
+	}
+	return nil, err
+}
@@ -0,0 +1,75 @@
+// Copyright 2017 longXboy, longxboyhi@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transport
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/longXboy/lunnel/util"
+)
+
+func TestInterleaveFamilies(t *testing.T) {
+	var ips []net.IP
+	for _, s := range []string{"::1", "::2", "::3", "10.0.0.1", "10.0.0.2"} {
+		ips = append(ips, net.ParseIP(s))
+	}
+	want := []string{"::1", "10.0.0.1", "::2", "10.0.0.2", "::3"}
+	got := interleaveFamilies(ips)
+	if len(got) != len(want) {
+		t.Fatalf("interleaved %d ips,want %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i].String() != want[i] {
+			t.Fatalf("ip %d is %s,want %s", i, got[i], want[i])
+		}
+	}
+}
+
+func TestDialRaceSkipsUnreachable(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen error:%v", err)
+	}
+	defer lis.Close()
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(lis.Addr().String())
+	// 192.0.2.1 is reserved for documentation and never answers
+	resolver, err := util.NewResolver(nil, 0, map[string][]string{"race.test": {"192.0.2.1", "127.0.0.1"}})
+	if err != nil {
+		t.Fatalf("NewResolver error:%v", err)
+	}
+	begin := time.Now()
+	conn, err := dialRace(net.JoinHostPort("race.test", port), Options{Resolver: resolver, DialTimeout: time.Second * 5})
+	if err != nil {
+		t.Fatalf("dialRace error:%v", err)
+	}
+	conn.Close()
+	if conn.RemoteAddr().String() != lis.Addr().String() {
+		t.Fatalf("connected to %s,want %s", conn.RemoteAddr(), lis.Addr())
+	}
+	if elapsed := time.Since(begin); elapsed > time.Second*2 {
+		t.Fatalf("dialRace took %v", elapsed)
+	}
+}
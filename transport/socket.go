@@ -0,0 +1,83 @@
+// Copyright 2017 longXboy, longxboyhi@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transport
+
+import (
+	"context"
+	"net"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// SocketOptions tune the tcp sockets of the transports for long-haul links,they are linux only
+type SocketOptions struct {
+	//TCP Fast Open,the first bytes of a connection ride on its SYN once the peer has issued a cookie
+	FastOpen bool `yaml:"fast_open,omitempty"`
+	//SO_SNDBUF and SO_RCVBUF in bytes,0 keeps the autotuning of the kernel
+	SendBuffer int `yaml:"send_buffer,omitempty"`
+	RecvBuffer int `yaml:"recv_buffer,omitempty"`
+	//congestion control algorithm like bbr or cubic,which must be available in the kernel,empty for the default
+	Congestion string `yaml:"congestion,omitempty"`
+}
+
+func (s SocketOptions) empty() bool {
+	return !s.FastOpen && s.SendBuffer == 0 && s.RecvBuffer == 0 && s.Congestion == ""
+}
+
+// Validate checks the options can be applied on this platform
+func (s SocketOptions) Validate() error {
+	if s.empty() {
+		return nil
+	}
+	if s.SendBuffer < 0 || s.RecvBuffer < 0 {
+		return errors.New("send_buffer and recv_buffer can not be negative")
+	}
+	if strings.ContainsAny(s.Congestion, " \t\r\n") {
+		return errors.Errorf("invalid congestion %s", s.Congestion)
+	}
+	return socketSupported()
+}
+
+// chainControls runs the socket controls in order,nil if there is none
+func chainControls(controls ...func(network, address string, c syscall.RawConn) error) func(network, address string, c syscall.RawConn) error {
+	var chained []func(network, address string, c syscall.RawConn) error
+	for _, control := range controls {
+		if control != nil {
+			chained = append(chained, control)
+		}
+	}
+	if len(chained) == 0 {
+		return nil
+	}
+	return func(network, address string, c syscall.RawConn) error {
+		for _, control := range chained {
+			if err := control(network, address, c); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// listenTcp listens on addr with the socket options,which the accepted connections inherit
+func listenTcp(addr string, opts Options) (net.Listener, error) {
+	var lc net.ListenConfig
+	if !opts.Socket.empty() {
+		lc.Control = socketControl(opts.Socket, true)
+	}
+	return lc.Listen(context.Background(), "tcp", addr)
+}
@@ -0,0 +1,74 @@
+// Copyright 2017 longXboy, longxboyhi@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transport
+
+import (
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// not exported by syscall
+const (
+	tcpFastOpen        = 0x17
+	tcpFastOpenConnect = 0x1e
+	// pending fast open requests a listener keeps
+	fastOpenQueue = 256
+)
+
+func socketSupported() error {
+	return nil
+}
+
+func socketControl(s SocketOptions, listen bool) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		var opErr error
+		err := c.Control(func(fd uintptr) {
+			if s.FastOpen {
+				var err error
+				if listen {
+					err = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, tcpFastOpen, fastOpenQueue)
+				} else {
+					err = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, tcpFastOpenConnect, 1)
+				}
+				if err != nil {
+					opErr = errors.Wrap(err, "enable tcp fast open")
+					return
+				}
+			}
+			if s.SendBuffer > 0 {
+				if err := syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_SNDBUF, s.SendBuffer); err != nil {
+					opErr = errors.Wrap(err, "set send buffer")
+					return
+				}
+			}
+			if s.RecvBuffer > 0 {
+				if err := syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_RCVBUF, s.RecvBuffer); err != nil {
+					opErr = errors.Wrap(err, "set recv buffer")
+					return
+				}
+			}
+			if s.Congestion != "" {
+				if err := syscall.SetsockoptString(int(fd), syscall.IPPROTO_TCP, syscall.TCP_CONGESTION, s.Congestion); err != nil {
+					opErr = errors.Wrapf(err, "set congestion %s", s.Congestion)
+				}
+			}
+		})
+		if err != nil {
+			return err
+		}
+		return opErr
+	}
+}
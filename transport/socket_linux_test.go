@@ -0,0 +1,73 @@
+// Copyright 2017 longXboy, longxboyhi@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transport
+
+import (
+	"net"
+	"syscall"
+	"testing"
+)
+
+func TestSocketOptions(t *testing.T) {
+	opts := Options{Socket: SocketOptions{FastOpen: true, RecvBuffer: 1 << 20, Congestion: "reno"}}
+	if err := opts.Socket.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	lis, err := listenTcp("127.0.0.1:0", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	go func() {
+		conn, err := lis.Accept()
+		if err == nil {
+			conn.Write([]byte("ok"))
+			conn.Close()
+		}
+	}()
+	conn, err := opts.dialer("tcp").Dial("tcp", lis.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	raw, err := conn.(*net.TCPConn).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var size int
+	raw.Control(func(fd uintptr) {
+		size, err = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_RCVBUF)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the kernel doubles the size asked for,and caps it by rmem_max
+	if size < 1<<16 {
+		t.Fatalf("recv buffer %d not applied", size)
+	}
+	buf := make([]byte, 2)
+	if _, err = conn.Read(buf); err != nil || string(buf) != "ok" {
+		t.Fatalf("read %q: %v", buf, err)
+	}
+}
+
+func TestSocketOptionsValidate(t *testing.T) {
+	if err := (SocketOptions{SendBuffer: -1}).Validate(); err == nil {
+		t.Fatal("negative send buffer should be refused")
+	}
+	if err := (SocketOptions{Congestion: "b br"}).Validate(); err == nil {
+		t.Fatal("congestion with spaces should be refused")
+	}
+}
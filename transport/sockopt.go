@@ -0,0 +1,85 @@
+// Copyright 2017 longXboy, longxboyhi@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transport
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/longXboy/lunnel/log"
+	"github.com/longXboy/lunnel/msg"
+	"github.com/pkg/errors"
+)
+
+// wrappedConn is a conn wrapping another one,like *tls.Conn
+type wrappedConn interface {
+	NetConn() net.Conn
+}
+
+// unwrapTcp returns the *net.TCPConn under the wrappers of conn
+func unwrapTcp(conn net.Conn) (*net.TCPConn, bool) {
+	for {
+		switch c := conn.(type) {
+		case *net.TCPConn:
+			return c, true
+		case wrappedConn:
+			conn = c.NetConn()
+		default:
+			return nil, false
+		}
+	}
+}
+
+// ApplyTcpOptions sets the socket options of the *net.TCPConn under conn,
+// conns not carried by tcp like streams are left untouched
+func ApplyTcpOptions(conn net.Conn, opts *msg.TcpOptions) error {
+	if opts == nil {
+		return nil
+	}
+	tcpConn, isok := unwrapTcp(conn)
+	if !isok {
+		transportLog.WithFields(log.Fields{"conn": fmt.Sprintf("%T", conn)}).Debugln("tcp options not applied to a conn not carried by tcp")
+		return nil
+	}
+	if opts.NoDelay != nil {
+		err := tcpConn.SetNoDelay(*opts.NoDelay)
+		if err != nil {
+			return errors.Wrap(err, "set nodelay")
+		}
+	}
+	if opts.KeepAlive < 0 {
+		err := tcpConn.SetKeepAlive(false)
+		if err != nil {
+			return errors.Wrap(err, "disable keepalive")
+		}
+	} else if opts.KeepAlive > 0 {
+		err := tcpConn.SetKeepAlive(true)
+		if err != nil {
+			return errors.Wrap(err, "enable keepalive")
+		}
+		err = tcpConn.SetKeepAlivePeriod(time.Duration(opts.KeepAlive) * time.Second)
+		if err != nil {
+			return errors.Wrap(err, "set keepalive period")
+		}
+	}
+	if opts.Linger != nil {
+		err := tcpConn.SetLinger(*opts.Linger)
+		if err != nil {
+			return errors.Wrap(err, "set linger")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+// Copyright 2017 longXboy, longxboyhi@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transport
+
+import (
+	"crypto/tls"
+	"net"
+	"testing"
+
+	"github.com/longXboy/lunnel/msg"
+)
+
+type nestedConn struct {
+	net.Conn
+}
+
+func (nc *nestedConn) NetConn() net.Conn {
+	return nc.Conn
+}
+
+func TestApplyTcpOptionsUnwrap(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err == nil {
+			conn.Close()
+		}
+	}()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	wrapped := &nestedConn{tls.Client(conn, &tls.Config{InsecureSkipVerify: true})}
+	tcpConn, isok := unwrapTcp(wrapped)
+	if !isok || tcpConn != conn {
+		t.Fatalf("the tcp conn under tls and a wrapper should be found,got %v", tcpConn)
+	}
+	noDelay := false
+	err = ApplyTcpOptions(wrapped, &msg.TcpOptions{NoDelay: &noDelay, KeepAlive: 30})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	if _, isok := unwrapTcp(&nestedConn{c1}); isok {
+		t.Fatal("a pipe should not be taken as tcp")
+	}
+}
@@ -16,85 +16,304 @@ package transport
 
 import (
 	"bufio"
+	"crypto/tls"
 	"encoding/base64"
 	"fmt"
 	"io/ioutil"
 	"net"
 	"net/http"
 	"net/url"
+	"sort"
+	"sync"
+	"time"
 
 	"github.com/longXboy/lunnel/log"
 	"github.com/longXboy/lunnel/transport/kcp"
+	"github.com/longXboy/lunnel/util"
 	"github.com/pkg/errors"
 )
 
-func Listen(addr string, transportMode string) (net.Listener, error) {
-	var lis net.Listener
-	var err error
-	if transportMode == "kcp" {
-		lis, err = kcp.Listen(addr)
+var transportLog = log.Module("transport")
+
+// Transport carries the control and pipe connections between client and server,
+// a custom transport is compiled in by calling Register from the init of its package
+type Transport interface {
+	Listen(addr string, opts Options) (net.Listener, error)
+	Dial(addr string, opts Options) (net.Conn, error)
+}
+
+// Options are the settings of client and server a transport may use
+type Options struct {
+	//http proxy to dial through,only the tcp transport supports it
+	HttpProxy string
+	//key to encrypt the packets of packet based transports with,empty for none
+	PacketKey []byte
+	//how long a stream based transport may take to connect(and CONNECT through HttpProxy),0 is unlimited
+	DialTimeout time.Duration
+	//tls config the https and wss transports verify server with,nil for the system roots
+	TlsConfig *tls.Config
+	//url path,Host header and extra headers of the websocket handshake of the ws transport,
+	//WsTls dials wss with TlsConfig
+	WsPath    string
+	WsHost    string
+	WsHeaders map[string]string
+	WsTls     bool
+	//interval of the pings keeping the intermediaries from idling the ws transport out,0 disables them
+	Heartbeat time.Duration
+	//source ip,interface(SO_BINDTODEVICE) and routing mark(SO_MARK) of the dials,the last two are linux only
+	BindIP        string
+	BindInterface string
+	RoutingMark   int
+	//DSCP(0-63) the packets of the dials are marked with by IP_TOS or IPV6_TCLASS,0 keeps the default,linux only
+	Dscp int
+	//resolves the addresses dialed(and of HttpProxy),nil leaves them to the system resolver
+	Resolver *util.Resolver
+	//socket options of the tcp connections dialed and listened
+	Socket SocketOptions
+	//injects faults into the connections dialed and accepted,nil for none
+	Faults *FaultInjector
+	//mtu of the packets of the kcp transport,0 probes the mtu of the path
+	KcpMtu int
+	//send and receive windows of the kcp transport in packets,0 keeps the defaults
+	KcpSndWnd int
+	KcpRcvWnd int
+	//zone delegated to server the dns transport queries names of,
+	//and the record type carrying the answers,TXT if 0
+	DnsZone   string
+	DnsRecord uint16
+}
+
+func (opts Options) kcpOptions() kcp.Options {
+	return kcp.Options{Mtu: opts.KcpMtu, SndWnd: opts.KcpSndWnd, RcvWnd: opts.KcpRcvWnd}
+}
+
+// ALPN is the protocol the https transport negotiates,so that the https port of server
+// tells the control and pipe connections from the visitors of https tunnels
+const ALPN = "lunnel"
+
+var transportsLock sync.RWMutex
+var transports = map[string]Transport{
+	"tcp":   tcpTransport{},
+	"kcp":   kcpTransport{},
+	"https": httpsTransport{},
+	"ws":    wsTransport{},
+	"dns":   dnsTransport{},
+}
+
+// Register makes t available as name,it replaces the transport registered for name before
+func Register(name string, t Transport) {
+	transportsLock.Lock()
+	transports[name] = t
+	transportsLock.Unlock()
+}
+
+func Lookup(name string) (Transport, error) {
+	transportsLock.RLock()
+	t, isok := transports[name]
+	transportsLock.RUnlock()
+	if !isok {
+		return nil, errors.Errorf("transport %s not registered", name)
+	}
+	return t, nil
+}
+
+// Names returns the names of the registered transports in order
+func Names() []string {
+	transportsLock.RLock()
+	names := make([]string, 0, len(transports))
+	for name := range transports {
+		names = append(names, name)
+	}
+	transportsLock.RUnlock()
+	sort.Strings(names)
+	return names
+}
+
+// Listen listens on addr in transportMode with opts,
+// the accepted connections are obfuscated by obfs if it is not nil
+func Listen(addr string, transportMode string, opts Options, obfs Obfuscator) (net.Listener, error) {
+	t, err := Lookup(transportMode)
+	if err != nil {
+		return nil, err
+	}
+	if obfs != nil {
+		opts.PacketKey = obfs.PacketKey()
+	}
+	lis, err := t.Listen(addr, opts)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Faults != nil {
+		lis = &faultListener{Listener: lis, fi: opts.Faults}
+	}
+	if obfs != nil {
+		lis = &obfsListener{Listener: lis, obfs: obfs}
+	}
+	return lis, nil
+}
+
+// CreateConn dials addr in transportMode with opts,
+// and obfuscates the connection by obfs if it is not nil
+func CreateConn(addr string, transportMode string, opts Options, obfs Obfuscator) (net.Conn, error) {
+	t, err := Lookup(transportMode)
+	if err != nil {
+		return nil, err
+	}
+	if obfs != nil {
+		opts.PacketKey = obfs.PacketKey()
+	}
+	conn, err := t.Dial(addr, opts)
+	if err == nil && opts.Faults != nil {
+		conn, err = opts.Faults.wrap(conn)
+	}
+	if err != nil || obfs == nil {
+		return conn, err
+	}
+	oconn, err := obfs.Client(conn)
+	if err != nil {
+		conn.Close()
+		return nil, errors.Wrap(err, "obfs client")
+	}
+	return oconn, nil
+}
+
+type kcpTransport struct{}
+
+// ValidateKcpMtu checks the mtu of the kcp packets configured,0 probes the path
+func ValidateKcpMtu(mtu int) error {
+	if mtu != 0 && (mtu < kcp.MinMtu || mtu > kcp.MaxMtu) {
+		return errors.Errorf("kcp mtu %d out of range,must be 0 or between %d and %d", mtu, kcp.MinMtu, kcp.MaxMtu)
+	}
+	return nil
+}
+
+func (kcpTransport) Listen(addr string, opts Options) (net.Listener, error) {
+	lis, err := kcp.ListenWithKey(addr, opts.PacketKey, opts.kcpOptions())
+	if err != nil {
+		return nil, errors.Wrap(err, "listen kcp")
+	}
+	return lis, nil
+}
+
+func (kcpTransport) Dial(addr string, opts Options) (net.Conn, error) {
+	addr, err := opts.Resolver.ResolveAddr(addr)
+	if err != nil {
+		return nil, errors.Wrap(err, "kcp resolve")
+	}
+	if opts.bound() {
+		conn, err := opts.dialer("udp").Dial("udp", addr)
 		if err != nil {
-			return nil, errors.Wrap(err, "listen kcp")
+			return nil, errors.Wrap(err, "kcp dial")
 		}
-	} else {
-		lis, err = net.Listen("tcp", addr)
+		kcpConn, err := kcp.DialWithConn(addr, opts.PacketKey, opts.kcpOptions(), conn.(*net.UDPConn))
 		if err != nil {
-			log.WithFields(log.Fields{"address": addr, "protocol": "tcp", "err": err}).Fatalln("server's control listen failed!")
-			return nil, errors.Wrap(err, "listen tcp")
+			conn.Close()
+			return nil, errors.Wrap(err, "kcp dial")
 		}
+		return kcpConn, nil
+	}
+	kcpConn, err := kcp.DialWithKey(addr, opts.PacketKey, opts.kcpOptions())
+	if err != nil {
+		return nil, errors.Wrap(err, "kcp dial")
+	}
+	return kcpConn, nil
+}
+
+type tcpTransport struct{}
+
+func (tcpTransport) Listen(addr string, opts Options) (net.Listener, error) {
+	lis, err := listenTcp(addr, opts)
+	if err != nil {
+		transportLog.WithFields(log.Fields{"address": addr, "protocol": "tcp", "err": err}).Fatalln("server's control listen failed!")
+		return nil, errors.Wrap(err, "listen tcp")
 	}
 	return lis, nil
 }
 
-func CreateConn(addr string, transportMode string, httpProxy string) (net.Conn, error) {
+func (tcpTransport) Dial(addr string, opts Options) (net.Conn, error) {
 	var err error
-	if transportMode == "kcp" {
-		kcpConn, err := kcp.Dial(addr)
+	httpProxy := opts.HttpProxy
+	if httpProxy == "" {
+		tcpConn, err := dialRace(addr, opts)
 		if err != nil {
-			return nil, errors.Wrap(err, "kcp dial")
+			return nil, errors.Wrap(err, "tcp dial")
 		}
-		return kcpConn, nil
+		return tcpConn, nil
 	} else {
-		if httpProxy == "" {
-			tcpConn, err := net.Dial("tcp", addr)
-			if err != nil {
-				return nil, errors.Wrap(err, "tcp dial")
-			}
-			return tcpConn, nil
-		} else {
-			var parsedUrl *url.URL
-			parsedUrl, err = url.Parse(httpProxy)
-			if err != nil {
-				return nil, errors.Wrap(err, "url parse")
-			}
-			proxyConn, err := net.Dial("tcp", parsedUrl.Host)
-			if err != nil {
-				return nil, errors.Wrap(err, "http_proxy dial")
-			}
-			req, err := http.NewRequest("CONNECT", "http://"+addr, nil)
-			if err != nil {
-				return nil, errors.Wrap(err, "http_proxy dial,generate new req")
-			}
-			if parsedUrl.User != nil {
-				proxyAuth := "Basic " + base64.StdEncoding.EncodeToString([]byte(parsedUrl.User.String()))
-				req.Header.Set("Proxy-Authorization", proxyAuth)
-			}
-			req.Header.Set("User-Agent", "Mozilla/5.0 (compatible; lunnel)")
-			req.Write(proxyConn)
-			resp, err := http.ReadResponse(bufio.NewReader(proxyConn), req)
-			if err != nil {
-				return nil, errors.Wrap(err, "http_proxy dial,read response")
-			}
-			content, err := ioutil.ReadAll(resp.Body)
-			if err != nil {
-				return nil, errors.Wrap(err, "http_proxy dial,ioutil read response")
-			}
-			resp.Body.Close()
-			if resp.StatusCode != 200 {
-				return nil, errors.New(fmt.Sprintf("http_proxy dial,response code not 200,body:%s", string(content)))
-			}
-			log.WithFields(log.Fields{"content": string(content), "http_proxy": parsedUrl.Host}).Infoln("connect http_proxy success!")
-			return proxyConn, nil
+		var parsedUrl *url.URL
+		parsedUrl, err = url.Parse(httpProxy)
+		if err != nil {
+			return nil, errors.Wrap(err, "url parse")
+		}
+		proxyConn, err := dialRace(parsedUrl.Host, opts)
+		if err != nil {
+			return nil, errors.Wrap(err, "http_proxy dial")
+		}
+		if opts.DialTimeout > 0 {
+			proxyConn.SetDeadline(time.Now().Add(opts.DialTimeout))
+			defer proxyConn.SetDeadline(time.Time{})
 		}
+		req, err := http.NewRequest("CONNECT", "http://"+addr, nil)
+		if err != nil {
+			return nil, errors.Wrap(err, "http_proxy dial,generate new req")
+		}
+		if parsedUrl.User != nil {
+			proxyAuth := "Basic " + base64.StdEncoding.EncodeToString([]byte(parsedUrl.User.String()))
+			req.Header.Set("Proxy-Authorization", proxyAuth)
+		}
+		req.Header.Set("User-Agent", "Mozilla/5.0 (compatible; lunnel)")
+		req.Write(proxyConn)
+		resp, err := http.ReadResponse(bufio.NewReader(proxyConn), req)
+		if err != nil {
+			return nil, errors.Wrap(err, "http_proxy dial,read response")
+		}
+		content, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return nil, errors.Wrap(err, "http_proxy dial,ioutil read response")
+		}
+		resp.Body.Close()
+		if resp.StatusCode != 200 {
+			return nil, errors.New(fmt.Sprintf("http_proxy dial,response code not 200,body:%s", string(content)))
+		}
+		transportLog.WithFields(log.Fields{"content": string(content), "http_proxy": parsedUrl.Host}).Infoln("connect http_proxy success!")
+		return proxyConn, nil
+	}
+}
+
+// httpsTransport dials tls over tcp with ALPN,it is served on the https port by server
+// rather than listened on its own
+type httpsTransport struct{}
+
+func (httpsTransport) Listen(addr string, opts Options) (net.Listener, error) {
+	return nil, errors.New("https transport is served on the https port")
+}
+
+func (httpsTransport) Dial(addr string, opts Options) (net.Conn, error) {
+	conn, err := tcpTransport{}.Dial(addr, opts)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{}
+	if opts.TlsConfig != nil {
+		config = opts.TlsConfig.Clone()
+	}
+	config.NextProtos = []string{ALPN}
+	if config.ServerName == "" {
+		config.ServerName, _, _ = net.SplitHostPort(addr)
+	}
+	tlsConn := tls.Client(conn, config)
+	if opts.DialTimeout > 0 {
+		tlsConn.SetDeadline(time.Now().Add(opts.DialTimeout))
+	}
+	err = tlsConn.Handshake()
+	if err != nil {
+		conn.Close()
+		return nil, errors.Wrap(err, "https transport tls handshake")
+	}
+	tlsConn.SetDeadline(time.Time{})
+	if tlsConn.ConnectionState().NegotiatedProtocol != ALPN {
+		tlsConn.Close()
+		return nil, errors.New("https transport not enabled by server")
 	}
+	return tlsConn, nil
 }
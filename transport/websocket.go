@@ -0,0 +1,194 @@
+// Copyright 2017 longXboy, longxboyhi@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transport
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/websocket"
+)
+
+// DefaultWsPath is the url path of the ws transport if not configured
+const DefaultWsPath = "/lunnel"
+
+// wsTransport carries the connections in binary websocket frames,so that they pass
+// through the CDNs and load balancers which only forward http.the tls of wss is
+// usually terminated by them,server listens in plain websocket
+type wsTransport struct{}
+
+// wsConn pings the other side every heartbeat to keep the intermediaries from idling it out
+type wsConn struct {
+	*websocket.Conn
+	// lock guards PayloadType,which is switched to send the pings
+	lock    sync.Mutex
+	remote  net.Addr
+	die     chan struct{}
+	dieOnce sync.Once
+}
+
+func newWsConn(ws *websocket.Conn, remote net.Addr, heartbeat time.Duration) *wsConn {
+	ws.PayloadType = websocket.BinaryFrame
+	c := &wsConn{Conn: ws, remote: remote, die: make(chan struct{})}
+	if heartbeat > 0 {
+		go c.heartbeat(heartbeat)
+	}
+	return c
+}
+
+func (c *wsConn) Write(p []byte) (int, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.Conn.Write(p)
+}
+
+func (c *wsConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *wsConn) Close() error {
+	c.dieOnce.Do(func() {
+		close(c.die)
+	})
+	return c.Conn.Close()
+}
+
+func (c *wsConn) heartbeat(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.lock.Lock()
+			c.PayloadType = websocket.PingFrame
+			_, err := c.Conn.Write(nil)
+			c.PayloadType = websocket.BinaryFrame
+			c.lock.Unlock()
+			if err != nil {
+				return
+			}
+		case <-c.die:
+			return
+		}
+	}
+}
+
+type wsListener struct {
+	net.Listener
+	conns     chan net.Conn
+	die       chan struct{}
+	closeOnce sync.Once
+}
+
+func (l *wsListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.die:
+		return nil, errors.New("ws listener closed")
+	}
+}
+
+func (l *wsListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.die)
+	})
+	return l.Listener.Close()
+}
+
+func (wsTransport) Listen(addr string, opts Options) (net.Listener, error) {
+	lis, err := listenTcp(addr, opts)
+	if err != nil {
+		return nil, errors.Wrap(err, "listen ws")
+	}
+	l := &wsListener{Listener: lis, conns: make(chan net.Conn), die: make(chan struct{})}
+	path := opts.WsPath
+	if path == "" {
+		path = DefaultWsPath
+	}
+	m := http.NewServeMux()
+	m.Handle(path, websocket.Server{
+		// the origin is whatever the CDN in front sends,it isn't checked
+		Handshake: func(*websocket.Config, *http.Request) error {
+			return nil
+		},
+		Handler: func(ws *websocket.Conn) {
+			remote, _ := net.ResolveTCPAddr("tcp", ws.Request().RemoteAddr)
+			c := newWsConn(ws, remote, opts.Heartbeat)
+			select {
+			case l.conns <- c:
+			case <-l.die:
+				return
+			}
+			// the websocket is closed once the handler returns
+			<-c.die
+		},
+	})
+	go http.Serve(lis, m)
+	return l, nil
+}
+
+func (wsTransport) Dial(addr string, opts Options) (net.Conn, error) {
+	conn, err := tcpTransport{}.Dial(addr, opts)
+	if err != nil {
+		return nil, err
+	}
+	if opts.DialTimeout > 0 {
+		conn.SetDeadline(time.Now().Add(opts.DialTimeout))
+	}
+	host := opts.WsHost
+	if host == "" {
+		host = addr
+	}
+	scheme := "ws"
+	if opts.WsTls {
+		config := &tls.Config{}
+		if opts.TlsConfig != nil {
+			config = opts.TlsConfig.Clone()
+		}
+		if config.ServerName == "" {
+			config.ServerName = host
+			if h, _, err := net.SplitHostPort(host); err == nil {
+				config.ServerName = h
+			}
+		}
+		conn = tls.Client(conn, config)
+		scheme = "wss"
+	}
+	path := opts.WsPath
+	if path == "" {
+		path = DefaultWsPath
+	}
+	config, err := websocket.NewConfig(fmt.Sprintf("%s://%s%s", scheme, host, path), fmt.Sprintf("https://%s", host))
+	if err != nil {
+		conn.Close()
+		return nil, errors.Wrap(err, "ws config")
+	}
+	for k, v := range opts.WsHeaders {
+		config.Header.Set(k, v)
+	}
+	ws, err := websocket.NewClient(config, conn)
+	if err != nil {
+		conn.Close()
+		return nil, errors.Wrap(err, "ws handshake")
+	}
+	conn.SetDeadline(time.Time{})
+	return newWsConn(ws, conn.RemoteAddr(), opts.Heartbeat), nil
+}
@@ -0,0 +1,54 @@
+// Copyright 2017 longXboy, longxboyhi@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"encoding/binary"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// MaxDatagramSize is the largest udp payload
+const MaxDatagramSize = 65507
+
+// WriteDatagram writes p to the stream prefixed by its 2 bytes length,
+// so that the datagram boundary is kept over stream transports
+func WriteDatagram(w io.Writer, p []byte) error {
+	if len(p) > MaxDatagramSize {
+		return errors.Errorf("datagram length(%d) out of limit(%d)", len(p), MaxDatagramSize)
+	}
+	frame := GetBuf(len(p) + 2)
+	defer PutBuf(frame)
+	binary.BigEndian.PutUint16(frame, uint16(len(p)))
+	copy(frame[2:], p)
+	_, err := w.Write(frame[:len(p)+2])
+	return err
+}
+
+// ReadDatagram reads a datagram written by WriteDatagram into buf,
+// buf must be at least MaxDatagramSize long
+func ReadDatagram(r io.Reader, buf []byte) (int, error) {
+	var header [2]byte
+	_, err := io.ReadFull(r, header[:])
+	if err != nil {
+		return 0, err
+	}
+	length := int(binary.BigEndian.Uint16(header[:]))
+	if length > len(buf) {
+		return 0, errors.Errorf("datagram length(%d) greater than buffer(%d)", length, len(buf))
+	}
+	return io.ReadFull(r, buf[:length])
+}
@@ -0,0 +1,45 @@
+// Copyright 2017 longXboy, longxboyhi@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"bytes"
+	"testing"
+)
+
+func Test_Datagram(t *testing.T) {
+	var stream bytes.Buffer
+	datagrams := [][]byte{[]byte("hello"), {}, bytes.Repeat([]byte{'x'}, 3000)}
+	for _, d := range datagrams {
+		err := WriteDatagram(&stream, d)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	buf := make([]byte, MaxDatagramSize)
+	for i, d := range datagrams {
+		n, err := ReadDatagram(&stream, buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf[:n], d) {
+			t.Errorf("datagram %d mismatch,got %d bytes,expect %d bytes", i, n, len(d))
+		}
+	}
+	err := WriteDatagram(&stream, make([]byte, MaxDatagramSize+1))
+	if err == nil {
+		t.Errorf("oversized datagram written")
+	}
+}
@@ -0,0 +1,72 @@
+// Copyright 2017 longXboy, longxboyhi@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"os"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// OpenFiles returns the file descriptors open by the process and its soft RLIMIT_NOFILE
+func OpenFiles() (int, int, error) {
+	var limit syscall.Rlimit
+	err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &limit)
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "getrlimit")
+	}
+	dir, err := os.Open("/proc/self/fd")
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "open /proc/self/fd")
+	}
+	names, err := dir.Readdirnames(-1)
+	dir.Close()
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "read /proc/self/fd")
+	}
+	// don't count the fd of the dir itself
+	return len(names) - 1, int(limit.Cur), nil
+}
+
+// RaiseOpenFiles raises the soft RLIMIT_NOFILE to target,and the hard one with it if it is lower,which takes privilege.
+// it returns the soft limit in effect,short of target with the error if it couldn't be raised that far
+func RaiseOpenFiles(target int) (int, error) {
+	var limit syscall.Rlimit
+	err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &limit)
+	if err != nil {
+		return 0, errors.Wrap(err, "getrlimit")
+	}
+	if limit.Cur >= uint64(target) {
+		return int(limit.Cur), nil
+	}
+	want := limit
+	want.Cur = uint64(target)
+	if want.Max < want.Cur {
+		want.Max = want.Cur
+	}
+	err = syscall.Setrlimit(syscall.RLIMIT_NOFILE, &want)
+	if err == nil {
+		return target, nil
+	}
+	err = errors.Wrapf(err, "setrlimit to %d", target)
+	// go as far as the hard limit allows
+	if limit.Cur < limit.Max {
+		limit.Cur = limit.Max
+		syscall.Setrlimit(syscall.RLIMIT_NOFILE, &limit)
+	}
+	syscall.Getrlimit(syscall.RLIMIT_NOFILE, &limit)
+	return int(limit.Cur), err
+}
@@ -0,0 +1,57 @@
+// Copyright 2017 longXboy, longxboyhi@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"os"
+	"testing"
+)
+
+func TestOpenFiles(t *testing.T) {
+	before, limit, err := OpenFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if limit <= before {
+		t.Fatalf("%d files open over the limit %d", before, limit)
+	}
+	f, err := os.Open(os.DevNull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	after, _, err := OpenFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after != before+1 {
+		t.Fatalf("%d files open after opening one more than %d", after, before)
+	}
+}
+
+func TestRaiseOpenFiles(t *testing.T) {
+	_, limit, err := OpenFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a target under the limit in effect leaves it
+	got, err := RaiseOpenFiles(limit / 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != limit {
+		t.Fatalf("limit %d changed to %d", limit, got)
+	}
+}
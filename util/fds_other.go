@@ -0,0 +1,31 @@
+// Copyright 2017 longXboy, longxboyhi@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !linux
+// +build !linux
+
+package util
+
+import "github.com/pkg/errors"
+
+// OpenFiles returns the file descriptors open by the process and its soft RLIMIT_NOFILE
+func OpenFiles() (int, int, error) {
+	return 0, 0, errors.New("open files are only counted on linux")
+}
+
+// RaiseOpenFiles raises the soft RLIMIT_NOFILE to target,and the hard one with it if it is lower,which takes privilege.
+// it returns the soft limit in effect,short of target with the error if it couldn't be raised that far
+func RaiseOpenFiles(target int) (int, error) {
+	return 0, errors.New("open files limit is only raised on linux")
+}
@@ -0,0 +1,30 @@
+// Copyright 2017 longXboy, longxboyhi@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import "io"
+
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// CloseWrite shuts down the writing side of conn so that the peer reads EOF and can still answer,
+// conn is closed entirely if it can't be half-closed
+func CloseWrite(conn io.Closer) error {
+	if cw, isok := conn.(closeWriter); isok {
+		return cw.CloseWrite()
+	}
+	return conn.Close()
+}
@@ -0,0 +1,40 @@
+// Copyright 2017 longXboy, longxboyhi@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"bytes"
+	"os/exec"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// keyringSecret reads the generic password of account ref from the login keychain,
+// stored like: security add-generic-password -s lunnel -a <ref> -w
+func keyringSecret(ref string) (string, error) {
+	var stderr bytes.Buffer
+	cmd := exec.Command("security", "find-generic-password", "-s", "lunnel", "-a", ref, "-w")
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", errors.Wrapf(err, "security find-generic-password %s:%s", ref, strings.TrimSpace(stderr.String()))
+	}
+	secret := strings.TrimRight(string(out), "\r\n")
+	if secret == "" {
+		return "", errors.Errorf("keyring has no secret of %s", ref)
+	}
+	return secret, nil
+}
@@ -0,0 +1,39 @@
+// Copyright 2017 longXboy, longxboyhi@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"bytes"
+	"os/exec"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// keyringSecret looks up the secret of account ref in the secret service(gnome keyring or kwallet) by secret-tool,
+// stored like: secret-tool store --label=lunnel service lunnel account <ref>
+func keyringSecret(ref string) (string, error) {
+	var stderr bytes.Buffer
+	cmd := exec.Command("secret-tool", "lookup", "service", "lunnel", "account", ref)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", errors.Wrapf(err, "secret-tool lookup %s:%s", ref, strings.TrimSpace(stderr.String()))
+	}
+	if len(out) == 0 {
+		return "", errors.Errorf("keyring has no secret of %s", ref)
+	}
+	return strings.TrimRight(string(out), "\r\n"), nil
+}
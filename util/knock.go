@@ -0,0 +1,100 @@
+// Copyright 2017 longXboy, longxboyhi@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// KnockSkew is how far the timestamp of a knock may drift from the server clock
+const KnockSkew = time.Second * 60
+
+const knockMagic = "LUNNEL-KNOCK"
+
+// SignKnock returns the hex hmac-sha256 which opens the public port for a knock sent at ts
+func SignKnock(secret string, port uint16, ts int64) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d:%d", port, ts)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyKnock checks sig against secret and that ts is within KnockSkew of now
+func VerifyKnock(secret string, port uint16, ts int64, sig string, now time.Time) bool {
+	t := time.Unix(ts, 0)
+	if t.Before(now.Add(-KnockSkew)) || t.After(now.Add(KnockSkew)) {
+		return false
+	}
+	expected := SignKnock(secret, port, ts)
+	return hmac.Equal([]byte(expected), []byte(strings.ToLower(sig)))
+}
+
+// KnockReplay remembers the knocks accepted until their timestamp is out of KnockSkew,
+// so a knock seen on the wire can't be replayed from another ip
+type KnockReplay struct {
+	lock sync.Mutex
+	used map[string]int64
+}
+
+// Use records the verified knock,it returns false if the knock has been used already
+func (r *KnockReplay) Use(port uint16, ts int64, sig string, now time.Time) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.used == nil {
+		r.used = make(map[string]int64)
+	}
+	oldest := now.Add(-KnockSkew).Unix()
+	for k, t := range r.used {
+		if t < oldest {
+			delete(r.used, k)
+		}
+	}
+	key := fmt.Sprintf("%d:%d:%s", port, ts, strings.ToLower(sig))
+	if _, isok := r.used[key]; isok {
+		return false
+	}
+	r.used[key] = ts
+	return true
+}
+
+// NewKnockPacket encodes a knock of port as the payload of an udp packet
+func NewKnockPacket(secret string, port uint16, ts int64) []byte {
+	return []byte(fmt.Sprintf("%s %d %d %s", knockMagic, port, ts, SignKnock(secret, port, ts)))
+}
+
+// ParseKnockPacket decodes a packet made by NewKnockPacket
+func ParseKnockPacket(p []byte) (port uint16, ts int64, sig string, err error) {
+	fields := strings.Fields(string(p))
+	if len(fields) != 4 || fields[0] != knockMagic {
+		return 0, 0, "", errors.New("invalid knock packet")
+	}
+	p64, err := strconv.ParseUint(fields[1], 10, 16)
+	if err != nil {
+		return 0, 0, "", errors.Wrap(err, "parse knock port")
+	}
+	ts, err = strconv.ParseInt(fields[2], 10, 64)
+	if err != nil {
+		return 0, 0, "", errors.Wrap(err, "parse knock timestamp")
+	}
+	return uint16(p64), ts, fields[3], nil
+}
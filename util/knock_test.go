@@ -0,0 +1,68 @@
+// Copyright 2017 longXboy, longxboyhi@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_Knock(t *testing.T) {
+	now := time.Now()
+	p := NewKnockPacket("secret", 2222, now.Unix())
+	port, ts, sig, err := ParseKnockPacket(p)
+	if err != nil {
+		t.Fatalf("parse knock packet failed!err:=%v", err)
+	}
+	if port != 2222 || ts != now.Unix() {
+		t.Errorf("parsed port(%d) ts(%d) mismatch", port, ts)
+	}
+	if !VerifyKnock("secret", port, ts, sig, now) {
+		t.Errorf("valid knock rejected")
+	}
+	if VerifyKnock("other", port, ts, sig, now) {
+		t.Errorf("knock with wrong secret accepted")
+	}
+	if VerifyKnock("secret", port+1, ts, sig, now) {
+		t.Errorf("knock of another port accepted")
+	}
+	if VerifyKnock("secret", port, ts, sig, now.Add(KnockSkew*2)) {
+		t.Errorf("stale knock accepted")
+	}
+	_, _, _, err = ParseKnockPacket([]byte("GET / HTTP/1.1"))
+	if err == nil {
+		t.Errorf("invalid knock packet parsed")
+	}
+}
+
+func Test_KnockReplay(t *testing.T) {
+	var r KnockReplay
+	now := time.Now()
+	sig := SignKnock("secret", 2222, now.Unix())
+	if !r.Use(2222, now.Unix(), sig, now) {
+		t.Fatalf("first knock rejected")
+	}
+	if r.Use(2222, now.Unix(), strings.ToUpper(sig), now.Add(time.Second)) {
+		t.Errorf("replayed knock accepted")
+	}
+	if !r.Use(2222, now.Unix()+1, SignKnock("secret", 2222, now.Unix()+1), now.Add(time.Second)) {
+		t.Errorf("next knock rejected")
+	}
+	r.Use(2222, now.Add(KnockSkew*3).Unix(), "", now.Add(KnockSkew*3))
+	if len(r.used) != 1 {
+		t.Errorf("%d expired knocks kept", len(r.used)-1)
+	}
+}
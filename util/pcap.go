@@ -0,0 +1,145 @@
+// Copyright 2017 longXboy, longxboyhi@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"time"
+)
+
+// flags of the tcp segments written by PcapWriter
+const (
+	TcpFin = 0x01
+	TcpSyn = 0x02
+	TcpPsh = 0x08
+	TcpAck = 0x10
+)
+
+// PcapMaxPayload is the most payload a segment written by PcapWriter may carry
+const PcapMaxPayload = 65535 - 60
+
+// linkTypeRaw is LINKTYPE_RAW,packets begin with an ipv4 or ipv6 header
+const linkTypeRaw = 101
+
+// PcapWriter writes tcp segments made up from application data as a pcap file,
+// so that tools like wireshark can follow the streams
+type PcapWriter struct {
+	w io.Writer
+}
+
+// NewPcapWriter writes the file header to w
+func NewPcapWriter(w io.Writer) (*PcapWriter, error) {
+	hdr := make([]byte, 24)
+	binary.LittleEndian.PutUint32(hdr[0:], 0xa1b2c3d4)
+	binary.LittleEndian.PutUint16(hdr[4:], 2)
+	binary.LittleEndian.PutUint16(hdr[6:], 4)
+	binary.LittleEndian.PutUint32(hdr[16:], 65535)
+	binary.LittleEndian.PutUint32(hdr[20:], linkTypeRaw)
+	_, err := w.Write(hdr)
+	if err != nil {
+		return nil, err
+	}
+	return &PcapWriter{w: w}, nil
+}
+
+// WriteTCP writes a segment from src to dst carrying payload,which is at most PcapMaxPayload.
+// the bytes written are returned
+func (pw *PcapWriter) WriteTCP(ts time.Time, src, dst *net.TCPAddr, seq, ack uint32, flags uint8, payload []byte) (int, error) {
+	tcp := make([]byte, 20+len(payload))
+	binary.BigEndian.PutUint16(tcp[0:], uint16(src.Port))
+	binary.BigEndian.PutUint16(tcp[2:], uint16(dst.Port))
+	binary.BigEndian.PutUint32(tcp[4:], seq)
+	binary.BigEndian.PutUint32(tcp[8:], ack)
+	tcp[12] = 5 << 4
+	tcp[13] = flags
+	binary.BigEndian.PutUint16(tcp[14:], 65535)
+	copy(tcp[20:], payload)
+
+	var ip, pseudo []byte
+	src4, dst4 := src.IP.To4(), dst.IP.To4()
+	if src4 != nil && dst4 != nil {
+		ip = make([]byte, 20)
+		ip[0] = 0x45
+		binary.BigEndian.PutUint16(ip[2:], uint16(20+len(tcp)))
+		binary.BigEndian.PutUint16(ip[6:], 0x4000)
+		ip[8] = 64
+		ip[9] = 6
+		copy(ip[12:], src4)
+		copy(ip[16:], dst4)
+		binary.BigEndian.PutUint16(ip[10:], checksum(0, ip))
+		pseudo = make([]byte, 12)
+		copy(pseudo[0:], src4)
+		copy(pseudo[4:], dst4)
+		pseudo[9] = 6
+		binary.BigEndian.PutUint16(pseudo[10:], uint16(len(tcp)))
+	} else {
+		src16, dst16 := src.IP.To16(), dst.IP.To16()
+		if src16 == nil {
+			src16 = net.IPv6zero
+		}
+		if dst16 == nil {
+			dst16 = net.IPv6zero
+		}
+		ip = make([]byte, 40)
+		ip[0] = 0x60
+		binary.BigEndian.PutUint16(ip[4:], uint16(len(tcp)))
+		ip[6] = 6
+		ip[7] = 64
+		copy(ip[8:], src16)
+		copy(ip[24:], dst16)
+		pseudo = make([]byte, 40)
+		copy(pseudo[0:], src16)
+		copy(pseudo[16:], dst16)
+		binary.BigEndian.PutUint32(pseudo[32:], uint32(len(tcp)))
+		pseudo[39] = 6
+	}
+	binary.BigEndian.PutUint16(tcp[16:], checksum(sum(0, pseudo), tcp))
+
+	rec := make([]byte, 16)
+	binary.LittleEndian.PutUint32(rec[0:], uint32(ts.Unix()))
+	binary.LittleEndian.PutUint32(rec[4:], uint32(ts.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(rec[8:], uint32(len(ip)+len(tcp)))
+	binary.LittleEndian.PutUint32(rec[12:], uint32(len(ip)+len(tcp)))
+	var written int
+	for _, b := range [][]byte{rec, ip, tcp} {
+		n, err := pw.w.Write(b)
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+func sum(s uint32, b []byte) uint32 {
+	for i := 0; i+1 < len(b); i += 2 {
+		s += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		s += uint32(b[len(b)-1]) << 8
+	}
+	return s
+}
+
+// checksum is the internet checksum of b added to the partial sum s
+func checksum(s uint32, b []byte) uint16 {
+	s = sum(s, b)
+	for s>>16 != 0 {
+		s = s&0xffff + s>>16
+	}
+	return ^uint16(s)
+}
@@ -0,0 +1,71 @@
+// Copyright 2017 longXboy, longxboyhi@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPcapWriter(t *testing.T) {
+	var buf bytes.Buffer
+	pw, err := NewPcapWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 40000}
+	dst := &net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 80}
+	n, err := pw.WriteTCP(time.Unix(100, 5000), src, dst, 1, 1, TcpPsh|TcpAck, []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 16+20+20+5 || buf.Len() != 24+n {
+		t.Fatalf("wrote %d,buffered %d", n, buf.Len())
+	}
+	b := buf.Bytes()
+	if binary.LittleEndian.Uint32(b) != 0xa1b2c3d4 || binary.LittleEndian.Uint32(b[20:]) != linkTypeRaw {
+		t.Fatal("invalid file header")
+	}
+	rec := b[24:]
+	if binary.LittleEndian.Uint32(rec) != 100 || binary.LittleEndian.Uint32(rec[4:]) != 5 || binary.LittleEndian.Uint32(rec[8:]) != 45 {
+		t.Fatalf("invalid record header %x", rec[:16])
+	}
+	ip := rec[16:36]
+	if checksum(0, ip) != 0 {
+		t.Fatal("invalid ip checksum")
+	}
+	tcp := rec[36:]
+	pseudo := append(append(append([]byte{}, ip[12:20]...), 0, 6), 0, byte(len(tcp)))
+	if checksum(sum(0, pseudo), tcp) != 0 {
+		t.Fatal("invalid tcp checksum")
+	}
+	if string(tcp[20:]) != "hello" || tcp[13] != TcpPsh|TcpAck || binary.BigEndian.Uint16(tcp[2:]) != 80 {
+		t.Fatalf("invalid segment %x", tcp)
+	}
+
+	buf.Reset()
+	pw, _ = NewPcapWriter(&buf)
+	src6 := &net.TCPAddr{IP: net.ParseIP("::1"), Port: 40000}
+	n, err = pw.WriteTCP(time.Now(), src6, dst, 0, 0, TcpSyn, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 16+40+20 || buf.Bytes()[24+16]>>4 != 6 {
+		t.Fatal("mixed families should be written as ipv6")
+	}
+}
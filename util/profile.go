@@ -0,0 +1,45 @@
+// Copyright 2017 longXboy, longxboyhi@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"reflect"
+)
+
+// MergeProfile fills the zero fields of the struct dst points to with the fields of profile,
+// which must be a struct of the same type.maps are merged with the keys of dst taking precedence
+func MergeProfile(dst interface{}, profile interface{}) {
+	d := reflect.ValueOf(dst).Elem()
+	p := reflect.ValueOf(profile)
+	for i := 0; i < d.NumField(); i++ {
+		field := d.Field(i)
+		from := p.Field(i)
+		if !field.CanSet() || from.IsZero() {
+			continue
+		}
+		if field.Kind() == reflect.Map {
+			merged := reflect.MakeMap(field.Type())
+			for _, k := range from.MapKeys() {
+				merged.SetMapIndex(k, from.MapIndex(k))
+			}
+			for _, k := range field.MapKeys() {
+				merged.SetMapIndex(k, field.MapIndex(k))
+			}
+			field.Set(merged)
+		} else if field.IsZero() {
+			field.Set(from)
+		}
+	}
+}
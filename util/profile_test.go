@@ -0,0 +1,49 @@
+// Copyright 2017 longXboy, longxboyhi@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"testing"
+)
+
+type profileConf struct {
+	Host     string
+	Rate     float64
+	AllowIPs []string
+	Labels   map[string]string
+	Cap      *int
+	hidden   string
+}
+
+func Test_MergeProfile(t *testing.T) {
+	limit := 10
+	profile := profileConf{Host: "a.example.com", Rate: 5, AllowIPs: []string{"10.0.0.0/8"}, Labels: map[string]string{"team": "ops", "env": "prod"}, Cap: &limit, hidden: "x"}
+	conf := profileConf{Host: "b.example.com", Labels: map[string]string{"env": "dev"}}
+	MergeProfile(&conf, profile)
+	if conf.Host != "b.example.com" || conf.Rate != 5 || len(conf.AllowIPs) != 1 || conf.Cap != &limit || conf.hidden != "" {
+		t.Error("merge profile", conf)
+	}
+	if len(conf.Labels) != 2 || conf.Labels["env"] != "dev" || conf.Labels["team"] != "ops" {
+		t.Error("merge profile labels", conf.Labels)
+	}
+	if profile.Labels["env"] != "prod" {
+		t.Error("profile labels modified", profile.Labels)
+	}
+	empty := profileConf{Rate: 1}
+	MergeProfile(&empty, profileConf{})
+	if empty.Rate != 1 || empty.Labels != nil {
+		t.Error("merge empty profile", empty)
+	}
+}
@@ -0,0 +1,45 @@
+// Copyright 2017 longXboy, longxboyhi@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_RateLimiter(t *testing.T) {
+	r := NewRateLimiter(2, 3)
+	now := r.last
+	for i := 0; i < 3; i++ {
+		if !r.allowAt(now) {
+			t.Errorf("burst token %d not allowed", i)
+		}
+	}
+	if r.allowAt(now) {
+		t.Errorf("allowed after burst exhausted")
+	}
+	if !r.allowAt(now.Add(time.Millisecond * 500)) {
+		t.Errorf("not allowed after refill")
+	}
+	if r.allowAt(now.Add(time.Millisecond * 500)) {
+		t.Errorf("allowed more than refilled")
+	}
+	if !r.allowAt(now.Add(time.Second * 10)) {
+		t.Errorf("not allowed after long idle")
+	}
+	if r.tokens > r.burst {
+		t.Errorf("tokens(%v) greater than burst(%v)", r.tokens, r.burst)
+	}
+}
@@ -0,0 +1,130 @@
+// Copyright 2017 longXboy, longxboyhi@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"context"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Resolver looks hosts up in its static overrides first and then asks its dns servers in order,
+// the system resolver is used if no server is configured.a nil Resolver leaves the lookups to the dialer
+type Resolver struct {
+	servers []string
+	timeout time.Duration
+	hosts   map[string][]net.IP
+}
+
+// NewResolver creates a resolver asking servers(ip or ip:port) with timeout for each server,
+// hosts maps the host names to the ips returned without asking
+func NewResolver(servers []string, timeout time.Duration, hosts map[string][]string) (*Resolver, error) {
+	r := &Resolver{timeout: timeout, hosts: make(map[string][]net.IP, len(hosts))}
+	for _, s := range servers {
+		if net.ParseIP(s) != nil {
+			s = net.JoinHostPort(s, "53")
+		} else if _, _, err := net.SplitHostPort(s); err != nil {
+			return nil, errors.Errorf("invalid dns server %s", s)
+		}
+		r.servers = append(r.servers, s)
+	}
+	for host, list := range hosts {
+		for _, s := range list {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, errors.Errorf("invalid ip %s of host %s", s, host)
+			}
+			r.hosts[strings.ToLower(host)] = append(r.hosts[strings.ToLower(host)], ip)
+		}
+	}
+	return r, nil
+}
+
+func (r *Resolver) context() (context.Context, context.CancelFunc) {
+	if r.timeout <= 0 {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithTimeout(context.Background(), r.timeout)
+}
+
+func (r *Resolver) lookup(res *net.Resolver, host string) ([]net.IP, error) {
+	ctx, cancel := r.context()
+	defer cancel()
+	addrs, err := res.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]net.IP, 0, len(addrs))
+	for _, a := range addrs {
+		ips = append(ips, a.IP)
+	}
+	if len(ips) == 0 {
+		return nil, errors.Errorf("no address found for %s", host)
+	}
+	return ips, nil
+}
+
+// LookupIP returns the ips of host,the next server is asked if one fails
+func (r *Resolver) LookupIP(host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	if r == nil {
+		return net.LookupIP(host)
+	}
+	if ips, isok := r.hosts[strings.ToLower(host)]; isok {
+		return ips, nil
+	}
+	if len(r.servers) == 0 {
+		return r.lookup(net.DefaultResolver, host)
+	}
+	var err error
+	for _, server := range r.servers {
+		server := server
+		res := &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, server)
+			},
+		}
+		var ips []net.IP
+		ips, err = r.lookup(res, host)
+		if err == nil {
+			return ips, nil
+		}
+	}
+	return nil, errors.Wrapf(err, "lookup %s", host)
+}
+
+// ResolveAddr replaces the host of addr(host:port) by its first ip,
+// addr is returned as it is by a nil Resolver
+func (r *Resolver) ResolveAddr(addr string) (string, error) {
+	if r == nil {
+		return addr, nil
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", errors.Wrap(err, "split host port")
+	}
+	ips, err := r.LookupIP(host)
+	if err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(ips[0].String(), port), nil
+}
@@ -0,0 +1,53 @@
+// Copyright 2017 longXboy, longxboyhi@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_Resolver(t *testing.T) {
+	r, err := NewResolver([]string{"127.0.0.1", "[::1]:5353"}, time.Second, map[string][]string{"Server.Example.com": {"10.0.0.1", "10.0.0.2"}})
+	if err != nil {
+		t.Fatalf("new resolver failed!err:=%v", err)
+	}
+	if r.servers[0] != "127.0.0.1:53" || r.servers[1] != "[::1]:5353" {
+		t.Errorf("dns servers should be normalized,got %v", r.servers)
+	}
+	ips, err := r.LookupIP("server.example.com")
+	if err != nil || len(ips) != 2 || ips[0].String() != "10.0.0.1" {
+		t.Errorf("host override should be returned,got %v err:=%v", ips, err)
+	}
+	addr, err := r.ResolveAddr("SERVER.example.com:8080")
+	if err != nil || addr != "10.0.0.1:8080" {
+		t.Errorf("addr should be resolved by override,got %s err:=%v", addr, err)
+	}
+	addr, err = r.ResolveAddr("[::1]:80")
+	if err != nil || addr != "[::1]:80" {
+		t.Errorf("ip addr should be kept,got %s err:=%v", addr, err)
+	}
+	var nilResolver *Resolver
+	addr, err = nilResolver.ResolveAddr("example.com:80")
+	if err != nil || addr != "example.com:80" {
+		t.Errorf("nil resolver should keep addr,got %s err:=%v", addr, err)
+	}
+	if _, err = NewResolver([]string{"example.com"}, 0, nil); err == nil {
+		t.Errorf("dns server without port should be invalid")
+	}
+	if _, err = NewResolver(nil, 0, map[string][]string{"a": {"x"}}); err == nil {
+		t.Errorf("invalid override ip should be refused")
+	}
+}
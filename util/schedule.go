@@ -0,0 +1,141 @@
+// Copyright 2017 longXboy, longxboyhi@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+type window struct {
+	days  [7]bool
+	start int
+	end   int
+}
+
+// Schedule is a set of weekly time windows,such as "mon-fri 09:00-18:00" or "* 22:00-06:00"
+type Schedule []window
+
+func parseDays(spec string, w *window) error {
+	if spec == "*" {
+		for i := range w.days {
+			w.days[i] = true
+		}
+		return nil
+	}
+	for _, part := range strings.Split(spec, ",") {
+		bounds := strings.SplitN(part, "-", 2)
+		from, isok := weekdays[strings.ToLower(bounds[0])]
+		if !isok {
+			return errors.Errorf("invalid weekday %s", bounds[0])
+		}
+		to := from
+		if len(bounds) == 2 {
+			to, isok = weekdays[strings.ToLower(bounds[1])]
+			if !isok {
+				return errors.Errorf("invalid weekday %s", bounds[1])
+			}
+		}
+		for d := from; ; d = (d + 1) % 7 {
+			w.days[d] = true
+			if d == to {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+func parseClock(spec string) (int, error) {
+	parts := strings.SplitN(spec, ":", 2)
+	if len(parts) != 2 {
+		return 0, errors.Errorf("invalid time %s", spec)
+	}
+	hour, err := strconv.Atoi(parts[0])
+	if err != nil || hour < 0 || hour > 24 {
+		return 0, errors.Errorf("invalid hour of %s", spec)
+	}
+	minute, err := strconv.Atoi(parts[1])
+	if err != nil || minute < 0 || minute > 59 || (hour == 24 && minute != 0) {
+		return 0, errors.Errorf("invalid minute of %s", spec)
+	}
+	return hour*60 + minute, nil
+}
+
+// ParseSchedule parses windows in "<days> <HH:MM>-<HH:MM>" format,
+// days is * or weekdays like mon-fri,sat,sun.A window ending before it starts spans midnight
+func ParseSchedule(specs []string) (Schedule, error) {
+	var s Schedule
+	for _, spec := range specs {
+		fields := strings.Fields(spec)
+		if len(fields) != 2 {
+			return nil, errors.Errorf("invalid window %s", spec)
+		}
+		var w window
+		err := parseDays(fields[0], &w)
+		if err != nil {
+			return nil, errors.Wrapf(err, "window %s", spec)
+		}
+		clocks := strings.SplitN(fields[1], "-", 2)
+		if len(clocks) != 2 {
+			return nil, errors.Errorf("invalid time range of window %s", spec)
+		}
+		w.start, err = parseClock(clocks[0])
+		if err != nil {
+			return nil, errors.Wrapf(err, "window %s", spec)
+		}
+		w.end, err = parseClock(clocks[1])
+		if err != nil {
+			return nil, errors.Wrapf(err, "window %s", spec)
+		}
+		s = append(s, w)
+	}
+	return s, nil
+}
+
+// Active reports whether t falls in any window,an empty schedule is always active
+func (s Schedule) Active(t time.Time) bool {
+	if len(s) == 0 {
+		return true
+	}
+	minute := t.Hour()*60 + t.Minute()
+	yesterday := (t.Weekday() + 6) % 7
+	for _, w := range s {
+		if w.start <= w.end {
+			if w.days[t.Weekday()] && minute >= w.start && minute < w.end {
+				return true
+			}
+			continue
+		}
+		// spans midnight,the days are the days the window starts on
+		if (w.days[t.Weekday()] && minute >= w.start) || (w.days[yesterday] && minute < w.end) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,54 @@
+// Copyright 2017 longXboy, longxboyhi@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_Schedule(t *testing.T) {
+	s, err := ParseSchedule([]string{"mon-fri 09:00-18:00", "sat 22:00-02:00"})
+	if err != nil {
+		t.Fatalf("parse schedule failed!err:=%v", err)
+	}
+	// 2017-06-05 is a monday
+	cases := []struct {
+		at     time.Time
+		active bool
+	}{
+		{time.Date(2017, 6, 5, 9, 0, 0, 0, time.UTC), true},
+		{time.Date(2017, 6, 5, 8, 59, 0, 0, time.UTC), false},
+		{time.Date(2017, 6, 9, 17, 59, 0, 0, time.UTC), true},
+		{time.Date(2017, 6, 9, 18, 0, 0, 0, time.UTC), false},
+		{time.Date(2017, 6, 10, 12, 0, 0, 0, time.UTC), false},
+		{time.Date(2017, 6, 10, 23, 0, 0, 0, time.UTC), true},
+		{time.Date(2017, 6, 11, 1, 30, 0, 0, time.UTC), true},
+		{time.Date(2017, 6, 11, 2, 0, 0, 0, time.UTC), false},
+	}
+	for _, c := range cases {
+		if s.Active(c.at) != c.active {
+			t.Errorf("active at %v should be %v", c.at, c.active)
+		}
+	}
+	if !Schedule(nil).Active(time.Now()) {
+		t.Errorf("empty schedule should be always active")
+	}
+	for _, spec := range []string{"mon", "xyz 09:00-10:00", "* 9-10", "* 25:00-26:00"} {
+		if _, err = ParseSchedule([]string{spec}); err == nil {
+			t.Errorf("invalid window %s parsed", spec)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+// Copyright 2017 longXboy, longxboyhi@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// SdNotify sends state(e.g. READY=1) to the notify socket of systemd,
+// it does nothing unless the process is started by systemd with Type=notify
+func SdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return errors.Wrap(err, "dial notify socket")
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	if err != nil {
+		return errors.Wrap(err, "write notify socket")
+	}
+	return nil
+}
+
+// SdWatchdogInterval is the interval systemd expects WATCHDOG=1 in,0 if the watchdog is off
+func SdWatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// RunWatchdog sends WATCHDOG=1 at half of the watchdog interval as long as healthy reports true,
+// so that systemd restarts the process once it hangs.it returns at once if the watchdog is off
+func RunWatchdog(healthy func() bool) {
+	interval := SdWatchdogInterval()
+	if interval == 0 {
+		return
+	}
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+	for range ticker.C {
+		if healthy() {
+			SdNotify("WATCHDOG=1")
+		}
+	}
+}
+
+// Responsive reports whether fn returns in timeout,e.g. fn takes the locks a deadlock would hold
+func Responsive(fn func(), timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		fn()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
@@ -0,0 +1,77 @@
+// Copyright 2017 longXboy, longxboyhi@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func Test_SdNotify(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sdnotify")
+	if err != nil {
+		t.Fatalf("create temp dir failed!err:=%v", err)
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		t.Fatalf("listen notify socket failed!err:=%v", err)
+	}
+	defer conn.Close()
+	os.Setenv("NOTIFY_SOCKET", socket)
+	defer os.Unsetenv("NOTIFY_SOCKET")
+	err = SdNotify("READY=1")
+	if err != nil {
+		t.Fatalf("notify failed!err:=%v", err)
+	}
+	buf := make([]byte, 64)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("read notify socket failed!err:=%v", err)
+	}
+	if string(buf[:n]) != "READY=1" {
+		t.Errorf("notified %q,want READY=1", buf[:n])
+	}
+}
+
+func Test_SdWatchdogInterval(t *testing.T) {
+	defer os.Unsetenv("WATCHDOG_USEC")
+	defer os.Unsetenv("WATCHDOG_PID")
+	os.Setenv("WATCHDOG_USEC", "3000000")
+	if d := SdWatchdogInterval(); d != time.Second*3 {
+		t.Errorf("watchdog interval %v,want 3s", d)
+	}
+	os.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()+1))
+	if d := SdWatchdogInterval(); d != 0 {
+		t.Errorf("watchdog of another pid should be off,got %v", d)
+	}
+	if !Responsive(func() {}, time.Second) {
+		t.Errorf("returning fn should be responsive")
+	}
+	var lock sync.Mutex
+	lock.Lock()
+	defer lock.Unlock()
+	if Responsive(func() { lock.Lock() }, time.Millisecond*50) {
+		t.Errorf("blocked fn should not be responsive")
+	}
+}
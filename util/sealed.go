@@ -0,0 +1,158 @@
+// Copyright 2017 longXboy, longxboyhi@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/scrypt"
+)
+
+// SealedPrefix starts the secrets sealed by Seal
+const SealedPrefix = "lunnel-sealed:"
+
+const sealSaltSize = 16
+
+// PassphraseFunc returns the passphrase the sealed secrets are unlocked with
+type PassphraseFunc func() (string, error)
+
+var passphraseLock sync.Mutex
+var passphraseFunc PassphraseFunc = EnvPassphrase
+var passphrase string
+
+// EnvPassphrase is the default PassphraseFunc,it takes the passphrase from LUNNEL_PASSPHRASE,or the file LUNNEL_PASSPHRASE_FILE names
+func EnvPassphrase() (string, error) {
+	if value, isok := os.LookupEnv("LUNNEL_PASSPHRASE"); isok {
+		return value, nil
+	}
+	if path := os.Getenv("LUNNEL_PASSPHRASE_FILE"); path != "" {
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return "", errors.Wrap(err, "read passphrase file")
+		}
+		return strings.TrimRight(string(content), "\r\n"), nil
+	}
+	return "", errors.New("neither LUNNEL_PASSPHRASE nor LUNNEL_PASSPHRASE_FILE is set")
+}
+
+// SetPassphraseFunc makes the sealed secrets unlocked by the passphrase f returns,
+// like one asked on the terminal.f is called once and its passphrase kept for the later secrets
+func SetPassphraseFunc(f PassphraseFunc) {
+	passphraseLock.Lock()
+	passphraseFunc = f
+	passphrase = ""
+	passphraseLock.Unlock()
+}
+
+func unlockPassphrase() (string, error) {
+	passphraseLock.Lock()
+	defer passphraseLock.Unlock()
+	if passphrase != "" {
+		return passphrase, nil
+	}
+	p, err := passphraseFunc()
+	if err != nil {
+		return "", err
+	}
+	if p == "" {
+		return "", errors.New("passphrase can not be empty")
+	}
+	passphrase = p
+	return p, nil
+}
+
+func sealKey(passphrase string, salt []byte) (cipher.AEAD, error) {
+	key, err := scrypt.Key([]byte(passphrase), salt, 1<<15, 8, 1, 32)
+	if err != nil {
+		return nil, errors.Wrap(err, "derive key")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Seal encrypts secret by aes-gcm with a key derived from passphrase by scrypt,
+// the result starts with SealedPrefix and is referred as ${sealed:<result>} in the config
+func Seal(secret string, passphrase string) (string, error) {
+	salt := make([]byte, sealSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return "", errors.Wrap(err, "generate salt")
+	}
+	aead, err := sealKey(passphrase, salt)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return "", errors.Wrap(err, "generate nonce")
+	}
+	sealed := append(salt, nonce...)
+	sealed = aead.Seal(sealed, nonce, []byte(secret), nil)
+	return SealedPrefix + base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+// Unseal decrypts the secret sealed by Seal with the same passphrase
+func Unseal(sealed string, passphrase string) (string, error) {
+	if !strings.HasPrefix(sealed, SealedPrefix) {
+		return "", errors.New("not a sealed secret")
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(sealed, SealedPrefix))
+	if err != nil {
+		return "", errors.Wrap(err, "decode sealed secret")
+	}
+	if len(raw) < sealSaltSize {
+		return "", errors.New("sealed secret too short")
+	}
+	aead, err := sealKey(passphrase, raw[:sealSaltSize])
+	if err != nil {
+		return "", err
+	}
+	raw = raw[sealSaltSize:]
+	if len(raw) < aead.NonceSize() {
+		return "", errors.New("sealed secret too short")
+	}
+	secret, err := aead.Open(nil, raw[:aead.NonceSize()], raw[aead.NonceSize():], nil)
+	if err != nil {
+		return "", errors.New("wrong passphrase or corrupted sealed secret")
+	}
+	return string(secret), nil
+}
+
+// sealedSecret unseals ref,which is a sealed secret or the path of a file holding one
+func sealedSecret(ref string) (string, error) {
+	sealed := ref
+	if !strings.HasPrefix(ref, SealedPrefix) {
+		content, err := ioutil.ReadFile(ref)
+		if err != nil {
+			return "", errors.Wrap(err, "read sealed secret file")
+		}
+		sealed = strings.TrimSpace(string(content))
+	}
+	p, err := unlockPassphrase()
+	if err != nil {
+		return "", errors.Wrap(err, "unlock sealed secret")
+	}
+	return Unseal(sealed, p)
+}
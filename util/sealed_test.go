@@ -0,0 +1,61 @@
+// Copyright 2017 longXboy, longxboyhi@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func Test_Seal(t *testing.T) {
+	sealed, err := Seal("auth-token", "kiosk passphrase")
+	if err != nil {
+		t.Fatalf("seal error:%v", err)
+	}
+	secret, err := Unseal(sealed, "kiosk passphrase")
+	if err != nil || secret != "auth-token" {
+		t.Fatalf("Unseal=%s,%v", secret, err)
+	}
+	if _, err = Unseal(sealed, "wrong passphrase"); err == nil {
+		t.Errorf("unsealed by a wrong passphrase")
+	}
+	if _, err = Unseal(sealed[:len(sealed)-4], "kiosk passphrase"); err == nil {
+		t.Errorf("truncated secret unsealed")
+	}
+
+	f, err := ioutil.TempFile("", "lunnel-sealed")
+	if err != nil {
+		t.Fatalf("create temp file error:%v", err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(sealed + "\n")
+	f.Close()
+	asked := 0
+	SetPassphraseFunc(func() (string, error) {
+		asked++
+		return "kiosk passphrase", nil
+	})
+	defer SetPassphraseFunc(EnvPassphrase)
+	for _, value := range []string{"${sealed:" + sealed + "}", "${sealed:" + f.Name() + "}"} {
+		secret, err = ResolveSecret(value)
+		if err != nil || secret != "auth-token" {
+			t.Errorf("ResolveSecret(%s)=%s,%v", value, secret, err)
+		}
+	}
+	if asked != 1 {
+		t.Errorf("passphrase asked %d times", asked)
+	}
+}
@@ -0,0 +1,100 @@
+// Copyright 2017 longXboy, longxboyhi@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// SecretProvider resolves the reference of a secret like ${scheme:ref} in the config
+type SecretProvider interface {
+	Secret(ref string) (string, error)
+}
+
+type SecretProviderFunc func(ref string) (string, error)
+
+func (f SecretProviderFunc) Secret(ref string) (string, error) {
+	return f(ref)
+}
+
+var secretProvidersLock sync.RWMutex
+var secretProviders = map[string]SecretProvider{
+	"env": SecretProviderFunc(func(name string) (string, error) {
+		value, isok := os.LookupEnv(name)
+		if !isok {
+			return "", errors.Errorf("environment variable %s not set", name)
+		}
+		return value, nil
+	}),
+	"file": SecretProviderFunc(func(path string) (string, error) {
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return "", errors.Wrap(err, "read secret file")
+		}
+		return strings.TrimRight(string(content), "\r\n"), nil
+	}),
+	//sealed by Seal,inline or in the file of the path
+	"sealed": SecretProviderFunc(sealedSecret),
+	//stored in the keyring of the os under the service lunnel
+	"keyring": SecretProviderFunc(keyringSecret),
+}
+
+// RegisterSecretProvider makes ${scheme:ref} resolved by p,it replaces the provider registered for scheme before
+func RegisterSecretProvider(scheme string, p SecretProvider) {
+	secretProvidersLock.Lock()
+	secretProviders[scheme] = p
+	secretProvidersLock.Unlock()
+}
+
+// ResolveSecret returns the secret referred by value if it is in ${scheme:ref} form,otherwise value itself
+func ResolveSecret(value string) (string, error) {
+	if !strings.HasPrefix(value, "${") || !strings.HasSuffix(value, "}") {
+		return value, nil
+	}
+	ref := value[2 : len(value)-1]
+	idx := strings.IndexByte(ref, ':')
+	if idx <= 0 {
+		return value, nil
+	}
+	scheme := ref[:idx]
+	secretProvidersLock.RLock()
+	p, isok := secretProviders[scheme]
+	secretProvidersLock.RUnlock()
+	if !isok {
+		return "", errors.Errorf("secret provider %s not registered", scheme)
+	}
+	secret, err := p.Secret(ref[idx+1:])
+	if err != nil {
+		return "", errors.Wrapf(err, "resolve secret %s", value)
+	}
+	return secret, nil
+}
+
+// ResolveSecrets replaces every value with the secret it refers to
+func ResolveSecrets(values ...*string) error {
+	for _, v := range values {
+		secret, err := ResolveSecret(*v)
+		if err != nil {
+			return err
+		}
+		*v = secret
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+// Copyright 2017 longXboy, longxboyhi@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func Test_ResolveSecret(t *testing.T) {
+	os.Setenv("LUNNEL_TEST_SECRET", "from-env")
+	defer os.Unsetenv("LUNNEL_TEST_SECRET")
+	f, err := ioutil.TempFile("", "lunnel-secret")
+	if err != nil {
+		t.Fatalf("create temp file error:%v", err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("from-file\n")
+	f.Close()
+	RegisterSecretProvider("test", SecretProviderFunc(func(ref string) (string, error) {
+		return "test-" + ref, nil
+	}))
+
+	cases := map[string]string{
+		"plain":                            "plain",
+		"${env:LUNNEL_TEST_SECRET}":        "from-env",
+		"${file:" + f.Name() + "}":         "from-file",
+		"${test:key}":                      "test-key",
+		"${not a reference}":               "${not a reference}",
+		"prefix ${env:LUNNEL_TEST_SECRET}": "prefix ${env:LUNNEL_TEST_SECRET}",
+	}
+	for value, expect := range cases {
+		secret, err := ResolveSecret(value)
+		if err != nil || secret != expect {
+			t.Errorf("ResolveSecret(%s)=%s,%v,expect %s", value, secret, err, expect)
+		}
+	}
+	if _, err = ResolveSecret("${env:LUNNEL_TEST_NOT_SET}"); err == nil {
+		t.Errorf("unset environment variable resolved")
+	}
+	if _, err = ResolveSecret("${unknown:ref}"); err == nil {
+		t.Errorf("unknown provider resolved")
+	}
+	a, b := "${env:LUNNEL_TEST_SECRET}", "plain"
+	err = ResolveSecrets(&a, &b)
+	if err != nil || a != "from-env" || b != "plain" {
+		t.Errorf("ResolveSecrets error:%v,%s,%s", err, a, b)
+	}
+}
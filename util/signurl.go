@@ -0,0 +1,51 @@
+// Copyright 2017 longXboy, longxboyhi@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SignedURLParam is the query parameter and cookie name carrying the token of signed urls
+const SignedURLParam = "lunnel_token"
+
+// SignURL returns the token which grants access to host until expire
+func SignURL(secret string, host string, expire int64) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%s:%d", host, expire)
+	return fmt.Sprintf("%d.%s", expire, hex.EncodeToString(mac.Sum(nil)))
+}
+
+// VerifySignedURL checks token is signed for host and not expired,the expire time is returned
+func VerifySignedURL(secret string, host string, token string, now time.Time) (int64, bool) {
+	idx := strings.IndexByte(token, '.')
+	if idx <= 0 {
+		return 0, false
+	}
+	expire, err := strconv.ParseInt(token[:idx], 10, 64)
+	if err != nil || now.Unix() >= expire {
+		return 0, false
+	}
+	if !hmac.Equal([]byte(SignURL(secret, host, expire)), []byte(token)) {
+		return 0, false
+	}
+	return expire, true
+}
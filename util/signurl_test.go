@@ -0,0 +1,41 @@
+// Copyright 2017 longXboy, longxboyhi@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_SignURL(t *testing.T) {
+	now := time.Now()
+	token := SignURL("secret", "demo.example.com", now.Add(time.Hour).Unix())
+	expire, ok := VerifySignedURL("secret", "demo.example.com", token, now)
+	if !ok || expire != now.Add(time.Hour).Unix() {
+		t.Errorf("valid token rejected")
+	}
+	if _, ok = VerifySignedURL("secret", "other.example.com", token, now); ok {
+		t.Errorf("token of another host accepted")
+	}
+	if _, ok = VerifySignedURL("other", "demo.example.com", token, now); ok {
+		t.Errorf("token with wrong secret accepted")
+	}
+	if _, ok = VerifySignedURL("secret", "demo.example.com", token, now.Add(time.Hour*2)); ok {
+		t.Errorf("expired token accepted")
+	}
+	if _, ok = VerifySignedURL("secret", "demo.example.com", "garbage", now); ok {
+		t.Errorf("malformed token accepted")
+	}
+}
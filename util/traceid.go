@@ -0,0 +1,50 @@
+// Copyright 2017 longXboy, longxboyhi@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"strconv"
+
+	"github.com/satori/go.uuid"
+)
+
+// NewTraceID returns a short random id for the log lines of a control connection,
+// client sends it in the hello so that both sides log the same id
+func NewTraceID() string {
+	var b [4]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// ValidTraceID reports whether id sent by the peer is fit for the log lines
+func ValidTraceID(id string) bool {
+	if len(id) == 0 || len(id) > 32 {
+		return false
+	}
+	_, err := hex.DecodeString(id)
+	return err == nil
+}
+
+// PipeID returns the id of the pipe whose hello carried once
+func PipeID(once uuid.UUID) string {
+	return hex.EncodeToString(once[:4])
+}
+
+// StreamID returns the id of stream sid of pipe,smux numbers the streams of a pipe alike on both sides
+func StreamID(pipe string, sid uint32) string {
+	return pipe + "/" + strconv.FormatUint(uint64(sid), 10)
+}
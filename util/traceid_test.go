@@ -0,0 +1,43 @@
+// Copyright 2017 longXboy, longxboyhi@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"testing"
+
+	"github.com/satori/go.uuid"
+)
+
+func TestTraceID(t *testing.T) {
+	id := NewTraceID()
+	if len(id) != 8 || !ValidTraceID(id) {
+		t.Fatalf("invalid trace id %s", id)
+	}
+	if id == NewTraceID() {
+		t.Fatal("trace ids should differ")
+	}
+	for _, bad := range []string{"", "xyz", "a\nb", "0123456789abcdef0123456789abcdef00"} {
+		if ValidTraceID(bad) {
+			t.Fatalf("%q should be invalid", bad)
+		}
+	}
+	once := uuid.FromStringOrNil("6ba7b810-9dad-11d1-80b4-00c04fd430c8")
+	if PipeID(once) != "6ba7b810" {
+		t.Fatalf("pipe id %s", PipeID(once))
+	}
+	if StreamID(PipeID(once), 3) != "6ba7b810/3" {
+		t.Fatalf("stream id %s", StreamID(PipeID(once), 3))
+	}
+}
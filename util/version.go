@@ -0,0 +1,81 @@
+// Copyright 2017 longXboy, longxboyhi@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+type version struct {
+	parts      []int
+	preRelease bool
+}
+
+func parseVersion(s string) (version, error) {
+	var v version
+	s = strings.TrimPrefix(strings.TrimSpace(s), "v")
+	if i := strings.IndexByte(s, '+'); i >= 0 {
+		s = s[:i]
+	}
+	if i := strings.IndexByte(s, '-'); i >= 0 {
+		s = s[:i]
+		v.preRelease = true
+	}
+	for _, p := range strings.Split(s, ".") {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 {
+			return v, errors.Errorf("invalid version %s", s)
+		}
+		v.parts = append(v.parts, n)
+	}
+	return v, nil
+}
+
+// CompareVersion compares the dotted versions a and b(e.g. 0.1.2,v1.0.0-rc1),it returns -1,0 or 1
+// if a is older than,the same as or newer than b.missing parts count as 0 and a pre-release
+// is older than its release
+func CompareVersion(a string, b string) (int, error) {
+	va, err := parseVersion(a)
+	if err != nil {
+		return 0, err
+	}
+	vb, err := parseVersion(b)
+	if err != nil {
+		return 0, err
+	}
+	for i := 0; i < len(va.parts) || i < len(vb.parts); i++ {
+		var x, y int
+		if i < len(va.parts) {
+			x = va.parts[i]
+		}
+		if i < len(vb.parts) {
+			y = vb.parts[i]
+		}
+		if x < y {
+			return -1, nil
+		} else if x > y {
+			return 1, nil
+		}
+	}
+	if va.preRelease && !vb.preRelease {
+		return -1, nil
+	} else if !va.preRelease && vb.preRelease {
+		return 1, nil
+	}
+	return 0, nil
+}
@@ -0,0 +1,47 @@
+// Copyright 2017 longXboy, longxboyhi@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"testing"
+)
+
+func Test_CompareVersion(t *testing.T) {
+	cases := []struct {
+		a, b string
+		want int
+	}{
+		{"0.1.2", "0.1.2", 0},
+		{"0.1.2", "0.1.10", -1},
+		{"v1.0", "1.0.0", 0},
+		{"1.0.0-rc1", "1.0.0", -1},
+		{"1.2.0", "1.1.9", 1},
+		{"1.0.0+build5", "1.0.0", 0},
+	}
+	for _, c := range cases {
+		got, err := CompareVersion(c.a, c.b)
+		if err != nil {
+			t.Fatalf("compare %s with %s failed!err:=%v", c.a, c.b, err)
+		}
+		if got != c.want {
+			t.Errorf("compare %s with %s got %d,want %d", c.a, c.b, got, c.want)
+		}
+	}
+	for _, s := range []string{"", "1.x", "1..2"} {
+		if _, err := CompareVersion(s, "1.0"); err == nil {
+			t.Errorf("invalid version %q compared", s)
+		}
+	}
+}
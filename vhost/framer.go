@@ -0,0 +1,226 @@
+// Copyright 2017 longXboy, longxboyhi@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vhost
+
+import (
+	"bufio"
+	"bytes"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+)
+
+// maxFramedLine is the longest chunk size or trailer line followed
+const maxFramedLine = 4096
+
+const (
+	frameHeader = iota
+	frameBody
+	frameChunkSize
+	frameChunkData
+	frameTrailer
+	frameStopped
+)
+
+// HttpFramer follows the http/1.x messages of one direction of a connection proxied as a byte stream,
+// it stops at the first message it can not frame,like an upgrade or a body read until close
+type HttpFramer struct {
+	// OnRequest is called with the method of each request of a request direction
+	OnRequest func(method string)
+	// OnResponse is called with the status of each response of a response direction,
+	// it returns the method of the request answered,which is needed for framing the HEAD ones
+	OnResponse func(status int) (method string)
+
+	state     int
+	buf       []byte
+	remaining int64
+}
+
+// NewRequestFramer returns a framer of the direction carrying requests
+func NewRequestFramer(onRequest func(method string)) *HttpFramer {
+	return &HttpFramer{OnRequest: onRequest}
+}
+
+// NewResponseFramer returns a framer of the direction carrying responses
+func NewResponseFramer(onResponse func(status int) string) *HttpFramer {
+	return &HttpFramer{OnResponse: onResponse}
+}
+
+// Stopped reports whether the framer has given up following the connection
+func (f *HttpFramer) Stopped() bool {
+	return f.state == frameStopped
+}
+
+// Feed follows the bytes p of the connection
+func (f *HttpFramer) Feed(p []byte) {
+	for len(p) > 0 {
+		switch f.state {
+		case frameHeader:
+			from := len(f.buf) - 3
+			if from < 0 {
+				from = 0
+			}
+			f.buf = append(f.buf, p...)
+			idx := bytes.Index(f.buf[from:], []byte("\r\n\r\n"))
+			if idx < 0 {
+				if len(f.buf) > maxRequestHeader {
+					f.stop()
+				}
+				return
+			}
+			end := from + idx + 4
+			// the rest is kept apart from buf which is reused for the next header
+			p = append([]byte(nil), f.buf[end:]...)
+			f.parseHeader(f.buf[:end])
+			f.buf = f.buf[:0]
+		case frameBody, frameChunkData:
+			n := int64(len(p))
+			if n > f.remaining {
+				n = f.remaining
+			}
+			p = p[n:]
+			f.remaining -= n
+			if f.remaining == 0 {
+				if f.state == frameBody {
+					f.state = frameHeader
+				} else {
+					f.state = frameChunkSize
+				}
+			}
+		case frameChunkSize, frameTrailer:
+			idx := bytes.IndexByte(p, '\n')
+			if idx < 0 {
+				f.buf = append(f.buf, p...)
+				if len(f.buf) > maxFramedLine {
+					f.stop()
+				}
+				return
+			}
+			f.buf = append(f.buf, p[:idx+1]...)
+			p = p[idx+1:]
+			line := strings.TrimRight(string(f.buf), "\r\n")
+			f.buf = f.buf[:0]
+			if f.state == frameTrailer {
+				if line == "" {
+					f.state = frameHeader
+				}
+				continue
+			}
+			if semi := strings.IndexByte(line, ';'); semi >= 0 {
+				line = line[:semi]
+			}
+			size, err := strconv.ParseInt(strings.TrimSpace(line), 16, 64)
+			if err != nil || size < 0 {
+				f.stop()
+				return
+			}
+			if size == 0 {
+				f.state = frameTrailer
+			} else {
+				// the data is followed by a crlf
+				f.state = frameChunkData
+				f.remaining = size + 2
+			}
+		case frameStopped:
+			return
+		}
+	}
+}
+
+func (f *HttpFramer) stop() {
+	f.state = frameStopped
+	f.buf = nil
+}
+
+// parseHeader handles the header of a message and sets how its body is framed
+func (f *HttpFramer) parseHeader(raw []byte) {
+	tp := textproto.NewReader(bufio.NewReader(bytes.NewReader(raw)))
+	start, err := tp.ReadLine()
+	if err != nil {
+		f.stop()
+		return
+	}
+	header, err := tp.ReadMIMEHeader()
+	if err != nil {
+		f.stop()
+		return
+	}
+	noBody := false
+	if f.OnResponse != nil {
+		status, ok := parseStatusLine(start)
+		if !ok || status == http.StatusSwitchingProtocols {
+			f.stop()
+			return
+		}
+		if status < 200 {
+			// an interim response,the final one follows
+			f.state = frameHeader
+			return
+		}
+		method := f.OnResponse(status)
+		noBody = method == "HEAD" || status == http.StatusNoContent || status == http.StatusNotModified
+	} else {
+		method, _, _, ok := parseRequestLine(start)
+		if !ok || method == "CONNECT" {
+			f.stop()
+			return
+		}
+		if f.OnRequest != nil {
+			f.OnRequest(method)
+		}
+		if http.Header(header).Get("Upgrade") != "" {
+			// the connection may switch to another protocol
+			f.stop()
+			return
+		}
+	}
+	f.state = frameHeader
+	if noBody {
+		return
+	}
+	if strings.Contains(strings.ToLower(http.Header(header).Get("Transfer-Encoding")), "chunked") {
+		f.state = frameChunkSize
+		return
+	}
+	cl := http.Header(header).Get("Content-Length")
+	if cl == "" {
+		if f.OnResponse != nil {
+			// the body lasts until the connection is closed
+			f.stop()
+		}
+		return
+	}
+	length, err := strconv.ParseInt(strings.TrimSpace(cl), 10, 64)
+	if err != nil || length < 0 {
+		f.stop()
+		return
+	}
+	if length > 0 {
+		f.state = frameBody
+		f.remaining = length
+	}
+}
+
+func parseStatusLine(line string) (int, bool) {
+	if !strings.HasPrefix(line, "HTTP/1.") || len(line) < 12 || line[8] != ' ' {
+		return 0, false
+	}
+	status, err := strconv.Atoi(line[9:12])
+	if err != nil || status < 100 {
+		return 0, false
+	}
+	return status, true
+}
@@ -0,0 +1,95 @@
+// Copyright 2017 longXboy, longxboyhi@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vhost
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRequestFramer(t *testing.T) {
+	stream := "GET / HTTP/1.1\r\nHost: a\r\n\r\n" +
+		"POST /form HTTP/1.1\r\nHost: a\r\nContent-Length: 26\r\n\r\nGET /fake HTTP/1.1\r\n\r\nabcd" +
+		"PUT /chunk HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n5;ext=1\r\nHEAD \r\n0\r\nX-Trailer: 1\r\n\r\n" +
+		"HEAD /last HTTP/1.1\r\nHost: a\r\n\r\n"
+	want := []string{"GET", "POST", "PUT", "HEAD"}
+	for _, step := range []int{len(stream), 1, 7} {
+		var methods []string
+		f := NewRequestFramer(func(method string) { methods = append(methods, method) })
+		for i := 0; i < len(stream); i += step {
+			end := i + step
+			if end > len(stream) {
+				end = len(stream)
+			}
+			f.Feed([]byte(stream[i:end]))
+		}
+		if !reflect.DeepEqual(methods, want) || f.Stopped() {
+			t.Fatalf("feed by %d got %v,want %v", step, methods, want)
+		}
+	}
+}
+
+func TestResponseFramer(t *testing.T) {
+	stream := "HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nhello" +
+		"HTTP/1.1 100 Continue\r\n\r\n" +
+		"HTTP/1.1 404 Not Found\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nHTT\r\n0\r\n\r\n" +
+		"HTTP/1.1 200 OK\r\nContent-Length: 100\r\n\r\n" +
+		"HTTP/1.1 204 No Content\r\n\r\n" +
+		"HTTP/1.1 502 Bad Gateway\r\nContent-Length: 0\r\n\r\n"
+	methods := []string{"GET", "POST", "HEAD", "DELETE", "GET"}
+	want := []int{200, 404, 200, 204, 502}
+	for _, step := range []int{len(stream), 1, 5} {
+		var statuses []int
+		f := NewResponseFramer(func(status int) string {
+			statuses = append(statuses, status)
+			return methods[len(statuses)-1]
+		})
+		for i := 0; i < len(stream); i += step {
+			end := i + step
+			if end > len(stream) {
+				end = len(stream)
+			}
+			f.Feed([]byte(stream[i:end]))
+		}
+		if !reflect.DeepEqual(statuses, want) || f.Stopped() {
+			t.Fatalf("feed by %d got %v,want %v", step, statuses, want)
+		}
+	}
+}
+
+func TestFramerStops(t *testing.T) {
+	cases := []struct {
+		response bool
+		stream   string
+	}{
+		{true, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\n\r\n"},
+		{true, "HTTP/1.0 200 OK\r\n\r\nuntil close"},
+		{true, "garbage\r\n\r\n"},
+		{false, "GET /ws HTTP/1.1\r\nUpgrade: websocket\r\n\r\n"},
+		{false, "CONNECT a:443 HTTP/1.1\r\n\r\n"},
+	}
+	for _, c := range cases {
+		var f *HttpFramer
+		if c.response {
+			f = NewResponseFramer(func(int) string { return "GET" })
+		} else {
+			f = NewRequestFramer(func(string) {})
+		}
+		f.Feed([]byte(c.stream))
+		if !f.Stopped() {
+			t.Fatalf("framer of %q should stop", c.stream)
+		}
+	}
+}
@@ -26,3 +26,76 @@ const badGateWayTemplate string = "HTTP/1.1 502 Bad Gateway\r\nServer: lunnel/%s
 func BadGateWayResp() string {
 	return fmt.Sprintf(badGateWayTemplate, version.Version, time.Now().UTC().Format("Mon, 02 Jan 2006 15:04:05 GMT"))
 }
+
+func httpResp(status string, header string, body string) string {
+	return fmt.Sprintf("HTTP/1.1 %s\r\nServer: lunnel/%s\r\nDate: %s\r\n%sContent-Length: %d\r\n\r\n%s", status, version.Version, time.Now().UTC().Format("Mon, 02 Jan 2006 15:04:05 GMT"), header, len(body), body)
+}
+
+func ForbiddenResp() string {
+	return httpResp("403 Forbidden", "", "Forbidden: remote_addr_not_allowed")
+}
+
+func UnauthorizedResp() string {
+	return httpResp("401 Unauthorized", "WWW-Authenticate: Basic realm=\"lunnel\"\r\n", "Unauthorized: authorization_required")
+}
+
+func InvalidTokenResp() string {
+	return httpResp("403 Forbidden", "", "Forbidden: signed_url_invalid_or_expired")
+}
+
+// RedirectResp redirects to location and stores cookie(the value of Set-Cookie) on browser
+func RedirectResp(location string, cookie string) string {
+	return httpResp("302 Found", fmt.Sprintf("Location: %s\r\nSet-Cookie: %s\r\n", location, cookie), "")
+}
+
+// QuotaExceededResp serves page as html,or a plain text message if page is empty
+func QuotaExceededResp(page string) string {
+	if page == "" {
+		return httpResp("503 Service Unavailable", "", "Service Unavailable: quota_exceeded")
+	}
+	return httpResp("503 Service Unavailable", "Content-Type: text/html; charset=utf-8\r\n", page)
+}
+
+// NotFoundResp serves page as html,or a plain text message if page is empty
+func NotFoundResp(page string) string {
+	if page == "" {
+		return httpResp("404 Not Found", "", "Not Found: path_not_served")
+	}
+	return httpResp("404 Not Found", "Content-Type: text/html; charset=utf-8\r\n", page)
+}
+
+// MaintenanceResp serves page as html,or a plain text message if page is empty
+func MaintenanceResp(page string) string {
+	if page == "" {
+		return httpResp("503 Service Unavailable", "Retry-After: 60\r\n", "Service Unavailable: tunnel_under_maintenance")
+	}
+	return httpResp("503 Service Unavailable", "Retry-After: 60\r\nContent-Type: text/html; charset=utf-8\r\n", page)
+}
+
+// OverloadedResp tells the user to retry later when server refuses the tunnel to keep its resources
+func OverloadedResp() string {
+	return httpResp("503 Service Unavailable", "Retry-After: 30\r\n", "Service Unavailable: server_overloaded")
+}
+
+// TooBusyResp tells the user to retry later when the client is out of streams
+func TooBusyResp() string {
+	return httpResp("503 Service Unavailable", "Retry-After: 5\r\n", "Service Unavailable: too_busy")
+}
+
+func OfflineResp() string {
+	return httpResp("503 Service Unavailable", "", "Service Unavailable: tunnel_offline_by_schedule")
+}
+
+// StatusTokenRequiredResp rejects requests to the status page without a valid token
+func StatusTokenRequiredResp() string {
+	return httpResp("401 Unauthorized", "", "Unauthorized: status_token_required")
+}
+
+// StatusPageResp serves body of the status page with contentType,it is never cached
+func StatusPageResp(contentType string, body string) string {
+	return httpResp("200 OK", fmt.Sprintf("Content-Type: %s\r\nCache-Control: no-store\r\n", contentType), body)
+}
+
+func TooManyRequestsResp() string {
+	return httpResp("429 Too Many Requests", "", "Too Many Requests: rate_limit_exceeded")
+}
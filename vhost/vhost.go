@@ -33,6 +33,9 @@ const (
 	typeClientHello uint8 = 1 // Type client hello
 )
 
+// maxRequestHeader is how much of a request is read for its header at most,as http.DefaultMaxHeaderBytes
+const maxRequestHeader = 1 << 20
+
 // TLS extension numbers
 const (
 	extensionServerName          uint16 = 0
@@ -62,6 +65,10 @@ func newShareConn(conn net.Conn) (*sharedConn, io.Reader) {
 	return sc, io.TeeReader(conn, sc.buff)
 }
 
+func (sc *sharedConn) NetConn() net.Conn {
+	return sc.Conn
+}
+
 func (sc *sharedConn) Read(p []byte) (n int, err error) {
 	sc.Lock()
 	if sc.buff == nil {
@@ -146,7 +153,7 @@ func readHandshake(rd io.Reader) (host string, err error) {
 		return
 	}
 	if len(data) < 2 {
-		err = errors.Errorf("readHandshake: extension dataLen[%d] is too short")
+		err = errors.Errorf("readHandshake: extension dataLen[%d] is too short", len(data))
 		return
 	}
 
@@ -228,26 +235,54 @@ func GetHttpsHostname(c net.Conn) (sc net.Conn, _ map[string]string, err error)
 }
 
 func GetHttpRequestInfo(c net.Conn) (_ net.Conn, _ map[string]string, err error) {
-	reqInfoMap := make(map[string]string, 0)
 	sc, rd := newShareConn(c)
 
-	request, err := http.ReadRequest(bufio.NewReader(rd))
+	// everything read is kept to be replayed,so a visitor can't make it grow without end
+	request, err := http.ReadRequest(bufio.NewReader(io.LimitReader(rd, maxRequestHeader)))
 	if err != nil {
-		return sc, reqInfoMap, err
+		return sc, make(map[string]string, 0), err
 	}
+	reqInfoMap := RequestInfo(request)
+	// the body is left unread,it is replayed from c after the header
+	return sc, reqInfoMap, nil
+}
+
+// RequestInfo returns the fields of request which the routing and the tunnel policy depend on
+func RequestInfo(request *http.Request) map[string]string {
+	reqInfoMap := make(map[string]string, 0)
 	// hostName
 	tmpArr := strings.Split(request.Host, ":")
 	reqInfoMap["Host"] = tmpArr[0]
+	reqInfoMap["Method"] = request.Method
 	reqInfoMap["Path"] = request.URL.Path
 	reqInfoMap["Scheme"] = request.URL.Scheme
+	reqInfoMap["Query"] = request.URL.RawQuery
+
+	// token of signed url,the url without it is kept to redirect browser to after setting the cookie
+	query := request.URL.Query()
+	if token := query.Get(util.SignedURLParam); token != "" {
+		reqInfoMap["Token"] = token
+		query.Del(util.SignedURLParam)
+		u := *request.URL
+		u.RawQuery = query.Encode()
+		reqInfoMap["TokenRedirect"] = u.RequestURI()
+	} else if cookie, err := request.Cookie(util.SignedURLParam); err == nil {
+		reqInfoMap["Token"] = cookie.Value
+	}
+
+	// hops appended by the proxies in front of server,only trusted when sent by them
+	if xff := request.Header["X-Forwarded-For"]; len(xff) > 0 {
+		reqInfoMap["ForwardedFor"] = strings.Join(xff, ",")
+	} else if realIP := request.Header.Get("X-Real-Ip"); realIP != "" {
+		reqInfoMap["ForwardedFor"] = realIP
+	}
 
 	// Authorization
 	authStr := request.Header.Get("Authorization")
 	if authStr != "" {
 		reqInfoMap["Authorization"] = authStr
 	}
-	request.Body.Close()
-	return sc, reqInfoMap, nil
+	return reqInfoMap
 }
 
 func HttpHostNameRewrite(c net.Conn, rewriteHost string) (_ net.Conn, err error) {
@@ -264,8 +299,11 @@ func hostNameRewrite(request io.Reader, rewriteHost string) (_ []byte, err error
 	buf := util.GetBuf(1024)
 	defer util.PutBuf(buf)
 
-	request.Read(buf)
-	retBuffer, err := parseRequest(buf, rewriteHost)
+	n, err := request.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	retBuffer, err := parseRequest(buf[:n], rewriteHost)
 	return retBuffer, err
 }
 
@@ -285,7 +323,10 @@ func parseRequest(org []byte, rewriteHost string) (ret []byte, err error) {
 	if justAuthority {
 		rawurl = "http://" + rawurl
 	}
-	req.URL, _ = url.ParseRequestURI(rawurl)
+	req.URL, err = url.ParseRequestURI(rawurl)
+	if err != nil {
+		return nil, errors.Wrap(err, "parse request uri")
+	}
 	if justAuthority {
 		// Strip the bogus "http://" back off.
 		req.URL.Scheme = ""
@@ -339,24 +380,36 @@ func changeHostName(buff *bytes.Buffer, rewriteHost string) (_ []byte, err error
 		i := bytes.IndexByte(peek, '\n')
 		if i < 3 {
 			// Not present (-1) or found within the next few bytes,
-			// implying we're at the end ("\r\n\r\n" or "\n\n")
-			return nil, err
+			// implying we're at the end ("\r\n\r\n" or "\n\n"),there is no Host to rewrite
+			break
 		}
 		kv := peek[:i]
 		j := bytes.IndexByte(kv, ':')
-		if j < 0 {
-			return nil, fmt.Errorf("malformed MIME header line: " + string(kv))
+		if kv[0] == ' ' || kv[0] == '\t' {
+			// obsolete line folding continues the value of the last header
+			j = 0
+		} else if j < 0 {
+			return nil, fmt.Errorf("malformed MIME header line: %s", string(kv))
 		}
-		if strings.Contains(strings.ToLower(string(kv[:j])), "host") {
+		if j > 0 && strings.EqualFold(strings.TrimSpace(string(kv[:j])), "host") {
 			var hostHeader string
-			portPos := bytes.IndexByte(kv[j+1:], ':')
-			if portPos == -1 {
-				hostHeader = fmt.Sprintf("Host: %s\n", rewriteHost)
+			value := strings.TrimSpace(string(kv[j+1:]))
+			portPos := strings.LastIndexByte(value, ':')
+			if portPos == -1 || strings.HasSuffix(value, "]") {
+				hostHeader = fmt.Sprintf("Host: %s\r\n", rewriteHost)
 			} else {
-				hostHeader = fmt.Sprintf("Host: %s:%s\n", rewriteHost, kv[portPos+1:])
+				hostHeader = fmt.Sprintf("Host: %s:%s\r\n", rewriteHost, value[portPos+1:])
 			}
 			retBuf.WriteString(hostHeader)
 			peek = peek[i+1:]
+			// obsolete line folding continues the value replaced
+			for len(peek) > 0 && (peek[0] == ' ' || peek[0] == '\t') {
+				k := bytes.IndexByte(peek, '\n')
+				if k < 0 {
+					break
+				}
+				peek = peek[k+1:]
+			}
 			break
 		} else {
 			retBuf.Write(peek[:i])
@@ -0,0 +1,104 @@
+// Copyright 2017 longXboy, longxboyhi@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vhost
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// bufConn reads from r,the deadlines are ignored
+type bufConn struct {
+	net.Conn
+	r *bytes.Reader
+}
+
+func (c *bufConn) Read(p []byte) (int, error)      { return c.r.Read(p) }
+func (c *bufConn) SetReadDeadline(time.Time) error { return nil }
+
+// clientHello records the first flight of a tls client to serverName
+func clientHello(t testing.TB, serverName string) []byte {
+	c1, c2 := net.Pipe()
+	go tls.Client(c1, &tls.Config{ServerName: serverName, NextProtos: []string{"h2", "http/1.1"}}).Handshake()
+	defer c1.Close()
+	defer c2.Close()
+	buf := make([]byte, 4096)
+	n, err := c2.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf[:n]
+}
+
+// replayed checks everything read while parsing is read again from the conn returned
+func replayed(t *testing.T, sc net.Conn, data []byte) {
+	got, _ := ioutil.ReadAll(sc)
+	if !bytes.Equal(got, data) {
+		t.Fatalf("replayed %q,want %q", got, data)
+	}
+}
+
+func FuzzGetHttpsHostname(f *testing.F) {
+	f.Add(clientHello(f, "a.example.com"))
+	f.Add([]byte("\x16\x03\x01\x00\x00"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		sc, _, _ := GetHttpsHostname(&bufConn{r: bytes.NewReader(data)})
+		replayed(t, sc, data)
+	})
+}
+
+func FuzzGetHttpRequestInfo(f *testing.F) {
+	f.Add([]byte("GET /index.html?a=1&lunnel_token=x HTTP/1.1\r\nHost: a.example.com\r\nX-Forwarded-For: 1.2.3.4\r\n\r\n"))
+	f.Add([]byte("POST /upload HTTP/1.1\r\nHost: a.example.com:8080\r\nContent-Length: 5\r\n\r\nhello"))
+	f.Add([]byte("CONNECT a.example.com:443 HTTP/1.1\r\n\r\n"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		sc, _, _ := GetHttpRequestInfo(&bufConn{r: bytes.NewReader(data)})
+		replayed(t, sc, data)
+	})
+}
+
+func FuzzHostNameRewrite(f *testing.F) {
+	f.Add([]byte("GET / HTTP/1.1\r\nHost: a.example.com:8080\r\nX-Forwarded-Host: b.example.com\r\n\r\n"))
+	f.Add([]byte("GET http://a.example.com/ HTTP/1.1\r\nHost: a.example.com\r\n\r\n"))
+	f.Add([]byte("GET / HTTP/1.0\r\n\r\n"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		if len(data) > 1024 {
+			// only the first read is rewritten
+			return
+		}
+		req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(data)))
+		if err != nil {
+			return
+		}
+		out, err := hostNameRewrite(bytes.NewReader(data), "b.example.com")
+		if err != nil {
+			// refusing is fine,a rewrite the backend reads differently is not
+			return
+		}
+		rewritten, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(out)))
+		if err != nil {
+			t.Fatalf("rewritten %q of %q can't be read:%v", out, data, err)
+		}
+		if req.Host != "" && rewritten.Host != "b.example.com" && !bytes.HasPrefix([]byte(rewritten.Host), []byte("b.example.com:")) {
+			t.Fatalf("host %q rewritten to %q", req.Host, rewritten.Host)
+		}
+	})
+}
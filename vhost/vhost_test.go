@@ -0,0 +1,52 @@
+// Copyright 2017 longXboy, longxboyhi@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vhost
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestHostNameRewrite(t *testing.T) {
+	cases := []struct {
+		req  string
+		want string
+	}{
+		{"GET / HTTP/1.1\r\nHost: a.example.com:8080\r\n\r\n", "GET / HTTP/1.1\r\nHost: b.example.com:8080\r\n\r\n"},
+		{"GET / HTTP/1.1\r\nX-Forwarded-Host: c.example.com\r\nHost: a.example.com\r\n\r\n", "GET / HTTP/1.1\r\nX-Forwarded-Host: c.example.com\r\nHost: b.example.com\r\n\r\n"},
+		{"GET / HTTP/1.1\r\nAccept: */*\r\n\r\nbody", "GET / HTTP/1.1\r\nAccept: */*\r\n\r\nbody"},
+	}
+	for _, c := range cases {
+		got, err := hostNameRewrite(bytes.NewReader([]byte(c.req)), "b.example.com")
+		if err != nil {
+			t.Fatalf("rewrite %q failed:%v", c.req, err)
+		}
+		if string(got) != c.want {
+			t.Fatalf("rewrite %q got %q,want %q", c.req, got, c.want)
+		}
+	}
+	_, err := hostNameRewrite(bytes.NewReader([]byte("GET %zz HTTP/1.1\r\n\r\n")), "b.example.com")
+	if err == nil {
+		t.Fatal("invalid request uri should be refused")
+	}
+}
+
+func TestRequestHeaderLimit(t *testing.T) {
+	req := "GET / HTTP/1.1\r\nHost: a.example.com\r\nX-Pad: " + string(bytes.Repeat([]byte("a"), maxRequestHeader)) + "\r\n\r\n"
+	_, _, err := GetHttpRequestInfo(&bufConn{r: bytes.NewReader([]byte(req))})
+	if err == nil {
+		t.Fatal("header over the limit should be refused")
+	}
+}